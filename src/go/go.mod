@@ -3,6 +3,11 @@ module github.com/entreya/csvquery
 go 1.24.0
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/pierrec/lz4/v4 v4.1.25
 	golang.org/x/sys v0.40.0
 )
+
+require github.com/klauspost/compress v1.18.0
+
+require gopkg.in/yaml.v3 v3.0.1
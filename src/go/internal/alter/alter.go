@@ -1,158 +1,674 @@
 package alter
 
 import (
+	"bufio"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
 	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+	"github.com/entreya/csvquery/internal/updatemgr"
 )
 
-// AlterConfig configures the alteration
+// AlterConfig configures the alteration: exactly one of AddColumn,
+// DropColumn, RenameColumn and SetDefault.
 type AlterConfig struct {
 	CsvPath      string
 	AddColumn    string
-	DefaultValue string
-	Materialize  bool
-	Separator    string
+	DefaultValue string // Of AddColumn, or the new default of SetDefault
+	Materialize  bool   // Add AddColumn to the CSV rather than to the schema
+	Separator    string // "" or "auto": detected
+
+	DropColumn   string // A virtual column, or one of the CSV (rewritten without it)
+	RenameColumn string // A virtual column, or one of the CSV (its header is rewritten)
+	NewName      string // Of RenameColumn
+	SetDefault   string // Virtual column whose default becomes DefaultValue
+	Expression   string // Computes AddColumn, or SetDefault instead of a default (see schema.Expr)
+
+	// Rewriting the CSV moves its rows, so it invalidates every index in
+	// IndexDir ("" = the CSV's directory). A materialized column moves
+	// them by known amounts: the indexes are translated to the new offsets.
+	// Other rewrites drop them, and with Rebuild build them again: under
+	// their new names after a rename, all but those over a dropped column.
+	IndexDir string
+	Rebuild  bool
+	Workers  int // Of the rebuild (0 = one per CPU)
+	MemoryMB int // Per rebuild worker (0 = 500)
+	Version  string
+	Output   io.Writer // Indexer output
+}
+
+// Result reports what an alteration did besides changing the schema.
+type Result struct {
+	Rewritten  bool     // The CSV was rewritten
+	Dropped    []string // Indexes dropped and not rebuilt
+	Rebuilt    []string // Indexes built again, by their new names
+	Translated []string // Indexes moved to the offsets of the rewritten CSV
 }
 
 // AlterTable handles CSV schema changes
 type AlterTable struct {
 	config AlterConfig
+	schema *schema.Schema
+	sep    byte
+	header []string // Of the CSV; nil when it has none
 }
 
 // NewAlterTable creates a new instance
 func NewAlterTable(config AlterConfig) *AlterTable {
-	if config.Separator == "" {
-		config.Separator = ","
+	if config.IndexDir == "" {
+		config.IndexDir = filepath.Dir(config.CsvPath)
+	}
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.MemoryMB <= 0 {
+		config.MemoryMB = 500
+	}
+	if config.Output == nil {
+		config.Output = io.Discard
 	}
 	return &AlterTable{config: config}
 }
 
-// Run performs the alteration (O(1) Metadata or O(N) Rewrite)
-func (a *AlterTable) Run() error {
+// Run performs the alteration: O(1) on the schema for virtual columns, an
+// O(N) rewrite of the CSV for its own.
+func (a *AlterTable) Run() (Result, error) {
+	ops := 0
+	for _, col := range []string{a.config.AddColumn, a.config.DropColumn, a.config.RenameColumn, a.config.SetDefault} {
+		if col != "" {
+			ops++
+		}
+	}
+	if ops != 1 {
+		return Result{}, fmt.Errorf("alter takes exactly one of add-column, drop-column, rename-column and set-default")
+	}
+
 	s, err := schema.Load(a.config.CsvPath)
 	if err != nil {
-		return fmt.Errorf("failed to load schema: %v", err)
+		return Result{}, fmt.Errorf("failed to load schema: %v", err)
+	}
+	a.schema = s
+	if a.sep, err = common.ResolveSeparator(a.config.Separator, a.config.CsvPath); err != nil {
+		return Result{}, fmt.Errorf("failed to open csv: %v", err)
+	}
+	if a.header, err = a.readHeader(); err != nil {
+		return Result{}, err
+	}
+
+	switch {
+	case a.config.AddColumn != "":
+		return a.add()
+	case a.config.DropColumn != "":
+		return a.drop()
+	case a.config.RenameColumn != "":
+		return a.rename()
 	}
+	return a.setDefault()
+}
 
+// add adds a virtual column, or a column of the CSV holding the default.
+func (a *AlterTable) add() (Result, error) {
+	name := a.config.AddColumn
 	// Check if column already exists (virtual)
-	if _, exists := s.VirtualColumns[a.config.AddColumn]; exists && !a.config.Materialize {
-		return fmt.Errorf("column '%s' already exists (virtual)", a.config.AddColumn)
+	virtual, exists := a.virtual(name)
+	if exists && !a.config.Materialize {
+		return Result{}, fmt.Errorf("column '%s' already exists (virtual)", name)
+	}
+	if a.position(name) >= 0 {
+		return Result{}, fmt.Errorf("column '%s' already exists in physical file", name)
 	}
 
-	// Check physical file
-	inputFile, err := os.Open(a.config.CsvPath)
-	if err != nil {
-		return fmt.Errorf("failed to open csv: %v", err)
+	if a.config.Expression != "" {
+		if a.config.Materialize {
+			return Result{}, fmt.Errorf("a computed column cannot be materialized")
+		}
+		return Result{}, a.compute(name)
 	}
-	// We need to close inputFile later, but for materialization we might read it fully.
-	// Let's handle closing in specific blocks or use a func.
+	if !a.config.Materialize {
+		a.schema.AddVirtualColumn(name, a.config.DefaultValue)
+		return Result{}, a.saveSchema()
+	}
+	if _, ok := a.schema.ComputedColumns[virtual]; ok {
+		return Result{}, fmt.Errorf("column '%s' is computed: it cannot be materialized", name)
+	}
+	if a.header == nil {
+		return Result{}, fmt.Errorf("failed to read header: the CSV is empty")
+	}
+	return a.rewrite(
+		a.appendField(name, a.config.DefaultValue),
+		nil, "",
+		// If this column was virtual, remove it now that it's physical
+		func() {
+			if exists {
+				a.schema.RemoveVirtualColumn(virtual)
+			}
+		},
+	)
+}
 
-	// Check header
-	reader := csv.NewReader(inputFile)
-	reader.Comma = rune(a.config.Separator[0])
-	header, err := reader.Read()
-	_ = inputFile.Close() // Close immediately after checking header
+// drop removes a virtual column, or a column of the CSV with its values.
+func (a *AlterTable) drop() (Result, error) {
+	name := a.config.DropColumn
+	if err := a.checkUnread(name); err != nil {
+		return Result{}, err
+	}
+	if _, ok := a.virtual(name); ok {
+		a.schema.DropColumn(name, -1)
+		if err := a.saveSchema(); err != nil {
+			return Result{}, err
+		}
+		return a.reindexVirtual(name, "", true)
+	}
+	pos := a.position(name)
+	if pos < 0 {
+		return Result{}, fmt.Errorf("column '%s' not found", name)
+	}
+	if len(a.header) == 1 {
+		return Result{}, fmt.Errorf("cannot drop '%s': it is the only column", name)
+	}
+	return a.rewrite(
+		a.reencode(slices.Delete(slices.Clone(a.header), pos, pos+1), func(record []string) []string {
+			if pos < len(record) {
+				record = slices.Delete(record, pos, pos+1)
+			}
+			return record
+		}),
+		nil, a.header[pos],
+		func() { a.schema.DropColumn(a.header[pos], pos) },
+	)
+}
 
-	if err == nil {
-		for _, col := range header {
-			if strings.EqualFold(col, a.config.AddColumn) {
-				return fmt.Errorf("column '%s' already exists in physical file", a.config.AddColumn)
+// rename renames a virtual column, or a column in the header of the CSV.
+func (a *AlterTable) rename() (Result, error) {
+	old, name := a.config.RenameColumn, a.config.NewName
+	if name == "" {
+		return Result{}, fmt.Errorf("rename-column needs the new name (--to)")
+	}
+	if _, ok := a.virtual(name); ok || a.position(name) >= 0 {
+		if !strings.EqualFold(old, name) {
+			return Result{}, fmt.Errorf("column '%s' already exists", name)
+		}
+	}
+	if err := a.checkUnread(old); err != nil {
+		return Result{}, err
+	}
+	if _, ok := a.virtual(old); ok {
+		a.schema.RenameColumn(old, name)
+		if err := a.saveSchema(); err != nil {
+			return Result{}, err
+		}
+		return a.reindexVirtual(old, name, false)
+	}
+	pos := a.position(old)
+	if pos < 0 {
+		return Result{}, fmt.Errorf("column '%s' not found", old)
+	}
+	header := slices.Clone(a.header)
+	header[pos] = name
+	return a.rewrite(
+		a.reencode(header, func(record []string) []string { return record }),
+		map[string]string{strings.ToLower(a.header[pos]): name}, "",
+		func() { a.schema.RenameColumn(a.header[pos], name) },
+	)
+}
+
+// setDefault changes the default of a virtual column, or its expression.
+func (a *AlterTable) setDefault() (Result, error) {
+	name := a.config.SetDefault
+	col, ok := a.virtual(name)
+	if !ok {
+		if a.position(name) >= 0 {
+			return Result{}, fmt.Errorf("column '%s' is in the CSV: only virtual columns have a default", name)
+		}
+		return Result{}, fmt.Errorf("column '%s' not found", name)
+	}
+	if a.config.Expression != "" {
+		if err := a.compute(col); err != nil {
+			return Result{}, err
+		}
+	} else {
+		a.schema.AddVirtualColumn(col, a.config.DefaultValue)
+		if err := a.saveSchema(); err != nil {
+			return Result{}, err
+		}
+	}
+	return a.reindexVirtual(col, "", false)
+}
+
+// reindexVirtual carries the indexes over a virtual column, and over the
+// computed columns that read it, across a change of its schema (saved
+// already): those over the column are dropped with it, the others built
+// again with Rebuild (under to after a rename), else dropped too.
+func (a *AlterTable) reindexVirtual(name, to string, dropped bool) (Result, error) {
+	var res Result
+	store, meta, err := a.indexMeta()
+	if err != nil || meta == nil {
+		return res, err
+	}
+	affected := []string{strings.ToLower(name)}
+	for i := 0; i < len(affected); i++ {
+		for _, col := range a.schema.ReadBy(affected[i]) {
+			if !slices.Contains(affected, strings.ToLower(col)) {
+				affected = append(affected, strings.ToLower(col))
 			}
 		}
 	}
 
-	if a.config.Materialize {
-		return a.materialize(s)
+	var names []string
+	var specs []indexer.IndexSpec
+	for _, index := range slices.Sorted(maps.Keys(meta.Indexes)) {
+		stats := meta.Indexes[index]
+		if !slices.ContainsFunc(stats.Columns, func(col string) bool { return slices.Contains(affected, strings.ToLower(col)) }) {
+			continue
+		}
+		names = append(names, index)
+		columns := slices.Clone(stats.Columns)
+		for i, col := range columns {
+			if to != "" && strings.EqualFold(col, name) {
+				columns[i] = to
+			}
+		}
+		if !a.config.Rebuild || dropped && slices.ContainsFunc(columns, func(col string) bool { return strings.EqualFold(col, name) }) {
+			res.Dropped = append(res.Dropped, index)
+			continue
+		}
+		specs = append(specs, indexer.IndexSpec{Columns: columns, Collation: stats.Collation})
 	}
+	if len(names) == 0 {
+		return res, nil
+	}
+	if err := indexer.DropIndexes(store, a.config.CsvPath, names, false); err != nil {
+		return res, fmt.Errorf("failed to drop indexes: %w", err)
+	}
+	if len(specs) == 0 {
+		return res, nil
+	}
+	return res, a.rebuild(specs, meta.RowStore != "", &res) // A build without it would unlist the row store
+}
 
-	// Virtual Mode
-	s.AddVirtualColumn(a.config.AddColumn, a.config.DefaultValue)
-	if err := s.Save(); err != nil {
-		return fmt.Errorf("failed to save schema: %v", err)
+// compute makes name a column computed by the configured expression, after
+// checking the columns it reads exist and are not computed from it.
+func (a *AlterTable) compute(name string) error {
+	if err := a.schema.AddComputedColumn(name, a.config.Expression); err != nil {
+		return err
+	}
+	m := make(map[string]int)
+	for i, col := range a.header {
+		m[strings.ToLower(strings.TrimSpace(col))] = i
+	}
+	for _, cols := range []map[string]string{a.schema.VirtualColumns, a.schema.ComputedColumns} {
+		for col := range cols {
+			if _, ok := m[strings.ToLower(col)]; !ok {
+				m[strings.ToLower(col)] = len(m)
+			}
+		}
 	}
+	if err := a.schema.AddAliases(m, len(a.header)); err != nil {
+		return err
+	}
+	if _, err := a.schema.Computed(m, len(a.header)); err != nil {
+		return err
+	}
+	return a.saveSchema()
+}
 
+// checkUnread fails if a computed column other than name reads it.
+func (a *AlterTable) checkUnread(name string) error {
+	readers := slices.DeleteFunc(a.schema.ReadBy(name), func(col string) bool { return strings.EqualFold(col, name) })
+	if len(readers) > 0 {
+		return fmt.Errorf("column '%s' is read by computed column(s) %s", name, strings.Join(readers, ", "))
+	}
 	return nil
 }
 
-// materialize rewrites the CSV file to include the new column
-func (a *AlterTable) materialize(s *schema.Schema) error {
-	// 1. Open Input
-	inputFile, err := os.Open(a.config.CsvPath)
+// rewrite replaces the CSV with what write writes to a temporary file,
+// calls update to change the schema to match, and carries the indexes
+// over: by the offset translation write returns, if any (see
+// indexer.TranslateIndexes), else by dropping (or rebuilding) them, their
+// columns renamed by renamed (lowercase old name -> new name), those over
+// dropped not rebuilt.
+func (a *AlterTable) rewrite(write func(w io.Writer) (func(int64) int64, error), renamed map[string]string, dropped string, update func()) (Result, error) {
+	// Pending updates are keyed by row offset, which the rewrite moves
+	um, err := updatemgr.Load(a.config.CsvPath)
 	if err != nil {
-		return err
+		return Result{}, fmt.Errorf("failed to load updates: %v", err)
+	}
+	if len(um.Overrides) > 0 || len(um.Deleted) > 0 {
+		return Result{}, fmt.Errorf("the CSV has pending updates; they would no longer match its rows after the rewrite")
+	}
+	store, meta, err := a.indexMeta()
+	if err != nil {
+		return Result{}, err
 	}
-	defer func() { _ = inputFile.Close() }()
-
-	reader := csv.NewReader(inputFile)
-	reader.Comma = rune(a.config.Separator[0])
 
-	// 2. Open Output (Temp)
+	// 1. Write the new file (Temp)
 	tempPath := a.config.CsvPath + ".tmp"
 	outputFile, err := os.Create(tempPath)
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+	defer func() {
+		_ = outputFile.Close()
+		_ = os.Remove(tempPath) // Gone after the rename
+	}()
+	buf := bufio.NewWriterSize(outputFile, 1<<20)
+	translate, err := write(buf)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := buf.Flush(); err != nil {
+		return Result{}, err
+	}
+	if err := outputFile.Close(); err != nil {
+		return Result{}, err
 	}
-	defer func() { _ = outputFile.Close() }()
 
-	writer := csv.NewWriter(outputFile)
-	writer.Comma = rune(a.config.Separator[0])
+	// 2. Translate the indexes, published as the new file replaces the CSV
+	res := Result{Rewritten: true}
+	moved := false
+	if meta != nil && translate != nil {
+		names, err := indexer.TranslateIndexes(a.config.CsvPath, tempPath, a.config.IndexDir, translate, func(save func() error) error {
+			if err := os.Rename(tempPath, a.config.CsvPath); err != nil {
+				return fmt.Errorf("failed to replace csv file: %v", err)
+			}
+			moved = true
+			return save()
+		})
+		if err == nil {
+			res.Translated = names
+			update()
+			return res, a.saveSchema()
+		}
+		fmt.Fprintf(a.config.Output, "Indexes not translated (%v): dropping them\n", err)
+	}
 
-	// 3. Process Header
-	header, err := reader.Read()
-	if err != nil {
-		return fmt.Errorf("failed to read header: %v", err)
+	// 3. Else drop the indexes before they point into the new file
+	var specs []indexer.IndexSpec
+	rowStore := false
+	if meta != nil {
+		if specs, rowStore, err = a.dropIndexes(store, meta, renamed, dropped, &res); err != nil {
+			return res, err
+		}
 	}
-	newHeader := append(header, a.config.AddColumn)
-	if err := writer.Write(newHeader); err != nil {
-		return err
+
+	// 4. Atomic Rename
+	if !moved {
+		if err := os.Rename(tempPath, a.config.CsvPath); err != nil {
+			return res, fmt.Errorf("failed to replace csv file: %v", err)
+		}
+	}
+	update()
+	if err := a.saveSchema(); err != nil {
+		return res, err
 	}
 
-	// 4. Process Rows
-	// Note: We don't support LazyQuotes/FieldsPerRecord checks here for simplicity,
-	// but standard encoding/csv handles robust parsing.
-	defaultValue := a.config.DefaultValue
+	if len(specs) == 0 && !rowStore {
+		return res, nil
+	}
+	return res, a.rebuild(specs, rowStore, &res)
+}
 
-	for {
-		record, err := reader.Read()
+// reencode writes the CSV again record by record: header, then each record
+// passed through row.
+func (a *AlterTable) reencode(header []string, row func([]string) []string) func(io.Writer) (func(int64) int64, error) {
+	return func(w io.Writer) (func(int64) int64, error) {
+		inputFile, err := os.Open(a.config.CsvPath)
 		if err != nil {
-			if err.Error() == "EOF" {
+			return nil, err
+		}
+		defer func() { _ = inputFile.Close() }()
+
+		reader := csv.NewReader(inputFile)
+		reader.Comma = rune(a.sep)
+		reader.FieldsPerRecord = -1
+		writer := csv.NewWriter(w)
+		writer.Comma = rune(a.sep)
+
+		if _, err := reader.Read(); err != nil {
+			return nil, fmt.Errorf("failed to read header: %v", err)
+		}
+		if err := writer.Write(header); err != nil {
+			return nil, err
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
 				break
 			}
-			return err
+			if err != nil {
+				return nil, err
+			}
+			if err := writer.Write(row(record)); err != nil {
+				return nil, err
+			}
 		}
+		writer.Flush()
+		return nil, writer.Error()
+	}
+}
 
-		newRecord := append(record, defaultValue)
-		if err := writer.Write(newRecord); err != nil {
-			return err
+// appendField writes the CSV with a field appended to every record: name
+// to the header, value to the rows. The bytes of the records are copied as
+// they are, quoting and line endings included, so each row moves by the
+// bytes added before it, which the returned function maps offsets by.
+// Empty lines stay empty.
+func (a *AlterTable) appendField(name, value string) func(io.Writer) (func(int64) int64, error) {
+	return func(w io.Writer) (func(int64) int64, error) {
+		inputFile, err := os.Open(a.config.CsvPath)
+		if err != nil {
+			return nil, err
 		}
+		defer func() { _ = inputFile.Close() }()
+		data, err := common.MmapFile(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = common.MunmapFile(data) }()
+
+		headerField, field := a.field(name), a.field(value)
+		var starts []int64 // Of the rows, in order
+		header := true
+		var rs common.RecordScanner
+		for pos := 0; pos < len(data) && err == nil; {
+			// Bitmaps of a chunk at a time
+			end := len(data)
+			if pos+appendChunk < len(data) {
+				end = common.RecordBoundary(data, pos+appendChunk)
+			}
+			chunk := data[pos:end]
+			rs.Reset(chunk, a.sep)
+			rs.Records(func(start, end, next int) bool {
+				content := end
+				if content > start && chunk[content-1] == '\r' {
+					content--
+				}
+				if content == start {
+					_, err = w.Write(chunk[start:next])
+					return err == nil
+				}
+				if _, err = w.Write(chunk[start:content]); err != nil {
+					return false
+				}
+				if header {
+					_, err = io.WriteString(w, headerField)
+					header = false
+				} else {
+					starts = append(starts, int64(pos+start))
+					_, err = io.WriteString(w, field)
+				}
+				if err == nil {
+					_, err = w.Write(chunk[content:next])
+				}
+				return err == nil
+			})
+			pos = end
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return func(offset int64) int64 {
+			i, _ := slices.BinarySearch(starts, offset)
+			return offset + int64(len(headerField)) + int64(i*len(field))
+		}, nil
 	}
+}
+
+// appendChunk is the CSV appendField scans at a time.
+const appendChunk = 64 << 20
 
+// field returns value as a field appended to a record: the separator,
+// then value quoted as the CSV writer would.
+func (a *AlterTable) field(value string) string {
+	var buf strings.Builder
+	writer := csv.NewWriter(&buf)
+	writer.Comma = rune(a.sep)
+	_ = writer.Write([]string{"", value}) // Never fails on a strings.Builder
 	writer.Flush()
-	if err := writer.Error(); err != nil {
-		return err
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// indexMeta reads the index metadata of the CSV: nil when it has none.
+func (a *AlterTable) indexMeta() (storage.Backend, *common.IndexMeta, error) {
+	store, err := storage.Open(a.config.IndexDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	csvName := strings.TrimSuffix(filepath.Base(a.config.CsvPath), filepath.Ext(a.config.CsvPath))
+	data, err := storage.ReadFile(store, csvName+"_meta.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil, nil // Nothing indexed
+	}
+	if err != nil {
+		return nil, nil, err
 	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, nil, fmt.Errorf("invalid index metadata: %w", err)
+	}
+	return store, &meta, nil
+}
 
-	// Explicit close to ensure flush
-	_ = outputFile.Close()
-	_ = inputFile.Close()
+// dropIndexes drops every index of meta and the row store. With Rebuild,
+// it returns the specs to build again (see rewrite) and whether there was
+// a row store; the rest are listed in res.Dropped.
+func (a *AlterTable) dropIndexes(store storage.Backend, meta *common.IndexMeta, renamed map[string]string, dropped string, res *Result) ([]indexer.IndexSpec, bool, error) {
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var specs []indexer.IndexSpec
+	for _, name := range names {
+		stats := meta.Indexes[name]
+		columns := make([]string, len(stats.Columns))
+		for i, col := range stats.Columns {
+			columns[i] = col
+			if to, ok := renamed[strings.ToLower(col)]; ok {
+				columns[i] = to
+			}
+		}
+		keep := a.config.Rebuild && len(columns) > 0 && !slices.ContainsFunc(columns, func(col string) bool {
+			return strings.EqualFold(col, dropped)
+		})
+		if !keep {
+			res.Dropped = append(res.Dropped, name)
+			continue
+		}
+		specs = append(specs, indexer.IndexSpec{Columns: columns, Collation: stats.Collation})
+	}
+	if err := indexer.DropIndexes(store, a.config.CsvPath, names, true); err != nil {
+		return nil, false, fmt.Errorf("failed to drop indexes: %w", err)
+	}
+	return specs, a.config.Rebuild && meta.RowStore != "", nil
+}
 
-	// 5. Atomic Rename
-	if err := os.Rename(tempPath, a.config.CsvPath); err != nil {
-		return fmt.Errorf("failed to replace csv file: %v", err)
+// rebuild builds the specs (and the row store) on the rewritten CSV.
+func (a *AlterTable) rebuild(specs []indexer.IndexSpec, rowStore bool, res *Result) error {
+	entries := make([]any, len(specs))
+	for i, spec := range specs {
+		entries[i] = spec.Columns
+		if spec.Collation != "" {
+			entries[i] = map[string]any{"col": spec.Columns, spec.Collation: true}
+		}
+		res.Rebuilt = append(res.Rebuilt, indexer.IndexName(spec.Columns))
+	}
+	columns, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = indexer.NewIndexer(indexer.IndexerConfig{
+		InputFile:   a.config.CsvPath,
+		OutputDir:   a.config.IndexDir,
+		Columns:     string(columns),
+		Separator:   string(rune(a.sep)),
+		Workers:     a.config.Workers,
+		MemoryMB:    a.config.MemoryMB,
+		BloomFPRate: 0.01,
+		Version:     a.config.Version,
+		RowStore:    rowStore,
+		Output:      a.config.Output,
+	}).Run()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild indexes: %w", err)
 	}
+	return nil
+}
 
-	// 6. Cleanup Virtual Schema if needed
-	// If this column was virtual, remove it now that it's physical
-	if _, ok := s.VirtualColumns[a.config.AddColumn]; ok {
-		s.RemoveVirtualColumn(a.config.AddColumn)
-		if err := s.Save(); err != nil {
-			return fmt.Errorf("failed to update schema after materialization: %v", err)
+// readHeader reads the header of the CSV: nil for an empty file.
+func (a *AlterTable) readHeader() ([]string, error) {
+	inputFile, err := os.Open(a.config.CsvPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open csv: %v", err)
+	}
+	defer func() { _ = inputFile.Close() }()
+	reader := csv.NewReader(inputFile)
+	reader.Comma = rune(a.sep)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	return header, nil
+}
+
+// position returns the position of a column in the header
+// (case-insensitive), or -1.
+func (a *AlterTable) position(name string) int {
+	return slices.IndexFunc(a.header, func(col string) bool { return strings.EqualFold(col, name) })
+}
+
+// virtual returns the name a virtual column, maybe computed, is declared
+// under (case-insensitive).
+func (a *AlterTable) virtual(name string) (string, bool) {
+	for _, cols := range []map[string]string{a.schema.VirtualColumns, a.schema.ComputedColumns} {
+		for col := range cols {
+			if strings.EqualFold(col, name) {
+				return col, true
+			}
 		}
 	}
+	return "", false
+}
 
+func (a *AlterTable) saveSchema() error {
+	if err := a.schema.Save(); err != nil {
+		return fmt.Errorf("failed to save schema: %v", err)
+	}
 	return nil
 }
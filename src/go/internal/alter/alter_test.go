@@ -0,0 +1,180 @@
+package alter
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/schema"
+)
+
+func TestAlterRewritesAndRebuilds(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "t.csv")
+	if err := os.WriteFile(csvPath, []byte("id,name,city\n1,ann,Paris\n2,bob,Rome\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := indexer.NewIndexer(indexer.IndexerConfig{
+		InputFile: csvPath, OutputDir: dir, Columns: `["id",["city","name"]]`,
+		Workers: 1, MemoryMB: 16, BloomFPRate: 0.01, Output: io.Discard,
+	}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := schema.Load(csvPath)
+	s.Aliases = map[string]string{"n": "name", "c": "#3"}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	indexes := func() []string {
+		data, err := os.ReadFile(filepath.Join(dir, "t_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta common.IndexMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for name := range meta.Indexes {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	res, err := NewAlterTable(AlterConfig{CsvPath: csvPath, RenameColumn: "NAME", NewName: "who", Rebuild: true}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Rewritten || !reflect.DeepEqual(res.Rebuilt, []string{"city_who", "id"}) {
+		t.Errorf("Rename: %+v", res)
+	}
+	if got := indexes(); !reflect.DeepEqual(got, []string{"city_who", "id"}) {
+		t.Errorf("Indexes %v after the rename", got)
+	}
+
+	res, err = NewAlterTable(AlterConfig{CsvPath: csvPath, DropColumn: "who", Rebuild: true}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Dropped, []string{"city_who"}) || !reflect.DeepEqual(res.Rebuilt, []string{"id"}) {
+		t.Errorf("Drop: %+v", res)
+	}
+	if got := indexes(); !reflect.DeepEqual(got, []string{"id"}) {
+		t.Errorf("Indexes %v after the drop", got)
+	}
+	if data, _ := os.ReadFile(csvPath); string(data) != "id,city\n1,Paris\n2,Rome\n" {
+		t.Errorf("CSV after the drop:\n%s", data)
+	}
+	s, _ = schema.Load(csvPath)
+	if want := map[string]string{"c": "#2"}; !reflect.DeepEqual(s.Aliases, want) {
+		t.Errorf("Aliases %v, want %v", s.Aliases, want)
+	}
+
+	// Virtual columns only change the schema
+	for _, cfg := range []AlterConfig{
+		{AddColumn: "v", DefaultValue: "x"},
+		{SetDefault: "V", DefaultValue: "y"},
+		{RenameColumn: "v", NewName: "w"},
+		{AddColumn: "twice", Expression: "id * 2"},
+	} {
+		cfg.CsvPath = csvPath
+		if res, err := NewAlterTable(cfg).Run(); err != nil || res.Rewritten {
+			t.Fatalf("%+v: %+v, %v", cfg, res, err)
+		}
+	}
+	s, _ = schema.Load(csvPath)
+	if want := map[string]string{"w": "y"}; !reflect.DeepEqual(s.VirtualColumns, want) {
+		t.Errorf("Virtual columns %v, want %v", s.VirtualColumns, want)
+	}
+	if want := map[string]string{"twice": "id * 2"}; !reflect.DeepEqual(s.ComputedColumns, want) {
+		t.Errorf("Computed columns %v, want %v", s.ComputedColumns, want)
+	}
+
+	for _, cfg := range []AlterConfig{
+		{SetDefault: "id"},
+		{DropColumn: "nope"},
+		{RenameColumn: "id", NewName: "city"},
+		{AddColumn: "a", DropColumn: "id"},
+		{DropColumn: "id"}, // Read by twice
+		{AddColumn: "a", Expression: "nope * 2"},
+		{AddColumn: "a", Expression: "id *"},
+		{AddColumn: "a", Expression: "id", Materialize: true},
+	} {
+		cfg.CsvPath = csvPath
+		if _, err := NewAlterTable(cfg).Run(); err == nil {
+			t.Errorf("Ran %+v", cfg)
+		}
+	}
+}
+
+func TestMaterializeTranslatesIndexes(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "t.csv")
+	data := "id,name\r\n1,\"a\nb\"\r\n\r\n2,bob\r\n3,cid"
+	if err := os.WriteFile(csvPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func(outputDir string) {
+		err := indexer.NewIndexer(indexer.IndexerConfig{
+			InputFile: csvPath, OutputDir: outputDir, Columns: `["id","name"]`, ZoneColumn: "id",
+			Workers: 1, MemoryMB: 16, BloomFPRate: 0.01, Output: io.Discard,
+		}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	build(dir)
+
+	res, err := NewAlterTable(AlterConfig{CsvPath: csvPath, AddColumn: "note", DefaultValue: "x,y", Materialize: true, Rebuild: true}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Translated, []string{"id", "name"}) || res.Rebuilt != nil || res.Dropped != nil {
+		t.Errorf("Materialize: %+v", res)
+	}
+	want := "id,name,note\r\n1,\"a\nb\",\"x,y\"\r\n\r\n2,bob,\"x,y\"\r\n3,cid,\"x,y\""
+	if got, _ := os.ReadFile(csvPath); string(got) != want {
+		t.Errorf("CSV %q, want %q", got, want)
+	}
+
+	// The translated indexes hold what a build of the new CSV does
+	fresh := filepath.Join(dir, "fresh")
+	build(fresh)
+	records := func(dir, name string) []common.IndexRecord {
+		data, err := os.ReadFile(filepath.Join(dir, "t_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta common.IndexMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		br, err := common.NewBlockReaderMmap(filepath.Join(dir, meta.Indexes[name].File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer br.Cleanup()
+		var recs []common.IndexRecord
+		for _, block := range br.Footer.Blocks.All() {
+			got, err := br.ReadBlock(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, got...)
+		}
+		return recs
+	}
+	for _, name := range []string{"id", "name"} {
+		if got, want := records(dir, name), records(fresh, name); !reflect.DeepEqual(got, want) {
+			t.Errorf("Index %s: %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+// BlockCache keeps decoded index blocks in memory, least recently used
+// first out once they take more than its budget. A BlockReader given one
+// (SetCache) serves repeated reads of a block from it instead of reading and
+// decompressing the block again. Blocks are keyed by the identity of their
+// index file (path, size and, for local files, modification time) and their
+// offset, so a rebuilt index never reads the blocks of the one it replaced.
+// Safe for concurrent use.
+type BlockCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // Of *cachedBlock, most recently used first
+	entries map[blockKey]*list.Element
+	hits    int64
+	misses  int64
+}
+
+// blockKey identifies a block: index file, then where in it (or in its
+// cold file or a part file) the block is.
+type blockKey struct {
+	index  string
+	cold   bool
+	part   int
+	offset int64
+}
+
+type cachedBlock struct {
+	key     blockKey
+	records []IndexRecord
+}
+
+// BlockCacheStats describes the use of a BlockCache.
+type BlockCacheStats struct {
+	Blocks int   `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+	Max    int64 `json:"maxBytes"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// NewBlockCache returns a cache holding up to maxBytes of decoded blocks,
+// or nil (no cache) when maxBytes is not positive.
+func NewBlockCache(maxBytes int64) *BlockCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &BlockCache{max: maxBytes, lru: list.New(), entries: make(map[blockKey]*list.Element)}
+}
+
+// blockBytes is the memory a cached block takes.
+func blockBytes(records []IndexRecord) int64 {
+	return int64(cap(records))*int64(unsafe.Sizeof(IndexRecord{})) + 128 // Map and list entries
+}
+
+// get returns the records of a cached block.
+func (c *BlockCache) get(key blockKey) ([]IndexRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cachedBlock).records, true
+}
+
+// put caches the records of a block. They must not change afterwards.
+// Blocks larger than an eighth of the budget are not cached, so one scan of
+// big blocks cannot flush everything else.
+func (c *BlockCache) put(key blockKey, records []IndexRecord) {
+	n := blockBytes(records)
+	if n > c.max/8 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return // Cached by a concurrent reader meanwhile
+	}
+	c.entries[key] = c.lru.PushFront(&cachedBlock{key: key, records: records})
+	c.size += n
+	for c.size > c.max {
+		last := c.lru.Back()
+		old := c.lru.Remove(last).(*cachedBlock)
+		delete(c.entries, old.key)
+		c.size -= blockBytes(old.records)
+	}
+}
+
+// Stats returns the current use of the cache. A nil cache has none.
+func (c *BlockCache) Stats() BlockCacheStats {
+	if c == nil {
+		return BlockCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return BlockCacheStats{Blocks: len(c.entries), Bytes: c.size, Max: c.max, Hits: c.hits, Misses: c.misses}
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestIndex writes an index of n records with keys prefix00000... to path.
+func writeTestIndex(t *testing.T, path, prefix string, n int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := NewBlockWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		var rec IndexRecord
+		PutKey(&rec.Key, []byte(fmt.Sprintf("%s%05d", prefix, i)))
+		rec.Offset, rec.Line = int64(i*10), int64(i+2)
+		if err := bw.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.cidx")
+	writeTestIndex(t, path, "a", 5000)
+
+	plain, err := NewBlockReaderMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Cleanup()
+	if plain.Footer.Blocks.Len() < 4 {
+		t.Fatalf("%d blocks", plain.Footer.Blocks.Len())
+	}
+	first, err := plain.ReadBlock(plain.Footer.Blocks.At(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]IndexRecord(nil), first...)
+
+	cache := NewBlockCache(1 << 20)
+	br, err := NewBlockReaderMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Cleanup()
+	br.SetCache(cache)
+	for range 3 {
+		got, err := br.ReadBlock(br.Footer.Blocks.At(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("Cached block differs")
+		}
+		// Reading another block must not overwrite the cached one
+		if _, err := br.ReadBlock(br.Footer.Blocks.At(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := cache.Stats(); st.Hits != 4 || st.Misses != 2 || st.Blocks != 2 {
+		t.Errorf("Stats %+v after reading 2 blocks 3 times", st)
+	}
+
+	// A rebuilt index at the same path is not served the old blocks
+	writeTestIndex(t, path, "b", 6000)
+	rebuilt, err := NewBlockReaderMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.Cleanup()
+	rebuilt.SetCache(cache)
+	got, err := rebuilt.ReadBlock(rebuilt.Footer.Blocks.At(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if KeyString(&got[0].Key) != "b00000" {
+		t.Errorf("Rebuilt index starts with %q", KeyString(&got[0].Key))
+	}
+
+	// The budget holds
+	small := NewBlockCache(8 * blockBytes(want))
+	rebuilt.SetCache(small)
+	for _, meta := range rebuilt.Footer.Blocks.All() {
+		if _, err := rebuilt.ReadBlock(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := small.Stats(); st.Bytes > st.Max || st.Blocks == 0 {
+		t.Errorf("Stats %+v", st)
+	}
+	if NewBlockCache(0) != nil {
+		t.Error("Cache without a budget")
+	}
+}
+
+func TestReadBlockPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.cidx")
+	for _, codecName := range []string{CodecLZ4, CodecZstd, CodecNone} {
+		codec, err := NewCodec(codecName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw, err := NewBlockWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw.SetCodec(codec)
+		for i := range 3000 {
+			var rec IndexRecord
+			PutKey(&rec.Key, []byte(fmt.Sprintf("k%05d", i)))
+			rec.Offset, rec.Line = int64(i*10), int64(i+2)
+			if err := bw.WriteRecord(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+
+		br, err := NewBlockReaderMmap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := br.Footer.Blocks.At(1)
+		whole, err := br.ReadBlock(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]IndexRecord(nil), whole...)
+		for _, n := range []int{0, 1, 7, len(want) - 1, len(want), len(want) + 5} {
+			got, err := br.ReadBlockPrefix(meta, n)
+			if err != nil {
+				t.Fatalf("%s: %d records: %v", codecName, n, err)
+			}
+			if !reflect.DeepEqual(got, want[:min(n, len(want))]) && !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %d records: got %d, not the block's first", codecName, n, len(got))
+			}
+			if len(got) < min(n, len(want)) {
+				t.Errorf("%s: %d records: got only %d", codecName, n, len(got))
+			}
+		}
+		br.Cleanup()
+	}
+}
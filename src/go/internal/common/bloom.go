@@ -19,6 +19,8 @@ import (
 	"hash/crc32"
 	"math"
 	"os"
+
+	"github.com/entreya/csvquery/internal/storage"
 )
 
 // BloomFilter implements a space-efficient probabilistic set
@@ -225,3 +227,20 @@ func LoadBloomFilterMmap(path string) (*BloomFilter, func(), error) {
 
 	return bloom, cleanup, nil
 }
+
+// OpenBloomFilter loads a bloom filter stored in a storage backend, mapping
+// local files like LoadBloomFilterMmap. The cleanup func is never nil.
+func OpenBloomFilter(store storage.Backend, name string) (*BloomFilter, func(), error) {
+	if path, ok := storage.LocalPath(store, name); ok {
+		return LoadBloomFilterMmap(path)
+	}
+	data, err := storage.ReadFile(store, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	bloom := DeserializeBloom(data)
+	if bloom == nil {
+		return nil, nil, fmt.Errorf("invalid bloom filter data")
+	}
+	return bloom, func() {}, nil
+}
@@ -4,20 +4,41 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"unicode/utf8"
 
-	"github.com/pierrec/lz4/v4"
+	"github.com/entreya/csvquery/internal/storage"
 )
 
 const (
-	// MagicCIDX is the magic header for the compressed index file
+	// MagicCIDX2 is the magic header of index files with a binary footer
+	// (see footer.go)
+	MagicCIDX2 = "CID2"
+	// MagicCIDX is the magic header of index files with a JSON footer,
+	// written before MagicCIDX2
 	MagicCIDX = "CIDX"
+	// MagicCold is the magic header of the cold block file of a tiered index
+	MagicCold = "CIDC"
+	// MagicPart is the magic header of a part file of a partitioned index
+	MagicPart = "CIDP"
 	// BlockTargetSize is the target size for uncompressed blocks (64KB)
 	BlockTargetSize = 64 * 1024
 )
 
+// ErrCorruptBlock is returned by ReadBlock when a block fails verification.
+var ErrCorruptBlock = errors.New("corrupt index block")
+
+// crcTable is the Castagnoli polynomial, hardware-accelerated on amd64/arm64
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // BlockMeta holds metadata for a single compressed block
 type BlockMeta struct {
 	StartKey    string `json:"startKey"`    // The first key in the block
@@ -25,13 +46,88 @@ type BlockMeta struct {
 	Length      int64  `json:"length"`      // Length of the compressed block in bytes
 	RecordCount int64  `json:"recordCount"` // Number of records in this block (for fast COUNT)
 	IsDistinct  bool   `json:"isDistinct"`  // Optimized: true if block contains only 1 unique key
+
+	// Zone map (see SparseIndex.ZoneMaps)
+	EndKey   string   `json:"endKey,omitempty"`   // The last (largest) key in the block
+	MinValue *float64 `json:"minValue,omitempty"` // Numeric min of the zone column; nil unless every value is numeric
+	MaxValue *float64 `json:"maxValue,omitempty"` // Numeric max of the zone column
+
+	Checksum uint32 `json:"crc32c,omitempty"` // CRC-32C of the compressed bytes (see SparseIndex.Checksums)
+
+	Cold bool `json:"cold,omitempty"` // Block is in SparseIndex.ColdFile; Offset is within that file
+	Part int  `json:"part,omitempty"` // Block is in SparseIndex.Parts[Part-1] (0 = in the .cidx)
+}
+
+// blockMetaJSON is BlockMeta without its JSON methods.
+type blockMetaJSON BlockMeta
+
+// blockMetaWire carries keys JSON strings cannot hold: encoding/json
+// replaces invalid UTF-8 with U+FFFD, which would break the block search.
+// Such keys are written as base64 bytes instead, leaving the string empty.
+type blockMetaWire struct {
+	blockMetaJSON
+	StartKeyBin []byte `json:"startKeyBin,omitempty"`
+	EndKeyBin   []byte `json:"endKeyBin,omitempty"`
+}
+
+func (m BlockMeta) MarshalJSON() ([]byte, error) {
+	w := blockMetaWire{blockMetaJSON: blockMetaJSON(m)}
+	if !utf8.ValidString(m.StartKey) {
+		w.StartKeyBin, w.StartKey = []byte(m.StartKey), ""
+	}
+	if !utf8.ValidString(m.EndKey) {
+		w.EndKeyBin, w.EndKey = []byte(m.EndKey), ""
+	}
+	return json.Marshal(w)
+}
+
+func (m *BlockMeta) UnmarshalJSON(data []byte) error {
+	var w blockMetaWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*m = BlockMeta(w.blockMetaJSON)
+	if w.StartKeyBin != nil {
+		m.StartKey = string(w.StartKeyBin)
+	}
+	if w.EndKeyBin != nil {
+		m.EndKey = string(w.EndKeyBin)
+	}
+	return nil
 }
 
 // SparseIndex represents the footer of the .cidx file
 type SparseIndex struct {
-	Blocks []BlockMeta `json:"blocks"`
+	Blocks BlockList `json:"blocks"`
+
+	// ZoneMaps is set when blocks carry EndKey (older indexes only have StartKey).
+	// ZoneColumn names the column MinValue/MaxValue describe ("" = none).
+	ZoneMaps   bool   `json:"zoneMaps,omitempty"`
+	ZoneColumn string `json:"zoneColumn,omitempty"`
+
+	// Checksums is set when every block carries a Checksum; ReadBlock then
+	// verifies it. Older indexes are read unverified.
+	Checksums bool `json:"checksums,omitempty"`
+
+	// Codec compresses the blocks (see codec.go; "" = lz4)
+	Codec string `json:"codec,omitempty"`
+
+	// A tiered index keeps its footer and hot blocks in the .cidx and the
+	// blocks marked Cold in ColdFile of the ColdStore location (a directory
+	// or s3:// URL, see storage.Open) on slower storage.
+	ColdStore string `json:"coldStore,omitempty"`
+	ColdFile  string `json:"coldFile,omitempty"`
+
+	// A partitioned index keeps only its footer in the .cidx and the blocks
+	// in part files next to it, each holding a contiguous key range with
+	// every record of a key in one part. A lookup reads the parts whose
+	// blocks its key range overlaps, nothing else.
+	Parts []string `json:"parts,omitempty"`
 }
 
+// ZoneFunc returns the zone column value of the row a record points at.
+type ZoneFunc func(rec *IndexRecord) string
+
 // BlockWriter handles writing compressed blocks to an io.Writer
 type BlockWriter struct {
 	w           io.Writer
@@ -39,34 +135,93 @@ type BlockWriter struct {
 	currentSize int
 	sparseIndex SparseIndex
 	offset      int64
-	lw          *lz4.Writer
+	codec       Codec
 	rawBuf      bytes.Buffer
-	compBuf     bytes.Buffer
+	compBuf     []byte
+	zone        ZoneFunc
+
+	// Partitioning (see SetPartitions)
+	out         io.Writer // Where blocks go: w, or the current part file
+	newPart     func(part int) (io.Writer, string, error)
+	perPart     int64
+	part        int
+	partRecords int64
+	lastKey     [64]byte
 }
 
 // NewBlockWriter creates a new BlockWriter
 func NewBlockWriter(w io.Writer) (*BlockWriter, error) {
 	// Write Magic Header
-	n, err := w.Write([]byte(MagicCIDX))
+	n, err := w.Write([]byte(MagicCIDX2))
 	if err != nil {
 		return nil, err
 	}
-	// Create lz4 writer once
-	lw := lz4.NewWriter(io.Discard)
-	// Apply fastest compression and 64K Block size preference
-	// Use Apply pattern for options in v4
-	_ = lw.Apply(lz4.BlockSizeOption(lz4.Block64Kb))
-
 	return &BlockWriter{
-		w:      w,
-		buffer: make([]IndexRecord, 0, 1000), // Pre-allocate some space
-		offset: int64(n),
-		lw:     lw,
+		w:           w,
+		out:         w,
+		buffer:      make([]IndexRecord, 0, 1000), // Pre-allocate some space
+		offset:      int64(n),
+		codec:       &lz4Codec{},
+		sparseIndex: SparseIndex{ZoneMaps: true, Checksums: true, Codec: CodecLZ4},
 	}, nil
 }
 
+// SetCodec selects the block compression. Must be called before the first
+// record.
+func (bw *BlockWriter) SetCodec(c Codec) {
+	bw.codec = c
+	bw.sparseIndex.Codec = c.Name()
+}
+
+// SetZoneMap records the numeric min/max of column per block, reading each
+// record's value through fn. Must be called before the first record.
+func (bw *BlockWriter) SetZoneMap(column string, fn ZoneFunc) {
+	bw.sparseIndex.ZoneColumn = column
+	bw.zone = fn
+}
+
+// SetPartitions writes the blocks to part files instead of w, starting a
+// new part once the current one holds perPart records and the key changes.
+// newPart creates part n (1-based) and returns its name in the footer (see
+// SparseIndex.Parts); the caller commits the part files after Close. Must
+// be called before the first record.
+func (bw *BlockWriter) SetPartitions(perPart int64, newPart func(part int) (io.Writer, string, error)) {
+	bw.perPart = max(perPart, 1)
+	bw.newPart = newPart
+}
+
+// nextPart ends the current part and starts writing blocks to the next.
+func (bw *BlockWriter) nextPart() error {
+	if err := bw.FlushBlock(); err != nil {
+		return err
+	}
+	out, name, err := bw.newPart(bw.part + 1)
+	if err != nil {
+		return err
+	}
+	n, err := out.Write([]byte(MagicPart))
+	if err != nil {
+		return err
+	}
+	bw.part++
+	bw.out = out
+	bw.offset = int64(n)
+	bw.partRecords = 0
+	bw.sparseIndex.Parts = append(bw.sparseIndex.Parts, name)
+	return nil
+}
+
 // WriteRecord adds a record to the buffer and flushes to disk if full across blocks
 func (bw *BlockWriter) WriteRecord(rec IndexRecord) error {
+	if bw.newPart != nil {
+		if bw.part == 0 || (bw.partRecords >= bw.perPart && rec.Key != bw.lastKey) {
+			if err := bw.nextPart(); err != nil {
+				return err
+			}
+		}
+		bw.partRecords++
+		bw.lastKey = rec.Key
+	}
 	bw.buffer = append(bw.buffer, rec)
 	// Approximate size check: Key length + 16 bytes for offsets
 	bw.currentSize += len(rec.Key) + 16
@@ -90,20 +245,17 @@ func (bw *BlockWriter) FlushBlock() error {
 		return err
 	}
 
-	// 2. Compress with LZ4
-	bw.compBuf.Reset()
-	bw.lw.Reset(&bw.compBuf)
-	if _, err := bw.lw.Write(bw.rawBuf.Bytes()); err != nil {
-		return err
-	}
-	if err := bw.lw.Close(); err != nil {
+	// 2. Compress
+	var err error
+	bw.compBuf, err = bw.codec.Compress(bw.compBuf[:0], bw.rawBuf.Bytes())
+	if err != nil {
 		return err
 	}
-	compressedBytes := bw.compBuf.Bytes()
+	compressedBytes := bw.compBuf
 
 	// 3. Record Metadata
 	// Convert [64]byte key to string, trimming nulls
-	keyStr := string(bytes.TrimRight(bw.buffer[0].Key[:], "\x00"))
+	keyStr := KeyString(&bw.buffer[0].Key)
 
 	// Check if block is distinct (all keys are identical)
 	isDistinct := true
@@ -123,11 +275,17 @@ func (bw *BlockWriter) FlushBlock() error {
 		Length:      int64(len(compressedBytes)),
 		RecordCount: int64(len(bw.buffer)), // Track record count for fast COUNT(*)
 		IsDistinct:  isDistinct,
+		EndKey:      KeyString(&bw.buffer[len(bw.buffer)-1].Key),
+		Checksum:    crc32.Checksum(compressedBytes, crcTable),
+		Part:        bw.part,
+	}
+	if bw.zone != nil {
+		meta.MinValue, meta.MaxValue = bw.zoneRange()
 	}
-	bw.sparseIndex.Blocks = append(bw.sparseIndex.Blocks, meta)
+	bw.sparseIndex.Blocks.Append(meta)
 
 	// 4. Write to Disk
-	n, err := bw.w.Write(compressedBytes)
+	n, err := bw.out.Write(compressedBytes)
 	if err != nil {
 		return err
 	}
@@ -139,47 +297,138 @@ func (bw *BlockWriter) FlushBlock() error {
 	return nil
 }
 
+// zoneRange computes the numeric range of the zone column over the buffered
+// records. Returns nils if any value is not a number.
+func (bw *BlockWriter) zoneRange() (*float64, *float64) {
+	var lo, hi float64
+	for i := range bw.buffer {
+		v, err := strconv.ParseFloat(bw.zone(&bw.buffer[i]), 64)
+		if err != nil {
+			return nil, nil
+		}
+		if i == 0 || v < lo {
+			lo = v
+		}
+		if i == 0 || v > hi {
+			hi = v
+		}
+	}
+	return &lo, &hi
+}
+
 // Close finalizes the file by writing the remaining buffer and the footer
+// (to w, also when the blocks went to part files)
 func (bw *BlockWriter) Close() error {
 	// Flush remaining records
 	if err := bw.FlushBlock(); err != nil {
 		return err
 	}
 
-	// Serialize Footer (Sparse Index)
-	footerBytes, err := json.Marshal(bw.sparseIndex)
-	if err != nil {
-		return err
-	}
+	return WriteFooter(bw.w, bw.sparseIndex)
+}
 
-	// Write Footer
-	n, err := bw.w.Write(footerBytes)
+// WriteFooter writes the footer that ends a .cidx file starting with
+// MagicCIDX2: the binary sparse index and its length (8 bytes, big-endian).
+func WriteFooter(w io.Writer, footer SparseIndex) error {
+	footerBytes, err := appendFooter(nil, &footer)
 	if err != nil {
 		return err
 	}
-
-	// Write Footer Length (8 bytes)
-	if err := binary.Write(bw.w, binary.BigEndian, int64(n)); err != nil {
+	n, err := w.Write(footerBytes)
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return binary.Write(w, binary.BigEndian, int64(n))
 }
 
 // BlockReader handles reading compressed blocks.
 // Supports two modes: seek-based (via io.ReadSeeker) and mmap-based (zero-copy).
 type BlockReader struct {
 	r         io.ReadSeeker // nil when using mmap mode
+	closer    io.Closer     // Storage object behind r, closed by Cleanup
 	mmapData  []byte        // non-nil when using mmap mode (zero-copy)
 	Footer    SparseIndex
+	codec     Codec
 	compBuf   []byte        // reusable buffer for compressed block data
 	decompBuf []byte        // reusable buffer for decompressed block data
 	recBuf    []IndexRecord // reusable buffer for decompressed records
+	cold      *blockFile    // Cold blocks of a tiered index (nil = untiered), shared with forks
+	parts     []*blockFile  // Part files of a partitioned index, shared with forks
+	cache     *BlockCache   // Decoded blocks (nil = none, see SetCache)
+	id        string        // Identity of the index file in the cache ("" = not cacheable)
+	release   func()        // Cleanup of a fork from a HandlePool: return it
+}
+
+// blockFile is a file holding blocks outside the .cidx: the cold file of a
+// tiered index or a part of a partitioned one. It is opened on the first
+// read of one of its blocks.
+type blockFile struct {
+	store    storage.Backend // nil: opened from location
+	location string
+	name     string
+	what     string // For errors
+	once     sync.Once
+	obj      storage.Object
+	err      error
+}
+
+func newColdTier(footer SparseIndex) *blockFile {
+	if footer.ColdFile == "" {
+		return nil
+	}
+	return &blockFile{location: footer.ColdStore, name: footer.ColdFile, what: "cold blocks of tiered index"}
+}
+
+// newPartFiles returns the part files of a partitioned index, found in
+// store (nil when the reader does not know where the index is).
+func newPartFiles(footer SparseIndex, store storage.Backend) []*blockFile {
+	parts := make([]*blockFile, len(footer.Parts))
+	for i, name := range footer.Parts {
+		parts[i] = &blockFile{store: store, name: name, what: fmt.Sprintf("part %d of partitioned index", i+1)}
+	}
+	return parts
+}
+
+func (f *blockFile) open() (storage.Object, error) {
+	f.once.Do(func() {
+		store := f.store
+		if store == nil {
+			if f.location == "" {
+				f.err = fmt.Errorf("%s: index location unknown", f.what)
+				return
+			}
+			var err error
+			if store, err = storage.Open(f.location); err != nil {
+				f.err = err
+				return
+			}
+		}
+		var err error
+		if f.obj, err = store.Open(f.name); err != nil {
+			f.err = fmt.Errorf("%s: %w", f.what, err)
+		}
+	})
+	return f.obj, f.err
+}
+
+func (f *blockFile) close() {
+	if f != nil && f.obj != nil {
+		_ = f.obj.Close()
+	}
 }
 
 // NewBlockReader initializes a reader and loads the SparseIndex (seek-based mode).
 func NewBlockReader(r io.ReadSeeker) (*BlockReader, error) {
-	// 1. Seek to end - 8 to get footer length
+	// 1. The magic header tells the footer format
+	magic := make([]byte, len(MagicCIDX2))
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+
+	// 2. Seek to end - 8 to get footer length
 	if _, err := r.Seek(-8, io.SeekEnd); err != nil {
 		return nil, err
 	}
@@ -188,29 +437,52 @@ func NewBlockReader(r io.ReadSeeker) (*BlockReader, error) {
 	if err := binary.Read(r, binary.BigEndian, &footerLen); err != nil {
 		return nil, err
 	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if footerLen <= 0 || footerLen > size-8-int64(len(MagicCIDX)) {
+		return nil, fmt.Errorf("invalid footer: length %d in a %d byte file", footerLen, size)
+	}
 
-	// 2. Seek to Footer Start
+	// 3. Seek to Footer Start
 	if _, err := r.Seek(-(8 + footerLen), io.SeekEnd); err != nil {
 		return nil, err
 	}
 
-	// 3. Read Footer
+	// 4. Read Footer
 	footerBytes := make([]byte, footerLen)
 	if _, err := io.ReadFull(r, footerBytes); err != nil {
 		return nil, err
 	}
 
-	var footer SparseIndex
-	if err := json.Unmarshal(footerBytes, &footer); err != nil {
+	footer, err := parseFooter(magic, footerBytes)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := NewCodec(footer.Codec)
+	if err != nil {
 		return nil, err
 	}
 
 	return &BlockReader{
 		r:      r,
 		Footer: footer,
+		codec:  codec,
+		cold:   newColdTier(footer),
+		parts:  newPartFiles(footer, partStore(r)),
 	}, nil
 }
 
+// partStore returns where the part files of an index read from r are: next
+// to it for a file, unknown otherwise (OpenBlockReader sets its store).
+func partStore(r io.ReadSeeker) storage.Backend {
+	if f, ok := r.(*os.File); ok {
+		return storage.NewLocal(filepath.Dir(f.Name()))
+	}
+	return nil
+}
+
 // NewBlockReaderMmap creates a mmap-based block reader (zero-copy, minimal memory).
 // The file is memory-mapped and the footer is parsed directly from mapped memory.
 // Call Cleanup() when done to unmap.
@@ -221,10 +493,14 @@ func NewBlockReaderMmap(path string) (*BlockReader, error) {
 	}
 	defer func() { _ = f.Close() }()
 
-	data, err := MmapFile(f)
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
+	data, err := MmapFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMmap, err)
+	}
 
 	if len(data) < 8 {
 		_ = MunmapFile(data)
@@ -234,93 +510,231 @@ func NewBlockReaderMmap(path string) (*BlockReader, error) {
 	// Parse footer length from last 8 bytes (zero I/O — direct memory access)
 	footerLen := int64(binary.BigEndian.Uint64(data[len(data)-8:]))
 	footerStart := int64(len(data)) - 8 - footerLen
-	if footerStart < 4 { // must be after CIDX magic
+	if footerLen <= 0 || footerStart < 4 { // must be after CIDX magic
 		_ = MunmapFile(data)
 		return nil, fmt.Errorf("invalid footer: start=%d", footerStart)
 	}
 
-	// Parse footer from mapped memory (zero-copy)
-	var footer SparseIndex
-	if err := json.Unmarshal(data[footerStart:int64(len(data))-8], &footer); err != nil {
+	// Parse footer from mapped memory: a binary one copies its block
+	// table, decoding nothing
+	footer, err := parseFooter(data[:len(MagicCIDX2)], data[footerStart:int64(len(data))-8])
+	if err != nil {
+		_ = MunmapFile(data)
+		return nil, err
+	}
+	codec, err := NewCodec(footer.Codec)
+	if err != nil {
 		_ = MunmapFile(data)
 		return nil, err
 	}
 
-	return &BlockReader{
+	br := &BlockReader{
 		mmapData: data,
 		Footer:   footer,
-	}, nil
+		codec:    codec,
+		cold:     newColdTier(footer),
+		parts:    newPartFiles(footer, storage.NewLocal(filepath.Dir(path))),
+		id:       cacheID(path, info.Size(), info.ModTime().UnixNano()),
+	}
+	// Open the part files now: a rebuild may remove them while the mapping
+	// of the .cidx lives on (see IndexMeta.Generation)
+	for _, part := range br.parts {
+		if _, err := part.open(); err != nil {
+			br.Cleanup()
+			return nil, err
+		}
+	}
+	return br, nil
+}
+
+// errMmap is returned (wrapped) by NewBlockReaderMmap when the file can't be
+// mapped.
+var errMmap = errors.New("cannot map index")
+
+// OpenBlockReader opens an index stored in a storage backend. Local files
+// are memory-mapped; other backends are read block by block (ranged reads),
+// so only the footer and the blocks a query touches are fetched. So are
+// local files where mapping is not supported (see mmapSupported) or fails.
+func OpenBlockReader(store storage.Backend, name string) (*BlockReader, error) {
+	path, local := storage.LocalPath(store, name)
+	if local && mmapSupported {
+		br, err := NewBlockReaderMmap(path)
+		if !errors.Is(err, errMmap) {
+			return br, err
+		}
+	}
+	obj, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	br, err := NewBlockReader(io.NewSectionReader(obj, 0, obj.Size()))
+	if err != nil {
+		_ = obj.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	br.closer = obj
+	br.parts = newPartFiles(br.Footer, store)
+	// No modification time of remote indexes without another request: a
+	// rebuild writes indexes of a new generation under a new name anyway
+	var modTime int64
+	if local {
+		if info, err := store.Stat(name); err == nil {
+			modTime = info.ModTime.UnixNano()
+		}
+	}
+	br.id = cacheID(store.String()+"/"+name, obj.Size(), modTime)
+	return br, nil
 }
 
-// Cleanup releases mmap resources. Safe to call on non-mmap readers.
+func cacheID(path string, size, modTime int64) string {
+	return path + "\x00" + strconv.FormatInt(size, 10) + "\x00" + strconv.FormatInt(modTime, 10)
+}
+
+// SetCache makes ReadBlock serve blocks from cache (nil = none) and keep
+// the blocks it decodes there. Forks made afterwards share it.
+func (br *BlockReader) SetCache(cache *BlockCache) {
+	br.cache = cache
+}
+
+// Cleanup releases mmap resources (and the storage object of readers from
+// OpenBlockReader). Safe to call on any reader; readers of a HandlePool go
+// back to it.
 func (br *BlockReader) Cleanup() {
+	if br.release != nil {
+		br.release()
+		br.release = nil
+		br.mmapData, br.r, br.cold, br.parts = nil, nil, nil, nil
+		return
+	}
 	if br.mmapData != nil {
 		_ = MunmapFile(br.mmapData)
 		br.mmapData = nil
 	}
+	if br.closer != nil {
+		_ = br.closer.Close()
+		br.closer = nil
+	}
+	br.cold.close()
+	br.cold = nil
+	for _, part := range br.parts {
+		part.close()
+	}
+	br.parts = nil
+}
+
+// Fork returns a reader over the same mapping with its own decode buffers,
+// so blocks can be read from several goroutines. Only the original reader
+// may be cleaned up. Returns nil for seek-based readers (shared file
+// position), except those of OpenBlockReader, whose storage object
+// supports concurrent ranged reads.
+func (br *BlockReader) Fork() *BlockReader {
+	if sr, ok := br.r.(*io.SectionReader); ok && br.closer != nil {
+		ra, off, n := sr.Outer()
+		return &BlockReader{
+			r:      io.NewSectionReader(ra, off, n),
+			Footer: br.Footer,
+			codec:  br.codec,
+			cold:   br.cold,
+			parts:  br.parts,
+			cache:  br.cache,
+			id:     br.id,
+		}
+	}
+	if br.mmapData == nil {
+		return nil
+	}
+	return &BlockReader{
+		mmapData: br.mmapData,
+		Footer:   br.Footer,
+		codec:    br.codec, // Decompress is concurrency-safe
+		cold:     br.cold,
+		parts:    br.parts,
+		cache:    br.cache,
+		id:       br.id,
+	}
 }
 
 // ReadBlock reads and decompresses a specific block using batch parsing.
 // Decompresses the full block into a flat buffer, then batch-parses all records at once.
 // Uses mmap zero-copy when available, otherwise falls back to seek+read.
+// The records are valid until the next read and must not be modified.
 func (br *BlockReader) ReadBlock(meta BlockMeta) ([]IndexRecord, error) {
-	var compData []byte
-
-	if br.mmapData != nil {
-		// Mmap mode: zero-copy slice directly into mapped memory (no syscalls)
-		end := meta.Offset + meta.Length
-		if end > int64(len(br.mmapData)) {
-			return nil, fmt.Errorf("block extends past mmap boundary: %d > %d", end, len(br.mmapData))
-		}
-		compData = br.mmapData[meta.Offset:end]
-	} else {
-		// Seek mode: traditional file I/O
-		if _, err := br.r.Seek(meta.Offset, io.SeekStart); err != nil {
-			return nil, err
-		}
-
-		needed := int(meta.Length)
-		if cap(br.compBuf) < needed {
-			br.compBuf = make([]byte, needed)
-		}
-		br.compBuf = br.compBuf[:needed]
+	if br.cache == nil || br.id == "" {
+		return br.decodeBlock(meta)
+	}
+	key := blockKey{index: br.id, cold: meta.Cold, part: meta.Part, offset: meta.Offset}
+	if records, ok := br.cache.get(key); ok {
+		return records, nil
+	}
+	records, err := br.decodeBlock(meta)
+	if err != nil {
+		return nil, err
+	}
+	records = slices.Clone(records)
+	br.cache.put(key, records)
+	return records, nil
+}
 
-		if _, err := io.ReadFull(br.r, br.compBuf); err != nil {
-			return nil, err
-		}
-		compData = br.compBuf
+// decodeBlock reads and decodes a block into the reader's buffers.
+func (br *BlockReader) decodeBlock(meta BlockMeta) ([]IndexRecord, error) {
+	compData, err := br.RawBlock(meta)
+	if err != nil {
+		return nil, err
 	}
 
 	// Decompress entire block into a flat buffer
-	lr := lz4.NewReader(bytes.NewReader(compData))
-
 	// Use decompBuf for decompressed data (reusable)
 	// Estimate: each block is ~64KB uncompressed
 	if cap(br.decompBuf) < BlockTargetSize*2 {
 		br.decompBuf = make([]byte, 0, BlockTargetSize*2)
 	}
-	br.decompBuf = br.decompBuf[:0]
+	br.decompBuf, err = br.codec.Decompress(br.decompBuf[:0], compData)
+	if err != nil {
+		return nil, fmt.Errorf("%w at offset %d: %v", ErrCorruptBlock, meta.Offset, err)
+	}
+	if len(br.decompBuf)%RecordSize != 0 || (meta.RecordCount > 0 && int64(len(br.decompBuf)/RecordSize) != meta.RecordCount) {
+		return nil, fmt.Errorf("%w at offset %d: %d bytes decoded, expected %d records", ErrCorruptBlock, meta.Offset, len(br.decompBuf), meta.RecordCount)
+	}
 
-	// Read all decompressed data using a temp buffer
-	var tmpBuf [8192]byte
-	for {
-		n, err := lr.Read(tmpBuf[:])
-		if n > 0 {
-			br.decompBuf = append(br.decompBuf, tmpBuf[:n]...)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
+	return br.parseRecords(len(br.decompBuf) / RecordSize), nil
+}
+
+// ReadBlockPrefix reads the first n records of a block, for scans that
+// need no more of it: its decompression stops once they are decoded where
+// the codec can (see PrefixCodec), and only they are parsed. A block in the
+// cache is served from it; one read partly is not added to it. The records
+// are valid until the next read and must not be modified.
+func (br *BlockReader) ReadBlockPrefix(meta BlockMeta, n int) ([]IndexRecord, error) {
+	pc, ok := br.codec.(PrefixCodec)
+	if !ok || n < 0 || int64(n) >= meta.RecordCount {
+		return br.ReadBlock(meta)
+	}
+	if br.cache != nil && br.id != "" {
+		key := blockKey{index: br.id, cold: meta.Cold, part: meta.Part, offset: meta.Offset}
+		if records, ok := br.cache.get(key); ok {
+			return records[:min(n, len(records))], nil
 		}
 	}
+	compData, err := br.RawBlock(meta)
+	if err != nil {
+		return nil, err
+	}
+	br.decompBuf, err = pc.DecompressPrefix(br.decompBuf[:0], compData, n*RecordSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w at offset %d: %v", ErrCorruptBlock, meta.Offset, err)
+	}
+	if len(br.decompBuf) < n*RecordSize {
+		return nil, fmt.Errorf("%w at offset %d: %d bytes decoded, expected %d records", ErrCorruptBlock, meta.Offset, len(br.decompBuf), meta.RecordCount)
+	}
+	return br.parseRecords(n), nil
+}
 
+// parseRecords parses the first count records of the decompressed block.
+func (br *BlockReader) parseRecords(count int) []IndexRecord {
 	// Batch parse all records at once (single pass, zero per-record overhead)
-	count := len(br.decompBuf) / RecordSize
 	if count == 0 {
 		br.recBuf = br.recBuf[:0]
-		return br.recBuf, nil
+		return br.recBuf
 	}
 
 	// Inline batch parse to reuse br.recBuf
@@ -337,6 +751,89 @@ func (br *BlockReader) ReadBlock(meta BlockMeta) ([]IndexRecord, error) {
 			Line:   int64(binary.BigEndian.Uint64(br.decompBuf[offset+72 : offset+80])),
 		}
 	}
+	return br.recBuf
+}
+
+// RawBlock returns the compressed bytes of a block, verified against its
+// checksum, from the .cidx or the cold file or part file holding it. The
+// slice is valid until the next read.
+func (br *BlockReader) RawBlock(meta BlockMeta) ([]byte, error) {
+	var compData []byte
 
-	return br.recBuf, nil
+	file, err := br.blockFile(meta)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		obj, err := file.open()
+		if err != nil {
+			return nil, err
+		}
+		if meta.Offset < 0 || meta.Length < 0 || meta.Offset+meta.Length > obj.Size() {
+			return nil, fmt.Errorf("%w at offset %d of %s: extends past end of file (truncated?)", ErrCorruptBlock, meta.Offset, file.name)
+		}
+		if cap(br.compBuf) < int(meta.Length) {
+			br.compBuf = make([]byte, meta.Length)
+		}
+		br.compBuf = br.compBuf[:meta.Length]
+		if _, err := obj.ReadAt(br.compBuf, meta.Offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		compData = br.compBuf
+	} else if br.mmapData != nil {
+		// Mmap mode: zero-copy slice directly into mapped memory (no syscalls)
+		end := meta.Offset + meta.Length
+		if meta.Offset < 0 || meta.Length < 0 || end > int64(len(br.mmapData)) {
+			return nil, fmt.Errorf("%w at offset %d: extends past end of file (%d > %d bytes, truncated?)", ErrCorruptBlock, meta.Offset, end, len(br.mmapData))
+		}
+		compData = br.mmapData[meta.Offset:end]
+	} else {
+		// Seek mode: traditional file I/O
+		if _, err := br.r.Seek(meta.Offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		needed := int(meta.Length)
+		if cap(br.compBuf) < needed {
+			br.compBuf = make([]byte, needed)
+		}
+		br.compBuf = br.compBuf[:needed]
+
+		if _, err := io.ReadFull(br.r, br.compBuf); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil, fmt.Errorf("%w at offset %d: extends past end of file (truncated?)", ErrCorruptBlock, meta.Offset)
+			}
+			return nil, err
+		}
+		compData = br.compBuf
+	}
+
+	if br.Footer.Checksums {
+		if sum := crc32.Checksum(compData, crcTable); sum != meta.Checksum {
+			where := ""
+			if file != nil {
+				where = " of " + file.name
+			}
+			return nil, fmt.Errorf("%w at offset %d%s: checksum mismatch (crc32c %08x, expected %08x)", ErrCorruptBlock, meta.Offset, where, sum, meta.Checksum)
+		}
+	}
+	return compData, nil
+}
+
+// blockFile returns the file outside the .cidx holding a block (nil = the
+// .cidx itself).
+func (br *BlockReader) blockFile(meta BlockMeta) (*blockFile, error) {
+	switch {
+	case meta.Cold:
+		if br.cold == nil {
+			return nil, fmt.Errorf("%w at offset %d: cold block in an index without a cold file", ErrCorruptBlock, meta.Offset)
+		}
+		return br.cold, nil
+	case meta.Part > 0:
+		if meta.Part > len(br.parts) {
+			return nil, fmt.Errorf("%w at offset %d: block of part %d in an index with %d parts", ErrCorruptBlock, meta.Offset, meta.Part, len(br.parts))
+		}
+		return br.parts[meta.Part-1], nil
+	}
+	return nil, nil
 }
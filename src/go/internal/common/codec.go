@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Block compression codecs, recorded in SparseIndex.Codec
+const (
+	CodecLZ4  = "lz4"  // Default: fast decompression, moderate size
+	CodecZstd = "zstd" // Smaller indexes, slower decompression
+	CodecNone = "none" // No compression: largest, no decode cost
+)
+
+// Codec compresses index blocks. Compress is called by a single writer;
+// Decompress must be safe for concurrent use (forked readers share it).
+type Codec interface {
+	Name() string
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// PrefixCodec is a Codec that can stop decompressing once the start of the
+// data is out, for reads of the first records of a block.
+type PrefixCodec interface {
+	Codec
+	// DecompressPrefix appends at least the first n bytes of the
+	// decompressed form of src to dst (all of it when shorter), and may
+	// append more.
+	DecompressPrefix(dst, src []byte, n int) ([]byte, error)
+}
+
+// NewCodec returns the codec with the given name ("" = lz4, for indexes
+// written before the footer recorded it).
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case CodecLZ4, "":
+		return &lz4Codec{}, nil
+	case CodecZstd:
+		return zstdCodec{}, nil
+	case CodecNone:
+		return noneCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q (use %s, %s or %s)", name, CodecLZ4, CodecZstd, CodecNone)
+}
+
+// lz4Codec writes LZ4 frames, the format of every index before codecs.
+type lz4Codec struct {
+	lw  *lz4.Writer // Reused across blocks (writer side only)
+	buf bytes.Buffer
+}
+
+func (c *lz4Codec) Name() string { return CodecLZ4 }
+
+func (c *lz4Codec) Compress(dst, src []byte) ([]byte, error) {
+	if c.lw == nil {
+		c.lw = lz4.NewWriter(io.Discard)
+		// 64K block size preference
+		_ = c.lw.Apply(lz4.BlockSizeOption(lz4.Block64Kb))
+	}
+	c.buf.Reset()
+	c.lw.Reset(&c.buf)
+	if _, err := c.lw.Write(src); err != nil {
+		return dst, err
+	}
+	if err := c.lw.Close(); err != nil {
+		return dst, err
+	}
+	return append(dst, c.buf.Bytes()...), nil
+}
+
+func (c *lz4Codec) Decompress(dst, src []byte) ([]byte, error) {
+	return c.DecompressPrefix(dst, src, -1)
+}
+
+// DecompressPrefix stops reading the frame once n bytes are out (n < 0 =
+// all of it): later frame blocks are not decoded.
+func (c *lz4Codec) DecompressPrefix(dst, src []byte, n int) ([]byte, error) {
+	lr := lz4.NewReader(bytes.NewReader(src))
+	var tmpBuf [8192]byte
+	start := len(dst)
+	for n < 0 || len(dst)-start < n {
+		r, err := lr.Read(tmpBuf[:])
+		if r > 0 {
+			dst = append(dst, tmpBuf[:r]...)
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// zstd encoder/decoder are safe for concurrent EncodeAll/DecodeAll, so one
+// pair serves the whole process
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdInit() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdErr
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return CodecZstd }
+
+func (zstdCodec) Compress(dst, src []byte) ([]byte, error) {
+	if err := zstdInit(); err != nil {
+		return dst, err
+	}
+	return zstdEncoder.EncodeAll(src, dst), nil
+}
+
+func (zstdCodec) Decompress(dst, src []byte) ([]byte, error) {
+	if err := zstdInit(); err != nil {
+		return dst, err
+	}
+	return zstdDecoder.DecodeAll(src, dst)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return CodecNone }
+
+func (noneCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noneCodec) DecompressPrefix(dst, src []byte, n int) ([]byte, error) {
+	if n < 0 || n > len(src) {
+		n = len(src)
+	}
+	return append(dst, src[:n]...), nil
+}
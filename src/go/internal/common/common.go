@@ -3,6 +3,8 @@ package common
 import (
 	"encoding/binary"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,7 +14,7 @@ const RecordSize = 64 + 8 + 8 // Key(64) + Offset(8) + Line(8) = 80 bytes
 // IndexRecord represents a single index entry
 // optimized for zero-allocation and memory alignment
 type IndexRecord struct {
-	Key    [64]byte // Fixed 64-byte key (no pointer, no heap alloc)
+	Key    [64]byte // Fixed 64-byte key, NUL-padded (see PutKey; no pointer, no heap alloc)
 	Offset int64    // Byte offset in CSV
 	Line   int64    // Line number (1-based)
 }
@@ -25,11 +27,37 @@ type IndexMeta struct {
 	CsvMtime   int64                 `json:"csvMtime"`
 	CsvHash    string                `json:"csvHash"`
 	Indexes    map[string]IndexStats `json:"indexes"`
+	RowStore   string                `json:"rowStore,omitempty"`  // .csvz copy of the CSV rows ("" = none)
+	Separator  string                `json:"separator,omitempty"` // Separator the CSV was indexed with ("" = comma, in old metadata)
+	Format     string                `json:"format,omitempty"`    // Input format when not CSV ("parquet", "arrow"): rows come from RowStore
+
+	// Generation counts the builds that published this metadata. Index
+	// files carry the generation that wrote them, so a build never
+	// overwrites files queries may have open (see IndexFileName).
+	Generation int64    `json:"generation,omitempty"`
+	Retired    []string `json:"retired,omitempty"` // Superseded remote files, removed by the next build
 }
 
+// IndexStats describes one index. IndexMeta.Indexes maps lowercase index
+// names to it, and File makes that map the manifest queries resolve index
+// names with, instead of guessing file names.
 type IndexStats struct {
-	DistinctCount int64 `json:"distinctCount"`
-	FileSize      int64 `json:"fileSize"`
+	File          string `json:"file,omitempty"` // .cidx name in the index storage; "" in old metadata
+	DistinctCount int64  `json:"distinctCount"`
+	FileSize      int64  `json:"fileSize"`
+	NullCount     *int64 `json:"nullCount,omitempty"` // Records with a null key (see IsNullKey); nil in old metadata
+
+	Columns   []string `json:"columns,omitempty"`   // Indexed columns, in key order; nil in old metadata
+	Collation string   `json:"collation,omitempty"` // CollationCI for case-insensitive keys; "" = bytewise
+
+	Partitions int `json:"partitions,omitempty"` // Part files of a partitioned index (see SparseIndex.Parts); FileSize includes them
+
+	// Key statistics captured by the merge phase (see KeyStats)
+	Records   int64         `json:"records,omitempty"`   // Records, null keys included
+	MinKey    string        `json:"minKey,omitempty"`    // Smallest non-null key, as stored (see EncodeKey)
+	MaxKey    string        `json:"maxKey,omitempty"`    // Largest non-null key, as stored
+	AvgKeyLen float64       `json:"avgKeyLen,omitempty"` // Mean stored length of the non-null keys
+	Histogram *KeyHistogram `json:"histogram,omitempty"` // nil in old metadata
 }
 
 // ReadRecord reads a single IndexRecord into the provided pointer
@@ -109,3 +137,34 @@ func WriteBatchRecords(w io.Writer, recs []IndexRecord) error {
 	_, err := w.Write(buf)
 	return err
 }
+
+// IndexFileName returns the .cidx name of an index written by build
+// generation gen: <csvName>_<name>.g<gen>.cidx, or <csvName>_<name>.cidx
+// for generation 0 (builds before generations).
+func IndexFileName(csvName, name string, gen int64) string {
+	if gen == 0 {
+		return csvName + "_" + name + ".cidx"
+	}
+	return csvName + "_" + name + ".g" + strconv.FormatInt(gen, 10) + ".cidx"
+}
+
+// PartFileName returns the name of part n (1-based) of a partitioned index
+// written to indexFile: <indexFile>.p<n>, outside the _*.cidx listing.
+func PartFileName(indexFile string, n int) string {
+	return indexFile + ".p" + strconv.Itoa(n)
+}
+
+// LegacyIndexFile resolves an index missing from the manifest (metadata
+// written before IndexStats.File): the first of the sorted files named
+// <csvName>_<name>.cidx, ignoring the case of name as older versions stored
+// uppercase names.
+func LegacyIndexFile(files []string, csvName, name string) (string, bool) {
+	prefix := csvName + "_"
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f, prefix)
+		if ok && strings.EqualFold(rest, name+".cidx") {
+			return f, true
+		}
+	}
+	return "", false
+}
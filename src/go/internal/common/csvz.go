@@ -0,0 +1,243 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// .csvz row store: a compressed copy of a CSV that index records can still
+// point into, so the CSV itself can be archived.
+//
+//	"CSVZ" | block 0 | block 1 | ... | JSON RowStoreFooter | footer length (8 bytes, BE)
+//
+// Each block holds whole lines of the CSV (the header is the first line of
+// block 0), compressed with the footer's codec. Index records keep their
+// offsets into the original CSV: RowStore translates an offset to its block
+// with the footer and decompresses only that block.
+
+// MagicCSVZ starts every row store file.
+const MagicCSVZ = "CSVZ"
+
+// RowStoreBlockSize is the uncompressed size lines are grouped up to. A
+// longer line gets a block of its own.
+const RowStoreBlockSize = 256 << 10
+
+// RowBlock locates the CSV bytes [Start, Start+Length) compressed at Pos.
+type RowBlock struct {
+	Start    int64  `json:"start"`
+	Length   int64  `json:"length"`
+	Pos      int64  `json:"pos"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"crc32c"` // CRC-32C of the compressed bytes
+}
+
+// RowStoreFooter describes a row store.
+type RowStoreFooter struct {
+	CsvSize int64      `json:"csvSize"`
+	Codec   string     `json:"codec"`
+	Blocks  []RowBlock `json:"blocks"`
+}
+
+// WriteRowStore writes the row store of csv (the whole CSV file) to w.
+func WriteRowStore(w io.Writer, csv []byte, codec Codec) error {
+	if _, err := w.Write([]byte(MagicCSVZ)); err != nil {
+		return err
+	}
+	footer := RowStoreFooter{CsvSize: int64(len(csv)), Codec: codec.Name()}
+	pos := int64(len(MagicCSVZ))
+	var comp []byte
+	for start := 0; start < len(csv); {
+		end := min(start+RowStoreBlockSize, len(csv))
+		if end < len(csv) {
+			// End the block after the last complete record, or after the
+			// first record if it is longer than a block
+			end = recordsEnd(csv, start, end)
+		}
+		var err error
+		if comp, err = codec.Compress(comp[:0], csv[start:end]); err != nil {
+			return err
+		}
+		if _, err := w.Write(comp); err != nil {
+			return err
+		}
+		footer.Blocks = append(footer.Blocks, RowBlock{
+			Start:    int64(start),
+			Length:   int64(end - start),
+			Pos:      pos,
+			Size:     int64(len(comp)),
+			Checksum: crc32.Checksum(comp, crcTable),
+		})
+		pos += int64(len(comp))
+		start = end
+	}
+
+	footerBytes, err := json.Marshal(footer)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(footerBytes); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, int64(len(footerBytes)))
+}
+
+// recordsEnd returns where a block of csv starting at start and ending near
+// end should end: after the last record that ends by end, or after the first
+// record if none does.
+func recordsEnd(csv []byte, start, end int) int {
+	next := start
+	for next < end {
+		recordEnd := len(csv)
+		if e := RecordEnd(csv[next:]); e >= 0 {
+			recordEnd = next + e + 1
+		}
+		if recordEnd > end && next > start {
+			break
+		}
+		next = recordEnd
+	}
+	return next
+}
+
+// RowStore reads rows of a .csvz file by their offset in the original CSV.
+// It keeps the last decompressed block, so rows read in offset order (or
+// clustered, as index scans are) rarely decompress a block twice. Not safe
+// for concurrent use.
+type RowStore struct {
+	obj    storage.Object
+	Footer RowStoreFooter
+	codec  Codec
+
+	block   int    // Index of the decompressed block (-1 = none)
+	data    []byte // Its CSV bytes
+	compBuf []byte
+}
+
+// OpenRowStore opens a row store in a storage backend.
+func OpenRowStore(store storage.Backend, name string) (*RowStore, error) {
+	obj, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := newRowStore(obj)
+	if err != nil {
+		_ = obj.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return rs, nil
+}
+
+func newRowStore(obj storage.Object) (*RowStore, error) {
+	size := obj.Size()
+	if size < int64(len(MagicCSVZ))+8 {
+		return nil, fmt.Errorf("row store too small: %d bytes", size)
+	}
+	var tail [8]byte
+	if _, err := obj.ReadAt(tail[:], size-8); err != nil {
+		return nil, err
+	}
+	footerLen := int64(binary.BigEndian.Uint64(tail[:]))
+	if footerLen <= 0 || footerLen > size-8-int64(len(MagicCSVZ)) {
+		return nil, fmt.Errorf("invalid footer: length %d in a %d byte file", footerLen, size)
+	}
+	footerBytes := make([]byte, footerLen)
+	if _, err := obj.ReadAt(footerBytes, size-8-footerLen); err != nil {
+		return nil, err
+	}
+	rs := &RowStore{obj: obj, block: -1}
+	if err := json.Unmarshal(footerBytes, &rs.Footer); err != nil {
+		return nil, err
+	}
+	codec, err := NewCodec(rs.Footer.Codec)
+	if err != nil {
+		return nil, err
+	}
+	rs.codec = codec
+	return rs, nil
+}
+
+// RowAt returns the record starting at offset of the original CSV, with its
+// line terminator (none for a last line without one). The slice is only
+// valid until the next call.
+func (rs *RowStore) RowAt(offset int64) ([]byte, error) {
+	blocks := rs.Footer.Blocks
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Start+blocks[i].Length > offset
+	})
+	if offset < 0 || i == len(blocks) {
+		return nil, fmt.Errorf("offset %d is outside the row store (%d CSV bytes)", offset, rs.Footer.CsvSize)
+	}
+	if err := rs.load(i); err != nil {
+		return nil, err
+	}
+	row := rs.data[offset-blocks[i].Start:]
+	if end := RecordEnd(row); end >= 0 {
+		row = row[:end+1]
+	}
+	return row, nil
+}
+
+// load decompresses block i, unless it is the current one.
+func (rs *RowStore) load(i int) error {
+	if rs.block == i {
+		return nil
+	}
+	b := rs.Footer.Blocks[i]
+	if cap(rs.compBuf) < int(b.Size) {
+		rs.compBuf = make([]byte, b.Size)
+	}
+	comp := rs.compBuf[:b.Size]
+	if _, err := rs.obj.ReadAt(comp, b.Pos); err != nil && err != io.EOF {
+		return err
+	}
+	if sum := crc32.Checksum(comp, crcTable); sum != b.Checksum {
+		return fmt.Errorf("%w at offset %d: checksum mismatch (crc32c %08x, expected %08x)", ErrCorruptBlock, b.Pos, sum, b.Checksum)
+	}
+	data, err := rs.codec.Decompress(rs.data[:0], comp)
+	if err != nil {
+		return fmt.Errorf("%w at offset %d: %v", ErrCorruptBlock, b.Pos, err)
+	}
+	if int64(len(data)) != b.Length {
+		return fmt.Errorf("%w at offset %d: %d bytes decompressed, expected %d", ErrCorruptBlock, b.Pos, len(data), b.Length)
+	}
+	rs.data, rs.block = data, i
+	return nil
+}
+
+// Reader returns a reader of the CSV bytes of the whole row store, block
+// after block. It shares the decompressed block with RowAt.
+func (rs *RowStore) Reader() io.Reader {
+	return &rowStoreReader{rs: rs}
+}
+
+type rowStoreReader struct {
+	rs    *RowStore
+	block int // Block being read
+	pos   int // Next byte of it
+}
+
+func (r *rowStoreReader) Read(p []byte) (int, error) {
+	for r.block < len(r.rs.Footer.Blocks) {
+		if err := r.rs.load(r.block); err != nil {
+			return 0, err
+		}
+		if r.pos < len(r.rs.data) {
+			n := copy(p, r.rs.data[r.pos:])
+			r.pos += n
+			return n, nil
+		}
+		r.block, r.pos = r.block+1, 0
+	}
+	return 0, io.EOF
+}
+
+// Close releases the underlying file.
+func (rs *RowStore) Close() error {
+	return rs.obj.Close()
+}
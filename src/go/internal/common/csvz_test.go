@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+func TestRowStore(t *testing.T) {
+	// Enough rows for several blocks, one line longer than a block, quoted
+	// fields spanning lines, and a last line without a newline
+	var csv bytes.Buffer
+	csv.WriteString("id,name\n")
+	var offsets []int64
+	for i := range 30000 {
+		offsets = append(offsets, int64(csv.Len()))
+		name := fmt.Sprintf("user%d", i)
+		if i == 20000 {
+			name = strings.Repeat("x", RowStoreBlockSize+10)
+		} else if i%7 == 0 {
+			name = fmt.Sprintf("\"user\n%d\"", i)
+		}
+		fmt.Fprintf(&csv, "%d,%s\r\n", i, name)
+	}
+	offsets = append(offsets, int64(csv.Len()))
+	csv.WriteString("30000,last")
+	data := csv.Bytes()
+
+	dir := t.TempDir()
+	store, err := storage.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codecName := range []string{CodecLZ4, CodecZstd, CodecNone} {
+		codec, err := NewCodec(codecName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := WriteRowStore(&buf, data, codec); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "rows.csvz"), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := OpenRowStore(store, "rows.csvz")
+		if err != nil {
+			t.Fatalf("%s: %v", codecName, err)
+		}
+		if len(rs.Footer.Blocks) < 3 {
+			t.Errorf("%s: %d blocks, expected several", codecName, len(rs.Footer.Blocks))
+		}
+		if header, err := rs.RowAt(0); err != nil || string(header) != "id,name\n" {
+			t.Errorf("%s: header %q (%v)", codecName, header, err)
+		}
+		// Out of order, so blocks are decompressed again
+		for _, i := range []int{29999, 0, 20000, 12345, 20001, 20006, 30000} {
+			off := offsets[i]
+			want := data[off:]
+			if i+1 < len(offsets) {
+				want = data[off:offsets[i+1]]
+			}
+			got, err := rs.RowAt(off)
+			if err != nil {
+				t.Fatalf("%s: row %d: %v", codecName, i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: row %d is %.40q, expected %.40q", codecName, i, got, want)
+			}
+		}
+		if _, err := rs.RowAt(int64(len(data))); err == nil {
+			t.Errorf("%s: offset past the CSV was accepted", codecName)
+		}
+		// Read back whole, after a RowAt left a block loaded
+		if all, err := io.ReadAll(rs.Reader()); err != nil || !bytes.Equal(all, data) {
+			t.Errorf("%s: Reader returned %d bytes of %d (%v)", codecName, len(all), len(data), err)
+		}
+		_ = rs.Close()
+	}
+
+	// A flipped byte in a block fails its checksum
+	raw, _ := os.ReadFile(filepath.Join(dir, "rows.csvz"))
+	raw[len(MagicCSVZ)+10] ^= 0xff
+	if err := os.WriteFile(filepath.Join(dir, "rows.csvz"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := OpenRowStore(store, "rows.csvz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rs.Close() }()
+	if _, err := rs.RowAt(offsets[1]); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("Corrupt block read with error %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Index deltas keep the indexes of a CSV usable between builds: writes
+// with deltas on add the index records of the rows they append to a delta
+// file per index, <csvName>_<index>.delta, and queries merge those records
+// into their index scans. A delta file is a header, then its records
+// sorted like an index's (by key, then offset):
+//
+//	magic "CQDELTA1" | generation u64 | from u64 | to u64 | records
+//
+// It holds the rows of the CSV in [from, to), for the indexes of the
+// metadata generation it was written against, and counts only while from
+// is where that generation's indexes end (IndexMeta.CsvSize). The next
+// build covers the rows and removes the files.
+
+const (
+	deltaMagic      = "CQDELTA1"
+	deltaHeaderSize = len(deltaMagic) + 24
+)
+
+// ErrBadDelta is a delta file that does not decode.
+var ErrBadDelta = errors.New("invalid index delta")
+
+// DeltaHeader describes the rows a delta file holds.
+type DeltaHeader struct {
+	Generation int64 // IndexMeta.Generation of the indexes it extends
+	From, To   int64 // Byte range of the CSV rows
+}
+
+// Covers reports whether the delta extends the indexes of meta: it starts
+// where they end, for their generation.
+func (h DeltaHeader) Covers(meta *IndexMeta) bool {
+	return meta != nil && h.Generation == meta.Generation && h.From == meta.CsvSize && h.To >= h.From
+}
+
+// DeltaFileName returns the name of the delta file of an index.
+func DeltaFileName(csvName, index string) string {
+	return csvName + "_" + index + ".delta"
+}
+
+// EncodeDelta returns a delta file of records, which must be sorted.
+func EncodeDelta(h DeltaHeader, records []IndexRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(deltaHeaderSize + len(records)*RecordSize)
+	buf.WriteString(deltaMagic)
+	var n [8]byte
+	for _, v := range []int64{h.Generation, h.From, h.To} {
+		binary.BigEndian.PutUint64(n[:], uint64(v))
+		buf.Write(n[:])
+	}
+	if err := WriteBatchRecords(&buf, records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeDelta decodes a delta file.
+func DecodeDelta(data []byte) (DeltaHeader, []IndexRecord, error) {
+	if len(data) < deltaHeaderSize || string(data[:len(deltaMagic)]) != deltaMagic {
+		return DeltaHeader{}, nil, fmt.Errorf("%w: no delta header", ErrBadDelta)
+	}
+	body := data[deltaHeaderSize:]
+	if len(body)%RecordSize != 0 {
+		return DeltaHeader{}, nil, fmt.Errorf("%w: %d bytes of records", ErrBadDelta, len(body))
+	}
+	h := DeltaHeader{
+		Generation: int64(binary.BigEndian.Uint64(data[8:16])),
+		From:       int64(binary.BigEndian.Uint64(data[16:24])),
+		To:         int64(binary.BigEndian.Uint64(data[24:32])),
+	}
+	records, err := ReadBatchRecords(bytes.NewReader(body), len(body)/RecordSize)
+	return h, records, err
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	records := make([]IndexRecord, 3)
+	for i, key := range []string{"a", "b", "b"} {
+		PutKey(&records[i].Key, []byte(key))
+		records[i].Offset = int64(100 + i*10)
+	}
+	h := DeltaHeader{Generation: 4, From: 100, To: 130}
+	data, err := EncodeDelta(h, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, recs, err := DecodeDelta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != h || !reflect.DeepEqual(recs, records) {
+		t.Errorf("Read back %+v with %v", back, recs)
+	}
+
+	if !h.Covers(&IndexMeta{Generation: 4, CsvSize: 100}) {
+		t.Error("Delta does not cover the indexes it extends")
+	}
+	for _, meta := range []*IndexMeta{nil, {Generation: 5, CsvSize: 100}, {Generation: 4, CsvSize: 130}} {
+		if h.Covers(meta) {
+			t.Errorf("Delta covers %+v", meta)
+		}
+	}
+
+	for _, bad := range [][]byte{nil, data[:10], data[:len(data)-1], append([]byte("JUNKJUNK"), data[8:]...)} {
+		if _, _, err := DecodeDelta(bad); !errors.Is(err, ErrBadDelta) {
+			t.Errorf("Decoding %d bytes: %v", len(bad), err)
+		}
+	}
+}
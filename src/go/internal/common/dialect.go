@@ -0,0 +1,290 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Dialect describes how a CSV file is written: its separator, quote
+// character and whether the first line is a header.
+type Dialect struct {
+	Separator byte
+	Quote     byte
+	HasHeader bool
+}
+
+// DefaultDialect is assumed when a sample gives no evidence otherwise.
+var DefaultDialect = Dialect{Separator: ',', Quote: '"', HasHeader: true}
+
+// SniffBytes is how much of a file SniffFile reads.
+const SniffBytes = 64 << 10
+
+// sniffRecords bounds the records of a sample that are examined.
+const sniffRecords = 50
+
+// sniffSeparators are the separators recognized, in order of preference.
+var sniffSeparators = []byte{',', ';', '\t', '|'}
+
+func (d Dialect) String() string {
+	header := "yes"
+	if !d.HasHeader {
+		header = "no"
+	}
+	return fmt.Sprintf("separator=%s quote=%q header=%s", SeparatorName(d.Separator), d.Quote, header)
+}
+
+// SeparatorName renders a separator for messages ("tab" for '\t').
+func SeparatorName(sep byte) string {
+	if sep == '\t' {
+		return "tab"
+	}
+	return strconv.QuoteRune(rune(sep))
+}
+
+// ParseSeparator parses a --separator value: a single character, or
+// "tab" / "\t". "" and "auto" return 0, meaning detect.
+func ParseSeparator(s string) (byte, error) {
+	switch s {
+	case "", "auto":
+		return 0, nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	if len(s) != 1 || s[0] == '\n' || s[0] == '\r' || s[0] == '"' {
+		return 0, fmt.Errorf("invalid separator %q: must be a single ASCII character, \"tab\" or \"auto\"", s)
+	}
+	return s[0], nil
+}
+
+// SniffFile detects the dialect of a CSV file from its first SniffBytes.
+func SniffFile(path string) (Dialect, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return DefaultDialect, err
+	}
+	defer func() { _ = f.Close() }()
+	return SniffReader(f)
+}
+
+// SniffReader detects the dialect from the first SniffBytes of r.
+func SniffReader(r io.Reader) (Dialect, error) {
+	sample := make([]byte, SniffBytes)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return DefaultDialect, err
+	}
+	return SniffDialect(sample[:n], n == len(sample)), nil
+}
+
+// ResolveSeparator returns the separator of a --separator value, detecting
+// it from the file when the value is "" or "auto".
+func ResolveSeparator(value, path string) (byte, error) {
+	sep, err := ParseSeparator(value)
+	if err != nil || sep != 0 {
+		return sep, err
+	}
+	d, err := SniffFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return d.Separator, nil
+}
+
+// SniffDialect detects the dialect of a sample from the start of a file.
+// truncated means the sample ends mid-file, so its last line is dropped.
+//
+// The separator is the candidate found the same (non-zero) number of times
+// outside quotes on every line, preferring the one that splits lines into
+// the most fields. The quote is ' only when fields start with it and never
+// with ". The first line is taken for a header unless it looks like the
+// others: a value that parses as a number where the column below it is
+// numeric too, and no column where it holds text over numbers.
+func SniffDialect(sample []byte, truncated bool) Dialect {
+	sample = bytes.TrimPrefix(sample, []byte("\xef\xbb\xbf"))
+	if truncated {
+		if nl := bytes.LastIndexByte(sample, '\n'); nl >= 0 {
+			sample = sample[:nl+1]
+		}
+	}
+	d := DefaultDialect
+	d.Quote = sniffQuote(sample)
+
+	records := splitRecords(sample, d.Quote)
+	if len(records) == 0 {
+		return d
+	}
+
+	best, bestFields := byte(0), 0
+	for _, sep := range sniffSeparators {
+		fields := -1
+		for _, rec := range records {
+			n := countOutsideQuotes(rec, sep, d.Quote)
+			if fields < 0 {
+				fields = n
+			} else if n != fields {
+				fields = 0
+				break
+			}
+		}
+		if fields > bestFields {
+			best, bestFields = sep, fields
+		}
+	}
+	if best == 0 {
+		best = mostFrequent(records[0], d.Quote)
+	}
+	d.Separator = best
+	d.HasHeader = sniffHeader(records, d)
+	return d
+}
+
+// sniffQuote picks the quote character from how fields start.
+func sniffQuote(sample []byte) byte {
+	var double, single int
+	for i, c := range sample {
+		if c != '"' && c != '\'' {
+			continue
+		}
+		if i > 0 && !isFieldStart(sample[i-1]) {
+			continue
+		}
+		if c == '"' {
+			double++
+		} else {
+			single++
+		}
+	}
+	if single > 0 && double == 0 {
+		return '\''
+	}
+	return '"'
+}
+
+func isFieldStart(prev byte) bool {
+	if prev == '\n' {
+		return true
+	}
+	for _, sep := range sniffSeparators {
+		if prev == sep {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRecords splits a sample into records at newlines outside quotes,
+// without their terminators. Empty lines are skipped.
+func splitRecords(sample []byte, quote byte) [][]byte {
+	var records [][]byte
+	start, inQuote := 0, false
+	for i := 0; i < len(sample) && len(records) < sniffRecords; i++ {
+		switch sample[i] {
+		case quote:
+			inQuote = !inQuote
+		case '\n':
+			if inQuote {
+				continue
+			}
+			if rec := bytes.TrimSuffix(sample[start:i], []byte{'\r'}); len(rec) > 0 {
+				records = append(records, rec)
+			}
+			start = i + 1
+		}
+	}
+	if start < len(sample) && len(records) < sniffRecords {
+		if rec := bytes.TrimRight(sample[start:], "\r\n"); len(rec) > 0 {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func countOutsideQuotes(rec []byte, sep, quote byte) int {
+	n, inQuote := 0, false
+	for _, c := range rec {
+		switch {
+		case c == quote:
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			n++
+		}
+	}
+	return n
+}
+
+// mostFrequent picks the candidate separator found most often in a record
+// (for samples no candidate splits consistently). Ties and none found
+// fall back to the order of preference.
+func mostFrequent(rec []byte, quote byte) byte {
+	best, bestCount := sniffSeparators[0], 0
+	for _, sep := range sniffSeparators {
+		if n := countOutsideQuotes(rec, sep, quote); n > bestCount {
+			best, bestCount = sep, n
+		}
+	}
+	return best
+}
+
+// sniffHeader votes per column on whether the first record is a header.
+func sniffHeader(records [][]byte, d Dialect) bool {
+	if len(records) < 2 {
+		return true
+	}
+	first := splitFields(records[0], d)
+	rows := make([][]string, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		rows = append(rows, splitFields(rec, d))
+	}
+
+	votes := 0
+	for col, value := range first {
+		numeric, seen := true, 0
+		for _, row := range rows {
+			if col >= len(row) || row[col] == "" {
+				continue
+			}
+			seen++
+			if !isNumber(row[col]) {
+				numeric = false
+				break
+			}
+		}
+		if seen == 0 || !numeric {
+			continue // Text columns say nothing: names look like values
+		}
+		if isNumber(value) {
+			votes--
+		} else {
+			votes++
+		}
+	}
+	return votes >= 0
+}
+
+// splitFields splits a record into its unquoted fields.
+func splitFields(rec []byte, d Dialect) []string {
+	var fields []string
+	var field []byte
+	inQuote := false
+	for _, c := range rec {
+		switch {
+		case c == d.Quote:
+			inQuote = !inQuote
+		case c == d.Separator && !inQuote:
+			fields = append(fields, strings.TrimSpace(string(field)))
+			field = field[:0]
+		default:
+			field = append(field, c)
+		}
+	}
+	return append(fields, strings.TrimSpace(string(field)))
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
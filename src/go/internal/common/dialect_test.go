@@ -0,0 +1,54 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSniffDialect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sample string
+		want   Dialect
+	}{
+		{"comma", "id,name,score\n1,alice,3.5\n2,bob,4\n", Dialect{',', '"', true}},
+		{"semicolon export", "id;name;price\n1;Müller, Hans;3,50\n2;Smith;4,00\n", Dialect{';', '"', true}},
+		{"tab", "id\tname\n1\talice\n2\tbob\n", Dialect{'\t', '"', true}},
+		{"pipe", "a|b|c\nx|y|z\n", Dialect{'|', '"', true}},
+		{"quoted separators", "id,note\n1,\"a;b;c\"\n2,\"d;e\"\n", Dialect{',', '"', true}},
+		{"quoted newline", "id;note\n1;\"two\nlines\"\n2;x\n", Dialect{';', '"', true}},
+		{"single quotes", "id,name\n1,'O''Brien, Pat'\n2,'Lee'\n", Dialect{',', '\'', true}},
+		{"no header", "1,alice,3.5\n2,bob,4\n3,carol,5\n", Dialect{',', '"', false}},
+		{"numeric header", "2021,2022\n10,20\n30,40\n", Dialect{',', '"', false}},
+		{"text only", "name,city\nalice,paris\n", Dialect{',', '"', true}},
+		{"bom and crlf", "\xef\xbb\xbfid;name\r\n1;a\r\n2;b\r\n", Dialect{';', '"', true}},
+		{"single column", "name\nalice\nbob\n", Dialect{',', '"', true}},
+	} {
+		if got := SniffDialect([]byte(tc.sample), false); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// A truncated sample drops its partial last line
+	sample := "a;b\n1;2\n3;4\n5,6,7,8"
+	if got := SniffDialect([]byte(sample), true); got.Separator != ';' {
+		t.Errorf("Truncated sample: separator %s", SeparatorName(got.Separator))
+	}
+}
+
+func TestParseSeparator(t *testing.T) {
+	for in, want := range map[string]byte{"": 0, "auto": 0, ",": ',', ";": ';', "tab": '\t', `\t`: '\t', "|": '|'} {
+		got, err := ParseSeparator(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSeparator(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{";;", "\n", `"`, "é"} {
+		if _, err := ParseSeparator(in); err == nil {
+			t.Errorf("ParseSeparator(%q) accepted", in)
+		}
+	}
+	if _, err := SniffReader(strings.NewReader("")); err != nil {
+		t.Errorf("Empty input: %v", err)
+	}
+}
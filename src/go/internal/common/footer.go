@@ -0,0 +1,347 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Binary footer, written by every build since MagicCIDX2 (older indexes
+// start with MagicCIDX and end with a JSON SparseIndex, still read). The
+// block table has fixed-size entries, so opening an index copies it without
+// decoding anything: BlockList.At decodes the one block asked for.
+//
+//	flags (1 byte) | codec | zone column | cold store | cold file | parts
+//	| block count | key stride | entries (blockEntrySize each)
+//	| start keys | end keys
+//
+// Strings are a uvarint length and bytes, parts a uvarint count and
+// strings, counts uvarints. An entry holds:
+//
+//	offset (8) | length (4) | records (4) | crc32c (4) | part (4)
+//	| flags (4) | min (8) | max (8)
+//
+// All integers are little-endian. The keys of the blocks are in two arrays
+// of key stride bytes per block, NUL-padded (stored keys never end with a
+// NUL, see PutKey). The start keys are sorted, so LowerBound and UpperBound
+// binary search them in place.
+
+const blockEntrySize = 44
+
+// Footer flags
+const (
+	footerZoneMaps  = 1 << 0
+	footerChecksums = 1 << 1
+)
+
+// Block entry flags
+const (
+	entryDistinct = 1 << 0
+	entryCold     = 1 << 1
+	entryZone     = 1 << 2 // MinValue and MaxValue are set
+)
+
+// BlockList is the block table of a footer. Lists read from a binary
+// footer keep the encoded entries and decode a block on each At; the others
+// hold decoded blocks. The zero value is an empty list.
+type BlockList struct {
+	blocks  []BlockMeta
+	entries []byte // Binary footer: the entries, then the keys
+	n       int
+	stride  int // Bytes per key
+}
+
+// NewBlockList returns a list of blocks.
+func NewBlockList(blocks []BlockMeta) BlockList {
+	return BlockList{blocks: blocks}
+}
+
+// Len returns the number of blocks.
+func (l BlockList) Len() int {
+	if l.entries != nil {
+		return l.n
+	}
+	return len(l.blocks)
+}
+
+// At returns block i.
+func (l BlockList) At(i int) BlockMeta {
+	if l.entries == nil {
+		return l.blocks[i]
+	}
+	if i < 0 || i >= l.n {
+		panic(fmt.Sprintf("block %d out of %d", i, l.n))
+	}
+	e := l.entries[i*blockEntrySize : (i+1)*blockEntrySize]
+	flags := binary.LittleEndian.Uint32(e[24:])
+	meta := BlockMeta{
+		Offset:      int64(binary.LittleEndian.Uint64(e)),
+		Length:      int64(binary.LittleEndian.Uint32(e[8:])),
+		RecordCount: int64(binary.LittleEndian.Uint32(e[12:])),
+		Checksum:    binary.LittleEndian.Uint32(e[16:]),
+		Part:        int(binary.LittleEndian.Uint32(e[20:])),
+		IsDistinct:  flags&entryDistinct != 0,
+		Cold:        flags&entryCold != 0,
+		StartKey:    string(l.key(0, i)),
+		EndKey:      string(l.key(1, i)),
+	}
+	if flags&entryZone != 0 {
+		lo := math.Float64frombits(binary.LittleEndian.Uint64(e[28:]))
+		hi := math.Float64frombits(binary.LittleEndian.Uint64(e[36:]))
+		meta.MinValue, meta.MaxValue = &lo, &hi
+	}
+	return meta
+}
+
+// key returns the start (array 0) or end key (array 1) of block i of a
+// binary list.
+func (l BlockList) key(array, i int) []byte {
+	at := l.n*blockEntrySize + (array*l.n+i)*l.stride
+	return bytes.TrimRight(l.entries[at:at+l.stride], "\x00")
+}
+
+// StartKey returns the StartKey of block i.
+func (l BlockList) StartKey(i int) string {
+	if l.entries == nil {
+		return l.blocks[i].StartKey
+	}
+	return string(l.key(0, i))
+}
+
+// EndKey returns the EndKey of block i.
+func (l BlockList) EndKey(i int) string {
+	if l.entries == nil {
+		return l.blocks[i].EndKey
+	}
+	return string(l.key(1, i))
+}
+
+// LowerBound returns the first block whose StartKey is not less than key,
+// or Len if there is none.
+func (l BlockList) LowerBound(key string) int {
+	return l.search(key, 0)
+}
+
+// UpperBound returns the first block whose StartKey is greater than key,
+// or Len if there is none.
+func (l BlockList) UpperBound(key string) int {
+	return l.search(key, 1)
+}
+
+// search returns the first block whose StartKey compares to key at or above
+// bound (0 or 1).
+func (l BlockList) search(key string, bound int) int {
+	if l.entries == nil {
+		return sort.Search(len(l.blocks), func(i int) bool {
+			return strings.Compare(l.blocks[i].StartKey, key) >= bound
+		})
+	}
+	k := []byte(key)
+	return sort.Search(l.n, func(i int) bool {
+		return bytes.Compare(l.key(0, i), k) >= bound
+	})
+}
+
+// All iterates over the blocks in order.
+func (l BlockList) All() iter.Seq2[int, BlockMeta] {
+	return func(yield func(int, BlockMeta) bool) {
+		for i := range l.Len() {
+			if !yield(i, l.At(i)) {
+				return
+			}
+		}
+	}
+}
+
+// Slice returns all blocks, decoded.
+func (l BlockList) Slice() []BlockMeta {
+	if l.entries == nil {
+		return l.blocks
+	}
+	blocks := make([]BlockMeta, l.n)
+	for i := range blocks {
+		blocks[i] = l.At(i)
+	}
+	return blocks
+}
+
+// Append adds a block to the list.
+func (l *BlockList) Append(meta BlockMeta) {
+	if l.entries != nil {
+		*l = BlockList{blocks: l.Slice()}
+	}
+	l.blocks = append(l.blocks, meta)
+}
+
+func (l BlockList) MarshalJSON() ([]byte, error) {
+	blocks := l.Slice()
+	if blocks == nil {
+		blocks = []BlockMeta{}
+	}
+	return json.Marshal(blocks)
+}
+
+func (l *BlockList) UnmarshalJSON(data []byte) error {
+	*l = BlockList{}
+	return json.Unmarshal(data, &l.blocks)
+}
+
+// appendFooter appends the binary form of footer to dst.
+func appendFooter(dst []byte, footer *SparseIndex) ([]byte, error) {
+	var flags byte
+	if footer.ZoneMaps {
+		flags |= footerZoneMaps
+	}
+	if footer.Checksums {
+		flags |= footerChecksums
+	}
+	dst = append(dst, flags)
+	for _, s := range []string{footer.Codec, footer.ZoneColumn, footer.ColdStore, footer.ColdFile} {
+		dst = appendFooterString(dst, s)
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(footer.Parts)))
+	for _, part := range footer.Parts {
+		dst = appendFooterString(dst, part)
+	}
+
+	n := footer.Blocks.Len()
+	stride := 0
+	for i := range n {
+		meta := footer.Blocks.At(i)
+		stride = max(stride, len(meta.StartKey), len(meta.EndKey))
+		if strings.HasSuffix(meta.StartKey, "\x00") || strings.HasSuffix(meta.EndKey, "\x00") {
+			return nil, fmt.Errorf("block %d has a key ending with a NUL byte", i)
+		}
+	}
+	dst = binary.AppendUvarint(dst, uint64(n))
+	dst = binary.AppendUvarint(dst, uint64(stride))
+	keys := make([]byte, 2*n*stride)
+	for i := range n {
+		meta := footer.Blocks.At(i)
+		if meta.Offset < 0 || meta.Length < 0 || meta.Length > math.MaxUint32 || meta.RecordCount < 0 || meta.RecordCount > math.MaxUint32 {
+			return nil, fmt.Errorf("block %d does not fit a binary footer entry", i)
+		}
+		var flags uint32
+		if meta.IsDistinct {
+			flags |= entryDistinct
+		}
+		if meta.Cold {
+			flags |= entryCold
+		}
+		var lo, hi float64
+		if meta.MinValue != nil && meta.MaxValue != nil {
+			flags |= entryZone
+			lo, hi = *meta.MinValue, *meta.MaxValue
+		}
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(meta.Offset))
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(meta.Length))
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(meta.RecordCount))
+		dst = binary.LittleEndian.AppendUint32(dst, meta.Checksum)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(meta.Part))
+		dst = binary.LittleEndian.AppendUint32(dst, flags)
+		dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(lo))
+		dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(hi))
+		copy(keys[i*stride:], meta.StartKey)
+		copy(keys[(n+i)*stride:], meta.EndKey)
+	}
+	return append(dst, keys...), nil
+}
+
+func appendFooterString(dst []byte, s string) []byte {
+	return append(binary.AppendUvarint(dst, uint64(len(s))), s...)
+}
+
+// decodeFooter decodes a binary footer. The block table is copied, not
+// decoded, so data may be a mapping that is unmapped later.
+func decodeFooter(data []byte) (SparseIndex, error) {
+	var footer SparseIndex
+	d := footerDecoder{data: data}
+	flags := d.byte()
+	footer.ZoneMaps = flags&footerZoneMaps != 0
+	footer.Checksums = flags&footerChecksums != 0
+	footer.Codec = d.string()
+	footer.ZoneColumn = d.string()
+	footer.ColdStore = d.string()
+	footer.ColdFile = d.string()
+	if parts := d.uvarint(); parts > 0 && d.err == nil {
+		if parts > uint64(len(d.data)) {
+			return footer, fmt.Errorf("invalid footer: %d parts", parts)
+		}
+		footer.Parts = make([]string, parts)
+		for i := range footer.Parts {
+			footer.Parts[i] = d.string()
+		}
+	}
+	n, stride := d.uvarint(), d.uvarint()
+	if d.err != nil {
+		return footer, d.err
+	}
+	rest := d.data[d.pos:]
+	if n > uint64(len(rest))/blockEntrySize || stride > uint64(len(rest)) || n*(blockEntrySize+2*stride) != uint64(len(rest)) {
+		return footer, fmt.Errorf("invalid footer: %d blocks with %d-byte keys in %d bytes", n, stride, len(rest))
+	}
+	entries := make([]byte, len(rest))
+	copy(entries, rest)
+	footer.Blocks = BlockList{entries: entries, n: int(n), stride: int(stride)}
+	return footer, nil
+}
+
+// footerDecoder reads the fields of a binary footer; the first error sticks.
+type footerDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *footerDecoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.data) {
+		d.err = fmt.Errorf("invalid footer: truncated")
+		return 0
+	}
+	d.pos++
+	return d.data[d.pos-1]
+}
+
+func (d *footerDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid footer: truncated")
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *footerDecoder) string() string {
+	l := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if l > uint64(len(d.data)-d.pos) {
+		d.err = fmt.Errorf("invalid footer: truncated")
+		return ""
+	}
+	d.pos += int(l)
+	return string(d.data[d.pos-int(l) : d.pos])
+}
+
+// parseFooter decodes the footer of an index whose file starts with magic.
+func parseFooter(magic []byte, data []byte) (SparseIndex, error) {
+	switch string(magic) {
+	case MagicCIDX2:
+		return decodeFooter(data)
+	case MagicCIDX:
+		var footer SparseIndex
+		err := json.Unmarshal(data, &footer)
+		return footer, err
+	}
+	return SparseIndex{}, fmt.Errorf("not an index file (magic %q)", magic)
+}
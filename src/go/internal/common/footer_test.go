@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryFooter(t *testing.T) {
+	lo, hi := -1.5, 42.0
+	footer := SparseIndex{
+		Blocks: NewBlockList([]BlockMeta{
+			{StartKey: "", EndKey: "NULL", Offset: 4, Length: 100, RecordCount: 10, IsDistinct: false, Checksum: 0xdeadbeef},
+			{StartKey: "caf\xe9", EndKey: "caf\xe9", Offset: 104, Length: 1 << 20, RecordCount: 1, IsDistinct: true, MinValue: &lo, MaxValue: &hi, Cold: true, Part: 3},
+		}),
+		ZoneMaps:   true,
+		ZoneColumn: "price",
+		Checksums:  true,
+		Codec:      CodecZstd,
+		ColdStore:  "s3://bucket/cold",
+		ColdFile:   "x.cold",
+		Parts:      []string{"x.cidx.p1", "x.cidx.p2", "x.cidx.p3"},
+	}
+	data, err := appendFooter(nil, &footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := parseFooter([]byte(MagicCIDX2), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Blocks.Len() != 2 {
+		t.Fatalf("%d blocks read back", back.Blocks.Len())
+	}
+	if !reflect.DeepEqual(back.Blocks.Slice(), footer.Blocks.Slice()) {
+		t.Errorf("Blocks read back as %+v", back.Blocks.Slice())
+	}
+	back.Blocks, footer.Blocks = BlockList{}, BlockList{}
+	if !reflect.DeepEqual(back, footer) {
+		t.Errorf("Footer read back as %+v", back)
+	}
+
+	bad := SparseIndex{Blocks: NewBlockList([]BlockMeta{{StartKey: "a\x00"}})}
+	if _, err := appendFooter(nil, &bad); err == nil {
+		t.Error("Key ending with a NUL byte was written")
+	}
+
+	// Truncated footers fail cleanly
+	for _, n := range []int{0, 1, 10, len(data) - 1} {
+		if _, err := parseFooter([]byte(MagicCIDX2), data[:n]); err == nil {
+			t.Errorf("Footer truncated to %d bytes was read", n)
+		}
+	}
+	if _, err := parseFooter([]byte("JUNK"), data); err == nil {
+		t.Error("File with an unknown magic was read")
+	}
+}
+
+func TestFooterFormats(t *testing.T) {
+	// An index as written now, and the same blocks with a JSON footer
+	var buf bytes.Buffer
+	bw, err := NewBlockWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5000 {
+		var rec IndexRecord
+		PutKey(&rec.Key, []byte(fmt.Sprintf("key%05d", i)))
+		rec.Offset, rec.Line = int64(i*10), int64(i+2)
+		if err := bw.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	current := buf.Bytes()
+	if string(current[:4]) != MagicCIDX2 {
+		t.Fatalf("Index starts with %q", current[:4])
+	}
+	footerLen := int(binary.BigEndian.Uint64(current[len(current)-8:]))
+	jsonFooter, err := json.Marshal(bw.sparseIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := append([]byte(MagicCIDX), current[4:len(current)-8-footerLen]...)
+	legacy = append(legacy, jsonFooter...)
+	legacy = binary.BigEndian.AppendUint64(legacy, uint64(len(jsonFooter)))
+
+	for name, data := range map[string][]byte{"binary": current, "json": legacy} {
+		br, err := NewBlockReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if br.Footer.Blocks.Len() < 2 || !br.Footer.Checksums || !br.Footer.ZoneMaps {
+			t.Fatalf("%s: footer %+v", name, br.Footer)
+		}
+		records := 0
+		for i, meta := range br.Footer.Blocks.All() {
+			recs, err := br.ReadBlock(meta)
+			if err != nil {
+				t.Fatalf("%s: block %d: %v", name, i, err)
+			}
+			if KeyString(&recs[0].Key) != meta.StartKey || KeyString(&recs[len(recs)-1].Key) != meta.EndKey {
+				t.Errorf("%s: block %d keys %q-%q, footer says %q-%q", name, i, recs[0].Key, recs[len(recs)-1].Key, meta.StartKey, meta.EndKey)
+			}
+			records += len(recs)
+		}
+		if records != 5000 {
+			t.Errorf("%s: %d records", name, records)
+		}
+	}
+}
+
+func TestBlockListSearch(t *testing.T) {
+	starts := []string{"b", "d", "d", "d", "f", "h\xff"}
+	var blocks []BlockMeta
+	for i, k := range starts {
+		blocks = append(blocks, BlockMeta{StartKey: k, EndKey: k + "z", Offset: int64(i)})
+	}
+	decoded := NewBlockList(blocks)
+	data, err := appendFooter(nil, &SparseIndex{Blocks: decoded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	footer, err := parseFooter([]byte(MagicCIDX2), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key          string
+		lower, upper int
+	}{
+		{"", 0, 0},
+		{"a", 0, 0},
+		{"b", 0, 1},
+		{"c", 1, 1},
+		{"d", 1, 4},
+		{"dz", 4, 4},
+		{"f", 4, 5},
+		{"h\xff", 5, 6},
+		{"z", 6, 6},
+	}
+	for name, list := range map[string]BlockList{"decoded": decoded, "binary": footer.Blocks} {
+		for _, tt := range tests {
+			if got := list.LowerBound(tt.key); got != tt.lower {
+				t.Errorf("%s: LowerBound(%q) = %d, want %d", name, tt.key, got, tt.lower)
+			}
+			if got := list.UpperBound(tt.key); got != tt.upper {
+				t.Errorf("%s: UpperBound(%q) = %d, want %d", name, tt.key, got, tt.upper)
+			}
+		}
+		for i, k := range starts {
+			if list.StartKey(i) != k || list.EndKey(i) != k+"z" {
+				t.Errorf("%s: block %d keys %q-%q", name, i, list.StartKey(i), list.EndKey(i))
+			}
+		}
+	}
+}
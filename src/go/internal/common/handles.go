@@ -0,0 +1,240 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// HandlePool keeps the files queries read open between them: index
+// readers, mapped CSVs and bloom filters. A query of a file opened recently
+// skips opening, mapping and parsing it again. A file is reopened when it
+// changes (size or modification time), while queries still reading the old
+// one finish with it, and closed once idle for handleIdleTimeout or when
+// more than the pool's limit are idle, least recently used first. Safe for
+// concurrent use.
+type HandlePool struct {
+	mu     sync.Mutex
+	max    int
+	open   map[handleKey]*handle
+	closed bool
+}
+
+// handleKey identifies a pooled file: its kind and where it is.
+type handleKey struct {
+	kind handleKind
+	name string // Location and name
+}
+
+type handleKind int
+
+const (
+	handleIndex handleKind = iota // *BlockReader
+	handleMap                     // []byte, a mapped file
+	handleBloom                   // *BloomFilter
+)
+
+type handle struct {
+	value    any
+	close    func()
+	info     storage.Info
+	refs     int  // Users that have not released it yet
+	stale    bool // Out of the pool: close once unused
+	lastUsed time.Time
+}
+
+// handleIdleTimeout is how long an unused file stays open.
+const handleIdleTimeout = time.Minute
+
+// NewHandlePool returns a pool keeping up to maxIdle unused files open.
+func NewHandlePool(maxIdle int) *HandlePool {
+	return &HandlePool{max: maxIdle, open: make(map[handleKey]*handle)}
+}
+
+// acquire returns the value of a pooled file, opening it with open when it
+// isn't pooled or changed since (info is its current state), and a func
+// releasing it. Unpooled values (pool closed) are closed on release.
+func (p *HandlePool) acquire(key handleKey, info storage.Info, open func() (any, func(), error)) (any, func(), error) {
+	p.mu.Lock()
+	if h, ok := p.open[key]; ok {
+		if h.info.Size == info.Size && h.info.ModTime.Equal(info.ModTime) {
+			release := p.use(h)
+			p.mu.Unlock()
+			return h.value, release, nil
+		}
+		p.retire(key, h)
+	}
+	p.mu.Unlock()
+
+	value, closeFn, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return value, closeFn, nil
+	}
+	if old, ok := p.open[key]; ok {
+		p.retire(key, old) // Opened concurrently
+	}
+	h := &handle{value: value, close: closeFn, info: info}
+	p.open[key] = h
+	release := p.use(h)
+	p.sweep()
+	return value, release, nil
+}
+
+// use takes a reference to h and returns the func dropping it. Called with
+// p.mu held.
+func (p *HandlePool) use(h *handle) func() {
+	h.refs++
+	h.lastUsed = time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			h.refs--
+			h.lastUsed = time.Now()
+			if h.stale && h.refs == 0 {
+				h.close()
+			}
+			p.sweep()
+		})
+	}
+}
+
+// retire removes a pooled file, closing it once unused. Called with p.mu
+// held.
+func (p *HandlePool) retire(key handleKey, h *handle) {
+	delete(p.open, key)
+	h.stale = true
+	if h.refs == 0 {
+		h.close()
+	}
+}
+
+// sweep closes files idle for too long, then the least recently used idle
+// ones beyond the limit. Called with p.mu held.
+func (p *HandlePool) sweep() {
+	now := time.Now()
+	idle := 0
+	for key, h := range p.open {
+		switch {
+		case h.refs > 0:
+		case now.Sub(h.lastUsed) > handleIdleTimeout:
+			p.retire(key, h)
+		default:
+			idle++
+		}
+	}
+	for ; idle > p.max; idle-- {
+		var oldestKey handleKey
+		var oldest *handle
+		for key, h := range p.open {
+			if h.refs == 0 && (oldest == nil || h.lastUsed.Before(oldest.lastUsed)) {
+				oldestKey, oldest = key, h
+			}
+		}
+		p.retire(oldestKey, oldest)
+	}
+}
+
+// OpenIndex returns a reader of the index name in store, like
+// OpenBlockReader: a fork of the pooled reader, with its own decode
+// buffers over the shared mapping. Its Cleanup returns it to the pool.
+func (p *HandlePool) OpenIndex(store storage.Backend, name string) (*BlockReader, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	key := handleKey{kind: handleIndex, name: store.String() + "/" + name}
+	value, release, err := p.acquire(key, info, func() (any, func(), error) {
+		br, err := OpenBlockReader(store, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return br, br.Cleanup, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fork := value.(*BlockReader).Fork()
+	if fork == nil { // Not shareable (OpenBlockReader readers always are)
+		release()
+		return OpenBlockReader(store, name)
+	}
+	fork.release = release
+	return fork, nil
+}
+
+// MapFile returns the contents of the file at path, memory-mapped like
+// MmapFile, and a func releasing them. Errors opening the file are those
+// of os.Open.
+func (p *HandlePool) MapFile(path string) ([]byte, func(), error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := handleKey{kind: handleMap, name: path}
+	value, release, err := p.acquire(key, storage.Info{Size: info.Size(), ModTime: info.ModTime()}, func() (any, func(), error) {
+		return MapFile(path)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return value.([]byte), release, nil
+}
+
+// OpenBloom returns the bloom filter name in store, like OpenBloomFilter.
+func (p *HandlePool) OpenBloom(store storage.Backend, name string) (*BloomFilter, func(), error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := handleKey{kind: handleBloom, name: store.String() + "/" + name}
+	value, release, err := p.acquire(key, info, func() (any, func(), error) {
+		bloom, cleanup, err := OpenBloomFilter(store, name)
+		return bloom, cleanup, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return value.(*BloomFilter), release, nil
+}
+
+// MapFile maps the file at path like MmapFile and returns a func unmapping
+// it. Errors opening the file are those of os.Open.
+func MapFile(path string) ([]byte, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	data, err := MmapFile(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to mmap %s: %w", path, err)
+	}
+	return data, func() { _ = MunmapFile(data) }, nil
+}
+
+// Len returns the number of files open.
+func (p *HandlePool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.open)
+}
+
+// Close closes every pooled file once unused; later opens are not pooled.
+func (p *HandlePool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, h := range p.open {
+		p.retire(key, h)
+	}
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+func TestHandlePool(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewLocal(dir)
+	writeTestIndex(t, filepath.Join(dir, "a.cidx"), "a", 5000)
+	pool := NewHandlePool(1)
+
+	firstKey := func(br *BlockReader) string {
+		t.Helper()
+		records, err := br.ReadBlock(br.Footer.Blocks.At(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return KeyString(&records[0].Key)
+	}
+
+	r1, err := pool.OpenIndex(store, "a.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := pool.OpenIndex(store, "a.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &r1.mmapData[0] != &r2.mmapData[0] {
+		t.Error("Readers of the same index do not share its mapping")
+	}
+	if firstKey(r1) != "a00000" || firstKey(r2) != "a00000" {
+		t.Error("Pooled readers read the wrong blocks")
+	}
+	r1.Cleanup()
+	r2.Cleanup()
+	r2.Cleanup() // Twice is harmless
+	if pool.Len() != 1 {
+		t.Errorf("%d indexes open, want 1", pool.Len())
+	}
+
+	// An index replaced on disk is reopened, while readers of the old one
+	// keep reading it
+	r3, err := pool.OpenIndex(store, "a.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestIndex(t, filepath.Join(dir, "new.cidx"), "b", 6000)
+	if err := os.Rename(filepath.Join(dir, "new.cidx"), filepath.Join(dir, "a.cidx")); err != nil {
+		t.Fatal(err)
+	}
+	r4, err := pool.OpenIndex(store, "a.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstKey(r3) != "a00000" || firstKey(r4) != "b00000" {
+		t.Errorf("Readers across a rebuild read %q and %q", firstKey(r3), firstKey(r4))
+	}
+	r3.Cleanup()
+	r4.Cleanup()
+
+	// Idle indexes beyond the limit are closed
+	writeTestIndex(t, filepath.Join(dir, "c.cidx"), "c", 100)
+	r5, err := pool.OpenIndex(store, "c.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r5.Cleanup()
+	if pool.Len() != 1 {
+		t.Errorf("%d indexes open, want 1", pool.Len())
+	}
+
+	pool.Close()
+	if pool.Len() != 0 {
+		t.Errorf("%d indexes open after Close", pool.Len())
+	}
+	r6, err := pool.OpenIndex(store, "c.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstKey(r6) != "c00000" {
+		t.Error("Reader after Close reads the wrong blocks")
+	}
+	r6.Cleanup()
+}
+
+func TestHandlePoolFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewLocal(dir)
+	pool := NewHandlePool(8)
+	defer pool.Close()
+
+	csvPath := filepath.Join(dir, "a.csv")
+	if err := os.WriteFile(csvPath, []byte("id\n1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d1, release1, err := pool.MapFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, release2, err := pool.MapFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &d1[0] != &d2[0] {
+		t.Error("Mappings of the same file are not shared")
+	}
+	release1()
+	release1() // Twice is harmless
+	release2()
+
+	// A changed file is mapped again
+	if err := os.WriteFile(csvPath, []byte("id\n1\n2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d3, release3, err := pool.MapFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d3) != "id\n1\n2\n" {
+		t.Errorf("Changed file read as %q", d3)
+	}
+	release3()
+	if _, _, err := pool.MapFile(filepath.Join(dir, "missing.csv")); !os.IsNotExist(err) {
+		t.Errorf("Missing file: %v", err)
+	}
+
+	bloom := NewBloomFilter(100, 0.01)
+	bloom.Add("x")
+	if err := os.WriteFile(filepath.Join(dir, "a.bloom"), bloom.Serialize(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		b, release, err := pool.OpenBloom(store, "a.bloom")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.MightContain("x") {
+			t.Error("Pooled bloom filter lost its key")
+		}
+		release()
+	}
+	if pool.Len() != 2 {
+		t.Errorf("%d files open, want 2", pool.Len())
+	}
+}
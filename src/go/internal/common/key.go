@@ -0,0 +1,184 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Composite index keys are JSON arrays of strings: ["active","books"].
+// Values are escaped like JSON strings (\", \\, control characters), so a
+// value containing quotes or separators cannot run into its neighbour.
+// Values without those characters encode exactly as in older indexes.
+
+const hexDigits = "0123456789abcdef"
+
+// AppendCompositeKey appends the composite key of values to dst. The
+// indexer and the query planner must both build keys through it.
+func AppendCompositeKey(dst []byte, values [][]byte) []byte {
+	dst = append(dst, '[')
+	for i, v := range values {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		for _, c := range v {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			default:
+				dst = append(dst, c)
+			}
+		}
+		dst = append(dst, '"')
+	}
+	return append(dst, ']')
+}
+
+// CompositeKey returns the composite key of string values.
+func CompositeKey(values []string) string {
+	raw := make([][]byte, len(values))
+	size := 2
+	for i, v := range values {
+		raw[i] = []byte(v)
+		size += len(v) + 3
+	}
+	return string(AppendCompositeKey(make([]byte, 0, size), raw))
+}
+
+// SplitCompositeKey decodes a composite key back into its values.
+func SplitCompositeKey(key string) ([]string, error) {
+	var values []string
+	if err := json.Unmarshal([]byte(key), &values); err != nil {
+		return nil, fmt.Errorf("invalid composite key %q: %w", key, err)
+	}
+	return values, nil
+}
+
+// KeySize is the width of IndexRecord.Key. Longer keys are truncated.
+const KeySize = 64
+
+// Keys are stored NUL-padded to KeySize, so a key's own NUL bytes would be
+// lost with the padding. They are escaped order-preservingly instead:
+// 0x00 -> 0x01 0x01 and 0x01 -> 0x01 0x02. Other bytes, including non-UTF-8
+// sequences, are stored as is, so text keys are unchanged. Search keys,
+// block StartKey/EndKey and bloom filters all use this stored form.
+const keyEscape = 0x01
+
+// PutKey stores key into dst and reports whether it had to be truncated.
+func PutKey(dst *[KeySize]byte, key []byte) (truncated bool) {
+	n := 0
+	for _, c := range key {
+		if c > keyEscape {
+			if n == KeySize {
+				return true
+			}
+			dst[n] = c
+			n++
+			continue
+		}
+		if n+2 > KeySize {
+			clear(dst[n:])
+			return true
+		}
+		dst[n], dst[n+1] = keyEscape, c+1
+		n += 2
+	}
+	clear(dst[n:])
+	return false
+}
+
+// EncodeKey returns the stored form of key, and whether it was truncated.
+func EncodeKey(key string) (string, bool) {
+	var buf [KeySize]byte
+	truncated := PutKey(&buf, []byte(key))
+	return KeyString(&buf), truncated
+}
+
+// KeyString returns the stored form of a record key, without padding.
+func KeyString(key *[KeySize]byte) string {
+	n := KeySize
+	for n > 0 && key[n-1] == 0 {
+		n--
+	}
+	return string(key[:n])
+}
+
+// DecodeKey turns a stored key back into the (possibly truncated) value.
+func DecodeKey(stored string) string {
+	if strings.IndexByte(stored, keyEscape) < 0 {
+		return stored
+	}
+	buf := make([]byte, 0, len(stored))
+	for i := 0; i < len(stored); i++ {
+		if stored[i] == keyEscape && i+1 < len(stored) {
+			i++
+			buf = append(buf, stored[i]-1)
+			continue
+		}
+		buf = append(buf, stored[i])
+	}
+	return string(buf)
+}
+
+// KeyMayBeTruncated reports whether a stored key is long enough that the
+// value it came from may have been cut. Such keys are only a prefix: a
+// lookup must confirm matches against the row.
+func KeyMayBeTruncated(stored string) bool {
+	return len(stored) >= KeySize-1
+}
+
+// IsNullKey reports whether a stored key stands for a null value: empty
+// (also the key of a missing column) or the literal NULL, as IS NULL
+// filters define it. Composite keys are never null.
+func IsNullKey(stored string) bool {
+	return stored == "" || stored == "NULL"
+}
+
+// IsNullRecordKey is IsNullKey for a record key, without allocating.
+func IsNullRecordKey(key *[KeySize]byte) bool {
+	return key[0] == 0 || (key[4] == 0 && string(key[:4]) == "NULL")
+}
+
+// CollationCI is the collation of case-insensitive indexes: their keys are
+// stored case-folded, and searched with keys folded the same way.
+const CollationCI = "ci"
+
+// FoldKey returns the case-insensitive form of a key: its Unicode lower
+// case, except the literal NULL, which stays the null marker of IsNullKey.
+// Composite keys fold as a whole, their escapes being lowercase already.
+func FoldKey(key string) string {
+	if key == "NULL" {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+// AppendFoldKey appends FoldKey of key to dst.
+func AppendFoldKey(dst, key []byte) []byte {
+	if string(key) == "NULL" {
+		return append(dst, key...)
+	}
+	for _, c := range key {
+		if c >= utf8.RuneSelf {
+			return append(dst, bytes.ToLower(key)...)
+		}
+	}
+	for _, c := range key {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompositeKey(t *testing.T) {
+	// Unchanged encoding for plain values (existing indexes stay valid)
+	if got := CompositeKey([]string{"active", "books"}); got != `["active","books"]` {
+		t.Errorf("Plain values encoded as %s", got)
+	}
+
+	// Values that collided under naive quoting
+	a := CompositeKey([]string{`x","y`, "z"})
+	b := CompositeKey([]string{"x", `y","z`})
+	if a == b {
+		t.Errorf("Distinct values share key %s", a)
+	}
+
+	for _, values := range [][]string{
+		{`x","y`, "z"},
+		{`say "hi"`, `back\slash`},
+		{"line\nbreak", "tab\there", "\x01"},
+		{"", ""},
+	} {
+		key := CompositeKey(values)
+		got, err := SplitCompositeKey(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("Round trip of %q gave %q (key %s)", values, got, key)
+		}
+	}
+
+	// The scanner's byte path must produce the same key
+	raw := AppendCompositeKey(nil, [][]byte{[]byte(`a"b`), nil})
+	if string(raw) != CompositeKey([]string{`a"b`, ""}) {
+		t.Errorf("AppendCompositeKey %s differs from CompositeKey", raw)
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	values := []string{"", "a", "a\x00", "a\x00\x00", "a\x01", "a\x02", "\x00b", "caf\xe9", "\xff\xfe", "plain text"}
+	var stored []string
+	for _, v := range values {
+		var key [KeySize]byte
+		if PutKey(&key, []byte(v)) {
+			t.Fatalf("%q reported as truncated", v)
+		}
+		s := KeyString(&key)
+		if got := DecodeKey(s); got != v {
+			t.Errorf("Round trip of %q gave %q", v, got)
+		}
+		if enc, _ := EncodeKey(v); enc != s {
+			t.Errorf("EncodeKey(%q) = %q, stored %q", v, enc, s)
+		}
+		stored = append(stored, s)
+	}
+	// Text keys are stored as is (existing indexes stay valid)
+	if stored[len(stored)-1] != "plain text" {
+		t.Errorf("Plain key stored as %q", stored[len(stored)-1])
+	}
+	// Stored keys sort like the values
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	byStored := slices.Clone(values)
+	slices.SortFunc(byStored, func(a, b string) int {
+		ea, _ := EncodeKey(a)
+		eb, _ := EncodeKey(b)
+		return strings.Compare(ea, eb)
+	})
+	if !slices.Equal(sorted, byStored) {
+		t.Errorf("Stored order %q differs from value order %q", byStored, sorted)
+	}
+
+	// Truncation never leaves half an escape behind
+	long := strings.Repeat("x", KeySize-1) + "\x00"
+	enc, truncated := EncodeKey(long)
+	if !truncated || enc != long[:KeySize-1] || !KeyMayBeTruncated(enc) {
+		t.Errorf("EncodeKey of %d bytes = %q, truncated %v", len(long), enc, truncated)
+	}
+	if _, truncated := EncodeKey(strings.Repeat("x", KeySize)); truncated {
+		t.Error("Key of exactly KeySize bytes reported as truncated")
+	}
+
+	// Footers keep non-UTF-8 keys intact
+	meta := SparseIndex{Blocks: NewBlockList([]BlockMeta{{StartKey: "caf\xe9", EndKey: "\xff", RecordCount: 2}, {StartKey: "ok"}})}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back SparseIndex
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, meta) {
+		t.Errorf("Footer round trip gave %+v (JSON %s)", back, data)
+	}
+}
@@ -0,0 +1,80 @@
+package common
+
+import "bytes"
+
+// HistogramBuckets is the least number of buckets of the histogram an
+// index build records (see KeyStats); there are fewer only when the index
+// has fewer non-null keys.
+const HistogramBuckets = 16
+
+// KeyHistogram is an equi-depth histogram of the non-null keys of an
+// index, in key order: bucket i ends with key Bounds[i] and holds Depth
+// records. The records after the last bound, up to IndexStats.MaxKey, make
+// a last, smaller bucket. The bounds are thus an evenly spaced sample of
+// the sorted keys: the share of them a predicate accepts estimates the
+// share of the rows it does.
+type KeyHistogram struct {
+	Bounds []string `json:"bounds"` // As stored (see EncodeKey)
+	Depth  int64    `json:"depth"`
+}
+
+// KeyStats collects the key statistics of IndexStats from the records of
+// an index, fed in index order.
+type KeyStats struct {
+	records  int64
+	nulls    int64
+	keyBytes int64 // Stored length of the non-null keys
+	min      string
+	last     [KeySize]byte // Largest non-null key so far
+
+	// Histogram: every step-th non-null key. Once the bounds reach twice
+	// HistogramBuckets, every other one is dropped and the step doubles.
+	step   int64
+	bounds []string
+}
+
+// Add counts a record. Records must come in index order.
+func (k *KeyStats) Add(rec *IndexRecord) {
+	k.records++
+	if IsNullRecordKey(&rec.Key) {
+		k.nulls++
+		return
+	}
+	n := int64(KeySize)
+	if i := bytes.IndexByte(rec.Key[:], 0); i >= 0 {
+		n = int64(i)
+	}
+	if k.records == k.nulls+1 {
+		k.min = KeyString(&rec.Key)
+		k.step = 1
+	}
+	k.keyBytes += n
+	k.last = rec.Key
+
+	if (k.records-k.nulls)%k.step != 0 {
+		return
+	}
+	k.bounds = append(k.bounds, KeyString(&rec.Key))
+	if len(k.bounds) == 2*HistogramBuckets {
+		for i := range HistogramBuckets {
+			k.bounds[i] = k.bounds[2*i+1]
+		}
+		k.bounds = k.bounds[:HistogramBuckets]
+		k.step *= 2
+	}
+}
+
+// Apply records the statistics in stats.
+func (k *KeyStats) Apply(stats *IndexStats) {
+	nulls := k.nulls
+	stats.NullCount = &nulls
+	stats.Records = k.records
+	stats.MinKey, stats.MaxKey, stats.AvgKeyLen = "", "", 0
+	stats.Histogram = &KeyHistogram{Bounds: []string{}}
+	if keys := k.records - k.nulls; keys > 0 {
+		stats.MinKey = k.min
+		stats.MaxKey = KeyString(&k.last)
+		stats.AvgKeyLen = float64(k.keyBytes) / float64(keys)
+		stats.Histogram = &KeyHistogram{Bounds: append([]string(nil), k.bounds...), Depth: k.step}
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeyStats(t *testing.T) {
+	var keys KeyStats
+	add := func(key string) {
+		var rec IndexRecord
+		copy(rec.Key[:], key)
+		keys.Add(&rec)
+	}
+	add("")
+	add("")
+	const n = 1000
+	for i := range n {
+		add(fmt.Sprintf("k%04d", i))
+	}
+
+	var stats IndexStats
+	keys.Apply(&stats)
+	if stats.Records != n+2 || stats.NullCount == nil || *stats.NullCount != 2 {
+		t.Fatalf("Records %d, nulls %v", stats.Records, stats.NullCount)
+	}
+	if stats.MinKey != "k0000" || stats.MaxKey != "k0999" || stats.AvgKeyLen != 5 {
+		t.Errorf("Min %q, max %q, avg length %v", stats.MinKey, stats.MaxKey, stats.AvgKeyLen)
+	}
+
+	h := stats.Histogram
+	if len(h.Bounds) < HistogramBuckets || len(h.Bounds) >= 2*HistogramBuckets {
+		t.Fatalf("%d buckets", len(h.Bounds))
+	}
+	for i, bound := range h.Bounds {
+		// Bucket i ends with the (i+1)*Depth-th non-null key
+		if want := fmt.Sprintf("k%04d", int64(i+1)*h.Depth-1); bound != want {
+			t.Errorf("Bound %d = %q, want %q", i, bound, want)
+		}
+	}
+	if rest := n - int64(len(h.Bounds))*h.Depth; rest < 0 || rest >= h.Depth {
+		t.Errorf("Last bucket holds %d keys, depth %d", rest, h.Depth)
+	}
+
+	// All null: no key range, an empty histogram
+	var nulls KeyStats
+	var rec IndexRecord
+	copy(rec.Key[:], "NULL")
+	nulls.Add(&rec)
+	nulls.Apply(&stats)
+	if stats.Records != 1 || *stats.NullCount != 1 || stats.MinKey != "" || stats.Histogram == nil || len(stats.Histogram.Bounds) != 0 {
+		t.Errorf("All-null stats %+v", stats)
+	}
+}
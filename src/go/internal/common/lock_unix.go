@@ -0,0 +1,18 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile acquires an exclusive lock on the file, blocking until it is free.
+func LockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+// UnlockFile releases the lock
+func UnlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+package common
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockRange covers the whole file (and anything appended later).
+// LockFileEx locks byte ranges, so we lock the maximum range to get the
+// same whole-file semantics as flock(LOCK_EX) on Unix.
+const (
+	lockRangeLow  = ^uint32(0)
+	lockRangeHigh = ^uint32(0)
+)
+
+// LockFile acquires an exclusive lock on the file.
+// Blocks until the lock is available, like the Unix flock path.
+func LockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.LockFileEx(
+		windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0,
+		lockRangeLow,
+		lockRangeHigh,
+		ol,
+	)
+}
+
+// UnlockFile releases the lock
+func UnlockFile(file *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.UnlockFileEx(
+		windows.Handle(file.Fd()),
+		0,
+		lockRangeLow,
+		lockRangeHigh,
+		ol,
+	)
+}
@@ -8,6 +8,9 @@ import (
 	"syscall"
 )
 
+// mmapSupported tells whether MmapFile maps files (see OpenBlockReader).
+const mmapSupported = true
+
 // MmapFile memory maps a file for reading
 func MmapFile(f *os.File) ([]byte, error) {
 	stat, err := f.Stat()
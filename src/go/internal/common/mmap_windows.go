@@ -8,6 +8,10 @@ import (
 	"os"
 )
 
+// mmapSupported tells whether MmapFile maps files. Without it, indexes are
+// read block by block (see OpenBlockReader) rather than loaded whole.
+const mmapSupported = false
+
 // MmapFile memory maps a file (Fallback to ReadAll on Windows for now to avoid unsafe pointer arithmetic complexity without external lib)
 // TODO: Implement proper Windows mmap
 func MmapFile(f *os.File) ([]byte, error) {
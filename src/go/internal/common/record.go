@@ -0,0 +1,88 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+
+	"github.com/entreya/csvquery/internal/simd"
+)
+
+// RecordEnd returns the index of the newline that ends the CSV record at
+// the start of data: the first one outside double quotes, so quoted fields
+// may span lines (RFC 4180). It returns -1 if the record runs to the end of
+// data. Quotes are counted a line at a time with SIMD.
+func RecordEnd(data []byte) int {
+	var quotes uint64
+	for pos := 0; ; {
+		nl := bytes.IndexByte(data[pos:], '\n')
+		if nl < 0 {
+			return -1
+		}
+		quotes += simd.ScanSeparators(data[pos:pos+nl], '"')
+		if quotes%2 == 0 {
+			return pos + nl
+		}
+		pos += nl + 1
+	}
+}
+
+// ReadCSVRecord reads the next record from r, with its terminator (none on
+// a last record without one). Like RecordEnd, newlines inside quoted fields
+// do not end it. At the end of input it returns io.EOF with what was read.
+func ReadCSVRecord(r *bufio.Reader) ([]byte, error) {
+	record, err := r.ReadBytes('\n')
+	if err != nil {
+		return record, err
+	}
+	quotes := simd.ScanSeparators(record, '"')
+	for quotes%2 != 0 {
+		line, err := r.ReadBytes('\n')
+		record = append(record, line...)
+		if err != nil {
+			return record, err
+		}
+		quotes += simd.ScanSeparators(line, '"')
+	}
+	return record, nil
+}
+
+// SplitFields appends the fields of record, a CSV record without its
+// terminator, to dst as stored: quoted fields keep their quotes and escapes,
+// so writing them back joined by sep reproduces the record.
+func SplitFields(record []byte, sep byte, dst [][]byte) [][]byte {
+	start := 0
+	inQuote := false
+	for i, b := range record {
+		switch {
+		case b == '"':
+			inQuote = !inQuote
+		case b == sep && !inQuote:
+			dst = append(dst, record[start:i])
+			start = i + 1
+		}
+	}
+	return append(dst, record[start:])
+}
+
+// AppendField appends value to dst as a CSV field, quoted (with quotes
+// doubled) if it holds sep, a quote, a newline or surrounding spaces.
+func AppendField(dst []byte, value string, sep byte) []byte {
+	needs := value != "" && (value[0] == ' ' || value[len(value)-1] == ' ')
+	for i := 0; i < len(value) && !needs; i++ {
+		switch value[i] {
+		case sep, '"', '\n', '\r':
+			needs = true
+		}
+	}
+	if !needs {
+		return append(dst, value...)
+	}
+	dst = append(dst, '"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' {
+			dst = append(dst, '"')
+		}
+		dst = append(dst, value[i])
+	}
+	return append(dst, '"')
+}
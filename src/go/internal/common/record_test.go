@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecordEnd(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want int
+	}{
+		{"a,b\nc,d\n", 3},
+		{"a,\"b\nc\",d\nx\n", 9},
+		{"a,\"say \"\"hi\"\"\nthere\"\nx\n", 20},
+		{"a,\"open\nstill open", -1},
+		{"no newline", -1},
+	} {
+		if got := RecordEnd([]byte(tc.data)); got != tc.want {
+			t.Errorf("RecordEnd(%q) = %d, want %d", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestReadCSVRecord(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("id,note\r\n1,\"two\r\nlines\"\r\n2,\"a\n\"\"b\"\"\n\"\n3,last"))
+	want := []string{"id,note\r\n", "1,\"two\r\nlines\"\r\n", "2,\"a\n\"\"b\"\"\n\"\n", "3,last"}
+	for i, w := range want {
+		got, err := ReadCSVRecord(r)
+		if string(got) != w || (err != nil) != (i == len(want)-1) {
+			t.Errorf("Record %d: %q, %v; want %q", i, got, err, w)
+		}
+	}
+	if got, err := ReadCSVRecord(r); len(got) != 0 || err != io.EOF {
+		t.Errorf("After the last record: %q, %v", got, err)
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	record := "1,\"a, \"\"b\"\"\",,\"two\nlines\",last"
+	got := SplitFields([]byte(record), ',', nil)
+	want := []string{"1", "\"a, \"\"b\"\"\"", "", "\"two\nlines\"", "last"}
+	if len(got) != len(want) {
+		t.Fatalf("SplitFields = %q, want %q", got, want)
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("Field %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	for _, tc := range []struct{ value, want string }{
+		{"plain", "plain"},
+		{"", ""},
+		{"a;b", "a;b"},
+		{"a,b", "\"a,b\""},
+		{"say \"hi\"", "\"say \"\"hi\"\"\""},
+		{"two\nlines", "\"two\nlines\""},
+		{" padded", "\" padded\""},
+	} {
+		if got := string(AppendField(nil, tc.value, ',')); got != tc.want {
+			t.Errorf("AppendField(%q) = %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
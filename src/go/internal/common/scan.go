@@ -0,0 +1,270 @@
+package common
+
+import (
+	"bytes"
+	"math/bits"
+	"slices"
+
+	"github.com/entreya/csvquery/internal/simd"
+)
+
+// RecordScanner splits a chunk of CSV into records and fields using the
+// quote, separator and newline bitmaps of simd.ScanWithSeparator, 64 bytes
+// per word: separators and newlines between double quotes do not count, so
+// quoted fields may hold both (RFC 4180). The bitmaps are reused from chunk
+// to chunk. A RecordScanner is not safe for concurrent use; parallel scans
+// give each worker its own.
+type RecordScanner struct {
+	data     []byte
+	quotes   []uint64
+	seps     []uint64
+	newlines []uint64
+}
+
+// Reset builds the bitmaps of data.
+func (s *RecordScanner) Reset(data []byte, sep byte) {
+	words := (len(data) + 63) / 64
+	s.quotes = resetBitmap(s.quotes, words)
+	s.seps = resetBitmap(s.seps, words)
+	s.newlines = resetBitmap(s.newlines, words)
+	s.data = data
+	simd.ScanWithSeparator(data, sep, s.quotes, s.seps, s.newlines)
+}
+
+func resetBitmap(b []uint64, words int) []uint64 {
+	if cap(b) < words {
+		return make([]uint64, words)
+	}
+	b = b[:words]
+	clear(b)
+	return b
+}
+
+// Records calls fn for each record of the chunk, in order, with the start
+// of the record, the end of its content (its newline, or the end of the
+// chunk for a last record without one) and the start of the next record.
+// Empty lines are records too. fn returns false to stop.
+func (s *RecordScanner) Records(fn func(start, end, next int) bool) {
+	start := 0
+	inQuote := false
+	for w, nl := range s.newlines {
+		q := s.quotes[w]
+		if q == 0 {
+			if inQuote {
+				continue // Newlines inside a quoted field
+			}
+			for nl != 0 {
+				pos := w*64 + bits.TrailingZeros64(nl)
+				nl &= nl - 1
+				if !fn(start, pos, pos+1) {
+					return
+				}
+				start = pos + 1
+			}
+			continue
+		}
+		for combined := q | nl; combined != 0; combined &= combined - 1 {
+			bit := combined & -combined
+			if q&bit != 0 {
+				inQuote = !inQuote
+				continue
+			}
+			if inQuote {
+				continue
+			}
+			pos := w*64 + bits.TrailingZeros64(bit)
+			if !fn(start, pos, pos+1) {
+				return
+			}
+			start = pos + 1
+		}
+	}
+	if start < len(s.data) {
+		fn(start, len(s.data), len(s.data))
+	}
+}
+
+// Fields appends the fields of data[start:end], a record without its
+// newline, to dst and returns it, stopping after max fields. Surrounding
+// quotes are removed from a field; escaped quotes inside are left as they
+// are. The fields point into the chunk.
+func (s *RecordScanner) Fields(start, end, max int, dst [][]byte) [][]byte {
+	if max <= 0 {
+		return dst
+	}
+	fieldStart := start
+	inQuote := false
+	for w := start / 64; w*64 < end; w++ {
+		combined := s.quotes[w] | s.seps[w]
+		if lo := start - w*64; lo > 0 {
+			combined &^= 1<<uint(lo) - 1
+		}
+		if hi := end - w*64; hi < 64 {
+			combined &= 1<<uint(hi) - 1
+		}
+		for ; combined != 0; combined &= combined - 1 {
+			bit := combined & -combined
+			if s.quotes[w]&bit != 0 {
+				inQuote = !inQuote
+				continue
+			}
+			if inQuote {
+				continue
+			}
+			pos := w*64 + bits.TrailingZeros64(bit)
+			dst = append(dst, unquote(s.data[fieldStart:pos]))
+			if len(dst) >= max {
+				return dst
+			}
+			fieldStart = pos + 1
+		}
+	}
+	return append(dst, unquote(s.data[fieldStart:end]))
+}
+
+// Project appends the first len(used) fields of data[start:end], a record
+// without its newline, to dst as strings, unquoted as Fields leaves them:
+// the fields with used set are converted, the others are left empty. A
+// bitmap word without quotes whose separators end only unused fields is
+// taken a popcount at a time, so on wide rows the fields between those
+// needed are counted rather than split.
+func (s *RecordScanner) Project(start, end int, used []bool, dst []string) []string {
+	if len(used) == 0 {
+		return dst
+	}
+	field := 0 // Index of the field that starts at fieldStart
+	fieldStart := start
+	inQuote := false
+	for w := start / 64; w*64 < end; w++ {
+		mask := ^uint64(0)
+		if lo := start - w*64; lo > 0 {
+			mask &^= 1<<uint(lo) - 1
+		}
+		if hi := end - w*64; hi < 64 {
+			mask &= 1<<uint(hi) - 1
+		}
+		quotes, seps := s.quotes[w]&mask, s.seps[w]&mask
+		if quotes == 0 {
+			if inQuote || seps == 0 {
+				continue // No field ends in this word
+			}
+			if n := bits.OnesCount64(seps); field+n < len(used) && !slices.Contains(used[field:field+n], true) {
+				for range n {
+					dst = append(dst, "")
+				}
+				field += n
+				fieldStart = w*64 + 64 - bits.LeadingZeros64(seps)
+				continue
+			}
+		}
+		for combined := quotes | seps; combined != 0; combined &= combined - 1 {
+			bit := combined & -combined
+			if quotes&bit != 0 {
+				inQuote = !inQuote
+				continue
+			}
+			if inQuote {
+				continue
+			}
+			pos := w*64 + bits.TrailingZeros64(bit)
+			dst = append(dst, s.project(fieldStart, pos, used[field]))
+			if field++; field >= len(used) {
+				return dst
+			}
+			fieldStart = pos + 1
+		}
+	}
+	return append(dst, s.project(fieldStart, end, used[field]))
+}
+
+// project returns data[start:end] as a Project field.
+func (s *RecordScanner) project(start, end int, used bool) string {
+	if !used {
+		return ""
+	}
+	return string(unquote(s.data[start:end]))
+}
+
+// unquote removes the double quotes around a field.
+func unquote(field []byte) []byte {
+	if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+		return field[1 : len(field)-1]
+	}
+	return field
+}
+
+// RecordBoundary returns the start of the first record after the line
+// holding data[hint]: the first line start at or after it whose line has an
+// even number of quotes, which a line inside a quoted field does not. It
+// returns len(data) if there is none.
+func RecordBoundary(data []byte, hint int) int {
+	if hint >= len(data) {
+		return len(data)
+	}
+	nl := bytes.IndexByte(data[hint:], '\n')
+	if nl == -1 {
+		return len(data)
+	}
+	for pos := hint + nl + 1; pos < len(data); {
+		next := bytes.IndexByte(data[pos:], '\n')
+		if next == -1 {
+			return pos // End of file is a valid boundary always
+		}
+		if simd.ScanSeparators(data[pos:pos+next], '"')%2 == 0 {
+			return pos // Even quotes: a self-contained line
+		}
+		pos += next + 1 // Odd quotes: inside a multiline field
+	}
+	return len(data)
+}
+
+// SplitRecords divides data[start:end] into n parts of about the same size
+// that begin on record boundaries. It returns the n+1 bounds; parts may be
+// empty.
+func SplitRecords(data []byte, start, end, n int) []int {
+	bounds := make([]int, n+1)
+	bounds[0], bounds[n] = start, end
+	for i := 1; i < n; i++ {
+		bounds[i] = max(min(RecordBoundary(data, start+(end-start)*i/n), end), bounds[i-1])
+	}
+	return bounds
+}
+
+// countWindow is how much of the data CountRecords builds bitmaps for at a
+// time.
+const countWindow = 1 << 20
+
+// CountRecords returns the number of records in data, which starts on a
+// record boundary: newlines outside double quotes, plus a last record
+// without one. Like Records, empty lines count. The quote and newline
+// bitmaps are built a window at a time, so memory stays small on large
+// files.
+func CountRecords(data []byte) int64 {
+	var s RecordScanner
+	var count int64
+	inQuote := false
+	for off := 0; off < len(data); off += countWindow {
+		s.Reset(data[off:min(off+countWindow, len(data))], ',')
+		for w, nl := range s.newlines {
+			q := s.quotes[w]
+			if q == 0 {
+				if !inQuote {
+					count += int64(bits.OnesCount64(nl))
+				}
+				continue
+			}
+			for combined := q | nl; combined != 0; combined &= combined - 1 {
+				bit := combined & -combined
+				if q&bit != 0 {
+					inQuote = !inQuote
+				} else if !inQuote {
+					count++
+				}
+			}
+		}
+	}
+	if len(data) > 0 && (inQuote || data[len(data)-1] != '\n') {
+		count++ // A last record without a newline, or an unclosed quote
+	}
+	return count
+}
@@ -0,0 +1,161 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRecordScanner(t *testing.T) {
+	// Long enough for records and fields to cross bitmap words
+	long := strings.Repeat("x", 70)
+	data := "1,plain\n\n2,\"two\nlines, \"\"quoted\"\"\"\n3;semi,\"" + long + "\"," + long + "\r\n4,last"
+	want := [][]string{
+		{"1", "plain"},
+		{""},
+		{"2", "two\nlines, \"\"quoted\"\""},
+		{"3;semi", long, long},
+		{"4", "last"},
+	}
+
+	var s RecordScanner
+	for _, data := range []string{data, "pad\n" + data} { // Reused, other alignment
+		s.Reset([]byte(data), ',')
+		var got [][]string
+		var fields [][]byte
+		next := 0
+		s.Records(func(start, end, n int) bool {
+			if start != next {
+				t.Errorf("Record at %d, want %d", start, next)
+			}
+			next = n
+			end -= strings.Count(data[start:end], "\r") // Only at the end here
+			var row []string
+			for _, f := range s.Fields(start, end, 10, fields[:0]) {
+				row = append(row, string(f))
+			}
+			got = append(got, row)
+			return true
+		})
+		if next != len(data) {
+			t.Errorf("Records end at %d, want %d", next, len(data))
+		}
+		if strings.HasPrefix(data, "pad\n") {
+			got = got[1:]
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Got %d records %q, want %d", len(got), got, len(want))
+		}
+		for i := range want {
+			if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+				t.Errorf("Record %d: %q, want %q", i, got[i], want[i])
+			}
+		}
+	}
+
+	// Fields stop at max; Records stops when fn returns false
+	s.Reset([]byte("a,b,c\nd,e,f\n"), ',')
+	if got := s.Fields(0, 5, 2, nil); len(got) != 2 || string(got[1]) != "b" {
+		t.Errorf("Fields with max 2: %q", got)
+	}
+	n := 0
+	s.Records(func(_, _, _ int) bool { n++; return false })
+	if n != 1 {
+		t.Errorf("Records called fn %d times after false", n)
+	}
+}
+
+func TestRecordScannerProject(t *testing.T) {
+	// Wide enough for whole words of unused fields to be skipped
+	var cols []string
+	for i := range 120 {
+		cols = append(cols, strings.Repeat("v", i%3)+string(rune('a'+i%26)))
+	}
+	cols[50], cols[101] = "\"skipped, quoted\"", "\"quoted, with sep\""
+	line := strings.Join(cols, ",")
+
+	var s RecordScanner
+	for _, pad := range []string{"", "x\n", "pad to shift words\n"} {
+		data := pad + line
+		s.Reset([]byte(data), ',')
+		used := make([]bool, 111)
+		used[1], used[100], used[101], used[110] = true, true, true, true
+		got := s.Project(len(pad), len(data), used, nil)
+		if len(got) != len(used) {
+			t.Fatalf("Project returned %d fields, want %d", len(got), len(used))
+		}
+		for i, f := range got {
+			want := ""
+			if used[i] {
+				want = strings.Trim(cols[i], `"`)
+			}
+			if f != want {
+				t.Errorf("pad %q: field %d = %q, want %q", pad, i, f, want)
+			}
+		}
+	}
+
+	// Fewer fields than the mask, and an empty record
+	s.Reset([]byte("a,b"), ',')
+	if got := s.Project(0, 3, []bool{false, true, true}, nil); len(got) != 2 || got[1] != "b" {
+		t.Errorf("Project of a short row: %q", got)
+	}
+	if got := s.Project(1, 1, []bool{true}, nil); len(got) != 1 || got[0] != "" {
+		t.Errorf("Project of an empty record: %q", got)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	data := []byte("h\n1,a\n2,\"x\ny\"\n3,b\n4,c\n")
+	if got := RecordBoundary(data, 8); got != 14 {
+		t.Errorf("RecordBoundary inside a quoted field = %d, want 14", got)
+	}
+	if got := RecordBoundary(data, len(data)-1); got != len(data) {
+		t.Errorf("RecordBoundary on the last line = %d, want %d", got, len(data))
+	}
+	bounds := SplitRecords(data, 2, len(data), 4)
+	if len(bounds) != 5 || bounds[0] != 2 || bounds[4] != len(data) {
+		t.Fatalf("SplitRecords = %v", bounds)
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] < bounds[i-1] {
+			t.Errorf("Bounds out of order: %v", bounds)
+		}
+		if b := bounds[i]; b < len(data) && data[b-1] != '\n' {
+			t.Errorf("Bound %d is not a line start: %v", b, bounds)
+		}
+	}
+}
+
+func TestCountRecords(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want int64
+	}{
+		{"", 0},
+		{"h\n", 1},
+		{"h\n1,a", 2},
+		{"h\n1,\"a\nb\"\n2,c\n", 3},
+		{"h\n1,\"a\"\"\nb\"\n\n", 3},
+		{"h\n1,\"open\n", 2},
+	} {
+		if got := CountRecords([]byte(tc.data)); got != tc.want {
+			t.Errorf("CountRecords(%q) = %d, want %d", tc.data, got, tc.want)
+		}
+	}
+
+	// Quoted fields spanning bitmap words and windows
+	var b strings.Builder
+	b.WriteString("h\n")
+	for i := 0; b.Len() < 3*countWindow; i++ {
+		fmt.Fprintf(&b, "%d,\"%s\n%s\"\n", i, strings.Repeat("x", i%97), strings.Repeat("y", i%61))
+	}
+	data := []byte(b.String())
+	var s RecordScanner
+	s.Reset(data, ',')
+	var want int64
+	s.Records(func(_, _, _ int) bool { want++; return true })
+	if got := CountRecords(data); got != want {
+		t.Errorf("CountRecords of %d bytes = %d, want %d", len(data), got, want)
+	}
+}
@@ -0,0 +1,366 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// loadExistingMeta reads the metadata of the indexes an append run extends.
+func (indexer *Indexer) loadExistingMeta() error {
+	if storage.IsRemote(indexer.config.OutputDir) {
+		return fmt.Errorf("append requires a local index directory, not %s", indexer.config.OutputDir)
+	}
+	data, err := os.ReadFile(indexer.metaPath())
+	if err != nil {
+		return fmt.Errorf("append requires existing index metadata: %w", err)
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid index metadata: %w", err)
+	}
+	if meta.Indexes == nil {
+		meta.Indexes = make(map[string]common.IndexStats)
+	}
+	if meta.CsvSize != indexer.config.AppendFrom {
+		return fmt.Errorf("indexes cover %d bytes of the CSV, cannot append from offset %d", meta.CsvSize, indexer.config.AppendFrom)
+	}
+	for i, cols := range indexer.colDefs {
+		name := IndexName(cols)
+		if stats, ok := meta.Indexes[name]; ok && stats.Collation != indexer.collations[i] {
+			return fmt.Errorf("index %s has collation %q, not %q; rebuild it to change collation", name, stats.Collation, indexer.collations[i])
+		}
+	}
+	indexer.meta = meta
+	return nil
+}
+
+// mergeDelta folds the freshly sorted delta into the existing index file
+// prevFile, writing the result to newFile. It returns the file that holds
+// the index afterwards: prevFile itself when the delta is empty. The bloom
+// filter (if any) is rebuilt from the merged keys.
+func (indexer *Indexer) mergeDelta(name, prevFile, newFile, deltaPath string, bloom *common.BloomFilter, zoneColumn string, zone common.ZoneFunc) (string, keyCounts, error) {
+	indexPath := filepath.Join(indexer.config.OutputDir, prevFile)
+	newPath := filepath.Join(indexer.config.OutputDir, newFile)
+	deltaInfo, err := os.Stat(deltaPath)
+	if err != nil {
+		return "", keyCounts{}, err
+	}
+	indexInfo, err := os.Stat(indexPath)
+	if err != nil {
+		return "", keyCounts{}, err
+	}
+	indexer.metaMutex.Lock()
+	stats := indexer.meta.Indexes[name]
+	indexer.metaMutex.Unlock()
+
+	switch {
+	case deltaInfo.Size() == 0:
+		// No new rows for this index; keep it as is (and its bloom filter)
+		if bloom != nil {
+			if existing, err := common.LoadBloomFilter(indexPath + ".bloom"); err == nil {
+				*bloom = *existing
+			}
+		}
+		if stats.NullCount == nil || stats.Histogram == nil {
+			counts, err := countDistinct(indexPath, nil) // Metadata from before key statistics
+			return prevFile, counts, err
+		}
+		return prevFile, keyCounts{distinct: stats.DistinctCount, prev: &stats}, nil
+	case indexInfo.Size() == 0:
+		// Index was empty; the delta is the whole index
+		if err := os.Rename(deltaPath, newPath); err != nil {
+			return "", keyCounts{}, err
+		}
+		counts, err := countDistinct(newPath, bloom)
+		return newFile, counts, err
+	}
+	counts, err := mergeIndexFiles(indexPath, newPath, deltaPath, bloom, zoneColumn, zone, indexer.config.Codec, stats.Partitions)
+	return newFile, counts, err
+}
+
+// keyCounts are the key statistics of an index written by a merge.
+type keyCounts struct {
+	distinct int64 // Distinct keys
+	keys     common.KeyStats
+	prev     *common.IndexStats // Unchanged index: its key statistics stand
+}
+
+// add counts a record; newKey tells whether its key differs from the last.
+func (k *keyCounts) add(rec *common.IndexRecord, newKey bool, bloom *common.BloomFilter) {
+	if newKey {
+		k.distinct++
+		if bloom != nil {
+			bloom.Add(common.KeyString(&rec.Key))
+		}
+	}
+	k.keys.Add(rec)
+}
+
+// apply records the statistics in the metadata of the index.
+func (k *keyCounts) apply(stats *common.IndexStats) {
+	stats.DistinctCount = k.distinct
+	if k.prev == nil {
+		k.keys.Apply(stats)
+		return
+	}
+	stats.NullCount, stats.Records = k.prev.NullCount, k.prev.Records
+	stats.MinKey, stats.MaxKey, stats.AvgKeyLen = k.prev.MinKey, k.prev.MaxKey, k.prev.AvgKeyLen
+	stats.Histogram = k.prev.Histogram
+}
+
+// countDistinct collects the key statistics of an index, feeding the
+// distinct keys to bloom.
+func countDistinct(indexPath string, bloom *common.BloomFilter) (keyCounts, error) {
+	br, err := common.NewBlockReaderMmap(indexPath)
+	if err != nil {
+		return keyCounts{}, err
+	}
+	defer br.Cleanup()
+
+	stream := &recordStream{br: br}
+	var counts keyCounts
+	var lastKey [64]byte
+	for first := true; ; first = false {
+		rec, ok, err := stream.next()
+		if err != nil {
+			return keyCounts{}, err
+		}
+		if !ok {
+			return counts, nil
+		}
+		counts.add(&rec, first || rec.Key != lastKey, bloom)
+		lastKey = rec.Key
+	}
+}
+
+// recordStream iterates over every record of an index file in order.
+type recordStream struct {
+	br       *common.BlockReader
+	blockIdx int
+	records  []common.IndexRecord
+	pos      int
+}
+
+func (rs *recordStream) next() (common.IndexRecord, bool, error) {
+	for rs.pos >= len(rs.records) {
+		if rs.blockIdx >= rs.br.Footer.Blocks.Len() {
+			return common.IndexRecord{}, false, nil
+		}
+		records, err := rs.br.ReadBlock(rs.br.Footer.Blocks.At(rs.blockIdx))
+		if err != nil {
+			return common.IndexRecord{}, false, err
+		}
+		rs.blockIdx++
+		rs.records = records
+		rs.pos = 0
+	}
+	rec := rs.records[rs.pos]
+	rs.pos++
+	return rec, true, nil
+}
+
+// recordLess orders records by key, then CSV offset (same as the Sorter).
+func recordLess(a, b *common.IndexRecord) bool {
+	cmp := bytes.Compare(a.Key[:], b.Key[:])
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return a.Offset < b.Offset
+}
+
+// mergeIndexFiles merges the sorted records of deltaPath and the index at
+// indexPath into outPath. The result is written to a temp file and renamed,
+// so outPath never holds a partial index. partitions > 1 splits it into
+// that many part files (see Sorter.SetPartitions).
+// Returns the key counts of the merged index.
+func mergeIndexFiles(indexPath, outPath, deltaPath string, bloom *common.BloomFilter, zoneColumn string, zone common.ZoneFunc, codecName string, partitions int) (keyCounts, error) {
+	codec, err := common.NewCodec(codecName)
+	if err != nil {
+		return keyCounts{}, err
+	}
+
+	oldReader, err := common.NewBlockReaderMmap(indexPath)
+	if err != nil {
+		return keyCounts{}, fmt.Errorf("failed to open existing index: %w", err)
+	}
+	defer oldReader.Cleanup()
+
+	deltaReader, err := common.NewBlockReaderMmap(deltaPath)
+	if err != nil {
+		return keyCounts{}, fmt.Errorf("failed to open appended rows: %w", err)
+	}
+	defer deltaReader.Cleanup()
+
+	tmpPath := outPath + ".merge"
+	outFile, err := os.Create(tmpPath)
+	if err != nil {
+		return keyCounts{}, err
+	}
+	defer func() {
+		_ = outFile.Close()
+		_ = os.Remove(tmpPath) // No-op after a successful rename
+	}()
+
+	writer, err := common.NewBlockWriter(outFile)
+	if err != nil {
+		return keyCounts{}, err
+	}
+	if zone != nil {
+		writer.SetZoneMap(zoneColumn, zone)
+	}
+	writer.SetCodec(codec)
+	var records int64
+	for _, br := range []*common.BlockReader{oldReader, deltaReader} {
+		for _, meta := range br.Footer.Blocks.All() {
+			records += meta.RecordCount
+		}
+	}
+	parts := newPartFiles(writer, storage.NewLocal(filepath.Dir(outPath)), filepath.Base(outPath), partitions, records)
+	defer parts.abort()
+
+	streams := [2]*recordStream{{br: oldReader}, {br: deltaReader}}
+	var heads [2]common.IndexRecord
+	var ok [2]bool
+	for i, stream := range streams {
+		if heads[i], ok[i], err = stream.next(); err != nil {
+			return keyCounts{}, err
+		}
+	}
+
+	var counts keyCounts
+	var lastKey [64]byte
+	first := true
+
+	for ok[0] || ok[1] {
+		src := 0
+		if !ok[0] || (ok[1] && recordLess(&heads[1], &heads[0])) {
+			src = 1
+		}
+		rec := heads[src]
+
+		counts.add(&rec, first || rec.Key != lastKey, bloom)
+		lastKey = rec.Key
+		first = false
+
+		if err := writer.WriteRecord(rec); err != nil {
+			return keyCounts{}, err
+		}
+		if heads[src], ok[src], err = streams[src].next(); err != nil {
+			return keyCounts{}, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return keyCounts{}, err
+	}
+	if err := outFile.Close(); err != nil {
+		return keyCounts{}, err
+	}
+	if err := parts.commit(); err != nil {
+		return keyCounts{}, err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		return keyCounts{}, err
+	}
+	parts.keep()
+	return counts, nil
+}
+
+// AppendIndexes brings the indexes of csvPath in outputDir up to date with
+// the rows appended to the CSV since they were built: an append run over
+// every index of the metadata (see CurrentConfig). A CSV that has not
+// grown is left alone. publish is the Publish hook of the run (nil = none).
+func AppendIndexes(csvPath, outputDir string, publish func(func() error) error, out io.Writer) error {
+	cfg, meta, err := CurrentConfig(csvPath, outputDir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(csvPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() == meta.CsvSize {
+		return nil
+	}
+	cfg.AppendFrom = meta.CsvSize
+	cfg.Publish = publish
+	cfg.Output = out
+	idx := NewIndexer(cfg)
+	defer idx.Cleanup()
+	return idx.Run()
+}
+
+// CurrentConfig returns the config that builds the indexes the metadata of
+// csvPath in outputDir lists again, with their columns and collations, the
+// largest partition count among them and the row store if there is one,
+// along with that metadata.
+func CurrentConfig(csvPath, outputDir string) (IndexerConfig, common.IndexMeta, error) {
+	var meta common.IndexMeta
+	if storage.IsRemote(outputDir) {
+		return IndexerConfig{}, meta, fmt.Errorf("requires a local index directory, not %s", outputDir)
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	data, err := os.ReadFile(filepath.Join(outputDir, csvName+"_meta.json"))
+	if err != nil {
+		return IndexerConfig{}, meta, fmt.Errorf("requires existing index metadata: %w", err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return IndexerConfig{}, meta, fmt.Errorf("invalid index metadata: %w", err)
+	}
+	if len(meta.Indexes) == 0 {
+		return IndexerConfig{}, meta, fmt.Errorf("index metadata lists no indexes")
+	}
+
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columns, partitions, err := indexColumns(meta, names)
+	if err != nil {
+		return IndexerConfig{}, meta, err
+	}
+
+	return IndexerConfig{
+		InputFile:   csvPath,
+		OutputDir:   outputDir,
+		Columns:     string(columns),
+		Separator:   meta.Separator,
+		BloomFPRate: 0.01,
+		RowStore:    meta.RowStore != "",
+		Partitions:  partitions,
+	}, meta, nil
+}
+
+// indexColumns returns the --columns spec that builds the named indexes of
+// meta again, with their collations, and the largest partition count
+// among them.
+func indexColumns(meta common.IndexMeta, names []string) (string, int, error) {
+	entries := make([]any, len(names))
+	partitions := 0
+	for i, name := range names {
+		stats, ok := meta.Indexes[name]
+		if !ok {
+			return "", 0, fmt.Errorf("no index %s", name)
+		}
+		if len(stats.Columns) == 0 {
+			return "", 0, fmt.Errorf("index %s predates column metadata; rebuild it", name)
+		}
+		entries[i] = stats.Columns
+		if stats.Collation == common.CollationCI {
+			entries[i] = map[string]any{"col": stats.Columns, "ci": true}
+		}
+		partitions = max(partitions, stats.Partitions)
+	}
+	columns, err := json.Marshal(entries)
+	return string(columns), partitions, err
+}
@@ -0,0 +1,543 @@
+package indexer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Arrow IPC file input (Feather v2 too): the footer, a flatbuffer, lists
+// the schema and the blocks of the dictionary and record batches. Each
+// record batch is rendered column by column. Only flat schemas of
+// primitive, decimal, temporal and (large) string or binary columns are
+// read, dictionary-encoded or not; buffers may be LZ4 or zstd compressed.
+//
+//	"ARROW1\0\0" | stream messages | Footer | footer length (4 bytes, LE) | "ARROW1"
+
+const arrowMagic = "ARROW1"
+
+// Arrow type ids (the Type union)
+const (
+	arrowNull            = 1
+	arrowInt             = 2
+	arrowFloatingPoint   = 3
+	arrowBinary          = 4
+	arrowUtf8            = 5
+	arrowBool            = 6
+	arrowDecimal         = 7
+	arrowDate            = 8
+	arrowTime            = 9
+	arrowTimestamp       = 10
+	arrowFixedSizeBinary = 15
+	arrowDuration        = 18
+	arrowLargeBinary     = 19
+	arrowLargeUtf8       = 20
+)
+
+// Arrow message header types
+const (
+	arrowDictionaryBatch = 2
+	arrowRecordBatch     = 3
+)
+
+// arrowColumn is a column of a flat Arrow schema.
+type arrowColumn struct {
+	name   string
+	typ    byte
+	width  int // Bytes per value of fixed-width types (0 = bool, or offsets and data)
+	large  bool
+	signed bool
+	float  int // FloatingPoint precision: 0 half, 1 single, 2 double
+	format valueFormat
+
+	dictID  int64          // Dictionary id (-1 = not dictionary-encoded)
+	index   arrowIndexType // Index type of a dictionary-encoded column
+	dict    []string
+	hasDict bool
+}
+
+// arrowIndexType is the integer index type of a dictionary-encoded column.
+type arrowIndexType struct {
+	width  int
+	signed bool
+}
+
+// readArrow calls fn with the column names and the rendered values of
+// each record batch of the Arrow IPC file data ("" = null).
+func readArrow(data []byte, fn func(names []string, columns [][]string, rows int) error) (err error) {
+	defer recoverCorrupt("Arrow", &err)
+
+	if len(data) < 18 || string(data[:6]) != arrowMagic || string(data[len(data)-6:]) != arrowMagic {
+		return fmt.Errorf("not an Arrow IPC file")
+	}
+	footerLen := int(int32(binary.LittleEndian.Uint32(data[len(data)-10:])))
+	if footerLen <= 0 || footerLen > len(data)-18 {
+		return fmt.Errorf("corrupt Arrow file: footer length %d", footerLen)
+	}
+	footer := fbRoot(data[len(data)-10-footerLen : len(data)-10])
+
+	schema, ok := footer.table(1)
+	if !ok {
+		return fmt.Errorf("corrupt Arrow file: no schema")
+	}
+	if schema.int(0, 2, 0) != 0 {
+		return fmt.Errorf("big-endian Arrow files are not supported")
+	}
+	columns, err := arrowSchema(schema)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	byDict := make(map[int64]*arrowColumn)
+	for i := range columns {
+		names[i] = columns[i].name
+		if columns[i].dictID >= 0 {
+			byDict[columns[i].dictID] = &columns[i]
+		}
+	}
+
+	// Dictionaries first: record batches index into them
+	start, n := footer.vector(2)
+	for i := range n {
+		batch, body, err := arrowMessage(data, footer.buf[start+24*i:], arrowDictionaryBatch)
+		if err != nil {
+			return err
+		}
+		id := batch.int(0, 8, 0)
+		c := byDict[id]
+		if c == nil {
+			return fmt.Errorf("corrupt Arrow file: dictionary %d has no column", id)
+		}
+		rb, ok := batch.table(1)
+		if !ok {
+			return fmt.Errorf("corrupt Arrow file: empty dictionary batch")
+		}
+		value := *c
+		value.dictID = -1
+		values, err := arrowBatch(rb, body, []arrowColumn{value})
+		if err != nil {
+			return fmt.Errorf("dictionary of column %s: %w", c.name, err)
+		}
+		if batch.int(2, 1, 0) != 0 { // Delta
+			c.dict = append(c.dict, values[0]...)
+		} else {
+			c.dict = values[0]
+		}
+		c.hasDict = true
+	}
+
+	start, n = footer.vector(3)
+	for i := range n {
+		rb, body, err := arrowMessage(data, footer.buf[start+24*i:], arrowRecordBatch)
+		if err != nil {
+			return err
+		}
+		values, err := arrowBatch(rb, body, columns)
+		if err != nil {
+			return err
+		}
+		if err := fn(names, values, int(rb.int(0, 8, 0))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arrowSchema returns the columns of a flat schema.
+func arrowSchema(schema fbTable) ([]arrowColumn, error) {
+	start, n := schema.vector(1)
+	if n == 0 {
+		return nil, fmt.Errorf("arrow file has no columns")
+	}
+	columns := make([]arrowColumn, n)
+	for i := range n {
+		field := schema.tableAt(start, i)
+		c := &columns[i]
+		c.name = field.str(0)
+		c.dictID = -1
+		if _, children := field.vector(5); children > 0 {
+			return nil, fmt.Errorf("column %s is nested; only flat Arrow schemas can be indexed", c.name)
+		}
+		if err := c.setType(byte(field.int(2, 1, 0)), field); err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.name, err)
+		}
+		if enc, ok := field.table(4); ok {
+			c.dictID = enc.int(0, 8, 0)
+			c.index = arrowIndexType{width: 4, signed: true} // Default int32
+			if it, ok := enc.table(1); ok {
+				c.index = arrowIndexType{width: int(it.int(0, 4, 0)) / 8, signed: it.int(1, 1, 0) != 0}
+			}
+		}
+	}
+	return columns, nil
+}
+
+// setType sets the value type of a column from its Type union.
+func (c *arrowColumn) setType(typ byte, field fbTable) error {
+	c.typ = typ
+	t, _ := field.table(3)
+	switch typ {
+	case arrowNull, arrowBool, arrowBinary, arrowUtf8:
+	case arrowLargeBinary, arrowLargeUtf8:
+		c.large = true
+	case arrowInt:
+		c.width = int(t.int(0, 4, 0)) / 8
+		c.signed = t.int(1, 1, 0) != 0
+		if !c.signed {
+			c.format.kind = fmtUnsigned
+		}
+	case arrowFloatingPoint:
+		c.float = int(t.int(0, 2, 0))
+		c.width = []int{2, 4, 8}[c.float]
+	case arrowDecimal:
+		c.width = int(t.int(2, 4, 128)) / 8
+		c.format = valueFormat{kind: fmtDecimal, scale: int(t.int(1, 4, 0))}
+		if c.format.scale < -maxDecimalScale || c.format.scale > maxDecimalScale {
+			return fmt.Errorf("invalid decimal scale %d", c.format.scale)
+		}
+	case arrowDate:
+		if t.int(0, 2, 1) == 0 { // DAY: int32 days
+			c.width = 4
+		} else { // MILLISECOND: int64 milliseconds of a day's start
+			c.width = 8
+		}
+		c.format.kind = fmtDate
+	case arrowTime:
+		c.width = int(t.int(1, 4, 32)) / 8
+		c.format = valueFormat{kind: fmtTime, unit: arrowUnit(t.int(0, 2, 1))}
+	case arrowTimestamp:
+		c.width = 8
+		c.format = valueFormat{kind: fmtTimestamp, unit: arrowUnit(t.int(0, 2, 0))}
+	case arrowDuration:
+		c.width = 8
+	case arrowFixedSizeBinary:
+		c.width = int(t.int(0, 4, 0))
+	default:
+		return fmt.Errorf("unsupported Arrow type %d", typ)
+	}
+	if c.width < 0 {
+		return fmt.Errorf("invalid width %d", c.width)
+	}
+	return nil
+}
+
+// arrowUnit returns the nanoseconds of a TimeUnit.
+func arrowUnit(unit int64) int64 {
+	return [...]int64{1e9, 1e6, 1e3, 1}[min(max(unit, 0), 3)]
+}
+
+// arrowMessage reads the message of a footer Block and returns its header,
+// of type want, and body.
+func arrowMessage(data, block []byte, want int) (fbTable, []byte, error) {
+	offset := int(int64(binary.LittleEndian.Uint64(block)))
+	metaLen := int(int32(binary.LittleEndian.Uint32(block[8:])))
+	bodyLen := int(int64(binary.LittleEndian.Uint64(block[16:])))
+	if offset < 8 || metaLen < 8 || bodyLen < 0 || offset+metaLen+bodyLen > len(data) {
+		return fbTable{}, nil, fmt.Errorf("corrupt Arrow file: block at %d is outside the file", offset)
+	}
+	msg := data[offset : offset+metaLen]
+	if binary.LittleEndian.Uint32(msg) == 0xffffffff { // Continuation marker
+		msg = msg[8:]
+	} else {
+		msg = msg[4:]
+	}
+	root := fbRoot(msg)
+	if typ := int(root.int(1, 1, 0)); typ != want {
+		return fbTable{}, nil, fmt.Errorf("corrupt Arrow file: message of type %d where %d was expected", typ, want)
+	}
+	header, ok := root.table(2)
+	if !ok {
+		return fbTable{}, nil, fmt.Errorf("corrupt Arrow file: message without header")
+	}
+	return header, data[offset+metaLen : offset+metaLen+bodyLen], nil
+}
+
+// arrowBatch renders the columns of a RecordBatch.
+func arrowBatch(rb fbTable, body []byte, columns []arrowColumn) ([][]string, error) {
+	rows := int(rb.int(0, 8, 0))
+	nodesStart, nodes := rb.vector(1)
+	bufStart, nbufs := rb.vector(2)
+	if nodes != len(columns) {
+		return nil, fmt.Errorf("corrupt Arrow file: %d field nodes for %d columns", nodes, len(columns))
+	}
+	codec := -1
+	if comp, ok := rb.table(3); ok {
+		codec = int(comp.int(0, 1, 0))
+	}
+
+	next := 0
+	buffer := func() ([]byte, error) {
+		if next >= nbufs {
+			return nil, fmt.Errorf("corrupt Arrow file: too few buffers")
+		}
+		p := bufStart + 16*next
+		next++
+		off := int(int64(binary.LittleEndian.Uint64(rb.buf[p:])))
+		l := int(int64(binary.LittleEndian.Uint64(rb.buf[p+8:])))
+		if off < 0 || l < 0 || off+l > len(body) {
+			return nil, fmt.Errorf("corrupt Arrow file: buffer outside the body")
+		}
+		return arrowDecompress(body[off:off+l], codec)
+	}
+
+	out := make([][]string, len(columns))
+	for i := range columns {
+		c := &columns[i]
+		length := int(int64(binary.LittleEndian.Uint64(rb.buf[nodesStart+16*i:])))
+		if length != rows {
+			return nil, fmt.Errorf("column %s: %d values in a batch of %d rows", c.name, length, rows)
+		}
+		values := make([]string, rows)
+		out[i] = values
+		if c.typ == arrowNull {
+			continue // No buffers
+		}
+		validity, err := buffer()
+		if err != nil {
+			return nil, err
+		}
+		valid := func(r int) bool {
+			return len(validity) == 0 || validity[r/8]&(1<<(r%8)) != 0
+		}
+
+		if c.dictID >= 0 {
+			indices, err := buffer()
+			if err != nil {
+				return nil, err
+			}
+			if !c.hasDict {
+				return nil, fmt.Errorf("column %s: no dictionary", c.name)
+			}
+			w := c.index.width
+			if w <= 0 || len(indices) < w*rows {
+				return nil, fmt.Errorf("column %s: short index buffer", c.name)
+			}
+			for r := range rows {
+				if !valid(r) {
+					continue
+				}
+				j := arrowInteger(indices[r*w:(r+1)*w], c.index.signed)
+				if j < 0 || j >= int64(len(c.dict)) {
+					return nil, fmt.Errorf("column %s: dictionary index %d out of %d", c.name, j, len(c.dict))
+				}
+				values[r] = c.dict[j]
+			}
+			continue
+		}
+
+		switch {
+		case c.typ == arrowBool:
+			bits, err := buffer()
+			if err != nil {
+				return nil, err
+			}
+			for r := range rows {
+				if valid(r) {
+					values[r] = strconv.FormatBool(bits[r/8]&(1<<(r%8)) != 0)
+				}
+			}
+		case c.width == 0: // (Large) binary and utf8: offsets, then data
+			offsets, err := buffer()
+			if err != nil {
+				return nil, err
+			}
+			data, err := buffer()
+			if err != nil {
+				return nil, err
+			}
+			ow := 4
+			if c.large {
+				ow = 8
+			}
+			if len(offsets) < ow*(rows+1) {
+				return nil, fmt.Errorf("column %s: short offsets buffer", c.name)
+			}
+			for r := range rows {
+				if !valid(r) {
+					continue
+				}
+				from := arrowInteger(offsets[r*ow:(r+1)*ow], true)
+				to := arrowInteger(offsets[(r+1)*ow:(r+2)*ow], true)
+				if from < 0 || to < from || to > int64(len(data)) {
+					return nil, fmt.Errorf("column %s: offsets outside the data", c.name)
+				}
+				values[r] = string(data[from:to])
+			}
+		default:
+			data, err := buffer()
+			if err != nil {
+				return nil, err
+			}
+			if len(data) < c.width*rows {
+				return nil, fmt.Errorf("column %s: short values buffer", c.name)
+			}
+			for r := range rows {
+				if valid(r) {
+					values[r] = c.value(data[r*c.width : (r+1)*c.width])
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// value renders a fixed-width value.
+func (c *arrowColumn) value(b []byte) string {
+	switch c.typ {
+	case arrowFloatingPoint:
+		switch c.float {
+		case 0:
+			return valueFormat{kind: fmtFloat16}.bytes(b)
+		case 1:
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 'g', -1, 32)
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 'g', -1, 64)
+	case arrowDecimal:
+		be := make([]byte, len(b)) // Little-endian two's complement
+		for i := range b {
+			be[len(b)-1-i] = b[i]
+		}
+		return c.format.bytes(be)
+	case arrowFixedSizeBinary:
+		return string(b)
+	case arrowDate:
+		v := arrowInteger(b, true)
+		if c.width == 8 {
+			v = int64(math.Floor(float64(v) / 86400000))
+		}
+		return c.format.int(v, false)
+	case arrowInt:
+		if !c.signed && c.width == 8 {
+			return strconv.FormatUint(binary.LittleEndian.Uint64(b), 10)
+		}
+	}
+	return c.format.int(arrowInteger(b, c.signed || c.typ != arrowInt), false)
+}
+
+// arrowInteger reads a little-endian integer of 1, 2, 4 or 8 bytes.
+func arrowInteger(b []byte, signed bool) int64 {
+	switch len(b) {
+	case 1:
+		if signed {
+			return int64(int8(b[0]))
+		}
+		return int64(b[0])
+	case 2:
+		if signed {
+			return int64(int16(binary.LittleEndian.Uint16(b)))
+		}
+		return int64(binary.LittleEndian.Uint16(b))
+	case 4:
+		if signed {
+			return int64(int32(binary.LittleEndian.Uint32(b)))
+		}
+		return int64(binary.LittleEndian.Uint32(b))
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// arrowDecompress returns a buffer of a batch compressed with codec (-1 =
+// none, 0 = LZ4 frame, 1 = zstd): its uncompressed length (-1 = stored as
+// is), then its bytes.
+func arrowDecompress(buf []byte, codec int) ([]byte, error) {
+	if codec < 0 || len(buf) == 0 {
+		return buf, nil
+	}
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("corrupt Arrow file: short compressed buffer")
+	}
+	size := int64(binary.LittleEndian.Uint64(buf))
+	if size == -1 {
+		return buf[8:], nil
+	}
+	name := common.CodecLZ4
+	if codec == 1 {
+		name = common.CodecZstd
+	}
+	c, err := common.NewCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.Decompress(nil, buf[8:]) // Not sized by a length that may be corrupt
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) != size {
+		return nil, fmt.Errorf("corrupt Arrow file: buffer of %d bytes decompressed, %d expected", len(out), size)
+	}
+	return out, nil
+}
+
+// fbTable is a flatbuffer table at pos of buf, read without generated code.
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+// fbRoot returns the root table of a flatbuffer.
+func fbRoot(buf []byte) fbTable {
+	return fbTable{buf, int(binary.LittleEndian.Uint32(buf))}
+}
+
+// field returns the position of field i (0 = absent).
+func (t fbTable) field(i int) int {
+	vt := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	vtLen := int(binary.LittleEndian.Uint16(t.buf[vt:]))
+	o := 4 + 2*i
+	if o+2 > vtLen {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(t.buf[vt+o:]))
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+// int returns the signed integer of size bytes in field i, or def.
+func (t fbTable) int(i, size int, def int64) int64 {
+	p := t.field(i)
+	if p == 0 {
+		return def
+	}
+	return arrowInteger(t.buf[p:p+size], true)
+}
+
+// table returns the table field i refers to.
+func (t fbTable) table(i int) (fbTable, bool) {
+	p := t.field(i)
+	if p == 0 {
+		return fbTable{}, false
+	}
+	return fbTable{t.buf, p + int(binary.LittleEndian.Uint32(t.buf[p:]))}, true
+}
+
+// str returns the string of field i.
+func (t fbTable) str(i int) string {
+	start, n := t.vector(i)
+	return string(t.buf[start : start+n])
+}
+
+// vector returns the start of the elements of the vector in field i and
+// their number.
+func (t fbTable) vector(i int) (int, int) {
+	p := t.field(i)
+	if p == 0 {
+		return 0, 0
+	}
+	p += int(binary.LittleEndian.Uint32(t.buf[p:]))
+	n := int(binary.LittleEndian.Uint32(t.buf[p:]))
+	if n > len(t.buf)-p-4 { // Every element takes a byte at least
+		panic("vector overruns the buffer")
+	}
+	return p + 4, n
+}
+
+// tableAt returns element j of a vector of tables starting at start.
+func (t fbTable) tableAt(start, j int) fbTable {
+	p := start + 4*j
+	return fbTable{t.buf, p + int(binary.LittleEndian.Uint32(t.buf[p:]))}
+}
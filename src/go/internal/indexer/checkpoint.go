@@ -0,0 +1,206 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// defaultCheckpointBytes is how much of the CSV is scanned between
+// checkpoints. Each checkpoint spills every sorter's buffer, so this trades
+// a few extra spill chunks for how much work an interruption can lose.
+const defaultCheckpointBytes = 1 << 30
+
+// checkpoint is the resume manifest of a full build, kept in the temp
+// directory until the build completes. Rows before Offset are in the listed
+// spill chunks of every index; indexes marked Done are written completely.
+// `index --resume` continues from it instead of starting over.
+type checkpoint struct {
+	CsvSize  int64  `json:"csvSize"`
+	CsvMtime int64  `json:"csvMtime"`
+	CsvHash  string `json:"csvHash"`
+	Options  string `json:"options"` // Columns and block options of the build
+
+	Generation int64 `json:"generation,omitempty"` // Of the index files written (0 = unsuffixed names)
+
+	Offset  int64                       `json:"offset"` // Next byte to scan
+	Rows    int64                       `json:"rows"`   // Rows before Offset
+	Indexes map[string]*checkpointIndex `json:"indexes"`
+}
+
+type checkpointIndex struct {
+	Chunks    []string          `json:"chunks"`    // Spill chunks, relative to the temp directory
+	Distincts []int64           `json:"distincts"` // Distinct keys per chunk
+	Records   int64             `json:"records"`
+	Done      bool              `json:"done,omitempty"`
+	Stats     common.IndexStats `json:"stats"` // Set once Done
+}
+
+// checkpointPath is per CSV: builds of several CSVs may share the temp dir.
+func (indexer *Indexer) checkpointPath() string {
+	csvName := strings.TrimSuffix(filepath.Base(indexer.config.InputFile), filepath.Ext(indexer.config.InputFile))
+	return filepath.Join(indexer.tempDir, csvName+"_checkpoint.json")
+}
+
+// checkpointOptions describes the settings that shape the spill chunks and
+// indexes. A checkpoint is only resumed under the same ones.
+func (indexer *Indexer) checkpointOptions() string {
+	cols, _ := json.Marshal(indexer.colDefs)
+	opts := fmt.Sprintf("columns=%s separator=%q zone=%q codec=%q bloom=%g",
+		cols, indexer.config.Separator, indexer.config.ZoneColumn, indexer.config.Codec, indexer.config.BloomFPRate)
+	if slices.ContainsFunc(indexer.collations, func(c string) bool { return c != "" }) {
+		collations, _ := json.Marshal(indexer.collations)
+		opts += " collations=" + string(collations)
+	}
+	if indexer.config.Partitions > 1 {
+		opts += fmt.Sprintf(" partitions=%d", indexer.config.Partitions)
+	}
+	return opts
+}
+
+// newCheckpoint starts the manifest of a fresh build, discarding one left
+// by an interrupted run.
+func (indexer *Indexer) newCheckpoint() error {
+	dna, err := indexer.calculateFingerprint()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(indexer.checkpointPath()); err == nil {
+		fmt.Fprintln(indexer.out, "Discarding the checkpoint of an interrupted run (use --resume to continue it)")
+		_ = os.Remove(indexer.checkpointPath())
+	}
+	indexer.checkpoint = &checkpoint{
+		CsvSize:  dna.size,
+		CsvMtime: dna.mtime,
+		CsvHash:  dna.hash,
+		Options:  indexer.checkpointOptions(),
+		Indexes:  make(map[string]*checkpointIndex),
+	}
+	return nil
+}
+
+// loadCheckpoint reads the manifest of an interrupted run and checks that
+// it still matches the CSV, the options and the files on disk.
+func (indexer *Indexer) loadCheckpoint() error {
+	data, err := os.ReadFile(indexer.checkpointPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no interrupted build to resume (%s not found)", indexer.checkpointPath())
+		}
+		return err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %w", indexer.checkpointPath(), err)
+	}
+
+	dna, err := indexer.calculateFingerprint()
+	if err != nil {
+		return err
+	}
+	switch {
+	case dna.size != cp.CsvSize || dna.mtime != cp.CsvMtime || dna.hash != cp.CsvHash:
+		return fmt.Errorf("cannot resume: %s changed since the interrupted build; run without --resume", indexer.config.InputFile)
+	case cp.Options != indexer.checkpointOptions():
+		return fmt.Errorf("cannot resume: options differ from the interrupted build (%s); run without --resume", cp.Options)
+	}
+	for _, cols := range indexer.colDefs {
+		state := cp.Indexes[IndexName(cols)]
+		if state == nil {
+			continue
+		}
+		for _, chunk := range state.Chunks {
+			if _, err := os.Stat(filepath.Join(indexer.tempDir, chunk)); err != nil {
+				return fmt.Errorf("cannot resume: spill chunk of %s is missing: %w; run without --resume", IndexName(cols), err)
+			}
+		}
+	}
+	if cp.Indexes == nil {
+		cp.Indexes = make(map[string]*checkpointIndex)
+	}
+	indexer.checkpoint = &cp
+	return nil
+}
+
+// resumedIndex returns the checkpointed state of an index (nil = none).
+func (indexer *Indexer) resumedIndex(name string) *checkpointIndex {
+	if indexer.checkpoint == nil {
+		return nil
+	}
+	indexer.checkpointMutex.Lock()
+	defer indexer.checkpointMutex.Unlock()
+	return indexer.checkpoint.Indexes[name]
+}
+
+// checkpointScan makes every sorter spill what it buffered, then records
+// that all rows before offset are on disk. channels must carry every row
+// before offset already.
+func (indexer *Indexer) checkpointScan(offset, rows int64, channels []chan []common.IndexRecord) {
+	if indexer.checkpoint == nil {
+		return
+	}
+	// A nil batch asks a sorter node to spill and report (see runSorterNode)
+	indexer.barrier.Add(len(channels))
+	for _, ch := range channels {
+		ch <- nil
+	}
+	indexer.barrier.Wait()
+
+	indexer.sorterMutex.RLock()
+	sorters := append([]*Sorter(nil), indexer.sorters...)
+	indexer.sorterMutex.RUnlock()
+
+	indexer.checkpointMutex.Lock()
+	defer indexer.checkpointMutex.Unlock()
+	if indexer.sorterFailed.Load() {
+		return // A failed sorter dropped rows: the chunks are no longer complete
+	}
+	cp := indexer.checkpoint
+	for _, sorter := range sorters {
+		state := &checkpointIndex{
+			Distincts: append([]int64(nil), sorter.chunkDistincts...),
+			Records:   sorter.GetStats().TotalRecords,
+		}
+		for _, chunk := range sorter.chunkFiles {
+			rel, err := filepath.Rel(indexer.tempDir, chunk)
+			if err != nil {
+				return
+			}
+			state.Chunks = append(state.Chunks, rel)
+		}
+		cp.Indexes[sorter.Name] = state
+	}
+	cp.Offset, cp.Rows = offset, rows
+	indexer.saveCheckpointLocked()
+}
+
+// checkpointDone records that an index is written completely.
+func (indexer *Indexer) checkpointDone(name string, stats common.IndexStats) {
+	if indexer.checkpoint == nil {
+		return
+	}
+	indexer.checkpointMutex.Lock()
+	defer indexer.checkpointMutex.Unlock()
+	indexer.checkpoint.Indexes[name] = &checkpointIndex{Done: true, Stats: stats}
+	indexer.saveCheckpointLocked()
+}
+
+// saveCheckpointLocked writes the manifest atomically. Failures only cost
+// resumability, so they are reported and otherwise ignored.
+func (indexer *Indexer) saveCheckpointLocked() {
+	data, err := json.MarshalIndent(indexer.checkpoint, "", "  ")
+	if err == nil {
+		tmp := indexer.checkpointPath() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, indexer.checkpointPath())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(indexer.out, "  ⚠️  Failed to write checkpoint: %v\n", err)
+	}
+}
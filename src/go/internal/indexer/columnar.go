@@ -0,0 +1,266 @@
+package indexer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Columnar inputs: Parquet and Arrow IPC files are indexed like a CSV of
+// their rows. The adapter decodes them a row group (or record batch) at a
+// time and renders the rows as CSV records, comma-separated with the
+// column names as header, to a temp file the scanner reads as usual. Index
+// records point into that rendering, which the build keeps as the input's
+// .csvz row store; queries read rows from it (see IndexMeta.Format).
+
+// Input formats other than CSV, as IndexMeta.Format records them.
+const (
+	FormatParquet = "parquet"
+	FormatArrow   = "arrow"
+)
+
+// InputFormat returns the format of the file at path from its magic bytes:
+// FormatParquet, FormatArrow (Arrow IPC file, Feather v2) or "" for CSV.
+func InputFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	var head [6]byte
+	n, err := io.ReadFull(f, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case n >= 4 && string(head[:4]) == parquetMagic:
+		return FormatParquet, nil
+	case n == 6 && string(head[:]) == arrowMagic:
+		return FormatArrow, nil
+	}
+	return "", nil
+}
+
+// newColumnarScanner renders the Parquet or Arrow file at path to a CSV in
+// tempDir and returns a scanner of it.
+func newColumnarScanner(path, format, tempDir string) (*Scanner, error) {
+	csvPath := filepath.Join(tempDir, filepath.Base(path)+".csv")
+	if err := renderColumnar(path, format, csvPath); err != nil {
+		_ = os.Remove(csvPath)
+		return nil, err
+	}
+	scanner, err := NewScanner(csvPath, ",")
+	if err != nil {
+		_ = os.Remove(csvPath)
+		return nil, err
+	}
+	scanner.rendered = csvPath
+	return scanner, nil
+}
+
+// renderColumnar writes the rows of the columnar file at path as a CSV to
+// csvPath.
+func renderColumnar(path, format, csvPath string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	data, err := common.MmapFile(f)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = common.MunmapFile(data) }()
+
+	out, err := os.Create(csvPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = out.Close() }()
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	header := false
+	var line []byte
+	emit := func(names []string, columns [][]string, rows int) error {
+		if !header {
+			line = line[:0]
+			for i, name := range names {
+				if i > 0 {
+					line = append(line, ',')
+				}
+				line = common.AppendField(line, name, ',')
+			}
+			_, _ = w.Write(append(line, '\n'))
+			header = true
+		}
+		for r := range rows {
+			line = line[:0]
+			for i, col := range columns {
+				if i > 0 {
+					line = append(line, ',')
+				}
+				line = common.AppendField(line, col[r], ',')
+			}
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch format {
+	case FormatParquet:
+		err = readParquet(data, emit)
+	case FormatArrow:
+		err = readArrow(data, emit)
+	default:
+		err = fmt.Errorf("unknown input format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	if !header {
+		return fmt.Errorf("%s: no columns", filepath.Base(path))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// recoverCorrupt turns a panic of a decoder reading past the data it was
+// given into the error of a corrupt file.
+func recoverCorrupt(format string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("corrupt %s file: %v", format, r)
+	}
+}
+
+// valueKind is how a columnar value is written in the CSV rendering.
+type valueKind int
+
+const (
+	fmtPlain     valueKind = iota // Integers, text and bytes as they are
+	fmtUnsigned                   // Unsigned integer
+	fmtDecimal                    // Unscaled integer (big-endian bytes) and scale
+	fmtDate                       // Days since the epoch: 2006-01-02
+	fmtTime                       // Time of day in units: 15:04:05.999999999
+	fmtTimestamp                  // Units since the epoch: RFC 3339 in UTC
+	fmtInt96                      // Legacy Parquet timestamp (nanoseconds of the Julian day)
+	fmtUUID                       // 16 bytes: 8-4-4-4-12 hex
+	fmtFloat16                    // IEEE half precision, 2 bytes little-endian
+)
+
+// valueFormat writes the values of a column.
+type valueFormat struct {
+	kind  valueKind
+	scale int   // fmtDecimal
+	unit  int64 // Nanoseconds per unit of fmtTime and fmtTimestamp
+}
+
+// int writes an integer value; is32 tells an unsigned 32-bit one.
+func (f valueFormat) int(v int64, is32 bool) string {
+	switch f.kind {
+	case fmtUnsigned:
+		if is32 {
+			return strconv.FormatUint(uint64(uint32(v)), 10)
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	case fmtDecimal:
+		return scaleDecimal(big.NewInt(v), f.scale)
+	case fmtDate:
+		return time.Unix(v*86400, 0).UTC().Format(time.DateOnly)
+	case fmtTime:
+		return time.Unix(0, v*f.unit).UTC().Format("15:04:05.999999999")
+	case fmtTimestamp:
+		perSecond := int64(1e9) / f.unit
+		sec, rem := v/perSecond, v%perSecond
+		if rem < 0 {
+			sec, rem = sec-1, rem+perSecond
+		}
+		return time.Unix(sec, rem*f.unit).UTC().Format(time.RFC3339Nano)
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+// bytes writes a byte array value.
+func (f valueFormat) bytes(b []byte) string {
+	switch f.kind {
+	case fmtDecimal:
+		v := new(big.Int).SetBytes(b)
+		if len(b) > 0 && b[0]&0x80 != 0 { // Two's complement
+			v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+		}
+		return scaleDecimal(v, f.scale)
+	case fmtInt96:
+		if len(b) == 12 {
+			nanos := int64(binary.LittleEndian.Uint64(b))
+			days := int64(binary.LittleEndian.Uint32(b[8:])) - 2440588 // Julian day of the epoch
+			return time.Unix(days*86400, nanos).UTC().Format(time.RFC3339Nano)
+		}
+	case fmtUUID:
+		if len(b) == 16 {
+			h := hex.EncodeToString(b)
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+		}
+	case fmtFloat16:
+		if len(b) == 2 {
+			return strconv.FormatFloat(float64(halfToFloat(binary.LittleEndian.Uint16(b))), 'g', -1, 32)
+		}
+	}
+	return string(b)
+}
+
+// maxDecimalScale bounds the scale of decimals (the digits of a 256-bit one).
+const maxDecimalScale = 76
+
+// scaleDecimal writes the unscaled value v with scale digits after the
+// point (a negative scale appends zeros).
+func scaleDecimal(v *big.Int, scale int) string {
+	s := v.String()
+	if scale < 0 && v.Sign() != 0 {
+		return s + strings.Repeat("0", -scale)
+	}
+	if scale <= 0 {
+		return s
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	if neg {
+		return "-" + s
+	}
+	return s
+}
+
+// halfToFloat converts an IEEE 754 half precision value.
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+	switch exp {
+	case 0: // Zero or subnormal
+		f := float32(frac) / 1024 / 16384
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case 0x1f: // Infinity or NaN
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+}
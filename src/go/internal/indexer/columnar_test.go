@@ -0,0 +1,524 @@
+package indexer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
+	"github.com/klauspost/compress/s2"
+)
+
+const parquetCSV = `id,name,price,day
+1,alice,10.50,1970-01-01
+2,,-0.05,2022-01-08
+3,"bob, jr",0.00,1969-12-31
+4,alice,1.99,1970-01-02
+5,carol,1000.00,1971-01-01
+`
+
+func TestParquetInput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.parquet")
+	if err := os.WriteFile(path, buildParquet(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format, err := InputFormat(path); err != nil || format != FormatParquet {
+		t.Fatalf("Detected format %q (%v)", format, err)
+	}
+	if got := renderFile(t, path, FormatParquet); got != parquetCSV {
+		t.Errorf("Rendered\n%s\nexpected\n%s", got, parquetCSV)
+	}
+
+	// Indexed like a CSV, with the rendering kept as the row store
+	out := filepath.Join(dir, "indexes")
+	idx := NewIndexer(IndexerConfig{
+		InputFile: path, OutputDir: out, Columns: `["name"]`,
+		Workers: 2, MemoryMB: 16, BloomFPRate: 0.01,
+	})
+	idx.out = io.Discard
+	if err := idx.Run(); err != nil {
+		t.Fatalf("Indexer failed: %v", err)
+	}
+	verifyIndex(t, builtIndex(t, out, "name"), 5, false)
+	data, err := os.ReadFile(filepath.Join(out, "test_meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Format != FormatParquet || meta.RowStore == "" || meta.TotalRows != 5 {
+		t.Fatalf("Metadata format %q, row store %q, %d rows", meta.Format, meta.RowStore, meta.TotalRows)
+	}
+	store, err := storage.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := common.OpenRowStore(store, meta.RowStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rs.Close() }()
+	if rows, err := io.ReadAll(rs.Reader()); err != nil || string(rows) != parquetCSV {
+		t.Errorf("Row store holds\n%s\n(%v)", rows, err)
+	}
+
+	// Appends read new bytes of a CSV
+	idx = NewIndexer(IndexerConfig{InputFile: path, OutputDir: out, Columns: `["name"]`, AppendFrom: 100})
+	idx.out = io.Discard
+	if err := idx.Run(); err == nil || !strings.Contains(err.Error(), "--append") {
+		t.Errorf("Append of a Parquet file: %v", err)
+	}
+}
+
+func TestArrowInput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.arrow")
+	if err := os.WriteFile(path, buildArrow(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format, err := InputFormat(path); err != nil || format != FormatArrow {
+		t.Fatalf("Detected format %q (%v)", format, err)
+	}
+	want := `id,name,cat,price,ts,flag
+1,x,blue,12.34,1970-01-01T00:00:00Z,true
+2,,red,-0.01,1970-01-01T00:00:01.5Z,false
+3,"say ""hi""",red,0.05,1970-01-02T00:00:00Z,true
+`
+	if got := renderFile(t, path, FormatArrow); got != want {
+		t.Errorf("Rendered\n%s\nexpected\n%s", got, want)
+	}
+
+	// Truncated files fail cleanly
+	data, _ := os.ReadFile(path)
+	if err := readArrow(data[:len(data)/2], nil); err == nil {
+		t.Error("Truncated Arrow file was read")
+	}
+	data, _ = os.ReadFile(path)
+	data[len(data)/3] ^= 0xff
+	_ = readArrow(data, func([]string, [][]string, int) error { return nil }) // Must not panic
+}
+
+func TestCSVInputFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(path, []byte("PAR"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format, err := InputFormat(path); err != nil || format != "" {
+		t.Errorf("Detected format %q (%v) for a CSV", format, err)
+	}
+}
+
+func renderFile(t *testing.T, path, format string) string {
+	t.Helper()
+	csvPath := filepath.Join(t.TempDir(), "rendered.csv")
+	if err := renderColumnar(path, format, csvPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Thrift compact protocol writer for building Parquet metadata.
+type (
+	tI32    int32
+	tI64    int64
+	tBin    string
+	tList   []any // Of tI32, tBin or tStruct
+	tStruct []tField
+	tField  struct {
+		id int16
+		v  any
+	}
+)
+
+func thriftType(v any) byte {
+	switch v.(type) {
+	case tI32:
+		return 5
+	case tI64:
+		return 6
+	case tBin:
+		return 8
+	case tList:
+		return 9
+	}
+	return 12
+}
+
+func appendThrift(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case tI32:
+		return binary.AppendVarint(b, int64(v))
+	case tI64:
+		return binary.AppendVarint(b, int64(v))
+	case tBin:
+		return append(binary.AppendUvarint(b, uint64(len(v))), v...)
+	case tList:
+		elem := byte(12)
+		if len(v) > 0 {
+			elem = thriftType(v[0])
+		}
+		b = append(b, 0xf0|elem)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for _, item := range v {
+			b = appendThrift(b, item)
+		}
+		return b
+	case tStruct:
+		for _, f := range v {
+			b = append(b, thriftType(f.v)) // Long form field headers
+			b = binary.AppendVarint(b, int64(f.id))
+			b = appendThrift(b, f.v)
+		}
+		return append(b, 0)
+	}
+	panic("unknown Thrift value")
+}
+
+// packBits bit-packs values as one RLE/bit-packed hybrid run.
+func packBits(values []uint64, width int) []byte {
+	groups := (len(values) + 7) / 8
+	out := binary.AppendUvarint(nil, uint64(groups<<1|1))
+	packed := make([]byte, groups*width)
+	for i, v := range values {
+		for b := range width {
+			if v&(1<<b) != 0 {
+				bit := i*width + b
+				packed[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+	return append(out, packed...)
+}
+
+// buildParquet writes two row groups of id (INT64), name (optional,
+// dictionary-encoded), price (DECIMAL(9,2) as INT32) and day (DATE); the
+// second row group is snappy-compressed.
+func buildParquet() []byte {
+	type group struct {
+		ids    []int64
+		names  []string // "" = null
+		prices []int32
+		days   []int32
+		codec  int32
+	}
+	groups := []group{
+		{[]int64{1, 2, 3}, []string{"alice", "", "bob, jr"}, []int32{1050, -5, 0}, []int32{0, 19000, -1}, 0},
+		{[]int64{4, 5}, []string{"alice", "carol"}, []int32{199, 100000}, []int32{1, 365}, 1},
+	}
+
+	file := []byte(parquetMagic)
+	var rowGroups tList
+	for _, g := range groups {
+		// writePage appends a page and returns its offset
+		writePage := func(header tStruct, page []byte) int64 {
+			pos := int64(len(file))
+			size := len(page)
+			if g.codec == 1 {
+				page = s2.EncodeSnappy(nil, page)
+			}
+			header = append(tStruct{{2, tI32(size)}, {3, tI32(len(page))}}, header...)
+			file = append(appendThrift(file, header), page...)
+			return pos
+		}
+		chunk := func(physical int32, name string, dictOffset, dataOffset int64) tStruct {
+			meta := tStruct{
+				{1, tI32(physical)},
+				{2, tList{tI32(pqPlain), tI32(pqRLEDictionary)}},
+				{3, tList{tBin(name)}},
+				{4, tI32(g.codec)},
+				{5, tI64(len(g.ids))},
+				{6, tI64(int64(len(file)) - min(dictOffset, dataOffset))},
+				{7, tI64(int64(len(file)) - min(dictOffset, dataOffset))},
+				{9, tI64(dataOffset)},
+			}
+			if dictOffset < dataOffset {
+				meta = append(meta, tField{11, tI64(dictOffset)})
+			}
+			return tStruct{{2, tI64(dataOffset)}, {3, meta}}
+		}
+		dataPage := func(n int, encoding int32) tStruct {
+			return tStruct{{1, tI32(pqDataPage)}, {5, tStruct{{1, tI32(n)}, {2, tI32(encoding)}, {3, tI32(pqRLE)}, {4, tI32(pqRLE)}}}}
+		}
+		plainInts := func(width int, values ...int64) []byte {
+			var b []byte
+			for _, v := range values {
+				if width == 4 {
+					b = binary.LittleEndian.AppendUint32(b, uint32(v))
+				} else {
+					b = binary.LittleEndian.AppendUint64(b, uint64(v))
+				}
+			}
+			return b
+		}
+		int32s := func(v []int32) []int64 {
+			out := make([]int64, len(v))
+			for i := range v {
+				out[i] = int64(v[i])
+			}
+			return out
+		}
+
+		var columns tList
+		pos := writePage(dataPage(len(g.ids), pqPlain), plainInts(8, g.ids...))
+		columns = append(columns, chunk(pqInt64, "id", pos+1, pos))
+
+		// name: dictionary page, then definition levels and indices
+		var dict, levelBits []byte
+		var levels, indices []uint64
+		seen := map[string]uint64{}
+		for _, name := range g.names {
+			if name == "" {
+				levels = append(levels, 0)
+				continue
+			}
+			levels = append(levels, 1)
+			if _, ok := seen[name]; !ok {
+				seen[name] = uint64(len(seen))
+				dict = binary.LittleEndian.AppendUint32(dict, uint32(len(name)))
+				dict = append(dict, name...)
+			}
+			indices = append(indices, seen[name])
+		}
+		dictPos := writePage(tStruct{{1, tI32(pqDictionaryPage)}, {7, tStruct{{1, tI32(len(seen))}, {2, tI32(pqPlain)}}}}, dict)
+		levelBits = packBits(levels, 1)
+		page := binary.LittleEndian.AppendUint32(nil, uint32(len(levelBits)))
+		page = append(append(page, levelBits...), 1) // Bit width of the indices
+		page = append(page, packBits(indices, 1)...)
+		pos = writePage(dataPage(len(g.names), pqRLEDictionary), page)
+		columns = append(columns, chunk(pqByteArray, "name", dictPos, pos))
+
+		pos = writePage(dataPage(len(g.prices), pqPlain), plainInts(4, int32s(g.prices)...))
+		columns = append(columns, chunk(pqInt32, "price", pos+1, pos))
+		pos = writePage(dataPage(len(g.days), pqPlain), plainInts(4, int32s(g.days)...))
+		columns = append(columns, chunk(pqInt32, "day", pos+1, pos))
+
+		rowGroups = append(rowGroups, tStruct{{1, columns}, {2, tI64(0)}, {3, tI64(len(g.ids))}})
+	}
+
+	schema := tList{
+		tStruct{{4, tBin("schema")}, {5, tI32(4)}},
+		tStruct{{1, tI32(pqInt64)}, {3, tI32(0)}, {4, tBin("id")}},
+		tStruct{{1, tI32(pqByteArray)}, {3, tI32(1)}, {4, tBin("name")}, {6, tI32(0)}},
+		tStruct{{1, tI32(pqInt32)}, {3, tI32(0)}, {4, tBin("price")}, {6, tI32(5)}, {7, tI32(2)}, {8, tI32(9)}},
+		tStruct{{1, tI32(pqInt32)}, {3, tI32(0)}, {4, tBin("day")}, {10, tStruct{{6, tStruct{}}}}},
+	}
+	footer := appendThrift(nil, tStruct{{1, tI32(2)}, {2, schema}, {3, tI64(5)}, {4, rowGroups}})
+	file = append(file, footer...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(footer)))
+	return append(file, parquetMagic...)
+}
+
+// Flatbuffer builder for Arrow metadata: tables are written before their
+// children, which uoffsets allow.
+type (
+	fbTab     []any // Fields by id: fbScalar, fbTab, fbTables, fbStructs, string or nil
+	fbScalar  []byte
+	fbTables  []fbTab
+	fbStructs struct {
+		n   int
+		raw []byte
+	}
+)
+
+func fbI8(v int8) fbScalar   { return fbScalar{byte(v)} }
+func fbI16(v int16) fbScalar { return binary.LittleEndian.AppendUint16(nil, uint16(v)) }
+func fbI32(v int32) fbScalar { return binary.LittleEndian.AppendUint32(nil, uint32(v)) }
+func fbI64(v int64) fbScalar { return binary.LittleEndian.AppendUint64(nil, uint64(v)) }
+
+func fbBuild(root fbTab) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(fbWrite(&buf, root)))
+	return buf
+}
+
+func fbWrite(buf *[]byte, obj any) int {
+	pos := len(*buf)
+	switch o := obj.(type) {
+	case string:
+		*buf = binary.LittleEndian.AppendUint32(*buf, uint32(len(o)))
+		*buf = append(append(*buf, o...), 0)
+	case fbStructs:
+		*buf = binary.LittleEndian.AppendUint32(*buf, uint32(o.n))
+		*buf = append(*buf, o.raw...)
+	case fbTables:
+		*buf = binary.LittleEndian.AppendUint32(*buf, uint32(len(o)))
+		*buf = append(*buf, make([]byte, 4*len(o))...)
+		for i, t := range o {
+			slot := pos + 4 + 4*i
+			child := fbWrite(buf, t) // May move *buf
+			binary.LittleEndian.PutUint32((*buf)[slot:], uint32(child-slot))
+		}
+	case fbTab:
+		offsets := make([]int, len(o))
+		size := 4
+		for i, f := range o {
+			if f == nil {
+				continue
+			}
+			offsets[i] = size
+			if s, ok := f.(fbScalar); ok {
+				size += len(s)
+			} else {
+				size += 4
+			}
+		}
+		*buf = binary.LittleEndian.AppendUint16(*buf, uint16(4+2*len(o)))
+		*buf = binary.LittleEndian.AppendUint16(*buf, uint16(size))
+		for _, off := range offsets {
+			*buf = binary.LittleEndian.AppendUint16(*buf, uint16(off))
+		}
+		table := len(*buf)
+		*buf = binary.LittleEndian.AppendUint32(*buf, uint32(table-pos))
+		for _, f := range o {
+			if s, ok := f.(fbScalar); ok {
+				*buf = append(*buf, s...)
+			} else if f != nil {
+				*buf = append(*buf, 0, 0, 0, 0)
+			}
+		}
+		for i, f := range o {
+			if _, ok := f.(fbScalar); ok || f == nil {
+				continue
+			}
+			slot := table + offsets[i]
+			child := fbWrite(buf, f)
+			binary.LittleEndian.PutUint32((*buf)[slot:], uint32(child-slot))
+		}
+		return table
+	}
+	return pos
+}
+
+// buildArrow writes an Arrow IPC file of id (int64), name (nullable
+// utf8), cat (utf8 dictionary with int8 indices), price (decimal128 with
+// scale 2), ts (timestamp ms) and flag (bool) in two record batches, the
+// second zstd-compressed.
+func buildArrow(t *testing.T) []byte {
+	t.Helper()
+	file := []byte(arrowMagic + "\x00\x00")
+	pad := func(b []byte) []byte {
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	var dictBlocks, batchBlocks []byte
+	writeMessage := func(blocks *[]byte, typ int8, header fbTab, body []byte) {
+		meta := pad(fbBuild(fbTab{fbI16(4), fbI8(typ), header, fbI64(int64(len(body)))}))
+		offset := len(file)
+		file = binary.LittleEndian.AppendUint32(file, 0xffffffff)
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(meta)))
+		file = append(append(file, meta...), body...)
+		*blocks = binary.LittleEndian.AppendUint64(*blocks, uint64(offset))
+		*blocks = binary.LittleEndian.AppendUint64(*blocks, uint64(8+len(meta))) // Length, then padding
+		*blocks = binary.LittleEndian.AppendUint64(*blocks, uint64(len(body)))
+	}
+	// batch returns a RecordBatch of rows rows with one node per column
+	batch := func(rows, columns int, buffers [][]byte, zstd bool) (fbTab, []byte) {
+		var nodes, bufs, body []byte
+		for range columns {
+			nodes = binary.LittleEndian.AppendUint64(nodes, uint64(rows))
+			nodes = binary.LittleEndian.AppendUint64(nodes, 0)
+		}
+		codec, _ := common.NewCodec(common.CodecZstd)
+		for _, b := range buffers {
+			if zstd && len(b) > 0 {
+				comp, err := codec.Compress(binary.LittleEndian.AppendUint64(nil, uint64(len(b))), b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b = comp
+			}
+			bufs = binary.LittleEndian.AppendUint64(bufs, uint64(len(body)))
+			bufs = binary.LittleEndian.AppendUint64(bufs, uint64(len(b)))
+			body = pad(append(body, b...))
+		}
+		rb := fbTab{fbI64(int64(rows)), fbStructs{columns, nodes}, fbStructs{len(buffers), bufs}, nil}
+		if zstd {
+			rb[3] = fbTab{fbI8(1)}
+		}
+		return rb, body
+	}
+	le := func(width int, values ...int64) []byte {
+		var b []byte
+		for _, v := range values {
+			switch width {
+			case 1:
+				b = append(b, byte(v))
+			case 8:
+				b = binary.LittleEndian.AppendUint64(b, uint64(v))
+			case 16: // Sign-extended
+				b = binary.LittleEndian.AppendUint64(b, uint64(v))
+				b = binary.LittleEndian.AppendUint64(b, uint64(v>>63))
+			}
+		}
+		return b
+	}
+	utf8s := func(values ...string) (offsets, data []byte) {
+		offsets = binary.LittleEndian.AppendUint32(nil, 0)
+		for _, v := range values {
+			data = append(data, v...)
+			offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+		}
+		return offsets, data
+	}
+
+	field := func(name string, typ int8, spec fbTab, dict fbTab) fbTab {
+		f := fbTab{name, fbI8(1), fbI8(typ), spec, nil, fbTables{}}
+		if dict != nil {
+			f[4] = dict
+		}
+		return f
+	}
+	schema := fbTab{fbI16(0), fbTables{
+		field("id", arrowInt, fbTab{fbI32(64), fbI8(1)}, nil),
+		field("name", arrowUtf8, fbTab{}, nil),
+		field("cat", arrowUtf8, fbTab{}, fbTab{fbI64(7), fbTab{fbI32(8), fbI8(1)}}),
+		field("price", arrowDecimal, fbTab{fbI32(10), fbI32(2)}, nil),
+		field("ts", arrowTimestamp, fbTab{fbI16(1)}, nil),
+		field("flag", arrowBool, fbTab{}, nil),
+	}}
+
+	offsets, data := utf8s("red", "blue")
+	rb, body := batch(2, 1, [][]byte{nil, offsets, data}, false)
+	writeMessage(&dictBlocks, arrowDictionaryBatch, fbTab{fbI64(7), rb}, body)
+
+	nameOffsets, nameData := utf8s("x", "")
+	rb, body = batch(2, 6, [][]byte{
+		nil, le(8, 1, 2),
+		{0b01}, nameOffsets, nameData,
+		nil, le(1, 1, 0),
+		nil, le(16, 1234, -1),
+		nil, le(8, 0, 1500),
+		nil, {0b01},
+	}, false)
+	writeMessage(&batchBlocks, arrowRecordBatch, rb, body)
+
+	nameOffsets, nameData = utf8s(`say "hi"`)
+	rb, body = batch(1, 6, [][]byte{
+		nil, le(8, 3),
+		nil, nameOffsets, nameData,
+		nil, le(1, 0),
+		nil, le(16, 5),
+		nil, le(8, 86400000),
+		nil, {0b1},
+	}, true)
+	writeMessage(&batchBlocks, arrowRecordBatch, rb, body)
+
+	footer := fbBuild(fbTab{fbI16(4), schema, fbStructs{1, dictBlocks}, fbStructs{2, batchBlocks}})
+	file = append(file, footer...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(footer)))
+	return append(file, arrowMagic...)
+}
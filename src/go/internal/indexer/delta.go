@@ -0,0 +1,147 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// WriteDeltas extends the index deltas of csvPath in outputDir (see
+// common.DeltaHeader) with the rows appended to the CSV from byte offset
+// from. Only those bytes are scanned when the deltas end at from; deltas
+// left behind by an earlier build, or missing rows another append did not
+// record, are written again from where the indexes end. A CSV without
+// index metadata has no indexes to extend: nothing is written.
+func WriteDeltas(csvPath, outputDir string, from int64) error {
+	if storage.IsRemote(outputDir) {
+		return fmt.Errorf("index deltas require a local index directory, not %s", outputDir)
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	data, err := os.ReadFile(filepath.Join(outputDir, csvName+"_meta.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid index metadata: %w", err)
+	}
+	if meta.Format != "" {
+		return fmt.Errorf("%s input is indexed in full; index deltas apply to CSV files", meta.Format)
+	}
+	if len(meta.Indexes) == 0 {
+		return nil
+	}
+
+	scanner, err := NewScanner(csvPath, meta.Separator)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = scanner.Close() }()
+	s, err := schema.Load(csvPath)
+	if err != nil {
+		return err
+	}
+	if err := scanner.AddSchema(s); err != nil {
+		return err
+	}
+	end := scanner.fileSize
+	store := storage.NewLocal(outputDir)
+
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	// Each delta is extended from from if it ends there, else rewritten
+	// from where the indexes end: the scan covers the earliest start
+	colIndices := make([][]int, len(names))
+	starts := make([]int64, len(names))
+	previous := make([][]common.IndexRecord, len(names))
+	scanFrom := end
+	for i, name := range names {
+		stats := meta.Indexes[name]
+		if len(stats.Columns) == 0 {
+			return fmt.Errorf("index %s predates column metadata; rebuild it", name)
+		}
+		colIndices[i] = make([]int, len(stats.Columns))
+		for j, col := range stats.Columns {
+			idx, ok := scanner.GetColumnIndex(col)
+			if !ok {
+				return fmt.Errorf("index %s: column not found: %s", name, col)
+			}
+			colIndices[i][j] = idx
+		}
+
+		starts[i] = meta.CsvSize
+		if data, err := os.ReadFile(filepath.Join(outputDir, common.DeltaFileName(csvName, name))); err == nil {
+			if h, records, err := common.DecodeDelta(data); err == nil && h.Covers(&meta) && h.To == from {
+				starts[i], previous[i] = from, records
+			}
+		}
+		scanFrom = min(scanFrom, starts[i])
+	}
+
+	// Keys as the build makes them (see Indexer.Run), per worker
+	workers := make([][][]common.IndexRecord, scanner.workers)
+	foldBufs := make([][]byte, scanner.workers)
+	handler := func(workerID int, keys [][]byte, offset, line int64) {
+		if workers[workerID] == nil {
+			workers[workerID] = make([][]common.IndexRecord, len(names))
+		}
+		for i, key := range keys {
+			if offset < starts[i] {
+				continue
+			}
+			if meta.Indexes[names[i]].Collation == common.CollationCI {
+				foldBufs[workerID] = common.AppendFoldKey(foldBufs[workerID][:0], key)
+				key = foldBufs[workerID]
+			}
+			rec := common.IndexRecord{Offset: offset, Line: line}
+			common.PutKey(&rec.Key, key)
+			workers[workerID][i] = append(workers[workerID][i], rec)
+		}
+	}
+	if err := scanner.ScanRange(max(scanFrom, scanner.DataStart()), end, colIndices, handler); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		records := previous[i]
+		for _, recs := range workers {
+			if recs != nil {
+				records = append(records, recs[i]...)
+			}
+		}
+		slices.SortFunc(records, compareRecords)
+		h := common.DeltaHeader{Generation: meta.Generation, From: meta.CsvSize, To: end}
+		data, err := common.EncodeDelta(h, records)
+		if err != nil {
+			return err
+		}
+		if err := storage.WriteFile(store, common.DeltaFileName(csvName, name), data); err != nil {
+			return fmt.Errorf("index %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// removeDeltas removes the index deltas of the named indexes of a CSV
+// (names in any case). Missing files are ignored.
+func removeDeltas(store storage.Backend, csvName string, names []string) {
+	for _, name := range names {
+		_ = store.Remove(common.DeltaFileName(csvName, strings.ToLower(name)))
+	}
+}
@@ -5,14 +5,21 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/status"
+	"github.com/entreya/csvquery/internal/storage"
 )
 
 // IndexerConfig holds configuration for the indexer
@@ -26,29 +33,78 @@ type IndexerConfig struct {
 	BloomFPRate float64 // Bloom filter false positive rate
 	Verbose     bool    // Enable verbose output
 	Version     string  // version string
+
+	// ZoneColumn is the column whose numeric min/max every index records
+	// per block. Empty: single-column indexes use their own column.
+	ZoneColumn string
+
+	// Codec compresses the index blocks: lz4 (default), zstd or none
+	Codec string
+
+	// RowStore also writes a compressed copy of the CSV rows (.csvz) that
+	// queries read rows from when the CSV is gone. Append builds rewrite
+	// an existing one.
+	RowStore bool
+
+	// AppendFrom indexes only rows starting at this byte offset and merges
+	// them into the existing indexes (0 = full build)
+	AppendFrom int64
+
+	// Partitions splits each index over that many part files of about equal
+	// size (0 or 1 = one .cidx), so a lookup maps only the part holding its
+	// keys. Append builds keep the partition count of the existing index.
+	Partitions int
+
+	// Resume continues an interrupted full build from its checkpoint.
+	// CheckpointBytes is the CSV scanned between checkpoints (0 = 1 GiB).
+	Resume          bool
+	CheckpointBytes int64
+	Output          io.Writer // Progress output (defaults to stdout)
+
+	// Publish, if set, runs the metadata write that switches queries to
+	// the new index files (and removes the superseded ones), so a caller
+	// can hold a lock around it, e.g. to let running queries finish first.
+	Publish func(publish func() error) error
 }
 
 // Indexer builds multiple indexes from a CSV file
 type Indexer struct {
 	config      IndexerConfig
-	colDefs     [][]string // Parsed column definitions
+	colDefs     [][]string     // Parsed column definitions
+	schema      *schema.Schema // Column aliases of the CSV (see parseColumns)
+	collations  []string       // Collation of each index of colDefs ("" or common.CollationCI)
 	scanner     *Scanner
 	tempDir     string
 	meta        common.IndexMeta
 	metaMutex   sync.Mutex
 	sorters     []*Sorter
 	sorterMutex sync.RWMutex
-	stopReport  chan struct{}
+	memory      *memoryArbiter  // Sort budget shared by the sorters
+	store       storage.Backend // Where the indexes are written (OutputDir)
+	generation  int64           // Of the files this build writes (see publishing in saveMeta)
+
+	// Resume manifest of full builds (see checkpoint.go)
+	checkpoint      *checkpoint
+	checkpointMutex sync.Mutex
+	barrier         sync.WaitGroup // Sorter nodes that have yet to spill for a checkpoint
+	sorterFailed    atomic.Bool
+	stopReport      chan struct{}
+	out             io.Writer
 }
 
 // NewIndexer creates a new indexer
 func NewIndexer(config IndexerConfig) *Indexer {
+	out := config.Output
+	if out == nil {
+		out = os.Stdout
+	}
 	return &Indexer{
 		config: config,
 		meta: common.IndexMeta{
 			Indexes: make(map[string]common.IndexStats),
 		},
 		stopReport: make(chan struct{}),
+		out:        out,
 	}
 }
 
@@ -57,55 +113,143 @@ func (indexer *Indexer) Run() error {
 	// startTime := time.Now()
 
 	// Print header
-	fmt.Println("╔══════════════════════════════════════════════════════════════════════════╗")
+	fmt.Fprintln(indexer.out, "╔══════════════════════════════════════════════════════════════════════════╗")
 	content := fmt.Sprintf("CSVQUERY INDEXER (PIPELINED) v%s", indexer.config.Version)
 	padding := 74 - len(content)
 	left := padding / 2
 	right := padding - left
-	fmt.Printf("║%*s%s%*s║\n", left, "", content, right, "")
-	fmt.Println("╚══════════════════════════════════════════════════════════════════════════╝")
-	fmt.Printf("\nInput:    %s\n", indexer.config.InputFile)
-	fmt.Printf("Output:   %s\n", indexer.config.OutputDir)
+	fmt.Fprintf(indexer.out, "║%*s%s%*s║\n", left, "", content, right, "")
+	fmt.Fprintln(indexer.out, "╚══════════════════════════════════════════════════════════════════════════╝")
+	fmt.Fprintf(indexer.out, "\nInput:    %s\n", indexer.config.InputFile)
+	fmt.Fprintf(indexer.out, "Output:   %s\n", indexer.config.OutputDir)
 
 	// Parse column definitions
 	if err := indexer.parseColumns(); err != nil {
 		return err
 	}
-	fmt.Printf("Indexes:  %d\n", len(indexer.colDefs))
-	fmt.Printf("Workers:  %d\n", indexer.config.Workers)
-	fmt.Printf("Memory:   %dMB per worker\n\n", indexer.config.MemoryMB)
+	format, err := InputFormat(indexer.config.InputFile)
+	if err != nil {
+		return err
+	}
+	if format != "" {
+		if indexer.config.AppendFrom > 0 || indexer.config.Resume {
+			return fmt.Errorf("%s input is indexed in full; --append and --resume apply to CSV files", format)
+		}
+		fmt.Fprintf(indexer.out, "Format:   %s\n", format)
+	}
+	if indexer.config.AppendFrom > 0 {
+		if err := indexer.loadExistingMeta(); err != nil {
+			return err
+		}
+		fmt.Fprintf(indexer.out, "Append:   from byte %d\n", indexer.config.AppendFrom)
+	}
+	fmt.Fprintf(indexer.out, "Indexes:  %d\n", len(indexer.colDefs))
+	fmt.Fprintf(indexer.out, "Workers:  %d\n", indexer.config.Workers)
+	fmt.Fprintf(indexer.out, "Memory:   %dMB per worker\n\n", indexer.config.MemoryMB)
 
-	// Create output directory
-	if err := os.MkdirAll(indexer.config.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	// Open the output location. Spills stay local: next to the indexes, or
+	// in the system temp dir when they go to remote storage.
+	store, err := storage.Open(indexer.config.OutputDir)
+	if err != nil {
+		return err
+	}
+	indexer.store = store
+	if _, local := store.(*storage.Local); local {
+		if err := os.MkdirAll(indexer.config.OutputDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+		indexer.tempDir = filepath.Join(indexer.config.OutputDir, ".csvquery_temp")
+	} else {
+		sum := sha1.Sum([]byte(indexer.config.OutputDir))
+		indexer.tempDir = filepath.Join(os.TempDir(), "csvquery_temp_"+hex.EncodeToString(sum[:6]))
 	}
 
 	// Create temp directory for Sorter spills
-	indexer.tempDir = filepath.Join(indexer.config.OutputDir, ".csvquery_temp")
 	if err := os.MkdirAll(indexer.tempDir, 0755); err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
 	// NOTE: Cleanup registration moved to main.go using indexer.Cleanup()
 
-	// Open scanner
-	var err error
-	indexer.scanner, err = NewScanner(indexer.config.InputFile, indexer.config.Separator)
+	// Open scanner. Parquet and Arrow inputs are rendered to a CSV first.
+	if format != "" {
+		indexer.scanner, err = newColumnarScanner(indexer.config.InputFile, format, indexer.tempDir)
+	} else {
+		indexer.scanner, err = NewScanner(indexer.config.InputFile, indexer.config.Separator)
+	}
 	if err != nil {
 		return err
 	}
+	indexer.meta.Format = format
 	// Propagate worker count to scanner
 	if indexer.config.Workers > 0 {
 		indexer.scanner.SetWorkers(indexer.config.Workers)
 	}
+	indexer.scanner.SetStartOffset(indexer.config.AppendFrom)
 	defer func() { _ = indexer.scanner.Close() }()
+	dialect, sniffed := indexer.scanner.Dialect()
+	if sniffed && dialect.Separator != ',' {
+		fmt.Fprintf(indexer.out, "Separator: %s (detected)\n\n", common.SeparatorName(dialect.Separator))
+	}
+	if !dialect.HasHeader {
+		fmt.Fprintf(indexer.out, "  ⚠️  The first line looks like data rather than a header; its values are used as column names\n")
+	}
+	if dialect.Quote != '"' {
+		fmt.Fprintf(indexer.out, "  ⚠️  Fields look quoted with %q; only \" is recognized as a quote\n", dialect.Quote)
+	}
 
-	// Validate columns
+	// Validate columns (virtual ones are computed during the scan)
+	if err := indexer.scanner.AddSchema(indexer.schema); err != nil {
+		return err
+	}
 	for _, cols := range indexer.colDefs {
 		if err := indexer.scanner.ValidateColumns(cols); err != nil {
 			return err
 		}
 	}
+	if indexer.config.ZoneColumn != "" {
+		if err := indexer.scanner.ValidateColumns([]string{indexer.config.ZoneColumn}); err != nil {
+			return err
+		}
+	}
+	if _, err := common.NewCodec(indexer.config.Codec); err != nil {
+		return err
+	}
+
+	// Full builds keep a checkpoint (append builds are cheap to redo)
+	var resumedRows int64
+	switch {
+	case indexer.config.Resume && indexer.config.AppendFrom > 0:
+		return fmt.Errorf("--resume applies to full builds only")
+	case indexer.config.Resume:
+		if err := indexer.loadCheckpoint(); err != nil {
+			return err
+		}
+		resumedRows = indexer.checkpoint.Rows
+		indexer.scanner.SetStartOffset(indexer.checkpoint.Offset)
+		done := 0
+		for _, state := range indexer.checkpoint.Indexes {
+			if state.Done {
+				done++
+			}
+		}
+		fmt.Fprintf(indexer.out, "Resume:   from byte %d (%d rows, %d indexes done)\n\n", indexer.checkpoint.Offset, resumedRows, done)
+	case indexer.config.AppendFrom == 0:
+		if err := indexer.newCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	// Files of this build get the next generation, so the indexes queries
+	// are reading stay untouched until saveMeta publishes the new ones
+	indexer.generation = indexer.previousMeta().Generation + 1
+	if indexer.checkpoint != nil {
+		if indexer.config.Resume {
+			indexer.generation = indexer.checkpoint.Generation
+		} else {
+			indexer.checkpoint.Generation = indexer.generation
+		}
+	}
 
 	// Initialize Channels and Sorters
 	numIndexes := len(indexer.colDefs)
@@ -120,7 +264,14 @@ func (indexer *Indexer) Run() error {
 	indexer.startReporting()
 	defer indexer.stopReporting()
 
-	fmt.Println("Phase 1: Starting Pipelined Indexing...")
+	activity := status.Begin("index", fmt.Sprintf("input=%s columns=%s", indexer.config.InputFile, indexer.config.Columns))
+	defer activity.End()
+	startTime := time.Now()
+	activity.SetReporter(func() string { return indexer.statusLine(startTime) })
+
+	fmt.Fprintln(indexer.out, "Phase 1: Starting Pipelined Indexing...")
+
+	indexer.memory = newMemoryArbiter(int64(indexer.config.MemoryMB) << 20)
 
 	// Launch Sorter Consumers (One per index)
 	for i, cols := range indexer.colDefs {
@@ -130,10 +281,9 @@ func (indexer *Indexer) Run() error {
 
 		go func(indexIdx int, columns []string, batchChannel <-chan []common.IndexRecord) {
 			defer wg.Done()
-			// Normalize index name to lowercase to match QueryEngine expectations
-			colName := strings.ToLower(strings.Join(columns, "_"))
+			colName := IndexName(columns)
 
-			err := indexer.runSorterNode(colName, batchChannel)
+			err := indexer.runSorterNode(colName, columns, indexer.collations[indexIdx], batchChannel)
 			if err != nil {
 				errors <- fmt.Errorf("%s: %v", colName, err)
 			} else {
@@ -167,10 +317,16 @@ func (indexer *Indexer) Run() error {
 		}
 	}
 
+	// Keys longer than common.KeySize, per index
+	truncatedKeys := make([]atomic.Int64, numIndexes)
+
+	// Case-insensitive indexes fold their keys in a per-worker buffer
+	foldBufs := make([][]byte, numWorkers)
+
 	// Start Scanning
 	lastProgress := time.Now()
 
-	err = indexer.scanner.Scan(colIndices, func(workerID int, keys [][]byte, offset, line int64) {
+	handler := func(workerID int, keys [][]byte, offset, line int64) {
 		// keys corresponds to indexer.colDefs index
 		// Use workerID to access thread-local buffer
 		if workerID >= len(workerBuffers) {
@@ -181,9 +337,16 @@ func (indexer *Indexer) Run() error {
 		buffers := workerBuffers[workerID]
 
 		for i, key := range keys {
+			if indexer.collations[i] == common.CollationCI {
+				foldBufs[workerID] = common.AppendFoldKey(foldBufs[workerID][:0], key)
+				key = foldBufs[workerID]
+			}
+
 			// Optimization: Append to buffer
-			var keyBytes [64]byte
-			copy(keyBytes[:], key)
+			var keyBytes [common.KeySize]byte
+			if common.PutKey(&keyBytes, key) {
+				truncatedKeys[i].Add(1)
+			}
 
 			rec := common.IndexRecord{
 				Key:    keyBytes,
@@ -217,17 +380,39 @@ func (indexer *Indexer) Run() error {
 			// fmt.Println(indexer.scanner.ScanProgress())
 			lastProgress = time.Now()
 		}
-	})
+	}
 
-	// Flush remaining buffers
-	for w := 0; w < numWorkers; w++ {
-		for i := 0; i < numIndexes; i++ {
-			if len(workerBuffers[w][i]) > 0 {
-				channels[i] <- workerBuffers[w][i]
+	// flushBuffers sends the workers' partial batches
+	flushBuffers := func() {
+		for w := 0; w < numWorkers; w++ {
+			for i := 0; i < numIndexes; i++ {
+				if len(workerBuffers[w][i]) > 0 {
+					channels[i] <- workerBuffers[w][i]
+					workerBuffers[w][i] = make([]common.IndexRecord, 0, batchSize)
+				}
 			}
 		}
 	}
 
+	// Scan in segments, checkpointing after each
+	interval := indexer.config.CheckpointBytes
+	if interval <= 0 {
+		interval = defaultCheckpointBytes
+	}
+	for from, end := indexer.scanner.DataStart(), indexer.scanner.fileSize; from < end; {
+		to := end
+		if indexer.checkpoint != nil && end-from > interval {
+			to = indexer.scanner.RecordBoundary(from + interval)
+		}
+		if err = indexer.scanner.ScanRange(from, to, colIndices, handler); err != nil {
+			break
+		}
+		flushBuffers()
+		rows, _, _ := indexer.scanner.GetStats()
+		indexer.checkpointScan(to, resumedRows+rows, channels)
+		from = to
+	}
+
 	// Close all channels to signal Sorters to finish
 	for _, batchChannel := range channels {
 		close(batchChannel)
@@ -250,13 +435,13 @@ func (indexer *Indexer) Run() error {
 			if !ok {
 				results = nil
 			} else {
-				fmt.Printf("  ✅ %s\n", name)
+				fmt.Fprintf(indexer.out, "  ✅ %s\n", name)
 			}
 		case err, ok := <-errors:
 			if !ok {
 				errors = nil
 			} else {
-				fmt.Printf("  ❌ %v\n", err)
+				fmt.Fprintf(indexer.out, "  ❌ %v\n", err)
 				hasError = true
 			}
 		}
@@ -264,15 +449,25 @@ func (indexer *Indexer) Run() error {
 			break
 		}
 	}
+	for i, cols := range indexer.colDefs {
+		if n := truncatedKeys[i].Load(); n > 0 {
+			fmt.Fprintf(indexer.out, "  ⚠️  %s: %d keys longer than %d bytes were truncated; lookups on them are verified against the CSV\n",
+				IndexName(cols), n, common.KeySize)
+		}
+	}
 
 	// Stats
 	rows, bytes, elapsed := indexer.scanner.GetStats()
-	indexer.meta.TotalRows = rows
-	fmt.Printf("\nStatistics:\n")
-	fmt.Printf("  Rows: %d\n", rows)
-	fmt.Printf("  Size: %.1f GB\n", float64(bytes)/1024/1024/1024)
-	fmt.Printf("  Time: %v\n", elapsed.Round(time.Millisecond))
-	fmt.Printf("  Rate: %.0f rows/sec\n", float64(rows)/elapsed.Seconds())
+	if indexer.config.AppendFrom > 0 {
+		indexer.meta.TotalRows += rows
+	} else {
+		indexer.meta.TotalRows = resumedRows + rows
+	}
+	fmt.Fprintf(indexer.out, "\nStatistics:\n")
+	fmt.Fprintf(indexer.out, "  Rows: %d\n", resumedRows+rows)
+	fmt.Fprintf(indexer.out, "  Size: %.1f GB\n", float64(bytes)/1024/1024/1024)
+	fmt.Fprintf(indexer.out, "  Time: %v\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(indexer.out, "  Rate: %.0f rows/sec\n", float64(rows)/elapsed.Seconds())
 
 	// Capture CSV DNA for integrity protection
 	if csvMeta, err := indexer.calculateFingerprint(); err == nil {
@@ -281,12 +476,30 @@ func (indexer *Indexer) Run() error {
 		indexer.meta.CsvHash = csvMeta.hash
 	}
 
+	if hasError && indexer.checkpoint != nil {
+		// Keep the spill chunks and finished indexes for --resume
+		return fmt.Errorf("some indexes failed to build; fix the cause and rerun with --resume")
+	}
+
+	// Columnar inputs always get one: queries read their rows from it
+	if indexer.config.RowStore || indexer.meta.Format != "" || (indexer.config.AppendFrom > 0 && indexer.meta.RowStore != "") {
+		if err := indexer.writeRowStore(); err != nil {
+			return fmt.Errorf("row store: %w", err)
+		}
+	} else {
+		indexer.meta.RowStore = ""
+	}
+
 	// Cleanup temp files
 	indexer.Cleanup()
 
 	// Save metadata
-	if err := indexer.saveMeta(); err != nil {
-		fmt.Printf("⚠️ Failed to save metadata: %v\n", err)
+	publish := indexer.config.Publish
+	if publish == nil {
+		publish = func(save func() error) error { return save() }
+	}
+	if err := publish(indexer.saveMeta); err != nil {
+		fmt.Fprintf(indexer.out, "⚠️ Failed to save metadata: %v\n", err)
 	}
 
 	if hasError {
@@ -296,11 +509,38 @@ func (indexer *Indexer) Run() error {
 	return nil
 }
 
-// runSorterNode consumes data from channel and feeds the Sorter
-func (indexer *Indexer) runSorterNode(name string, batchChannel <-chan []common.IndexRecord) error {
-	csvName := strings.TrimSuffix(filepath.Base(indexer.config.InputFile), filepath.Ext(indexer.config.InputFile))
-	indexPath := filepath.Join(indexer.config.OutputDir, csvName+"_"+name+".cidx")
-	bloomPath := indexPath + ".bloom"
+// runSorterNode consumes data from channel and feeds the Sorter. A nil
+// batch is a checkpoint: spill the buffer, then report to the barrier.
+func (indexer *Indexer) runSorterNode(name string, columns []string, collation string, batchChannel <-chan []common.IndexRecord) (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Keep consuming so the scan and later checkpoints never wait on us
+		indexer.sorterFailed.Store(true)
+		for batch := range batchChannel {
+			if batch == nil {
+				indexer.barrier.Done()
+			}
+		}
+	}()
+
+	resumed := indexer.resumedIndex(name)
+	if resumed != nil && resumed.Done {
+		for batch := range batchChannel {
+			if batch == nil {
+				indexer.barrier.Done()
+			}
+		}
+		stats := resumed.Stats
+		stats.File = indexer.indexFile(name)
+		indexer.metaMutex.Lock()
+		indexer.meta.Indexes[name] = stats
+		indexer.metaMutex.Unlock()
+		return nil
+	}
+
+	indexName := indexer.indexFile(name)
 
 	// Temp dir strictly for this sorter (for external spills)
 	tempSortDir := filepath.Join(indexer.tempDir, fmt.Sprintf("sort_%s", name))
@@ -308,10 +548,11 @@ func (indexer *Indexer) runSorterNode(name string, batchChannel <-chan []common.
 		return fmt.Errorf("failed to create temp sort dir: %w", err)
 	}
 
-	// Memory limit per indexer (shared budget)
+	// Guaranteed share of the sort budget: half an even split. The rest is
+	// borrowed from the arbiter by whichever sorters are buffering.
 	totalMemBytes := indexer.config.MemoryMB * 1024 * 1024
 	numIndexes := len(indexer.colDefs)
-	memoryPerIndex := totalMemBytes / numIndexes
+	memoryPerIndex := totalMemBytes / numIndexes / 2
 	if memoryPerIndex < 10*1024*1024 {
 		memoryPerIndex = 10 * 1024 * 1024 // Minimum 10MB per index
 	}
@@ -325,19 +566,75 @@ func (indexer *Indexer) runSorterNode(name string, batchChannel <-chan []common.
 		bloom = common.NewBloomFilter(10_000_000, indexer.config.BloomFPRate)
 	}
 
-	sorter := NewSorter(name, indexPath, tempSortDir, memoryPerIndex, bloom)
+	// Append mode: sort the new rows on their own, then merge them in
+	// (the bloom filter is filled by the merge instead)
+	sortPath := ""
+	sortBloom := bloom
+	prevFile := ""                          // Append mode only (local)
+	partitions := indexer.config.Partitions // Appends keep those of the index
+	if indexer.config.AppendFrom > 0 {
+		prevFile = indexer.appendTarget(name)
+		if _, err := os.Stat(filepath.Join(indexer.config.OutputDir, prevFile)); err != nil {
+			return fmt.Errorf("no existing index to append to: %w", err)
+		}
+		sortPath = filepath.Join(tempSortDir, "delta.cidx")
+		sortBloom = nil
+		indexer.metaMutex.Lock()
+		partitions = indexer.meta.Indexes[name].Partitions
+		indexer.metaMutex.Unlock()
+	}
+
+	if partitions < 2 {
+		partitions = 0
+	}
+
+	sorter := NewSorter(name, sortPath, tempSortDir, memoryPerIndex, sortBloom)
+	if sortPath == "" {
+		sorter.SetOutput(indexer.store, indexName)
+		sorter.SetPartitions(partitions)
+	}
+	zoneColumn, zone := indexer.zoneMap(columns)
+	if zone != nil {
+		sorter.SetZoneMap(zoneColumn, zone)
+	}
+	sorter.SetCodec(indexer.config.Codec)
+	if indexer.memory != nil {
+		sorter.SetMemoryArbiter(indexer.memory)
+	}
+	// Sorters of all indexes finalize at about the same time: share the workers
+	sorter.SetMergeWorkers(max(1, indexer.config.Workers/len(indexer.colDefs)))
+
+	if resumed != nil {
+		chunks := make([]string, len(resumed.Chunks))
+		for i, chunk := range resumed.Chunks {
+			chunks[i] = filepath.Join(indexer.tempDir, chunk)
+		}
+		sorter.Resume(chunks, resumed.Distincts, resumed.Records)
+	}
 
 	indexer.sorterMutex.Lock()
 	indexer.sorters = append(indexer.sorters, sorter)
 	indexer.sorterMutex.Unlock()
 
 	defer func() {
+		if err != nil && indexer.checkpoint != nil {
+			sorter.releaseMemory() // Keep the chunks for --resume
+			return
+		}
 		sorter.Cleanup()
 		// idx.cleanup() handles the root temp dir.
 	}()
 
 	// Consume channel (Batches)
 	for batch := range batchChannel {
+		if batch == nil {
+			err := sorter.flushChunk()
+			indexer.barrier.Done()
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		for _, indexRecord := range batch {
 			if err := sorter.Add(indexRecord); err != nil {
 				return err
@@ -350,81 +647,426 @@ func (indexer *Indexer) runSorterNode(name string, batchChannel <-chan []common.
 	if err != nil {
 		return err
 	}
+	counts := keyCounts{distinct: distinctCount, keys: sorter.KeyStats()}
 
-	// Get file size
-	stat, _ := os.Stat(indexPath)
-	fileSize := stat.Size()
+	if sortPath != "" {
+		file, merged, err := indexer.mergeDelta(name, prevFile, indexName, sortPath, bloom, zoneColumn, zone)
+		if err != nil {
+			return err
+		}
+		indexName, counts = file, merged
+	}
+
+	fileSize, err := indexSize(indexer.store, indexName)
+	if err != nil {
+		return err
+	}
 
 	// Update metadata
-	indexer.metaMutex.Lock()
-	indexer.meta.Indexes[name] = common.IndexStats{
-		DistinctCount: distinctCount,
-		FileSize:      fileSize,
+	stats := common.IndexStats{
+		File:       indexName,
+		FileSize:   fileSize,
+		Columns:    columns,
+		Collation:  collation,
+		Partitions: partitions,
 	}
+	counts.apply(&stats)
+	indexer.metaMutex.Lock()
+	indexer.meta.Indexes[name] = stats
 	indexer.metaMutex.Unlock()
 
 	// Serialize Bloom Filter
 	if bloom != nil {
-		if err := os.WriteFile(bloomPath, bloom.Serialize(), 0644); err != nil {
-			fmt.Printf("  ⚠️  Bloom filter failed for %s: %v\n", name, err)
+		if err := storage.WriteFile(indexer.store, indexName+".bloom", bloom.Serialize()); err != nil {
+			fmt.Fprintf(indexer.out, "  ⚠️  Bloom filter failed for %s: %v\n", name, err)
 		}
 	}
 
+	indexer.checkpointDone(name, stats)
 	return nil
 }
 
+// zoneMap picks the zone map column of an index: the configured ZoneColumn
+// (read from the CSV row), else the key itself for single-column indexes.
+func (indexer *Indexer) zoneMap(columns []string) (string, common.ZoneFunc) {
+	keyZone := func(rec *common.IndexRecord) string {
+		return common.DecodeKey(common.KeyString(&rec.Key))
+	}
+
+	zoneColumn := strings.ToLower(strings.TrimSpace(indexer.config.ZoneColumn))
+	if zoneColumn == "" {
+		if len(columns) != 1 {
+			return "", nil
+		}
+		return strings.ToLower(columns[0]), keyZone
+	}
+	if len(columns) == 1 && strings.EqualFold(columns[0], zoneColumn) {
+		return zoneColumn, keyZone
+	}
+
+	col, _ := indexer.scanner.GetColumnIndex(zoneColumn)
+	return zoneColumn, func(rec *common.IndexRecord) string {
+		return indexer.scanner.FieldAt(rec.Offset, col)
+	}
+}
+
 // parseColumns parses the JSON column definitions
 func (indexer *Indexer) parseColumns() error {
+	specs, err := ParseIndexSpecs(indexer.config.Columns)
+	if err != nil {
+		return err
+	}
+	// Aliases stand for their header names (see schema.ColumnName), so an
+	// index built on an alias serves queries by either name
+	s, err := schema.Load(indexer.config.InputFile)
+	if err != nil {
+		return fmt.Errorf("failed to load schema: %w", err)
+	}
+	indexer.schema = s
+	for _, spec := range specs {
+		for i, col := range spec.Columns {
+			spec.Columns[i] = s.ColumnName(col)
+		}
+		indexer.colDefs = append(indexer.colDefs, spec.Columns)
+		indexer.collations = append(indexer.collations, spec.Collation)
+	}
+	if indexer.config.ZoneColumn != "" {
+		indexer.config.ZoneColumn = s.ColumnName(indexer.config.ZoneColumn)
+	}
+	return nil
+}
+
+// IndexSpec is one index of a --columns array.
+type IndexSpec struct {
+	Columns   []string
+	Collation string // common.CollationCI or "" (bytewise)
+}
+
+// ParseColumns parses a --columns JSON array into the columns of each
+// index (see ParseIndexSpecs).
+func ParseColumns(spec string) ([][]string, error) {
+	specs, err := ParseIndexSpecs(spec)
+	if err != nil {
+		return nil, err
+	}
+	colDefs := make([][]string, len(specs))
+	for i, s := range specs {
+		colDefs[i] = s.Columns
+	}
+	return colDefs, nil
+}
+
+// ParseIndexSpecs parses a --columns JSON array: "COL" entries are single
+// column indexes, ["A","B"] entries are composite indexes, and
+// {"col":"COL","ci":true} (or {"col":["A","B"],"ci":true}) entries build a
+// case-insensitive index.
+func ParseIndexSpecs(spec string) ([]IndexSpec, error) {
 	// Parse JSON
 	var raw interface{}
-	if err := json.Unmarshal([]byte(indexer.config.Columns), &raw); err != nil {
-		return fmt.Errorf("failed to parse columns JSON: %w", err)
+	if err := json.Unmarshal([]byte(spec), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse columns JSON: %w", err)
+	}
+
+	var specs []IndexSpec
+
+	// columnList reads "COL1" or ["COL1", "COL2"]
+	columnList := func(item interface{}) []string {
+		switch col := item.(type) {
+		case string:
+			return []string{col}
+		case []interface{}:
+			var cols []string
+			for _, c := range col {
+				if s, ok := c.(string); ok {
+					cols = append(cols, s)
+				}
+			}
+			return cols
+		}
+		return nil
 	}
 
 	// Handle different formats
 	switch v := raw.(type) {
 	case []interface{}:
 		for _, item := range v {
-			switch col := item.(type) {
-			case string:
-				// Single column: "COL1"
-				indexer.colDefs = append(indexer.colDefs, []string{col})
-			case []interface{}:
-				// Composite or array: ["COL1"] or ["COL1", "COL2"]
-				var cols []string
-				for _, c := range col {
-					if s, ok := c.(string); ok {
-						cols = append(cols, s)
-					}
+			spec := IndexSpec{Columns: columnList(item)}
+			if obj, ok := item.(map[string]interface{}); ok {
+				spec.Columns = columnList(obj["col"])
+				if len(spec.Columns) == 0 {
+					return nil, fmt.Errorf("column object %v needs a \"col\" name or array", obj)
 				}
-				if len(cols) > 0 {
-					indexer.colDefs = append(indexer.colDefs, cols)
+				if ci, _ := obj["ci"].(bool); ci {
+					spec.Collation = common.CollationCI
 				}
 			}
+			if len(spec.Columns) > 0 {
+				specs = append(specs, spec)
+			}
 		}
 	default:
-		return fmt.Errorf("columns must be a JSON array")
+		return nil, fmt.Errorf("columns must be a JSON array")
 	}
 
-	if len(indexer.colDefs) == 0 {
-		return fmt.Errorf("no valid column definitions found")
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no valid column definitions found")
 	}
 
-	return nil
+	return specs, nil
+}
+
+// IndexName returns the name an index over columns is stored under
+// (<csv>_<name>.cidx), normalized to lowercase to match the QueryEngine.
+func IndexName(columns []string) string {
+	return strings.ToLower(strings.Join(columns, "_"))
 }
 
-// saveMeta writes metadata to JSON file
+// saveMeta publishes the build: writing the metadata atomically switches
+// queries from the files of the previous generation to the new ones. The
+// files it superseded are removed afterwards; local readers that still
+// have them open keep reading them, so on remote storage (where a removed
+// object is gone for everyone) they are only removed by the next build.
 func (indexer *Indexer) saveMeta() error {
 	indexer.meta.CapturedAt = time.Now()
+	if indexer.scanner != nil {
+		indexer.meta.Separator = string(indexer.scanner.separator)
+	}
+	prev := indexer.previousMeta()
+	indexer.completeManifest(prev)
+	indexer.meta.Generation = max(indexer.generation, prev.Generation)
+
+	superseded := indexer.supersededFiles(prev)
+	remove := prev.Retired
+	indexer.meta.Retired = nil
+	if storage.IsRemote(indexer.config.OutputDir) {
+		indexer.meta.Retired = superseded
+	} else {
+		remove = append(remove, superseded...)
+	}
 
 	data, err := json.MarshalIndent(indexer.meta, "", "  ")
 	if err != nil {
 		return err
 	}
+	if err := storage.WriteFile(indexer.store, indexer.metaName(), data); err != nil {
+		return err
+	}
+	for _, file := range remove {
+		removeIndexFiles(indexer.store, file)
+	}
+	// The new indexes cover the rows of the deltas of the previous ones
+	removeDeltas(indexer.store, indexer.csvName(), slices.Collect(maps.Keys(prev.Indexes)))
+	return nil
+}
 
-	csvName := strings.TrimSuffix(filepath.Base(indexer.config.InputFile), filepath.Ext(indexer.config.InputFile))
-	metaPath := filepath.Join(indexer.config.OutputDir, csvName+"_meta.json")
-	return os.WriteFile(metaPath, data, 0644)
+// previousMeta reads the metadata the build replaces (empty if none).
+func (indexer *Indexer) previousMeta() common.IndexMeta {
+	var prev common.IndexMeta
+	if data, err := storage.ReadFile(indexer.store, indexer.metaName()); err == nil {
+		_ = json.Unmarshal(data, &prev)
+	}
+	return prev
+}
+
+// supersededFiles lists the index files of prev the new metadata no
+// longer references.
+func (indexer *Indexer) supersededFiles(prev common.IndexMeta) []string {
+	current := make(map[string]bool, len(indexer.meta.Indexes))
+	for _, stats := range indexer.meta.Indexes {
+		current[stats.File] = true
+	}
+	var files []string
+	for name, stats := range prev.Indexes {
+		file := stats.File
+		if file == "" {
+			file = common.IndexFileName(indexer.csvName(), name, 0)
+		}
+		if !current[file] && !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// indexSize returns the size of an index file plus its part files.
+func indexSize(store storage.Backend, file string) (int64, error) {
+	info, err := store.Stat(file)
+	if err != nil || info.Size == 0 { // Empty index: no footer
+		return info.Size, err
+	}
+	br, err := common.OpenBlockReader(store, file)
+	if err != nil {
+		return 0, err
+	}
+	parts := br.Footer.Parts
+	br.Cleanup()
+	size := info.Size
+	for _, part := range parts {
+		info, err := store.Stat(part)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size
+	}
+	return size, nil
+}
+
+// removeIndexFiles removes an index file with its bloom filter and, for a
+// tiered index, its cold blocks, or for a partitioned one its part files.
+// Missing files are ignored.
+func removeIndexFiles(store storage.Backend, file string) {
+	if br, err := common.OpenBlockReader(store, file); err == nil {
+		coldStore, coldFile, parts := br.Footer.ColdStore, br.Footer.ColdFile, br.Footer.Parts
+		br.Cleanup()
+		if coldFile != "" {
+			if cold, err := storage.Open(coldStore); err == nil {
+				_ = cold.Remove(coldFile)
+			}
+		}
+		for _, part := range parts {
+			_ = store.Remove(part)
+		}
+	}
+	_ = store.Remove(file + ".bloom")
+	_ = store.Remove(file)
+}
+
+// DropIndexes removes indexes of csvPath from store, and its row store
+// too if dropRowStore is set. The metadata is rewritten first, so queries
+// stop using the files before they go; the files are removed as superseded
+// files of a build are (see saveMeta).
+func DropIndexes(store storage.Backend, csvPath string, names []string, dropRowStore bool) error {
+	metaName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath)) + "_meta.json"
+	data, err := storage.ReadFile(store, metaName)
+	if err != nil {
+		return err
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid index metadata: %w", err)
+	}
+	files, err := IndexFiles(store, csvPath)
+	if err != nil {
+		return err
+	}
+
+	var remove []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if file, ok := files[name]; ok {
+			remove = append(remove, file)
+		}
+		delete(meta.Indexes, name)
+	}
+	rowStore := ""
+	if dropRowStore {
+		rowStore, meta.RowStore = meta.RowStore, ""
+	}
+	if _, local := store.(*storage.Local); !local {
+		remove, meta.Retired = meta.Retired, remove
+	}
+
+	if data, err = json.MarshalIndent(meta, "", "  "); err != nil {
+		return err
+	}
+	if err := storage.WriteFile(store, metaName, data); err != nil {
+		return err
+	}
+	for _, file := range remove {
+		removeIndexFiles(store, file)
+	}
+	removeDeltas(store, strings.TrimSuffix(metaName, "_meta.json"), names)
+	if rowStore != "" {
+		_ = store.Remove(rowStore)
+	}
+	return nil
+}
+
+// appendTarget returns the file of the index an append run extends.
+func (indexer *Indexer) appendTarget(name string) string {
+	indexer.metaMutex.Lock()
+	defer indexer.metaMutex.Unlock()
+	if file := indexer.meta.Indexes[name].File; file != "" {
+		return file
+	}
+	return common.IndexFileName(indexer.csvName(), name, 0)
+}
+
+// completeManifest makes the metadata list every index of the CSV: a
+// build only knows the indexes it built, so the entries of others still
+// present are kept from the previous metadata, and entries without a File
+// (written before the manifest) get the file found for them, or are
+// dropped with it.
+func (indexer *Indexer) completeManifest(prev common.IndexMeta) {
+	csvName := indexer.csvName()
+	files, err := indexer.store.List(csvName + "_*.cidx")
+	if err != nil {
+		return
+	}
+	if indexer.config.AppendFrom == 0 {
+		for name, stats := range prev.Indexes {
+			if _, ok := indexer.meta.Indexes[name]; !ok {
+				indexer.meta.Indexes[name] = stats
+			}
+		}
+	}
+	for name, stats := range indexer.meta.Indexes {
+		file := stats.File
+		if file == "" {
+			file, _ = common.LegacyIndexFile(files, csvName, name)
+		}
+		if !slices.Contains(files, file) {
+			delete(indexer.meta.Indexes, name)
+			continue
+		}
+		stats.File = file
+		indexer.meta.Indexes[name] = stats
+	}
+}
+
+// writeRowStore writes the .csvz row store of the whole CSV with the index
+// codec. Offsets in it are those of the CSV, so every index can use it.
+func (indexer *Indexer) writeRowStore() error {
+	codec, err := common.NewCodec(indexer.config.Codec)
+	if err != nil {
+		return err
+	}
+	name := indexer.csvName() + ".csvz"
+	w, err := indexer.store.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := common.WriteRowStore(w, indexer.scanner.data, codec); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	indexer.meta.RowStore = name
+	fmt.Fprintf(indexer.out, "  ✅ row store %s\n", name)
+	return nil
+}
+
+// csvName returns the base name of the input CSV, the prefix of its index files
+func (indexer *Indexer) csvName() string {
+	return strings.TrimSuffix(filepath.Base(indexer.config.InputFile), filepath.Ext(indexer.config.InputFile))
+}
+
+// indexFile returns the name of the .cidx file this build writes for an index
+func (indexer *Indexer) indexFile(name string) string {
+	return common.IndexFileName(indexer.csvName(), name, indexer.generation)
+}
+
+// metaName returns the name of the _meta.json file for the input CSV
+func (indexer *Indexer) metaName() string {
+	return indexer.csvName() + "_meta.json"
+}
+
+// metaPath returns the local path of the _meta.json file (append mode)
+func (indexer *Indexer) metaPath() string {
+	return filepath.Join(indexer.config.OutputDir, indexer.metaName())
 }
 
 type csvDNA struct {
@@ -434,25 +1076,45 @@ type csvDNA struct {
 }
 
 func (indexer *Indexer) calculateFingerprint() (csvDNA, error) {
-	file, err := os.Open(indexer.config.InputFile)
+	stat, err := os.Stat(indexer.config.InputFile)
 	if err != nil {
 		return csvDNA{}, err
 	}
-	defer func() { _ = file.Close() }()
 
-	stat, err := file.Stat()
+	// Fingerprint what was scanned, not what the file has grown to since,
+	// so a later append run starts exactly where this one stopped
+	size := stat.Size()
+	if indexer.scanner != nil && indexer.scanner.fileSize < size {
+		size = indexer.scanner.fileSize
+	}
+	hash, err := CsvFingerprint(indexer.config.InputFile, size)
 	if err != nil {
 		return csvDNA{}, err
 	}
 
-	size := stat.Size()
-	mtime := stat.ModTime().Unix()
+	return csvDNA{
+		size:  size,
+		mtime: stat.ModTime().Unix(),
+		hash:  hash,
+	}, nil
+}
+
+// CsvFingerprint hashes start, middle and end samples of the first size
+// bytes of a CSV. Comparing it against IndexMeta.CsvHash with the indexed
+// size tells whether a grown file still starts with the indexed data.
+func CsvFingerprint(path string, size int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+
 	sampleSize := int64(512 * 1024) // 512KB per sample
 
 	hasher := sha1.New()
 
 	// 1. Start Sample
-	buf := make([]byte, sampleSize)
+	buf := make([]byte, min(sampleSize, size))
 	n, _ := file.ReadAt(buf, 0)
 	hasher.Write(buf[:n])
 
@@ -472,11 +1134,7 @@ func (indexer *Indexer) calculateFingerprint() (csvDNA, error) {
 		hasher.Write(buf[:n])
 	}
 
-	return csvDNA{
-		size:  size,
-		mtime: mtime,
-		hash:  hex.EncodeToString(hasher.Sum(nil)),
-	}, nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // Cleanup removes temp files
@@ -503,7 +1161,7 @@ func (indexer *Indexer) startReporting() {
 			case <-ticker.C:
 				indexer.printStatus(startTime)
 			case <-indexer.stopReport:
-				fmt.Println() // New line after progress
+				fmt.Fprintln(indexer.out) // New line after progress
 				return
 			}
 		}
@@ -518,6 +1176,12 @@ func (indexer *Indexer) stopReporting() {
 }
 
 func (indexer *Indexer) printStatus(startTime time.Time) {
+	// Simple single-line output
+	fmt.Fprintf(indexer.out, "\r\033[K%s", indexer.statusLine(startTime))
+}
+
+// statusLine summarizes the build's phase and progress.
+func (indexer *Indexer) statusLine(startTime time.Time) string {
 	rowsScanned, bytesScanned, _ := indexer.scanner.GetStats()
 
 	indexer.sorterMutex.RLock()
@@ -574,7 +1238,11 @@ func (indexer *Indexer) printStatus(startTime time.Time) {
 		etaStr = "complete"
 	}
 
-	// Simple single-line output
-	fmt.Printf("\r\033[K[%s] Rows: %d | Rate: %.0f/s | Elapsed: %s | ETA: %s",
+	line := fmt.Sprintf("[%s] Rows: %d | Rate: %.0f/s | Elapsed: %s | ETA: %s",
 		phase, rowsScanned, rate, elapsed.Round(time.Second), etaStr)
+	if indexer.memory != nil && phase == "Scanning" {
+		used, _, total := indexer.memory.stats()
+		line += fmt.Sprintf(" | Sort mem: %d/%d MB", used>>20, total>>20)
+	}
+	return line
 }
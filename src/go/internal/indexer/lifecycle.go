@@ -0,0 +1,143 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// IndexInfo describes an index of a CSV for `csvquery indexes list`.
+type IndexInfo struct {
+	Name      string   `json:"name"`
+	File      string   `json:"file"`
+	Columns   []string `json:"columns,omitempty"`
+	Collation string   `json:"collation,omitempty"`
+	Size      int64    `json:"size"` // Index, parts and bloom filter
+	Distinct  int64    `json:"distinct"`
+	DeltaRows int      `json:"deltaRows,omitempty"` // Appended rows its delta holds
+	Stale     string   `json:"stale,omitempty"`     // Why queries cannot trust it ("" = fresh)
+}
+
+// ListIndexes describes every index the metadata of csvPath in store
+// lists, by name.
+func ListIndexes(store storage.Backend, csvPath string) ([]IndexInfo, error) {
+	meta, err := readMeta(store, csvPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := IndexFiles(store, csvPath)
+	if err != nil {
+		return nil, err
+	}
+	stale := StaleReason(csvPath, meta)
+
+	infos := make([]IndexInfo, 0, len(meta.Indexes))
+	for name, stats := range meta.Indexes {
+		info := IndexInfo{Name: name, File: files[name], Columns: stats.Columns, Collation: stats.Collation, Distinct: stats.DistinctCount, Stale: stale}
+		if size, err := indexSize(store, info.File); err != nil {
+			info.Stale = "index file missing"
+		} else {
+			info.Size = size
+		}
+		if bloom, err := store.Stat(info.File + ".bloom"); err == nil {
+			info.Size += bloom.Size
+		}
+		if rows, ok := deltaRows(store, csvPath, name, meta); ok {
+			info.DeltaRows = rows
+			if strings.HasPrefix(info.Stale, "CSV grew") {
+				info.Stale = ""
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// StaleReason tells why indexes built with meta no longer match csvPath
+// ("" = they do): a CSV that grew can be appended to, any other change
+// needs a rebuild.
+func StaleReason(csvPath string, meta common.IndexMeta) string {
+	if meta.Format != "" {
+		return "" // Rows come from the row store, not the input file
+	}
+	info, err := os.Stat(csvPath)
+	if err != nil {
+		return "CSV missing"
+	}
+	if info.Size() == meta.CsvSize && info.ModTime().Unix() == meta.CsvMtime {
+		return ""
+	}
+	if info.Size() > meta.CsvSize {
+		if hash, err := CsvFingerprint(csvPath, meta.CsvSize); err == nil && hash == meta.CsvHash {
+			return fmt.Sprintf("CSV grew by %d bytes", info.Size()-meta.CsvSize)
+		}
+	}
+	if hash, err := CsvFingerprint(csvPath, info.Size()); err == nil && info.Size() == meta.CsvSize && hash == meta.CsvHash {
+		return "" // Touched, not changed
+	}
+	return "CSV changed"
+}
+
+// RebuildConfig returns the config that builds the named indexes of
+// csvPath in outputDir again, alone, with the columns, collations and
+// partitions the metadata records. Other indexes keep their files, so the
+// CSV must still be the one they were built from.
+func RebuildConfig(csvPath, outputDir string, names []string) (IndexerConfig, error) {
+	cfg, meta, err := CurrentConfig(csvPath, outputDir)
+	if err != nil {
+		return cfg, err
+	}
+	if reason := StaleReason(csvPath, meta); reason != "" && len(names) < len(meta.Indexes) {
+		return cfg, fmt.Errorf("%s since the indexes were built: rebuild all of them (--all)", reason)
+	}
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	columns, partitions, err := indexColumns(meta, lower)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Columns, cfg.Partitions = columns, partitions
+	return cfg, nil
+}
+
+// deltaRows returns the records of the delta of an index when it extends
+// the index to the end of csvPath (see WriteDeltas).
+func deltaRows(store storage.Backend, csvPath, name string, meta common.IndexMeta) (int, bool) {
+	info, err := os.Stat(csvPath)
+	if err != nil {
+		return 0, false
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	data, err := storage.ReadFile(store, common.DeltaFileName(csvName, name))
+	if err != nil {
+		return 0, false
+	}
+	h, records, err := common.DecodeDelta(data)
+	if err != nil || !h.Covers(&meta) || h.To != info.Size() {
+		return 0, false
+	}
+	return len(records), true
+}
+
+// readMeta reads the index metadata of csvPath in store.
+func readMeta(store storage.Backend, csvPath string) (common.IndexMeta, error) {
+	var meta common.IndexMeta
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	data, err := storage.ReadFile(store, csvName+"_meta.json")
+	if err != nil {
+		return meta, fmt.Errorf("no index metadata for %s in %s: %w", filepath.Base(csvPath), store, err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("invalid index metadata: %w", err)
+	}
+	return meta, nil
+}
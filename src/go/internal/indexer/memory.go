@@ -0,0 +1,60 @@
+package indexer
+
+import "sync"
+
+// bytesPerRecord is the in-memory cost of a buffered IndexRecord
+// (80 bytes plus slice/GC overhead), as assumed by NewSorter.
+const bytesPerRecord = 100
+
+// memoryArbiter shares the indexer's sort budget (--memory) between the
+// sorters of one build. Each sorter keeps a small guaranteed share and
+// borrows more while its buffer fills; what it borrowed goes back to the
+// pool when it spills or finishes. So an index whose sorter spills early or
+// finishes first (often a low-cardinality one, whose merge is cheap) leaves
+// its budget to the sorters still buffering, instead of each sorter being
+// capped at a fixed MemoryMB/numIndexes slice.
+type memoryArbiter struct {
+	mu    sync.Mutex
+	total int64 // Budget in bytes
+	used  int64 // Granted and not yet released (may exceed total: see reserve)
+	peak  int64
+}
+
+func newMemoryArbiter(totalBytes int64) *memoryArbiter {
+	return &memoryArbiter{total: totalBytes}
+}
+
+// reserve grants n bytes unconditionally: every sorter needs its
+// guaranteed share to make progress, even if that overcommits the budget.
+func (a *memoryArbiter) reserve(n int64) {
+	a.mu.Lock()
+	a.used += n
+	a.peak = max(a.peak, a.used)
+	a.mu.Unlock()
+}
+
+// tryAcquire grants n bytes if the budget has room for all of them.
+func (a *memoryArbiter) tryAcquire(n int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.used+n > a.total {
+		return false
+	}
+	a.used += n
+	a.peak = max(a.peak, a.used)
+	return true
+}
+
+// release returns n bytes to the pool.
+func (a *memoryArbiter) release(n int64) {
+	a.mu.Lock()
+	a.used -= n
+	a.mu.Unlock()
+}
+
+// stats reports the bytes currently granted, the peak and the budget.
+func (a *memoryArbiter) stats() (used, peak, total int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used, a.peak, a.total
+}
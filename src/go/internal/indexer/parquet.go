@@ -0,0 +1,910 @@
+package indexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/klauspost/compress/s2"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Parquet input: the file's footer (Thrift compact FileMetaData) lists the
+// row groups and, per column, where its pages are. Every column chunk of a
+// row group is decoded to rendered values, then the row group is handed
+// over row by row. Only flat schemas are read: top-level columns that are
+// required or optional, not repeated or nested.
+//
+//	"PAR1" | row group 0 | ... | FileMetaData | footer length (4 bytes, LE) | "PAR1"
+
+const parquetMagic = "PAR1"
+
+// Parquet physical types
+const (
+	pqBoolean = iota
+	pqInt32
+	pqInt64
+	pqInt96
+	pqFloat
+	pqDouble
+	pqByteArray
+	pqFixedLenByteArray
+)
+
+// Parquet encodings
+const (
+	pqPlain                = 0
+	pqPlainDictionary      = 2
+	pqRLE                  = 3
+	pqDeltaBinaryPacked    = 5
+	pqDeltaLengthByteArray = 6
+	pqDeltaByteArray       = 7
+	pqRLEDictionary        = 8
+	pqByteStreamSplit      = 9
+)
+
+// Parquet page types
+const (
+	pqDataPage       = 0
+	pqDictionaryPage = 2
+	pqDataPageV2     = 3
+)
+
+// parquetColumn is a column of a flat Parquet schema.
+type parquetColumn struct {
+	name     string
+	physical int64
+	typeLen  int
+	optional bool
+	format   valueFormat
+}
+
+// readParquet calls fn with the column names and the rendered values of
+// each row group of the Parquet file data, column by column ("" = null).
+func readParquet(data []byte, fn func(names []string, columns [][]string, rows int) error) (err error) {
+	defer recoverCorrupt("Parquet", &err)
+
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		return fmt.Errorf("not a Parquet file")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLen <= 0 || footerLen > len(data)-12 {
+		return fmt.Errorf("corrupt Parquet file: footer length %d", footerLen)
+	}
+	meta, _, err := readThriftStruct(data[len(data)-8-footerLen : len(data)-8])
+	if err != nil {
+		return fmt.Errorf("corrupt Parquet footer: %w", err)
+	}
+
+	columns, err := parquetSchema(meta.list(2))
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+
+	values := make([][]string, len(columns))
+	for _, rg := range meta.list(4) {
+		group := rg.(thriftStruct)
+		rows := int(group.int(3))
+		chunks := group.list(1)
+		if len(chunks) != len(columns) {
+			return fmt.Errorf("corrupt Parquet file: row group has %d columns, schema %d", len(chunks), len(columns))
+		}
+		for i, chunk := range chunks {
+			cc := chunk.(thriftStruct)
+			if path := cc.bytes(1); len(path) > 0 {
+				return fmt.Errorf("column %s is stored in another file (%s)", columns[i].name, path)
+			}
+			if values[i], err = columns[i].readChunk(data, cc.strct(3), values[i][:0], rows); err != nil {
+				return fmt.Errorf("column %s: %w", columns[i].name, err)
+			}
+			if len(values[i]) != rows {
+				return fmt.Errorf("column %s: %d values in a row group of %d rows", columns[i].name, len(values[i]), rows)
+			}
+		}
+		if err := fn(names, values, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parquetSchema returns the columns of a flat schema: the root element,
+// then one leaf per column.
+func parquetSchema(elements []any) ([]parquetColumn, error) {
+	if len(elements) < 2 {
+		return nil, fmt.Errorf("parquet file has no columns")
+	}
+	var columns []parquetColumn
+	for _, e := range elements[1:] {
+		el := e.(thriftStruct)
+		name := string(el.bytes(4))
+		if el.int(5) > 0 {
+			return nil, fmt.Errorf("column %s is nested; only flat Parquet schemas can be indexed", name)
+		}
+		if el.int(3) == 2 {
+			return nil, fmt.Errorf("column %s is repeated; only flat Parquet schemas can be indexed", name)
+		}
+		c := parquetColumn{
+			name:     name,
+			physical: el.int(1),
+			typeLen:  int(el.int(2)),
+			optional: el.int(3) == 1,
+		}
+		c.format = parquetFormat(el, c.physical)
+		if c.format.scale < 0 || c.format.scale > maxDecimalScale {
+			return nil, fmt.Errorf("column %s: invalid decimal scale %d", name, c.format.scale)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// parquetFormat returns how the values of a schema element are written,
+// from its logical type, or its converted type in older files.
+func parquetFormat(el thriftStruct, physical int64) valueFormat {
+	if lt, ok := el[10].(thriftStruct); ok {
+		for id, v := range lt {
+			ann, _ := v.(thriftStruct)
+			switch id {
+			case 5: // DECIMAL
+				return valueFormat{kind: fmtDecimal, scale: int(ann.int(1))}
+			case 6: // DATE
+				return valueFormat{kind: fmtDate}
+			case 7: // TIME
+				return valueFormat{kind: fmtTime, unit: parquetUnit(ann.strct(2))}
+			case 8: // TIMESTAMP
+				return valueFormat{kind: fmtTimestamp, unit: parquetUnit(ann.strct(2))}
+			case 10: // INTEGER
+				if !ann.bool(2) {
+					return valueFormat{kind: fmtUnsigned}
+				}
+				return valueFormat{}
+			case 14: // UUID
+				return valueFormat{kind: fmtUUID}
+			case 15: // FLOAT16
+				return valueFormat{kind: fmtFloat16}
+			}
+		}
+	}
+	switch el.int(6) {
+	case 5: // DECIMAL
+		return valueFormat{kind: fmtDecimal, scale: int(el.int(7))}
+	case 6: // DATE
+		return valueFormat{kind: fmtDate}
+	case 7: // TIME_MILLIS
+		return valueFormat{kind: fmtTime, unit: 1e6}
+	case 8: // TIME_MICROS
+		return valueFormat{kind: fmtTime, unit: 1e3}
+	case 9: // TIMESTAMP_MILLIS
+		return valueFormat{kind: fmtTimestamp, unit: 1e6}
+	case 10: // TIMESTAMP_MICROS
+		return valueFormat{kind: fmtTimestamp, unit: 1e3}
+	case 11, 12, 13, 14: // UINT_8 to UINT_64
+		return valueFormat{kind: fmtUnsigned}
+	}
+	if physical == pqInt96 {
+		return valueFormat{kind: fmtInt96}
+	}
+	return valueFormat{}
+}
+
+// parquetUnit returns the nanoseconds of a TimeUnit union.
+func parquetUnit(unit thriftStruct) int64 {
+	switch {
+	case unit[1] != nil:
+		return 1e6 // MILLIS
+	case unit[2] != nil:
+		return 1e3 // MICROS
+	}
+	return 1 // NANOS
+}
+
+// readChunk appends the rendered values of a column chunk to dst.
+func (c *parquetColumn) readChunk(data []byte, meta thriftStruct, dst []string, rows int) ([]string, error) {
+	start := meta.int(9) // data_page_offset
+	if dict, ok := meta[11].(int64); ok && dict > 0 && dict < start {
+		start = dict
+	}
+	end := start + meta.int(7) // total_compressed_size
+	if start < 4 || end > int64(len(data)) || end < start {
+		return nil, fmt.Errorf("chunk [%d, %d) is outside the file", start, end)
+	}
+	codec := meta.int(4)
+	numValues := int(meta.int(5))
+
+	var dict []string
+	var page []byte
+	chunk := data[start:end]
+	for len(dst) < numValues && len(chunk) > 0 {
+		header, n, err := readThriftStruct(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("page header: %w", err)
+		}
+		size := int(header.int(3))
+		if size < 0 || n+size > len(chunk) {
+			return nil, fmt.Errorf("page of %d bytes overruns the chunk", size)
+		}
+		body := chunk[n : n+size]
+		chunk = chunk[n+size:]
+		uncompressed := int(header.int(2))
+
+		switch header.int(1) {
+		case pqDictionaryPage:
+			if page, err = decompressPage(codec, page[:0], body, uncompressed); err != nil {
+				return nil, err
+			}
+			dh := header.strct(7)
+			if dict, _, err = c.decodePlain(page, int(dh.int(1)), nil); err != nil {
+				return nil, fmt.Errorf("dictionary page: %w", err)
+			}
+		case pqDataPage:
+			if page, err = decompressPage(codec, page[:0], body, uncompressed); err != nil {
+				return nil, err
+			}
+			dh := header.strct(5)
+			count := int(dh.int(1))
+			if count < 0 || count > rows-len(dst) {
+				return nil, errPageValues
+			}
+			levels := page
+			var defined []bool
+			if c.optional {
+				if dh.int(3) != pqRLE {
+					return nil, fmt.Errorf("unsupported definition level encoding %d", dh.int(3))
+				}
+				if len(levels) < 4 {
+					return nil, errCorruptPage
+				}
+				l := int(binary.LittleEndian.Uint32(levels))
+				if 4+l > len(levels) {
+					return nil, errCorruptPage
+				}
+				if defined, err = decodeLevels(levels[4:4+l], count); err != nil {
+					return nil, err
+				}
+				levels = levels[4+l:]
+			}
+			if dst, err = c.decodePage(levels, int(dh.int(2)), count, defined, dict, dst); err != nil {
+				return nil, err
+			}
+		case pqDataPageV2:
+			dh := header.strct(8)
+			count := int(dh.int(1))
+			if count < 0 || count > rows-len(dst) {
+				return nil, errPageValues
+			}
+			defLen, repLen := int(dh.int(5)), int(dh.int(6))
+			if repLen < 0 || defLen < 0 || repLen+defLen > len(body) {
+				return nil, errCorruptPage
+			}
+			var defined []bool
+			if c.optional {
+				if defined, err = decodeLevels(body[repLen:repLen+defLen], count); err != nil {
+					return nil, err
+				}
+			}
+			values := body[repLen+defLen:]
+			if compressed, ok := dh[7].(bool); !ok || compressed {
+				if page, err = decompressPage(codec, page[:0], values, uncompressed-repLen-defLen); err != nil {
+					return nil, err
+				}
+				values = page
+			}
+			if dst, err = c.decodePage(values, int(dh.int(4)), count, defined, dict, dst); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(dst) > rows {
+		return nil, fmt.Errorf("%d values in a row group of %d rows", len(dst), rows)
+	}
+	return dst, nil
+}
+
+var errCorruptPage = errors.New("corrupt page")
+
+var errPageValues = errors.New("page holds more values than the rows left in its row group")
+
+// decodeLevels decodes the definition levels of a page of count values:
+// whether each one is defined (not null).
+func decodeLevels(data []byte, count int) ([]bool, error) {
+	levels, _, err := decodeHybrid(data, 1, count)
+	if err != nil {
+		return nil, err
+	}
+	defined := make([]bool, count)
+	for i, l := range levels {
+		defined[i] = l > 0
+	}
+	return defined, nil
+}
+
+// decodePage appends the count values of a data page to dst: nulls where
+// defined is false, the values of data in encoding elsewhere.
+func (c *parquetColumn) decodePage(data []byte, encoding, count int, defined []bool, dict []string, dst []string) ([]string, error) {
+	present := count
+	if defined != nil {
+		present = 0
+		for _, d := range defined {
+			if d {
+				present++
+			}
+		}
+	}
+
+	var values []string
+	var err error
+	switch encoding {
+	case pqPlain:
+		values, _, err = c.decodePlain(data, present, nil)
+	case pqPlainDictionary, pqRLEDictionary:
+		if dict == nil {
+			return nil, fmt.Errorf("dictionary-encoded page without a dictionary")
+		}
+		if len(data) < 1 {
+			return nil, errCorruptPage
+		}
+		var idx []uint64
+		if idx, _, err = decodeHybrid(data[1:], int(data[0]), present); err != nil {
+			return nil, err
+		}
+		values = make([]string, present)
+		for i, j := range idx {
+			if j >= uint64(len(dict)) {
+				return nil, fmt.Errorf("dictionary index %d out of %d", j, len(dict))
+			}
+			values[i] = dict[j]
+		}
+	case pqRLE:
+		if c.physical != pqBoolean || len(data) < 4 {
+			return nil, fmt.Errorf("unsupported RLE encoding of type %d", c.physical)
+		}
+		var bits []uint64
+		if bits, _, err = decodeHybrid(data[4:], 1, present); err != nil {
+			return nil, err
+		}
+		values = make([]string, present)
+		for i, b := range bits {
+			values[i] = strconv.FormatBool(b != 0)
+		}
+	case pqDeltaBinaryPacked:
+		var ints []int64
+		if ints, _, err = decodeDeltaBinaryPacked(data, present); err != nil {
+			return nil, err
+		}
+		values = make([]string, present)
+		for i, v := range ints {
+			if c.physical == pqInt32 {
+				v = int64(int32(v))
+			}
+			values[i] = c.format.int(v, c.physical == pqInt32)
+		}
+	case pqDeltaLengthByteArray, pqDeltaByteArray:
+		var raw [][]byte
+		if raw, err = decodeDeltaByteArray(data, present, encoding == pqDeltaByteArray); err != nil {
+			return nil, err
+		}
+		values = make([]string, present)
+		for i, b := range raw {
+			values[i] = c.format.bytes(b)
+		}
+	case pqByteStreamSplit:
+		width := c.width()
+		if width == 0 || len(data) < width*present {
+			return nil, fmt.Errorf("unsupported BYTE_STREAM_SPLIT encoding of type %d", c.physical)
+		}
+		plain := make([]byte, width*present)
+		for i := range present {
+			for b := range width {
+				plain[i*width+b] = data[b*present+i]
+			}
+		}
+		values, _, err = c.decodePlain(plain, present, nil)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != present {
+		return nil, fmt.Errorf("%d values decoded, %d expected", len(values), present)
+	}
+
+	if defined == nil {
+		return append(dst, values...), nil
+	}
+	next := 0
+	for _, d := range defined {
+		if d {
+			dst = append(dst, values[next])
+			next++
+		} else {
+			dst = append(dst, "")
+		}
+	}
+	return dst, nil
+}
+
+// width returns the size of the column's fixed-width values (0 = variable).
+func (c *parquetColumn) width() int {
+	switch c.physical {
+	case pqInt32, pqFloat:
+		return 4
+	case pqInt64, pqDouble:
+		return 8
+	case pqInt96:
+		return 12
+	case pqFixedLenByteArray:
+		return c.typeLen
+	}
+	return 0
+}
+
+// decodePlain appends n PLAIN-encoded values of data to dst and returns
+// the bytes read.
+func (c *parquetColumn) decodePlain(data []byte, n int, dst []string) ([]string, int, error) {
+	if c.physical == pqBoolean {
+		if len(data)*8 < n {
+			return nil, 0, errCorruptPage
+		}
+		for i := range n {
+			dst = append(dst, strconv.FormatBool(data[i/8]&(1<<(i%8)) != 0))
+		}
+		return dst, (n + 7) / 8, nil
+	}
+	if c.physical == pqByteArray {
+		pos := 0
+		for range n {
+			if pos+4 > len(data) {
+				return nil, 0, errCorruptPage
+			}
+			l := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if l < 0 || pos+l > len(data) {
+				return nil, 0, errCorruptPage
+			}
+			dst = append(dst, c.format.bytes(data[pos:pos+l]))
+			pos += l
+		}
+		return dst, pos, nil
+	}
+
+	width := c.width()
+	if width <= 0 || len(data) < width*n {
+		return nil, 0, errCorruptPage
+	}
+	for i := range n {
+		v := data[i*width : (i+1)*width]
+		switch c.physical {
+		case pqInt32:
+			dst = append(dst, c.format.int(int64(int32(binary.LittleEndian.Uint32(v))), true))
+		case pqInt64:
+			dst = append(dst, c.format.int(int64(binary.LittleEndian.Uint64(v)), false))
+		case pqFloat:
+			dst = append(dst, strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(v))), 'g', -1, 32))
+		case pqDouble:
+			dst = append(dst, strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(v)), 'g', -1, 64))
+		default: // INT96, FIXED_LEN_BYTE_ARRAY
+			dst = append(dst, c.format.bytes(v))
+		}
+	}
+	return dst, width * n, nil
+}
+
+// decodeHybrid decodes n values of the RLE/bit-packed hybrid encoding of
+// the given bit width, and returns the bytes read.
+func decodeHybrid(data []byte, bitWidth, n int) ([]uint64, int, error) {
+	if bitWidth < 0 || bitWidth > 64 {
+		return nil, 0, fmt.Errorf("invalid bit width %d", bitWidth)
+	}
+	out := make([]uint64, 0, n)
+	pos := 0
+	for len(out) < n {
+		header, l := binary.Uvarint(data[pos:])
+		if l <= 0 {
+			return nil, 0, errCorruptPage
+		}
+		pos += l
+		if header>>1 == 0 {
+			return nil, 0, errCorruptPage // An empty run would never end
+		}
+		if header&1 == 1 { // Bit-packed groups of 8 values
+			count := int(header>>1) * 8
+			size := int(header>>1) * bitWidth
+			if pos+size > len(data) {
+				return nil, 0, errCorruptPage
+			}
+			out = unpackBits(out, data[pos:pos+size], bitWidth, min(count, n-len(out)))
+			pos += size
+		} else { // Run of one value
+			count := int(header >> 1)
+			size := (bitWidth + 7) / 8
+			if pos+size > len(data) {
+				return nil, 0, errCorruptPage
+			}
+			var v uint64
+			for i := range size {
+				v |= uint64(data[pos+i]) << (8 * i)
+			}
+			pos += size
+			for range min(count, n-len(out)) {
+				out = append(out, v)
+			}
+		}
+	}
+	return out, pos, nil
+}
+
+// unpackBits appends n values of bitWidth bits packed least significant
+// bit first.
+func unpackBits(dst []uint64, data []byte, bitWidth, n int) []uint64 {
+	if bitWidth == 0 {
+		for range n {
+			dst = append(dst, 0)
+		}
+		return dst
+	}
+	bit := 0
+	for range n {
+		var v uint64
+		for b := 0; b < bitWidth; {
+			byteIdx, off := bit/8, bit%8
+			take := min(8-off, bitWidth-b)
+			v |= uint64(data[byteIdx]>>off&(1<<take-1)) << b
+			b += take
+			bit += take
+		}
+		dst = append(dst, v)
+	}
+	return dst
+}
+
+// decodeDeltaBinaryPacked decodes n DELTA_BINARY_PACKED integers and
+// returns the bytes read.
+func decodeDeltaBinaryPacked(data []byte, n int) ([]int64, int, error) {
+	pos := 0
+	uvarint := func() uint64 {
+		v, l := binary.Uvarint(data[pos:])
+		if l <= 0 {
+			panic(errCorruptPage)
+		}
+		pos += l
+		return v
+	}
+	varint := func() int64 {
+		v, l := binary.Varint(data[pos:])
+		if l <= 0 {
+			panic(errCorruptPage)
+		}
+		pos += l
+		return v
+	}
+
+	blockSize := int(uvarint())
+	miniblocks := int(uvarint())
+	total := int(uvarint())
+	value := varint()
+	if miniblocks <= 0 || blockSize%miniblocks != 0 || blockSize/miniblocks%32 != 0 {
+		return nil, 0, fmt.Errorf("invalid delta block of %d values in %d miniblocks", blockSize, miniblocks)
+	}
+	perMini := blockSize / miniblocks
+	out := make([]int64, 0, n)
+	if total > 0 {
+		out = append(out, value)
+	}
+	for len(out) < total {
+		minDelta := varint()
+		if pos+miniblocks > len(data) {
+			return nil, 0, errCorruptPage
+		}
+		widths := data[pos : pos+miniblocks]
+		pos += miniblocks
+		for _, w := range widths {
+			if len(out) >= total {
+				break
+			}
+			if w > 64 {
+				return nil, 0, errCorruptPage
+			}
+			size := perMini * int(w) / 8
+			if pos+size > len(data) {
+				return nil, 0, errCorruptPage
+			}
+			deltas := unpackBits(nil, data[pos:pos+size], int(w), perMini)
+			pos += size
+			for _, d := range deltas {
+				if len(out) >= total {
+					break
+				}
+				value += minDelta + int64(d)
+				out = append(out, value)
+			}
+		}
+	}
+	if len(out) < n {
+		return nil, 0, fmt.Errorf("%d delta values, %d expected", len(out), n)
+	}
+	return out[:n], pos, nil
+}
+
+// decodeDeltaByteArray decodes n DELTA_LENGTH_BYTE_ARRAY values, or
+// DELTA_BYTE_ARRAY values (prefix lengths first) if prefixed.
+func decodeDeltaByteArray(data []byte, n int, prefixed bool) ([][]byte, error) {
+	var prefixes []int64
+	if prefixed {
+		var read int
+		var err error
+		if prefixes, read, err = decodeDeltaBinaryPacked(data, n); err != nil {
+			return nil, err
+		}
+		data = data[read:]
+	}
+	lengths, read, err := decodeDeltaBinaryPacked(data, n)
+	if err != nil {
+		return nil, err
+	}
+	data = data[read:]
+	out := make([][]byte, n)
+	var prev []byte
+	for i, l := range lengths {
+		if l < 0 || int(l) > len(data) {
+			return nil, errCorruptPage
+		}
+		v := data[:l]
+		data = data[l:]
+		if prefixed {
+			p := prefixes[i]
+			if p < 0 || int(p) > len(prev) {
+				return nil, errCorruptPage
+			}
+			v = append(bytes.Clone(prev[:p]), v...)
+		}
+		out[i] = v
+		prev = v
+	}
+	return out, nil
+}
+
+// decompressPage appends the decompressed page to dst.
+func decompressPage(codec int64, dst, src []byte, size int) ([]byte, error) {
+	switch codec {
+	case 0: // UNCOMPRESSED
+		return append(dst, src...), nil
+	case 1: // SNAPPY
+		n, err := s2.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if n > 32*len(src)+32 { // Snappy expands 21 times at most
+			return nil, errCorruptPage
+		}
+		out := make([]byte, n)
+		if _, err := s2.Decode(out, src); err != nil {
+			return nil, err
+		}
+		return append(dst, out...), nil
+	case 2: // GZIP
+		zr, err := gzip.NewReader(bytes.NewReader(src))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.Grow(size)
+		if _, err := io.Copy(&buf, zr); err != nil {
+			return nil, err
+		}
+		return append(dst, buf.Bytes()...), nil
+	case 6: // ZSTD
+		codec, err := common.NewCodec(common.CodecZstd)
+		if err != nil {
+			return nil, err
+		}
+		return codec.Decompress(dst, src)
+	case 7: // LZ4_RAW
+		if size < 0 || size > 255*len(src)+16 { // LZ4 expands 255 times at most
+			return nil, errCorruptPage
+		}
+		out := make([]byte, size)
+		n, err := lz4.UncompressBlock(src, out)
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, out[:n]...), nil
+	}
+	return nil, fmt.Errorf("unsupported compression codec %d (expected none, snappy, gzip, zstd or lz4_raw)", codec)
+}
+
+// Thrift compact protocol, enough of it to read Parquet metadata: structs
+// are decoded to maps of field id to value (int64, bool, float64, []byte,
+// []any or thriftStruct); maps are skipped.
+
+type thriftStruct map[int16]any
+
+func (s thriftStruct) int(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftStruct) bool(id int16) bool {
+	v, _ := s[id].(bool)
+	return v
+}
+
+func (s thriftStruct) bytes(id int16) []byte {
+	v, _ := s[id].([]byte)
+	return v
+}
+
+func (s thriftStruct) list(id int16) []any {
+	v, _ := s[id].([]any)
+	return v
+}
+
+func (s thriftStruct) strct(id int16) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// thriftReader reads compact protocol values from data.
+type thriftReader struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// readThriftStruct reads a struct from the start of data and returns it
+// with the bytes it took.
+func readThriftStruct(data []byte) (thriftStruct, int, error) {
+	r := &thriftReader{data: data}
+	s, err := r.strct()
+	return s, r.pos, err
+}
+
+var errThrift = errors.New("corrupt Thrift data")
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errThrift
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *thriftReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errThrift
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *thriftReader) varint() (int64, error) {
+	v, err := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1), err // Zigzag
+}
+
+func (r *thriftReader) strct() (thriftStruct, error) {
+	if r.depth++; r.depth > 64 {
+		return nil, errThrift
+	}
+	defer func() { r.depth-- }()
+	s := make(thriftStruct)
+	var id int16
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		typ := b & 0x0f
+		if typ == 0 { // Stop
+			return s, nil
+		}
+		if delta := b >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		if s[id], err = r.value(typ); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *thriftReader) value(typ byte) (any, error) {
+	switch typ {
+	case 1: // True
+		return true, nil
+	case 2: // False
+		return false, nil
+	case 3: // Byte
+		b, err := r.byte()
+		return int64(int8(b)), err
+	case 4, 5, 6: // i16, i32, i64
+		return r.varint()
+	case 7: // Double
+		if r.pos+8 > len(r.data) {
+			return nil, errThrift
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.data[r.pos:]))
+		r.pos += 8
+		return v, nil
+	case 8: // Binary
+		n, err := r.uvarint()
+		if err != nil || n > uint64(len(r.data)-r.pos) {
+			return nil, errThrift
+		}
+		v := r.data[r.pos : r.pos+int(n)]
+		r.pos += int(n)
+		return v, nil
+	case 9, 10: // List, set
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(b >> 4)
+		if size == 15 {
+			if size, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(r.data)-r.pos) { // Every element takes a byte at least
+			return nil, errThrift
+		}
+		elem := b & 0x0f
+		list := make([]any, 0, size)
+		for range size {
+			var v any
+			if elem == 1 || elem == 2 { // Booleans are a byte each in lists
+				c, err := r.byte()
+				if err != nil {
+					return nil, err
+				}
+				v = c == 1
+			} else if v, err = r.value(elem); err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case 11: // Map
+		size, err := r.uvarint()
+		if err != nil || size > uint64(len(r.data)-r.pos) {
+			return nil, errThrift
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		kv, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		for range size {
+			if _, err := r.value(kv >> 4); err != nil {
+				return nil, err
+			}
+			if _, err := r.value(kv & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case 12: // Struct
+		return r.strct()
+	}
+	return nil, fmt.Errorf("%w: type %d", errThrift, typ)
+}
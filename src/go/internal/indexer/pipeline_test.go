@@ -2,12 +2,18 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
 )
 
 func TestEndToEndPipeline(t *testing.T) {
@@ -64,8 +70,8 @@ func TestEndToEndPipeline(t *testing.T) {
 	}
 
 	// 4. Verify Output Files
-	idIndex := filepath.Join(outputDir, "test_id.cidx")
-	catIndex := filepath.Join(outputDir, "test_category.cidx")
+	idIndex := builtIndex(t, outputDir, "id")
+	catIndex := builtIndex(t, outputDir, "category")
 	metaFile := filepath.Join(outputDir, "test_meta.json")
 
 	if _, err := os.Stat(idIndex); os.IsNotExist(err) {
@@ -101,7 +107,7 @@ func verifyIndex(t *testing.T, path string, expectedCount int, unique bool) {
 	count := 0
 	var lastKey string
 
-	for _, block := range br.Footer.Blocks {
+	for _, block := range br.Footer.Blocks.All() {
 		recs, err := br.ReadBlock(block)
 		if err != nil {
 			t.Fatal(err)
@@ -121,3 +127,1121 @@ func verifyIndex(t *testing.T, path string, expectedCount int, unique bool) {
 		t.Errorf("Expected %d records in %s, got %d", expectedCount, filepath.Base(path), count)
 	}
 }
+
+// builtIndex returns the path of an index of test.csv in dir, from the
+// manifest in its metadata.
+func builtIndex(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "test_meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	stats, ok := meta.Indexes[name]
+	if !ok {
+		t.Fatalf("No index %s in the metadata", name)
+	}
+	return filepath.Join(dir, stats.File)
+}
+
+func TestAppendPipeline(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	writeRows := func(from, to int) {
+		f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		if from == 0 {
+			_, _ = f.WriteString("id,name,category\n")
+		}
+		for i := from; i < to; i++ {
+			_, _ = fmt.Fprintf(f, "%d,name_%d,cat_%d\n", i, i, i%5)
+		}
+	}
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{
+		InputFile:   csvPath,
+		OutputDir:   outputDir,
+		Columns:     `["id", "category"]`,
+		Separator:   ",",
+		Workers:     4,
+		MemoryMB:    64,
+		BloomFPRate: 0.01,
+		Output:      io.Discard,
+	}
+
+	writeRows(0, 5000)
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Initial build failed: %v", err)
+	}
+
+	stat, err := os.Stat(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRows(5000, 8000)
+
+	cfg.AppendFrom = stat.Size()
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	verifyIndex(t, builtIndex(t, outputDir, "id"), 8000, true)
+	verifyIndex(t, builtIndex(t, outputDir, "category"), 8000, false)
+
+	bloom, err := common.LoadBloomFilter(builtIndex(t, outputDir, "id") + ".bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bloom.MightContain("7999") {
+		t.Error("Bloom filter is missing an appended key")
+	}
+
+	// Appending from the wrong offset must be refused
+	cfg.AppendFrom = 10
+	if err := NewIndexer(cfg).Run(); err == nil {
+		t.Error("Expected append from a stale offset to fail")
+	}
+
+	// AppendIndexes takes the indexes from the metadata
+	writeRows(8000, 9000)
+	if err := AppendIndexes(csvPath, outputDir, nil, io.Discard); err != nil {
+		t.Fatalf("AppendIndexes failed: %v", err)
+	}
+	verifyIndex(t, builtIndex(t, outputDir, "id"), 9000, true)
+	verifyIndex(t, builtIndex(t, outputDir, "category"), 9000, false)
+	if err := AppendIndexes(csvPath, outputDir, nil, io.Discard); err != nil {
+		t.Errorf("AppendIndexes without new rows failed: %v", err)
+	}
+}
+
+func TestNullCounts(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	// Every 4th email is empty and every 10th NULL (20 and 40 share both)
+	writeRows := func(from, to int) {
+		f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		if from == 0 {
+			_, _ = f.WriteString("id,email\n")
+		}
+		for i := from; i < to; i++ {
+			email := fmt.Sprintf("user%d@example.com", i)
+			switch {
+			case i%4 == 0:
+				email = ""
+			case i%10 == 0:
+				email = "NULL"
+			}
+			_, _ = fmt.Fprintf(f, "%d,%s\n", i, email)
+		}
+	}
+	nulls := func(n int) int64 {
+		return int64(n/4 + n/10 - n/20)
+	}
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: outputDir,
+		Columns:   `["email", ["id", "email"]]`,
+		Separator: ",",
+		Workers:   2,
+		MemoryMB:  64,
+		Output:    io.Discard,
+	}
+	check := func(rows int) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(outputDir, "test_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta common.IndexMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if got := meta.Indexes["email"].NullCount; got == nil || *got != nulls(rows) {
+			t.Errorf("email null count after %d rows: got %v, expected %d", rows, got, nulls(rows))
+		}
+		if got := meta.Indexes["id_email"].NullCount; got == nil || *got != 0 {
+			t.Errorf("Composite keys are never null, got %v", got)
+		}
+		email := meta.Indexes["email"]
+		if email.Records != int64(rows) || email.Histogram == nil || email.AvgKeyLen == 0 {
+			t.Errorf("email key statistics after %d rows: %+v", rows, email)
+		} else if bounds := email.Histogram.Bounds; bounds[len(bounds)-1] > email.MaxKey || email.MinKey > bounds[0] {
+			t.Errorf("Histogram %v outside of key range %q..%q", bounds, email.MinKey, email.MaxKey)
+		}
+	}
+
+	writeRows(0, 2000)
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Initial build failed: %v", err)
+	}
+	check(2000)
+
+	stat, err := os.Stat(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRows(2000, 3000)
+	cfg.AppendFrom = stat.Size()
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	check(3000)
+}
+
+func TestManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	var csv bytes.Buffer
+	csv.WriteString("id,name,category\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&csv, "%d,name_%d,cat_%d\n", i, i, i%5)
+	}
+	if err := os.WriteFile(csvPath, csv.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	build := func(columns string) {
+		t.Helper()
+		cfg := IndexerConfig{
+			InputFile: csvPath,
+			OutputDir: outputDir,
+			Columns:   columns,
+			Separator: ",",
+			Workers:   2,
+			MemoryMB:  64,
+			Output:    io.Discard,
+		}
+		if err := NewIndexer(cfg).Run(); err != nil {
+			t.Fatalf("Build of %s failed: %v", columns, err)
+		}
+	}
+	manifest := func() map[string]string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(outputDir, "test_meta.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta common.IndexMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]string)
+		for name, stats := range meta.Indexes {
+			files[name] = stats.File
+		}
+		return files
+	}
+
+	// Separate builds keep each other's entries
+	build(`["id"]`)
+	build(`["category", ["id", "name"]]`)
+	want := map[string]string{"id": "test_id.g1.cidx", "category": "test_category.g2.cidx", "id_name": "test_id_name.g2.cidx"}
+	if got := manifest(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Manifest: got %v, expected %v", got, want)
+	}
+
+	// Entries of removed indexes are dropped
+	if err := os.Remove(filepath.Join(outputDir, want["id_name"])); err != nil {
+		t.Fatal(err)
+	}
+	build(`["id"]`)
+	delete(want, "id_name")
+	want["id"] = "test_id.g3.cidx"
+	if got := manifest(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Manifest after removing an index: got %v, expected %v", got, want)
+	}
+}
+
+func TestGenerations(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	writeRows := func(from, to int) {
+		t.Helper()
+		f, err := os.OpenFile(csvPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from == 0 {
+			_, _ = f.WriteString("id,category\n")
+		}
+		for i := from; i < to; i++ {
+			_, _ = fmt.Fprintf(f, "%d,cat_%d\n", i, i%3)
+		}
+		_ = f.Close()
+	}
+	writeRows(0, 1000)
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: outputDir, Columns: `["id","category"]`, Separator: ",",
+		Workers: 2, MemoryMB: 64, BloomFPRate: 0.01, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	first := builtIndex(t, outputDir, "id")
+	if filepath.Base(first) != "test_id.g1.cidx" {
+		t.Fatalf("First build wrote %s", first)
+	}
+
+	// A reader of the first generation keeps working across a rebuild
+	reader, err := common.NewBlockReaderMmap(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Cleanup()
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	second := builtIndex(t, outputDir, "id")
+	if filepath.Base(second) != "test_id.g2.cidx" {
+		t.Errorf("Rebuild wrote %s", second)
+	}
+	for _, old := range []string{first, first + ".bloom"} {
+		if _, err := os.Stat(old); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Superseded %s not removed (%v)", filepath.Base(old), err)
+		}
+	}
+	records := 0
+	for _, block := range reader.Footer.Blocks.All() {
+		recs, err := reader.ReadBlock(block)
+		if err != nil {
+			t.Fatalf("Open reader failed after the rebuild: %v", err)
+		}
+		records += len(recs)
+	}
+	if records != 1000 {
+		t.Errorf("Open reader read %d records, expected 1000", records)
+	}
+
+	// Appends publish a new generation too
+	info, _ := os.Stat(csvPath)
+	writeRows(1000, 1500)
+	cfg.AppendFrom = info.Size()
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	third := builtIndex(t, outputDir, "id")
+	if filepath.Base(third) != "test_id.g3.cidx" {
+		t.Errorf("Append wrote %s", third)
+	}
+	if _, err := os.Stat(second); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Index superseded by the append not removed (%v)", err)
+	}
+	verifyIndex(t, third, 1500, true)
+	verifyIndex(t, builtIndex(t, outputDir, "category"), 1500, false)
+	if _, err := os.Stat(third + ".bloom"); err != nil {
+		t.Errorf("Bloom filter of the append missing: %v", err)
+	}
+}
+
+func TestDropIndexes(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	var csv bytes.Buffer
+	csv.WriteString("id,category\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&csv, "%d,cat_%d\n", i, i%5)
+	}
+	if err := os.WriteFile(csvPath, csv.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `["id","category"]`, Separator: ",",
+		Workers: 2, MemoryMB: 64, BloomFPRate: 0.01, RowStore: true, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	dropped := builtIndex(t, tmpDir, "category")
+
+	store, err := storage.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DropIndexes(store, csvPath, []string{"Category"}, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{dropped, dropped + ".bloom", filepath.Join(tmpDir, "test.csvz")} {
+		if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s not removed (%v)", filepath.Base(file), err)
+		}
+	}
+	files, err := IndexFiles(store, csvPath)
+	if err != nil || len(files) != 1 || files["id"] == "" {
+		t.Errorf("Indexes after the drop: %v (%v)", files, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "test_meta.json"))
+	if bytes.Contains(data, []byte("rowStore")) {
+		t.Errorf("Row store still listed: %s", data)
+	}
+}
+
+func TestIndexLifecycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	var csv bytes.Buffer
+	csv.WriteString("id,category\n")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&csv, "%d,cat_%d\n", i, i%5)
+	}
+	if err := os.WriteFile(csvPath, csv.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `["id",{"col":"category","ci":true}]`, Separator: ",",
+		Workers: 2, MemoryMB: 64, BloomFPRate: 0.01, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	kept := builtIndex(t, tmpDir, "id")
+
+	store := storage.NewLocal(tmpDir)
+	infos, err := ListIndexes(store, csvPath)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("ListIndexes: %+v (%v)", infos, err)
+	}
+	if infos[0].Name != "category" || infos[0].Collation != common.CollationCI || infos[0].Distinct != 5 || infos[0].Size == 0 || infos[0].Stale != "" {
+		t.Errorf("category: %+v", infos[0])
+	}
+
+	// Rebuilding one index leaves the other's file alone
+	if _, err := RebuildConfig(csvPath, tmpDir, []string{"missing"}); err == nil {
+		t.Error("Rebuilt an unknown index")
+	}
+	rebuild, err := RebuildConfig(csvPath, tmpDir, []string{"Category"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuild.Columns != `[{"ci":true,"col":["category"]}]` {
+		t.Errorf("Rebuild columns %s", rebuild.Columns)
+	}
+	rebuild.Workers, rebuild.MemoryMB, rebuild.Output = 2, 64, io.Discard
+	if err := NewIndexer(rebuild).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if builtIndex(t, tmpDir, "id") != kept {
+		t.Error("Rebuilding category rewrote id")
+	}
+	if infos, _ = ListIndexes(store, csvPath); len(infos) != 2 || infos[0].Collation != common.CollationCI || infos[1].Stale != "" {
+		t.Errorf("After the rebuild: %+v", infos)
+	}
+
+	// Once the CSV changes, only a full rebuild keeps the indexes consistent
+	f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("500,cat_0\n")
+	_ = f.Close()
+	if infos, _ = ListIndexes(store, csvPath); !strings.HasPrefix(infos[0].Stale, "CSV grew") {
+		t.Errorf("Stale after an append: %q", infos[0].Stale)
+	}
+	if _, err := RebuildConfig(csvPath, tmpDir, []string{"id"}); err == nil {
+		t.Error("Rebuilt one index of a changed CSV")
+	}
+}
+
+func TestZoneMaps(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,category,value\n")
+	for i := 0; i < 5000; i++ {
+		value := fmt.Sprintf("%d", i*10)
+		if i == 4321 {
+			value = "n/a" // Non-numeric: its block gets no numeric range
+		}
+		_, _ = fmt.Fprintf(f, "%d,\"cat_%d\",%s\n", i, i%3, value)
+	}
+	_ = f.Close()
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{
+		InputFile:  csvPath,
+		OutputDir:  outputDir,
+		Columns:    `["category"]`,
+		Separator:  ",",
+		Workers:    2,
+		MemoryMB:   64,
+		Output:     io.Discard,
+		ZoneColumn: "value",
+	}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Indexer failed: %v", err)
+	}
+
+	br, err := common.NewBlockReaderMmap(builtIndex(t, outputDir, "category"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Cleanup()
+
+	if !br.Footer.ZoneMaps || br.Footer.ZoneColumn != "value" {
+		t.Fatalf("Expected zone maps on 'value', got %v/%q", br.Footer.ZoneMaps, br.Footer.ZoneColumn)
+	}
+
+	withoutRange := 0
+	maxValue := 0.0
+	for _, meta := range br.Footer.Blocks.All() {
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := string(bytes.TrimRight(records[len(records)-1].Key[:], "\x00")); meta.EndKey != last {
+			t.Errorf("EndKey %q, last key %q", meta.EndKey, last)
+		}
+		if meta.MinValue == nil {
+			withoutRange++
+			continue
+		}
+		if *meta.MinValue > *meta.MaxValue {
+			t.Errorf("Block %s: min %v > max %v", meta.StartKey, *meta.MinValue, *meta.MaxValue)
+		}
+		if *meta.MaxValue > maxValue {
+			maxValue = *meta.MaxValue
+		}
+	}
+	if withoutRange != 1 {
+		t.Errorf("Expected exactly one block without a numeric range, got %d", withoutRange)
+	}
+	if first := br.Footer.Blocks.At(0); first.MinValue == nil || *first.MinValue != 0 {
+		t.Errorf("First block should start at value 0, got %v", first.MinValue)
+	}
+	if maxValue != 49990 {
+		t.Errorf("Expected max value 49990, got %v", maxValue)
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,category\n")
+	for i := 0; i < 3000; i++ {
+		_, _ = fmt.Fprintf(f, "%d,cat_%d\n", i, i%7)
+	}
+	_ = f.Close()
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: outputDir,
+		Columns:   `["id"]`,
+		Separator: ",",
+		Workers:   2,
+		MemoryMB:  64,
+		Output:    io.Discard,
+	}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Indexer failed: %v", err)
+	}
+
+	indexPath := builtIndex(t, outputDir, "id")
+	verifyIndex(t, indexPath, 3000, true)
+
+	// Flip a byte inside the second block
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, err := common.NewBlockReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !br.Footer.Checksums || br.Footer.Blocks.Len() < 2 {
+		t.Fatalf("Expected a checksummed index with several blocks, got %d blocks", br.Footer.Blocks.Len())
+	}
+	bad := br.Footer.Blocks.At(1)
+	data[bad.Offset+bad.Length/2] ^= 0xFF
+
+	br, err = common.NewBlockReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := br.ReadBlock(br.Footer.Blocks.At(0)); err != nil {
+		t.Errorf("Intact block failed verification: %v", err)
+	}
+	if _, err := br.ReadBlock(bad); !errors.Is(err, common.ErrCorruptBlock) {
+		t.Errorf("Expected ErrCorruptBlock, got %v", err)
+	}
+
+	// A truncated copy fails on open instead of returning garbage
+	if _, err := common.NewBlockReader(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Error("Expected truncated index to fail")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,category\n")
+	for i := 0; i < 3000; i++ {
+		_, _ = fmt.Fprintf(f, "%d,cat_%d\n", i, i%7)
+	}
+	_ = f.Close()
+
+	for _, codec := range []string{common.CodecLZ4, common.CodecZstd, common.CodecNone} {
+		outputDir := filepath.Join(tmpDir, codec)
+		cfg := IndexerConfig{
+			InputFile: csvPath,
+			OutputDir: outputDir,
+			Columns:   `["id","category"]`,
+			Separator: ",",
+			Workers:   2,
+			MemoryMB:  64,
+			Output:    io.Discard,
+			Codec:     codec,
+		}
+		if err := NewIndexer(cfg).Run(); err != nil {
+			t.Fatalf("%s: indexer failed: %v", codec, err)
+		}
+
+		idIndex := builtIndex(t, outputDir, "id")
+		br, err := common.NewBlockReaderMmap(idIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.Footer.Codec != codec {
+			t.Errorf("Expected codec %q in footer, got %q", codec, br.Footer.Codec)
+		}
+		br.Cleanup()
+
+		verifyIndex(t, idIndex, 3000, true)
+		verifyIndex(t, builtIndex(t, outputDir, "category"), 3000, false)
+	}
+
+	cfg := IndexerConfig{InputFile: csvPath, Columns: `["id"]`, Output: io.Discard, Codec: "gzip"}
+	if err := NewIndexer(cfg).Run(); err == nil {
+		t.Error("Expected unknown codec to fail")
+	}
+}
+
+func TestCaseInsensitiveIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,email\n")
+	for i, email := range []string{"Ann@Example.com", "ann@example.com", "BOB@EXAMPLE.COM", "NULL", "", "Émile@example.com"} {
+		_, _ = fmt.Fprintf(f, "%d,%s\n", i, email)
+	}
+	_ = f.Close()
+
+	specs, err := ParseIndexSpecs(`["id", {"col":"email","ci":true}, {"col":["id","email"]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if specs[0].Collation != "" || specs[1].Collation != common.CollationCI || len(specs[2].Columns) != 2 || specs[2].Collation != "" {
+		t.Errorf("Parsed %+v", specs)
+	}
+	if _, err := ParseIndexSpecs(`[{"ci":true}]`); err == nil {
+		t.Error("Expected a column object without col to fail")
+	}
+
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `[{"col":"email","ci":true}]`, Separator: ",", Workers: 2, MemoryMB: 64, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := common.NewBlockReaderMmap(builtIndex(t, tmpDir, "email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Cleanup()
+	records, err := br.ReadBlock(br.Footer.Blocks.At(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := range records {
+		keys = append(keys, common.KeyString(&records[i].Key))
+	}
+	want := []string{"", "NULL", "ann@example.com", "ann@example.com", "bob@example.com", "émile@example.com"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Keys %q, expected %q", keys, want)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, "test_meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	stats := meta.Indexes["email"]
+	if stats.Collation != common.CollationCI || fmt.Sprint(stats.Columns) != "[email]" || *stats.NullCount != 2 {
+		t.Errorf("Metadata %+v", stats)
+	}
+
+	// Appending with another collation must be refused
+	info, _ := os.Stat(csvPath)
+	cfg.Columns = `["email"]`
+	cfg.AppendFrom = info.Size()
+	if err := NewIndexer(cfg).Run(); err == nil {
+		t.Error("Expected an append changing the collation to fail")
+	}
+}
+
+func TestTiering(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	coldDir := filepath.Join(tmpDir, "cold")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,category\n")
+	for i := 0; i < 5000; i++ {
+		_, _ = fmt.Fprintf(f, "%05d,cat_%d\n", i, i%7)
+	}
+	_ = f.Close()
+
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `["id"]`, Separator: ",", Workers: 2, MemoryMB: 64, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ResolveIndexFile(store, csvPath, "ID")
+	if err != nil || file != "test_id.g1.cidx" {
+		t.Fatalf("Resolved %q (%v)", file, err)
+	}
+	indexPath := filepath.Join(tmpDir, file)
+
+	stats, err := TierIndex(store, file, coldDir, "03000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ColdBlocks == 0 || stats.HotBlocks == 0 {
+		t.Fatalf("Expected hot and cold blocks, got %+v", stats)
+	}
+	br, err := common.NewBlockReaderMmap(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range br.Footer.Blocks.All() {
+		if b.Cold != (b.EndKey < "03000") {
+			t.Errorf("Block %s..%s cold=%v", b.StartKey, b.EndKey, b.Cold)
+		}
+	}
+	coldFile := filepath.Join(br.Footer.ColdStore, br.Footer.ColdFile)
+	br.Cleanup()
+	verifyIndex(t, indexPath, 5000, true)
+
+	// Moving every block back removes the cold file
+	if stats, err = TierIndex(store, file, "", ""); err != nil || stats.ColdBlocks != 0 {
+		t.Fatalf("Untiering gave %+v (%v)", stats, err)
+	}
+	if _, err := os.Stat(coldFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Cold file %s left behind (%v)", coldFile, err)
+	}
+	verifyIndex(t, indexPath, 5000, true)
+}
+
+func TestPartitions(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	writeRows := func(from, to int) {
+		t.Helper()
+		f, err := os.OpenFile(csvPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from == 0 {
+			_, _ = f.WriteString("id,category\n")
+		}
+		for i := from; i < to; i++ {
+			_, _ = fmt.Fprintf(f, "%05d,cat_%d\n", i, i%7)
+		}
+		_ = f.Close()
+	}
+	writeRows(0, 20000)
+
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `["id","category"]`, Separator: ",",
+		Workers: 2, MemoryMB: 64, Partitions: 4, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key lives in a single part, and parts hold ascending key ranges
+	checkParts := func(name string, wantParts int) []string {
+		t.Helper()
+		path := builtIndex(t, tmpDir, name)
+		br, err := common.NewBlockReaderMmap(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer br.Cleanup()
+		if len(br.Footer.Parts) != wantParts {
+			t.Fatalf("%s has %d parts, expected %d", name, len(br.Footer.Parts), wantParts)
+		}
+		partOf := map[string]int{}
+		last := 0
+		for _, block := range br.Footer.Blocks.All() {
+			if block.Part < last || (wantParts > 0) != (block.Part > 0) {
+				t.Fatalf("%s: block %s in part %d after part %d", name, block.StartKey, block.Part, last)
+			}
+			last = block.Part
+			recs, err := br.ReadBlock(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range recs {
+				key := common.KeyString(&r.Key)
+				if part, ok := partOf[key]; ok && part != block.Part {
+					t.Fatalf("%s: key %s in parts %d and %d", name, key, part, block.Part)
+				}
+				partOf[key] = block.Part
+			}
+		}
+		files := []string{path}
+		for _, part := range br.Footer.Parts {
+			files = append(files, filepath.Join(tmpDir, part))
+		}
+		return files
+	}
+	idFiles := checkParts("id", 4)
+	checkParts("category", 4)
+	verifyIndex(t, idFiles[0], 20000, true)
+	verifyIndex(t, builtIndex(t, tmpDir, "category"), 20000, false)
+
+	var size int64
+	for _, file := range idFiles {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "test_meta.json"))
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if stats := meta.Indexes["id"]; stats.Partitions != 4 || stats.FileSize != size {
+		t.Errorf("Metadata has %d partitions of %d bytes, expected 4 of %d", stats.Partitions, stats.FileSize, size)
+	}
+
+	store, _ := storage.Open(tmpDir)
+	if _, err := TierIndex(store, filepath.Base(idFiles[0]), filepath.Join(tmpDir, "cold"), "10000"); err == nil {
+		t.Error("Tiering a partitioned index succeeded")
+	}
+
+	// Appends keep the partitions; the superseded parts go
+	info, _ := os.Stat(csvPath)
+	writeRows(20000, 22000)
+	cfg.Partitions = 0
+	cfg.AppendFrom = info.Size()
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	appended := checkParts("id", 4)
+	verifyIndex(t, appended[0], 22000, true)
+	for _, old := range idFiles {
+		if _, err := os.Stat(old); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Superseded %s not removed (%v)", filepath.Base(old), err)
+		}
+	}
+
+	// An unpartitioned rebuild removes them too
+	cfg.AppendFrom = 0
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkParts("id", 0)
+	for _, old := range appended {
+		if _, err := os.Stat(old); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Superseded %s not removed (%v)", filepath.Base(old), err)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("id,category\n")
+	for i := 0; i < 20000; i++ {
+		_, _ = fmt.Fprintf(f, "%d,cat_%d\n", i, i%7)
+	}
+	_ = f.Close()
+
+	outputDir := filepath.Join(tmpDir, "indexes")
+	cfg := IndexerConfig{
+		InputFile:       csvPath,
+		OutputDir:       outputDir,
+		Columns:         `["id","category"]`,
+		Separator:       ",",
+		Workers:         2,
+		MemoryMB:        64,
+		BloomFPRate:     0.01,
+		Output:          io.Discard,
+		CheckpointBytes: 32 * 1024,
+	}
+
+	// A directory in its place makes writing the category index fail
+	catIndex := filepath.Join(outputDir, "test_category.g1.cidx")
+	if err := os.MkdirAll(catIndex, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewIndexer(cfg).Run(); err == nil {
+		t.Fatal("Expected the category index to fail")
+	}
+
+	idx := NewIndexer(cfg)
+	idx.tempDir = filepath.Join(outputDir, ".csvquery_temp")
+	if err := idx.parseColumns(); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.loadCheckpoint(); err != nil {
+		t.Fatalf("No usable checkpoint after the failure: %v", err)
+	}
+	if state := idx.checkpoint.Indexes["id"]; state == nil || !state.Done {
+		t.Errorf("id index not recorded as done: %+v", state)
+	}
+	if state := idx.checkpoint.Indexes["category"]; state == nil || len(state.Chunks) < 2 || state.Records != 20000 {
+		t.Errorf("category index not checkpointed by segment: %+v", state)
+	}
+	idIndex := filepath.Join(outputDir, "test_id.g1.cidx") // No metadata before the resume
+	idBefore, err := os.Stat(idIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other options must not resume the checkpoint
+	other := cfg
+	other.Resume = true
+	other.Codec = common.CodecZstd
+	if err := NewIndexer(other).Run(); err == nil {
+		t.Error("Expected resuming with another codec to fail")
+	}
+
+	if err := os.Remove(catIndex); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Resume = true
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+
+	idAfter, err := os.Stat(idIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idAfter.ModTime().Equal(idBefore.ModTime()) {
+		t.Error("Finished id index was rebuilt")
+	}
+	verifyIndex(t, idIndex, 20000, true)
+	verifyIndex(t, catIndex, 20000, false)
+
+	meta, err := os.ReadFile(filepath.Join(outputDir, "test_meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(meta, []byte(`"totalRows": 20000`)) || !bytes.Contains(meta, []byte(`"id"`)) {
+		t.Errorf("Unexpected meta after resume: %s", meta)
+	}
+
+	if err := NewIndexer(cfg).Run(); err == nil {
+		t.Error("Expected a second resume to find no checkpoint")
+	}
+}
+
+func TestDeltas(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	appendRows := func(from, to int) int64 {
+		stat, _ := os.Stat(csvPath)
+		f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		if from == 0 {
+			_, _ = f.WriteString("id,category\n")
+		}
+		for i := from; i < to; i++ {
+			_, _ = fmt.Fprintf(f, "%d,Cat_%d\n", i, i%3)
+		}
+		if stat == nil {
+			return 0
+		}
+		return stat.Size()
+	}
+	readDelta := func(name string) (common.DeltaHeader, []common.IndexRecord) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(tmpDir, common.DeltaFileName("test", name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, records, err := common.DecodeDelta(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h, records
+	}
+
+	appendRows(0, 100)
+	cfg := IndexerConfig{
+		InputFile: csvPath,
+		OutputDir: tmpDir,
+		Columns:   `["id", {"col":"category","ci":true}]`,
+		Workers:   2,
+		MemoryMB:  16,
+		Output:    io.Discard,
+	}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, "test_meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each write extends the deltas with its rows
+	if err := WriteDeltas(csvPath, tmpDir, appendRows(100, 110)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDeltas(csvPath, tmpDir, appendRows(110, 115)); err != nil {
+		t.Fatal(err)
+	}
+	h, records := readDelta("category")
+	if !h.Covers(&meta) || len(records) != 15 {
+		t.Fatalf("Delta %+v with %d records after two writes", h, len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if compareRecords(records[i-1], records[i]) > 0 {
+			t.Fatal("Delta records are not sorted")
+		}
+	}
+	if key := common.KeyString(&records[0].Key); key != "cat_0" {
+		t.Errorf("First key of the case-insensitive delta is %q", key)
+	}
+
+	// Rows appended without deltas are picked up by the next write
+	appendRows(115, 120)
+	if err := WriteDeltas(csvPath, tmpDir, appendRows(120, 121)); err != nil {
+		t.Fatal(err)
+	}
+	if _, records := readDelta("id"); len(records) != 21 {
+		t.Errorf("Delta has %d records, want the 21 rows since the build", len(records))
+	}
+
+	// The next build covers the rows and removes the deltas
+	cfg.AppendFrom = meta.CsvSize
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, common.DeltaFileName("test", "id"))); !os.IsNotExist(err) {
+		t.Errorf("Delta kept after the build: %v", err)
+	}
+	verifyIndex(t, builtIndex(t, tmpDir, "id"), 121, true)
+}
+
+func TestVirtualColumnIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "test.csv")
+	if err := os.WriteFile(csvPath, []byte("id,price,qty,date\n1,2.5,4,2024-01-05\n2,\"3\",3,2023-06-01\n3,x,1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := schema.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddVirtualColumn("region", "EU")
+	for name, expr := range map[string]string{"total": "price * qty", "year": "substr(date, 0, 4)"} {
+		if err := s.AddComputedColumn(name, expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := IndexerConfig{InputFile: csvPath, OutputDir: tmpDir, Columns: `["total", ["region", "year"]]`, ZoneColumn: "total", Workers: 2, MemoryMB: 16, Output: io.Discard}
+	if err := NewIndexer(cfg).Run(); err != nil {
+		t.Fatal(err)
+	}
+	keys := func(name string) []string {
+		t.Helper()
+		br, err := common.NewBlockReaderMmap(builtIndex(t, tmpDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer br.Cleanup()
+		records, err := br.ReadBlock(br.Footer.Blocks.At(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for i := range records {
+			keys = append(keys, common.DecodeKey(common.KeyString(&records[i].Key)))
+		}
+		return keys
+	}
+	if got, want := keys("total"), []string{"", "10", "9"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Keys of total %q, want %q", got, want)
+	}
+	if got, want := keys("region_year"), []string{`["EU",""]`, `["EU","2023"]`, `["EU","2024"]`}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Keys of region_year %q, want %q", got, want)
+	}
+
+	// Deltas compute the columns of appended rows as the build does
+	f, err := os.OpenFile(csvPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := f.Stat()
+	_, _ = f.WriteString("4,1.5,2,2022-03-03\n")
+	_ = f.Close()
+	if err := WriteDeltas(csvPath, tmpDir, stat.Size()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, common.DeltaFileName("test", "total")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, records, err := common.DecodeDelta(data); err != nil || len(records) != 1 || common.KeyString(&records[0].Key) != "3" {
+		t.Errorf("Delta of total: %v, %v", records, err)
+	}
+}
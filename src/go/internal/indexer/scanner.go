@@ -15,7 +15,6 @@ package indexer
 import (
 	"bytes"
 	"fmt"
-	"math/bits"
 	"os"
 	"runtime"
 	"strings"
@@ -24,25 +23,37 @@ import (
 	"time"
 
 	"github.com/entreya/csvquery/internal/common"
-	"github.com/entreya/csvquery/internal/simd"
+	"github.com/entreya/csvquery/internal/schema"
 )
 
 // Scanner reads CSV files efficiently using Mmap and Parallelism
 type Scanner struct {
 	filePath    string
-	separator   byte // optimized for single byte separator
+	separator   byte           // optimized for single byte separator
+	dialect     common.Dialect // As detected (Separator: the one in use)
+	sniffed     bool           // Separator was detected, not given
 	headers     []string
 	headerMap   map[string]int
-	data        []byte // mmapped data
+	virtual     [][]byte                // Defaults of the virtual columns, after the header's (see AddSchema)
+	computed    []schema.ComputedColumn // Virtual columns computed from the row
+	data        []byte                  // mmapped data
 	fileSize    int64
 	workers     int
 	startTime   time.Time
 	rowsScanned int64
 	scanBytes   int64
+	startOffset int    // First byte to scan (0 = right after the header)
+	rendered    string // CSV rendering of a columnar input, removed on Close
 }
 
-// NewScanner creates a new Mmap-based CSV scanner
+// NewScanner creates a new Mmap-based CSV scanner. An empty or "auto"
+// separator is detected from the start of the file.
 func NewScanner(filePath, separator string) (*Scanner, error) {
+	sep, err := common.ParseSeparator(separator)
+	if err != nil {
+		return nil, err
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
@@ -61,9 +72,18 @@ func NewScanner(filePath, separator string) (*Scanner, error) {
 		return nil, err
 	}
 
+	sample := data[:min(len(data), common.SniffBytes)]
+	dialect := common.SniffDialect(sample, len(sample) < len(data))
+	if sep == 0 {
+		sep = dialect.Separator
+	}
+	dialect.Separator = sep
+
 	scanner := &Scanner{
 		filePath:  filePath,
-		separator: separator[0], // assume single byte separator
+		separator: sep,
+		dialect:   dialect,
+		sniffed:   separator == "" || separator == "auto",
 		data:      data,
 		fileSize:  size,
 		workers:   runtime.NumCPU(),
@@ -125,23 +145,124 @@ func (scanner *Scanner) GetColumnIndex(name string) (int, bool) {
 	return idx, ok
 }
 
+// AddSchema adds the columns of a schema to the header map: its virtual
+// columns, numbered after the header's in name order as queries number
+// them, and its aliases. Rows then have the virtual columns' defaults, and
+// the values of computed ones, at those positions.
+func (scanner *Scanner) AddSchema(s *schema.Schema) error {
+	if s == nil {
+		return nil
+	}
+	for _, name := range s.VirtualNames() {
+		key := strings.ToLower(name)
+		if _, ok := scanner.headerMap[key]; !ok {
+			scanner.headerMap[key] = len(scanner.headers) + len(scanner.virtual)
+			scanner.virtual = append(scanner.virtual, []byte(s.VirtualColumns[name]))
+		}
+	}
+	if err := s.AddAliases(scanner.headerMap, len(scanner.headers)); err != nil {
+		return err
+	}
+	var err error
+	scanner.computed, err = s.Computed(scanner.headerMap, len(scanner.headers))
+	return err
+}
+
+// appendVirtual pads the fields of a row to the header's columns, dropping
+// any past them, and appends the virtual columns. strs is a buffer for the
+// row as strings, which computed columns are evaluated on.
+func (scanner *Scanner) appendVirtual(values [][]byte, strs *[]string) [][]byte {
+	physical := len(scanner.headers)
+	for len(values) < physical {
+		values = append(values, nil)
+	}
+	values = append(values[:physical], scanner.virtual...)
+	if len(scanner.computed) == 0 {
+		return values
+	}
+	*strs = (*strs)[:0]
+	for _, v := range values {
+		*strs = append(*strs, string(v))
+	}
+	for _, c := range scanner.computed {
+		v := c.Expr.Eval(*strs)
+		(*strs)[c.Pos] = v
+		values[c.Pos] = []byte(v)
+	}
+	return values
+}
+
 // GetHeaders returns all column headers
 func (scanner *Scanner) GetHeaders() []string {
 	return scanner.headers
 }
 
+// Dialect returns the dialect of the CSV, and whether its separator was
+// detected rather than given.
+func (scanner *Scanner) Dialect() (common.Dialect, bool) {
+	return scanner.dialect, scanner.sniffed
+}
+
 // ValidateColumns checks if all requested columns exist
 func (scanner *Scanner) ValidateColumns(columns []string) error {
 	for _, col := range columns {
 		normalized := strings.ToLower(strings.TrimSpace(col))
 		if _, ok := scanner.headerMap[normalized]; !ok {
 			// Use %q to show exact strings (reveals quoting/spacing/newlines)
-			return fmt.Errorf("column not found: %s (detected %d headers: %q)", col, len(scanner.headers), scanner.headers)
+			return fmt.Errorf("column not found: %s (detected %d headers: %q with separator %s)",
+				col, len(scanner.headers), scanner.headers, common.SeparatorName(scanner.separator))
 		}
 	}
 	return nil
 }
 
+// FieldAt returns column col of the row starting at offset, with
+// surrounding quotes removed ("" if the row has fewer columns). Past the
+// header's columns, it is a virtual column (see AddSchema).
+func (scanner *Scanner) FieldAt(offset int64, col int) string {
+	if offset < 0 || offset >= int64(len(scanner.data)) {
+		return ""
+	}
+	row := scanner.data[offset:]
+	if end := common.RecordEnd(row); end != -1 {
+		row = row[:end]
+	}
+	row = bytes.TrimSuffix(row, []byte{'\r'})
+	if col >= len(scanner.headers) {
+		var rs common.RecordScanner
+		rs.Reset(row, scanner.separator)
+		var strs []string
+		values := scanner.appendVirtual(rs.Fields(0, len(row), len(scanner.headers), nil), &strs)
+		if col < len(values) {
+			return string(values[col])
+		}
+		return ""
+	}
+
+	start, n := 0, 0
+	inQuote := false
+	for i := 0; i <= len(row); i++ {
+		if i < len(row) {
+			if row[i] == '"' {
+				inQuote = !inQuote
+			}
+			if row[i] != scanner.separator || inQuote {
+				continue
+			}
+		}
+		if n == col {
+			field := row[start:i]
+			if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
+				field = field[1 : len(field)-1]
+			}
+			return string(field)
+		}
+		n++
+		start = i + 1
+	}
+	return ""
+}
+
 // SetWorkers sets the number of parallel workers
 func (scanner *Scanner) SetWorkers(n int) {
 	if n > 0 {
@@ -149,19 +270,54 @@ func (scanner *Scanner) SetWorkers(n int) {
 	}
 }
 
+// SetStartOffset restricts Scan to rows starting at or after offset.
+// offset must be the start of a record (used for append-only indexing).
+func (scanner *Scanner) SetStartOffset(offset int64) {
+	if offset > 0 {
+		scanner.startOffset = int(offset)
+	}
+}
+
 // Scan processes the CSV in parallel
 //
 // Parameters:
 //   - indexDefs: Array of column index definitions
 //   - handler: Function called for each row (MUST be thread-safe)
 func (scanner *Scanner) Scan(indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64)) error {
-	// Find start of data (after header)
+	return scanner.ScanRange(scanner.DataStart(), scanner.fileSize, indexDefs, handler)
+}
+
+// DataStart is the offset of the first row Scan visits: right after the
+// header, or the start offset.
+func (scanner *Scanner) DataStart() int64 {
 	startIdx := bytes.IndexByte(scanner.data, '\n') + 1
-	if startIdx <= 0 || startIdx >= len(scanner.data) {
+	if startIdx > 0 && scanner.startOffset > startIdx {
+		startIdx = scanner.startOffset
+	}
+	if startIdx <= 0 {
+		return scanner.fileSize
+	}
+	return int64(startIdx)
+}
+
+// RecordBoundary returns the start of the first record at or after hint
+// (the file size if there is none).
+func (scanner *Scanner) RecordBoundary(hint int64) int64 {
+	if hint >= scanner.fileSize {
+		return scanner.fileSize
+	}
+	return int64(common.RecordBoundary(scanner.data, int(hint)))
+}
+
+// ScanRange processes the rows in [start, end) in parallel, like Scan.
+// Both must be record boundaries (see RecordBoundary).
+func (scanner *Scanner) ScanRange(start, end int64, indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64)) error {
+	startIdx := int(start)
+	dataSize := min(int(end), len(scanner.data))
+	if startIdx <= 0 || startIdx >= dataSize {
 		return nil // End of file
 	}
 
-	dataSize := len(scanner.data)
 	chunkSize := (dataSize - startIdx) / scanner.workers
 
 	// CRITICAL FIX: Precompute ALL safe boundaries first to prevent gaps/overlaps.
@@ -174,7 +330,7 @@ func (scanner *Scanner) Scan(indexDefs [][]int, handler func(workerID int, keys
 	for i := 1; i < scanner.workers; i++ {
 		hint := startIdx + (i * chunkSize)
 		if hint < dataSize {
-			boundaries[i] = findSafeRecordBoundary(scanner.data, hint)
+			boundaries[i] = min(common.RecordBoundary(scanner.data, hint), dataSize)
 		} else {
 			boundaries[i] = dataSize
 		}
@@ -200,88 +356,19 @@ func (scanner *Scanner) Scan(indexDefs [][]int, handler func(workerID int, keys
 	}
 
 	wg.Wait()
-	scanner.scanBytes = int64(dataSize)
+	atomic.StoreInt64(&scanner.scanBytes, int64(dataSize))
 	return nil
 }
 
-// findSafeRecordBoundary finds the next newline that is NOT inside a quoted field
-// hint is the approximate start position (from simple chunking)
-func findSafeRecordBoundary(data []byte, hint int) int {
-	// First, find the first newline at or after hint
-	currentPosition := hint
-	if currentPosition >= len(data) {
-		return len(data)
-	}
-
-	// Seek to next newline
-	nextNL := bytes.IndexByte(data[currentPosition:], '\n')
-	if nextNL == -1 {
-		return len(data)
-	}
-	currentPosition += nextNL
-
-	currentNL := currentPosition
-
-	loopCount := 0
-
-	for {
-		loopCount++
-
-		// seek next newline
-		if currentNL+1 >= len(data) {
-			return len(data)
-		}
-
-		nextNL := bytes.IndexByte(data[currentNL+1:], '\n')
-		if nextNL == -1 {
-			// End of file is a valid boundary always
-			return currentNL + 1
-		}
-		nextPos := currentNL + 1 + nextNL
-
-		// Count quotes in data[currentNL+1 : nextPos]
-		quotes := 0
-		for i := currentNL + 1; i < nextPos; i++ {
-			if data[i] == '"' {
-				quotes++
-			}
-		}
-
-		if quotes%2 == 0 {
-			// Even quotes implies self-contained line.
-			// So currentNL is a valid start.
-			return currentNL + 1
-		}
-
-		// Odd quotes implies we are inside a multiline field or just finished one half of it.
-		// So currentNL was invalid.
-		// Try next one.
-		currentNL = nextPos
-	}
-}
-
 func (scanner *Scanner) processChunk(start, end int, workerID int, indexDefs [][]int, handler func(workerID int, keys [][]byte, offset, line int64)) {
-	if start >= len(scanner.data) {
-		return
-	}
-
 	// Clamp end to data length
-	if end > len(scanner.data) {
-		end = len(scanner.data)
-	}
+	end = min(end, len(scanner.data))
 
 	// Skip if start >= end (can happen with small files and many workers)
 	if start >= end {
 		return
 	}
-
 	dataChunk := scanner.data[start:end]
-	chunkLen := len(dataChunk)
-	if chunkLen == 0 {
-		return
-	}
-
-	sep := scanner.separator
 
 	// Reusable buffers per worker
 	keys := make([][]byte, len(indexDefs))
@@ -296,231 +383,96 @@ func (scanner *Scanner) processChunk(start, end int, workerID int, indexDefs [][
 		}
 	}
 
-	currentRowValues := make([][]byte, maxCol+1)
+	values := make([][]byte, 0, maxCol+1)
 	scratchBuf := make([]byte, 0, 1024)
+	var strs []string                         // Row as strings, for computed columns
+	virtual := maxCol >= len(scanner.headers) // An index is over a virtual column
+	if virtual {
+		maxCol = len(scanner.headers) - 1 // Computed columns may read any column
+	}
 
 	// SIMD Phase: Generate bitmaps for the entire chunk
-	bitmapLen := (chunkLen + 63) / 64
-	quotesBitmap := make([]uint64, bitmapLen)
-	sepsBitmap := make([]uint64, bitmapLen)
-	newlinesBitmap := make([]uint64, bitmapLen)
-
-	// Use custom separator if not comma
-	if sep == ',' {
-		simd.Scan(dataChunk, quotesBitmap, sepsBitmap, newlinesBitmap)
-	} else {
-		simd.ScanWithSeparator(dataChunk, sep, quotesBitmap, sepsBitmap, newlinesBitmap)
-	}
+	var rs common.RecordScanner
+	rs.Reset(dataChunk, scanner.separator)
 
 	// Local accumulators for atomics optimization
 	var localRowsScanned int64
 	var localScanBytes int64
 
 	// Parse using bitmaps
-	lineStart := 0
-	inQuote := false
-
-	for wordIdx := 0; wordIdx < bitmapLen; wordIdx++ {
-		quoteMask := quotesBitmap[wordIdx]
-		newlineMask := newlinesBitmap[wordIdx]
-
-		// Fast path: no structural chars in this 64-byte word
-		if quoteMask == 0 && newlineMask == 0 && !inQuote {
-			continue
+	rs.Records(func(lineStart, lineEnd, next int) bool {
+		// Handle CR
+		if lineEnd > lineStart && dataChunk[lineEnd-1] == '\r' {
+			lineEnd--
 		}
-
-		// Process each set bit (quote or newline)
-		combined := quoteMask | newlineMask
-		for combined != 0 {
-			tz := bits.TrailingZeros64(combined)
-			bitMask := uint64(1) << tz
-			combined &^= bitMask
-
-			bytePos := wordIdx*64 + tz
-			if bytePos >= chunkLen {
-				break
-			}
-
-			isQuote := (quoteMask & bitMask) != 0
-			isNewline := (newlineMask & bitMask) != 0
-
-			if isQuote {
-				inQuote = !inQuote
-				continue
-			}
-
-			if isNewline && !inQuote {
-				// End of line found
-				lineEnd := bytePos
-				lineBytes := dataChunk[lineStart:lineEnd]
-
-				// Handle CR
-				if len(lineBytes) > 0 && lineBytes[len(lineBytes)-1] == '\r' {
-					lineBytes = lineBytes[:len(lineBytes)-1]
-				}
-
-				if len(lineBytes) > 0 {
-					// Clear buffer
-					for k := range currentRowValues {
-						currentRowValues[k] = nil
-					}
-
-					// Parse line using SIMD bitmaps
-					scanner.parseLineSimd(lineBytes, sep, int64(start+lineStart), workerID, indexDefs, handler, keys, currentRowValues, &scratchBuf, lineStart, quotesBitmap, sepsBitmap)
-					localRowsScanned++
-				}
-
-				localScanBytes += int64(lineEnd - lineStart + 1)
-				lineStart = bytePos + 1
+		if lineEnd > lineStart {
+			values = rs.Fields(lineStart, lineEnd, maxCol+1, values[:0])
+			if virtual {
+				values = scanner.appendVirtual(values, &strs)
 			}
+			scanner.emitKeys(values, int64(start+lineStart), workerID, indexDefs, handler, keys, &scratchBuf)
+			localRowsScanned++
 		}
+		localScanBytes += int64(next - lineStart)
 
 		// Periodic progress update (every ~64KB)
-		if wordIdx%1024 == 0 {
+		if localScanBytes >= 64*1024 {
 			atomic.AddInt64(&scanner.scanBytes, localScanBytes)
 			atomic.AddInt64(&scanner.rowsScanned, localRowsScanned)
 			localScanBytes = 0
 			localRowsScanned = 0
 		}
-	}
-
-	// Handle last line (no trailing newline)
-	if lineStart < chunkLen && !inQuote {
-		lineBytes := dataChunk[lineStart:]
-
-		// Handle CR
-		if len(lineBytes) > 0 && lineBytes[len(lineBytes)-1] == '\r' {
-			lineBytes = lineBytes[:len(lineBytes)-1]
-		}
-
-		if len(lineBytes) > 0 {
-			for k := range currentRowValues {
-				currentRowValues[k] = nil
-			}
-			scanner.parseLineSimd(lineBytes, sep, int64(start+lineStart), workerID, indexDefs, handler, keys, currentRowValues, &scratchBuf, lineStart, quotesBitmap, sepsBitmap)
-			localRowsScanned++
-		}
-		localScanBytes += int64(chunkLen - lineStart)
-	}
+		return true
+	})
 
 	// Final update
 	atomic.AddInt64(&scanner.scanBytes, localScanBytes)
 	atomic.AddInt64(&scanner.rowsScanned, localRowsScanned)
 }
 
-// parseLineSimd parses a single line using pre-computed SIMD bitmaps.
-// This enables quote-aware field extraction at hardware speed.
+// emitKeys passes the index keys of a row to the handler.
 //
 // Parameters:
-//   - line: the raw line bytes (without newline)
-//   - sep: separator byte
+//   - values: the row's fields, as far as the index columns need (missing
+//     fields are empty)
 //   - offset: byte offset in the original file
-//   - lineStartInChunk: where this line starts within the chunk (for bitmap indexing)
-//   - quotesBitmap, sepsBitmap: pre-computed bitmaps from SIMD scan
-func (scanner *Scanner) parseLineSimd(
-	line []byte,
-	sep byte,
+func (scanner *Scanner) emitKeys(
+	values [][]byte,
 	offset int64,
 	workerID int,
 	indexDefs [][]int,
 	handler func(workerID int, keys [][]byte, offset, line int64),
 	keys [][]byte,
-	currentRowValues [][]byte,
 	scratchBuf *[]byte,
-	lineStartInChunk int,
-	quotesBitmap, sepsBitmap []uint64,
 ) {
-	maxCol := len(currentRowValues) - 1
-	lineLen := len(line)
-
-	if lineLen == 0 {
-		return
-	}
-
-	// Extract fields using the bitmap
-	colIdx := 0
-	fieldStart := 0
-	inQuote := false
-
-	for i := 0; i < lineLen && colIdx <= maxCol; i++ {
-		// Get the bitmap position (relative to chunk start)
-		bitmapPos := lineStartInChunk + i
-		wordIdx := bitmapPos / 64
-		bitPos := uint(bitmapPos % 64)
-
-		if wordIdx >= len(quotesBitmap) {
-			// Fallback to byte-by-byte for safety
-			break
-		}
-
-		isQuote := (quotesBitmap[wordIdx] & (1 << bitPos)) != 0
-		isSep := (sepsBitmap[wordIdx] & (1 << bitPos)) != 0
-
-		if isQuote {
-			inQuote = !inQuote
-			continue
-		}
-
-		if isSep && !inQuote {
-			// End of field
-			valBytes := line[fieldStart:i]
-			// Trim quotes if present
-			if len(valBytes) >= 2 && valBytes[0] == '"' && valBytes[len(valBytes)-1] == '"' {
-				valBytes = valBytes[1 : len(valBytes)-1]
-			}
-			currentRowValues[colIdx] = valBytes
-			colIdx++
-			fieldStart = i + 1
-		}
-	}
-
-	// Handle last field
-	if colIdx <= maxCol && fieldStart <= lineLen {
-		valBytes := line[fieldStart:]
-		if len(valBytes) >= 2 && valBytes[0] == '"' && valBytes[len(valBytes)-1] == '"' {
-			valBytes = valBytes[1 : len(valBytes)-1]
-		}
-		currentRowValues[colIdx] = valBytes
-	}
-
 	// Populate keys
 	*scratchBuf = (*scratchBuf)[:0]
 
 	for i, indices := range indexDefs {
 		if len(indices) == 1 {
 			idx := indices[0]
-			if idx < len(currentRowValues) && currentRowValues[idx] != nil {
-				keys[i] = currentRowValues[idx]
+			if idx < len(values) {
+				keys[i] = values[idx]
 			} else {
 				keys[i] = []byte{}
 			}
 		} else {
-			startLen := len(*scratchBuf)
-			*scratchBuf = append(*scratchBuf, '[')
-			for j, idx := range indices {
-				if j > 0 {
-					*scratchBuf = append(*scratchBuf, ',')
-				}
-				*scratchBuf = append(*scratchBuf, '"')
-
-				if idx < len(currentRowValues) && currentRowValues[idx] != nil {
-					*scratchBuf = append(*scratchBuf, currentRowValues[idx]...)
+			var parts [8][]byte
+			fields := parts[:0]
+			for _, idx := range indices {
+				if idx < len(values) {
+					fields = append(fields, values[idx])
+				} else {
+					fields = append(fields, nil)
 				}
-				*scratchBuf = append(*scratchBuf, '"')
 			}
-			*scratchBuf = append(*scratchBuf, ']')
-
-			endLen := len(*scratchBuf)
-			keys[i] = (*scratchBuf)[startLen:endLen]
+			startLen := len(*scratchBuf)
+			*scratchBuf = common.AppendCompositeKey(*scratchBuf, fields)
+			keys[i] = (*scratchBuf)[startLen:]
 		}
 	}
 
 	handler(workerID, keys, offset, 0)
-
-	// Clear currentRowValues slots
-	for k := 0; k < len(currentRowValues); k++ {
-		currentRowValues[k] = nil
-	}
 }
 
 // GetStats returns scanning statistics
@@ -530,7 +482,11 @@ func (scanner *Scanner) GetStats() (rowsScanned int64, bytesRead int64, elapsed
 
 // Close releases resources
 func (scanner *Scanner) Close() error {
-	return common.MunmapFile(scanner.data)
+	err := common.MunmapFile(scanner.data)
+	if scanner.rendered != "" {
+		_ = os.Remove(scanner.rendered)
+	}
+	return err
 }
 
 // ScanProgress returns a human-readable progress string
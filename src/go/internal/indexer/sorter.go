@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
 
 	"github.com/pierrec/lz4/v4"
 )
@@ -33,14 +36,17 @@ var (
 // Sorter handles external merge sort for large datasets
 type Sorter struct {
 	Name          string
-	outputPath    string
+	outputPath    string          // Local path of the output (tests, logs)
+	output        storage.Backend // Where the output index is written
+	outputName    string
 	tempDir       string
 	chunkSize     int // Max records per chunk
 	chunkFiles    []string
 	totalRecords  int64
 	bytesWritten  int64
 	mergedRecords int64
-	state         int32 // Atomic state
+	keys          common.KeyStats // Of the output, collected by the final merge
+	state         int32           // Atomic state
 
 	// Buffer for current chunk
 	memBuffer []common.IndexRecord
@@ -50,6 +56,26 @@ type Sorter struct {
 
 	// Bloom Filter (Concurrent Building)
 	bloom *common.BloomFilter
+
+	// Zone map column for the output blocks (optional)
+	zoneColumn string
+	zone       common.ZoneFunc
+
+	// Block compression codec of the output index ("" = lz4)
+	codec string
+
+	// Part files of the output index (0 or 1 = unpartitioned)
+	partitions int
+
+	// Concurrent intermediate merges in Finalize (see kWayMerge)
+	mergeWorkers int
+	runFiles     []string
+
+	// Shared sort budget (nil = fixed chunkSize, see SetMemoryArbiter)
+	arbiter  *memoryArbiter
+	baseSize int   // Guaranteed records per chunk
+	borrowed int64 // Bytes borrowed beyond baseSize
+	reserved bool
 }
 
 // NewSorter creates a new external sorter
@@ -77,6 +103,8 @@ func NewSorter(name, outputPath, tempDir string, memoryLimit int, bloom *common.
 	return &Sorter{
 		Name:       name,
 		outputPath: outputPath,
+		output:     storage.NewLocal(filepath.Dir(outputPath)),
+		outputName: filepath.Base(outputPath),
 		tempDir:    tempDir,
 		chunkSize:  chunkSize,
 		memBuffer:  make([]common.IndexRecord, 0, chunkSize),
@@ -84,19 +112,138 @@ func NewSorter(name, outputPath, tempDir string, memoryLimit int, bloom *common.
 	}
 }
 
+// SetZoneMap makes the output index record per-block numeric min/max of
+// column (see common.BlockWriter.SetZoneMap).
+func (sorter *Sorter) SetZoneMap(column string, fn common.ZoneFunc) {
+	sorter.zoneColumn = column
+	sorter.zone = fn
+}
+
+// SetOutput writes the output index to a storage backend instead of the
+// local outputPath.
+func (sorter *Sorter) SetOutput(store storage.Backend, name string) {
+	sorter.output = store
+	sorter.outputName = name
+	sorter.outputPath = strings.TrimSuffix(store.String(), "/") + "/" + name
+}
+
+// SetCodec selects the block compression of the output index.
+func (sorter *Sorter) SetCodec(name string) {
+	sorter.codec = name
+}
+
+// SetPartitions splits the output index over n part files of about equal
+// record counts (see common.SparseIndex.Parts).
+func (sorter *Sorter) SetPartitions(n int) {
+	sorter.partitions = n
+}
+
+// SetMergeWorkers bounds how many groups of spill chunks Finalize merges
+// concurrently (1 = a single k-way merge).
+func (sorter *Sorter) SetMergeWorkers(n int) {
+	sorter.mergeWorkers = n
+}
+
+// KeyStats returns the key statistics of the output. Valid after Finalize.
+func (sorter *Sorter) KeyStats() common.KeyStats {
+	return sorter.keys
+}
+
+// Resume adopts spill chunks written by an interrupted build (see
+// checkpoint.go), as if their records had been added to this sorter.
+func (sorter *Sorter) Resume(chunks []string, distincts []int64, records int64) {
+	sorter.chunkFiles = append(sorter.chunkFiles, chunks...)
+	sorter.chunkDistincts = append(sorter.chunkDistincts, distincts...)
+	atomic.AddInt64(&sorter.totalRecords, records)
+	atomic.AddInt64(&sorter.bytesWritten, records*common.RecordSize)
+}
+
+// SetMemoryArbiter makes the sorter draw its chunk buffer from a budget
+// shared with other sorters. The memoryLimit passed to NewSorter becomes
+// the guaranteed share; a full buffer borrows more from the arbiter before
+// spilling, and hands it back after the spill.
+func (sorter *Sorter) SetMemoryArbiter(arbiter *memoryArbiter) {
+	sorter.arbiter = arbiter
+	sorter.baseSize = sorter.chunkSize
+	arbiter.reserve(int64(sorter.baseSize) * bytesPerRecord)
+	sorter.reserved = true
+}
+
 // Add adds a record to the sorter
 // When buffer is full, it's sorted and written to a temp file
 func (sorter *Sorter) Add(record common.IndexRecord) error {
 	sorter.memBuffer = append(sorter.memBuffer, record)
 	atomic.AddInt64(&sorter.totalRecords, 1)
 
-	// Flush chunk when full
-	if len(sorter.memBuffer) >= sorter.chunkSize {
+	// Flush chunk when full (unless the shared budget lets it grow)
+	if len(sorter.memBuffer) >= sorter.chunkSize && !sorter.grow() {
 		return sorter.flushChunk()
 	}
 	return nil
 }
 
+// grow borrows budget to enlarge the chunk buffer by half, or by half the
+// guaranteed share if that much is not free. Geometric steps keep the
+// number of buffer copies logarithmic.
+func (sorter *Sorter) grow() bool {
+	if sorter.arbiter == nil {
+		return false
+	}
+	for _, step := range []int{sorter.chunkSize / 2, sorter.baseSize / 2} {
+		n := int64(step) * bytesPerRecord
+		if step > 0 && sorter.arbiter.tryAcquire(n) {
+			sorter.borrowed += n
+			sorter.chunkSize += step
+			sorter.memBuffer = slices.Grow(sorter.memBuffer, sorter.chunkSize-len(sorter.memBuffer))
+			return true
+		}
+	}
+	return false
+}
+
+// returnBorrowed gives the budget borrowed by grow back to the arbiter and
+// shrinks the (empty) chunk buffer to the guaranteed share.
+func (sorter *Sorter) returnBorrowed() {
+	if sorter.borrowed == 0 {
+		return
+	}
+	sorter.arbiter.release(sorter.borrowed)
+	sorter.borrowed = 0
+	sorter.chunkSize = sorter.baseSize
+	sorter.memBuffer = make([]common.IndexRecord, 0, sorter.baseSize)
+}
+
+// releaseMemory returns the sorter's whole share once nothing more will be
+// buffered. Safe to call more than once.
+func (sorter *Sorter) releaseMemory() {
+	sorter.memBuffer = nil
+	if sorter.arbiter == nil {
+		return
+	}
+	sorter.arbiter.release(sorter.borrowed)
+	sorter.borrowed = 0
+	if sorter.reserved {
+		sorter.arbiter.release(int64(sorter.baseSize) * bytesPerRecord)
+		sorter.reserved = false
+	}
+}
+
+// compareRecords orders records by key, then offset (see recordLess).
+func compareRecords(a, b common.IndexRecord) int {
+	cmp := bytes.Compare(a.Key[:], b.Key[:])
+	if cmp != 0 {
+		return cmp
+	}
+	// Tie-breaker: Offset
+	if a.Offset < b.Offset {
+		return -1
+	}
+	if a.Offset > b.Offset {
+		return 1
+	}
+	return 0
+}
+
 // flushChunk sorts the current buffer and writes to a temp file
 func (sorter *Sorter) flushChunk() error {
 	if len(sorter.memBuffer) == 0 {
@@ -104,20 +251,7 @@ func (sorter *Sorter) flushChunk() error {
 	}
 
 	// Sort by key, then offset (Zero Allocation)
-	slices.SortFunc(sorter.memBuffer, func(a, b common.IndexRecord) int {
-		cmp := bytes.Compare(a.Key[:], b.Key[:])
-		if cmp != 0 {
-			return cmp
-		}
-		// Tie-breaker: Offset
-		if a.Offset < b.Offset {
-			return -1
-		}
-		if a.Offset > b.Offset {
-			return 1
-		}
-		return 0
-	})
+	slices.SortFunc(sorter.memBuffer, compareRecords)
 
 	// Write to temp file
 	chunkPath := filepath.Join(sorter.tempDir, fmt.Sprintf("chunk_%d.tmp", len(sorter.chunkFiles)))
@@ -174,6 +308,7 @@ func (sorter *Sorter) flushChunk() error {
 	sorter.chunkFiles = append(sorter.chunkFiles, chunkPath)
 	sorter.chunkDistincts = append(sorter.chunkDistincts, distinctCount)
 	sorter.memBuffer = sorter.memBuffer[:0] // Clear buffer
+	sorter.returnBorrowed()
 
 	return nil
 }
@@ -185,6 +320,8 @@ func (sorter *Sorter) Finalize() (int64, error) {
 	if err := sorter.flushChunk(); err != nil {
 		return 0, err
 	}
+	// The merge streams: let sorters still buffering use our share
+	sorter.releaseMemory()
 
 	// Transition to Merging
 	atomic.StoreInt32(&sorter.state, int32(StateMerging))
@@ -192,11 +329,9 @@ func (sorter *Sorter) Finalize() (int64, error) {
 	// ALWAYS perform k-way merge to ensure output is compressed (even if 1 chunk)
 	if len(sorter.chunkFiles) == 0 {
 		// Empty file
-		f, err := os.Create(sorter.outputPath)
-		if err != nil {
+		if err := storage.WriteFile(sorter.output, sorter.outputName, nil); err != nil {
 			return 0, err
 		}
-		_ = f.Close()
 		atomic.StoreInt32(&sorter.state, int32(StateDone))
 		return 0, nil
 	}
@@ -279,90 +414,66 @@ func (m mergeItem) Less(other mergeItem) bool {
 	return m.record.Offset < other.record.Offset
 }
 
-// kWayMerge performs k-way merge of sorted chunk files
-func (sorter *Sorter) kWayMerge() (int64, error) {
-	chunkCount := len(sorter.chunkFiles)
-
-	// Open all chunk files
-	readers := make([]*bufio.Reader, chunkCount) // Changed to bufio.Reader
-	files := make([]*os.File, chunkCount)
+// Parallel merge tuning: below parallelMergeMinChunks spill chunks a single
+// merge is fast enough; an intermediate merge reads at most maxMergeFanIn.
+const (
+	parallelMergeMinChunks = 32
+	maxMergeFanIn          = 128
+)
 
-	for i, path := range sorter.chunkFiles {
-		chunkFile, err := os.Open(path)
+// kWayMerge performs k-way merge of sorted chunk files. With many chunks
+// and more than one merge worker, groups of chunks are first merged
+// concurrently into intermediate runs, so the final merge reads few runs.
+func (sorter *Sorter) kWayMerge() (int64, error) {
+	runs := sorter.chunkFiles
+	if len(runs) >= parallelMergeMinChunks && sorter.mergeWorkers > 1 {
+		merged, err := sorter.premergeRuns(runs)
 		if err != nil {
-			return 0, fmt.Errorf("failed to open chunk %d: %w", i, err)
+			return 0, err
 		}
-		files[i] = chunkFile
-		// Temp files are now LZ4 compressed
-		// lz4.NewReader wraps the file directly
-		// BUFFERING IS CRITICAL: We read small records.
-		lzReader := lz4.NewReader(chunkFile)
-
-		// Get reader from pool
-		bufReader := bufReaderPool.Get().(*bufio.Reader)
-		bufReader.Reset(lzReader)
-		readers[i] = bufReader
+		runs = merged
 	}
 
-	// cleanup readers (return to pool)
-	defer func() {
-		for _, r := range readers {
-			if r != nil {
-				r.Reset(nil)
-				bufReaderPool.Put(r)
-			}
-		}
-	}()
-
-	// Close all files on exit
-	defer func() {
-		for _, outputFile := range files {
-			if outputFile != nil {
-				_ = outputFile.Close()
-			}
-		}
-	}()
+	readers, closeRuns, err := openRuns(runs)
+	if err != nil {
+		return 0, err
+	}
+	defer closeRuns()
 
-	// Create output file
-	outFile, err := os.Create(sorter.outputPath)
+	// Create output file (replaces the previous index on Commit only)
+	outFile, err := sorter.output.Create(sorter.outputName)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create output file: %w", err)
 	}
-	defer func() { _ = outFile.Close() }()
+	committed := false
+	defer func() {
+		if !committed {
+			outFile.Abort()
+		}
+	}()
 
 	// Use BlockWriter for compressed output
 	writer, err := common.NewBlockWriter(outFile)
 	if err != nil {
 		return 0, err
 	}
-
-	// Initialize heap with first record from each chunk
-	mergeHeap := make(manualHeap, 0, chunkCount)
-
-	for i := 0; i < chunkCount; i++ {
-		rec, err := common.ReadRecord(readers[i])
-		if err == nil {
-			mergeHeap = append(mergeHeap, mergeItem{record: rec, source: i})
-		}
+	if sorter.zone != nil {
+		writer.SetZoneMap(sorter.zoneColumn, sorter.zone)
 	}
-	// Init heap (floyd's algorithm or just manual push... manual push is slower for init but K is small)
-	// We just appended, now simplify heapify
-	// Go's heap.Init is O(n). We can just do that manually:
-	n := len(mergeHeap)
-	for i := n/2 - 1; i >= 0; i-- {
-		mergeHeap.down(i, n)
+	codec, err := common.NewCodec(sorter.codec)
+	if err != nil {
+		return 0, err
 	}
+	writer.SetCodec(codec)
+	parts := newPartFiles(writer, sorter.output, sorter.outputName, sorter.partitions, atomic.LoadInt64(&sorter.totalRecords))
+	defer parts.abort()
 
 	var distinctCount int64 = 0
 	var lastKey [64]byte
 	var firstRecord = true
+	sorter.keys = common.KeyStats{}
 
-	// Merge phase
-	for len(mergeHeap) > 0 {
-		// Pop smallest
-		heapItem := mergeHeap.Pop()
-		rec := heapItem.record
-
+	err = mergeRecords(readers, func(rec *common.IndexRecord) error {
 		// Check distinct
 		if firstRecord || rec.Key != lastKey {
 			distinctCount++
@@ -371,7 +482,7 @@ func (sorter *Sorter) kWayMerge() (int64, error) {
 			if sorter.bloom != nil {
 				// We need string key for Bloom.
 				// Trim nulls
-				keyStr := string(bytes.TrimRight(rec.Key[:], "\x00"))
+				keyStr := common.KeyString(&rec.Key)
 				sorter.bloom.Add(keyStr)
 			}
 
@@ -379,33 +490,254 @@ func (sorter *Sorter) kWayMerge() (int64, error) {
 			firstRecord = false
 		}
 
+		sorter.keys.Add(rec)
+
 		// Write to output using BlockWriter (Write ALL records)
-		if err := writer.WriteRecord(rec); err != nil {
-			return 0, err
+		if err := writer.WriteRecord(*rec); err != nil {
+			return err
 		}
 		atomic.AddInt64(&sorter.mergedRecords, 1)
-
-		// Read next from same source
-		nextRec, err := common.ReadRecord(readers[heapItem.source])
-		if err == nil {
-			mergeHeap.Push(mergeItem{record: nextRec, source: heapItem.source})
-		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	// Finalize block writer
 	if err := writer.Close(); err != nil {
 		return 0, err
 	}
+	if err := parts.commit(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", sorter.outputPath, err)
+	}
+	committed = true
+	if err := outFile.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", sorter.outputPath, err)
+	}
+	parts.keep()
 
 	return distinctCount, nil
 }
 
+// partFiles are the part files a partitioned index is written to. They are
+// committed before the .cidx that lists them, and removed again unless
+// that succeeds too (keep).
+type partFiles struct {
+	store     storage.Backend
+	names     []string
+	writers   []storage.Writer // Not yet committed
+	committed int
+	kept      bool
+}
+
+// newPartFiles makes writer split its blocks over n part files of name in
+// store, with about records/n records each. n < 2 leaves it unpartitioned.
+func newPartFiles(writer *common.BlockWriter, store storage.Backend, name string, n int, records int64) *partFiles {
+	parts := &partFiles{store: store}
+	if n < 2 || records == 0 {
+		return parts
+	}
+	writer.SetPartitions((records+int64(n)-1)/int64(n), func(part int) (io.Writer, string, error) {
+		partName := common.PartFileName(name, part)
+		w, err := store.Create(partName)
+		if err != nil {
+			return nil, "", err
+		}
+		parts.names = append(parts.names, partName)
+		parts.writers = append(parts.writers, w)
+		return w, partName, nil
+	})
+	return parts
+}
+
+// commit publishes the part files written so far.
+func (parts *partFiles) commit() error {
+	for len(parts.writers) > 0 {
+		w := parts.writers[0]
+		parts.writers = parts.writers[1:]
+		if err := w.Commit(); err != nil {
+			return err
+		}
+		parts.committed++
+	}
+	return nil
+}
+
+// keep marks the part files as referenced by a committed .cidx.
+func (parts *partFiles) keep() {
+	parts.kept = true
+}
+
+// abort discards the part files, unless kept.
+func (parts *partFiles) abort() {
+	for _, w := range parts.writers {
+		w.Abort()
+	}
+	parts.writers = nil
+	if !parts.kept {
+		for _, name := range parts.names[:parts.committed] {
+			_ = parts.store.Remove(name)
+		}
+	}
+}
+
+// premergeRuns merges groups of chunks into intermediate runs, at most
+// mergeWorkers at a time, and returns the run files. Each group's chunks
+// are deleted as soon as its run is written.
+func (sorter *Sorter) premergeRuns(chunks []string) ([]string, error) {
+	groups := sorter.mergeWorkers
+	if minGroups := (len(chunks) + maxMergeFanIn - 1) / maxMergeFanIn; groups < minGroups {
+		groups = minGroups
+	}
+	size := (len(chunks) + groups - 1) / groups
+
+	var runs []string
+	for start := 0; start < len(chunks); start += size {
+		runs = append(runs, filepath.Join(sorter.tempDir, fmt.Sprintf("run_%d.tmp", len(runs))))
+	}
+	sorter.runFiles = runs
+
+	sem := make(chan struct{}, sorter.mergeWorkers)
+	errs := make(chan error, len(runs))
+	var wg sync.WaitGroup
+	for i := range runs {
+		group := chunks[i*size : min((i+1)*size, len(chunks))]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group []string, runPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := mergeToRun(group, runPath); err != nil {
+				errs <- err
+				return
+			}
+			for _, path := range group {
+				_ = os.Remove(path)
+			}
+		}(group, runs[i])
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// mergeToRun merges sorted chunk files into one run in the chunk format.
+func mergeToRun(chunks []string, runPath string) error {
+	readers, closeRuns, err := openRuns(chunks)
+	if err != nil {
+		return err
+	}
+	defer closeRuns()
+
+	file, err := os.Create(runPath)
+	if err != nil {
+		return fmt.Errorf("failed to create merge run: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	lzWriter := lz4.NewWriter(file)
+	bufferedWriter := bufWriterPool.Get().(*bufio.Writer)
+	bufferedWriter.Reset(lzWriter)
+	defer func() {
+		bufferedWriter.Reset(nil) // Release reference
+		bufWriterPool.Put(bufferedWriter)
+	}()
+
+	err = mergeRecords(readers, func(rec *common.IndexRecord) error {
+		return common.WriteRecord(bufferedWriter, *rec)
+	})
+	if err != nil {
+		return err
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return err
+	}
+	if err := lzWriter.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// openRuns opens LZ4-compressed chunk or run files for merging. The
+// returned function closes them and returns the buffers to the pool.
+func openRuns(paths []string) ([]*bufio.Reader, func(), error) {
+	readers := make([]*bufio.Reader, 0, len(paths))
+	files := make([]*os.File, 0, len(paths))
+	closeRuns := func() {
+		for _, r := range readers {
+			r.Reset(nil)
+			bufReaderPool.Put(r)
+		}
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+
+	for i, path := range paths {
+		chunkFile, err := os.Open(path)
+		if err != nil {
+			closeRuns()
+			return nil, nil, fmt.Errorf("failed to open chunk %d: %w", i, err)
+		}
+		files = append(files, chunkFile)
+		// Temp files are LZ4 compressed
+		// BUFFERING IS CRITICAL: We read small records.
+		bufReader := bufReaderPool.Get().(*bufio.Reader)
+		bufReader.Reset(lz4.NewReader(chunkFile))
+		readers = append(readers, bufReader)
+	}
+	return readers, closeRuns, nil
+}
+
+// mergeRecords calls emit for every record of the sorted readers, in
+// (key, offset) order.
+func mergeRecords(readers []*bufio.Reader, emit func(rec *common.IndexRecord) error) error {
+	// Initialize heap with first record from each chunk
+	mergeHeap := make(manualHeap, 0, len(readers))
+
+	for i := range readers {
+		rec, err := common.ReadRecord(readers[i])
+		if err == nil {
+			mergeHeap = append(mergeHeap, mergeItem{record: rec, source: i})
+		}
+	}
+	// Heapify in O(n)
+	n := len(mergeHeap)
+	for i := n/2 - 1; i >= 0; i-- {
+		mergeHeap.down(i, n)
+	}
+
+	// Merge phase
+	for len(mergeHeap) > 0 {
+		// Pop smallest
+		heapItem := mergeHeap.Pop()
+		if err := emit(&heapItem.record); err != nil {
+			return err
+		}
+
+		// Read next from same source
+		nextRec, err := common.ReadRecord(readers[heapItem.source])
+		if err == nil {
+			mergeHeap.Push(mergeItem{record: nextRec, source: heapItem.source})
+		}
+	}
+	return nil
+}
+
 // Cleanup removes temporary files
 func (sorter *Sorter) Cleanup() {
+	sorter.releaseMemory()
 	for _, path := range sorter.chunkFiles {
 		_ = os.Remove(path)
 	}
+	for _, path := range sorter.runFiles {
+		_ = os.Remove(path)
+	}
 	sorter.chunkFiles = nil
+	sorter.runFiles = nil
 }
 
 // State constants
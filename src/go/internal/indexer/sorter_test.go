@@ -0,0 +1,120 @@
+package indexer
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+func TestParallelMerge(t *testing.T) {
+	const records = 100_000
+	rng := rand.New(rand.NewSource(1))
+	keys := make([]int, records)
+	distinct := make(map[int]bool)
+	for i := range keys {
+		keys[i] = rng.Intn(records / 4)
+		distinct[keys[i]] = true
+	}
+
+	build := func(workers int) (string, int64) {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out.cidx")
+		sorter := NewSorter("test", out, dir, 0, nil) // Minimum chunk size: many spill chunks
+		sorter.SetMergeWorkers(workers)
+		defer sorter.Cleanup()
+
+		for i, k := range keys {
+			var rec common.IndexRecord
+			copy(rec.Key[:], fmt.Sprintf("key_%06d", k))
+			rec.Offset = int64(i)
+			rec.Line = int64(i + 2)
+			if err := sorter.Add(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if chunks := len(sorter.chunkFiles); workers > 1 && chunks < parallelMergeMinChunks {
+			t.Fatalf("Only %d chunks; the parallel merge would not run", chunks)
+		}
+		count, err := sorter.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "chunk_*.tmp")); workers > 1 && len(left) != 0 {
+			t.Errorf("%d chunks left after the intermediate merges", len(left))
+		}
+		return out, count
+	}
+
+	serialPath, serialCount := build(1)
+	parallelPath, parallelCount := build(4)
+
+	if serialCount != int64(len(distinct)) || parallelCount != serialCount {
+		t.Errorf("Distinct counts: serial %d, parallel %d, expected %d", serialCount, parallelCount, len(distinct))
+	}
+	serial, err := os.ReadFile(serialPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parallel, err := os.ReadFile(parallelPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(serial) != string(parallel) {
+		t.Error("Parallel merge output differs from the single k-way merge")
+	}
+	verifyIndex(t, parallelPath, records, false)
+}
+
+func TestMemoryArbiter(t *testing.T) {
+	const base = 1000 * bytesPerRecord // NewSorter's minimum chunk
+	arbiter := newMemoryArbiter(8 * base)
+
+	newSorter := func(name string) *Sorter {
+		dir := t.TempDir()
+		sorter := NewSorter(name, filepath.Join(dir, "out.cidx"), dir, base, nil)
+		sorter.SetMemoryArbiter(arbiter)
+		t.Cleanup(sorter.Cleanup)
+		return sorter
+	}
+	add := func(sorter *Sorter, n int) {
+		for i := 0; i < n; i++ {
+			var rec common.IndexRecord
+			copy(rec.Key[:], fmt.Sprintf("key_%06d", i%100))
+			rec.Offset = int64(i)
+			if err := sorter.Add(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// An idle sorter cedes its unused budget to a busy one
+	busy, idle := newSorter("busy"), newSorter("idle")
+	add(idle, 10)
+	add(busy, 5000)
+	if len(busy.chunkFiles) != 0 {
+		t.Fatalf("Busy sorter spilled %d chunks with budget to spare", len(busy.chunkFiles))
+	}
+
+	// Once the budget is exhausted it spills, and returns what it borrowed
+	add(busy, 5000)
+	if len(busy.chunkFiles) == 0 {
+		t.Fatal("Busy sorter never spilled past the budget")
+	}
+	if used, _, total := arbiter.stats(); used > total {
+		t.Errorf("Arbiter overcommitted: %d of %d bytes granted", used, total)
+	}
+
+	for _, sorter := range []*Sorter{busy, idle} {
+		if _, err := sorter.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	verifyIndex(t, busy.outputPath, 10000, false)
+	if used, peak, _ := arbiter.stats(); used != 0 || peak <= 2*base {
+		t.Errorf("After Finalize: %d bytes still granted, peak %d", used, peak)
+	}
+}
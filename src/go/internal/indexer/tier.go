@@ -0,0 +1,200 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// TierStats describes an index after TierIndex.
+type TierStats struct {
+	HotBlocks  int
+	HotBytes   int64
+	ColdBlocks int
+	ColdBytes  int64
+	ColdFile   string // Location of the cold blocks ("" = none)
+}
+
+// TierIndex splits an index between fast and slow storage. Blocks whose
+// keys all sort before hotFrom move to a cold file in coldLocation (a
+// directory or s3:// URL); the footer, the bloom filter and the other
+// blocks stay in the .cidx, whose footer records where each block is.
+// Blocks are copied compressed, as they are. Rerunning it re-tiers an
+// already tiered index; an empty hotFrom moves every block back.
+func TierIndex(store storage.Backend, name, coldLocation, hotFrom string) (TierStats, error) {
+	var stats TierStats
+	br, err := common.OpenBlockReader(store, name)
+	if err != nil {
+		return stats, err
+	}
+	defer br.Cleanup()
+	if len(br.Footer.Parts) > 0 {
+		return stats, fmt.Errorf("%s is partitioned; tiering needs an unpartitioned index", name)
+	}
+	if !br.Footer.ZoneMaps && hotFrom != "" {
+		return stats, fmt.Errorf("%s has no block end keys; rebuild it before tiering", name)
+	}
+
+	footer := br.Footer
+	blocks := make([]common.BlockMeta, br.Footer.Blocks.Len())
+	footer.ColdStore, footer.ColdFile = "", ""
+	oldStore, oldFile := br.Footer.ColdStore, br.Footer.ColdFile
+
+	var cold storage.Backend
+	var coldW storage.Writer
+	coldPos := int64(len(common.MagicCold))
+	defer func() {
+		if coldW != nil {
+			coldW.Abort()
+		}
+	}()
+
+	hot, err := store.Create(name)
+	if err != nil {
+		return stats, err
+	}
+	committed := false
+	defer func() {
+		if !committed && hot != nil {
+			hot.Abort()
+		}
+	}()
+	if _, err := hot.Write([]byte(common.MagicCIDX2)); err != nil {
+		return stats, err
+	}
+	hotPos := int64(len(common.MagicCIDX2))
+
+	for i, meta := range br.Footer.Blocks.All() {
+		raw, err := br.RawBlock(meta)
+		if err != nil {
+			return stats, err
+		}
+		meta.Cold = hotFrom != "" && meta.EndKey < hotFrom
+		if meta.Cold {
+			if coldW == nil {
+				if coldLocation == "" {
+					return stats, fmt.Errorf("blocks before %q need a cold storage location", hotFrom)
+				}
+				if !storage.IsRemote(coldLocation) {
+					// Queries may run from another directory
+					if coldLocation, err = filepath.Abs(coldLocation); err != nil {
+						return stats, err
+					}
+				}
+				if cold, err = storage.Open(coldLocation); err != nil {
+					return stats, err
+				}
+				// A new name each time, so the current cold file stays
+				// readable until the new footer replaces the old one
+				footer.ColdStore = coldLocation
+				footer.ColdFile = name + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + ".cold"
+				if coldW, err = cold.Create(footer.ColdFile); err != nil {
+					return stats, err
+				}
+				if _, err := coldW.Write([]byte(common.MagicCold)); err != nil {
+					return stats, err
+				}
+			}
+			if _, err := coldW.Write(raw); err != nil {
+				return stats, err
+			}
+			meta.Offset = coldPos
+			coldPos += meta.Length
+			stats.ColdBlocks++
+			stats.ColdBytes += meta.Length
+		} else {
+			if _, err := hot.Write(raw); err != nil {
+				return stats, err
+			}
+			meta.Offset = hotPos
+			hotPos += meta.Length
+			stats.HotBlocks++
+			stats.HotBytes += meta.Length
+		}
+		blocks[i] = meta
+	}
+	footer.Blocks = common.NewBlockList(blocks)
+
+	if coldW != nil {
+		err := coldW.Commit()
+		coldW = nil
+		if err != nil {
+			return stats, fmt.Errorf("failed to write cold blocks: %w", err)
+		}
+		defer func() {
+			if !committed {
+				_ = cold.Remove(footer.ColdFile) // Unreferenced
+			}
+		}()
+	}
+	if err := common.WriteFooter(hot, footer); err != nil {
+		return stats, err
+	}
+	if err := hot.Commit(); err != nil {
+		hot = nil
+		return stats, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	committed = true
+
+	if oldFile != "" {
+		if old, err := storage.Open(oldStore); err == nil {
+			_ = old.Remove(oldFile)
+		}
+	}
+	if footer.ColdFile != "" {
+		stats.ColdFile = strings.TrimSuffix(footer.ColdStore, "/") + "/" + footer.ColdFile
+	}
+	return stats, nil
+}
+
+// ResolveIndexFile returns the .cidx file of an index of csvPath in store
+// (see IndexFiles).
+func ResolveIndexFile(store storage.Backend, csvPath, name string) (string, error) {
+	files, err := IndexFiles(store, csvPath)
+	if err != nil {
+		return "", err
+	}
+	if file, ok := files[strings.ToLower(name)]; ok {
+		return file, nil
+	}
+	return "", fmt.Errorf("no index %q for %s in %s", name, filepath.Base(csvPath), store)
+}
+
+// IndexFiles maps the index names of csvPath to their .cidx files in store:
+// the manifest in the index metadata, or for metadata without one the
+// listed files named after the index.
+func IndexFiles(store storage.Backend, csvPath string) (map[string]string, error) {
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	if data, err := storage.ReadFile(store, csvName+"_meta.json"); err == nil {
+		var meta common.IndexMeta
+		if json.Unmarshal(data, &meta) == nil && len(meta.Indexes) > 0 {
+			files := make(map[string]string, len(meta.Indexes))
+			for name, stats := range meta.Indexes {
+				if stats.File == "" {
+					files = nil
+					break
+				}
+				files[name] = stats.File
+			}
+			if files != nil {
+				return files, nil
+			}
+		}
+	}
+	listed, err := store.List(csvName + "_*.cidx")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(listed))
+	for _, file := range listed {
+		name := strings.TrimSuffix(strings.TrimPrefix(file, csvName+"_"), ".cidx")
+		files[strings.ToLower(name)] = file
+	}
+	return files, nil
+}
@@ -0,0 +1,176 @@
+package indexer
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// TranslateIndexes carries the indexes of csvPath in outputDir over to
+// newPath, a rewrite of the CSV about to replace it that keeps its rows in
+// order with their indexed values, at other offsets: translate maps the
+// offset of each row to its offset in newPath, keeping their order, so no
+// index needs sorting again. Keys, key counts and bloom filters carry over;
+// zone maps of a zone column are read again from newPath, and a row store
+// is written again. The indexes are published as a new generation with
+// the DNA of newPath through publish, which is to move newPath in place of
+// the CSV before it saves the metadata. It returns the translated indexes.
+//
+// The indexes must cover the CSV as it is (no rows appended since they
+// were built) in a local directory.
+func TranslateIndexes(csvPath, newPath, outputDir string, translate func(offset int64) int64, publish func(save func() error) error) ([]string, error) {
+	if storage.IsRemote(outputDir) {
+		return nil, fmt.Errorf("requires a local index directory, not %s", outputDir)
+	}
+	indexer := NewIndexer(IndexerConfig{InputFile: csvPath, OutputDir: outputDir, Output: io.Discard})
+	indexer.store = storage.NewLocal(outputDir)
+	prev := indexer.previousMeta()
+	if len(prev.Indexes) == 0 && prev.RowStore == "" {
+		return nil, fmt.Errorf("requires existing index metadata")
+	}
+	if prev.Format != "" {
+		return nil, fmt.Errorf("%s input is indexed from its row store", prev.Format)
+	}
+	current, err := indexer.calculateFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	if current.size != prev.CsvSize || current.hash != prev.CsvHash {
+		return nil, fmt.Errorf("the indexes do not cover the CSV as it is; rebuild them")
+	}
+
+	indexer.scanner, err = NewScanner(newPath, prev.Separator)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = indexer.scanner.Close() }()
+	s, err := schema.Load(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := indexer.scanner.AddSchema(s); err != nil {
+		return nil, err
+	}
+	indexer.generation = prev.Generation + 1
+	indexer.meta = prev
+	indexer.meta.Indexes = make(map[string]common.IndexStats, len(prev.Indexes))
+	indexer.meta.Retired = nil
+
+	names := slices.Sorted(maps.Keys(prev.Indexes))
+	for _, name := range names {
+		stats := prev.Indexes[name]
+		if stats.File == "" {
+			return nil, fmt.Errorf("index %s predates the index manifest; rebuild it", name)
+		}
+		file := indexer.indexFile(name)
+		if err := indexer.translateIndex(stats, file, translate); err != nil {
+			return nil, fmt.Errorf("index %s: %w", name, err)
+		}
+		if stats.FileSize, err = indexSize(indexer.store, file); err != nil {
+			return nil, err
+		}
+		stats.File = file
+		indexer.meta.Indexes[name] = stats
+	}
+	if prev.RowStore != "" {
+		indexer.config.Codec = ""
+		if err := indexer.writeRowStore(); err != nil {
+			return nil, fmt.Errorf("row store: %w", err)
+		}
+	}
+
+	// The new file keeps its mtime when it is renamed over the CSV
+	indexer.config.InputFile = newPath
+	dna, err := indexer.calculateFingerprint()
+	indexer.config.InputFile = csvPath
+	if err != nil {
+		return nil, err
+	}
+	indexer.meta.CsvSize, indexer.meta.CsvMtime, indexer.meta.CsvHash = dna.size, dna.mtime, dna.hash
+	return names, publish(indexer.saveMeta)
+}
+
+// translateIndex writes the index of stats to file with translated offsets,
+// in the codec and partitions it has, and copies its bloom filter.
+func (indexer *Indexer) translateIndex(stats common.IndexStats, file string, translate func(int64) int64) error {
+	info, err := indexer.store.Stat(stats.File)
+	if err != nil {
+		return err
+	}
+	if info.Size == 0 { // Empty index: no footer
+		return storage.WriteFile(indexer.store, file, nil)
+	}
+	br, err := common.OpenBlockReader(indexer.store, stats.File)
+	if err != nil {
+		return err
+	}
+	defer br.Cleanup()
+	codec, err := common.NewCodec(br.Footer.Codec)
+	if err != nil {
+		return err
+	}
+
+	w, err := indexer.store.Create(file)
+	if err != nil {
+		return err
+	}
+	defer w.Abort() // No-op after Commit
+	writer, err := common.NewBlockWriter(w)
+	if err != nil {
+		return err
+	}
+	writer.SetCodec(codec)
+	if zoneColumn := br.Footer.ZoneColumn; zoneColumn != "" {
+		if len(stats.Columns) == 1 && strings.EqualFold(stats.Columns[0], zoneColumn) {
+			writer.SetZoneMap(zoneColumn, func(rec *common.IndexRecord) string {
+				return common.DecodeKey(common.KeyString(&rec.Key))
+			})
+		} else if col, ok := indexer.scanner.GetColumnIndex(zoneColumn); ok {
+			writer.SetZoneMap(zoneColumn, func(rec *common.IndexRecord) string {
+				return indexer.scanner.FieldAt(rec.Offset, col)
+			})
+		}
+	}
+	var records int64
+	for _, meta := range br.Footer.Blocks.All() {
+		records += meta.RecordCount
+	}
+	parts := newPartFiles(writer, indexer.store, file, stats.Partitions, records)
+	defer parts.abort()
+
+	stream := &recordStream{br: br}
+	for {
+		rec, ok, err := stream.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		rec.Offset = translate(rec.Offset)
+		if err := writer.WriteRecord(rec); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := parts.commit(); err != nil {
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	parts.keep()
+
+	if bloom, err := storage.ReadFile(indexer.store, stats.File+".bloom"); err == nil {
+		return storage.WriteFile(indexer.store, file+".bloom", bloom)
+	}
+	return nil
+}
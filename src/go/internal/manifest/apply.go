@@ -0,0 +1,109 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Options are the build settings Apply runs the indexer with.
+type Options struct {
+	Workers  int
+	MemoryMB int
+	Version  string
+	Output   io.Writer // Indexer output
+}
+
+// defaultSample is how many rows analyze samples unless the schema says.
+const defaultSample = 100000
+
+// Apply makes the dataset what its plan says: the schema first, then the
+// dropped indexes, then one build of every index to (re)build.
+func (p *Plan) Apply(opts Options) error {
+	ds := p.Dataset
+	if len(p.SetVirtual) > 0 || len(p.RemoveVirtual) > 0 || p.Analyze || len(p.Types) > 0 {
+		s, err := schema.Load(ds.CSV)
+		if err != nil {
+			return fmt.Errorf("failed to load schema: %w", err)
+		}
+		for col, def := range p.SetVirtual {
+			s.AddVirtualColumn(col, def)
+		}
+		for _, col := range p.RemoveVirtual {
+			s.RemoveVirtualColumn(col)
+		}
+		if p.Analyze {
+			sample := ds.Schema.Sample
+			if sample <= 0 {
+				sample = defaultSample
+			}
+			sep, _ := common.ParseSeparator(ds.Separator) // Checked by Load
+			columns, analysis, err := schema.Infer(ds.CSV, rune(sep), sample)
+			if err != nil {
+				return fmt.Errorf("analyze: %w", err)
+			}
+			s.SetColumns(columns, analysis)
+		}
+		for col, typ := range p.Types {
+			s.SetColumnType(col, typ)
+		}
+		if err := s.Save(); err != nil {
+			return fmt.Errorf("failed to save schema: %w", err)
+		}
+	}
+
+	if len(p.Drop) > 0 || p.DropRowStore {
+		store, err := storage.Open(ds.IndexDir)
+		if err != nil {
+			return err
+		}
+		if err := indexer.DropIndexes(store, ds.CSV, p.Drop, p.DropRowStore); err != nil {
+			return fmt.Errorf("failed to drop indexes: %w", err)
+		}
+	}
+
+	if len(p.Build) == 0 {
+		return nil
+	}
+	columns, err := specsJSON(p.Build)
+	if err != nil {
+		return err
+	}
+	bloom := 0.01
+	if ds.Bloom != nil {
+		bloom = *ds.Bloom
+	}
+	return indexer.NewIndexer(indexer.IndexerConfig{
+		InputFile:   ds.CSV,
+		OutputDir:   ds.IndexDir,
+		Columns:     columns,
+		Separator:   ds.Separator,
+		Workers:     opts.Workers,
+		MemoryMB:    opts.MemoryMB,
+		BloomFPRate: bloom,
+		Version:     opts.Version,
+		ZoneColumn:  ds.ZoneColumn,
+		Codec:       ds.Codec,
+		RowStore:    ds.RowStore,
+		Partitions:  ds.Partitions,
+		Output:      opts.Output,
+	}).Run()
+}
+
+// specsJSON writes index specs back as an `index --columns` array.
+func specsJSON(specs []indexer.IndexSpec) (string, error) {
+	entries := make([]any, len(specs))
+	for i, spec := range specs {
+		entries[i] = spec.Columns
+		if spec.Collation != "" {
+			entries[i] = map[string]any{"col": spec.Columns, spec.Collation: true}
+		}
+	}
+	data, err := json.Marshal(entries)
+	return string(data), err
+}
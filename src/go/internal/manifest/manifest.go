@@ -0,0 +1,206 @@
+// Package manifest applies a declarative description of csvquery datasets
+// (`csvquery apply manifest.yaml`): the indexes, schema and virtual columns
+// each CSV should have, and how its daemon is exposed. Plan diffs that
+// against the index metadata and schema files; Apply builds and drops
+// whatever differs.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Manifest is a parsed manifest file.
+type Manifest struct {
+	Datasets map[string]*Dataset `yaml:"datasets"`
+
+	Path string `yaml:"-"` // The file it was loaded from
+}
+
+// Dataset describes one CSV and what csvquery keeps for it. Paths are
+// relative to the manifest file.
+type Dataset struct {
+	CSV        string   `yaml:"csv"`
+	IndexDir   string   `yaml:"indexDir"`  // Directory or s3:// URL; default: next to the CSV
+	Separator  string   `yaml:"separator"` // Default: detected
+	Codec      string   `yaml:"codec"`
+	Bloom      *float64 `yaml:"bloom"` // Bloom filter false positive rate (0 = none)
+	ZoneColumn string   `yaml:"zoneColumn"`
+	RowStore   bool     `yaml:"csvz"`
+	Partitions int      `yaml:"partitions"` // Part files per index (0 or 1 = one .cidx)
+
+	// Entries as in `index --columns`: "col", [a, b] or {col: c, ci: true}
+	Indexes []any `yaml:"indexes"`
+
+	VirtualColumns map[string]string `yaml:"virtualColumns"` // Name -> default value
+	Schema         SchemaSpec        `yaml:"schema"`
+	Daemon         *DaemonSpec       `yaml:"daemon"` // nil = not exposed
+
+	specs []indexer.IndexSpec
+}
+
+// SchemaSpec declares the column metadata of a dataset.
+type SchemaSpec struct {
+	Analyze bool              `yaml:"analyze"` // Keep an `analyze` of the current CSV
+	Sample  int               `yaml:"sample"`  // Rows analyze samples (default 100000)
+	Types   map[string]string `yaml:"types"`   // Column -> type, overriding analyze
+}
+
+// DaemonSpec is how `daemon --manifest` serves a dataset.
+type DaemonSpec struct {
+	Socket           string `yaml:"socket"`
+	Host             string `yaml:"host"`
+	Port             int    `yaml:"port"`
+	Workers          int    `yaml:"workers"`
+	RequireIndex     bool   `yaml:"requireIndex"`
+	MaxFullScanBytes int64  `yaml:"maxFullScanBytes"`
+	TimeoutMs        int    `yaml:"timeoutMs"`
+	BlockCacheMB     int    `yaml:"blockCacheMB"` // 0 = the daemon's default
+}
+
+// Load reads and validates a manifest. Unknown keys are errors, so typos
+// do not silently drop an index.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var m Manifest
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(m.Datasets) == 0 {
+		return nil, fmt.Errorf("%s: no datasets", path)
+	}
+	m.Path = path
+
+	dir := filepath.Dir(path)
+	for _, name := range m.Names() {
+		ds := m.Datasets[name]
+		if ds == nil || ds.CSV == "" {
+			return nil, fmt.Errorf("dataset %s: csv is required", name)
+		}
+		ds.CSV = resolve(dir, ds.CSV)
+		if ds.IndexDir == "" {
+			ds.IndexDir = filepath.Dir(ds.CSV)
+		} else if !storage.IsRemote(ds.IndexDir) {
+			ds.IndexDir = resolve(dir, ds.IndexDir)
+		}
+		if _, err := common.ParseSeparator(ds.Separator); err != nil {
+			return nil, fmt.Errorf("dataset %s: %v", name, err)
+		}
+		if ds.Partitions < 0 {
+			return nil, fmt.Errorf("dataset %s: partitions must not be negative", name)
+		}
+		if ds.Codec == "" {
+			ds.Codec = common.CodecLZ4
+		}
+		if _, err := common.NewCodec(ds.Codec); err != nil {
+			return nil, fmt.Errorf("dataset %s: %w", name, err)
+		}
+		if len(ds.Indexes) > 0 {
+			columns, err := json.Marshal(ds.Indexes)
+			if err != nil {
+				return nil, fmt.Errorf("dataset %s: indexes: %w", name, err)
+			}
+			if ds.specs, err = indexer.ParseIndexSpecs(string(columns)); err != nil {
+				return nil, fmt.Errorf("dataset %s: indexes: %w", name, err)
+			}
+		}
+		for col, typ := range ds.Schema.Types {
+			if !validType(schema.ColumnType(typ)) {
+				return nil, fmt.Errorf("dataset %s: column %s: unknown type %q (string, int, float, bool or date)", name, col, typ)
+			}
+		}
+		if d := ds.Daemon; d != nil && d.Socket == "" && d.Port == 0 {
+			return nil, fmt.Errorf("dataset %s: daemon needs a socket or a port", name)
+		}
+	}
+	return &m, nil
+}
+
+// Names returns the dataset names in order.
+func (m *Manifest) Names() []string {
+	names := make([]string, 0, len(m.Datasets))
+	for name := range m.Datasets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DaemonArgs returns the `daemon` flags that serve the dataset. Flags
+// given after them override them.
+func (ds *Dataset) DaemonArgs() []string {
+	args := []string{"--csv", ds.CSV, "--index-dir", ds.IndexDir}
+	d := ds.Daemon
+	if d == nil {
+		return args
+	}
+	if d.Socket != "" {
+		args = append(args, "--socket", d.Socket)
+	}
+	if d.Host != "" {
+		args = append(args, "--host", d.Host)
+	}
+	if d.Port > 0 {
+		args = append(args, "--port", strconv.Itoa(d.Port))
+	}
+	if d.Workers > 0 {
+		args = append(args, "--workers", strconv.Itoa(d.Workers))
+	}
+	if d.RequireIndex {
+		args = append(args, "--require-index")
+	}
+	if d.MaxFullScanBytes > 0 {
+		args = append(args, "--max-fullscan-bytes", strconv.FormatInt(d.MaxFullScanBytes, 10))
+	}
+	if d.TimeoutMs > 0 {
+		args = append(args, "--timeout", strconv.Itoa(d.TimeoutMs))
+	}
+	if d.BlockCacheMB > 0 {
+		args = append(args, "--block-cache-mb", strconv.Itoa(d.BlockCacheMB))
+	}
+	return args
+}
+
+// Endpoint describes where the daemon of the dataset listens.
+func (d *DaemonSpec) Endpoint() string {
+	if d.Port > 0 {
+		host := d.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		return fmt.Sprintf("tcp:%s:%d", host, d.Port)
+	}
+	return "unix:" + d.Socket
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func validType(t schema.ColumnType) bool {
+	switch t {
+	case schema.TypeString, schema.TypeInt, schema.TypeFloat, schema.TypeBool, schema.TypeDate:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Plan is what Apply changes for one dataset.
+type Plan struct {
+	Name    string
+	Dataset *Dataset
+
+	Build         []indexer.IndexSpec // Indexes to build, or rebuild
+	BuildReasons  []string            // Why, per entry of Build
+	Drop          []string            // Index names to remove
+	DropRowStore  bool
+	Analyze       bool
+	Types         map[string]schema.ColumnType // Declared types that differ
+	SetVirtual    map[string]string            // Virtual columns to add or change
+	RemoveVirtual []string
+}
+
+// Empty reports whether the dataset is already as declared.
+func (p *Plan) Empty() bool {
+	return len(p.Build) == 0 && len(p.Drop) == 0 && !p.DropRowStore && !p.Analyze &&
+		len(p.Types) == 0 && len(p.SetVirtual) == 0 && len(p.RemoveVirtual) == 0
+}
+
+// PlanDataset diffs a dataset against its index metadata and schema.
+func PlanDataset(name string, ds *Dataset) (*Plan, error) {
+	p := &Plan{Name: name, Dataset: ds, Types: map[string]schema.ColumnType{}, SetVirtual: map[string]string{}}
+
+	info, err := os.Stat(ds.CSV)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.Open(ds.IndexDir)
+	if err != nil {
+		return nil, err
+	}
+	csvName := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+	var meta *common.IndexMeta
+	if data, err := storage.ReadFile(store, csvName+"_meta.json"); err == nil {
+		meta = &common.IndexMeta{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, fmt.Errorf("invalid index metadata of %s: %w", name, err)
+		}
+	}
+
+	// Indexes: every declared one must exist with its collation, for the
+	// current CSV; the others go
+	stale := ""
+	switch {
+	case meta == nil:
+		stale = "not built"
+	case meta.CsvSize != info.Size() || meta.CsvMtime != info.ModTime().Unix():
+		if hash, err := indexer.CsvFingerprint(ds.CSV, info.Size()); err != nil || hash != meta.CsvHash {
+			stale = "CSV changed"
+		}
+	case ds.RowStore && meta.RowStore == "":
+		stale = "row store missing"
+	}
+	var files map[string]string
+	if meta != nil {
+		if files, err = indexer.IndexFiles(store, ds.CSV); err != nil {
+			return nil, err
+		}
+	}
+	declared := map[string]bool{}
+	for _, spec := range ds.specs {
+		indexName := indexer.IndexName(spec.Columns)
+		declared[indexName] = true
+		reason := stale
+		if reason == "" {
+			stats, ok := meta.Indexes[indexName]
+			if _, err := store.Stat(files[indexName]); !ok || err != nil {
+				reason = "missing"
+			} else if stats.Collation != spec.Collation {
+				reason = fmt.Sprintf("collation %q, declared %q", stats.Collation, spec.Collation)
+			} else if parts := max(stats.Partitions, 1); parts != max(ds.Partitions, 1) && stats.DistinctCount > 0 {
+				reason = fmt.Sprintf("%d partitions, declared %d", parts, max(ds.Partitions, 1))
+			}
+		}
+		if reason != "" {
+			p.Build = append(p.Build, spec)
+			p.BuildReasons = append(p.BuildReasons, reason)
+		}
+	}
+	if meta != nil {
+		for indexName := range meta.Indexes {
+			if !declared[indexName] {
+				p.Drop = append(p.Drop, indexName)
+			}
+		}
+		sort.Strings(p.Drop)
+		// A build rewrites or unlists the row store itself
+		p.DropRowStore = !ds.RowStore && meta.RowStore != "" && len(p.Build) == 0
+	}
+
+	// Schema: virtual columns, declared types and analysis
+	s, err := schema.Load(ds.CSV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema of %s: %w", name, err)
+	}
+	for col, def := range ds.VirtualColumns {
+		if cur, ok := s.VirtualColumns[col]; !ok || cur != def {
+			p.SetVirtual[col] = def
+		}
+	}
+	for col := range s.VirtualColumns {
+		if _, ok := ds.VirtualColumns[col]; !ok {
+			p.RemoveVirtual = append(p.RemoveVirtual, col)
+		}
+	}
+	sort.Strings(p.RemoveVirtual)
+	// Indexes over a virtual column hold its default: a new one rebuilds them
+	for _, spec := range ds.specs {
+		if slices.ContainsFunc(p.Build, func(b indexer.IndexSpec) bool { return indexer.IndexName(b.Columns) == indexer.IndexName(spec.Columns) }) {
+			continue
+		}
+		for _, col := range spec.Columns {
+			if _, ok := p.SetVirtual[col]; ok {
+				p.Build = append(p.Build, spec)
+				p.BuildReasons = append(p.BuildReasons, "virtual column "+col+" changed")
+				break
+			}
+		}
+	}
+	if ds.Schema.Analyze {
+		p.Analyze = s.Analysis == nil || info.ModTime().After(s.Analysis.AnalyzedAt)
+	}
+	for col, typ := range ds.Schema.Types {
+		if cur, ok := s.Column(col); p.Analyze || !ok || cur.Type != schema.ColumnType(typ) {
+			p.Types[col] = schema.ColumnType(typ)
+		}
+	}
+	return p, nil
+}
+
+// Describe writes the plan, one change per line.
+func (p *Plan) Describe(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "%s (%s)\n", p.Name, p.Dataset.CSV)
+	if p.Empty() {
+		_, _ = fmt.Fprintln(w, "  up to date")
+	}
+	for i, spec := range p.Build {
+		collation := ""
+		if spec.Collation != "" {
+			collation = " [" + spec.Collation + "]"
+		}
+		_, _ = fmt.Fprintf(w, "  + index %s%s (%s)\n", indexer.IndexName(spec.Columns), collation, p.BuildReasons[i])
+	}
+	for _, name := range p.Drop {
+		_, _ = fmt.Fprintf(w, "  - index %s\n", name)
+	}
+	if p.DropRowStore {
+		_, _ = fmt.Fprintln(w, "  - row store")
+	}
+	for _, col := range sortedKeys(p.SetVirtual) {
+		_, _ = fmt.Fprintf(w, "  + virtual column %s = %q\n", col, p.SetVirtual[col])
+	}
+	for _, col := range p.RemoveVirtual {
+		_, _ = fmt.Fprintf(w, "  - virtual column %s\n", col)
+	}
+	if p.Analyze {
+		_, _ = fmt.Fprintln(w, "  ~ analyze")
+	}
+	for _, col := range sortedKeys(p.Types) {
+		_, _ = fmt.Fprintf(w, "  ~ type %s: %s\n", col, p.Types[col])
+	}
+	if d := p.Dataset.Daemon; d != nil {
+		_, _ = fmt.Fprintf(w, "  daemon: %s\n", d.Endpoint())
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,55 @@
+// Package memlimit detects container memory limits and derives the Go
+// runtime soft limit (GOMEMLIMIT) and buffer budgets from them, so the
+// indexer and daemon stay below the limit instead of being OOM-killed.
+package memlimit
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+// Limit describes the memory available to this process.
+type Limit struct {
+	Bytes  int64  // 0 = no limit detected
+	Source string // "cgroup v2", "cgroup v1" or "" when unlimited/unknown
+}
+
+// GoMemLimitFraction is the share of the container limit given to the Go
+// runtime; the rest is headroom for mmapped files and non-heap memory.
+const GoMemLimitFraction = 0.9
+
+// Detect returns the memory limit imposed on this process (cgroups on Linux).
+func Detect() Limit {
+	return detect()
+}
+
+// ApplyGoMemLimit sets the runtime soft memory limit to fraction of l,
+// unless GOMEMLIMIT is set in the environment (the operator's choice wins).
+// Returns the soft limit in effect (0 = none).
+func ApplyGoMemLimit(l Limit, fraction float64) int64 {
+	if os.Getenv("GOMEMLIMIT") != "" {
+		return debug.SetMemoryLimit(-1)
+	}
+	if l.Bytes <= 0 {
+		return 0
+	}
+	limit := int64(float64(l.Bytes) * fraction)
+	debug.SetMemoryLimit(limit)
+	return limit
+}
+
+// BudgetMB scales a default buffer budget down to fraction of the limit.
+// Returns defaultMB when no limit is known or the default already fits.
+func BudgetMB(l Limit, fraction float64, defaultMB int) int {
+	if l.Bytes <= 0 {
+		return defaultMB
+	}
+	mb := int(float64(l.Bytes) * fraction / (1024 * 1024))
+	if mb < 1 {
+		mb = 1
+	}
+	if mb < defaultMB {
+		return mb
+	}
+	return defaultMB
+}
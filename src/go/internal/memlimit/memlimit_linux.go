@@ -0,0 +1,98 @@
+//go:build linux
+
+package memlimit
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// unlimitedV1 is the threshold above which cgroup v1 reports "no limit"
+// (the kernel uses a page-aligned LONG_MAX).
+const unlimitedV1 = int64(1) << 60
+
+func detect() Limit {
+	procCgroup, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return Limit{}
+	}
+	return detectCgroup("/sys/fs/cgroup", procCgroup)
+}
+
+// detectCgroup finds the tightest memory limit on the path from this
+// process's cgroup up to the root. root is the cgroup mount point.
+func detectCgroup(root string, procCgroup []byte) Limit {
+	var v1Path, v2Path string
+	haveV2 := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(procCgroup))
+	for scanner.Scan() {
+		// Format: hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			v2Path, haveV2 = parts[2], true
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				v1Path = parts[2]
+			}
+		}
+	}
+
+	// Hybrid hosts list both; the memory controller lives where v1 says
+	if v1Path != "" {
+		if limit := minLimit(filepath.Join(root, "memory"), v1Path, "memory.limit_in_bytes"); limit > 0 {
+			return Limit{Bytes: limit, Source: "cgroup v1"}
+		}
+		return Limit{}
+	}
+	if haveV2 {
+		if limit := minLimit(root, v2Path, "memory.max"); limit > 0 {
+			return Limit{Bytes: limit, Source: "cgroup v2"}
+		}
+	}
+	return Limit{}
+}
+
+// minLimit walks from cgroupPath up to the hierarchy root and returns the
+// smallest limit found in file (0 = unlimited everywhere).
+func minLimit(mount, cgroupPath, file string) int64 {
+	var best int64
+	p := path.Clean("/" + cgroupPath)
+	for {
+		if limit := readLimit(filepath.Join(mount, p, file)); limit > 0 && (best == 0 || limit < best) {
+			best = limit
+		}
+		if p == "/" {
+			return best
+		}
+		p = path.Dir(p)
+	}
+}
+
+// readLimit parses a cgroup limit file. "max" and v1's huge sentinel mean
+// no limit and return 0, as do missing or unreadable files.
+func readLimit(file string) int64 {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n >= unlimitedV1 {
+		return 0
+	}
+	return n
+}
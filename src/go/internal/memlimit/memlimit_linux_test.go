@@ -0,0 +1,68 @@
+//go:build linux
+
+package memlimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLimit(t *testing.T, path, value string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectCgroupV2(t *testing.T) {
+	root := t.TempDir()
+	writeLimit(t, filepath.Join(root, "memory.max"), "max")
+	writeLimit(t, filepath.Join(root, "kubepods", "memory.max"), "1073741824")
+	writeLimit(t, filepath.Join(root, "kubepods", "pod1", "memory.max"), "max")
+
+	l := detectCgroup(root, []byte("0::/kubepods/pod1\n"))
+	if l.Bytes != 1<<30 || l.Source != "cgroup v2" {
+		t.Errorf("got %+v, want 1GiB from cgroup v2 parent", l)
+	}
+}
+
+func TestDetectCgroupV1Hybrid(t *testing.T) {
+	root := t.TempDir()
+	writeLimit(t, filepath.Join(root, "memory", "memory.limit_in_bytes"), "9223372036854771712")
+	writeLimit(t, filepath.Join(root, "memory", "docker", "abc", "memory.limit_in_bytes"), "268435456")
+
+	proc := "4:memory:/docker/abc\n1:cpu,cpuacct:/docker/abc\n0::/\n"
+	l := detectCgroup(root, []byte(proc))
+	if l.Bytes != 256<<20 || l.Source != "cgroup v1" {
+		t.Errorf("got %+v, want 256MiB from cgroup v1", l)
+	}
+}
+
+func TestDetectCgroupUnlimited(t *testing.T) {
+	root := t.TempDir()
+	writeLimit(t, filepath.Join(root, "memory.max"), "max")
+
+	if l := detectCgroup(root, []byte("0::/\n")); l.Bytes != 0 {
+		t.Errorf("got %+v, want no limit", l)
+	}
+	if l := detectCgroup(root, []byte("garbage")); l.Bytes != 0 {
+		t.Errorf("got %+v, want no limit for unparsable input", l)
+	}
+}
+
+func TestBudgetMB(t *testing.T) {
+	small := Limit{Bytes: 512 << 20, Source: "cgroup v2"}
+	if got := BudgetMB(small, 0.5, 500); got != 256 {
+		t.Errorf("BudgetMB(512MiB, 0.5) = %d, want 256", got)
+	}
+	if got := BudgetMB(Limit{Bytes: 64 << 30}, 0.5, 500); got != 500 {
+		t.Errorf("large limit should keep the default, got %d", got)
+	}
+	if got := BudgetMB(Limit{}, 0.5, 500); got != 500 {
+		t.Errorf("no limit should keep the default, got %d", got)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package memlimit
+
+// detect reports no limit: cgroups only exist on Linux.
+func detect() Limit {
+	return Limit{}
+}
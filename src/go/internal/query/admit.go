@@ -0,0 +1,133 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Admission. A daemon runs cheap index lookups and heavy full scans side
+// by side; QueryConfig.Admit lets it give each its own execution slots, so
+// a burst of scans cannot hold every slot while lookups wait. The engine
+// asks for a slot once the plan tells which class the query is in, before
+// it reads any data, and gives it back when Run returns. Waiting for a
+// slot counts against the query's Timeout and Context. Explain plans read
+// no data and take no slot.
+//
+// Cost. Before it takes a slot, a query estimates the bytes it will read:
+// a full scan, the whole CSV; a lookup, the rows the plan expects (see
+// estimate.go) times the average row of the CSV at index time. A query
+// whose cost is over QueryConfig.MaxCost fails with a CostError, naming
+// the index that would serve it, instead of running; Admit gets the cost
+// to weigh queries against a budget. Lookups on indexes without key
+// statistics have no estimate and are never refused.
+
+// Query classes, as QueryConfig.Admit and QueryEngine.Class name them.
+const (
+	ClassLookup = "lookup" // Reads index blocks and the rows they point to
+	ClassScan   = "scan"   // Reads the whole CSV
+)
+
+// admit takes an execution slot of class (see QueryConfig.Admit) for a
+// query expected to read rows rows (-1 = unknown; ignored by scans). A
+// query takes one slot, of the first class it asks for.
+func (q *QueryEngine) admit(class string, rows int64) error {
+	if q.Class != "" {
+		return nil
+	}
+	q.Class = class
+	q.Cost = q.estimateCost(class, rows)
+	if q.config.MaxCost > 0 && q.Cost > q.config.MaxCost {
+		return q.costError()
+	}
+	if q.config.Admit == nil {
+		return nil
+	}
+	ctx := q.config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !q.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, q.deadline)
+		defer cancel()
+	}
+	release, err := q.config.Admit(ctx, class, q.Cost)
+	if err != nil {
+		if cerr := q.checkDeadline(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+	q.release = release
+	return nil
+}
+
+// releaseSlot gives back the execution slot of the last Run, if it took
+// one.
+func (q *QueryEngine) releaseSlot() {
+	if q.release != nil {
+		q.release()
+		q.release = nil
+	}
+}
+
+// beginFullScan checks that a fallback full scan is allowed (see
+// checkFullScanAllowed) and takes a scan slot for it.
+func (q *QueryEngine) beginFullScan(reason string) error {
+	if err := q.checkFullScanAllowed(reason); err != nil {
+		return err
+	}
+	return q.admit(ClassScan, -1)
+}
+
+// estimateCost returns the bytes a query of class is expected to read (0 =
+// unknown).
+func (q *QueryEngine) estimateCost(class string, rows int64) int64 {
+	if class == ClassScan {
+		info, err := os.Stat(q.config.CsvPath)
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	if rows < 0 {
+		return 0
+	}
+	meta := q.loadMeta()
+	if meta == nil || meta.TotalRows <= 0 {
+		return 0
+	}
+	return rows * ((meta.CsvSize + meta.TotalRows - 1) / meta.TotalRows)
+}
+
+// planCost adds the cost of running plan as a query of class to it, when
+// known, for explain.
+func (q *QueryEngine) planCost(plan map[string]interface{}, class string) {
+	if cost := q.estimateCost(class, planRows(plan)); cost > 0 {
+		plan["estimated_bytes"] = cost
+	}
+}
+
+// planRows returns the rows plan expects to match (-1 = unknown).
+func planRows(plan map[string]interface{}) int64 {
+	if rows, ok := plan["estimated_rows"].(int64); ok {
+		return rows
+	}
+	return -1
+}
+
+// costError describes why the admitted query costs too much, and what
+// would make it cheaper.
+func (q *QueryEngine) costError() error {
+	e := &CostError{Class: q.Class, Bytes: q.Cost, Limit: q.config.MaxCost}
+	advice := "Narrow the filter with conditions on indexed columns"
+	if q.Class == ClassScan {
+		e.Index = q.indexSuggestion()
+		advice = q.suggestIndex()
+	}
+	e.msg = fmt.Sprintf("%s: a %s expected to read %d bytes of %s (limit %d). %s",
+		ErrTooExpensive, q.Class, e.Bytes, filepath.Base(q.config.CsvPath), e.Limit, advice)
+	return e
+}
@@ -0,0 +1,133 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAdmitCost(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city"]`)
+	info, err := os.Stat(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lookup of city = Paris expects 300 records / 5 keys
+	res, q, err := runTest(t, QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, `{"city":"Paris"}`), CountOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := q.loadMeta()
+	lookupCost := 60 * ((meta.CsvSize + meta.TotalRows - 1) / meta.TotalRows)
+	if q.Class != ClassLookup || q.Cost != lookupCost || res.Count.Count != 60 {
+		t.Errorf("Lookup: class %q, cost %d, count %d, want lookup, %d, 60", q.Class, q.Cost, res.Count.Count, lookupCost)
+	}
+
+	scan := where(t, `{"status":"open"}`)
+	for _, tc := range []struct {
+		name    string
+		where   *Condition
+		maxCost int64
+		class   string
+		cost    int64
+		refused bool
+	}{
+		{"lookup under the limit", where(t, `{"city":"Paris"}`), lookupCost, ClassLookup, lookupCost, false},
+		{"lookup over the limit", where(t, `{"city":"Paris"}`), lookupCost - 1, ClassLookup, lookupCost, true},
+		{"scan under the limit", scan, info.Size(), ClassScan, info.Size(), false},
+		{"scan over the limit", scan, info.Size() - 1, ClassScan, info.Size(), true},
+		{"no limit", scan, 0, ClassScan, info.Size(), false},
+	} {
+		_, q, err := runTest(t, QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: tc.where, MaxCost: tc.maxCost})
+		if q.Class != tc.class || q.Cost != tc.cost {
+			t.Errorf("%s: class %q, cost %d, want %q, %d", tc.name, q.Class, q.Cost, tc.class, tc.cost)
+		}
+		var cerr *CostError
+		if !tc.refused {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &cerr) || !errors.Is(err, ErrTooExpensive) {
+			t.Errorf("%s: error %v, want a CostError", tc.name, err)
+			continue
+		}
+		if cerr.Class != tc.class || cerr.Bytes != tc.cost || cerr.Limit != tc.maxCost {
+			t.Errorf("%s: refused %+v", tc.name, cerr)
+		}
+		if tc.class == ClassScan && (len(cerr.Index) != 1 || cerr.Index[0] != "status") {
+			t.Errorf("%s: suggested index %v, want [status]", tc.name, cerr.Index)
+		}
+	}
+}
+
+func TestAdmitSlots(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city"]`)
+
+	var asked []string
+	var costs []int64
+	held := 0
+	admit := func(ctx context.Context, class string, cost int64) (func(), error) {
+		asked = append(asked, class)
+		costs = append(costs, cost)
+		held++
+		return func() { held-- }, nil
+	}
+	for _, tc := range []struct {
+		name    string
+		cfg     QueryConfig
+		class   string
+		noSlots bool
+	}{
+		{"lookup", QueryConfig{Where: where(t, `{"city":"Rome"}`)}, ClassLookup, false},
+		{"scan", QueryConfig{Where: where(t, `{"status":"paid"}`)}, ClassScan, false},
+		{"group by", QueryConfig{GroupBy: "city", AggFunc: "count"}, ClassLookup, false},
+		{"explain", QueryConfig{Where: where(t, `{"status":"paid"}`), Explain: true}, "", true},
+	} {
+		asked, costs = nil, nil
+		cfg := tc.cfg
+		cfg.CsvPath, cfg.IndexDir, cfg.Admit = csvPath, dir, admit
+		_, q, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.noSlots {
+			if len(asked) != 0 {
+				t.Errorf("%s: took slots %v", tc.name, asked)
+			}
+			continue
+		}
+		if len(asked) != 1 || asked[0] != tc.class || costs[0] != q.Cost {
+			t.Errorf("%s: took slots %v of costs %v, want one %s of %d", tc.name, asked, costs, tc.class, q.Cost)
+		}
+		if held != 0 {
+			t.Errorf("%s: %d slots held after Run", tc.name, held)
+		}
+	}
+}
+
+func TestAdmitWaitTimeout(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city"]`)
+	refused := errors.New("no slot")
+	for _, tc := range []struct {
+		name  string
+		admit func(context.Context, string, int64) (func(), error)
+		want  error
+	}{
+		{"timed out", func(ctx context.Context, _ string, _ int64) (func(), error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, ErrTimeout},
+		{"refused", func(context.Context, string, int64) (func(), error) { return nil, refused }, refused},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, `{"city":"Rome"}`), Admit: tc.admit, Timeout: 20 * time.Millisecond}
+		if _, _, err := runTest(t, cfg); !errors.Is(err, tc.want) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package query
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Ordered group-by output. With QueryConfig.AggSort, groups come out as a
+// JSON array of {"key", "value"} pairs sorted by group key or by aggregate
+// value, and AggLimit keeps the first of them, so "the top 20" needs no
+// client-side sort of every group. Without it they stay a JSON map, in no
+// particular order.
+
+// Group is one group of an ordered group-by result.
+type Group struct {
+	Key   string   `json:"key"`
+	Value AggValue `json:"value"`
+}
+
+// groupOrder is a parsed AggSort.
+type groupOrder struct {
+	byKey bool // By group key, else by aggregate value
+	desc  bool
+}
+
+// parseAggSort parses an AggSort: "key", "value" or the name of an
+// aggregate ("count desc"), then "asc" (the default) or "desc".
+func parseAggSort(s string) (groupOrder, error) {
+	var o groupOrder
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields) > 2 {
+		return o, errorf(ErrBadQuery, "invalid --agg-sort %q: use key or value, then asc or desc", s)
+	}
+	switch fields[0] {
+	case "key":
+		o.byKey = true
+	case "value", "count", "sum", "avg", "min", "max":
+	default:
+		return o, errorf(ErrBadQuery, "invalid --agg-sort %q: use key or value, then asc or desc", s)
+	}
+	if len(fields) == 2 {
+		switch fields[1] {
+		case "asc":
+		case "desc":
+			o.desc = true
+		default:
+			return o, errorf(ErrBadQuery, "invalid --agg-sort %q: use key or value, then asc or desc", s)
+		}
+	}
+	return o, nil
+}
+
+// checkAggSort validates QueryConfig.AggSort and AggLimit.
+func (q *QueryEngine) checkAggSort() error {
+	switch {
+	case q.config.AggSort == "" && q.config.AggLimit > 0:
+		return errorf(ErrBadQuery, "--agg-limit needs --agg-sort: the order of the groups to keep")
+	case q.config.AggSort == "":
+		return nil
+	case q.config.GroupBy == "":
+		return errorf(ErrBadQuery, "--agg-sort orders groups: add --group-by")
+	}
+	o, err := parseAggSort(q.config.AggSort)
+	if err != nil {
+		return err
+	}
+	q.aggOrder = &o
+	return nil
+}
+
+// groupRanking collects groups in an order, keeping only the first limit
+// (0 = all) once it has twice as many.
+type groupRanking struct {
+	order  groupOrder
+	limit  int
+	groups []Group
+}
+
+func (r *groupRanking) add(key string, val float64) {
+	r.groups = append(r.groups, Group{Key: key, Value: AggValue(val)})
+	if r.limit > 0 && len(r.groups) >= 2*r.limit {
+		r.trim()
+	}
+}
+
+// trim sorts the groups and cuts them to the limit. Ties on value are
+// broken by key, so the result does not depend on the collection order.
+func (r *groupRanking) trim() {
+	slices.SortFunc(r.groups, func(a, b Group) int {
+		c := strings.Compare(a.Key, b.Key)
+		if !r.order.byKey {
+			c = cmp.Or(cmp.Compare(a.Value, b.Value), c)
+		}
+		if r.order.desc {
+			c = -c
+		}
+		return c
+	})
+	if r.limit > 0 && len(r.groups) > r.limit {
+		r.groups = r.groups[:r.limit]
+	}
+}
+
+func (r *groupRanking) result() []Group {
+	r.trim()
+	if r.groups == nil {
+		return []Group{}
+	}
+	return r.groups
+}
+
+// ranked returns the groups as finalGroups would, in order and limited.
+func (g *groupTable) ranked(order groupOrder, limit int) ([]Group, error) {
+	r := groupRanking{order: order, limit: limit}
+	if !g.spilled() {
+		for key, val := range finalGroups(g.results, g.counts) {
+			r.add(key, val)
+		}
+		return r.result(), nil
+	}
+	err := g.merge(func(key string, val float64) error {
+		r.add(key, val)
+		return nil
+	})
+	return r.result(), err
+}
+
+// writeRanked outputs ordered groups, or records them in the Result.
+func (q *QueryEngine) writeRanked(groups []Group) error {
+	if q.Result != nil {
+		q.Result.Ranked = groups
+		return nil
+	}
+	return json.NewEncoder(q.Writer).Encode(groups)
+}
+
+// RankGroups orders merged groups by an AggSort and keeps the first limit
+// (0 = all), as a query with them would have returned the groups.
+func RankGroups(groups map[string]float64, sort string, limit int) ([]Group, error) {
+	if sort == "" {
+		return nil, errorf(ErrBadQuery, "--agg-limit needs --agg-sort: the order of the groups to keep")
+	}
+	o, err := parseAggSort(sort)
+	if err != nil {
+		return nil, err
+	}
+	r := groupRanking{order: o, limit: limit}
+	for key, val := range groups {
+		r.add(key, val)
+	}
+	return r.result(), nil
+}
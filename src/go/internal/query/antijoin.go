@@ -0,0 +1,352 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// runAntiJoin streams keys from NotInFile (one per line) and outputs every key
+// that does NOT occur in NotInColumn. Each key is rejected by the bloom
+// filter when possible and otherwise probed with a single block read, so the
+// CSV itself is never touched when the column is indexed. Rows written to
+// the index deltas and pending updates count as a scan of the CSV would
+// see them (see keyChanges).
+func (q *QueryEngine) runAntiJoin() error {
+	if q.config.NotInColumn == "" {
+		return errorf(ErrBadQuery, "--column is required with --where-not-in-file")
+	}
+
+	keysFile, err := os.Open(q.config.NotInFile)
+	if err != nil {
+		return fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer func() { _ = keysFile.Close() }()
+
+	column := strings.ToLower(q.config.NotInColumn)
+
+	var contains func(key string) (bool, error)
+	if indexFile, ok := q.indexFileFor(column); ok {
+		probe, err := q.newIndexProbe(indexFile)
+		if err != nil {
+			return err
+		}
+		defer probe.Close()
+		if probe.changes, err = q.indexKeyChanges(column); err != nil {
+			return err
+		}
+		if err := q.admit(ClassLookup, -1); err != nil {
+			return err
+		}
+		q.UsedIndex = column
+		contains = probe.Contains
+		if q.indexCollation(column) == common.CollationCI {
+			contains = func(key string) (bool, error) { return probe.Contains(common.FoldKey(key)) }
+		}
+	} else {
+		if err := q.beginFullScan("no index on " + column + " for --where-not-in-file"); err != nil {
+			return err
+		}
+		set, err := q.loadColumnSet(column)
+		if err != nil {
+			return err
+		}
+		contains = func(key string) (bool, error) {
+			_, ok := set[key]
+			return ok, nil
+		}
+	}
+
+	writer := bufio.NewWriterSize(q.Writer, 65536)
+	defer func() { _ = writer.Flush() }()
+
+	var missing int64
+	lines := bufio.NewScanner(keysFile)
+	lines.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		if n%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
+			}
+		}
+		key := strings.TrimSuffix(lines.Text(), "\r")
+		if key == "" {
+			continue
+		}
+		found, err := contains(key)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		missing++
+		switch {
+		case q.config.CountOnly:
+		case q.Result != nil:
+			q.Result.Missing = append(q.Result.Missing, key)
+		default:
+			_, _ = fmt.Fprintln(writer, key)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+
+	if q.config.CountOnly {
+		q.writeCount(writer, missing)
+	}
+	return nil
+}
+
+// indexProbe answers point membership questions against a single index.
+// The last decoded block is kept, so sorted key files decode each block once.
+type indexProbe struct {
+	q           *QueryEngine
+	br          *common.BlockReader
+	bloom       *common.BloomFilter
+	bloomClose  func()
+	changes     *keyChanges // Changes since the build (nil = none)
+	cachedBlock int
+	records     []common.IndexRecord
+}
+
+func (q *QueryEngine) newIndexProbe(indexFile string) (*indexProbe, error) {
+	br, err := q.openBlockReader(indexFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init block reader: %w", err)
+	}
+	p := &indexProbe{q: q, br: br, cachedBlock: -1}
+
+	if bloom, cleanup, err := q.openBloom(indexFile + ".bloom"); err == nil {
+		p.bloom = bloom
+		p.bloomClose = cleanup
+	}
+	return p, nil
+}
+
+// Contains reports whether key occurs in the index, with the changes since
+// its build applied.
+func (p *indexProbe) Contains(key string) (bool, error) {
+	key, truncated := common.EncodeKey(key)
+	if truncated {
+		return false, nil // The index only holds a prefix of such values
+	}
+	if p.changes.has(key) {
+		return true, nil
+	}
+	if p.bloom != nil && !p.bloom.MightContain(key) {
+		return false, nil
+	}
+
+	blockIdx := p.q.findStartBlock(p.br.Footer, key)
+	if blockIdx == -1 {
+		return false, nil
+	}
+	if p.changes != nil && len(p.changes.removed) > 0 {
+		return p.live(blockIdx, key)
+	}
+	// The key's run may start in this block or exactly at the next one
+	blocks := p.br.Footer.Blocks
+	if blocks.StartKey(blockIdx) == key || (blockIdx+1 < blocks.Len() && blocks.StartKey(blockIdx+1) == key) {
+		return true, nil
+	}
+
+	records, err := p.block(blockIdx)
+	if err != nil {
+		return false, err
+	}
+	keyBytes := []byte(key)
+	i := sort.Search(len(records), func(i int) bool {
+		return compareRecordKey(&records[i].Key, keyBytes) >= 0
+	})
+	return i < len(records) && compareRecordKey(&records[i].Key, keyBytes) == 0, nil
+}
+
+// live reports whether a row of key's run, which starts in block blockIdx,
+// still has the key: is neither deleted nor updated in the column.
+func (p *indexProbe) live(blockIdx int, key string) (bool, error) {
+	keyBytes := []byte(key)
+	blocks := p.br.Footer.Blocks
+	for b := blockIdx; b < blocks.Len(); b++ {
+		if b > blockIdx && blocks.StartKey(b) > key {
+			break
+		}
+		records, err := p.block(b)
+		if err != nil {
+			return false, err
+		}
+		for i := range records {
+			switch cmp := compareRecordKey(&records[i].Key, keyBytes); {
+			case cmp > 0:
+				return false, nil
+			case cmp == 0 && !p.changes.removed[records[i].Offset]:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// block returns the records of block b, decoding it unless it is cached.
+func (p *indexProbe) block(b int) ([]common.IndexRecord, error) {
+	if b != p.cachedBlock {
+		records, err := p.br.ReadBlock(p.br.Footer.Blocks.At(b))
+		if err != nil {
+			return nil, err
+		}
+		p.records = records
+		p.cachedBlock = b
+	}
+	return p.records, nil
+}
+
+// Close releases the index and bloom filter mappings.
+func (p *indexProbe) Close() {
+	p.br.Cleanup()
+	if p.bloomClose != nil {
+		p.bloomClose()
+	}
+}
+
+// keyChanges are the changes to the keys of an index since its build: the
+// rows that no longer have their key, being deleted or updated in the
+// column, and the keys rows gained, from the index delta and the updated
+// values. Probes and key set exports apply them, so they see the keys a
+// scan of the CSV would.
+type keyChanges struct {
+	removed map[int64]bool // Index rows, by offset
+	added   []string       // Stored keys (see common.EncodeKey), sorted and distinct
+}
+
+// has reports whether key, a stored key, is among the added ones.
+func (c *keyChanges) has(key string) bool {
+	if c == nil {
+		return false
+	}
+	i := sort.SearchStrings(c.added, key)
+	return i < len(c.added) && c.added[i] == key
+}
+
+// indexKeyChanges returns the changes to the keys of the index of column,
+// or nil when there are none.
+func (q *QueryEngine) indexKeyChanges(column string) (*keyChanges, error) {
+	delta := q.loadDelta(column)
+	um := q.Updates
+	if len(delta) == 0 && (um == nil || (len(um.Deleted) == 0 && len(um.Overrides) == 0)) {
+		return nil, nil
+	}
+	headers, _, err := q.getHeaderMap()
+	if err != nil {
+		return nil, err
+	}
+	colIdx, hasCol := headers[column]
+	fold := q.indexCollation(column) == common.CollationCI
+
+	c := &keyChanges{removed: make(map[int64]bool)}
+	added := make(map[string]bool)
+	addKey := func(value string) {
+		if fold {
+			value = common.FoldKey(value)
+		}
+		if key, truncated := common.EncodeKey(value); !truncated {
+			added[key] = true
+		}
+	}
+	if um != nil {
+		for key, deleted := range um.Deleted {
+			if offset, err := strconv.ParseInt(key, 10, 64); err == nil && deleted {
+				c.removed[offset] = true
+			}
+		}
+		for key, row := range um.Overrides {
+			offset, err := strconv.ParseInt(key, 10, 64)
+			if err != nil || !hasCol || um.Deleted[key] {
+				continue
+			}
+			for col, val := range row {
+				if idx, ok := headers[col]; ok && idx == colIdx {
+					c.removed[offset] = true
+					addKey(val)
+				}
+			}
+		}
+	}
+	for i := range delta {
+		if !c.removed[delta[i].Offset] {
+			added[common.KeyString(&delta[i].Key)] = true
+		}
+	}
+
+	c.added = make([]string, 0, len(added))
+	for key := range added {
+		c.added = append(c.added, key)
+	}
+	sort.Strings(c.added)
+	return c, nil
+}
+
+// loadColumnSet reads every value of a column from the CSV, with the
+// pending updates applied. Used by the anti-join when the column has no
+// index.
+func (q *QueryEngine) loadColumnSet(column string) (map[string]struct{}, error) {
+	headers, _, err := q.getHeaderMap()
+	if err != nil {
+		return nil, err
+	}
+	colIdx, ok := headers[column]
+	if !ok {
+		return nil, errorf(ErrBadQuery, "column '%s' not found", column)
+	}
+
+	f, _, err := q.openScan()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	reader := bufio.NewReader(f)
+	header, err := common.ReadCSVRecord(reader) // Skip header
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(len(header))
+
+	set := make(map[string]struct{})
+	colsBuf := make([]string, 0, colIdx+1)
+	proj := &rowProjector{sep: q.separator(), used: make([]bool, colIdx+1)}
+	proj.used[colIdx] = true
+	for rows := 1; ; rows++ {
+		if rows%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return nil, err
+			}
+		}
+		line, err := common.ReadCSVRecord(reader) // Quoted fields may span lines
+		if len(line) > 0 && (q.Updates == nil || !q.Updates.IsDeleted(offset)) {
+			cols := proj.extract(bytes.TrimSpace(line), colsBuf)
+			if q.Updates != nil {
+				cols = q.applyUpdates(cols, q.Updates.GetRow(offset), headers)
+			}
+			if colIdx < len(cols) {
+				set[cols[colIdx]] = struct{}{}
+			}
+			colsBuf = cols
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,134 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/updatemgr"
+	"github.com/entreya/csvquery/internal/writer"
+)
+
+func TestAntiJoinScanQuotedNewlines(t *testing.T) {
+	// The second line of id 2's note would read as a row of id "ghost"
+	csvPath, dir := newTestCSV(t, "id,note\n1,plain\n2,\"two\nghost,lines\"\n3,last\n", `["note"]`)
+	keys := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(keys, []byte("1\nghost\n2\n4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := runTest(t, QueryConfig{CsvPath: csvPath, IndexDir: dir, NotInFile: keys, NotInColumn: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ghost", "4"}; !reflect.DeepEqual(res.Missing, want) {
+		t.Errorf("Missing %q, want %q", res.Missing, want)
+	}
+}
+
+func TestAntiJoinKeySetChanges(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testCities, `["id"]`)
+	keys := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(keys, []byte("1\n3\n5\n7\n99\n8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	antiJoin := func(indexDir string) []string {
+		t.Helper()
+		res, _, err := runTest(t, QueryConfig{CsvPath: csvPath, IndexDir: indexDir, NotInFile: keys, NotInColumn: "id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Missing
+	}
+	keySet := func() []string {
+		t.Helper()
+		var buf bytes.Buffer
+		q := NewQueryEngine(QueryConfig{CsvPath: csvPath, IndexDir: dir})
+		q.Writer = &buf
+		if _, err := q.ExportKeySet("id", KeySetKeys, 0); err != nil {
+			t.Fatal(err)
+		}
+		_, payload, _ := strings.Cut(buf.String(), "\n")
+		return strings.Fields(payload)
+	}
+
+	// Row 7 goes to the index delta, not the index
+	w := writer.NewCsvWriter(writer.WriterConfig{CsvPath: csvPath, DeltaDir: dir})
+	if err := w.Write(nil, [][]string{{"7", "gus", "Lima"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := antiJoin(dir), []string{"99", "8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta: missing %q, want %q", got, want)
+	}
+	if got, want := keySet(), []string{"1", "2", "3", "4", "5", "6", "7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta: key set %q, want %q", got, want)
+	}
+
+	// Row 3 now has id 99, row 5 is gone
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Set(rowOffset(testCities, "3"), "id", "99")
+	um.Delete(rowOffset(testCities, "5"))
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"3", "5", "8"}
+	if got := antiJoin(dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("updates: missing %q, want %q", got, want)
+	}
+	if got := antiJoin(t.TempDir()); !reflect.DeepEqual(got, want) {
+		t.Errorf("updates, full scan: missing %q, want %q", got, want)
+	}
+	if got, want := keySet(), []string{"1", "2", "4", "6", "7", "99"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updates: key set %q, want %q", got, want)
+	}
+}
+
+func TestAntiJoinDeletedRun(t *testing.T) {
+	// 2000 rows of city a span several index blocks
+	var b strings.Builder
+	b.WriteString("id,city\n")
+	for i := 1; i <= 2000; i++ {
+		fmt.Fprintf(&b, "%d,a\n", i)
+	}
+	b.WriteString("2001,b\n")
+	data := b.String()
+	csvPath, dir := newTestCSV(t, data, `["city"]`)
+	keys := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(keys, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		keep int // Rows of a not deleted, the last ones
+		want []string
+	}{
+		{"last row kept", 1, nil},
+		{"all deleted", 0, []string{"a"}},
+	} {
+		um, err := updatemgr.Load(csvPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 2000-tc.keep; i++ {
+			um.Delete(rowOffset(data, strconv.Itoa(i)))
+		}
+		if err := um.Save(); err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := runTest(t, QueryConfig{CsvPath: csvPath, IndexDir: dir, NotInFile: keys, NotInColumn: "city"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Missing, tc.want) {
+			t.Errorf("%s: missing %q, want %q", tc.name, res.Missing, tc.want)
+		}
+	}
+}
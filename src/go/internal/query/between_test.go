@@ -0,0 +1,85 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEvents is a CSV of 3000 rows, over several index blocks.
+var testEvents = func() string {
+	var b strings.Builder
+	b.WriteString("id,code,day\n")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3000 {
+		fmt.Fprintf(&b, "%d,c%04d,%s\n", i, (i*7)%3000, start.AddDate(0, 0, i%366).Format("2006-01-02"))
+	}
+	return b.String()
+}()
+
+func TestBetween(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testEvents, `["id","code","day"]`)
+	for _, tc := range []struct {
+		name     string
+		where    string
+		rows     int
+		strategy string
+	}{
+		{"text", `{"operator":"BETWEEN","column":"code","value":["c0100","c0199"]}`, 100, "Index Range Scan (Zone Map)"},
+		{"numbers", `{"operator":"BETWEEN","column":"id","value":[9,100]}`, 92, "Index Range Scan (Zone Map)"},
+		{"dates", `{"operator":"BETWEEN","column":"day","value":["2024-03-01","2024-03-31"]}`, 260, "Index Range Scan (Zone Map)"},
+		{"one value", `{"operator":"BETWEEN","column":"code","value":["c2999","c2999"]}`, 1, "Index Range Scan (Zone Map)"},
+		{"reversed", `{"operator":"BETWEEN","column":"code","value":["c0199","c0100"]}`, 0, "Index Range Scan (Zone Map)"},
+		{"and an equality", `{"operator":"AND","children":[
+			{"operator":"BETWEEN","column":"code","value":["c0000","c0999"]},
+			{"operator":"=","column":"day","value":"2024-01-01"}]}`, 3, "Index Scan (Composite)"},
+		{"in an OR", `{"operator":"OR","children":[
+			{"operator":"BETWEEN","column":"id","value":[0,9]},
+			{"operator":"BETWEEN","column":"id","value":[2990,3000]}]}`, 20, "Full Scan"},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.where)}
+		want := scanTest(t, cfg)
+		if len(want.Rows) != tc.rows {
+			t.Errorf("%s: full scan found %d rows, want %d", tc.name, len(want.Rows), tc.rows)
+		}
+
+		res, q, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if q.Strategy != tc.strategy {
+			t.Errorf("%s: strategy %q, want %q", tc.name, q.Strategy, tc.strategy)
+		}
+		got := offsets(res.Rows)
+		slices.Sort(got)
+		if !reflect.DeepEqual(got, offsets(want.Rows)) {
+			t.Errorf("%s (%s): rows %v, want %v", tc.name, q.Strategy, got, offsets(want.Rows))
+		}
+
+		cfg.CountOnly = true
+		res, _, err = runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: count: %v", tc.name, err)
+		} else if res.Count.Count != int64(tc.rows) {
+			t.Errorf("%s: count %d, want %d", tc.name, res.Count.Count, tc.rows)
+		}
+	}
+}
+
+func TestBetweenInvalid(t *testing.T) {
+	for _, filter := range []string{
+		`{"operator":"BETWEEN","column":"id","value":5}`,
+		`{"operator":"BETWEEN","column":"id","value":[5]}`,
+		`{"operator":"BETWEEN","column":"id","value":[1,2,3]}`,
+		`{"operator":"BETWEEN","column":"id","value":[null,5]}`,
+	} {
+		if _, err := ParseCondition([]byte(filter)); !errors.Is(err, ErrBadWhere) {
+			t.Errorf("%s: error %v, want a bad where", filter, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/entreya/csvquery/internal/schema"
+)
+
+// timeBucket truncates the dates of a GROUP BY column ("created_at:month")
+// so rows are rolled up per period instead of per distinct value.
+type timeBucket string
+
+const (
+	bucketNone    timeBucket = ""
+	bucketYear    timeBucket = "year"
+	bucketQuarter timeBucket = "quarter"
+	bucketMonth   timeBucket = "month"
+	bucketWeek    timeBucket = "week"
+	bucketDay     timeBucket = "day"
+	bucketHour    timeBucket = "hour"
+)
+
+// parseGroupBy splits a GROUP BY spec into its column and time bucket.
+func parseGroupBy(spec string) (string, timeBucket, error) {
+	column, bucket, ok := strings.Cut(spec, ":")
+	if !ok {
+		return spec, bucketNone, nil
+	}
+	switch b := timeBucket(strings.ToLower(bucket)); b {
+	case bucketYear, bucketQuarter, bucketMonth, bucketWeek, bucketDay, bucketHour:
+		return column, b, nil
+	}
+	return "", bucketNone, errorf(ErrBadQuery, "unknown time bucket %q in group-by %q (use year, quarter, month, week, day or hour)", bucket, spec)
+}
+
+// key returns the group of a value: the start of its period, formatted so
+// groups sort chronologically as text ("2024", "2024-Q1", "2024-03", the
+// Monday "2024-03-11" for weeks, "2024-03-14", "2024-03-14 09:00"). Values
+// that are not dates fall into the "" group, like nulls.
+func (b timeBucket) key(layout, v string) string {
+	if b == bucketNone {
+		return v
+	}
+	t, ok := schema.ParseDate(layout, v)
+	if !ok {
+		return ""
+	}
+	switch b {
+	case bucketYear:
+		return t.Format("2006")
+	case bucketQuarter:
+		return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())+2)/3)
+	case bucketMonth:
+		return t.Format("2006-01")
+	case bucketWeek:
+		offset := (int(t.Weekday()) + 6) % 7 // Days since Monday
+		return t.AddDate(0, 0, -offset).Format(time.DateOnly)
+	case bucketDay:
+		return t.Format(time.DateOnly)
+	case bucketHour:
+		return t.Format("2006-01-02 15:00")
+	}
+	return v
+}
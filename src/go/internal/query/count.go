@@ -0,0 +1,260 @@
+package query
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// runCoveredCount counts the records matching searchKey when the index covers
+// every condition, so the CSV is never read: those of the blocks from
+// startBlockIdx (none past endBlockIdx < startBlockIdx) and of the delta.
+func (q *QueryEngine) runCoveredCount(br *common.BlockReader, searchKey string, startBlockIdx, endBlockIdx int) error {
+	if q.intersect != nil {
+		total, err := q.countIntersection(br, searchKey, startBlockIdx, endBlockIdx)
+		if err != nil {
+			return err
+		}
+		q.printCount(total)
+		return nil
+	}
+	total := int64(len(q.delta))
+	if startBlockIdx <= endBlockIdx {
+		n, err := q.countKey(br, searchKey, startBlockIdx)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	q.printCount(total)
+	return nil
+}
+
+// countKey counts the records of searchKey from startBlockIdx on. Distinct
+// blocks of the key are summed from the footer without decompression; only
+// the mixed blocks at the edges of the key's run are decoded, in parallel.
+func (q *QueryEngine) countKey(br *common.BlockReader, searchKey string, startBlockIdx int) (int64, error) {
+	blocks := br.Footer.Blocks
+
+	var total int64
+	var boundary []int
+	for i := startBlockIdx; i < blocks.Len(); i++ {
+		b := blocks.At(i)
+		if b.StartKey > searchKey {
+			break
+		}
+		switch {
+		case b.RecordCount == 0:
+			// Old index format without RecordCount: decode to count
+			boundary = append(boundary, i)
+		case b.IsDistinct:
+			if b.StartKey == searchKey {
+				total += b.RecordCount
+			}
+			// A distinct block of a smaller key holds no matches
+		default:
+			boundary = append(boundary, i)
+		}
+	}
+
+	partial, err := countBoundaryBlocks(br, boundary, searchKey)
+	if err != nil {
+		return 0, err
+	}
+	total += partial
+
+	if q.config.Verbose {
+		fmt.Fprintf(os.Stderr, "DEBUG: covered COUNT: %d records of %q, %d boundary blocks decoded\n", total, searchKey, len(boundary))
+	}
+	return total, nil
+}
+
+// runNullCount answers the COUNT of a lone IS NULL or IS NOT NULL check on
+// the index column from the index alone: null values are the keys "" and
+// "NULL" (see common.IsNullKey), counted like a covered COUNT, and IS NOT
+// NULL is every other record. It returns false, before printing anything,
+// for old indexes whose blocks don't record their size.
+func (q *QueryEngine) runNullCount(br *common.BlockReader) (bool, error) {
+	var records int64
+	for _, b := range br.Footer.Blocks.All() {
+		if b.RecordCount == 0 {
+			return false, nil
+		}
+		records += b.RecordCount
+	}
+
+	var nulls int64
+	for _, key := range []string{"", "NULL"} {
+		start := q.findStartBlock(br.Footer, key)
+		if start == -1 {
+			continue
+		}
+		n, err := q.countKey(br, key, start)
+		if err != nil {
+			return true, err
+		}
+		nulls += n
+	}
+
+	if q.config.Where.Operator == OpIsNotNull {
+		q.printCount(records - nulls)
+	} else {
+		q.printCount(nulls)
+	}
+	return true, nil
+}
+
+// runRangeCount answers the COUNT of a WHERE clause made only of range
+// predicates and null checks on the index column (see onlyKeyPredicates)
+// from the index alone: blocks the zone maps rule out are skipped, blocks
+// the footer tells the count of are summed (see blockCount), and only the
+// others are decoded, their keys checked against the predicates. It
+// returns false, before printing anything, when a key is truncated (only
+// the CSV holds the value) or for old indexes whose blocks don't record
+// their size.
+func (q *QueryEngine) runRangeCount(br *common.BlockReader) (bool, error) {
+	z := q.zones
+	if z == nil || len(z.keyPreds) == 0 {
+		return false, nil
+	}
+	var total int64
+	decoded := 0
+	for _, b := range br.Footer.Blocks.All() {
+		if b.RecordCount == 0 {
+			return false, nil
+		}
+		if z.skipBlock(b) {
+			continue
+		}
+		if n, ok := z.blockCount(b); ok {
+			total += n
+			continue
+		}
+		if err := q.checkDeadline(); err != nil {
+			return true, err
+		}
+		records, err := br.ReadBlock(b)
+		if err != nil {
+			return true, err
+		}
+		decoded++
+		for i := range records {
+			stored := common.KeyString(&records[i].Key)
+			if common.KeyMayBeTruncated(stored) {
+				return false, nil
+			}
+			val := common.DecodeKey(stored)
+			match := true
+			for _, c := range z.keyPreds {
+				if !c.matchesKey(val) {
+					match = false
+					break
+				}
+			}
+			if match {
+				total++
+			}
+		}
+	}
+
+	if q.config.Verbose {
+		fmt.Fprintf(os.Stderr, "DEBUG: covered range COUNT: %d records, %d of %d blocks decoded\n", total, decoded, br.Footer.Blocks.Len())
+	}
+	q.printCount(total)
+	return true, nil
+}
+
+// printCount prints a count computed from the index, with the semantics of
+// the row path: Offset matches are skipped, and there are at most Limit.
+func (q *QueryEngine) printCount(total int64) {
+	total -= int64(q.config.Offset)
+	if total < 0 {
+		total = 0
+	}
+	if q.config.Limit > 0 && total > int64(q.config.Limit) {
+		total = int64(q.config.Limit)
+	}
+	q.writeCount(q.Writer, total)
+}
+
+// countBoundaryBlocks decodes the given blocks concurrently and counts the
+// records equal to searchKey.
+func countBoundaryBlocks(br *common.BlockReader, blockIdxs []int, searchKey string) (int64, error) {
+	key := []byte(searchKey)
+	countBlock := func(r *common.BlockReader, idx int) (int64, error) {
+		records, err := r.ReadBlock(r.Footer.Blocks.At(idx))
+		if err != nil {
+			return 0, err
+		}
+		lo := sort.Search(len(records), func(i int) bool {
+			return compareRecordKey(&records[i].Key, key) >= 0
+		})
+		hi := sort.Search(len(records), func(i int) bool {
+			return compareRecordKey(&records[i].Key, key) > 0
+		})
+		return int64(hi - lo), nil
+	}
+
+	// Serial when there is nothing to gain or the reader can't be shared
+	if len(blockIdxs) < 2 || br.Fork() == nil {
+		var total int64
+		for _, idx := range blockIdxs {
+			n, err := countBlock(br, idx)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+
+	workers := runtime.NumCPU()
+	if workers > len(blockIdxs) {
+		workers = len(blockIdxs)
+	}
+
+	jobs := make(chan int)
+	var (
+		mu       sync.Mutex
+		total    int64
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := br.Fork() // Own decode buffers per worker
+			var sum int64
+			for idx := range jobs {
+				n, err := countBlock(r, idx)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				sum += n
+			}
+			mu.Lock()
+			total += sum
+			mu.Unlock()
+		}()
+	}
+	for _, idx := range blockIdxs {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return total, nil
+}
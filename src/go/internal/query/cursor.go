@@ -0,0 +1,191 @@
+package query
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Pagination cursors. A row query stopped by its limit returns a cursor
+// (QueryEngine.NextCursor) naming the last row it emitted by its position
+// in the scan order: index key and CSV offset on the index path, which is
+// the order of the index records, or CSV offset for full scans. Passed
+// back as QueryConfig.Cursor, the next page starts right after that row:
+// an index scan binary-searches the blocks for the key, a full scan starts
+// at the next record, so the rows of earlier pages are not read again as
+// with Offset. Index deltas and dirty rows (see deltas.go, updates.go)
+// come after the blocks, so the cursor also records which of them the
+// last row was in.
+
+// Phases of a scan, in the order their rows are emitted.
+const (
+	cursorBlocks = iota // Index blocks, or the CSV for full scans
+	cursorDelta         // Records of the index's delta
+	cursorDirty         // Dirty rows the scan did not check
+)
+
+// cursorFullScan is the source of cursors taken by full scans.
+const cursorFullScan = "fullscan"
+
+// cursor is the decoded form of a cursor string.
+type cursor struct {
+	Query  string `json:"q"`           // Fingerprint of the CSV and filter
+	Source string `json:"s"`           // Index scanned, or cursorFullScan
+	Phase  int    `json:"p,omitempty"` // Phase of the last row
+	Key    []byte `json:"k,omitempty"` // Index key of the last row (index blocks and delta)
+	Offset int64  `json:"o"`           // CSV offset of the last row
+	Line   int64  `json:"l,omitempty"` // Line of the last row (full scans)
+}
+
+// cursorPos is the position of the last row a scan emitted.
+type cursorPos struct {
+	set    bool
+	phase  int
+	key    [64]byte
+	offset int64
+	line   int64
+}
+
+// at records the position of an emitted row; key is nil for full scans
+// and dirty rows.
+func (p *cursorPos) at(phase int, key *[64]byte, offset, line int64) {
+	p.set, p.phase, p.offset, p.line = true, phase, offset, line
+	if key != nil {
+		p.key = *key
+	}
+}
+
+// cursorFingerprint identifies the CSV and filter of a query, so a cursor
+// cannot continue another one. Limit, Offset and the output format may
+// change between pages.
+func (q *QueryEngine) cursorFingerprint() string {
+	where, _ := json.Marshal(q.config.Where)
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s", q.config.CsvPath, where)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// prepareCursor validates QueryConfig.Cursor and decodes it. Called once
+// at the start of Run, before planning mutates Where.
+func (q *QueryEngine) prepareCursor() error {
+	rows := !q.config.CountOnly && q.config.GroupBy == "" && !q.config.Explain && q.config.NotInFile == "" && !q.sampling()
+	if rows {
+		q.cursorQuery = q.cursorFingerprint()
+	}
+	if q.config.Cursor == "" || q.config.Explain {
+		return nil
+	}
+	switch {
+	case !rows:
+		return errorf(ErrBadQuery, "a cursor pages rows, not counts, groups, samples or anti-joins")
+	case q.config.Offset > 0:
+		return errorf(ErrBadQuery, "a cursor replaces the offset: pass one or the other")
+	case q.config.CheckpointPath != "" || q.config.ResumeFrom != "":
+		return errorf(ErrBadQuery, "a cursor does not combine with --checkpoint/--resume-from")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.config.Cursor)
+	if err != nil {
+		return errorf(ErrBadQuery, "invalid cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Source == "" {
+		return errorf(ErrBadQuery, "invalid cursor")
+	}
+	if c.Query != q.cursorQuery {
+		return errorf(ErrBadQuery, "the cursor belongs to a different CSV or filter")
+	}
+	q.cursor = &c
+	return nil
+}
+
+// checkCursorSource fails when the cursor was taken by a scan of another
+// source than the one about to run: the positions would not follow on.
+func (q *QueryEngine) checkCursorSource(source string) error {
+	if q.cursor == nil || q.cursor.Source == source {
+		return nil
+	}
+	return errorf(ErrStaleIndex, "the cursor was taken on %s, the query now reads %s: start again without it", q.cursor.Source, source)
+}
+
+// passed reports whether a row at this position of the scan was in an
+// earlier page. key is nil for full scans and dirty rows.
+func (c *cursor) passed(phase int, key *[64]byte, offset int64) bool {
+	if c == nil || phase != c.Phase {
+		return c != nil && phase < c.Phase
+	}
+	if key != nil {
+		if cmp := compareRecordKey(key, c.Key); cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return offset <= c.Offset
+}
+
+// skipPassed reports whether an index record was in an earlier page. Dirty
+// rows among those are marked checked as the scan of that page did, so they
+// are not emitted again after the blocks.
+func (q *QueryEngine) skipPassed(phase int, rec *common.IndexRecord) bool {
+	if !q.cursor.passed(phase, &rec.Key, rec.Offset) {
+		return false
+	}
+	if u := q.updates; u != nil && !u.deleted[rec.Offset] && (q.zones == nil || q.zones.keyMatches(&rec.Key)) {
+		if _, pending := u.overrides[rec.Offset]; pending {
+			u.seen[rec.Offset] = true
+		}
+	}
+	return true
+}
+
+// setNextCursor records the cursor after the last row emitted by a scan of
+// source that its limit stopped.
+func (q *QueryEngine) setNextCursor(source string, last cursorPos) {
+	if !last.set || q.cursorQuery == "" {
+		return
+	}
+	c := cursor{Query: q.cursorQuery, Source: source, Phase: last.phase, Offset: last.offset}
+	if source == cursorFullScan {
+		c.Line = last.line
+	} else if last.phase != cursorDirty {
+		n := len(last.key)
+		for n > 0 && last.key[n-1] == 0 {
+			n--
+		}
+		c.Key = last.key[:n]
+	}
+	data, _ := json.Marshal(c)
+	q.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorStart returns the block of an index scan over blocks start..end to
+// resume the cursor in: the last one whose first record is not after the
+// cursor's row, or start when there is none. Blocks are searched by their
+// start keys; among those starting with the cursor's key, a run of equal
+// keys, by the offset of their first record.
+func (q *QueryEngine) cursorStart(br *common.BlockReader, start, end int) (int, error) {
+	c := q.cursor
+	key := string(c.Key)
+	blocks := br.Footer.Blocks
+	var err error
+	found := start + sort.Search(end-start+1, func(i int) bool {
+		// true once the block's first record is after the cursor's row
+		b := start + i
+		switch k := blocks.StartKey(b); {
+		case k < key:
+			return false
+		case k > key:
+			return true
+		}
+		records, rerr := br.ReadBlock(blocks.At(b))
+		if rerr != nil || len(records) == 0 {
+			err = rerr
+			return true
+		}
+		return !c.passed(cursorBlocks, &records[0].Key, records[0].Offset)
+	})
+	return max(start, found-1), err
+}
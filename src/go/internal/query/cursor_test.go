@@ -0,0 +1,115 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+// pageAll runs cfg a page of limit rows at a time, following the cursors,
+// and returns the rows of every page.
+func pageAll(t *testing.T, cfg QueryConfig, limit int) []RowRef {
+	t.Helper()
+	cfg.Limit = limit
+	var rows []RowRef
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatal("the cursors never end")
+		}
+		res, q, err := runTest(t, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Rows) > limit {
+			t.Fatalf("page of %d rows, limit %d", len(res.Rows), limit)
+		}
+		rows = append(rows, res.Rows...)
+		if q.NextCursor == "" {
+			return rows
+		}
+		cfg.Cursor = q.NextCursor
+	}
+}
+
+func TestCursorPages(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,name,city\n")
+	for i := range 200 {
+		fmt.Fprintf(&b, "%d,n%d,%s\n", i, i, []string{"Paris", "Rome", "Oslo"}[i%3])
+	}
+	data := b.String()
+	csvPath, dir := newTestCSV(t, data, `["city"]`)
+
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Set(rowOffset(data, "1"), "city", "Paris") // Dirty: now matches
+	um.Set(rowOffset(data, "3"), "city", "Rome")  // Dirty: no longer matches
+	um.Delete(rowOffset(data, "6"))
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		where string
+	}{
+		{"index scan", `{"city":"Paris"}`},
+		{"full scan", `{"operator":"LIKE","column":"name","value":"n1%"}`},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.where)}
+		all, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(all.Rows) < 10 {
+			t.Fatalf("%s: %d rows", tc.name, len(all.Rows))
+		}
+		for _, id := range []string{"1", "3", "6"} {
+			found := slices.ContainsFunc(all.Rows, func(r RowRef) bool { return r.Offset == rowOffset(data, id) })
+			if found != (id == "1") {
+				t.Errorf("%s: row %s found %v", tc.name, id, found)
+			}
+		}
+		for _, limit := range []int{1, 7, 1000} {
+			if got := pageAll(t, cfg, limit); !reflect.DeepEqual(got, all.Rows) {
+				t.Errorf("%s, pages of %d: rows %v, want %v", tc.name, limit, got, all.Rows)
+			}
+		}
+	}
+}
+
+func TestCursorErrors(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testCities, `["city"]`)
+	cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, `{"city":"Paris"}`), Limit: 1}
+	_, q, err := runTest(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.NextCursor == "" {
+		t.Fatal("no cursor after a full page")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(*QueryConfig)
+	}{
+		{"other filter", func(c *QueryConfig) { c.Where = where(t, `{"city":"Rome"}`) }},
+		{"with an offset", func(c *QueryConfig) { c.Offset = 1 }},
+		{"counting", func(c *QueryConfig) { c.CountOnly = true }},
+		{"garbled", func(c *QueryConfig) { c.Cursor = "not-a-cursor" }},
+	} {
+		bad := cfg
+		bad.Cursor = q.NextCursor
+		tc.change(&bad)
+		if _, _, err := runTest(t, bad); !errors.Is(err, ErrBadQuery) {
+			t.Errorf("%s: error %v, want a bad query", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package query
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Index deltas on the index path. Rows written with deltas since the
+// indexes were built have their index records in a delta file per index
+// (see common.DeltaHeader), sorted like the index. An index scan visits the
+// delta's records of its search key after the index blocks, through the
+// same zone, update and filter checks, so the rows come last in the
+// output. A delta counts only while it starts where the indexes of the
+// current metadata end; the next build covers its rows and removes it.
+
+// loadDelta returns the records of the delta of an index, or nil when
+// there is none that extends the current indexes.
+func (q *QueryEngine) loadDelta(indexName string) []common.IndexRecord {
+	meta := q.loadMeta()
+	if meta == nil || q.store == nil || indexName == "" {
+		return nil
+	}
+	data, err := storage.ReadFile(q.store, common.DeltaFileName(q.csvName(), strings.ToLower(indexName)))
+	if err != nil {
+		return nil
+	}
+	h, records, err := common.DecodeDelta(data)
+	if err != nil || !h.Covers(meta) {
+		return nil
+	}
+	return records
+}
+
+// fileDelta returns the records of the delta of the index in file.
+func (q *QueryEngine) fileDelta(file string) []common.IndexRecord {
+	for name, f := range q.manifest() {
+		if f == file {
+			return q.loadDelta(name)
+		}
+	}
+	return nil
+}
+
+// deltaRecords returns the records of searchKey among sorted delta
+// records, or all of them without a search key.
+func deltaRecords(records []common.IndexRecord, searchKey string, hasSearchKey bool) []common.IndexRecord {
+	if !hasSearchKey {
+		return records
+	}
+	key := []byte(searchKey)
+	lo := sort.Search(len(records), func(i int) bool {
+		return compareRecordKey(&records[i].Key, key) >= 0
+	})
+	hi := sort.Search(len(records), func(i int) bool {
+		return compareRecordKey(&records[i].Key, key) > 0
+	})
+	return records[lo:hi]
+}
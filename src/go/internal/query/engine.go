@@ -3,14 +3,18 @@ package query
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,35 +23,161 @@ import (
 
 	"github.com/entreya/csvquery/internal/common"
 	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/status"
+	"github.com/entreya/csvquery/internal/storage"
 	"github.com/entreya/csvquery/internal/updatemgr"
 )
 
 // QueryConfig holds query parameters
 type QueryConfig struct {
 	CsvPath      string     // Path to CSV file
-	IndexDir     string     // Directory containing .didx files
+	IndexDir     string     // Directory containing .cidx files, or remote storage (see storage.Open)
 	Where        *Condition // Root of the filter tree
 	Limit        int        // Max results (0 = no limit)
 	Offset       int        // Skip first N results
+	Last         bool       // Limit and Offset count from the last result: read the index backward (see reverse.go)
+	OrderBy      string     // "key" or an indexed column, then "asc" or "desc": the index order of the rows ("" = ascending key)
 	CountOnly    bool       // Only output count
 	Explain      bool       // Output execution plan
 	GroupBy      string     // Column to group by
 	AggCol       string     // Column to aggregate
 	AggFunc      string     // Aggregation function (count, sum, avg, min, max)
+	AggSort      string     // "key" or "value", then "asc" or "desc": output groups as an ordered array ("" = a map; see aggsort.go)
+	AggLimit     int        // Groups kept after AggSort (0 = all)
+	Pivot        string     // Column whose values become the columns of the GroupBy groups (see pivot.go)
+	Separator    byte       // CSV separator (0 = as indexed, or detected)
 	Verbose      bool       // Output verbose logging
 	DebugHeaders bool       // Debug raw headers detection
+
+	RequireIndex     bool  // Fail instead of falling back to a full scan
+	MaxFullScanBytes int64 // Abort a fallback full scan on CSVs larger than this (0 = no limit)
+	MaxCost          int64 // Refuse queries expected to read more bytes than this (0 = no limit; see admit.go)
+
+	NotInFile   string // Key file for the anti-join (one key per line)
+	NotInColumn string // Column the anti-join keys are matched against
+
+	Format          string // Row output: "offsets" (default) or "csv"
+	OutputPath      string // Write results to this file instead of Writer
+	CheckpointPath  string // Write export progress markers here
+	ResumeFrom      string // Resume an interrupted export from this checkpoint
+	CheckpointEvery int64  // Rows between progress markers (0 = DefaultCheckpointEvery)
+	Cursor          string // Continue after the last row of a previous page (QueryEngine.NextCursor; see cursor.go)
+
+	Timeout time.Duration   // Abort scans running longer than this (0 = no limit)
+	Context context.Context // Abort scans once it is canceled (nil = never)
+
+	Stream     bool                            // Flush each result row to Writer as soon as it is found
+	OnPartial  func(groups map[string]float64) // Receives the groups so far while an aggregation runs (see progress.go)
+	OnProgress func(Progress)                  // Receives the progress of a running scan once a second (see progress.go)
+	Workers    int                             // Goroutines of a full scan (0 = CPU count; see fullscan.go)
+
+	GroupMemoryMB int    // Memory for group-by groups before they spill to disk (0 = DefaultGroupMemoryMB; see spill.go)
+	TempDir       string // Directory for group-by spill files ("" = system temp dir)
+
+	BlockCache *common.BlockCache // Decoded index blocks shared between queries (nil = none)
+	Handles    *common.HandlePool // Files kept open between queries (nil = open each time)
+
+	SampleFraction float64 // Return each matching row with this probability (0 = all; see sample.go)
+	SampleRows     int     // Return this many matching rows, picked at random (0 = all)
+	SampleSeed     int64   // Seed of the sample (0 = random)
+
+	Select []string // Columns of csv rows, by name; "*" = all, virtual ones included (nil = the row as stored; see export.go)
+
+	InSetFile   string  // Key set file for a semi-join (see keyset.go)
+	InSet       *KeySet // Already loaded key set (takes precedence over InSetFile)
+	InSetColumn string  // Column matched against the key set ("" = the set's column)
+
+	// Admit takes an execution slot of a query class (ClassLookup or
+	// ClassScan) for a query expected to read cost bytes (0 = unknown)
+	// before it reads data, blocking until one is free or ctx is done;
+	// release gives it back (nil = no limit; see admit.go)
+	Admit func(ctx context.Context, class string, cost int64) (release func(), err error)
 }
 
+// ErrTimeout is returned (wrapped) when a query runs past QueryConfig.Timeout.
+// Rows written before the deadline are a partial result.
+var ErrTimeout = errors.New("query timed out")
+
+// ErrCanceled is returned (wrapped, with the cause) when QueryConfig.Context
+// is canceled mid-query.
+var ErrCanceled = errors.New("query canceled")
+
+// deadlineCheckRows is how many rows a scan processes between deadline checks.
+const deadlineCheckRows = 4096
+
 // QueryEngine executes queries against disk indexes
 type QueryEngine struct {
 	config          QueryConfig
-	VirtualDefaults []string // Default values for virtual columns
+	VirtualDefaults []string                // Default values for virtual columns
+	computed        []schema.ComputedColumn // Virtual columns computed from the row (see appendVirtual)
 
 	// Writer for output (defaults to stdout)
 	Writer io.Writer
+	// Result receives the results as values instead of Writer as text
+	// (nil = write them; see result.go)
+	Result *Result
 
 	// Updates
 	Updates *updatemgr.UpdateManager
+	updates *rowUpdates          // Pending updates an index scan applies (nil = none, see updates.go)
+	delta   []common.IndexRecord // Records of the search key in the index's delta, visited after its blocks (see deltas.go)
+
+	// UsedIndex is the index the last Run read from ("" = none or full scan)
+	UsedIndex string
+	// Strategy is how the last Run answered, as explain names it
+	// ("" = not recorded for that path)
+	Strategy string
+	// NextCursor continues a row query after the last row of the last Run
+	// when its limit stopped it ("" = no more rows; see cursor.go)
+	NextCursor string
+	// Class is the admission class of the last Run, as the plan tagged it
+	// (ClassLookup or ClassScan; "" = it read no data; see admit.go)
+	Class string
+	// Cost is the bytes the last Run was expected to read when admitted
+	// (0 = unknown, or it read no data)
+	Cost int64
+
+	store    storage.Backend // Index artifacts of IndexDir
+	storeErr error
+
+	schema *schema.Schema // Virtual columns and analyzed column types (nil = none)
+
+	meta         *common.IndexMeta // Index metadata and manifest (nil = none, see loadMeta)
+	metaRead     bool
+	metaReloaded bool // Read again for an index file a newer build retired
+
+	sep byte // CSV separator (see separator)
+
+	groupBucket timeBucket  // Time bucket of GroupBy ("created_at:month")
+	groupLayout string      // Date layout of the GroupBy column ("" = detect)
+	aggOrder    *groupOrder // Order of the groups (nil = a map; see aggsort.go)
+
+	// Export state (see export.go)
+	output      *os.File
+	exportQuery string
+	resume      *ExportCheckpoint
+
+	// Pagination state (see cursor.go)
+	cursor      *cursor
+	cursorQuery string
+
+	// Order state (see reverse.go)
+	orderColumn string // Index the rows must come in the order of ("" = any)
+	descending  bool   // Rows come from the highest key down
+
+	// Scalar MIN/MAX state (see minmax.go)
+	keyPrefix string // Stored key prefix of the filter's equalities
+	keyPos    int    // Position of AggCol in composite keys (-1 = single-column index)
+
+	// Intersection and union state (see intersect.go, union.go)
+	probes       []postingProbe // Posting lists to intersect with the scanned index, or to unite
+	intersect    []int64        // Their shared offsets, sorted (nil = no intersection)
+	unionCovered bool           // The union answers the filter without a post-filter
+
+	release  func()           // Gives back the execution slot (nil = none; see admit.go)
+	deadline time.Time        // Zero when there is no Timeout
+	zones    *zoneFilter      // Block pruning for range predicates (nil = none)
+	activity *status.Activity // Entry in SIGUSR1 status dumps
 }
 
 // NewQueryEngine creates a query engine
@@ -56,17 +186,48 @@ func NewQueryEngine(config QueryConfig) *QueryEngine {
 		config: config,
 		Writer: os.Stdout,
 	}
+	qe.store, qe.storeErr = storage.Open(config.IndexDir)
 
 	// Load Updates
 	if config.CsvPath != "" {
 		if um, err := updatemgr.Load(config.CsvPath); err == nil {
 			qe.Updates = um
 		}
+		if s, err := schema.Load(config.CsvPath); err == nil {
+			qe.schema = s
+			qe.resolveAliases()
+			if config.Where != nil {
+				config.Where.applyTypes(s)
+			}
+		}
 	}
 
 	return qe
 }
 
+// resolveAliases replaces column aliases in the query by the header names
+// they stand for, so indexes, types and filters see the same names whether
+// the query uses an alias or not.
+func (q *QueryEngine) resolveAliases() {
+	if len(q.schema.Aliases) == 0 {
+		return
+	}
+	name := q.schema.ColumnName
+	if q.config.Where != nil {
+		q.config.Where.renameColumns(name)
+	}
+	if column, bucket, ok := strings.Cut(q.config.GroupBy, ":"); ok {
+		q.config.GroupBy = name(column) + ":" + bucket
+	} else if q.config.GroupBy != "" {
+		q.config.GroupBy = name(q.config.GroupBy)
+	}
+	for _, col := range []*string{&q.config.AggCol, &q.config.NotInColumn, &q.config.InSetColumn} {
+		if *col != "" {
+			*col = name(*col)
+		}
+	}
+}
+
 // applyUpdates applies overrides to the row
 func (q *QueryEngine) applyUpdates(cols []string, overrides map[string]string, headers map[string]int) []string {
 	// Create a copy to minimize side effects on internal buffers if needed,
@@ -91,41 +252,162 @@ func (q *QueryEngine) applyUpdates(cols []string, overrides map[string]string, h
 	return cols
 }
 
+// updatedRow returns row, a CSV row of physical columns, with the columns
+// of overrides replaced. The other fields keep their bytes as stored, quotes
+// included; override values are quoted as needed.
+func updatedRow(row []byte, overrides map[string]string, headers map[string]int, physical int, sep byte) []byte {
+	fields := common.SplitFields(row, sep, nil)
+	values := make(map[int]string, len(overrides))
+	for col, val := range overrides {
+		if idx, ok := headers[col]; ok && idx < physical {
+			values[idx] = val
+			for len(fields) <= idx {
+				fields = append(fields, nil)
+			}
+		}
+	}
+	out := make([]byte, 0, len(row)+16)
+	for i, f := range fields {
+		if i > 0 {
+			out = append(out, sep)
+		}
+		if val, ok := values[i]; ok {
+			out = common.AppendField(out, val, sep)
+		} else {
+			out = append(out, f...)
+		}
+	}
+	return out
+}
+
 // Run executes the query and outputs results
 func (q *QueryEngine) Run() error {
 	// 1. Validation & Setup
 	if q.config.CsvPath == "" {
-		return fmt.Errorf("csv path required")
+		return errorf(ErrBadQuery, "csv path required")
+	}
+	if q.storeErr != nil {
+		return q.storeErr
+	}
+	if err := q.resolveGroupBy(); err != nil {
+		return err
+	}
+	if err := q.checkAggSort(); err != nil {
+		return err
+	}
+	if err := q.checkPivot(); err != nil {
+		return err
+	}
+	if err := q.checkSample(); err != nil {
+		return err
+	}
+	if err := q.checkLast(); err != nil {
+		return err
+	}
+	if err := q.checkOrder(); err != nil {
+		return err
+	}
+	if cols := q.foldedColumns(); len(cols) > 0 && q.config.Where != nil {
+		q.config.Where.foldColumns(cols)
 	}
 	totalStart := time.Now()
+	if q.config.Timeout > 0 {
+		q.deadline = totalStart.Add(q.config.Timeout)
+	}
+	q.activity = status.Begin("query", q.statusDetail())
+	defer q.activity.End()
+	q.Class, q.Cost = "", 0
+	defer q.releaseSlot()
+	q.activity.SetPhase("planning")
+
+	if err := q.prepareExport(); err != nil {
+		return err
+	}
+	if q.output != nil {
+		defer func() { _ = q.output.Close() }()
+	}
+	if err := q.prepareCursor(); err != nil {
+		return err
+	}
+
+	// Anti-join: keys from a file that are NOT present in an indexed column
+	if q.config.NotInFile != "" {
+		q.activity.SetPhase("anti-join")
+		return q.runAntiJoin()
+	}
+
+	// Semi-join: rows whose column occurs in a key set from another instance
+	if err := q.attachKeySet(); err != nil {
+		return err
+	}
 
-	// Allow count-only mode without WHERE or GROUP BY (counts all rows)
-	if q.config.Where == nil && q.config.GroupBy == "" && !q.config.CountOnly {
-		return fmt.Errorf("no WHERE conditions or GROUP BY specified")
+	// Allow count-only mode without WHERE or GROUP BY (counts all rows),
+	// samples of all rows, and exports of selected columns
+	if q.config.Where == nil && q.config.GroupBy == "" && !q.config.CountOnly && !q.sampling() && len(q.config.Select) == 0 && q.orderColumn == "" && !q.minMax() {
+		return errorf(ErrBadQuery, "no WHERE conditions or GROUP BY specified")
 	}
 
+	deletes := q.Updates != nil && len(q.Updates.Deleted) > 0
+
 	// Fast path: COUNT(*) without filters - just count newlines in CSV
-	if q.config.CountOnly && q.config.Where == nil && q.config.GroupBy == "" {
+	if q.config.CountOnly && q.config.Where == nil && q.config.GroupBy == "" && !deletes && !q.sampling() {
+		q.activity.SetPhase("count all")
+		q.Strategy = "Count All"
 		return q.runCountAll()
 	}
 
-	// If Updates exist, we need special handling.
-	// For MVP/Robustness, let's use Full Scan if Updates exist for now.
-	if q.Updates != nil && len(q.Updates.Overrides) > 0 {
-		return q.runFullScan()
+	// Pending updates: index scans and group-bys apply them to the rows
+	// they read, but min/max read index keys alone
+	if deletes || (q.Updates != nil && len(q.Updates.Overrides) > 0) {
+		if q.minMax() {
+			return errorf(ErrNoIndex, "%s from index keys does not see pending row updates: write them into the CSV and reindex", strings.ToUpper(q.config.AggFunc))
+		}
+		var err error
+		if q.updates, err = q.newRowUpdates(); err != nil {
+			return fmt.Errorf("failed to read headers: %v", err)
+		}
+	}
+
+	// An OR of indexed equalities: the union of their posting lists
+	if plan, ok := q.planUnion(); ok {
+		if q.config.Explain {
+			q.planCost(plan, ClassLookup)
+			return q.writePlan(plan)
+		}
+		q.UsedIndex, _ = plan["index"].(string)
+		q.Strategy = "Index Union"
+		if err := q.admit(ClassLookup, planRows(plan)); err != nil {
+			return err
+		}
+		return q.runUnion()
 	}
 
 	// 1. Planning Phase
 	// Find the best index (single or composite)
-	indexPath, searchKey, hasSearchKey, plan, err := q.findBestIndex()
+	indexFile, searchKey, hasSearchKey, plan, err := q.findBestIndex()
 	if err != nil {
+		if q.config.Explain {
+			plan := map[string]interface{}{"strategy": "Full Scan", "reason": err.Error()}
+			q.planCost(plan, ClassScan)
+			return q.writePlan(plan)
+		}
+		if q.minMax() {
+			return err // Full scans do not aggregate
+		}
 		// Fallback to Full Scan
+		if err := q.beginFullScan("no suitable index found"); err != nil {
+			return err
+		}
+		q.Strategy = "Full Scan"
 		return q.runFullScan()
 	}
+	if err := q.checkOrderIndex(plan); err != nil {
+		return err
+	}
 
 	// OPTIMIZATION: If the index covers ALL conditions in Where, we can skip the post-filter.
 	// This is critical for COUNT performance (avoids random access CSV reads).
-	if q.config.Where != nil {
+	if q.config.Where != nil && q.config.Where.onlyEqualities() {
 		if covered, ok := plan["covered_columns"].([]string); ok && len(covered) > 0 {
 			// Check if all Where conditions are covered (case-insensitive)
 			allCovered := true
@@ -149,6 +431,9 @@ func (q *QueryEngine) Run() error {
 				}
 			}
 
+			if truncated, _ := plan["key_truncated"].(bool); truncated {
+				allCovered = false
+			}
 			if allCovered {
 				// Perfect match! Disable post-filter.
 				// For Count(*) this means we never touch the CSV file (only index).
@@ -168,73 +453,117 @@ func (q *QueryEngine) Run() error {
 		}
 	}
 
+	indexName, _ := plan["index"].(string)
+	q.delta = deltaRecords(q.loadDelta(indexName), searchKey, hasSearchKey)
+	if q.updates != nil {
+		plan["pending_rows"] = len(q.updates.deleted) + len(q.updates.overrides)
+		plan["dirty_rows"] = len(q.updates.dirty)
+	}
+	if len(q.delta) > 0 {
+		plan["delta_rows"] = len(q.delta)
+	}
+	if q.backward() {
+		plan["backward"] = true
+	}
 	if q.config.Explain {
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(plan)
+		q.planCost(plan, ClassLookup)
+		return q.writePlan(plan)
 	}
 
 	// 2. Execution Phase (Index Lookup)
+	if err := q.admit(ClassLookup, planRows(plan)); err != nil {
+		return err
+	}
 	execStart := time.Now()
+	q.UsedIndex, _ = plan["index"].(string)
+	q.Strategy, _ = plan["strategy"].(string)
 
-	// Initialize BlockReader using mmap (zero-copy, no syscalls per block)
-	br, err := common.NewBlockReaderMmap(indexPath)
+	// Initialize BlockReader (mmap for local indexes: zero-copy, no syscalls per block)
+	br, err := q.openBlockReader(indexFile)
 	if err != nil {
 		return fmt.Errorf("failed to init block reader: %w", err)
 	}
 	defer br.Cleanup()
 
-	// Try bloom filter first (only if we have a valid search key)
+	q.zones = q.newZoneFilter(indexName, br.Footer)
+
+	// Try bloom filter first (only if we have a valid search key). Rows
+	// updated to the key since the index was built are found by their
+	// pending updates alone, and rows written since by the delta.
+	dirty := (q.updates != nil && len(q.updates.dirty) > 0) || len(q.delta) > 0
+	absent := false
 	if hasSearchKey {
-		bloomPath := indexPath + ".bloom"
-		if _, err := os.Stat(bloomPath); err == nil {
-			bloom, bloomCleanup, err := common.LoadBloomFilterMmap(bloomPath)
-			if err == nil {
-				if bloomCleanup != nil {
-					defer bloomCleanup()
-				}
-				if !bloom.MightContain(searchKey) {
-					// Key definitely not in index
-					if q.config.CountOnly {
-						fmt.Println("0")
-					}
-					// Metrics even for 0 result
-					q.printMetrics(totalStart, execStart, time.Now())
-					return nil
+		if bloom, bloomCleanup, err := q.openBloom(indexFile + ".bloom"); err == nil {
+			defer bloomCleanup()
+			absent = !bloom.MightContain(searchKey)
+			if absent && !dirty {
+				// Key definitely not in index
+				if q.config.CountOnly {
+					q.writeCount(q.Writer, 0)
 				}
+				// Metrics even for 0 result
+				q.printMetrics(totalStart, execStart, time.Now())
+				return nil
 			}
 		}
 	}
 
 	// Identify Candidate Blocks
 	startBlockIdx := 0
-	endBlockIdx := len(br.Footer.Blocks) - 1
+	endBlockIdx := br.Footer.Blocks.Len() - 1
 
 	if hasSearchKey {
-		// Binary search in Sparse Index to find the first block that COULD contain the key
-		startBlockIdx = q.findStartBlock(br.Footer, searchKey)
-		if startBlockIdx == -1 {
+		// Binary search in Sparse Index to find the blocks that COULD contain the key
+		startBlockIdx, endBlockIdx = q.findBlockRange(br.Footer, searchKey)
+		if startBlockIdx == -1 && !dirty {
 			if q.config.CountOnly {
-				fmt.Println("0")
+				q.writeCount(q.Writer, 0)
 			}
 			q.printMetrics(totalStart, execStart, time.Now())
 			return nil
 		}
-		endBlockIdx = len(br.Footer.Blocks) - 1
+	}
+	if absent || startBlockIdx == -1 {
+		startBlockIdx, endBlockIdx = 0, -1 // No blocks: the dirty and delta rows alone
+	}
+
+	if len(q.probes) > 0 {
+		q.activity.SetPhase("index intersection")
+		if err := q.loadIntersection(); err != nil {
+			return err
+		}
 	}
 
 	// execTime := time.Since(execStart)
 	// fetchStart := time.Now()
 
 	// 3. Fetching Phase (Scanning Blocks & Output)
-	// Dispatch to Aggregation or Standard Output
+	// Dispatch to Aggregation or Standard Output. Counts from index keys
+	// alone do not see pending updates, nor delta rows but for the covered
+	// count.
+	if q.config.CountOnly && q.config.GroupBy == "" && q.config.Where != nil && q.updates == nil && len(q.delta) == 0 &&
+		q.config.Where.isNullCheck() && strings.EqualFold(q.config.Where.Column, indexName) {
+		q.activity.SetPhase("null count")
+		if ok, err := q.runNullCount(br); ok || err != nil {
+			return err
+		}
+	}
+	if q.config.CountOnly && q.config.GroupBy == "" && !hasSearchKey && !q.sampling() && q.updates == nil && len(q.delta) == 0 &&
+		q.config.Where != nil && q.config.Where.onlyKeyPredicates(indexName) {
+		q.activity.SetPhase("covered range count")
+		if ok, err := q.runRangeCount(br); ok || err != nil {
+			return err
+		}
+	}
 	var runErr error
-	if q.config.GroupBy != "" {
+	if q.config.CountOnly && q.config.Where == nil && q.config.GroupBy == "" && hasSearchKey && !q.sampling() && q.updates == nil {
+		q.activity.SetPhase("covered count")
+		runErr = q.runCoveredCount(br, searchKey, startBlockIdx, endBlockIdx)
+	} else if q.config.GroupBy != "" || q.minMax() {
 		// Use plan["index"] to check if we are scanning the GroupBy index
-		indexName, _ := plan["index"].(string)
 		runErr = q.runAggregation(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx, indexName)
 	} else {
-		runErr = q.runStandardOutput(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx)
+		runErr = q.runStandardOutput(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx, indexFile)
 	}
 
 	if runErr != nil {
@@ -249,42 +578,70 @@ func (q *QueryEngine) Run() error {
 	return nil
 }
 
+// resolveGroupBy splits a time bucket off the GroupBy column.
+func (q *QueryEngine) resolveGroupBy() error {
+	column, bucket, err := parseGroupBy(q.config.GroupBy)
+	if err != nil {
+		return err
+	}
+	q.config.GroupBy, q.groupBucket = column, bucket
+	if info, ok := q.columnInfo(column); ok && info.Type == schema.TypeDate {
+		q.groupLayout = info.Format
+	}
+	return nil
+}
+
 func (q *QueryEngine) printMetrics(totalStart, execStart, fetchStart time.Time) {
 	// No-op
 }
 
+// checkDeadline returns ErrTimeout once the query's Timeout has elapsed,
+// or ErrCanceled once its Context is canceled. Scans call it per block
+// (index) or every deadlineCheckRows rows (CSV).
+func (q *QueryEngine) checkDeadline() error {
+	if !q.deadline.IsZero() && time.Now().After(q.deadline) {
+		return fmt.Errorf("%w after %v", ErrTimeout, q.config.Timeout)
+	}
+	if q.config.Context != nil {
+		if err := context.Cause(q.config.Context); err != nil {
+			return fmt.Errorf("%w: %v", ErrCanceled, err)
+		}
+	}
+	return nil
+}
+
 // runCountAll counts all data rows in the CSV file (excluding header)
 // This is an optimized path for COUNT(*) without any filters.
 // First tries to count from index metadata (instant), then falls back to CSV scan.
 func (q *QueryEngine) runCountAll() error {
 	// OPTIMIZATION: Try counting from index metadata first (O(blocks) instead of O(file))
 	if count, ok := q.tryCountFromIndex(); ok {
-		_, _ = fmt.Fprintln(q.Writer, count)
+		q.writeCount(q.Writer, count)
 		return nil
 	}
 
 	// Fallback: Count newlines in CSV file
+	if err := q.admit(ClassScan, -1); err != nil {
+		return err
+	}
 	return q.runCountAllViaCsv()
 }
 
 // tryCountFromIndex attempts to count records by summing RecordCount from index blocks.
 // Returns (count, true) if successful, (0, false) if no usable index.
 func (q *QueryEngine) tryCountFromIndex() (int64, bool) {
-	if q.config.IndexDir == "" {
+	if q.config.IndexDir == "" || q.store == nil {
 		return 0, false
 	}
 
 	// Find any .cidx file for this CSV
-	csvBase := filepath.Base(q.config.CsvPath)
-	csvBase = strings.TrimSuffix(csvBase, filepath.Ext(csvBase))
-	pattern := filepath.Join(q.config.IndexDir, csvBase+"_*.cidx")
-	matches, err := filepath.Glob(pattern)
-	if err != nil || len(matches) == 0 {
+	matches := q.indexFiles()
+	if len(matches) == 0 {
 		return 0, false
 	}
 
-	// Open first available index using mmap
-	br, err := common.NewBlockReaderMmap(matches[0])
+	// Open first available index (mmap when local)
+	br, err := q.openBlockReader(matches[0])
 	if err != nil {
 		return 0, false
 	}
@@ -292,39 +649,39 @@ func (q *QueryEngine) tryCountFromIndex() (int64, bool) {
 
 	// Sum RecordCount from all blocks
 	var total int64
-	for _, block := range br.Footer.Blocks {
+	for _, block := range br.Footer.Blocks.All() {
 		if block.RecordCount == 0 {
 			// Old index format without RecordCount - fall back to CSV scan
 			return 0, false
 		}
 		total += block.RecordCount
 	}
+	total += int64(len(q.fileDelta(matches[0]))) // Rows written since the build
 
 	if q.config.Verbose {
 		fmt.Fprintf(os.Stderr, "DEBUG: COUNT via index %s: %d records from %d blocks\n",
-			filepath.Base(matches[0]), total, len(br.Footer.Blocks))
+			matches[0], total, br.Footer.Blocks.Len())
 	}
 
 	return total, true
 }
 
-// runCountAllViaCsv counts newlines in CSV file using parallel workers.
+// runCountAllViaCsv counts the records of the CSV file using parallel
+// workers. Parts start on record boundaries and newlines inside quoted
+// fields are not counted, so multiline fields count once.
 func (q *QueryEngine) runCountAllViaCsv() error {
-	f, err := os.Open(q.config.CsvPath)
-	if err != nil {
-		return fmt.Errorf("failed to open CSV: %w", err)
+	if meta := q.loadMeta(); meta != nil && meta.Format != "" {
+		q.writeCount(q.Writer, meta.TotalRows) // Parquet and Arrow rows hold no newlines to count
+		return nil
 	}
-	defer func() { _ = f.Close() }()
-
-	// Memory-map the file
-	data, err := common.MmapFile(f)
+	data, release, err := q.mapCSV()
 	if err != nil {
-		return fmt.Errorf("failed to mmap CSV: %w", err)
+		return fmt.Errorf("failed to open CSV: %w", q.requireCSV(err))
 	}
-	defer func() { _ = common.MunmapFile(data) }()
+	defer release()
 
 	if len(data) == 0 {
-		_, _ = fmt.Fprintln(q.Writer, 0)
+		q.writeCount(q.Writer, 0)
 		return nil
 	}
 
@@ -333,80 +690,99 @@ func (q *QueryEngine) runCountAllViaCsv() error {
 	if workers > 16 {
 		workers = 16
 	}
-	chunkSize := len(data) / workers
-	if chunkSize < 1024*1024 { // Minimum 1MB per chunk
+	if len(data)/workers < 1024*1024 { // Minimum 1MB per chunk
 		workers = 1
-		chunkSize = len(data)
 	}
+	bounds := common.SplitRecords(data, 0, len(data), workers)
 
 	var totalCount int64
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 
 	for i := 0; i < workers; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if i == workers-1 {
-			end = len(data)
-		}
-
 		wg.Add(1)
 		go func(chunk []byte) {
 			defer wg.Done()
-			// bytes.Count is highly optimized (SIMD/Assembly)
-			c := int64(bytes.Count(chunk, []byte{'\n'}))
+			c := common.CountRecords(chunk)
 			mu.Lock()
 			totalCount += c
 			mu.Unlock()
-		}(data[start:end])
+		}(data[bounds[i]:bounds[i+1]])
 	}
 
 	wg.Wait()
 
-	// Handle last line if no newline at EOF
-	if len(data) > 0 && data[len(data)-1] != '\n' {
-		totalCount++
-	}
-
 	// Subtract 1 for header row (assuming header exists if file not empty)
-	// Logic matches previous implementation: count-- if count > 0
 	if totalCount > 0 {
 		totalCount--
 	}
 
-	_, _ = fmt.Fprintln(q.Writer, totalCount)
+	q.writeCount(q.Writer, totalCount)
 	return nil
 }
 
+// openBlockReader opens an index of the query's index directory, from the
+// handle pool if there is one, reading blocks through the block cache.
+func (q *QueryEngine) openBlockReader(name string) (*common.BlockReader, error) {
+	var br *common.BlockReader
+	var err error
+	if q.config.Handles != nil {
+		br, err = q.config.Handles.OpenIndex(q.store, name)
+	} else {
+		br, err = common.OpenBlockReader(q.store, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	br.SetCache(q.config.BlockCache)
+	return br, nil
+}
+
+// openBloom opens the bloom filter of an index, from the handle pool if
+// there is one. The cleanup func is never nil.
+func (q *QueryEngine) openBloom(name string) (*common.BloomFilter, func(), error) {
+	if q.config.Handles != nil {
+		return q.config.Handles.OpenBloom(q.store, name)
+	}
+	return common.OpenBloomFilter(q.store, name)
+}
+
 // findStartBlock finds the FIRST block that might contain the key.
 func (q *QueryEngine) findStartBlock(sparse common.SparseIndex, key string) int {
-	left, right := 0, len(sparse.Blocks)-1
-	result := -1
-
-	// Binary search for FIRST block where StartKey <= key
-	for left <= right {
-		mid := (left + right) / 2
-		if sparse.Blocks[mid].StartKey <= key {
-			result = mid
-			left = mid + 1 // Continue searching right for rightmost match
-		} else {
-			right = mid - 1
-		}
-	}
+	start, _ := q.findBlockRange(sparse, key)
+	return start
+}
 
-	if result == -1 {
-		return -1 // Key is smaller than all blocks
+// findBlockRange finds the first and last blocks that might contain the key,
+// or -1, -1 when none can. Both are binary searches of the start keys.
+func (q *QueryEngine) findBlockRange(sparse common.SparseIndex, key string) (int, int) {
+	blocks := sparse.Blocks
+	end := blocks.UpperBound(key) - 1
+	if end == -1 {
+		return -1, -1 // Key is smaller than all blocks
 	}
 
-	// Backtrack to first block with this StartKey
-	targetKey := sparse.Blocks[result].StartKey
-	if targetKey == key {
-		for result > 0 && sparse.Blocks[result-1].StartKey == key {
-			result--
-		}
+	// A run of equal keys can span blocks, so the block before the first one
+	// starting with the key may still end with it (the last block starting
+	// below the key, when none starts with it). Its EndKey tells, when the
+	// index records one.
+	start := blocks.LowerBound(key)
+	if start > 0 && (!sparse.ZoneMaps || blocks.EndKey(start-1) >= key) {
+		start--
+	}
+	if start > end {
+		return -1, -1 // The key falls between two blocks
 	}
+	return start, end
+}
 
-	return result
+// wholeBlock reports whether every record of a block is of the search key,
+// or of any key without one.
+func wholeBlock(meta common.BlockMeta, searchKey string, hasSearchKey bool) bool {
+	if !hasSearchKey {
+		return true
+	}
+	return meta.StartKey == searchKey && (meta.IsDistinct || meta.EndKey != "" && meta.EndKey == searchKey)
 }
 
 // compareRecordKey compares a fixed [64]byte index key (null-padded) against a search key.
@@ -421,7 +797,7 @@ func compareRecordKey(key *[64]byte, searchKey []byte) int {
 }
 
 // runStandardOutput outputs matching records via stdout
-func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string, hasSearchKey bool, startBlockIdx, endBlockIdx int) error {
+func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string, hasSearchKey bool, startBlockIdx, endBlockIdx int, source string) error {
 	// Read Headers & Setup Context for filtering
 	headers, virtualDefaults, err := q.getHeaderMap()
 	if err != nil {
@@ -434,28 +810,19 @@ func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string
 		q.config.Where.ResolveColumns(headers)
 	}
 
-	var csvF *os.File
-	var csvData []byte
-
-	// Helper to load CSV only when needed
-	ensureCsvLoaded := func() error {
-		if csvData != nil {
+	// Rows are opened only when needed
+	var rows rowSource
+	ensureRowsOpen := func() error {
+		if rows != nil {
 			return nil
 		}
 		var err error
-		csvF, err = os.Open(q.config.CsvPath)
-		if err != nil {
-			return err
-		}
-		csvData, err = common.MmapFile(csvF)
+		rows, err = q.openRows()
 		return err
 	}
 	defer func() {
-		if csvData != nil {
-			_ = common.MunmapFile(csvData)
-		}
-		if csvF != nil {
-			_ = csvF.Close()
+		if rows != nil {
+			rows.close()
 		}
 	}()
 
@@ -471,21 +838,165 @@ func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string
 
 	count := int64(0)
 	skipped := 0
-	limitReached := false
+	limitReached := false // Or the scan is past the search key
+	full := false         // The limit is reached
 
-	// Use 64KB buffer for faster IO, especially on Windows pipes
-	writer := bufio.NewWriterSize(q.Writer, 65536)
+	if q.backward() && q.updates != nil && len(q.updates.dirty) > 0 {
+		return errorf(ErrBadQuery, "the index cannot be read backward while pending updates change filtered columns: write them into the CSV and reindex")
+	}
+
+	// Emitter buffers 64KB for faster IO, especially on Windows pipes
+	emitter, err := q.newRowEmitter(source)
+	if err != nil {
+		return err
+	}
+	writer := emitter.w
 	defer func() { _ = writer.Flush() }()
+	sep := q.separator()
+
+	// A cursor resumes the scan after the last row of its page; dirty rows
+	// need the blocks before it read, to know which were checked there
+	if err := q.checkCursorSource(q.UsedIndex); err != nil {
+		return err
+	}
+	if q.cursor != nil && (q.updates == nil || len(q.updates.dirty) == 0) {
+		if q.cursor.Phase > cursorBlocks {
+			startBlockIdx, endBlockIdx = 0, -1
+		} else if startBlockIdx <= endBlockIdx {
+			if startBlockIdx, err = q.cursorStart(br, startBlockIdx, endBlockIdx); err != nil {
+				return err
+			}
+		}
+	}
+	phase := cursorBlocks
+	var last cursorPos // The last row emitted, for the next cursor
 
 	searchKeyBytes := []byte(searchKey)
 	colsBuf := make([]string, 0, maxCol+1)
+	proj := q.newRowProjector(maxCol)
+
+	prog := q.startProgress("Index Scan", scanBytes(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx))
+	defer prog.finish()
+	var scanned int64
+	sample := q.newSampler()
+	var tail []tailRow // Rows of a backward scan, last first
+
+	// emit outputs a matching row, at key (nil for dirty rows) in the
+	// index; done is true once the limit is reached
+	emit := func(key *[64]byte, offset, line int64, row, raw []byte) (done bool, err error) {
+		if sample.reservoir() {
+			sample.offer(offset, line, row, raw)
+			return false, nil
+		}
+		if skipped < q.config.Offset {
+			skipped++
+			return false, nil
+		}
+		count++
+		switch {
+		case q.config.Last:
+			tail = append(tail, tailRow{offset: offset, line: line, row: bytes.Clone(row), raw: bytes.Clone(raw)})
+		case !q.config.CountOnly:
+			if err := emitter.Emit(offset, line, row, raw); err != nil {
+				return false, err
+			}
+		}
+		if q.config.Limit > 0 {
+			last.at(phase, key, offset, line)
+		}
+		return q.config.Limit > 0 && count >= int64(q.config.Limit), nil
+	}
+	// updated returns the row as it reads after pending updates, for CSV
+	// output of whole rows
+	updated := func(offset int64, row []byte) []byte {
+		if override := q.updates.overrides[offset]; override != nil && emitter.csvRows {
+			return updatedRow(row, override, q.updates.headers, len(q.updates.proj.used)-len(q.VirtualDefaults), sep)
+		}
+		return row
+	}
+	// visit emits the row of a record of the search key if it passes the
+	// filter, as it reads after pending updates
+	visit := func(rec *common.IndexRecord) (done bool, err error) {
+		if q.zones != nil && !q.zones.keyMatches(&rec.Key) {
+			return false, nil
+		}
+		if !q.intersects(rec.Offset) {
+			return false, nil
+		}
+
+		// Rows with pending updates are filtered as they now are
+		pending := false
+		if q.updates != nil {
+			if q.updates.deleted[rec.Offset] {
+				return false, nil
+			}
+			_, pending = q.updates.overrides[rec.Offset]
+		}
+
+		// Read CSV Line (a reservoir reads the rows it keeps at the end)
+		var row, raw []byte
+		if q.config.Where != nil || pending || (!q.config.CountOnly && !sample.reservoir()) {
+			if err := ensureRowsOpen(); err != nil {
+				return false, err
+			}
+			if raw, err = rows.rowAt(rec.Offset); err != nil {
+				return false, err
+			}
+			row = bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte{'\n'}), []byte{'\r'})
+
+			if pending {
+				if !q.updatedRowMatches(rec.Offset, row) {
+					return false, nil
+				}
+				row = updated(rec.Offset, row)
+			} else if q.config.Where != nil {
+				// Post-Filter (Where) — zero-allocation path
+				// Extract cols for filtering
+				cols := proj.extract(row, colsBuf)
+
+				// Inject Virtual Columns
+				cols = q.appendVirtual(cols)
+
+				// Update reuse buffer
+				colsBuf = cols
+				if !q.config.Where.EvaluateFast(cols) {
+					return false, nil
+				}
+			}
+		}
+		return emit(&rec.Key, rec.Offset, rec.Line, row, raw)
+	}
+
+	if q.backward() {
+		err := q.scanBackward(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx, visit, func(scanned int64) { prog.update(scanned, count) })
+		if err != nil {
+			return err
+		}
+		for i := len(tail) - 1; i >= 0; i-- {
+			if err := emitter.Emit(tail[i].offset, tail[i].line, tail[i].row, tail[i].raw); err != nil {
+				return err
+			}
+		}
+		return emitter.Finish()
+	}
+
+	// Without a filter to check, blocks all of the search key are skipped
+	// whole while the offset lasts, and the limit is read from the next
+	// (see common.BlockReader.ReadBlockPrefix)
+	direct := q.config.Where == nil && q.updates == nil && q.zones == nil && sample == nil && q.cursor == nil && q.intersect == nil
 
 	for i := startBlockIdx; i <= endBlockIdx; i++ {
 		if limitReached {
 			break
 		}
 
-		blockMeta := br.Footer.Blocks[i]
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+		prog.update(scanned, count)
+
+		blockMeta := br.Footer.Blocks.At(i)
+		scanned += blockMeta.Length
 		if q.config.Verbose {
 			fmt.Fprintf(os.Stderr, "DEBUG: Processing Block %d: Key=%s Len=%d\n", i, blockMeta.StartKey, blockMeta.Length)
 		}
@@ -493,8 +1004,23 @@ func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string
 		if hasSearchKey && blockMeta.StartKey > searchKey {
 			break
 		}
+		if q.zones != nil && q.zones.skipBlock(blockMeta) {
+			continue
+		}
+		if sample.skipBlock(blockMeta.RecordCount) {
+			continue
+		}
+		if direct && wholeBlock(blockMeta, searchKey, hasSearchKey) && skipped+int(blockMeta.RecordCount) <= q.config.Offset {
+			skipped += int(blockMeta.RecordCount)
+			continue
+		}
 
-		records, err := br.ReadBlock(blockMeta)
+		var records []common.IndexRecord
+		if direct && q.config.Limit > 0 && (!hasSearchKey || blockMeta.StartKey == searchKey) {
+			records, err = br.ReadBlockPrefix(blockMeta, q.config.Offset-skipped+q.config.Limit-int(count))
+		} else {
+			records, err = br.ReadBlock(blockMeta)
+		}
 		if err != nil {
 			return err
 		}
@@ -502,6 +1028,9 @@ func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string
 		for index := range records {
 			// use pointer to avoid copying 80 bytes
 			rec := &records[index]
+			if !sample.take() {
+				continue
+			}
 			if hasSearchKey {
 				cmp := compareRecordKey(&rec.Key, searchKeyBytes)
 				if cmp < 0 {
@@ -512,68 +1041,92 @@ func (q *QueryEngine) runStandardOutput(br *common.BlockReader, searchKey string
 					break
 				}
 			}
+			if q.cursor != nil && q.skipPassed(phase, rec) {
+				continue
+			}
+			if full, err = visit(rec); err != nil {
+				return err
+			}
+			if full {
+				limitReached = true
+				break
+			}
+		}
+	}
 
-			// Read CSV Line
-			if q.config.Where != nil || !q.config.CountOnly {
-				if err := ensureCsvLoaded(); err != nil {
-					return err
-				}
-				// fmt.Fprintf(os.Stderr, "DEBUG: csvData len=%d cap=%d ptr=%p path=%s\n", len(csvData), cap(csvData), csvData, q.config.CsvPath)
-				if len(csvData) == 0 {
-					return fmt.Errorf("CRITICAL: csvData is empty! Path: %s", q.config.CsvPath)
-				}
-
-				rowEnd := bytes.IndexByte(csvData[rec.Offset:], '\n')
-				if rowEnd == -1 {
-					rowEnd = len(csvData) - int(rec.Offset)
-				}
-				row := csvData[rec.Offset : int(rec.Offset)+rowEnd]
-				row = bytes.TrimSuffix(row, []byte{'\r'})
-
-				// Post-Filter (Where) — zero-allocation path
-				if q.config.Where != nil {
-					// Extract cols for filtering
-					cols := extractCols(row, ',', maxCol, colsBuf)
-
-					// Inject Virtual Columns
-					if len(q.VirtualDefaults) > 0 {
-						cols = append(cols, q.VirtualDefaults...)
-					}
-
-					if !q.config.Where.EvaluateFast(cols) {
-						colsBuf = cols
-						continue
-					}
-					// Update reuse buffer
-					colsBuf = cols
-				}
+	// Rows written since the build, from the index's delta (see deltas.go)
+	phase = cursorDelta
+	for i := 0; i < len(q.delta) && !full; i++ {
+		if i%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
 			}
+		}
+		if !sample.take() {
+			continue
+		}
+		if q.cursor != nil && q.skipPassed(phase, &q.delta[i]) {
+			continue
+		}
+		if full, err = visit(&q.delta[i]); err != nil {
+			return err
+		}
+	}
 
-			if skipped < q.config.Offset {
-				skipped++
+	// Dirty rows the scan did not check may match under their new values
+	phase = cursorDirty
+	if q.updates != nil && !full {
+		for _, offset := range q.updates.dirty {
+			if q.updates.seen[offset] || q.updates.deleted[offset] || !sample.take() || q.cursor.passed(phase, nil, offset) {
 				continue
 			}
-
-			count++
-			if !q.config.CountOnly {
-				_, _ = fmt.Fprintf(writer, "%d,%d\n", rec.Offset, rec.Line)
+			if err := ensureRowsOpen(); err != nil {
+				return err
 			}
-
-			if q.config.Limit > 0 && count >= int64(q.config.Limit) {
-				limitReached = true
+			raw, err := rows.rowAt(offset)
+			if err != nil {
+				return err
+			}
+			row := bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte{'\n'}), []byte{'\r'})
+			if !q.updatedRowMatches(offset, row) {
+				continue
+			}
+			// Line 0, as index records have no line numbers either
+			if full, err = emit(nil, offset, 0, updated(offset, row), raw); err != nil {
+				return err
+			}
+			if full {
 				break
 			}
 		}
 	}
 
+	if sample.reservoir() {
+		count, err = q.emitSample(sample, emitter, func(offset int64) ([]byte, error) {
+			if err := ensureRowsOpen(); err != nil {
+				return nil, err
+			}
+			return rows.rowAt(offset)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	if q.config.CountOnly {
-		_, _ = fmt.Fprintln(writer, count)
+		q.writeCount(writer, count)
 	}
-	return nil
+	if full {
+		q.setNextCursor(q.UsedIndex, last)
+	}
+	return emitter.Finish()
 }
 
 // runAggregation performs GroupBy and Aggregation
 func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, hasSearchKey bool, startBlockIdx, endBlockIdx int, indexName string) error {
+	if q.minMax() {
+		q.activity.SetPhase("min/max keys")
+		return q.runMinMax(br) // See minmax.go
+	}
 	headers, virtualDefaults, err := q.getHeaderMap()
 	if err != nil {
 		return fmt.Errorf("failed to read headers: %v", err)
@@ -586,7 +1139,8 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 	}
 
 	// Check Optimization Eligibility
-	isGroupingByIndex := strings.EqualFold(indexName, q.config.GroupBy)
+	isGroupingByIndex := strings.EqualFold(indexName, q.config.GroupBy) && q.indexCollation(indexName) != common.CollationCI && // Folded keys are not the values
+		q.config.Pivot == "" // Pivot groups need each row's pivot value
 
 	// Pre-calculate if we can perform metadata-only aggregation
 	// We can skip scan if:
@@ -597,28 +1151,19 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 
 	// fmt.Fprintf(os.Stderr, "DEBUG-GROUPBY: indexName=%q, GroupBy=%q, AggFunc=%q, isDistinctMode=%v, canSkipScan=%v, blocks=%d\n", ...
 
-	var csvF *os.File
-	var csvData []byte
-
-	// Helper to load CSV only when needed
-	ensureCsvLoaded := func() error {
-		if csvData != nil {
+	// Rows are opened only when needed
+	var rows rowSource
+	ensureRowsOpen := func() error {
+		if rows != nil {
 			return nil
 		}
 		var err error
-		csvF, err = os.Open(q.config.CsvPath)
-		if err != nil {
-			return err
-		}
-		csvData, err = common.MmapFile(csvF)
+		rows, err = q.openRows()
 		return err
 	}
 	defer func() {
-		if csvData != nil {
-			_ = common.MunmapFile(csvData)
-		}
-		if csvF != nil {
-			_ = csvF.Close()
+		if rows != nil {
+			rows.close()
 		}
 	}()
 
@@ -630,22 +1175,25 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 		for k := range headers {
 			avail = append(avail, k)
 		}
-		return fmt.Errorf("column '%s' not found. Available: %v", q.config.GroupBy, avail)
+		return errorf(ErrBadQuery, "column '%s' not found. Available: %v", q.config.GroupBy, avail)
 	}
 	aggC := 0
 	if q.config.AggCol != "" && q.config.AggCol != "*" {
 		var ok bool
 		aggC, ok = headers[strings.ToLower(q.config.AggCol)]
 		if !ok {
-			return fmt.Errorf("aggregation column '%s' not found", q.config.AggCol)
+			return errorf(ErrBadQuery, "aggregation column '%s' not found", q.config.AggCol)
+		}
+	}
+	pivotC := -1
+	if q.config.Pivot != "" {
+		if pivotC, ok = headers[strings.ToLower(q.config.Pivot)]; !ok {
+			return errorf(ErrBadQuery, "pivot column '%s' not found", q.config.Pivot)
 		}
 	}
 	isCountOnly := q.config.AggFunc == "count"
 
-	maxCol := groupC
-	if aggC > maxCol {
-		maxCol = aggC
-	}
+	maxCol := max(groupC, aggC, pivotC)
 	// If filtering is enabled, we must extract columns involved in the filter.
 	if q.config.Where != nil {
 		for _, idx := range headers {
@@ -655,38 +1203,143 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 		}
 	}
 
-	results := make(map[string]float64)
-	counts := make(map[string]int64)
+	groups := q.newGroupTable()
+	defer groups.cleanup()
 
 	limitReached := false
 
 	searchKeyBytes := []byte(searchKey)
 	colsBuf := make([]string, 0, maxCol+1)
+	read := []int{groupC, pivotC}
+	if !isCountOnly {
+		read = append(read, aggC)
+	}
+	proj := q.newRowProjector(maxCol, read...)
+
+	prog := q.startProgress("Aggregation", scanBytes(br, searchKey, hasSearchKey, startBlockIdx, endBlockIdx))
+	defer prog.finish()
+	var scanned, matched int64
+	lastPartial := time.Now()
+
+	// add adds a row's columns to its group
+	add := func(cols []string) error {
+		var groupVal string
+		if groupC < len(cols) {
+			groupVal = q.groupBucket.key(q.groupLayout, cols[groupC])
+		}
+		if pivotC >= 0 {
+			var pivotVal string
+			if pivotC < len(cols) {
+				pivotVal = cols[pivotC]
+			}
+			groupVal = pivotKey(groupVal, pivotVal)
+		}
+		matched++
+		var val float64
+		if !isCountOnly && aggC < len(cols) {
+			val, _ = strconv.ParseFloat(cols[aggC], 64)
+		}
+		return groups.add(groupVal, val, 1)
+	}
+	// readRow returns the row at offset, without its line ending
+	readRow := func(offset int64) ([]byte, error) {
+		if err := ensureRowsOpen(); err != nil {
+			return nil, err
+		}
+		row, err := rows.rowAt(offset)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(bytes.TrimSuffix(row, []byte{'\n'}), []byte{'\r'}), nil
+	}
+	// addUpdated adds a row with pending updates to its group if it passes
+	// the filter as it now reads (the whole filter, even where the index
+	// covers it)
+	addUpdated := func(offset int64, row []byte) error {
+		cols := q.updatedColumns(offset, row)
+		if f := q.updates.filter; f != nil && !f.EvaluateFast(cols) {
+			return nil
+		}
+		return add(cols)
+	}
+	// aggregate adds the row of a record of the search key to its group if
+	// it passes the filter, as it reads after pending updates
+	aggregate := func(rec *common.IndexRecord) error {
+		if q.zones != nil && !q.zones.keyMatches(&rec.Key) {
+			return nil
+		}
+		if !q.intersects(rec.Offset) {
+			return nil
+		}
+		pending := false
+		if q.updates != nil {
+			if q.updates.deleted[rec.Offset] {
+				return nil
+			}
+			_, pending = q.updates.overrides[rec.Offset]
+		}
+		row, err := readRow(rec.Offset)
+		if err != nil {
+			return err
+		}
+
+		if pending {
+			return addUpdated(rec.Offset, row)
+		}
+		cols := q.appendVirtual(proj.extract(row, colsBuf))
+		colsBuf = cols
+
+		// Where Filter — zero-allocation path
+		if q.config.Where != nil && !q.config.Where.EvaluateFast(cols) {
+			return nil
+		}
+		return add(cols)
+	}
 
 	for i := startBlockIdx; i <= endBlockIdx; i++ {
 		if limitReached {
 			break
 		}
 
-		blockMeta := br.Footer.Blocks[i]
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+		prog.update(scanned, matched)
+		if q.config.OnPartial != nil && !groups.spilled() && pivotC < 0 && time.Since(lastPartial) >= partialInterval {
+			q.config.OnPartial(finalGroups(groups.results, groups.counts))
+			lastPartial = time.Now()
+		}
+
+		blockMeta := br.Footer.Blocks.At(i)
+		scanned += blockMeta.Length
 
 		if hasSearchKey && blockMeta.StartKey > searchKey {
 			break
 		}
+		if q.zones != nil && q.zones.skipBlock(blockMeta) {
+			continue
+		}
 
 		// *** ULTRA-FAST DISTINCT/COUNT SCAN ***
 		// If block contains only one key, we can skip reading it entirely!
-		if isGroupingByIndex && blockMeta.IsDistinct && canUseMetadata {
-			groupKey := blockMeta.StartKey
+		// (Only without a post-filter: the block's rows are not checked,
+		// and not for a truncated key, which may stand for several values.)
+		if isGroupingByIndex && blockMeta.IsDistinct && canUseMetadata && q.config.Where == nil && q.intersect == nil && q.updates == nil &&
+			!common.KeyMayBeTruncated(blockMeta.StartKey) {
+			groupKey := q.groupBucket.key(q.groupLayout, common.DecodeKey(blockMeta.StartKey))
+			if hasSearchKey && blockMeta.StartKey != searchKey {
+				continue // Block of a smaller key before the search key's run
+			}
 
 			// Handle Limit/Offset/Search logic if needed (search is handled by loop range/break checks)
 
+			// For count, add the number of records in this block; for
+			// distinct, just mark presence
+			if err := groups.add(groupKey, 0, blockMeta.RecordCount); err != nil {
+				return err
+			}
 			if q.config.AggFunc == "count" {
-				// For count, add the number of records in this block
-				results[groupKey] += float64(blockMeta.RecordCount)
-			} else {
-				// For distinct, just mark presence
-				results[groupKey] = 1
+				matched += blockMeta.RecordCount
 			}
 			continue // Skip ReadBlock!
 		}
@@ -697,12 +1350,6 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 			return err
 		}
 
-		if csvData == nil {
-			if err := ensureCsvLoaded(); err != nil {
-				return err
-			}
-		}
-
 		for index := range records {
 			rec := &records[index]
 			if hasSearchKey {
@@ -715,103 +1362,163 @@ func (q *QueryEngine) runAggregation(br *common.BlockReader, searchKey string, h
 					break
 				}
 			}
-
-			// Read CSV Line
-			rowEnd := bytes.IndexByte(csvData[rec.Offset:], '\n')
-			if rowEnd == -1 {
-				rowEnd = len(csvData) - int(rec.Offset)
+			if err := aggregate(rec); err != nil {
+				return err
 			}
-			row := csvData[rec.Offset : int(rec.Offset)+rowEnd]
-			row = bytes.TrimSuffix(row, []byte{'\r'})
-
-			cols := extractCols(row, ',', maxCol, colsBuf)
+		}
+	}
 
-			// Inject Virtual Columns
-			if len(q.VirtualDefaults) > 0 {
-				cols = append(cols, q.VirtualDefaults...)
+	// Rows written since the build, from the index's delta (see deltas.go)
+	for i := range q.delta {
+		if i%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
 			}
+		}
+		if err := aggregate(&q.delta[i]); err != nil {
+			return err
+		}
+	}
 
-			var groupVal string
-			if groupC < len(cols) {
-				groupVal = cols[groupC]
+	// Dirty rows the scan did not check may match under their new values
+	if q.updates != nil {
+		for _, offset := range q.updates.dirty {
+			if q.updates.seen[offset] || q.updates.deleted[offset] {
+				continue
 			}
-
-			// Where Filter — zero-allocation path
-			if q.config.Where != nil {
-				if !q.config.Where.EvaluateFast(cols) {
-					colsBuf = cols
-					continue
-				}
+			row, err := readRow(offset)
+			if err != nil {
+				return err
 			}
-
-			var val float64
-			if !isCountOnly && aggC < len(cols) {
-				val, _ = strconv.ParseFloat(cols[aggC], 64)
+			if err := addUpdated(offset, row); err != nil {
+				return err
 			}
+		}
+	}
 
-			switch q.config.AggFunc {
-			case "count":
-				results[groupVal]++
-			case "sum":
-				results[groupVal] += val
-			case "min":
-				if curr, ok := results[groupVal]; !ok || val < curr {
-					results[groupVal] = val
-				}
-			case "max":
-				if curr, ok := results[groupVal]; !ok || val > curr {
-					results[groupVal] = val
-				}
-			case "avg":
-				results[groupVal] += val
-				counts[groupVal]++
-			case "": // Distinct Mode (Implicit)
-				results[groupVal] = 1
-			}
+	// delete(results, "") - Allow empty keys as valid groups
 
-			// Recapture buffer ownership (not strictly needed since we use colsBuf every iteration, but good practice)
-			colsBuf = cols
+	if groups.spilled() && q.config.Verbose {
+		fmt.Fprintf(os.Stderr, "DEBUG: Group-by spilled %d runs to %s\n", len(groups.runs), groups.dir)
+	}
+	if pivotC >= 0 {
+		all, err := groups.collect()
+		if err != nil {
+			return err
+		}
+		return q.writePivot(all)
+	}
+	if q.aggOrder != nil {
+		ranked, err := groups.ranked(*q.aggOrder, q.config.AggLimit)
+		if err != nil {
+			return err
 		}
+		return q.writeRanked(ranked)
+	}
+	if q.Result != nil {
+		q.Result.Groups, err = groups.collect()
+		return err
 	}
+	return groups.writeJSON(q.Writer)
+}
 
-	// delete(results, "") - Allow empty keys as valid groups
+// finalGroups copies aggregation results, turning avg sums into averages.
+func finalGroups(results map[string]float64, counts map[string]int64) map[string]float64 {
+	groups := make(map[string]float64, len(results))
+	for groupVal, v := range results {
+		if n := counts[groupVal]; n > 0 {
+			v /= float64(n) // avg: sums so far
+		}
+		groups[groupVal] = v
+	}
+	return groups
+}
 
-	return json.NewEncoder(q.Writer).Encode(results)
+// rowProjector splits rows into the columns a query reads. Only the
+// columns set in its mask become strings; the others, and those past the
+// mask, are left empty or out, so wide rows cost little more than the
+// columns used.
+type rowProjector struct {
+	rs   common.RecordScanner
+	sep  byte
+	used []bool
 }
 
-// extractCols extraction columns from a byte slice line without excessive allocation
-func extractCols(line []byte, sep byte, maxCol int, buf []string) []string {
-	cols := buf[:0]
-	start := 0
-	inQuote := false
-	for i := 0; i < len(line); i++ {
-		if line[i] == '"' {
-			inQuote = !inQuote
-		}
-		if line[i] == sep && !inQuote {
-			field := line[start:i]
-			// Trim quotes at byte level (avoids allocating a quoted string)
-			if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
-				field = field[1 : len(field)-1]
-			}
-			cols = append(cols, string(field))
-			start = i + 1
-			if len(cols) > maxCol {
-				return cols
-			}
+// newRowProjector returns a projector of the first maxCol+1 columns that
+// reads the filter's columns and extra (after ResolveColumns).
+func (q *QueryEngine) newRowProjector(maxCol int, extra ...int) *rowProjector {
+	p := &rowProjector{sep: q.separator(), used: make([]bool, maxCol+1)}
+	if q.config.Where != nil {
+		q.config.Where.markColumns(p.used)
+	}
+	for _, c := range extra {
+		if c >= 0 && c <= maxCol {
+			p.used[c] = true
 		}
 	}
-	field := line[start:]
-	if len(field) >= 2 && field[0] == '"' && field[len(field)-1] == '"' {
-		field = field[1 : len(field)-1]
+	q.markComputed(p.used)
+	return p
+}
+
+// projectAll marks every column as read, for rows written back whole.
+func (p *rowProjector) projectAll() {
+	for i := range p.used {
+		p.used[i] = true
 	}
-	cols = append(cols, string(field))
-	return cols
+}
+
+// extract appends the columns of line to buf[:0] and returns them.
+func (p *rowProjector) extract(line []byte, buf []string) []string {
+	p.rs.Reset(line, p.sep)
+	return p.rs.Project(0, len(line), p.used, buf[:0])
+}
+
+// HasColumn reports whether the CSV has the column name, a header name
+// (case-insensitive), a virtual column or an alias. Row overrides name
+// columns in lowercase.
+func (q *QueryEngine) HasColumn(name string) (bool, error) {
+	headers, _, err := q.getHeaderMap()
+	if err != nil {
+		return false, err
+	}
+	_, ok := headers[strings.ToLower(strings.TrimSpace(name))]
+	return ok, nil
+}
+
+// Columns returns the names of the CSV's columns in the order "*" selects
+// them: the header's, then the virtual ones.
+func (q *QueryEngine) Columns() ([]string, error) {
+	f, err := q.openHeader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	r := csv.NewReader(bufio.NewReader(f))
+	r.Comma = rune(q.separator())
+	r.LazyQuotes = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	header[0] = strings.TrimPrefix(header[0], "\uFEFF")
+	m := make(map[string]int, len(header))
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+		m[strings.ToLower(header[i])] = i
+	}
+	names, _ := q.virtualColumns(m)
+	return append(header, names...), nil
+}
+
+// Separator returns the separator the CSV's rows are read with, and csv
+// rows are written with.
+func (q *QueryEngine) Separator() byte {
+	return q.separator()
 }
 
 // getHeaderMap returns map of column name -> index (including virtual columns)
 func (q *QueryEngine) getHeaderMap() (map[string]int, []string, error) {
-	f, err := os.Open(q.config.CsvPath)
+	f, err := q.openHeader()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -828,6 +1535,7 @@ func (q *QueryEngine) getHeaderMap() (map[string]int, []string, error) {
 	}
 
 	csvReader := csv.NewReader(br)
+	csvReader.Comma = rune(q.separator())
 	header, err := csvReader.Read()
 	if err != nil {
 		return nil, nil, err
@@ -850,24 +1558,17 @@ func (q *QueryEngine) getHeaderMap() (map[string]int, []string, error) {
 		m[strings.ToLower(clean)] = i
 	}
 
-	// Load Schema for Virtual Columns
-	s, err := schema.Load(q.config.CsvPath)
-	if err == nil {
-		// Sort keys for deterministic order
-		var keys []string
-		for k := range s.VirtualColumns {
-			keys = append(keys, k)
+	// Schema for Virtual Columns
+	if s := q.schema; s != nil {
+		names, virtualDefaults := q.virtualColumns(m)
+		for i, k := range names {
+			m[strings.ToLower(k)] = len(header) + i
 		}
-		sort.Strings(keys)
-
-		var virtualDefaults []string
-		startIdx := len(header)
-		for _, k := range keys {
-			if _, exists := m[k]; !exists {
-				m[k] = startIdx
-				startIdx++
-				virtualDefaults = append(virtualDefaults, s.VirtualColumns[k])
-			}
+		if err := s.AddAliases(m, len(header)); err != nil {
+			return nil, nil, err
+		}
+		if q.computed, err = s.Computed(m, len(header)); err != nil {
+			return nil, nil, errorf(ErrBadQuery, "%v", err)
 		}
 		return m, virtualDefaults, nil
 	}
@@ -875,12 +1576,75 @@ func (q *QueryEngine) getHeaderMap() (map[string]int, []string, error) {
 	return m, nil, nil
 }
 
+// virtualColumns returns the schema's virtual columns, computed ones
+// included, that are not in the header m, in the order they follow the
+// header's columns, and their defaults ("" for computed columns, which
+// appendVirtual fills in).
+func (q *QueryEngine) virtualColumns(m map[string]int) (names, defaults []string) {
+	if q.schema == nil {
+		return nil, nil
+	}
+	for _, k := range q.schema.VirtualNames() {
+		if _, exists := m[strings.ToLower(k)]; !exists {
+			names = append(names, k)
+		}
+	}
+	for _, k := range names {
+		defaults = append(defaults, q.schema.VirtualColumns[k])
+	}
+	return names, defaults
+}
+
+// appendVirtual appends the virtual columns to the columns of a row: their
+// defaults, then the computed ones evaluated on the row.
+func (q *QueryEngine) appendVirtual(cols []string) []string {
+	if len(q.VirtualDefaults) == 0 {
+		return cols
+	}
+	return q.computeVirtual(append(cols, q.VirtualDefaults...))
+}
+
+// computeVirtual evaluates the computed columns of cols, the columns of a
+// row followed by its virtual ones, after any updates to the columns they
+// read.
+func (q *QueryEngine) computeVirtual(cols []string) []string {
+	for _, c := range q.computed {
+		if c.Pos < len(cols) {
+			cols[c.Pos] = c.Expr.Eval(cols)
+		}
+	}
+	return cols
+}
+
+// markComputed marks the columns that the computed columns set in used
+// read, so projectors extract them.
+func (q *QueryEngine) markComputed(used []bool) {
+	for i := len(q.computed) - 1; i >= 0; i-- { // Read before what reads them
+		c := q.computed[i]
+		if c.Pos >= len(used) || !used[c.Pos] {
+			continue
+		}
+		for _, pos := range c.Expr.Positions() {
+			if pos < len(used) {
+				used[pos] = true
+			}
+		}
+	}
+}
+
 // findBestIndex finds the best index for the query conditions
 func (q *QueryEngine) findBestIndex() (string, string, bool, map[string]interface{}, error) {
 	plan := make(map[string]interface{})
 	plan["query"] = q.config.Where
 
-	csvName := strings.TrimSuffix(filepath.Base(q.config.CsvPath), filepath.Ext(q.config.CsvPath))
+	// 0. Scalar MIN/MAX: the keys of the column's index hold the answer
+	if q.minMax() {
+		indexFile, err := q.planMinMax(plan)
+		if err != nil {
+			return "", "", false, nil, err
+		}
+		return indexFile, "", false, plan, nil
+	}
 
 	// 1. Try to find the best composite index
 	if q.config.Where != nil {
@@ -893,73 +1657,401 @@ func (q *QueryEngine) findBestIndex() (string, string, bool, map[string]interfac
 			}
 			sort.Strings(cols)
 
-			// Try the longest possible composite index first, then shorter ones
-			for i := len(cols); i >= 1; i-- {
+			// Try the longest possible composite index first, then shorter
+			// ones, then the single-column index of every condition, most
+			// selective first
+			var candidates [][]string
+			for i := len(cols); i >= 2; i-- {
 				// For now, we only support exact matches on the leading columns of the query
-				// Let's try the full combination
-				currentCols := cols[:i]
+				candidates = append(candidates, cols[:i])
+			}
+			for _, col := range q.bySelectivity(cols) {
+				candidates = append(candidates, []string{col})
+			}
+			folded := q.foldedColumns()
+			for _, currentCols := range candidates {
 				indexName := strings.Join(currentCols, "_")
 
 				// Build search key matched to Indexer's format
 				var searchKey string
-				if i == 1 {
+				if len(currentCols) == 1 {
 					searchKey = conds[currentCols[0]]
 				} else {
-					// Manual JSON construction
-					var b strings.Builder
-					b.WriteByte('[')
+					values := make([]string, len(currentCols))
 					for k, col := range currentCols {
-						if k > 0 {
-							b.WriteByte(',')
-						}
-						b.WriteByte('"')
-						b.WriteString(conds[col])
-						b.WriteByte('"')
+						values[k] = conds[col]
 					}
-					b.WriteByte(']')
-					searchKey = b.String()
+					searchKey = common.CompositeKey(values)
 				}
 
-				// Try lowercase index path first (new convention after normalization fix)
-				indexPath := filepath.Join(q.config.IndexDir, csvName+"_"+indexName+".cidx")
-				if _, err := os.Stat(indexPath); err != nil {
-					// Try uppercase (legacy index files created before normalization)
-					upperIndexName := strings.ToUpper(indexName)
-					altPath := filepath.Join(q.config.IndexDir, csvName+"_"+upperIndexName+".cidx")
-					if _, err := os.Stat(altPath); err == nil {
-						indexPath = altPath
-					}
+				// A case-insensitive index is searched with a folded key.
+				// A bytewise one would miss rows of columns compared
+				// case-insensitively.
+				if q.indexCollation(indexName) == common.CollationCI {
+					searchKey = common.FoldKey(searchKey)
+				} else if slices.ContainsFunc(currentCols, func(col string) bool { return folded[col] }) {
+					continue
 				}
 
-				if _, err := os.Stat(indexPath); err == nil {
+				if indexFile, ok := q.indexFileFor(indexName); ok {
 					plan["strategy"] = "Index Scan (Composite)"
 					plan["index"] = indexName
 					plan["covered_columns"] = currentCols
-					return indexPath, searchKey, true, plan, nil
+					if rows, ok := q.equalityEstimate(indexName); ok {
+						plan["estimated_rows"] = rows
+					}
+					if len(currentCols) == 1 {
+						if info, ok := q.columnInfo(indexName); ok {
+							plan["distinct_estimate"] = info.Distinct
+						}
+						q.planNullCount(plan, indexName)
+						q.planIntersection(plan, conds, indexName, folded)
+					}
+					// Index keys hold a prefix of long values: matches of a
+					// truncated key must be confirmed by the post-filter
+					var truncated bool
+					searchKey, truncated = common.EncodeKey(searchKey)
+					if truncated {
+						plan["key_truncated"] = true
+					}
+					return indexFile, searchKey, true, plan, nil
+				}
+			}
+		}
+	}
+
+	// 2. Range predicate on an indexed column: scan that index, skipping
+	// blocks by zone map and rows by key before touching the CSV. Of
+	// several, the one expected to match the fewest rows (see estimate.go)
+	if q.config.Where != nil {
+		var cols []string
+		for _, c := range q.config.Where.rangePredicates() {
+			cols = append(cols, strings.ToLower(c.Column))
+		}
+		sort.Strings(cols)
+		best, bestFile, bestRows := "", "", int64(-1)
+		for _, col := range slices.Compact(cols) {
+			if q.indexCollation(col) == common.CollationCI {
+				continue // Folded keys do not sort like the values
+			}
+			indexFile, ok := q.indexFileFor(col)
+			if !ok {
+				continue
+			}
+			rows, known := q.rangeEstimate(col)
+			if best == "" || (known && (bestRows < 0 || rows < bestRows)) {
+				best, bestFile, bestRows = col, indexFile, -1
+				if known {
+					bestRows = rows
 				}
 			}
 		}
+		if best != "" {
+			plan["strategy"] = "Index Range Scan (Zone Map)"
+			plan["index"] = best
+			if bestRows >= 0 {
+				plan["estimated_rows"] = bestRows
+			}
+			q.planNullCount(plan, best)
+			return bestFile, "", false, plan, nil
+		}
 	}
 
-	// 2. Fallback: GroupBy index (Preferred for Aggregation)
+	// 3. Fallback: GroupBy index (Preferred for Aggregation)
 	if q.config.GroupBy != "" {
 		groupName := strings.ReplaceAll(q.config.GroupBy, ",", "_")
-		indexPath := filepath.Join(q.config.IndexDir, csvName+"_"+groupName+".cidx")
-		if info, err := os.Stat(indexPath); err == nil {
-			if !info.IsDir() {
-				plan["strategy"] = "GroupBy Index Scan"
-				plan["index"] = groupName
-				return indexPath, "", false, plan, nil
+		if indexFile, ok := q.indexFileFor(groupName); ok && q.indexCollation(groupName) != common.CollationCI {
+			plan["strategy"] = "GroupBy Index Scan"
+			plan["index"] = groupName
+			return indexFile, "", false, plan, nil
+		}
+	}
+
+	// 4. All rows in the order of a column: walk its index whole
+	if q.config.Where == nil && q.orderColumn != "" && q.indexesComplete() {
+		if indexFile, ok := q.indexFileFor(q.orderColumn); ok && q.indexCollation(q.orderColumn) != common.CollationCI {
+			plan["strategy"] = "Index Ordered Scan"
+			plan["index"] = q.orderColumn
+			return indexFile, "", false, plan, nil
+		}
+	}
+
+	// 5. A sample of all rows: any index covering the whole CSV lists them
+	if q.config.Where == nil && q.sampling() {
+		if indexName, indexFile, ok := q.completeIndex(); ok {
+			plan["strategy"] = "Index Sample Scan"
+			plan["index"] = indexName
+			return indexFile, "", false, plan, nil
+		}
+	}
+
+	return "", "", false, nil, errorf(ErrNoIndex, "no suitable index found")
+}
+
+// planNullCount adds the null count recorded for a single-column index
+// at build time to the plan, if its metadata has one.
+func (q *QueryEngine) planNullCount(plan map[string]interface{}, indexName string) {
+	if stats, ok := q.indexStats(indexName); ok && stats.NullCount != nil {
+		plan["null_count"] = *stats.NullCount
+	}
+}
+
+// indexStats returns the build statistics of an index.
+func (q *QueryEngine) indexStats(indexName string) (common.IndexStats, bool) {
+	meta := q.loadMeta()
+	if meta == nil {
+		return common.IndexStats{}, false
+	}
+	stats, ok := meta.Indexes[strings.ToLower(indexName)]
+	return stats, ok
+}
+
+// indexCollation returns the collation an index was built with ("" =
+// bytewise).
+func (q *QueryEngine) indexCollation(indexName string) string {
+	stats, _ := q.indexStats(indexName)
+	return stats.Collation
+}
+
+// foldedColumns returns the (lowercase) columns of case-insensitive
+// indexes, whose equality conditions ignore case.
+func (q *QueryEngine) foldedColumns() map[string]bool {
+	meta := q.loadMeta()
+	if meta == nil {
+		return nil
+	}
+	var cols map[string]bool
+	for _, stats := range meta.Indexes {
+		if stats.Collation != common.CollationCI {
+			continue
+		}
+		if cols == nil {
+			cols = make(map[string]bool)
+		}
+		for _, col := range stats.Columns {
+			cols[strings.ToLower(col)] = true
+		}
+	}
+	return cols
+}
+
+// separator returns the CSV's separator: the configured one, the one the
+// indexes were built with, or the one detected from the start of the CSV.
+func (q *QueryEngine) separator() byte {
+	if q.sep != 0 {
+		return q.sep
+	}
+	q.sep = q.config.Separator
+	if meta := q.loadMeta(); q.sep == 0 && meta != nil && len(meta.Separator) == 1 {
+		q.sep = meta.Separator[0]
+	}
+	if q.sep == 0 {
+		q.sep = ','
+		if f, err := q.openHeader(); err == nil {
+			if d, err := common.SniffReader(f); err == nil {
+				q.sep = d.Separator
+			}
+			_ = f.Close()
+		}
+	}
+	return q.sep
+}
+
+// loadMeta reads the _meta.json file written next to the indexes, once.
+func (q *QueryEngine) loadMeta() *common.IndexMeta {
+	if q.metaRead || q.store == nil {
+		return q.meta
+	}
+	q.metaRead = true
+	data, err := storage.ReadFile(q.store, q.csvName()+"_meta.json")
+	if err != nil {
+		return nil
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	q.meta = &meta
+	return q.meta
+}
+
+// csvName returns the base name of the CSV, the prefix of its index files.
+func (q *QueryEngine) csvName() string {
+	return strings.TrimSuffix(filepath.Base(q.config.CsvPath), filepath.Ext(q.config.CsvPath))
+}
+
+// manifest maps the index names of the CSV to their files, from the index
+// metadata. It is nil for indexes built before the metadata listed files.
+func (q *QueryEngine) manifest() map[string]string {
+	meta := q.loadMeta()
+	if meta == nil {
+		return nil
+	}
+	files := make(map[string]string, len(meta.Indexes))
+	for name, stats := range meta.Indexes {
+		if stats.File == "" {
+			return nil
+		}
+		files[name] = stats.File
+	}
+	return files
+}
+
+// checkFullScanAllowed enforces RequireIndex and MaxFullScanBytes before a
+// fallback full scan. The error names the index that would avoid the scan.
+func (q *QueryEngine) checkFullScanAllowed(reason string) error {
+	if !q.config.RequireIndex && q.config.MaxFullScanBytes <= 0 {
+		return nil
+	}
+
+	if q.config.RequireIndex {
+		return errorf(ErrNoIndex, "full scan refused (--require-index): %s. %s", reason, q.suggestIndex())
+	}
+
+	info, err := os.Stat(q.config.CsvPath)
+	if err != nil {
+		return q.requireCSV(err)
+	}
+	if info.Size() > q.config.MaxFullScanBytes {
+		return errorf(ErrNoIndex, "full scan refused: %s and %s is %d bytes (limit %d). %s",
+			reason, filepath.Base(q.config.CsvPath), info.Size(), q.config.MaxFullScanBytes, q.suggestIndex())
+	}
+	return nil
+}
+
+// suggestIndex describes the index command that would serve this query.
+func (q *QueryEngine) suggestIndex() string {
+	cols := q.indexSuggestion()
+	if len(cols) == 0 {
+		return "No equality condition or GROUP BY column can use an index"
+	}
+
+	colsJSON, _ := json.Marshal(cols)
+	if len(cols) > 1 {
+		// Composite index definition
+		colsJSON, _ = json.Marshal([][]string{cols})
+	}
+	return fmt.Sprintf("Build one with: csvquery index --input %s --columns '%s'", q.config.CsvPath, colsJSON)
+}
+
+// indexSuggestion returns the columns of the index that would serve this
+// query (nil = none would).
+func (q *QueryEngine) indexSuggestion() []string {
+	var cols []string
+	if q.config.Where != nil {
+		for col := range q.config.Where.ExtractIndexConditions() {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+	}
+	if len(cols) == 0 && q.config.GroupBy != "" {
+		cols = []string{strings.ToLower(q.config.GroupBy)}
+	}
+	if len(cols) == 0 && q.config.NotInColumn != "" {
+		cols = []string{strings.ToLower(q.config.NotInColumn)}
+	}
+	return cols
+}
+
+// columnInfo returns the analyzed metadata of a column, if any.
+func (q *QueryEngine) columnInfo(column string) (schema.ColumnInfo, bool) {
+	if q.schema == nil {
+		return schema.ColumnInfo{}, false
+	}
+	return q.schema.Column(column)
+}
+
+// bySelectivity orders equality columns by their distinct count (see
+// distinctCount), highest first: an equality on a column with more distinct
+// values matches fewer rows. Columns of unknown count keep their order,
+// last.
+func (q *QueryEngine) bySelectivity(cols []string) []string {
+	ordered := slices.Clone(cols)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		da, okA := q.distinctCount(a)
+		db, okB := q.distinctCount(b)
+		switch {
+		case okA && okB:
+			return cmp.Compare(db, da)
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// indexFileFor resolves the .cidx file (its name in the index storage) for
+// an index name through the manifest in the index metadata. Without one
+// (indexes built by older versions), the listed files are matched by name.
+func (q *QueryEngine) indexFileFor(indexName string) (string, bool) {
+	if q.store == nil {
+		return "", false
+	}
+	if files := q.manifest(); files != nil {
+		indexFile, ok := files[strings.ToLower(indexName)]
+		if !ok {
+			return "", false
+		}
+		if _, err := q.store.Stat(indexFile); err != nil {
+			// Superseded by a build published since the metadata was
+			// read: its manifest lists the new generation
+			if q.metaReloaded {
+				return "", false
 			}
+			q.metaRead, q.metaReloaded = false, true
+			return q.indexFileFor(indexName)
 		}
+		return indexFile, true
+	}
+	files, err := q.store.List(q.csvName() + "_*.cidx")
+	if err != nil {
+		return "", false
 	}
+	return common.LegacyIndexFile(files, q.csvName(), indexName)
+}
 
-	return "", "", false, nil, fmt.Errorf("no suitable index found")
+// indexFiles lists the .cidx files of the CSV.
+func (q *QueryEngine) indexFiles() []string {
+	if files := q.manifest(); files != nil {
+		list := make([]string, 0, len(files))
+		for _, f := range files {
+			list = append(list, f)
+		}
+		slices.Sort(list)
+		return list
+	}
+	files, _ := q.store.List(q.csvName() + "_*.cidx")
+	return files
 }
 
 // runFullScan scans the entire CSV file to find matching rows
 func (q *QueryEngine) runFullScan() error {
-	f, err := os.Open(q.config.CsvPath)
+	if q.config.GroupBy != "" {
+		return errorf(ErrNoIndex, "group-by %s without a usable index: full scans do not aggregate; index the column", q.config.GroupBy)
+	}
+	if q.config.Last {
+		return errorf(ErrNoIndex, "--last without a usable index: full scans do not read backward; index a filtered column")
+	}
+	if q.config.OrderBy != "" {
+		return errorf(ErrNoIndex, "--order-by without a usable index: full scans return rows in file order; index the column")
+	}
+	if meta := q.loadMeta(); meta != nil && meta.Format != "" {
+		return q.runSerialScan() // Rows of Parquet and Arrow sources stream from the row store
+	}
+	if q.Updates == nil || len(q.Updates.Overrides) == 0 {
+		return q.runParallelScan() // See fullscan.go
+	}
+	return q.runSerialScan()
+}
+
+// runSerialScan is runFullScan for CSVs with pending row overrides: it
+// reads the rows one at a time, in order, applying the overrides of each
+// by its offset.
+func (q *QueryEngine) runSerialScan() error {
+	f, fileSize, err := q.openScan()
 	if err != nil {
 		return err
 	}
@@ -971,6 +2063,7 @@ func (q *QueryEngine) runFullScan() error {
 		return err
 	}
 	q.VirtualDefaults = virtualDefaults
+	deletes := q.Updates != nil && len(q.Updates.Deleted) > 0
 
 	// Pre-resolve filter columns to integer indices (once, not per row)
 	if q.config.Where != nil {
@@ -983,7 +2076,7 @@ func (q *QueryEngine) runFullScan() error {
 		headerMap[k] = v
 	}
 
-	// Buffered Reader (Need ReadBytes for offset tracking)
+	// Buffered Reader (records keep their bytes for offset tracking)
 	reader := bufio.NewReader(f)
 
 	// Line Counting
@@ -991,14 +2084,22 @@ func (q *QueryEngine) runFullScan() error {
 	currentOffset := int64(0)
 
 	// Read Header Line to skip
-	headerLine, err := reader.ReadBytes('\n')
+	headerLine, err := common.ReadCSVRecord(reader)
 	if err != nil {
 		return err
 	}
 	currentOffset += int64(len(headerLine))
 
+	if err := q.checkCursorSource(cursorFullScan); err != nil {
+		return err
+	}
+
 	// Output Writer
-	writer := bufio.NewWriter(q.Writer)
+	emitter, err := q.newRowEmitter("fullscan")
+	if err != nil {
+		return err
+	}
+	writer := emitter.w
 	defer func() { _ = writer.Flush() }()
 
 	// Metrics
@@ -1006,7 +2107,12 @@ func (q *QueryEngine) runFullScan() error {
 	count := int64(0)
 	skipped := 0
 
+	prog := q.startProgress("Full Scan", fileSize)
+	defer prog.finish()
+
 	colsBuf := make([]string, 0, len(headers))
+	sep := q.separator()
+	sample := q.newSampler()
 
 	// Max column index
 	maxCol := 0
@@ -1015,9 +2121,15 @@ func (q *QueryEngine) runFullScan() error {
 			maxCol = v
 		}
 	}
+	physical := maxCol + 1 - len(q.VirtualDefaults)
+	proj := q.newRowProjector(maxCol)
+	if emitter.csvRows {
+		proj.projectAll() // Updated rows are exported whole
+	}
 
 	for {
-		line, err := reader.ReadBytes('\n')
+		// A record spans lines where quoted fields hold newlines
+		line, err := common.ReadCSVRecord(reader)
 		if err != nil {
 			if err == io.EOF {
 				if len(line) == 0 {
@@ -1032,19 +2144,35 @@ func (q *QueryEngine) runFullScan() error {
 		currentOffset += int64(len(line))
 		lineNum++
 
+		if lineNum%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
+			}
+			prog.update(currentOffset, count)
+		}
+		if q.cursor.passed(cursorBlocks, nil, rowOffset) {
+			continue // In an earlier page
+		}
+		if !sample.take() {
+			continue
+		}
+
 		// Trim whitespace/newlines
 		trimmed := bytes.TrimSpace(line)
 
-		cols := extractCols(trimmed, ',', maxCol, colsBuf)
+		cols := proj.extract(trimmed, colsBuf)
+
+		cols = q.appendVirtual(cols)
 
-		if len(q.VirtualDefaults) > 0 {
-			cols = append(cols, q.VirtualDefaults...)
+		if deletes && q.Updates.IsDeleted(rowOffset) {
+			colsBuf = cols
+			continue
 		}
 
+		var override map[string]string
 		if q.Updates != nil {
-			rowId := fmt.Sprintf("%d", lineNum) // Implicit RowID
-			if override, exists := q.Updates.Overrides[rowId]; exists {
-				cols = q.applyUpdates(cols, override, headerMap)
+			if override = q.Updates.GetRow(rowOffset); override != nil {
+				cols = q.computeVirtual(q.applyUpdates(cols, override, headerMap))
 			}
 		}
 
@@ -1055,6 +2183,16 @@ func (q *QueryEngine) runFullScan() error {
 			}
 		}
 
+		row := trimmed
+		if override != nil && emitter.csvRows {
+			// Export the row as it reads after pending updates
+			row = updatedRow(trimmed, override, headerMap, physical, sep)
+		}
+		if sample.reservoir() {
+			sample.offer(rowOffset, lineNum, row, line)
+			colsBuf = cols
+			continue
+		}
 		if skipped < q.config.Offset {
 			skipped++
 			continue
@@ -1062,22 +2200,34 @@ func (q *QueryEngine) runFullScan() error {
 
 		count++
 		if !q.config.CountOnly {
-			_, _ = fmt.Fprintf(writer, "%d,%d\n", rowOffset, lineNum)
+			emitter.virtual = cols[len(cols)-len(q.VirtualDefaults):]
+			if err := emitter.Emit(rowOffset, lineNum, row, line); err != nil {
+				return err
+			}
 		}
 
 		if q.config.Limit > 0 && count >= int64(q.config.Limit) {
+			var last cursorPos
+			last.at(cursorBlocks, nil, rowOffset, lineNum)
+			q.setNextCursor(cursorFullScan, last)
 			break
 		}
 
 		colsBuf = cols
 	}
 
+	if sample.reservoir() {
+		emitter.virtual = q.VirtualDefaults // Overrides of virtual columns are not kept with sampled rows
+		if count, err = q.emitSample(sample, emitter, nil); err != nil {
+			return err
+		}
+	}
 	if q.config.CountOnly {
-		_, _ = fmt.Fprintln(writer, count)
+		q.writeCount(writer, count)
 	}
 
 	// Metrics
 	fmt.Fprintf(os.Stderr, "Full Scan Time: %v\n", time.Since(execStart))
 
-	return nil
+	return emitter.Finish()
 }
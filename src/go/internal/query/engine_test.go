@@ -0,0 +1,193 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+const testCities = "id,name,city\n1,ann,Paris\n2,bob,Rome\n3,cy,Paris\n4,dee,Oslo\n5,eve,Rome\n6,fay,Paris\n"
+
+// newTestCSV writes data as a CSV in a temp dir and indexes its columns
+// (as index --columns takes them). It returns the CSV's path and the dir.
+func newTestCSV(t *testing.T, data, columns string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "t.csv")
+	if err := os.WriteFile(csvPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := indexer.NewIndexer(indexer.IndexerConfig{
+		InputFile: csvPath, OutputDir: dir, Columns: columns,
+		Workers: 1, MemoryMB: 16, BloomFPRate: 0.01, Output: io.Discard,
+	}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csvPath, dir
+}
+
+// runTest runs a query into a Result.
+func runTest(t *testing.T, cfg QueryConfig) (*Result, *QueryEngine, error) {
+	t.Helper()
+	q := NewQueryEngine(cfg)
+	q.Writer = io.Discard
+	q.Result = &Result{}
+	err := q.Run()
+	return q.Result, q, err
+}
+
+// rowOffset returns the offset of the row of data whose first field is id.
+func rowOffset(data, id string) int64 {
+	return int64(strings.Index(data, "\n"+id+",") + 1)
+}
+
+// runOutput runs a query and returns what it writes to the engine's Writer.
+func runOutput(t *testing.T, cfg QueryConfig) (string, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	q := NewQueryEngine(cfg)
+	q.Writer = &buf
+	err := q.Run()
+	return buf.String(), err
+}
+
+// where parses a JSON filter.
+func where(t *testing.T, filter string) *Condition {
+	t.Helper()
+	cond, err := ParseCondition([]byte(filter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cond
+}
+
+func TestGroupByPendingUpdates(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testCities, `["id","city"]`)
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Set(rowOffset(testCities, "5"), "city", "Bergen")
+	um.Delete(rowOffset(testCities, "1"))
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		where string
+		want  map[string]AggValue
+	}{
+		{"all", "", map[string]AggValue{"Paris": 2, "Rome": 1, "Oslo": 1, "Bergen": 1}},
+		{"updated to the key", `{"city":"Bergen"}`, map[string]AggValue{"Bergen": 1}},
+		{"updated from the key", `{"city":"Rome"}`, map[string]AggValue{"Rome": 1}},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, GroupBy: "city", AggFunc: "count"}
+		if tc.where != "" {
+			cfg.Where = where(t, tc.where)
+		}
+		res, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Groups, tc.want) {
+			t.Errorf("%s: groups %v, want %v", tc.name, res.Groups, tc.want)
+		}
+	}
+}
+
+func TestOutputToWriter(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testCities, `["id","city"]`)
+	for _, tc := range []struct {
+		name     string
+		cfg      QueryConfig
+		strategy string // Of an explain plan, else the output
+		want     string
+	}{
+		{"explain", QueryConfig{IndexDir: dir, Where: where(t, `{"id":"3"}`), Explain: true}, "Index Scan (Composite)", ""},
+		{"explain without index", QueryConfig{IndexDir: t.TempDir(), Where: where(t, `{"id":"3"}`), Explain: true}, "Full Scan", ""},
+		{"count of a missing key", QueryConfig{IndexDir: dir, Where: where(t, `{"id":"99"}`), CountOnly: true}, "", "0\n"},
+		{"count before the first key", QueryConfig{IndexDir: dir, Where: where(t, `{"city":"Aachen"}`), CountOnly: true}, "", "0\n"},
+	} {
+		tc.cfg.CsvPath = csvPath
+		out, err := runOutput(t, tc.cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.strategy == "" {
+			if out != tc.want {
+				t.Errorf("%s: output %q, want %q", tc.name, out, tc.want)
+			}
+			continue
+		}
+		var plan map[string]interface{}
+		if err := json.Unmarshal([]byte(out), &plan); err != nil {
+			t.Errorf("%s: output %q is no plan: %v", tc.name, out, err)
+			continue
+		}
+		if plan["strategy"] != tc.strategy {
+			t.Errorf("%s: strategy %v, want %s", tc.name, plan["strategy"], tc.strategy)
+		}
+	}
+}
+
+func TestGroupByAvg(t *testing.T) {
+	// Paris: ids 1, 3, 6; Rome: 2, 5; Oslo: 4
+	csvPath, dir := newTestCSV(t, testCities, `["city","name"]`)
+	for _, tc := range []struct {
+		name  string
+		where string
+		want  map[string]AggValue
+	}{
+		{"all rows", "", map[string]AggValue{"Paris": 10.0 / 3, "Rome": 3.5, "Oslo": 4}},
+		{"filtered", `{"operator":"!=","column":"name","value":"cy"}`, map[string]AggValue{"Paris": 3.5, "Rome": 3.5, "Oslo": 4}},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, GroupBy: "city", AggFunc: "avg", AggCol: "id"}
+		if tc.where != "" {
+			cfg.Where = where(t, tc.where)
+		}
+		res, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Groups, tc.want) {
+			t.Errorf("%s: groups %v, want %v", tc.name, res.Groups, tc.want)
+		}
+	}
+}
+
+func TestGroupByFullScanRefused(t *testing.T) {
+	csvPath, _ := newTestCSV(t, testCities, `["id"]`)
+	for _, tc := range []struct {
+		name  string
+		where string
+	}{
+		{"all rows", ""},
+		{"filtered", `{"name":"ann"}`},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: t.TempDir(), GroupBy: "city", AggFunc: "count"}
+		if tc.where != "" {
+			cfg.Where = where(t, tc.where)
+		}
+		out, err := runOutput(t, cfg)
+		if !errors.Is(err, ErrNoIndex) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, ErrNoIndex)
+		}
+		if out != "" {
+			t.Errorf("%s: output %q, want none", tc.name, out)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Kinds of query errors, alongside ErrTimeout and ErrCanceled. Queries
+// return them wrapped, with the details; ErrorCode names the kind for
+// daemon responses and ExitCode picks the CLI's exit status.
+var (
+	// ErrBadWhere is a where condition that does not parse or compile.
+	ErrBadWhere = errors.New("invalid where condition")
+	// ErrBadQuery is any other invalid query: unknown columns, options
+	// that do not combine.
+	ErrBadQuery = errors.New("invalid query")
+	// ErrNoIndex is a query needing an index there is none for: a full
+	// scan refused by --require-index or --max-fullscan-bytes, or one that
+	// cannot answer it.
+	ErrNoIndex = errors.New("no usable index")
+	// ErrStaleIndex is an index that no longer matches the CSV: offsets
+	// past its end, or rows moved under a resumed export.
+	ErrStaleIndex = errors.New("index does not match the CSV")
+	// ErrTooExpensive is a query expected to read more than
+	// QueryConfig.MaxCost allows (see CostError).
+	ErrTooExpensive = errors.New("query too expensive")
+)
+
+// Error codes, as ErrorCode returns them.
+const (
+	CodeBadWhere     = "bad_where"
+	CodeBadQuery     = "bad_query"
+	CodeNoIndex      = "no_index"
+	CodeStaleIndex   = "stale_index"
+	CodeTooExpensive = "too_expensive"
+	CodeCorruptIndex = "corrupt_index"
+	CodeNotFound     = "not_found"
+	CodeTimeout      = "timeout"
+	CodeCanceled     = "canceled"
+	CodeInternal     = "internal"
+)
+
+// ErrorCode returns the code of the kind of err: one of the Code
+// constants, CodeInternal for errors of no known kind, "" for nil.
+func ErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrBadWhere):
+		return CodeBadWhere
+	case errors.Is(err, ErrBadQuery):
+		return CodeBadQuery
+	case errors.Is(err, ErrNoIndex):
+		return CodeNoIndex
+	case errors.Is(err, ErrStaleIndex):
+		return CodeStaleIndex
+	case errors.Is(err, ErrTooExpensive):
+		return CodeTooExpensive
+	case errors.Is(err, common.ErrCorruptBlock):
+		return CodeCorruptIndex
+	case errors.Is(err, ErrTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrCanceled):
+		return CodeCanceled
+	case errors.Is(err, fs.ErrNotExist):
+		return CodeNotFound
+	}
+	return CodeInternal
+}
+
+// exitCodes are the CLI exit statuses of the error codes. 124 matches
+// timeout(1) and 130 an interrupt.
+var exitCodes = map[string]int{
+	CodeBadWhere:     2,
+	CodeBadQuery:     2,
+	CodeNoIndex:      3,
+	CodeStaleIndex:   4,
+	CodeCorruptIndex: 5,
+	CodeNotFound:     6,
+	CodeTooExpensive: 7,
+	CodeTimeout:      124,
+	CodeCanceled:     130,
+	CodeInternal:     1,
+}
+
+// ExitCode returns the exit status of a command that failed with err (0
+// for nil).
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[ErrorCode(err)]
+}
+
+// CostError is a query refused by QueryConfig.MaxCost, with what it was
+// expected to cost. It is of kind ErrTooExpensive.
+type CostError struct {
+	Class string   // How it would have run: ClassLookup or ClassScan
+	Bytes int64    // Bytes it was expected to read
+	Limit int64    // QueryConfig.MaxCost
+	Index []string // Columns of the index that would serve it (nil = none known)
+	msg   string
+}
+
+func (e *CostError) Error() string { return e.msg }
+func (e *CostError) Unwrap() error { return ErrTooExpensive }
+
+// kindError is an error of a kind whose message is the error's own, not
+// prefixed with the kind's.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// errorf formats an error like fmt.Errorf and marks it of kind.
+func errorf(kind error, format string, args ...any) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,76 @@
+package query
+
+import (
+	"math"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Row estimates. Index builds record key statistics in the metadata (see
+// common.KeyStats): record and null counts, the key range and an
+// equi-depth histogram. An equality on an index is expected to match its
+// records spread evenly over its distinct keys; range predicates and null
+// checks on a column, the share of the histogram's bounds (an evenly
+// spaced sample of the sorted keys) they accept. Indexes built before key
+// statistics have no estimates.
+
+// distinctCount returns the distinct values of a column: analyzed (see
+// `csvquery analyze`), else the distinct keys of its index.
+func (q *QueryEngine) distinctCount(column string) (int64, bool) {
+	if info, ok := q.columnInfo(column); ok {
+		return info.Distinct, true
+	}
+	if stats, ok := q.indexStats(column); ok && stats.Histogram != nil {
+		return stats.DistinctCount, true
+	}
+	return 0, false
+}
+
+// equalityEstimate returns the rows an equality on every column of an
+// index is expected to match.
+func (q *QueryEngine) equalityEstimate(indexName string) (int64, bool) {
+	stats, ok := q.indexStats(indexName)
+	if !ok || stats.Histogram == nil || stats.DistinctCount == 0 {
+		return 0, false
+	}
+	return int64(math.Ceil(float64(stats.Records) / float64(stats.DistinctCount))), true
+}
+
+// rangeEstimate returns the rows the range predicates and null checks on
+// column (see rangePredicates) are expected to match.
+func (q *QueryEngine) rangeEstimate(column string) (int64, bool) {
+	stats, ok := q.indexStats(column)
+	if !ok || stats.Histogram == nil || stats.NullCount == nil || q.config.Where == nil {
+		return 0, false
+	}
+	var preds []*Condition
+	for _, c := range q.config.Where.rangePredicates() {
+		if strings.EqualFold(c.Column, column) {
+			preds = append(preds, c)
+		}
+	}
+	accepts := func(val string) bool {
+		for _, c := range preds {
+			if !c.matchesKey(val) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var rows float64
+	if bounds := stats.Histogram.Bounds; len(bounds) > 0 {
+		matched := 0
+		for _, bound := range bounds {
+			if accepts(common.DecodeKey(bound)) {
+				matched++
+			}
+		}
+		rows = float64(matched) / float64(len(bounds)) * float64(stats.Records-*stats.NullCount)
+	}
+	if accepts("") {
+		rows += float64(*stats.NullCount)
+	}
+	return int64(math.Round(rows)), true
+}
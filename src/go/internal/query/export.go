@@ -0,0 +1,442 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// DefaultCheckpointEvery is how many emitted rows pass between progress markers.
+const DefaultCheckpointEvery = 100000
+
+// ExportCheckpoint is the progress marker of a long-running export.
+// Rows are emitted in a stable natural order (index key, then CSV offset;
+// or CSV offset for full scans), so "the first Emitted rows" identifies
+// exactly what has been written. LastOffset lets a resume detect that the
+// CSV or index changed underneath it.
+type ExportCheckpoint struct {
+	Query       string `json:"query"`       // Fingerprint of CSV, filter, source and format
+	Emitted     int64  `json:"emitted"`     // Rows written (after --offset)
+	LastOffset  int64  `json:"lastOffset"`  // CSV byte offset of the last written row
+	OutputBytes int64  `json:"outputBytes"` // Output size when the marker was taken
+	Complete    bool   `json:"complete"`
+}
+
+// LoadCheckpoint reads a checkpoint file written by a previous export.
+func LoadCheckpoint(path string) (*ExportCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var cp ExportCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint atomically (temp file + rename) so an
+// interruption mid-write never leaves a torn marker behind.
+func (cp *ExportCheckpoint) save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// countingWriter tracks how many bytes reached the underlying output.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rowEmitter writes result rows in the configured format and maintains
+// the export checkpoint. Rows already covered by --resume-from are skipped.
+type rowEmitter struct {
+	out     *countingWriter
+	w       *bufio.Writer
+	csvRows bool
+	rawRows bool    // Original line bytes, terminator included (--raw)
+	stream  bool    // Flush after every row (QueryConfig.Stream)
+	result  *Result // Receives the rows instead of w (QueryEngine.Result)
+
+	// Column selection of csv rows (QueryConfig.Select)
+	sep      byte
+	selected []int                                       // Header index of each output column (nil = the row as stored)
+	physical int                                         // Columns in the CSV header; selected ones past it are virtual
+	virtual  []string                                    // Virtual column values of the row being emitted
+	compute  func(row []byte, virtual []string) []string // Evaluates selected computed columns (nil = none)
+	fields   [][]byte
+
+	checkpointPath string
+	every          int64
+	cp             ExportCheckpoint
+
+	skip       int64 // Rows to skip when resuming
+	skipOffset int64 // Expected offset of the last skipped row
+	pending    int64 // Rows since the last checkpoint
+}
+
+// exportFingerprint identifies a query so a checkpoint cannot be resumed
+// against a different one. Must be computed before planning mutates Where.
+func (q *QueryEngine) exportFingerprint() string {
+	where, _ := json.Marshal(q.config.Where)
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%s", q.config.CsvPath, where, q.config.Offset, q.config.Limit, q.config.Format)
+	if len(q.config.Select) > 0 {
+		_, _ = fmt.Fprintf(h, "\x00%q", q.config.Select)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// prepareExport validates export options, loads the resume checkpoint and
+// opens OutputPath. Called once at the start of Run.
+func (q *QueryEngine) prepareExport() error {
+	switch q.config.Format {
+	case "", "offsets", "csv", "raw":
+	default:
+		return errorf(ErrBadQuery, "unknown format %q (expected offsets, csv or raw)", q.config.Format)
+	}
+	if len(q.config.Select) > 0 && (q.config.Format != "csv" || q.config.CountOnly || q.config.GroupBy != "") {
+		return errorf(ErrBadQuery, "selected columns only apply to csv row exports")
+	}
+
+	if q.config.CheckpointPath == "" && q.config.ResumeFrom == "" {
+		if q.config.OutputPath != "" {
+			f, err := os.Create(q.config.OutputPath)
+			if err != nil {
+				return err
+			}
+			q.output = f
+			q.Writer = f
+		}
+		return nil
+	}
+
+	if q.config.CountOnly || q.config.GroupBy != "" {
+		return errorf(ErrBadQuery, "--checkpoint/--resume-from only apply to row exports")
+	}
+	if q.config.CheckpointPath == "" {
+		q.config.CheckpointPath = q.config.ResumeFrom
+	}
+	q.exportQuery = q.exportFingerprint()
+
+	if q.config.ResumeFrom != "" {
+		cp, err := LoadCheckpoint(q.config.ResumeFrom)
+		if err != nil {
+			return err
+		}
+		if cp.Complete {
+			return fmt.Errorf("checkpoint %s: export already complete (%d rows)", q.config.ResumeFrom, cp.Emitted)
+		}
+		q.resume = cp
+	}
+
+	if q.config.OutputPath != "" {
+		f, err := os.OpenFile(q.config.OutputPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		// Drop anything written after the last marker, then append
+		var keep int64
+		if q.resume != nil {
+			keep = q.resume.OutputBytes
+		}
+		if err := f.Truncate(keep); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := f.Seek(keep, io.SeekStart); err != nil {
+			_ = f.Close()
+			return err
+		}
+		q.output = f
+		q.Writer = f
+	}
+	return nil
+}
+
+// newRowEmitter creates the emitter for a row-producing scan.
+// source describes the row order ("fullscan" or the index path).
+func (q *QueryEngine) newRowEmitter(source string) (*rowEmitter, error) {
+	out := &countingWriter{w: q.Writer}
+	e := &rowEmitter{
+		out:            out,
+		w:              bufio.NewWriterSize(out, 65536),
+		csvRows:        q.config.Format == "csv",
+		rawRows:        q.config.Format == "raw",
+		stream:         q.config.Stream,
+		checkpointPath: q.config.CheckpointPath,
+		every:          q.config.CheckpointEvery,
+	}
+	if e.every <= 0 {
+		e.every = DefaultCheckpointEvery
+	}
+	if q.Result != nil {
+		e.result = q.Result // No header, and nothing written to checkpoint
+		return e, nil
+	}
+	if e.csvRows && len(q.config.Select) > 0 {
+		header, err := e.selectColumns(q)
+		if err != nil {
+			return nil, err
+		}
+		if q.resume == nil {
+			_, _ = e.w.Write(header)
+			_ = e.w.WriteByte('\n')
+		}
+	} else if e.csvRows && q.resume == nil {
+		f, err := q.openHeader()
+		if err != nil {
+			return nil, err
+		}
+		err = e.writeHeader(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.checkpointPath == "" {
+		return e, nil
+	}
+
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s", q.exportQuery, source)
+	e.cp.Query = hex.EncodeToString(h.Sum(nil))
+
+	if q.resume != nil {
+		if q.resume.Query != e.cp.Query {
+			return nil, errorf(ErrBadQuery, "checkpoint %s was taken for a different query or index", q.config.ResumeFrom)
+		}
+		e.skip = q.resume.Emitted
+		e.skipOffset = q.resume.LastOffset
+		e.cp.OutputBytes = q.resume.OutputBytes
+	}
+	return e, nil
+}
+
+// selectColumns resolves QueryConfig.Select against the CSV header and
+// returns the header row of the selected columns. Columns are named as in
+// Select (case-insensitive, aliases allowed); "*" stands for the header's
+// columns as stored followed by the virtual ones.
+func (e *rowEmitter) selectColumns(q *QueryEngine) ([]byte, error) {
+	f, err := q.openHeader()
+	if err != nil {
+		return nil, err
+	}
+	line, err := common.ReadCSVRecord(bufio.NewReader(f))
+	_ = f.Close()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimPrefix(bytes.TrimRight(line, "\r\n"), []byte("\xef\xbb\xbf"))
+	headers, virtualDefaults, err := q.getHeaderMap()
+	if err != nil {
+		return nil, err
+	}
+
+	e.sep = q.separator()
+	physical := common.SplitFields(line, e.sep, nil)
+	e.physical = len(physical)
+	e.virtual = virtualDefaults
+	var header []byte
+	for _, name := range q.config.Select {
+		if name == "*" {
+			for i, f := range physical {
+				header = e.appendSep(header)
+				header = append(header, f...)
+				e.selected = append(e.selected, i)
+			}
+			names, _ := q.virtualColumns(physicalColumns(headers, len(physical)))
+			for i, name := range names {
+				header = common.AppendField(e.appendSep(header), name, e.sep)
+				e.selected = append(e.selected, len(physical)+i)
+			}
+			continue
+		}
+		idx, ok := headers[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errorf(ErrBadQuery, "column '%s' not found", name)
+		}
+		header = common.AppendField(e.appendSep(header), name, e.sep)
+		e.selected = append(e.selected, idx)
+	}
+	for _, c := range q.computed {
+		if slices.Contains(e.selected, c.Pos) {
+			e.compute = q.virtualComputer(e.physical)
+			break
+		}
+	}
+	return header, nil
+}
+
+// virtualComputer returns a function that evaluates the computed columns of
+// a row with physical columns, given its other virtual columns' values.
+func (q *QueryEngine) virtualComputer(physical int) func(row []byte, virtual []string) []string {
+	proj := q.newRowProjector(physical - 1)
+	proj.projectAll()
+	var cols []string
+	return func(row []byte, virtual []string) []string {
+		cols = proj.extract(row, cols)
+		for len(cols) < physical {
+			cols = append(cols, "") // A short row
+		}
+		cols = q.computeVirtual(append(cols, virtual...))
+		return cols[physical:]
+	}
+}
+
+// physicalColumns returns the columns of headers that are in the CSV.
+func physicalColumns(headers map[string]int, physical int) map[string]int {
+	m := make(map[string]int, physical)
+	for name, idx := range headers {
+		if idx < physical {
+			m[name] = idx
+		}
+	}
+	return m
+}
+
+// appendSep appends the separator before a column that is not the first.
+func (e *rowEmitter) appendSep(dst []byte) []byte {
+	if len(dst) > 0 || len(e.selected) > 0 {
+		return append(dst, e.sep)
+	}
+	return dst
+}
+
+// writeSelected writes the selected columns of row: its fields as stored,
+// quotes included, and the virtual columns' values quoted as needed.
+func (e *rowEmitter) writeSelected(row []byte) {
+	e.fields = common.SplitFields(row, e.sep, e.fields[:0])
+	virtual := e.virtual
+	if e.compute != nil {
+		virtual = e.compute(row, virtual)
+	}
+	var buf []byte
+	for i, c := range e.selected {
+		if i > 0 {
+			_ = e.w.WriteByte(e.sep)
+		}
+		switch {
+		case c < e.physical:
+			if c < len(e.fields) {
+				_, _ = e.w.Write(e.fields[c])
+			}
+		case c-e.physical < len(virtual):
+			buf = common.AppendField(buf[:0], virtual[c-e.physical], e.sep)
+			_, _ = e.w.Write(buf)
+		}
+	}
+	_ = e.w.WriteByte('\n')
+}
+
+func (e *rowEmitter) writeHeader(r io.Reader) error {
+	header, err := common.ReadCSVRecord(bufio.NewReader(r))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	header = bytes.TrimPrefix(bytes.TrimRight(header, "\r\n"), []byte("\xef\xbb\xbf"))
+	_, _ = e.w.Write(header)
+	return e.w.WriteByte('\n')
+}
+
+// Emit writes one result row: row is the (possibly updated) CSV row, raw the
+// line exactly as stored, terminator included. Only the one the format
+// needs must be set.
+func (e *rowEmitter) Emit(offset, line int64, row, raw []byte) error {
+	if e.skip > 0 {
+		e.skip--
+		e.cp.Emitted++
+		if e.skip == 0 && offset != e.skipOffset {
+			return errorf(ErrStaleIndex, "cannot resume: row %d is now at offset %d, checkpoint says %d (CSV or index changed)",
+				e.cp.Emitted, offset, e.skipOffset)
+		}
+		e.cp.LastOffset = offset
+		return nil
+	}
+
+	switch {
+	case e.result != nil:
+		e.result.addRow(RowRef{Offset: offset, Line: line})
+	case e.rawRows:
+		_, _ = e.w.Write(raw)
+		if len(raw) == 0 || raw[len(raw)-1] != '\n' {
+			_ = e.w.WriteByte('\n') // Last line of a file without a final newline
+		}
+	case e.csvRows && e.selected != nil:
+		e.writeSelected(row)
+	case e.csvRows:
+		_, _ = e.w.Write(row)
+		_ = e.w.WriteByte('\n')
+	default:
+		var buf [48]byte
+		b := strconv.AppendInt(buf[:0], offset, 10)
+		b = append(b, ',')
+		b = strconv.AppendInt(b, line, 10)
+		b = append(b, '\n')
+		_, _ = e.w.Write(b)
+	}
+
+	e.cp.Emitted++
+	e.cp.LastOffset = offset
+	if e.stream {
+		_ = e.w.Flush()
+	}
+
+	if e.checkpointPath != "" {
+		e.pending++
+		if e.pending >= e.every {
+			return e.checkpoint(false)
+		}
+	}
+	return nil
+}
+
+// checkpoint flushes output so that the marker never claims rows the
+// output doesn't contain yet, then persists it.
+func (e *rowEmitter) checkpoint(complete bool) error {
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	if f, ok := e.out.w.(*os.File); ok {
+		_ = f.Sync()
+	}
+	e.pending = 0
+	e.cp.Complete = complete
+	e.cp.OutputBytes += e.out.n
+	e.out.n = 0
+	return e.cp.save(e.checkpointPath)
+}
+
+// Finish flushes remaining output and writes the final marker.
+func (e *rowEmitter) Finish() error {
+	if e.skip > 0 {
+		return fmt.Errorf("cannot resume: only %d rows matched, checkpoint recorded %d", e.cp.Emitted, e.cp.Emitted+e.skip)
+	}
+	if e.checkpointPath == "" {
+		return e.w.Flush()
+	}
+	return e.checkpoint(true)
+}
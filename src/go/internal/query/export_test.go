@@ -0,0 +1,29 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteHeader(t *testing.T) {
+	for _, tc := range []struct {
+		csv, want string
+	}{
+		{"id,name\n1,ann\n", "id,name\n"},
+		{"\xef\xbb\xbfid,name\r\n1,ann\r\n", "id,name\n"},
+		{"id,\"long\nname\"\n1,ann\n", "id,\"long\nname\"\n"},
+		{"id,name", "id,name\n"},
+	} {
+		var out bytes.Buffer
+		e := &rowEmitter{w: bufio.NewWriter(&out)}
+		if err := e.writeHeader(strings.NewReader(tc.csv)); err != nil {
+			t.Fatal(err)
+		}
+		_ = e.w.Flush()
+		if out.String() != tc.want {
+			t.Errorf("Header of %q: %q, want %q", tc.csv, out.String(), tc.want)
+		}
+	}
+}
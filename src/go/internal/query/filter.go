@@ -3,7 +3,15 @@ package query
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
 )
 
 // FilterOp defines comparison operators
@@ -16,92 +24,325 @@ const (
 	OpLt        FilterOp = "<"
 	OpGte       FilterOp = ">="
 	OpLte       FilterOp = "<="
-	OpLike      FilterOp = "LIKE"
+	OpLike      FilterOp = "LIKE"   // SQL wildcards, case-insensitive (see likeMatcher)
+	OpRegex     FilterOp = "REGEXP" // Go regexp syntax, matched anywhere in the value
 	OpIsNull    FilterOp = "IS NULL"
 	OpIsNotNull FilterOp = "IS NOT NULL"
 	OpIn        FilterOp = "IN"
+	OpBetween   FilterOp = "BETWEEN" // Value is [low, high], both inclusive
+	OpInSet     FilterOp = "IN SET"  // Semi-join against an imported key set (see keyset.go)
+	OpNot       FilterOp = "NOT"     // Negates its single child (see normalize)
 )
 
 // Condition represents a single node in the filter tree
-// It can be a leaf (Column op Value) or non-leaf (AND/OR with Children)
+// It can be a leaf (Column op Value) or non-leaf (AND/OR/NOT with Children)
 type Condition struct {
-	Operator       FilterOp    `json:"operator"`
-	Column         string      `json:"column,omitempty"`
-	Value          interface{} `json:"value,omitempty"`
-	Children       []Condition `json:"children,omitempty"`
-	resolvedTarget string      // pre-computed string form of Value, set after parse
-	resolvedColIdx int         // pre-resolved column index for fast evaluation (-1 if unresolved)
-	lowerTarget    string      // pre-lowercased target for LIKE comparisons
+	Operator       FilterOp       `json:"operator"`
+	Column         string         `json:"column,omitempty"`
+	Value          interface{}    `json:"value,omitempty"`
+	Children       []Condition    `json:"children,omitempty"`
+	Escape         string         `json:"escape,omitempty"` // LIKE escape character (default \)
+	resolvedTarget string         // pre-computed string form of Value, set after parse
+	resolvedColIdx int            // pre-resolved column index for fast evaluation (-1 if unresolved)
+	like           *likeMatcher   // compiled pattern for OpLike
+	regex          *regexp.Regexp // compiled pattern for OpRegex
+	between        []Condition    // >= low and <= high leaves of OpBetween
+	targetNum      float64        // numeric form of the target (valid if targetIsNum)
+	targetIsNum    bool
+	colType        schema.ColumnType // analyzed type of Column ("" = unknown)
+	dateLayout     string            // time layout of a date column
+	targetTime     time.Time         // date form of the target (valid if targetIsTime)
+	targetIsTime   bool
+	targetLayout   string  // time layout the target is written in
+	targetInLayout bool    // the target is written in dateLayout
+	set            *KeySet // key set for OpInSet
+	fold           bool    // = and != ignore case (column has a case-insensitive index)
 }
 
 // resolveTargets pre-computes valid string targets for faster evaluation
 func (c *Condition) resolveTargets() {
 	if c.Value != nil {
 		c.resolvedTarget = fmt.Sprintf("%v", c.Value)
+		c.targetNum, c.targetIsNum = parseNumber(c.resolvedTarget)
+		if !c.targetIsNum {
+			if layout, ok := schema.DetectDateLayout(c.resolvedTarget); ok {
+				c.targetTime, _ = time.Parse(layout, c.resolvedTarget)
+				c.targetIsTime, c.targetLayout = true, layout
+			}
+		}
 	}
 	for i := range c.Children {
 		c.Children[i].resolveTargets()
 	}
 }
 
-// Evaluate checks if a row matches the condition
-// row map is Column -> Value
-func (c *Condition) Evaluate(row map[string]string) bool {
-	switch c.Operator {
-	case "AND":
-		for _, child := range c.Children {
-			if !child.Evaluate(row) {
-				return false
+// foldColumns makes = and != on the given (lowercase) columns compare
+// case-insensitively, like the case-insensitive indexes built on them, so
+// results do not depend on whether such an index serves the query.
+func (c *Condition) foldColumns(columns map[string]bool) {
+	if (c.Operator == OpEq || c.Operator == OpNeq) && columns[strings.ToLower(c.Column)] {
+		c.fold = true
+		c.resolvedTarget = common.FoldKey(c.resolvedTarget)
+	}
+	for i := range c.Children {
+		c.Children[i].foldColumns(columns)
+	}
+}
+
+// renameColumns replaces the column of every leaf by name(column); used to
+// resolve column aliases (see schema.ColumnName).
+func (c *Condition) renameColumns(name func(string) string) {
+	if c.Column != "" {
+		c.Column = name(c.Column)
+	}
+	for i := range c.Children {
+		c.Children[i].renameColumns(name)
+	}
+}
+
+// normalize validates NOT nodes and pushes them down to the leaves with De
+// Morgan's laws, so the conditions the planner reads (ExtractIndexConditions,
+// rangePredicates) never sit under a negation: NOT (a AND b) becomes
+// NOT a OR NOT b, NOT (a OR b) becomes NOT a AND NOT b, NOT NOT a becomes a
+// and NOT IS NULL becomes IS NOT NULL. Other negated leaves stay NOT nodes,
+// since NOT (x = 1) also matches rows without x, which x != 1 does not.
+// Nested ANDs (and ORs) are flattened into their parent.
+func (c *Condition) normalize() error {
+	if c.Operator == OpNot {
+		if len(c.Children) != 1 {
+			return fmt.Errorf("NOT needs exactly one child condition, got %d", len(c.Children))
+		}
+		child := c.Children[0]
+		switch child.Operator {
+		case "AND", "OR":
+			flipped := FilterOp("AND")
+			if child.Operator == "AND" {
+				flipped = "OR"
 			}
+			negated := make([]Condition, len(child.Children))
+			for i := range child.Children {
+				negated[i] = Condition{Operator: OpNot, Children: []Condition{child.Children[i]}}
+			}
+			*c = Condition{Operator: flipped, Children: negated}
+		case OpNot:
+			if len(child.Children) != 1 {
+				return fmt.Errorf("NOT needs exactly one child condition, got %d", len(child.Children))
+			}
+			*c = child.Children[0]
+			return c.normalize()
+		case OpIsNull:
+			child.Operator = OpIsNotNull
+			*c = child
+		case OpIsNotNull:
+			child.Operator = OpIsNull
+			*c = child
 		}
-		return true
-	case "OR":
+	}
+	for i := range c.Children {
+		if err := c.Children[i].normalize(); err != nil {
+			return err
+		}
+	}
+	if c.Operator == "AND" || c.Operator == "OR" {
+		flat := c.Children[:0:0]
 		for _, child := range c.Children {
-			if child.Evaluate(row) {
-				return true
+			if child.Operator == c.Operator {
+				flat = append(flat, child.Children...)
+			} else {
+				flat = append(flat, child)
 			}
 		}
-		return false
+		c.Children = flat
 	}
+	return nil
+}
 
-	// Leaf nodes
-	val, exists := row[c.Column]
+// compile prepares the operators that need more than a target: it compiles
+// the patterns of LIKE and REGEXP conditions and splits BETWEEN into its
+// bounds, so invalid ones are rejected when the query is parsed.
+func (c *Condition) compile() error {
+	switch c.Operator {
+	case OpBetween:
+		bounds, ok := c.Value.([]interface{})
+		if !ok || len(bounds) != 2 || bounds[0] == nil || bounds[1] == nil {
+			return fmt.Errorf("BETWEEN on %s needs a [low, high] value, got %v", c.Column, c.Value)
+		}
+		c.between = []Condition{
+			{Operator: OpGte, Column: c.Column, Value: bounds[0]},
+			{Operator: OpLte, Column: c.Column, Value: bounds[1]},
+		}
+		for i := range c.between {
+			c.between[i].resolveTargets()
+		}
+	case OpLike:
+		escape := '\\'
+		if c.Escape != "" {
+			r, size := utf8.DecodeRuneInString(c.Escape)
+			if size != len(c.Escape) {
+				return fmt.Errorf("LIKE escape must be a single character, got %q", c.Escape)
+			}
+			escape = r
+		}
+		m, err := compileLike(c.resolvedTarget, escape)
+		if err != nil {
+			return err
+		}
+		c.like = m
+	case OpRegex:
+		re, err := regexp.Compile(c.resolvedTarget)
+		if err != nil {
+			return fmt.Errorf("invalid REGEXP pattern for %s: %w", c.Column, err)
+		}
+		c.regex = re
+	}
+	for i := range c.Children {
+		if err := c.Children[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// parseNumber reports whether s is a number, and its value.
+func parseNumber(s string) (float64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// applyTypes records the column types inferred by `csvquery analyze`, so
+// comparisons follow them instead of guessing from each value: text columns
+// compare as text even when values look numeric ("02134"), date columns
+// compare as dates whatever their format.
+func (c *Condition) applyTypes(s *schema.Schema) {
+	for i := range c.Children {
+		c.Children[i].applyTypes(s)
+	}
+	for i := range c.between {
+		c.between[i].applyTypes(s)
+	}
+	info, ok := s.Column(c.Column)
+	if c.Column == "" || !ok {
+		return
+	}
+	c.colType = info.Type
+	switch info.Type {
+	case schema.TypeString, schema.TypeBool:
+		c.targetIsNum, c.targetIsTime = false, false
+	case schema.TypeInt, schema.TypeFloat:
+		c.targetIsTime = false
+	case schema.TypeDate:
+		c.dateLayout = info.Format
+		if t, ok := schema.ParseDate(info.Format, c.resolvedTarget); ok {
+			c.targetTime, c.targetIsTime, c.targetInLayout = t, true, true
+		}
+		if c.targetIsTime {
+			c.targetIsNum = false
+		}
+	}
+}
+
+// compare orders val against the target: as dates when the target is a
+// date (in any of schema.DateLayouts, so "03/15/2024" > "2024-01-01"), as
+// numbers when both are numbers ("9" < "10"), otherwise as strings. ok is
+// false when val cannot be ordered against the target: a null, a value
+// that is not a date for a date target, or a malformed value of a typed
+// column. It matches no range.
+func (c *Condition) compare(val string) (cmp int, ok bool) {
+	if c.targetIsTime {
+		t, ok := c.parseTime(val)
+		if !ok {
+			return 0, false
+		}
+		return t.Compare(c.targetTime), true
+	}
+	if c.targetIsNum {
+		if v, ok := parseNumber(val); ok {
+			switch {
+			case v < c.targetNum:
+				return -1, true
+			case v > c.targetNum:
+				return 1, true
+			}
+			return 0, true
+		}
+		if c.colType == schema.TypeInt || c.colType == schema.TypeFloat {
+			return 0, false
+		}
+	}
+	return strings.Compare(val, c.resolvedTarget), true
+}
+
+// isNullCheck reports whether c is an IS NULL or IS NOT NULL leaf.
+func (c *Condition) isNullCheck() bool {
+	return c.Operator == OpIsNull || c.Operator == OpIsNotNull
+}
+
+// matchesKey evaluates a range operator or null check against the value
+// of an index key.
+func (c *Condition) matchesKey(val string) bool {
 	switch c.Operator {
 	case OpIsNull:
-		return !exists || val == "" || val == "NULL"
+		return schema.IsNull(val)
 	case OpIsNotNull:
-		return exists && val != "" && val != "NULL"
+		return !schema.IsNull(val)
 	}
+	return c.matchesRange(val)
+}
 
-	if !exists {
-		return false // Default fail if column missing for other ops
+// matchesRange evaluates a range operator (>, <, >=, <=) against val.
+func (c *Condition) matchesRange(val string) bool {
+	cmp, ok := c.compare(val)
+	if !ok {
+		return false
 	}
-
-	target := c.resolvedTarget
-
 	switch c.Operator {
-	case OpEq:
-		return val == target
-	case OpNeq:
-		return val != target
 	case OpGt:
-		return val > target
+		return cmp > 0
 	case OpLt:
-		return val < target
+		return cmp < 0
 	case OpGte:
-		return val >= target
+		return cmp >= 0
 	case OpLte:
-		return val <= target
-	case OpLike:
-		// Simple wildcard match
-		// TODO: Regex or better globbing if needed
-		return strings.Contains(strings.ToLower(val), strings.ToLower(target))
+		return cmp <= 0
 	}
-
 	return false
 }
 
+// parseTime parses a value compared against a date target: in the
+// column's analyzed layout, else trying the target's layout first.
+func (c *Condition) parseTime(val string) (time.Time, bool) {
+	if c.dateLayout != "" {
+		return schema.ParseDate(c.dateLayout, val)
+	}
+	if t, ok := schema.ParseDate(c.targetLayout, val); ok {
+		return t, true
+	}
+	return schema.ParseDate("", val)
+}
+
+// sortsAsKeys reports whether compare orders the values between lo and hi
+// (the key bounds of a block) like index keys, as text, so the bounds can
+// rule the block out.
+func (c *Condition) sortsAsKeys(lo, hi string) bool {
+	if !c.targetIsTime {
+		return !c.targetIsNum
+	}
+	if c.colType == schema.TypeDate {
+		return c.targetInLayout && schema.SortsAsText(c.dateLayout)
+	}
+	// The column's format is unknown: trust the bounds if they are written
+	// like the target, in a layout whose text order is date order
+	if !schema.SortsAsText(c.targetLayout) {
+		return false
+	}
+	_, loOK := schema.ParseDate(c.targetLayout, lo)
+	_, hiOK := schema.ParseDate(c.targetLayout, hi)
+	return loOK && hiOK
+}
+
 // ResolveColumns pre-maps column names to integer indices for zero-allocation evaluation.
 // Must be called once before using EvaluateFast.
 func (c *Condition) ResolveColumns(headers map[string]int) {
@@ -113,15 +354,22 @@ func (c *Condition) ResolveColumns(headers map[string]int) {
 			c.resolvedColIdx = idx
 		}
 	}
-	// Pre-lowercase target for LIKE
-	if c.Operator == OpLike {
-		c.lowerTarget = strings.ToLower(c.resolvedTarget)
-	}
 	for i := range c.Children {
 		c.Children[i].ResolveColumns(headers)
 	}
 }
 
+// markColumns sets used[i] for every column index the condition reads
+// (after ResolveColumns).
+func (c *Condition) markColumns(used []bool) {
+	if c.resolvedColIdx >= 0 && c.resolvedColIdx < len(used) {
+		used[c.resolvedColIdx] = true
+	}
+	for i := range c.Children {
+		c.Children[i].markColumns(used)
+	}
+}
+
 // EvaluateFast checks if a row matches using pre-resolved column indices.
 // Zero allocations per call — works directly on the []string cols slice.
 func (c *Condition) EvaluateFast(cols []string) bool {
@@ -140,6 +388,8 @@ func (c *Condition) EvaluateFast(cols []string) bool {
 			}
 		}
 		return false
+	case OpNot:
+		return len(c.Children) == 1 && !c.Children[0].EvaluateFast(cols)
 	}
 
 	// Leaf nodes
@@ -162,27 +412,47 @@ func (c *Condition) EvaluateFast(cols []string) bool {
 	}
 
 	target := c.resolvedTarget
+	if c.fold {
+		val = common.FoldKey(val)
+	}
 
 	switch c.Operator {
 	case OpEq:
 		return val == target
 	case OpNeq:
 		return val != target
-	case OpGt:
-		return val > target
-	case OpLt:
-		return val < target
-	case OpGte:
-		return val >= target
-	case OpLte:
-		return val <= target
+	case OpGt, OpLt, OpGte, OpLte:
+		return c.matchesRange(val)
+	case OpBetween:
+		return len(c.between) == 2 && c.between[0].matchesRange(val) && c.between[1].matchesRange(val)
 	case OpLike:
-		return strings.Contains(strings.ToLower(val), c.lowerTarget)
+		return c.like != nil && c.like.match(val)
+	case OpRegex:
+		return c.regex != nil && c.regex.MatchString(val)
+	case OpInSet:
+		return c.set != nil && c.set.Contains(val)
 	}
 
 	return false
 }
 
+// onlyEqualities reports whether the condition is a single equality or an
+// AND of equalities, i.e. fully described by ExtractIndexConditions.
+func (c *Condition) onlyEqualities() bool {
+	switch c.Operator {
+	case OpEq:
+		return true
+	case "AND":
+		for i := range c.Children {
+			if c.Children[i].Operator != OpEq {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 // ExtractBestIndexKey finds the best single equality condition for legacy single-column search
 func (c *Condition) ExtractBestIndexKey() (string, string, bool) {
 	conds := c.ExtractIndexConditions()
@@ -192,7 +462,9 @@ func (c *Condition) ExtractBestIndexKey() (string, string, bool) {
 	return "", "", false
 }
 
-// ExtractIndexConditions finds all top-level equality conditions to use for composite indexing
+// ExtractIndexConditions finds all top-level equality conditions to use for
+// composite indexing. Negated equalities are NOT nodes (see normalize), so
+// they never select an index.
 func (c *Condition) ExtractIndexConditions() map[string]string {
 	res := make(map[string]string)
 	switch c.Operator {
@@ -208,7 +480,8 @@ func (c *Condition) ExtractIndexConditions() map[string]string {
 	return res
 }
 
-// ParseCondition parses the where JSON into a Condition tree
+// ParseCondition parses the where JSON into a Condition tree. Its errors
+// are of kind ErrBadWhere.
 func ParseCondition(data []byte) (*Condition, error) {
 	if len(data) == 0 || string(data) == "{}" || string(data) == "[]" {
 		return nil, nil
@@ -233,6 +506,9 @@ func ParseCondition(data []byte) (*Condition, error) {
 					Value:    valStr,
 				})
 			}
+			// In column order, not the map's: plans and cursors need the
+			// same tree for the same where
+			slices.SortFunc(root.Children, func(a, b Condition) int { return strings.Compare(a.Column, b.Column) })
 			root.resolveTargets()
 			return root, nil
 		}
@@ -242,11 +518,17 @@ func ParseCondition(data []byte) (*Condition, error) {
 	var complexCond Condition
 	if err := json.Unmarshal(data, &complexCond); err == nil {
 		if complexCond.Operator != "" {
+			if err := complexCond.normalize(); err != nil {
+				return nil, &kindError{kind: ErrBadWhere, err: err}
+			}
 			complexCond.resolveTargets()
+			if err := complexCond.compile(); err != nil {
+				return nil, &kindError{kind: ErrBadWhere, err: err}
+			}
 			return &complexCond, nil
 		}
 	}
 
 	// Fallback or error
-	return nil, fmt.Errorf("invalid where format")
+	return nil, errorf(ErrBadWhere, "invalid where format")
 }
@@ -0,0 +1,299 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// A parallel full scan maps the CSV and splits it into segments that begin
+// on record boundaries. Workers split their segment into records and fields
+// with the SIMD bitmaps of common.RecordScanner, as the indexer's scanner
+// does, and filter the rows; only the columns the filter reads become
+// strings. Segment results are consumed in file order, so rows come out as
+// a serial scan emits them, with the same line numbers.
+
+// scanSegmentBytes is the CSV a full scan worker takes at a time.
+const scanSegmentBytes = 8 << 20
+
+// scanMatch is a matching row found by a worker.
+type scanMatch struct {
+	offset int64
+	record int64 // Position among the records of its segment
+	row    []byte
+	raw    []byte
+}
+
+// segmentResult is what a worker found in one segment.
+type segmentResult struct {
+	records int64 // Records in the segment, matching or not
+	matched int64
+	matches []scanMatch // nil when only counting
+}
+
+// scanWorkers is the number of goroutines a full scan uses.
+func (q *QueryEngine) scanWorkers() int {
+	if q.config.Workers > 0 {
+		return q.config.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// runParallelScan is runFullScan for CSVs without pending row overrides.
+func (q *QueryEngine) runParallelScan() error {
+	data, release, err := q.mapCSV()
+	if err != nil {
+		return q.requireCSV(err)
+	}
+	defer release()
+
+	headers, virtualDefaults, err := q.getHeaderMap()
+	if err != nil {
+		return err
+	}
+	q.VirtualDefaults = virtualDefaults
+	if q.config.Where != nil {
+		q.config.Where.ResolveColumns(headers)
+	}
+
+	dataStart := len(data)
+	if end := common.RecordEnd(data); end >= 0 {
+		dataStart = end + 1
+	}
+	lineBase := int64(1) // Header is line 1
+	if err := q.checkCursorSource(cursorFullScan); err != nil {
+		return err
+	}
+	if c := q.cursor; c != nil {
+		// Resume at the record after the cursor's row
+		if c.Offset < int64(dataStart) || c.Offset >= int64(len(data)) {
+			return errorf(ErrStaleIndex, "the cursor is past the end of the CSV: start again without it")
+		}
+		dataStart = len(data)
+		if end := common.RecordEnd(data[c.Offset:]); end >= 0 {
+			dataStart = int(c.Offset) + end + 1
+		}
+		lineBase = c.Line
+	}
+
+	emitter, err := q.newRowEmitter("fullscan")
+	if err != nil {
+		return err
+	}
+	writer := emitter.w
+	defer func() { _ = writer.Flush() }()
+
+	execStart := time.Now()
+	prog := q.startProgress("Full Scan", int64(len(data)))
+	defer prog.finish()
+	sample := q.newSampler()
+
+	segments := max(1, (len(data)-dataStart+scanSegmentBytes-1)/scanSegmentBytes)
+	bounds := common.SplitRecords(data, dataStart, len(data), segments)
+	workers := min(q.scanWorkers(), segments)
+	keep := !q.config.CountOnly || sample != nil
+
+	// Segments are handed out in order, at most 2 per worker ahead of the
+	// one being consumed
+	results := make([]chan segmentResult, segments)
+	for i := range results {
+		results[i] = make(chan segmentResult, 1)
+	}
+	tokens := make(chan struct{}, 2*workers)
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	var stopped atomic.Bool
+	var wg sync.WaitGroup
+	defer func() {
+		stopped.Store(true)
+		close(stop)
+		wg.Wait() // Before the CSV is unmapped
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range segments {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := q.newSegmentScanner(data, headers, keep, &stopped)
+			for i := range jobs {
+				results[i] <- s.scan(bounds[i], bounds[i+1])
+			}
+		}()
+	}
+
+	count := int64(0)
+	skipped := 0
+	var last cursorPos // The last row emitted, for the next cursor
+
+consume:
+	for i := range segments {
+		res := <-results[i]
+		<-tokens
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+
+		if !keep {
+			n := res.matched
+			skip := min(n, int64(q.config.Offset-skipped))
+			skipped += int(skip)
+			count += n - skip
+			if q.config.Limit > 0 && count >= int64(q.config.Limit) {
+				count = int64(q.config.Limit)
+				break consume
+			}
+		}
+		for _, m := range res.matches {
+			if !sample.take() {
+				continue
+			}
+			lineNum := lineBase + m.record + 1
+			if sample.reservoir() {
+				sample.offer(m.offset, lineNum, m.row, m.raw)
+				continue
+			}
+			if skipped < q.config.Offset {
+				skipped++
+				continue
+			}
+			count++
+			if !q.config.CountOnly {
+				if err := emitter.Emit(m.offset, lineNum, m.row, m.raw); err != nil {
+					return err
+				}
+			}
+			if q.config.Limit > 0 && count >= int64(q.config.Limit) {
+				last.at(cursorBlocks, nil, m.offset, lineNum)
+				q.setNextCursor(cursorFullScan, last)
+				break consume
+			}
+		}
+		lineBase += res.records
+		prog.update(int64(bounds[i+1]), count)
+	}
+
+	if sample.reservoir() {
+		if count, err = q.emitSample(sample, emitter, nil); err != nil {
+			return err
+		}
+	}
+	if q.config.CountOnly {
+		q.writeCount(writer, count)
+	}
+
+	fmt.Fprintf(os.Stderr, "Full Scan Time: %v\n", time.Since(execStart))
+
+	return emitter.Finish()
+}
+
+// segmentScanner is the state of one full scan worker.
+type segmentScanner struct {
+	q       *QueryEngine
+	data    []byte
+	sep     byte
+	rs      common.RecordScanner
+	maxCol  int
+	used    []bool // Columns the filter reads
+	cols    []string
+	deletes bool
+	keep    bool
+	wanted  int64 // Matches after which the segment can stop (0 = all)
+	stopped *atomic.Bool
+}
+
+func (q *QueryEngine) newSegmentScanner(data []byte, headers map[string]int, keep bool, stopped *atomic.Bool) *segmentScanner {
+	maxCol := 0
+	for _, v := range headers {
+		maxCol = max(maxCol, v)
+	}
+	s := &segmentScanner{
+		q:       q,
+		data:    data,
+		sep:     q.separator(),
+		maxCol:  maxCol,
+		used:    make([]bool, maxCol+1),
+		cols:    make([]string, 0, maxCol+1+len(q.VirtualDefaults)),
+		deletes: q.Updates != nil && len(q.Updates.Deleted) > 0,
+		keep:    keep,
+		stopped: stopped,
+	}
+	if q.config.Where != nil {
+		q.config.Where.markColumns(s.used)
+	}
+	q.markComputed(s.used)
+	if q.config.Limit > 0 && !q.sampling() {
+		s.wanted = int64(q.config.Offset + q.config.Limit)
+	}
+	return s
+}
+
+// scan filters the records of data[start:end].
+func (s *segmentScanner) scan(start, end int) segmentResult {
+	var res segmentResult
+	if s.stopped.Load() {
+		return res
+	}
+	chunk := s.data[start:end]
+	s.rs.Reset(chunk, s.sep)
+	where := s.q.config.Where
+	s.rs.Records(func(recStart, _, next int) bool {
+		if res.records%4096 == 4095 && s.stopped.Load() {
+			return false
+		}
+		record := res.records
+		res.records++
+		raw := chunk[recStart:next]
+		offset := int64(start + recStart)
+
+		if s.deletes && s.q.Updates.IsDeleted(offset) {
+			return true
+		}
+		trimmed := bytes.TrimSpace(raw)
+		if where != nil && !where.EvaluateFast(s.columns(recStart, raw, trimmed)) {
+			return true
+		}
+
+		res.matched++
+		if s.keep {
+			res.matches = append(res.matches, scanMatch{offset: offset, record: record, row: trimmed, raw: raw})
+		}
+		if s.wanted > 0 && res.matched >= s.wanted {
+			return false // Enough for offset and limit: later rows are not emitted
+		}
+		return true
+	})
+	return res
+}
+
+// columns returns the row's fields as the filter sees them: the ones it
+// reads as strings, the others empty, then the virtual columns. raw starts
+// at chunk offset recStart, and trimmed is raw without surrounding
+// whitespace.
+func (s *segmentScanner) columns(recStart int, raw, trimmed []byte) []string {
+	ts := recStart + cap(raw) - cap(trimmed) // trimmed is a subslice of raw
+	s.cols = s.rs.Project(ts, ts+len(trimmed), s.used, s.cols[:0])
+	return s.q.appendVirtual(s.cols)
+}
@@ -0,0 +1,220 @@
+package query
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Index intersection. When no composite index covers a filter's
+// equalities, the single-column index of the most selective one is scanned
+// (see findBestIndex), and the single-column indexes of the others are
+// probed first: the CSV offsets of their keys (their posting lists, deltas
+// included) are intersected, and the scan skips every record whose offset
+// is not in all of them before reading its row. With every condition
+// covered and no key truncated, the rows are not read at all, and counts
+// come from the index alone. An index whose key is expected to match more
+// than intersectMaxRatio times the rows of the scanned one (see
+// estimate.go) is not probed: reading its posting list would cost more
+// than the rows it saves. Pending row updates turn intersection off, as
+// the indexes hold the rows as they were built.
+
+// intersectMaxRatio bounds the expected size of a probed posting list
+// relative to the scanned one.
+const intersectMaxRatio = 100
+
+// postingProbe is a posting list to intersect: the records of key in an
+// index.
+type postingProbe struct {
+	index string
+	file  string
+	key   string // Stored key (see common.EncodeKey)
+}
+
+// planIntersection plans probes of the single-column indexes of the
+// equality conditions other than the one of the scanned index.
+func (q *QueryEngine) planIntersection(plan map[string]interface{}, conds map[string]string, scanned string, folded map[string]bool) {
+	q.probes = nil
+	if q.updates != nil {
+		return
+	}
+	limit, bounded := q.equalityEstimate(scanned)
+	var cols []string
+	for col := range conds {
+		if col != scanned {
+			cols = append(cols, col)
+		}
+	}
+	sort.Strings(cols)
+
+	var names []string
+	for _, col := range q.bySelectivity(cols) {
+		if rows, ok := q.equalityEstimate(col); ok && bounded && rows > intersectMaxRatio*limit {
+			continue
+		}
+		p, truncated, ok := q.newPostingProbe(col, conds[col], folded)
+		if !ok {
+			continue
+		}
+		if truncated {
+			plan["key_truncated"] = true
+		}
+		q.probes = append(q.probes, p)
+		names = append(names, col)
+	}
+	if len(names) == 0 {
+		return
+	}
+	plan["strategy"] = "Index Intersection"
+	plan["intersected"] = names
+	plan["covered_columns"] = append([]string{scanned}, names...)
+}
+
+// newPostingProbe returns the probe of the single-column index of column
+// for an equality with value, if it has one whose keys compare like the
+// condition. truncated tells that the index holds only a prefix of value.
+func (q *QueryEngine) newPostingProbe(column, value string, folded map[string]bool) (p postingProbe, truncated, ok bool) {
+	if q.indexCollation(column) == common.CollationCI {
+		value = common.FoldKey(value)
+	} else if folded[strings.ToLower(column)] {
+		return p, false, false
+	}
+	file, ok := q.indexFileFor(column)
+	if !ok {
+		return p, false, false
+	}
+	key, truncated := common.EncodeKey(value)
+	return postingProbe{index: column, file: file, key: key}, truncated, true
+}
+
+// loadIntersection reads the posting lists of the planned probes and
+// keeps the offsets they share.
+func (q *QueryEngine) loadIntersection() error {
+	for i, p := range q.probes {
+		offsets, err := q.postingList(p)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			q.intersect = offsets
+		} else {
+			q.intersect = intersectOffsets(q.intersect, offsets)
+		}
+	}
+	return nil
+}
+
+// postingList returns the sorted CSV offsets of the records of a probe's
+// key.
+func (q *QueryEngine) postingList(p postingProbe) ([]int64, error) {
+	offsets := []int64{}
+	err := q.readPosting(p, func(rec *common.IndexRecord) {
+		offsets = append(offsets, rec.Offset)
+	})
+	slices.Sort(offsets)
+	return offsets, err
+}
+
+// readPosting visits the records of a probe's key, in its delta and its
+// index.
+func (q *QueryEngine) readPosting(p postingProbe, visit func(rec *common.IndexRecord)) error {
+	delta := deltaRecords(q.loadDelta(p.index), p.key, true)
+	for i := range delta {
+		visit(&delta[i])
+	}
+
+	if bloom, cleanup, err := q.openBloom(p.file + ".bloom"); err == nil {
+		absent := !bloom.MightContain(p.key)
+		cleanup()
+		if absent {
+			return nil
+		}
+	}
+	br, err := q.openBlockReader(p.file)
+	if err != nil {
+		return err
+	}
+	defer br.Cleanup()
+	key := []byte(p.key)
+	start, end := q.findBlockRange(br.Footer, p.key)
+	for i := start; i >= 0 && i <= end; i++ {
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+		meta := br.Footer.Blocks.At(i)
+		if meta.StartKey > p.key {
+			break
+		}
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			return err
+		}
+		for j := range records {
+			if compareRecordKey(&records[j].Key, key) == 0 {
+				visit(&records[j])
+			}
+		}
+	}
+	return nil
+}
+
+// intersectOffsets returns the offsets of both sorted lists.
+func intersectOffsets(a, b []int64) []int64 {
+	out := a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// intersects reports whether a record of the scanned index is in every
+// probed posting list (always, without probes).
+func (q *QueryEngine) intersects(offset int64) bool {
+	if q.intersect == nil {
+		return true
+	}
+	_, found := slices.BinarySearch(q.intersect, offset)
+	return found
+}
+
+// countIntersection counts the records of searchKey from startBlockIdx
+// on, and of the delta, that are in every probed posting list.
+func (q *QueryEngine) countIntersection(br *common.BlockReader, searchKey string, startBlockIdx, endBlockIdx int) (int64, error) {
+	var total int64
+	for i := range q.delta {
+		if q.intersects(q.delta[i].Offset) {
+			total++
+		}
+	}
+	key := []byte(searchKey)
+	for i := startBlockIdx; i >= 0 && i <= endBlockIdx; i++ {
+		if err := q.checkDeadline(); err != nil {
+			return 0, err
+		}
+		meta := br.Footer.Blocks.At(i)
+		if meta.StartKey > searchKey {
+			break
+		}
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			return 0, err
+		}
+		for j := range records {
+			if compareRecordKey(&records[j].Key, key) == 0 && q.intersects(records[j].Offset) {
+				total++
+			}
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,143 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+// testOrders is a CSV of 300 rows over a few cities and statuses.
+var testOrders = func() string {
+	var b strings.Builder
+	b.WriteString("id,name,city,status\n")
+	for i := range 300 {
+		fmt.Fprintf(&b, "%d,n%d,%s,%s\n", i, i, []string{"Paris", "Rome", "Oslo", "Lima", "Kyiv"}[i%5], []string{"open", "paid", "void"}[i%7%3])
+	}
+	return b.String()
+}()
+
+// offsets returns the offsets of rows: index records do not keep line
+// numbers.
+func offsets(rows []RowRef) []int64 {
+	out := make([]int64, len(rows))
+	for i := range rows {
+		out[i] = rows[i].Offset
+	}
+	return out
+}
+
+// scanTest runs cfg with no index, as the full scan that index plans must
+// agree with.
+func scanTest(t *testing.T, cfg QueryConfig) *Result {
+	t.Helper()
+	cfg.IndexDir = t.TempDir()
+	res, q, err := runTest(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Strategy != "Full Scan" {
+		t.Fatalf("reference query planned %q", q.Strategy)
+	}
+	return res
+}
+
+func TestIndexIntersection(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city","status","name"]`)
+	for _, tc := range []struct {
+		name     string
+		where    string
+		strategy string
+	}{
+		{"two equalities", `{"city":"Paris","status":"open"}`, "Index Intersection"},
+		{"three equalities", `{"city":"Rome","status":"paid","name":"n66"}`, "Index Intersection"},
+		{"no common row", `{"city":"Paris","name":"n1"}`, "Index Intersection"},
+		{"absent key", `{"city":"Paris","status":"lost"}`, "Index Intersection"},
+		{"post-filter", `{"operator":"AND","children":[
+			{"operator":"=","column":"city","value":"Oslo"},
+			{"operator":"=","column":"status","value":"void"},
+			{"operator":"LIKE","column":"name","value":"n1%"}]}`, "Index Intersection"},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.where)}
+		want := scanTest(t, cfg)
+
+		res, q, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if q.Strategy != tc.strategy {
+			t.Errorf("%s: strategy %q, want %q", tc.name, q.Strategy, tc.strategy)
+		}
+		if !reflect.DeepEqual(offsets(res.Rows), offsets(want.Rows)) {
+			t.Errorf("%s: rows %v, want %v", tc.name, offsets(res.Rows), offsets(want.Rows))
+		}
+
+		cfg.CountOnly = true
+		res, _, err = runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: count: %v", tc.name, err)
+		} else if res.Count.Count != int64(len(want.Rows)) {
+			t.Errorf("%s: count %d, want %d", tc.name, res.Count.Count, len(want.Rows))
+		}
+
+		cfg.CountOnly = false
+		if got := pageAll(t, cfg, 3); !reflect.DeepEqual(offsets(got), offsets(want.Rows)) {
+			t.Errorf("%s: pages %v, want %v", tc.name, offsets(got), offsets(want.Rows))
+		}
+	}
+}
+
+func TestIndexIntersectionPendingUpdates(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city","status"]`)
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Set(rowOffset(testOrders, "3"), "city", "Paris")  // Now matches
+	um.Set(rowOffset(testOrders, "0"), "status", "paid") // No longer matches
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, `{"city":"Paris","status":"open"}`)}
+	want := scanTest(t, cfg)
+	res, q, err := runTest(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Strategy == "Index Intersection" {
+		t.Error("intersected the indexes under pending updates")
+	}
+	// Updated rows come after those of the index (see cursor.go)
+	got := offsets(res.Rows)
+	slices.Sort(got)
+	if !reflect.DeepEqual(got, offsets(want.Rows)) {
+		t.Errorf("rows %v, want %v", got, offsets(want.Rows))
+	}
+	for _, id := range []string{"3", "0"} {
+		found := slices.ContainsFunc(res.Rows, func(r RowRef) bool { return r.Offset == rowOffset(testOrders, id) })
+		if found != (id == "3") {
+			t.Errorf("updated row %s found %v", id, found)
+		}
+	}
+}
+
+func TestIntersectOffsets(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, want []int64
+	}{
+		{[]int64{1, 3, 5, 7}, []int64{3, 4, 7, 9}, []int64{3, 7}},
+		{[]int64{1, 2}, []int64{3, 4}, []int64{}},
+		{[]int64{}, []int64{1}, []int64{}},
+		{[]int64{5}, []int64{5}, []int64{5}},
+	} {
+		a := append([]int64{}, tc.a...)
+		if got := intersectOffsets(a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("intersectOffsets(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Key set kinds
+const (
+	KeySetKeys  = "keys"  // Sorted distinct keys, one per line (exact)
+	KeySetBloom = "bloom" // Bloom filter over the distinct keys (approximate, much smaller)
+)
+
+const keySetFormat = "csvquery-keyset"
+
+// KeySetHeader is the first line (JSON) of a key set file. The payload
+// follows: newline-separated keys, or a serialized bloom filter.
+type KeySetHeader struct {
+	Format  string  `json:"format"`
+	Version int     `json:"version"`
+	Kind    string  `json:"kind"`
+	Column  string  `json:"column"`
+	Count   int64   `json:"count"`            // Distinct keys
+	FPRate  float64 `json:"fpRate,omitempty"` // Bloom false-positive rate
+	Source  string  `json:"source"`           // CSV the keys were exported from
+}
+
+// KeySet is the presence structure of a column exported by another
+// csvquery instance, used for semi-joins (--where-in-set).
+type KeySet struct {
+	Header KeySetHeader
+	keys   map[string]struct{}
+	bloom  *common.BloomFilter
+}
+
+// Contains reports whether key is in the set. Bloom key sets may report
+// false positives, never false negatives.
+func (s *KeySet) Contains(key string) bool {
+	if s.bloom != nil {
+		return s.bloom.MightContain(key)
+	}
+	_, ok := s.keys[key]
+	return ok
+}
+
+// ExportKeySet writes the distinct keys of an indexed column to q.Writer as
+// a key set. Only the index is read, never the CSV; rows written to the
+// index delta and pending updates count (see keyChanges).
+func (q *QueryEngine) ExportKeySet(column, kind string, fpRate float64) (KeySetHeader, error) {
+	column = strings.ToLower(column)
+	header := KeySetHeader{
+		Format:  keySetFormat,
+		Version: 1,
+		Kind:    kind,
+		Column:  column,
+		Source:  filepath.Base(q.config.CsvPath),
+	}
+	if kind != KeySetKeys && kind != KeySetBloom {
+		return header, errorf(ErrBadQuery, "unknown key set format %q (use %s or %s)", kind, KeySetKeys, KeySetBloom)
+	}
+	indexFile, ok := q.indexFileFor(column)
+	if !ok {
+		return header, errorf(ErrNoIndex, "no index on %s; run: csvquery index --input %s --columns '[\"%s\"]'", column, q.config.CsvPath, column)
+	}
+	q.UsedIndex = column
+
+	br, err := q.openBlockReader(indexFile)
+	if err != nil {
+		return header, fmt.Errorf("failed to init block reader: %w", err)
+	}
+	defer br.Cleanup()
+	changes, err := q.indexKeyChanges(column)
+	if err != nil {
+		return header, err
+	}
+
+	// Pass 1 counts (and for bloom sizes the filter); keys come out sorted
+	var bloom *common.BloomFilter
+	if err := distinctKeys(br, changes, func(string) error { header.Count++; return nil }); err != nil {
+		return header, err
+	}
+	if kind == KeySetBloom {
+		if fpRate <= 0 {
+			fpRate = 0.01
+		}
+		header.FPRate = fpRate
+		bloom = common.NewBloomFilter(int(header.Count), fpRate)
+	}
+
+	w := bufio.NewWriterSize(q.Writer, 65536)
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return header, err
+	}
+	_, _ = w.Write(headerJSON)
+	_ = w.WriteByte('\n')
+
+	err = distinctKeys(br, changes, func(key string) error {
+		if bloom != nil {
+			bloom.Add(key)
+			return nil
+		}
+		_, err := w.WriteString(key + "\n")
+		return err
+	})
+	if err != nil {
+		return header, err
+	}
+	if bloom != nil {
+		_, _ = w.Write(bloom.Serialize())
+	}
+	return header, w.Flush()
+}
+
+// distinctKeys calls fn for every distinct key of an index, in order, with
+// the changes since its build (nil = none) applied.
+func distinctKeys(br *common.BlockReader, changes *keyChanges, fn func(key string) error) error {
+	var added []string
+	var removed map[int64]bool
+	if changes != nil {
+		added, removed = changes.added, changes.removed
+	}
+	var last string // Last key passed to fn
+	first := true
+	put := func(key string) error {
+		if !first && key == last {
+			return nil
+		}
+		last, first = key, false
+		return fn(common.DecodeKey(key))
+	}
+
+	var lastRec [64]byte
+	firstRec := true
+	for _, meta := range br.Footer.Blocks.All() {
+		if meta.IsDistinct && !first && meta.StartKey == last {
+			continue // Run of a key already seen
+		}
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			return err
+		}
+		for i := range records {
+			if removed[records[i].Offset] || (!firstRec && records[i].Key == lastRec) {
+				continue
+			}
+			lastRec, firstRec = records[i].Key, false
+			key := common.KeyString(&lastRec)
+			for len(added) > 0 && added[0] < key {
+				if err := put(added[0]); err != nil {
+					return err
+				}
+				added = added[1:]
+			}
+			if err := put(key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range added {
+		if err := put(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeySet reads a key set file written by ExportKeySet.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet decodes a key set from its serialized form.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	nl := bytes.IndexByte(data, '\n')
+	if nl == -1 {
+		return nil, fmt.Errorf("invalid key set: missing header")
+	}
+	var set KeySet
+	if err := json.Unmarshal(data[:nl], &set.Header); err != nil || set.Header.Format != keySetFormat {
+		return nil, fmt.Errorf("invalid key set: not a %s file", keySetFormat)
+	}
+	payload := data[nl+1:]
+
+	switch set.Header.Kind {
+	case KeySetBloom:
+		set.bloom = common.DeserializeBloom(payload)
+		if set.bloom == nil {
+			return nil, fmt.Errorf("invalid key set: corrupt bloom filter")
+		}
+	case KeySetKeys:
+		set.keys = make(map[string]struct{}, set.Header.Count)
+		lines := bufio.NewScanner(bytes.NewReader(payload))
+		lines.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for lines.Scan() {
+			set.keys[lines.Text()] = struct{}{}
+		}
+		if err := lines.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid key set: unknown kind %q", set.Header.Kind)
+	}
+	return &set, nil
+}
+
+// attachKeySet adds the semi-join condition "column IN key set" to Where.
+func (q *QueryEngine) attachKeySet() error {
+	set := q.config.InSet
+	if set == nil && q.config.InSetFile != "" {
+		var err error
+		if set, err = LoadKeySet(q.config.InSetFile); err != nil {
+			return fmt.Errorf("failed to load key set: %w", err)
+		}
+	}
+	if set == nil {
+		return nil
+	}
+
+	column := strings.ToLower(q.config.InSetColumn)
+	if column == "" {
+		column = set.Header.Column
+	}
+	leaf := Condition{Operator: OpInSet, Column: column, set: set}
+
+	switch {
+	case q.config.Where == nil:
+		q.config.Where = &leaf
+	case q.config.Where.Operator == "AND":
+		q.config.Where.Children = append(q.config.Where.Children, leaf)
+	default:
+		q.config.Where = &Condition{Operator: "AND", Children: []Condition{*q.config.Where, leaf}}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// likeKind is the shape of a LIKE pattern; common shapes skip the regexp.
+type likeKind int
+
+const (
+	likeAny      likeKind = iota // "%": every value
+	likeExact                    // "abc"
+	likePrefix                   // "abc%"
+	likeSuffix                   // "%abc"
+	likeContains                 // "%abc%"
+	likeRegexp                   // Anything else, e.g. "a_c" or "a%b%c"
+)
+
+// likeMatcher matches a SQL LIKE pattern: % stands for any run of
+// characters, _ for exactly one, and the escape character (\ unless the
+// condition sets another) makes the character after it literal. Matching
+// ignores case, like the default collations of most databases.
+type likeMatcher struct {
+	kind likeKind
+	lit  string // Lowercase literal of the fast paths
+	re   *regexp.Regexp
+}
+
+// likeToken is a literal run or a wildcard ('%' or '_', with lit == "").
+type likeToken struct {
+	wildcard rune
+	lit      string
+}
+
+// compileLike parses pattern with escape as its escape character.
+func compileLike(pattern string, escape rune) (*likeMatcher, error) {
+	var tokens []likeToken
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			tokens = append(tokens, likeToken{lit: lit.String()})
+			lit.Reset()
+		}
+	}
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch {
+		case r == escape && i < len(pattern):
+			r, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+			lit.WriteRune(r)
+		case r == '%' || r == '_':
+			flush()
+			if r == '%' && len(tokens) > 0 && tokens[len(tokens)-1].wildcard == '%' {
+				continue // "%%" is "%"
+			}
+			tokens = append(tokens, likeToken{wildcard: r})
+		default:
+			lit.WriteRune(r)
+		}
+	}
+	flush()
+
+	m := &likeMatcher{kind: likeRegexp}
+	literal := func(t likeToken) bool { return t.wildcard == 0 }
+	pct := func(t likeToken) bool { return t.wildcard == '%' }
+	switch {
+	case len(tokens) == 0:
+		m.kind = likeExact // Matches the empty value only
+	case len(tokens) == 1 && pct(tokens[0]):
+		m.kind = likeAny
+	case len(tokens) == 1 && literal(tokens[0]):
+		m.kind, m.lit = likeExact, tokens[0].lit
+	case len(tokens) == 2 && literal(tokens[0]) && pct(tokens[1]):
+		m.kind, m.lit = likePrefix, tokens[0].lit
+	case len(tokens) == 2 && pct(tokens[0]) && literal(tokens[1]):
+		m.kind, m.lit = likeSuffix, tokens[1].lit
+	case len(tokens) == 3 && pct(tokens[0]) && literal(tokens[1]) && pct(tokens[2]):
+		m.kind, m.lit = likeContains, tokens[1].lit
+	}
+	m.lit = strings.ToLower(m.lit)
+	if m.kind != likeRegexp {
+		return m, nil
+	}
+
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, t := range tokens {
+		switch t.wildcard {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(t.lit))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid LIKE pattern %q: %w", pattern, err)
+	}
+	m.re = re
+	return m, nil
+}
+
+// match reports whether val matches the pattern.
+func (m *likeMatcher) match(val string) bool {
+	switch m.kind {
+	case likeAny:
+		return true
+	case likeExact:
+		return strings.EqualFold(val, m.lit)
+	case likePrefix:
+		return len(val) >= len(m.lit) && strings.EqualFold(val[:len(m.lit)], m.lit)
+	case likeSuffix:
+		return len(val) >= len(m.lit) && strings.EqualFold(val[len(val)-len(m.lit):], m.lit)
+	case likeContains:
+		return strings.Contains(strings.ToLower(val), m.lit)
+	}
+	return m.re.MatchString(val)
+}
@@ -0,0 +1,88 @@
+package query
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLikeMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		escape  rune
+		val     string
+		want    bool
+	}{
+		{"%", '\\', "", true},
+		{"%", '\\', "anything", true},
+		{"", '\\', "", true},
+		{"", '\\', "a", false},
+		{"abc", '\\', "ABC", true},
+		{"abc", '\\', "abcd", false},
+		{"ab%", '\\', "AbXYZ", true},
+		{"ab%", '\\', "a", false},
+		{"%yz", '\\', "xYZ", true},
+		{"%yz", '\\', "yzx", false},
+		{"%mid%", '\\', "a MID b", true},
+		{"%mid%", '\\', "mi d", false},
+		{"a_c", '\\', "abc", true},
+		{"a_c", '\\', "ac", false},
+		{"a_c", '\\', "aéc", true}, // _ is a character, not a byte
+		{"a%b%c", '\\', "axxbyyc", true},
+		{"a%b%c", '\\', "axxcyyb", false},
+		{"a%%b", '\\', "ab", true},
+		{"100\\%", '\\', "100%", true},
+		{"100\\%", '\\', "1000", false},
+		{"a\\_c", '\\', "a_c", true},
+		{"a\\_c", '\\', "abc", false},
+		{"100!%", '!', "100%", true},
+		{"100!%", '!', "100x", false},
+		{"a.c", '\\', "abc", false}, // Regexp characters are literal
+		{"a%", '\\', "a\nb", true},
+		{"x\\", '\\', "x\\", true}, // A trailing escape is literal
+	} {
+		m, err := compileLike(tc.pattern, tc.escape)
+		if err != nil {
+			t.Errorf("compileLike(%q): %v", tc.pattern, err)
+			continue
+		}
+		if got := m.match(tc.val); got != tc.want {
+			t.Errorf("%q LIKE %q (escape %q) = %v, want %v", tc.val, tc.pattern, tc.escape, got, tc.want)
+		}
+	}
+}
+
+func TestLikeRegexpQuery(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testCities, `["city"]`)
+	for _, tc := range []struct {
+		filter string
+		want   int64
+	}{
+		{`{"operator":"LIKE","column":"city","value":"p%"}`, 3},
+		{`{"operator":"LIKE","column":"city","value":"%O%"}`, 3},
+		{`{"operator":"LIKE","column":"city","value":"R_me"}`, 2},
+		{`{"operator":"LIKE","column":"name","value":"%e"}`, 2},
+		{`{"operator":"REGEXP","column":"city","value":"^(Rome|Oslo)$"}`, 3},
+		{`{"operator":"REGEXP","column":"city","value":"ari"}`, 3},
+		{`{"operator":"REGEXP","column":"city","value":"^ari"}`, 0},
+		{`{"operator":"REGEXP","column":"id","value":"^[1-3]$"}`, 3},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.filter), CountOnly: true}
+		res, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+		} else if res.Count.Count != tc.want {
+			t.Errorf("%s: count %d, want %d", tc.filter, res.Count.Count, tc.want)
+		}
+	}
+}
+
+func TestLikeRegexpInvalid(t *testing.T) {
+	for _, filter := range []string{
+		`{"operator":"REGEXP","column":"city","value":"(unclosed"}`,
+		`{"operator":"LIKE","column":"city","value":"a%","escape":"ab"}`,
+	} {
+		if _, err := ParseCondition([]byte(filter)); !errors.Is(err, ErrBadWhere) {
+			t.Errorf("%s: error %v, want a bad where", filter, err)
+		}
+	}
+}
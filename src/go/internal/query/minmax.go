@@ -0,0 +1,325 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+)
+
+// Scalar MIN and MAX. Without GroupBy, AggFunc "min" or "max" of AggCol is
+// answered from the keys of an index of the column, or of a composite index
+// whose leading columns are the filter's equalities followed by it: the
+// keys of those equalities are a run of the index sorted by the column.
+// Columns whose values sort as text (string, bool and sortable date
+// columns, see `csvquery analyze`) have their extremes in the first and
+// last keys of the run; the others, numbers among them, compare each key
+// of the run, distinct blocks by their start key alone. The CSV is read
+// only for values longer than a key holds. Null values ("" and "NULL") are
+// left out; with none other, the answer is empty.
+
+// minMax reports whether the query is a scalar MIN or MAX.
+func (q *QueryEngine) minMax() bool {
+	return q.config.GroupBy == "" && !q.config.CountOnly && (q.config.AggFunc == "min" || q.config.AggFunc == "max")
+}
+
+// planMinMax finds the index of a scalar MIN or MAX and records the key
+// prefix of its run (see findBestIndex).
+func (q *QueryEngine) planMinMax(plan map[string]interface{}) (string, error) {
+	column := strings.ToLower(q.config.AggCol)
+	if column == "" || column == "*" {
+		return "", errorf(ErrBadQuery, "%s needs --agg-col", strings.ToUpper(q.config.AggFunc))
+	}
+	conds := map[string]string{}
+	if q.config.Where != nil {
+		conds = q.config.Where.ExtractIndexConditions()
+		n := 1
+		if q.config.Where.Operator == "AND" {
+			n = len(q.config.Where.Children)
+		}
+		if !q.config.Where.onlyEqualities() || len(conds) != n {
+			return "", errorf(ErrNoIndex, "%s of %s is answered from index keys: the filter may only hold equalities", strings.ToUpper(q.config.AggFunc), column)
+		}
+	}
+	folded := q.foldedColumns()
+	meta := q.loadMeta()
+	var names []string
+	if meta != nil {
+		for name := range meta.Indexes {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := meta.Indexes[name]
+		columns := stats.Columns
+		if columns == nil && name == column {
+			columns = []string{column} // Old metadata: single-column indexes by name
+		}
+		if len(columns) <= len(conds) || !strings.EqualFold(columns[len(conds)], column) || stats.Collation == common.CollationCI {
+			continue
+		}
+		values := make([]string, 0, len(conds)+1)
+		for _, c := range columns[:len(conds)] {
+			v, ok := lookupFold(conds, c)
+			if !ok || folded[strings.ToLower(c)] {
+				break
+			}
+			values = append(values, v)
+		}
+		if len(values) < len(conds) {
+			continue
+		}
+		indexFile, ok := q.indexFileFor(name)
+		if !ok {
+			continue
+		}
+
+		// The run of the equalities: keys starting with their values
+		prefix, pos := "", -1
+		if len(columns) > 1 {
+			key := common.CompositeKey(append(values, ""))
+			prefix, pos = key[:len(key)-len(`""]`)], len(conds)
+		}
+		var truncated bool
+		if prefix, truncated = common.EncodeKey(prefix); truncated || len(prefix) >= common.KeySize {
+			continue // The column's values would not be in the keys
+		}
+		q.keyPrefix, q.keyPos = prefix, pos
+		plan["strategy"] = "Index Min/Max (Keys)"
+		plan["index"] = name
+		if len(conds) > 0 {
+			plan["covered_columns"] = columns[:len(conds)]
+		}
+		return indexFile, nil
+	}
+	return "", errorf(ErrNoIndex, "%s of %s needs an index of the column, or a composite index of the filter's columns followed by it: full scans do not aggregate", strings.ToUpper(q.config.AggFunc), column)
+}
+
+// lookupFold returns the value of the condition on column, whatever the
+// case of its name.
+func lookupFold(conds map[string]string, column string) (string, bool) {
+	for c, v := range conds {
+		if strings.EqualFold(c, column) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// runMinMax answers a scalar MIN or MAX from the run of the planned key
+// prefix in the index and its delta.
+func (q *QueryEngine) runMinMax(br *common.BlockReader) error {
+	headers, virtualDefaults, err := q.getHeaderMap()
+	if err != nil {
+		return fmt.Errorf("failed to read headers: %v", err)
+	}
+	q.VirtualDefaults = virtualDefaults
+	aggC, ok := headers[strings.ToLower(q.config.AggCol)]
+	if !ok {
+		return errorf(ErrBadQuery, "aggregation column '%s' not found", q.config.AggCol)
+	}
+	proj := q.newRowProjector(aggC, aggC)
+	var rows rowSource
+	defer func() {
+		if rows != nil {
+			rows.close()
+		}
+	}()
+
+	isMax := q.config.AggFunc == "max"
+	less := q.valueOrder()
+	var best string
+	found := false
+	// consider compares the value of a key with the best so far; offset
+	// locates the row of a key that may be truncated
+	consider := func(stored string, offset int64) error {
+		var value string
+		if common.KeyMayBeTruncated(stored) {
+			if rows == nil {
+				if rows, err = q.openRows(); err != nil {
+					return err
+				}
+			}
+			raw, err := rows.rowAt(offset)
+			if err != nil {
+				return err
+			}
+			row := bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte{'\n'}), []byte{'\r'})
+			cols := q.appendVirtual(proj.extract(row, nil))
+			if aggC < len(cols) {
+				value = cols[aggC]
+			}
+		} else if value, ok = q.keyValue(stored); !ok {
+			return fmt.Errorf("invalid composite key %q", stored)
+		}
+		if common.IsNullKey(value) {
+			return nil
+		}
+		if !found || (isMax && less(best, value)) || (!isMax && less(value, best)) {
+			best, found = value, true
+		}
+		return nil
+	}
+
+	for i := range q.delta {
+		stored := common.KeyString(&q.delta[i].Key)
+		if strings.HasPrefix(stored, q.keyPrefix) {
+			if err := consider(stored, q.delta[i].Offset); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Text-ordered single-column keys: the first (or last) non-null key of
+	// the run, with any rows sharing it when it may be truncated
+	firstKey := q.keyPos < 0 && q.sortsAsText(q.config.AggCol)
+	var extreme string
+	visit := func(stored string, offset int64) (bool, error) {
+		if firstKey {
+			if extreme != "" && stored != extreme {
+				return true, nil
+			}
+			if common.IsNullKey(stored) {
+				return false, nil
+			}
+			extreme = stored
+		}
+		if err := consider(stored, offset); err != nil {
+			return false, err
+		}
+		return firstKey && !common.KeyMayBeTruncated(stored), nil
+	}
+	if err := q.scanKeyRun(br, firstKey && isMax, visit); err != nil {
+		return err
+	}
+
+	if q.Result != nil {
+		q.Result.Value = &ValueResult{}
+		if found {
+			q.Result.Value.Value = &best
+		}
+		return nil
+	}
+	return writeValue(q.Writer, best)
+}
+
+// scanKeyRun visits the keys of the planned prefix's run in the index,
+// backward from the last when backward, until visit is done. A distinct
+// block is visited once, by its start key.
+func (q *QueryEngine) scanKeyRun(br *common.BlockReader, backward bool, visit func(stored string, offset int64) (bool, error)) error {
+	blocks := br.Footer.Blocks
+	n := blocks.Len()
+	start, end := 0, n-1
+	if q.keyPrefix != "" {
+		// The block before the first to start in the run may end in it
+		start = max(0, sort.Search(n, func(i int) bool { return blocks.StartKey(i) >= q.keyPrefix })-1)
+		after := q.keyPrefix[:len(q.keyPrefix)-1] + string(q.keyPrefix[len(q.keyPrefix)-1]+1)
+		end = sort.Search(n, func(i int) bool { return blocks.StartKey(i) >= after }) - 1
+	}
+	for k := 0; k <= end-start; k++ {
+		i := start + k
+		if backward {
+			i = end - k
+		}
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+		meta := blocks.At(i)
+		if meta.IsDistinct && !common.KeyMayBeTruncated(meta.StartKey) {
+			if !strings.HasPrefix(meta.StartKey, q.keyPrefix) {
+				continue
+			}
+			if done, err := visit(meta.StartKey, 0); err != nil || done {
+				return err
+			}
+			continue
+		}
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			return err
+		}
+		for j := range records {
+			rec := &records[j]
+			if backward {
+				rec = &records[len(records)-1-j]
+			}
+			stored := common.KeyString(&rec.Key)
+			if !strings.HasPrefix(stored, q.keyPrefix) {
+				continue
+			}
+			if done, err := visit(stored, rec.Offset); err != nil || done {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keyValue returns the AggCol value of a stored key.
+func (q *QueryEngine) keyValue(stored string) (string, bool) {
+	key := common.DecodeKey(stored)
+	if q.keyPos < 0 {
+		return key, true
+	}
+	values, err := common.SplitCompositeKey(key)
+	if err != nil || q.keyPos >= len(values) {
+		return "", false
+	}
+	return values[q.keyPos], true
+}
+
+// sortsAsText reports whether the values of an analyzed column sort like
+// its keys.
+func (q *QueryEngine) sortsAsText(column string) bool {
+	info, ok := q.columnInfo(strings.ToLower(column))
+	if !ok {
+		return false
+	}
+	switch info.Type {
+	case schema.TypeString, schema.TypeBool:
+		return true
+	case schema.TypeDate:
+		return schema.SortsAsText(info.Format)
+	}
+	return false
+}
+
+// valueOrder returns how AggCol values compare: as dates for date
+// columns, else as numbers when both are, else as text.
+func (q *QueryEngine) valueOrder() func(a, b string) bool {
+	info, _ := q.columnInfo(strings.ToLower(q.config.AggCol))
+	switch {
+	case q.sortsAsText(q.config.AggCol):
+		return func(a, b string) bool { return a < b }
+	case info.Type == schema.TypeDate:
+		return func(a, b string) bool {
+			ta, okA := schema.ParseDate(info.Format, a)
+			tb, okB := schema.ParseDate(info.Format, b)
+			if okA && okB {
+				return ta.Before(tb)
+			}
+			return a < b
+		}
+	}
+	return func(a, b string) bool {
+		fa, errA := strconv.ParseFloat(a, 64)
+		fb, errB := strconv.ParseFloat(b, 64)
+		if errA == nil && errB == nil {
+			return fa < fb
+		}
+		return a < b
+	}
+}
+
+// writeValue outputs the answer of a scalar MIN or MAX ("" = none).
+func writeValue(w io.Writer, value string) error {
+	_, err := fmt.Fprintln(w, value)
+	return err
+}
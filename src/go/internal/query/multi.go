@@ -0,0 +1,352 @@
+package query
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileColumn is the column multi-file queries prefix every row with: the
+// base name of the CSV the row comes from.
+const FileColumn = "_file"
+
+// IsMultiFile reports whether a --csv argument is a glob pattern that
+// selects several files (sales_*.csv) rather than a single path.
+func IsMultiFile(csvArg string) bool {
+	return strings.ContainsAny(csvArg, "*?[")
+}
+
+// RunMulti runs one query against every CSV matching pattern, up to workers
+// files at a time, and merges the results into out:
+//
+//   - counts are summed,
+//   - groups are merged per aggregate (avg from per-file sums and counts),
+//   - rows are interleaved as the files produce them, each prefixed with
+//     the FileColumn (in every format; csv gets one header),
+//   - explain prints the plan of every file.
+//
+// whereJSON is parsed for each file, as the engines modify their filter.
+// config.CsvPath is ignored; an empty IndexDir means each CSV's directory.
+// Offsets, cursors, --last, --order-by, scalar MIN/MAX, pivots, export
+// checkpoints and anti-joins do not span files.
+func RunMulti(pattern string, whereJSON []byte, config QueryConfig, workers int, out io.Writer) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errorf(fs.ErrNotExist, "no CSV file matches %s", pattern)
+	}
+	sort.Strings(files)
+	switch {
+	case config.Offset > 0:
+		return errorf(ErrBadQuery, "--offset does not apply to multi-file queries")
+	case config.CheckpointPath != "" || config.ResumeFrom != "":
+		return errorf(ErrBadQuery, "--checkpoint/--resume-from do not apply to multi-file queries")
+	case config.Cursor != "":
+		return errorf(ErrBadQuery, "--cursor does not apply to multi-file queries")
+	case config.Last:
+		return errorf(ErrBadQuery, "--last does not apply to multi-file queries")
+	case config.OrderBy != "":
+		return errorf(ErrBadQuery, "--order-by does not apply to multi-file queries")
+	case config.Pivot != "":
+		return errorf(ErrBadQuery, "--pivot does not apply to multi-file queries")
+	case config.GroupBy == "" && !config.CountOnly && (config.AggFunc == "min" || config.AggFunc == "max"):
+		return errorf(ErrBadQuery, "%s without --group-by does not apply to multi-file queries", strings.ToUpper(config.AggFunc))
+	case config.NotInFile != "":
+		return errorf(ErrBadQuery, "--where-not-in-file does not apply to multi-file queries")
+	case config.SampleRows > 0:
+		return errorf(ErrBadQuery, "--sample-rows does not apply to multi-file queries (use --sample)")
+	}
+
+	if config.OutputPath != "" {
+		f, err := os.Create(config.OutputPath)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+		config.OutputPath = ""
+	}
+
+	m := &multiQuery{files: files, where: whereJSON, config: config, workers: max(workers, 1)}
+	switch {
+	case config.Explain:
+		return m.explain(out)
+	case config.GroupBy != "":
+		return m.aggregate(out)
+	case config.CountOnly:
+		return m.count(out)
+	}
+	return m.rows(out)
+}
+
+// multiQuery is a query fanned out over several CSV files.
+type multiQuery struct {
+	files   []string
+	where   []byte
+	config  QueryConfig
+	workers int
+}
+
+// each runs the query against every file, at most workers at a time. The
+// writer for a file's output comes from newOut (called once per run); the
+// config can be adjusted per run by tweak (nil = as is).
+func (m *multiQuery) each(tweak func(*QueryConfig), newOut func(i int) io.Writer) error {
+	sem := make(chan struct{}, m.workers)
+	errs := make([]error, len(m.files))
+	var wg sync.WaitGroup
+	for i, file := range m.files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			errs[i] = m.run(file, tweak, newOut(i))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(m.files[i]), err)
+		}
+	}
+	return nil
+}
+
+func (m *multiQuery) run(file string, tweak func(*QueryConfig), w io.Writer) error {
+	cfg := m.config
+	cfg.CsvPath = file
+	if cfg.IndexDir == "" {
+		cfg.IndexDir = filepath.Dir(file)
+	}
+	cond, err := ParseCondition(m.where)
+	if err != nil {
+		return err
+	}
+	cfg.Where = cond
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	engine := NewQueryEngine(cfg)
+	engine.Writer = w
+	return engine.Run()
+}
+
+// count sums the count of every file.
+func (m *multiQuery) count(out io.Writer) error {
+	bufs := make([]bytes.Buffer, len(m.files))
+	if err := m.each(nil, func(i int) io.Writer { return &bufs[i] }); err != nil {
+		return err
+	}
+	var total int64
+	for i := range bufs {
+		n, err := strconv.ParseInt(strings.TrimSpace(bufs[i].String()), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: unexpected count output %q", filepath.Base(m.files[i]), bufs[i].String())
+		}
+		total += n
+	}
+	_, err := fmt.Fprintln(out, total)
+	return err
+}
+
+// aggregate merges the groups of every file. avg is computed from the sum
+// and count of each group, as averages of files do not combine.
+func (m *multiQuery) aggregate(out io.Writer) error {
+	fn := m.config.AggFunc
+	if fn == "avg" {
+		sums, err := m.groups("sum")
+		if err != nil {
+			return err
+		}
+		counts, err := m.groups("count")
+		if err != nil {
+			return err
+		}
+		sum, count := mergeGroups(sums, "sum"), mergeGroups(counts, "count")
+		for key, n := range count {
+			if n > 0 {
+				sum[key] /= n
+			}
+		}
+		return m.writeGroups(out, sum)
+	}
+	results, err := m.groups(fn)
+	if err != nil {
+		return err
+	}
+	return m.writeGroups(out, mergeGroups(results, fn))
+}
+
+// writeGroups outputs merged groups: a map, or ordered and limited as one
+// file's query would with AggSort.
+func (m *multiQuery) writeGroups(out io.Writer, groups map[string]float64) error {
+	if m.config.AggSort == "" && m.config.AggLimit == 0 {
+		return json.NewEncoder(out).Encode(groups)
+	}
+	ranked, err := RankGroups(groups, m.config.AggSort, m.config.AggLimit)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(ranked)
+}
+
+// groups runs a group-by with aggregate fn on every file.
+func (m *multiQuery) groups(fn string) ([]map[string]float64, error) {
+	bufs := make([]bytes.Buffer, len(m.files))
+	// Files return all their groups: a group's rank needs every file's
+	tweak := func(cfg *QueryConfig) { cfg.AggFunc, cfg.AggSort, cfg.AggLimit = fn, "", 0 }
+	if err := m.each(tweak, func(i int) io.Writer { return &bufs[i] }); err != nil {
+		return nil, err
+	}
+	results := make([]map[string]float64, len(m.files))
+	for i := range bufs {
+		if err := json.Unmarshal(bufs[i].Bytes(), &results[i]); err != nil {
+			return nil, fmt.Errorf("%s: unexpected group-by output: %w", filepath.Base(m.files[i]), err)
+		}
+	}
+	return results, nil
+}
+
+// mergeGroups combines per-file groups of aggregate fn.
+func mergeGroups(results []map[string]float64, fn string) map[string]float64 {
+	merged := make(map[string]float64)
+	for _, groups := range results {
+		for key, v := range groups {
+			cur, ok := merged[key]
+			switch {
+			case !ok:
+				merged[key] = v
+			case fn == "min":
+				merged[key] = min(cur, v)
+			case fn == "max":
+				merged[key] = max(cur, v)
+			case fn == "": // Distinct: presence
+			default: // count, sum
+				merged[key] = cur + v
+			}
+		}
+	}
+	return merged
+}
+
+// explain prints the plan of every file, keyed by file name.
+func (m *multiQuery) explain(out io.Writer) error {
+	bufs := make([]bytes.Buffer, len(m.files))
+	if err := m.each(nil, func(i int) io.Writer { return &bufs[i] }); err != nil {
+		return err
+	}
+	plans := make(map[string]json.RawMessage, len(m.files))
+	for i, file := range m.files {
+		plans[filepath.Base(file)] = json.RawMessage(bytes.TrimSpace(bufs[i].Bytes()))
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plans)
+}
+
+// rows interleaves the rows of every file, each line prefixed with its
+// file name, up to Limit rows in all.
+func (m *multiQuery) rows(out io.Writer) error {
+	mo := &multiOutput{w: bufio.NewWriterSize(out, 65536), limit: int64(m.config.Limit), csv: m.config.Format == "csv"}
+	writers := make([]*prefixWriter, len(m.files))
+	err := m.each(nil, func(i int) io.Writer {
+		writers[i] = &prefixWriter{out: mo, prefix: csvField(filepath.Base(m.files[i])) + ",", header: mo.csv}
+		return writers[i]
+	})
+	for _, w := range writers {
+		if w != nil {
+			w.close()
+		}
+	}
+	if flushErr := mo.w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// multiOutput is the shared output of a multi-file row query.
+type multiOutput struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	limit  int64 // 0 = none
+	rows   int64
+	csv    bool
+	header bool // csv header written
+}
+
+func (mo *multiOutput) line(prefix, line []byte, isHeader bool) error {
+	mo.mu.Lock()
+	defer mo.mu.Unlock()
+	if isHeader {
+		if mo.header {
+			return nil
+		}
+		mo.header = true
+		prefix = []byte(FileColumn + ",")
+	} else {
+		if mo.limit > 0 && mo.rows >= mo.limit {
+			return nil // Every engine stops at Limit rows too
+		}
+		mo.rows++
+	}
+	_, _ = mo.w.Write(prefix)
+	_, _ = mo.w.Write(line)
+	return mo.w.WriteByte('\n')
+}
+
+// prefixWriter passes the output of one file's engine on line by line,
+// with the file column in front.
+type prefixWriter struct {
+	out     *multiOutput
+	prefix  string
+	header  bool // Next line is the csv header
+	partial []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.partial = append(p.partial, b...)
+			break
+		}
+		line := b[:i]
+		if len(p.partial) > 0 {
+			line = append(p.partial, line...)
+			p.partial = p.partial[:0]
+		}
+		b = b[i+1:]
+		if err := p.out.line([]byte(p.prefix), line, p.header); err != nil {
+			return 0, err
+		}
+		p.header = false
+	}
+	return n, nil
+}
+
+// close passes on a last line without a terminator.
+func (p *prefixWriter) close() {
+	if len(p.partial) > 0 {
+		_ = p.out.line([]byte(p.prefix), p.partial, p.header)
+		p.partial = nil
+	}
+}
+
+// csvField quotes a value for a CSV line if it needs it.
+func csvField(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
@@ -0,0 +1,131 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/indexer"
+)
+
+// newMultiCSV writes each of files (name -> data) to one temp dir and
+// indexes its city column. It returns the glob of the files.
+func newMultiCSV(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		csvPath := filepath.Join(dir, name)
+		if err := os.WriteFile(csvPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := indexer.NewIndexer(indexer.IndexerConfig{
+			InputFile: csvPath, OutputDir: dir, Columns: `["city"]`,
+			Workers: 1, MemoryMB: 16, BloomFPRate: 0.01, Output: io.Discard,
+		}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "sales_*.csv")
+}
+
+// runMulti runs a multi-file query and returns its output.
+func runMulti(t *testing.T, pattern, whereJSON string, cfg QueryConfig) (string, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	err := RunMulti(pattern, []byte(whereJSON), cfg, 2, &buf)
+	return buf.String(), err
+}
+
+func TestRunMulti(t *testing.T) {
+	pattern := newMultiCSV(t, map[string]string{
+		"sales_1.csv": "id,city\n1,Paris\n3,Paris\n4,Rome\n",
+		"sales_2.csv": "id,city\n10,Paris\n20,Oslo\n",
+	})
+
+	out, err := runMulti(t, pattern, `{"city":"Paris"}`, QueryConfig{CountOnly: true})
+	if err != nil || out != "3\n" {
+		t.Errorf("count: %q (%v), want 3", out, err)
+	}
+
+	// avg from the sums and counts of every file: Paris is (1+3+10)/3, not
+	// the average of the files' averages
+	for _, tc := range []struct {
+		fn   string
+		want map[string]float64
+	}{
+		{"count", map[string]float64{"Paris": 3, "Rome": 1, "Oslo": 1}},
+		{"sum", map[string]float64{"Paris": 14, "Rome": 4, "Oslo": 20}},
+		{"avg", map[string]float64{"Paris": 14.0 / 3, "Rome": 4, "Oslo": 20}},
+		{"min", map[string]float64{"Paris": 1, "Rome": 4, "Oslo": 20}},
+		{"max", map[string]float64{"Paris": 10, "Rome": 4, "Oslo": 20}},
+	} {
+		out, err := runMulti(t, pattern, "", QueryConfig{GroupBy: "city", AggFunc: tc.fn, AggCol: "id"})
+		if err != nil {
+			t.Errorf("%s: %v", tc.fn, err)
+			continue
+		}
+		var got map[string]float64
+		if err := json.Unmarshal([]byte(out), &got); err != nil {
+			t.Errorf("%s: output %q: %v", tc.fn, out, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: groups %v, want %v", tc.fn, got, tc.want)
+		}
+	}
+
+	// Rows carry their file; csv has one header
+	out, err = runMulti(t, pattern, `{"city":"Paris"}`, QueryConfig{Format: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 4 || lines[0] != FileColumn+",id,city" {
+		t.Fatalf("rows %q, want a header and 3 rows", out)
+	}
+	rows := lines[1:]
+	sort.Strings(rows)
+	if want := []string{"sales_1.csv,1,Paris", "sales_1.csv,3,Paris", "sales_2.csv,10,Paris"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+	out, err = runMulti(t, pattern, `{"city":"Paris"}`, QueryConfig{Format: "csv", Limit: 2})
+	if n := strings.Count(out, "\n"); err != nil || n != 3 {
+		t.Errorf("limit 2: %q (%v), want a header and 2 rows", out, err)
+	}
+
+	// Explain: one plan per file
+	out, err = runMulti(t, pattern, `{"city":"Paris"}`, QueryConfig{Explain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plans map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &plans); err != nil {
+		t.Fatalf("explain %q: %v", out, err)
+	}
+	if len(plans) != 2 || plans["sales_1.csv"]["strategy"] == nil || plans["sales_2.csv"]["strategy"] == nil {
+		t.Errorf("explain %q, want the plans of both files", out)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		cfg     QueryConfig
+		want    error
+	}{
+		{"offset", pattern, QueryConfig{Offset: 1}, ErrBadQuery},
+		{"anti-join", pattern, QueryConfig{NotInFile: "keys.txt", NotInColumn: "id"}, ErrBadQuery},
+		{"no match", filepath.Join(filepath.Dir(pattern), "none_*.csv"), QueryConfig{CountOnly: true}, os.ErrNotExist},
+	} {
+		if _, err := runMulti(t, tc.pattern, "", tc.cfg); !errors.Is(err, tc.want) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
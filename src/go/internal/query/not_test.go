@@ -0,0 +1,97 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// describe writes a filter tree compactly: OP(children) or column op value.
+func describe(c *Condition) string {
+	if len(c.Children) == 0 {
+		if c.Value == nil {
+			return fmt.Sprintf("%s %s", c.Column, c.Operator)
+		}
+		return fmt.Sprintf("%s %s %v", c.Column, c.Operator, c.Value)
+	}
+	parts := make([]string, len(c.Children))
+	for i := range c.Children {
+		parts[i] = describe(&c.Children[i])
+	}
+	return fmt.Sprintf("%s(%s)", c.Operator, strings.Join(parts, ", "))
+}
+
+func TestNotNormalize(t *testing.T) {
+	const a, b, c = `{"operator":"=","column":"a","value":"1"}`, `{"operator":"=","column":"b","value":"2"}`, `{"operator":"=","column":"c","value":"3"}`
+	not := func(child string) string { return `{"operator":"NOT","children":[` + child + `]}` }
+	op := func(op string, children ...string) string {
+		return `{"operator":"` + op + `","children":[` + strings.Join(children, ",") + `]}`
+	}
+	for _, tc := range []struct {
+		filter, want string
+	}{
+		{not(a), "NOT(a = 1)"},
+		{not(not(a)), "a = 1"},
+		{not(not(not(a))), "NOT(a = 1)"},
+		{not(op("AND", a, b)), "OR(NOT(a = 1), NOT(b = 2))"},
+		{not(op("OR", a, b)), "AND(NOT(a = 1), NOT(b = 2))"},
+		{not(op("AND", a, not(b))), "OR(NOT(a = 1), b = 2)"},
+		{op("AND", c, not(op("OR", a, b))), "AND(c = 3, NOT(a = 1), NOT(b = 2))"},
+		{op("OR", c, not(op("AND", a, b))), "OR(c = 3, NOT(a = 1), NOT(b = 2))"},
+		{not(`{"operator":"IS NULL","column":"a"}`), "a IS NOT NULL"},
+		{not(`{"operator":"IS NOT NULL","column":"a"}`), "a IS NULL"},
+	} {
+		cond := where(t, tc.filter)
+		if got := describe(cond); got != tc.want {
+			t.Errorf("%s: normalized to %s, want %s", tc.filter, got, tc.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`{"operator":"NOT","children":[]}`,
+		`{"operator":"NOT","children":[` + a + `,` + b + `]}`,
+		not(`{"operator":"NOT","children":[]}`),
+	} {
+		if _, err := ParseCondition([]byte(filter)); !errors.Is(err, ErrBadWhere) {
+			t.Errorf("%s: error %v, want a bad where", filter, err)
+		}
+	}
+}
+
+func TestNotQuery(t *testing.T) {
+	// Row 7 has no city: NOT (city = Paris) matches it, city != Paris
+	// does not
+	data := testCities + "7,gus\n"
+	csvPath, dir := newTestCSV(t, data, `["city","name"]`)
+	for _, tc := range []struct {
+		filter string
+		want   []string
+	}{
+		{`{"operator":"NOT","children":[{"operator":"=","column":"city","value":"Paris"}]}`, []string{"2", "4", "5", "7"}},
+		{`{"operator":"!=","column":"city","value":"Paris"}`, []string{"2", "4", "5"}},
+		{`{"operator":"NOT","children":[{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"=","column":"city","value":"Rome"}]}]}`, []string{"4", "7"}},
+		{`{"operator":"AND","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"NOT","children":[{"operator":"=","column":"name","value":"cy"}]}]}`, []string{"1", "6"}},
+		{`{"operator":"NOT","children":[{"operator":"IS NULL","column":"city"}]}`, []string{"1", "2", "3", "4", "5", "6"}},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.filter)}
+		res, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.filter, err)
+			continue
+		}
+		var got []string
+		for _, r := range res.Rows {
+			got = append(got, data[r.Offset:][:strings.IndexByte(data[r.Offset:], ',')])
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: rows %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
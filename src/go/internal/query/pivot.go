@@ -0,0 +1,92 @@
+package query
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Pivot tables. With QueryConfig.Pivot, a group-by groups rows by the
+// GroupBy value and the pivot column's value together, in one scan: each
+// pair is a group of the usual table (spilling like any other, see
+// spill.go), keyed by the composite key of the two values. The groups are
+// then laid out as a crosstab, one row per GroupBy value and one column per
+// distinct pivot value, as JSON ({"row": {"column": value}}) or, with
+// Format "csv", as a table with a header row. Cells of pairs no row has are
+// left out (empty in csv).
+
+// checkPivot validates QueryConfig.Pivot.
+func (q *QueryEngine) checkPivot() error {
+	switch {
+	case q.config.Pivot == "":
+		return nil
+	case q.config.GroupBy == "":
+		return errorf(ErrBadQuery, "--pivot spreads groups into columns: add --group-by")
+	case q.config.AggSort != "":
+		return errorf(ErrBadQuery, "--pivot does not combine with --agg-sort")
+	}
+	return nil
+}
+
+// pivotKey is the group of a row of GroupBy value row and pivot value col.
+func pivotKey(row, col string) string {
+	return common.CompositeKey([]string{row, col})
+}
+
+// writePivot lays out the groups of a pivot query as a crosstab.
+func (q *QueryEngine) writePivot(groups map[string]AggValue) error {
+	table := make(map[string]map[string]AggValue)
+	for key, val := range groups {
+		values, err := common.SplitCompositeKey(key)
+		if err != nil || len(values) != 2 {
+			continue
+		}
+		cells := table[values[0]]
+		if cells == nil {
+			cells = make(map[string]AggValue)
+			table[values[0]] = cells
+		}
+		cells[values[1]] = val
+	}
+	if q.Result != nil {
+		q.Result.Pivot = table
+		return nil
+	}
+	if q.config.Format != "csv" {
+		return json.NewEncoder(q.Writer).Encode(table)
+	}
+
+	rows := make([]string, 0, len(table))
+	var columns []string
+	for row, cells := range table {
+		rows = append(rows, row)
+		for col := range cells {
+			columns = append(columns, col)
+		}
+	}
+	slices.Sort(rows)
+	slices.Sort(columns)
+	columns = slices.Compact(columns)
+
+	sep := q.separator()
+	line := common.AppendField(nil, q.config.GroupBy, sep)
+	for _, col := range columns {
+		line = append(line, sep)
+		line = common.AppendField(line, col, sep)
+	}
+	line = append(line, '\n')
+	for _, row := range rows {
+		line = common.AppendField(line, row, sep)
+		for _, col := range columns {
+			line = append(line, sep)
+			if val, ok := table[row][col]; ok {
+				line = strconv.AppendFloat(line, float64(val), 'f', -1, 64)
+			}
+		}
+		line = append(line, '\n')
+	}
+	_, err := q.Writer.Write(line)
+	return err
+}
@@ -0,0 +1,186 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// progressInterval is how often a running scan reports progress (--verbose,
+// QueryConfig.OnProgress).
+const progressInterval = 1 * time.Second
+
+// partialInterval is how often an aggregation passes its groups so far to
+// QueryConfig.OnPartial.
+const partialInterval = 500 * time.Millisecond
+
+// Progress is a snapshot of a running scan, as passed to
+// QueryConfig.OnProgress.
+type Progress struct {
+	Phase   string        // Scan phase, e.g. "Full Scan" or "Index Scan"
+	Scanned int64         // Bytes scanned so far
+	Total   int64         // Bytes the scan will read (0 = unknown)
+	Matched int64         // Rows matched so far
+	Elapsed time.Duration // Time since the scan began
+	ETA     time.Duration // Estimated time left (0 = unknown)
+}
+
+// progress tracks a scan's bytes scanned and rows matched. It feeds the
+// query's status activity (SIGUSR1 dumps) and, once per interval, prints a
+// status line with an ETA (--verbose) and passes a snapshot to
+// QueryConfig.OnProgress. Scans that finish within the first interval
+// report nothing. A nil *progress is a no-op.
+type progress struct {
+	phase   string
+	total   int64 // Bytes the scan will read (0 = unknown)
+	done    atomic.Int64
+	matched atomic.Int64
+	start   time.Time
+
+	out      io.Writer // nil unless printing
+	callback func(Progress)
+	stop     chan struct{} // nil unless reporting
+	wait     chan struct{}
+}
+
+// startProgress begins tracking a scan phase.
+func (q *QueryEngine) startProgress(phase string, total int64) *progress {
+	p := &progress{
+		phase:    phase,
+		total:    total,
+		start:    time.Now(),
+		callback: q.config.OnProgress,
+	}
+	if q.config.Verbose {
+		p.out = os.Stderr
+	}
+	q.activity.SetPhase(phase)
+	q.activity.SetReporter(p.statusLine)
+	if p.out == nil && p.callback == nil {
+		return p
+	}
+
+	p.stop = make(chan struct{})
+	p.wait = make(chan struct{})
+	go func() {
+		defer close(p.wait)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if p.out != nil {
+					// Whole lines rather than \r updates: DEBUG output shares stderr
+					fmt.Fprintf(p.out, "[%s] %s\n", p.phase, p.statusLine())
+				}
+				if p.callback != nil {
+					p.callback(p.snapshot())
+				}
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// update records the bytes scanned and rows matched so far.
+func (p *progress) update(done, matched int64) {
+	if p == nil {
+		return
+	}
+	p.done.Store(done)
+	p.matched.Store(matched)
+}
+
+// finish stops reporting. Safe to call on nil.
+func (p *progress) finish() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.wait
+}
+
+// snapshot returns the progress so far.
+func (p *progress) snapshot() Progress {
+	s := Progress{
+		Phase:   p.phase,
+		Scanned: p.done.Load(),
+		Total:   p.total,
+		Matched: p.matched.Load(),
+		Elapsed: time.Since(p.start),
+	}
+	if p.total > 0 && s.Scanned > 0 {
+		fraction := float64(s.Scanned) / float64(p.total)
+		s.ETA = max(time.Duration(s.Elapsed.Seconds()/fraction*float64(time.Second))-s.Elapsed, 0)
+	}
+	return s
+}
+
+// statusLine summarizes progress so far.
+func (p *progress) statusLine() string {
+	s := p.snapshot()
+
+	etaStr := "calculating..."
+	pct := ""
+	if p.total > 0 && s.Scanned > 0 {
+		pct = fmt.Sprintf(" (%.1f%%)", float64(s.Scanned)/float64(p.total)*100)
+		if s.ETA > 0 {
+			etaStr = s.ETA.Round(time.Second).String()
+		} else {
+			etaStr = "finishing..."
+		}
+	}
+
+	return fmt.Sprintf("Scanned: %s / %s%s | Matched: %d | Elapsed: %s | ETA: %s",
+		formatSize(s.Scanned), formatSize(p.total), pct, s.Matched, s.Elapsed.Round(time.Second), etaStr)
+}
+
+// statusDetail describes the query for status dumps.
+func (q *QueryEngine) statusDetail() string {
+	detail := "csv=" + q.config.CsvPath
+	if q.config.Where != nil {
+		if where, err := json.Marshal(q.config.Where); err == nil {
+			if len(where) > 200 {
+				where = append(where[:200:200], "..."...)
+			}
+			detail += " where=" + string(where)
+		}
+	}
+	if q.config.GroupBy != "" {
+		detail += " groupBy=" + q.config.GroupBy
+	}
+	return detail
+}
+
+// scanBytes is the compressed size of the blocks an index scan will visit.
+func scanBytes(br *common.BlockReader, searchKey string, hasSearchKey bool, startBlockIdx, endBlockIdx int) int64 {
+	var total int64
+	for i := startBlockIdx; i <= endBlockIdx && i < br.Footer.Blocks.Len(); i++ {
+		if hasSearchKey && br.Footer.Blocks.At(i).StartKey > searchKey {
+			break
+		}
+		total += br.Footer.Blocks.At(i).Length
+	}
+	return total
+}
+
+// formatSize renders a byte count for progress lines.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,76 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Result holds the results of a query run with QueryEngine.Result set, as
+// values rather than the text Run writes to Writer otherwise: callers
+// serving them in another form (the daemon) need not parse that text
+// back. Only the field of the query's kind is set.
+type Result struct {
+	Count   *CountResult                   // CountOnly queries
+	Value   *ValueResult                   // Scalar MIN and MAX queries
+	Rows    []RowRef                       // Matching rows, in output order (unless OnRow is set)
+	Groups  map[string]AggValue            // GroupBy queries
+	Ranked  []Group                        // GroupBy queries with AggSort, in order
+	Pivot   map[string]map[string]AggValue // GroupBy queries with Pivot: row, then column
+	Plan    map[string]any                 // Explain queries
+	Missing []string                       // Anti-join keys not found, in key file order
+
+	// OnRow receives each matching row as it is found, instead of Rows
+	// collecting them (nil = collect). Rows are passed one at a time, in
+	// output order.
+	OnRow func(RowRef)
+}
+
+// CountResult is the answer of a CountOnly query.
+type CountResult struct {
+	Count int64 `json:"count"`
+}
+
+// ValueResult is the answer of a scalar MIN or MAX query.
+type ValueResult struct {
+	Value *string `json:"value"` // nil when no row has a value
+}
+
+// RowRef locates a matching row in the CSV.
+type RowRef struct {
+	Offset int64 `json:"offset"` // Byte offset of the row's start
+	Line   int64 `json:"line"`   // Line number, counting records
+}
+
+// AggValue is the aggregate of one group.
+type AggValue float64
+
+// writeCount outputs the answer of a CountOnly query to w, or records it
+// in the Result.
+func (q *QueryEngine) writeCount(w io.Writer, n int64) {
+	if q.Result != nil {
+		q.Result.Count = &CountResult{Count: n}
+		return
+	}
+	_, _ = fmt.Fprintln(w, n)
+}
+
+// writePlan outputs an explain plan, or records it in the Result.
+func (q *QueryEngine) writePlan(plan map[string]any) error {
+	if q.Result != nil {
+		q.Result.Plan = plan
+		return nil
+	}
+	enc := json.NewEncoder(q.Writer)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+// addRow records a matching row in r.
+func (r *Result) addRow(ref RowRef) {
+	if r.OnRow != nil {
+		r.OnRow(ref)
+		return
+	}
+	r.Rows = append(r.Rows, ref)
+}
@@ -0,0 +1,181 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Backward index scans. With QueryConfig.Last, Limit and Offset count from
+// the end of the output: an index scan visits its rows from the last one
+// (the delta's, then the blocks' from the highest key down, records
+// backward within a block) and stops once it has them, so "the last N"
+// reads the end of the index rather than all of it. The rows are then
+// emitted in the usual order. QueryConfig.OrderBy "desc" emits them as
+// they are visited instead, from the highest key down, with Limit and
+// Offset applied in that order; naming a column rather than "key" makes
+// the scan use its index, walking all of it without a filter; a column of
+// numbers is refused, as its index orders them as text. Full scans
+// have no end to start from, and dirty rows (see updates.go) are known
+// only once the scan before them is done, so neither reads backward.
+
+// tailRow is a row a backward scan keeps until it is emitted.
+type tailRow struct {
+	offset, line int64
+	row, raw     []byte
+}
+
+// checkLast validates QueryConfig.Last.
+func (q *QueryEngine) checkLast() error {
+	if !q.config.Last {
+		return nil
+	}
+	switch {
+	case q.config.Limit <= 0:
+		return errorf(ErrBadQuery, "--last needs a --limit: the number of rows from the end")
+	case q.config.CountOnly || q.config.GroupBy != "" || q.config.NotInFile != "":
+		return errorf(ErrBadQuery, "--last applies to row queries, not counts, groups or anti-joins")
+	case q.sampling():
+		return errorf(ErrBadQuery, "--last does not combine with sampling")
+	case q.config.Cursor != "":
+		return errorf(ErrBadQuery, "--last does not combine with a cursor")
+	case q.config.CheckpointPath != "" || q.config.ResumeFrom != "":
+		return errorf(ErrBadQuery, "--last does not combine with --checkpoint/--resume-from")
+	}
+	return nil
+}
+
+// checkOrder validates QueryConfig.OrderBy and records its column and
+// direction.
+func (q *QueryEngine) checkOrder() error {
+	fields := strings.Fields(q.config.OrderBy)
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) > 2 {
+		return errorf(ErrBadQuery, "invalid --order-by %q: use key or a column, then asc or desc", q.config.OrderBy)
+	}
+	if len(fields) == 2 {
+		switch strings.ToLower(fields[1]) {
+		case "asc":
+		case "desc":
+			q.descending = true
+		default:
+			return errorf(ErrBadQuery, "invalid --order-by %q: use key or a column, then asc or desc", q.config.OrderBy)
+		}
+	}
+	if !strings.EqualFold(fields[0], "key") {
+		q.orderColumn = strings.ToLower(fields[0])
+	}
+	if !q.descending {
+		return nil
+	}
+	switch {
+	case q.config.Last:
+		return errorf(ErrBadQuery, "--last does not combine with a descending --order-by: take the --limit from the start")
+	case q.config.CountOnly || q.config.GroupBy != "" || q.config.NotInFile != "":
+		return errorf(ErrBadQuery, "a descending --order-by applies to row queries, not counts, groups or anti-joins")
+	case q.sampling():
+		return errorf(ErrBadQuery, "a descending --order-by does not combine with sampling")
+	case q.config.Cursor != "":
+		return errorf(ErrBadQuery, "a descending --order-by does not combine with a cursor")
+	case q.config.CheckpointPath != "" || q.config.ResumeFrom != "":
+		return errorf(ErrBadQuery, "a descending --order-by does not combine with --checkpoint/--resume-from")
+	}
+	return nil
+}
+
+// checkOrderIndex fails when the planned index does not order the rows by
+// the column of QueryConfig.OrderBy: the filter picked another one.
+func (q *QueryEngine) checkOrderIndex(plan map[string]interface{}) error {
+	if q.orderColumn == "" {
+		return nil
+	}
+	indexName, _ := plan["index"].(string)
+	covered, _ := plan["covered_columns"].([]string)
+	if indexName != q.orderColumn && (len(covered) == 0 || covered[0] != q.orderColumn) {
+		return errorf(ErrNoIndex, "the filter is answered by the %s index, which does not order rows by %s: filter on %s or drop --order-by", indexName, q.orderColumn, q.orderColumn)
+	}
+	if q.indexCollation(indexName) == common.CollationCI {
+		return errorf(ErrNoIndex, "the %s index is case-insensitive: its folded keys do not order rows by %s", indexName, q.orderColumn)
+	}
+	if q.numericKeys(indexName) {
+		return errorf(ErrNoIndex, "%s holds numbers, which the %s index orders as text (10 before 9): order by key for that order", q.orderColumn, indexName)
+	}
+	return nil
+}
+
+// numericKeys reports whether the order column holds values its index
+// does not sort as they compare: numbers, or dates in a layout that does
+// not sort as text. Columns not analyzed are taken as numbers when the
+// smallest and largest keys of their own index are.
+func (q *QueryEngine) numericKeys(indexName string) bool {
+	if _, ok := q.columnInfo(q.orderColumn); ok {
+		return !q.sortsAsText(q.orderColumn)
+	}
+	stats, ok := q.indexStats(indexName)
+	if !ok || indexName != q.orderColumn || stats.MinKey == "" {
+		return false
+	}
+	_, errMin := strconv.ParseFloat(common.DecodeKey(stats.MinKey), 64)
+	_, errMax := strconv.ParseFloat(common.DecodeKey(stats.MaxKey), 64)
+	return errMin == nil && errMax == nil
+}
+
+// backward reports whether an index scan reads from the last row.
+func (q *QueryEngine) backward() bool {
+	return q.config.Last || q.descending
+}
+
+// scanBackward visits the delta's records and those of blocks start..end
+// from the last to the first, stopping when visit is done. Without a
+// search key every record is visited; with one, those of the key.
+func (q *QueryEngine) scanBackward(br *common.BlockReader, searchKey string, hasSearchKey bool, start, end int,
+	visit func(*common.IndexRecord) (bool, error), progress func(scanned int64)) error {
+	for i := len(q.delta) - 1; i >= 0; i-- {
+		if i%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
+			}
+		}
+		if done, err := visit(&q.delta[i]); err != nil || done {
+			return err
+		}
+	}
+
+	key := []byte(searchKey)
+	var scanned int64
+	for i := end; i >= start; i-- {
+		if err := q.checkDeadline(); err != nil {
+			return err
+		}
+		progress(scanned)
+
+		meta := br.Footer.Blocks.At(i)
+		scanned += meta.Length
+		if q.zones != nil && q.zones.skipBlock(meta) {
+			continue
+		}
+		records, err := br.ReadBlock(meta)
+		if err != nil {
+			return err
+		}
+		for j := len(records) - 1; j >= 0; j-- {
+			rec := &records[j]
+			if hasSearchKey {
+				cmp := compareRecordKey(&rec.Key, key)
+				if cmp > 0 {
+					continue
+				}
+				if cmp < 0 {
+					return nil // Past the first record of the key
+				}
+			}
+			if done, err := visit(rec); err != nil || done {
+				return err
+			}
+		}
+	}
+	return nil
+}
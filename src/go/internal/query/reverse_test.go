@@ -0,0 +1,46 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOrderByDescending(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,name\n")
+	for id := 1; id <= 20; id++ {
+		fmt.Fprintf(&b, "%d,n%02d\n", id, id)
+	}
+	data := b.String()
+	csvPath, dir := newTestCSV(t, data, `["id","name"]`)
+
+	for _, tc := range []struct {
+		orderBy string
+		want    []string // First fields of the rows
+		err     error
+	}{
+		{"name desc", []string{"20", "19", "18"}, nil},
+		{"key desc", []string{"20", "19", "18"}, nil}, // Of the name index, planned for the filter below
+		{"id desc", nil, ErrNoIndex},
+		{"id", nil, ErrNoIndex},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, OrderBy: tc.orderBy, Limit: 3}
+		if strings.HasPrefix(tc.orderBy, "key") {
+			cfg.Where = where(t, `{"operator":">","column":"name","value":"n"}`)
+		}
+		res, _, err := runTest(t, cfg)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", tc.orderBy, err, tc.err)
+			continue
+		}
+		var got []string
+		for _, row := range res.Rows {
+			got = append(got, strings.SplitN(data[row.Offset:], ",", 2)[0])
+		}
+		if tc.err == nil && strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: rows %v, want %v", tc.orderBy, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// rowSource reads CSV lines by the offsets index records store: from the
+// mmapped CSV, or from its .csvz row store once the CSV is archived.
+type rowSource interface {
+	// rowAt returns the record at offset with its terminator (none on a last
+	// record without one); quoted fields may span lines. The slice is valid
+	// until the next call.
+	rowAt(offset int64) ([]byte, error)
+	close()
+}
+
+// mmapRows reads lines straight from the mmapped CSV.
+type mmapRows struct {
+	data    []byte
+	release func()
+}
+
+func (m *mmapRows) rowAt(offset int64) ([]byte, error) {
+	if offset < 0 || offset >= int64(len(m.data)) {
+		return nil, errorf(ErrStaleIndex, "offset %d is outside the CSV (%d bytes); reindex it", offset, len(m.data))
+	}
+	row := m.data[offset:]
+	if end := common.RecordEnd(row); end >= 0 {
+		row = row[:end+1]
+	}
+	return row, nil
+}
+
+func (m *mmapRows) close() {
+	m.release()
+}
+
+// storeRows reads lines from a .csvz row store.
+type storeRows struct {
+	rs *common.RowStore
+}
+
+func (s storeRows) rowAt(offset int64) ([]byte, error) { return s.rs.RowAt(offset) }
+func (s storeRows) close()                             { _ = s.rs.Close() }
+
+// columnarRows returns the row store of a Parquet or Arrow source, whose
+// rows only the row store holds as CSV (see IndexMeta.Format). ok is false
+// for CSV sources.
+func (q *QueryEngine) columnarRows() (rs *common.RowStore, ok bool, err error) {
+	meta := q.loadMeta()
+	if meta == nil || meta.Format == "" {
+		return nil, false, nil
+	}
+	if meta.RowStore == "" {
+		return nil, true, errorf(ErrStaleIndex, "%s input indexed without a row store; reindex it", meta.Format)
+	}
+	rs, err = common.OpenRowStore(q.store, meta.RowStore)
+	return rs, true, err
+}
+
+// openRows opens the rows of the CSV: the file itself, or the row store its
+// indexes were built with if the file does not exist.
+func (q *QueryEngine) openRows() (rowSource, error) {
+	if rs, ok, err := q.columnarRows(); ok {
+		if err != nil {
+			return nil, err
+		}
+		return storeRows{rs}, nil
+	}
+	data, release, err := q.mapCSV()
+	if err == nil {
+		if len(data) == 0 {
+			release()
+			return nil, fmt.Errorf("%s is empty", q.config.CsvPath)
+		}
+		return &mmapRows{data: data, release: release}, nil
+	}
+	rs, ok, storeErr := q.openRowStore(err)
+	if !ok {
+		return nil, storeErr
+	}
+	return storeRows{rs}, nil
+}
+
+// mapCSV maps the CSV, from the handle pool if there is one, and returns a
+// func releasing it. Errors opening the file are those of os.Open.
+func (q *QueryEngine) mapCSV() ([]byte, func(), error) {
+	if q.config.Handles != nil {
+		return q.config.Handles.MapFile(q.config.CsvPath)
+	}
+	return common.MapFile(q.config.CsvPath)
+}
+
+// openRowStore opens the row store in place of the CSV, which failed to
+// open with csvErr. Without a row store, csvErr is returned.
+func (q *QueryEngine) openRowStore(csvErr error) (*common.RowStore, bool, error) {
+	if !errors.Is(csvErr, fs.ErrNotExist) {
+		return nil, false, csvErr
+	}
+	meta := q.loadMeta()
+	if meta == nil || meta.RowStore == "" {
+		return nil, false, csvErr
+	}
+	rs, err := common.OpenRowStore(q.store, meta.RowStore)
+	if err != nil {
+		return nil, false, fmt.Errorf("%v, and its row store failed to open: %w", csvErr, err)
+	}
+	return rs, true, nil
+}
+
+// openHeader returns a reader positioned at the CSV header line, from the
+// CSV or its row store.
+func (q *QueryEngine) openHeader() (io.ReadCloser, error) {
+	rs, ok, err := q.columnarRows()
+	if ok && err != nil {
+		return nil, err
+	}
+	if !ok {
+		f, err := os.Open(q.config.CsvPath)
+		if err == nil {
+			return f, nil
+		}
+		var storeErr error
+		if rs, ok, storeErr = q.openRowStore(err); !ok {
+			return nil, storeErr
+		}
+	}
+	defer func() { _ = rs.Close() }()
+	header, err := rs.RowAt(0)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(header))), nil
+}
+
+// requireCSV is the error of scans that read the whole CSV when only its row
+// store is left.
+func (q *QueryEngine) requireCSV(csvErr error) error {
+	if errors.Is(csvErr, fs.ErrNotExist) {
+		if meta := q.loadMeta(); meta != nil && meta.RowStore != "" {
+			return fmt.Errorf("%w: the row store %s serves index lookups only; this query needs a full scan of the CSV", csvErr, meta.RowStore)
+		}
+	}
+	return csvErr
+}
+
+// openScan opens the CSV for a scan of all its rows, in order, and returns
+// its size: the file, or the row store of a Parquet or Arrow source.
+func (q *QueryEngine) openScan() (io.ReadCloser, int64, error) {
+	if rs, ok, err := q.columnarRows(); ok {
+		if err != nil {
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{rs.Reader(), rs}, rs.Footer.CsvSize, nil
+	}
+	f, err := os.Open(q.config.CsvPath)
+	if err != nil {
+		return nil, 0, q.requireCSV(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
@@ -0,0 +1,207 @@
+package query
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Sampling returns a uniform random sample of the rows a query matches:
+// each with probability SampleFraction, or SampleRows of them.
+//
+// A fraction is drawn as a Bernoulli sample by skipping a geometrically
+// distributed number of candidates between picks. Index scans skip whole
+// blocks that way without decompressing them, and read only the CSV rows
+// of the candidates picked. A row count is drawn by reservoir sampling over
+// the matches; when the index covers the whole filter, the reservoir holds
+// index records and only the rows it ends with are read. Without a filter,
+// an index of the CSV (one that covers all of it) stands for its rows.
+
+// sampler draws the sample of one scan.
+type sampler struct {
+	rng      *rand.Rand
+	fraction float64 // Probability of each candidate (1 = all)
+	skip     int64   // Candidates to pass over before the next pick
+	rows     int     // Reservoir size (0 = no reservoir)
+	seen     int64   // Matches offered to the reservoir
+	picked   []sampledRow
+}
+
+// sampledRow is a match in the reservoir. row and raw are nil until read
+// (see QueryEngine.emitSample).
+type sampledRow struct {
+	seq          int64 // Position among the matches, for output in scan order
+	offset, line int64
+	row, raw     []byte
+}
+
+// sampling tells whether the query asks for a sample.
+func (q *QueryEngine) sampling() bool {
+	return q.config.SampleFraction > 0 || q.config.SampleRows > 0
+}
+
+// checkSample validates the sampling options against the rest of the query.
+func (q *QueryEngine) checkSample() error {
+	if !q.sampling() {
+		return nil
+	}
+	switch {
+	case q.config.SampleFraction > 0 && q.config.SampleRows > 0:
+		return errorf(ErrBadQuery, "--sample and --sample-rows are exclusive")
+	case q.config.SampleFraction > 1:
+		return errorf(ErrBadQuery, "--sample %g: the fraction must be in (0, 1]", q.config.SampleFraction)
+	case q.config.GroupBy != "":
+		return errorf(ErrBadQuery, "sampling applies to row queries, not --group-by")
+	case q.config.NotInFile != "":
+		return errorf(ErrBadQuery, "sampling does not apply to --where-not-in-file")
+	case q.config.CheckpointPath != "" || q.config.ResumeFrom != "":
+		return errorf(ErrBadQuery, "a sample cannot be exported with checkpoints: each run draws another one")
+	}
+	return nil
+}
+
+// newSampler returns the sampler of a scan, nil when the query does not
+// sample.
+func (q *QueryEngine) newSampler() *sampler {
+	if !q.sampling() {
+		return nil
+	}
+	seed := q.config.SampleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &sampler{
+		rng:      rand.New(rand.NewPCG(uint64(seed), uint64(seed)>>32)),
+		fraction: 1,
+		rows:     q.config.SampleRows,
+	}
+	if q.config.SampleFraction > 0 {
+		s.fraction = q.config.SampleFraction
+	}
+	if q.config.Verbose {
+		fmt.Fprintf(os.Stderr, "DEBUG: Sampling with seed %d\n", seed)
+	}
+	s.nextSkip()
+	return s
+}
+
+// nextSkip draws the number of candidates before the next pick: geometric,
+// so each candidate is picked with probability fraction.
+func (s *sampler) nextSkip() {
+	if s.fraction >= 1 {
+		s.skip = 0
+		return
+	}
+	u := 1 - s.rng.Float64() // (0, 1]
+	s.skip = int64(math.Floor(math.Log(u) / math.Log1p(-s.fraction)))
+}
+
+// skipBlock tells whether a block of records candidates is passed over
+// whole.
+func (s *sampler) skipBlock(records int64) bool {
+	if s == nil || s.skip < records {
+		return false
+	}
+	s.skip -= records
+	return true
+}
+
+// take tells whether the next candidate is picked.
+func (s *sampler) take() bool {
+	if s == nil {
+		return true
+	}
+	if s.skip > 0 {
+		s.skip--
+		return false
+	}
+	s.nextSkip()
+	return true
+}
+
+// reservoir tells whether picks go to the reservoir rather than the output.
+func (s *sampler) reservoir() bool {
+	return s != nil && s.rows > 0
+}
+
+// offer adds a match to the reservoir. row and raw (nil = read later) are
+// copied.
+func (s *sampler) offer(offset, line int64, row, raw []byte) {
+	seq := s.seen
+	s.seen++
+	i := len(s.picked)
+	if i >= s.rows {
+		if i = int(s.rng.Int64N(s.seen)); i >= s.rows {
+			return
+		}
+	}
+	r := sampledRow{seq: seq, offset: offset, line: line, row: slices.Clone(row), raw: slices.Clone(raw)}
+	if i == len(s.picked) {
+		s.picked = append(s.picked, r)
+	} else {
+		s.picked[i] = r
+	}
+}
+
+// emitSample writes the reservoir in scan order, reading the rows not read
+// yet with rowAt, and applying offset and limit. It returns the rows
+// emitted.
+func (q *QueryEngine) emitSample(s *sampler, emitter *rowEmitter, rowAt func(offset int64) ([]byte, error)) (int64, error) {
+	sort.Slice(s.picked, func(i, j int) bool { return s.picked[i].seq < s.picked[j].seq })
+	picked := s.picked[min(q.config.Offset, len(s.picked)):]
+	if q.config.Limit > 0 && len(picked) > q.config.Limit {
+		picked = picked[:q.config.Limit]
+	}
+	if q.config.CountOnly {
+		return int64(len(picked)), nil
+	}
+	for _, r := range picked {
+		if r.raw == nil {
+			raw, err := rowAt(r.offset)
+			if err != nil {
+				return 0, err
+			}
+			r.raw, r.row = raw, bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte{'\n'}), []byte{'\r'})
+		}
+		if err := emitter.Emit(r.offset, r.line, r.row, r.raw); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(picked)), nil
+}
+
+// completeIndex returns an index that lists every row of the CSV, the first
+// by name: any index built from the CSV as it is now.
+func (q *QueryEngine) completeIndex() (name, indexFile string, ok bool) {
+	if !q.indexesComplete() {
+		return "", "", false
+	}
+	meta := q.loadMeta()
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if indexFile, ok := q.indexFileFor(name); ok {
+			return name, indexFile, true
+		}
+	}
+	return "", "", false
+}
+
+// indexesComplete reports whether the indexes were built from the CSV as it
+// is now, so each lists every row.
+func (q *QueryEngine) indexesComplete() bool {
+	meta := q.loadMeta()
+	if meta == nil {
+		return false
+	}
+	info, err := os.Stat(q.config.CsvPath)
+	return err == nil && info.Size() == meta.CsvSize
+}
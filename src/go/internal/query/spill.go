@@ -0,0 +1,327 @@
+package query
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// DefaultGroupMemoryMB is the memory a group-by holds its groups in before
+// spilling them to disk.
+const DefaultGroupMemoryMB = 512
+
+// groupOverhead estimates the memory of a group beyond its key: map entry,
+// string header and aggregate.
+const groupOverhead = 80
+
+// groupTable accumulates the aggregates of a group-by. When its groups
+// outgrow the memory limit, it writes them sorted by key to an LZ4 temp
+// file (a run) and starts over; the runs are merged into the result, the
+// way the indexer's sorter merges its chunks.
+type groupTable struct {
+	aggFunc string
+	results map[string]float64
+	counts  map[string]int64 // avg: rows summed per group
+	bytes   int64            // Estimated memory of the groups
+	limit   int64
+
+	tempBase string // Directory the spill directory goes in
+	dir      string // Spill directory ("" = not created yet)
+	runs     []string
+}
+
+func (q *QueryEngine) newGroupTable() *groupTable {
+	mb := q.config.GroupMemoryMB
+	if mb <= 0 {
+		mb = DefaultGroupMemoryMB
+	}
+	tempBase := q.config.TempDir
+	if tempBase == "" {
+		tempBase = os.TempDir()
+	}
+	return &groupTable{
+		aggFunc:  q.config.AggFunc,
+		results:  make(map[string]float64),
+		counts:   make(map[string]int64),
+		limit:    int64(mb) << 20,
+		tempBase: tempBase,
+	}
+}
+
+// add aggregates n rows of a group; val is their value (sum for n > 1).
+func (g *groupTable) add(key string, val float64, n int64) error {
+	curr, ok := g.results[key]
+	if !ok {
+		g.bytes += int64(len(key)) + groupOverhead
+	}
+	switch g.aggFunc {
+	case "count":
+		g.results[key] = curr + float64(n)
+	case "sum":
+		g.results[key] = curr + val
+	case "min":
+		if !ok || val < curr {
+			g.results[key] = val
+		}
+	case "max":
+		if !ok || val > curr {
+			g.results[key] = val
+		}
+	case "avg":
+		g.results[key] = curr + val
+		g.counts[key] += n
+	case "": // Distinct
+		g.results[key] = 1
+	}
+	if g.bytes > g.limit {
+		return g.spill()
+	}
+	return nil
+}
+
+// spilled tells whether groups went to disk: the in-memory groups are then
+// only part of the result.
+func (g *groupTable) spilled() bool {
+	return len(g.runs) > 0
+}
+
+// spill writes the groups to a run, sorted by key, and clears them.
+func (g *groupTable) spill() error {
+	if len(g.results) == 0 {
+		return nil
+	}
+	if g.dir == "" {
+		dir, err := os.MkdirTemp(g.tempBase, "csvquery_groupby_")
+		if err != nil {
+			return fmt.Errorf("failed to create group-by spill directory: %w", err)
+		}
+		g.dir = dir
+	}
+	keys := make([]string, 0, len(g.results))
+	for key := range g.results {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	path := filepath.Join(g.dir, fmt.Sprintf("run_%d.tmp", len(g.runs)))
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create group-by run: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+	lzWriter := lz4.NewWriter(file)
+	w := bufio.NewWriterSize(lzWriter, 256*1024)
+	var buf []byte
+	for _, key := range keys {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(g.results[key]))
+		buf = binary.AppendUvarint(buf, uint64(g.counts[key]))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := lzWriter.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	g.runs = append(g.runs, path)
+	g.results = make(map[string]float64)
+	g.counts = make(map[string]int64)
+	g.bytes = 0
+	return nil
+}
+
+// cleanup removes the runs. Safe to call more than once.
+func (g *groupTable) cleanup() {
+	if g.dir != "" {
+		_ = os.RemoveAll(g.dir)
+		g.dir = ""
+	}
+}
+
+// writeJSON writes the groups as a JSON object, as finalGroups would
+// encode them. Spilled groups are merged from their runs and written in
+// key order as they are merged.
+func (g *groupTable) writeJSON(w io.Writer) error {
+	if !g.spilled() {
+		return json.NewEncoder(w).Encode(finalGroups(g.results, g.counts))
+	}
+
+	bw := bufio.NewWriterSize(w, 256*1024)
+	_ = bw.WriteByte('{')
+	first := true
+	err := g.merge(func(key string, val float64) error {
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		if !first {
+			_ = bw.WriteByte(',')
+		}
+		first = false
+		_, _ = bw.Write(k)
+		_ = bw.WriteByte(':')
+		_, _ = bw.Write(v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, _ = bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// collect returns the groups as finalGroups would, spilled ones merged
+// from their runs.
+func (g *groupTable) collect() (map[string]AggValue, error) {
+	if !g.spilled() {
+		groups := make(map[string]AggValue, len(g.results))
+		for key, val := range finalGroups(g.results, g.counts) {
+			groups[key] = AggValue(val)
+		}
+		return groups, nil
+	}
+	groups := make(map[string]AggValue)
+	err := g.merge(func(key string, val float64) error {
+		groups[key] = AggValue(val)
+		return nil
+	})
+	return groups, err
+}
+
+// merge spills the groups left in memory, then calls fn with each group
+// of the runs in key order, its aggregates from every run combined.
+func (g *groupTable) merge(fn func(key string, val float64) error) error {
+	if err := g.spill(); err != nil {
+		return err
+	}
+
+	var cursors groupCursors
+	for _, path := range g.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+		c := &groupCursor{r: bufio.NewReaderSize(lz4.NewReader(f), 64*1024)}
+		if ok, err := c.next(); err != nil {
+			return err
+		} else if ok {
+			cursors = append(cursors, c)
+		}
+	}
+	heap.Init(&cursors)
+
+	for len(cursors) > 0 {
+		key, val, n := cursors[0].key, cursors[0].val, cursors[0].n
+		if err := cursors.advance(); err != nil {
+			return err
+		}
+		for len(cursors) > 0 && cursors[0].key == key {
+			val, n = g.combine(val, n, cursors[0].val, cursors[0].n)
+			if err := cursors.advance(); err != nil {
+				return err
+			}
+		}
+		if n > 0 {
+			val /= float64(n) // avg: sums so far
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// combine merges the aggregates of one group from two runs.
+func (g *groupTable) combine(a float64, an int64, b float64, bn int64) (float64, int64) {
+	switch g.aggFunc {
+	case "min":
+		return min(a, b), 0
+	case "max":
+		return max(a, b), 0
+	case "": // Distinct
+		return 1, 0
+	}
+	return a + b, an + bn // count, sum and avg
+}
+
+// groupCursor reads the groups of a run in key order.
+type groupCursor struct {
+	r   *bufio.Reader
+	key string
+	val float64
+	n   int64
+}
+
+// next reads the next group; false at the end of the run.
+func (c *groupCursor) next() (bool, error) {
+	keyLen, err := binary.ReadUvarint(c.r)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, keyLen+8)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return false, fmt.Errorf("corrupt group-by run: %w", err)
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return false, fmt.Errorf("corrupt group-by run: %w", err)
+	}
+	c.key = string(buf[:keyLen])
+	c.val = math.Float64frombits(binary.LittleEndian.Uint64(buf[keyLen:]))
+	c.n = int64(n)
+	return true, nil
+}
+
+// groupCursors is a min-heap of run cursors by current key.
+type groupCursors []*groupCursor
+
+func (h groupCursors) Len() int           { return len(h) }
+func (h groupCursors) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h groupCursors) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *groupCursors) Push(x any)        { *h = append(*h, x.(*groupCursor)) }
+func (h *groupCursors) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// advance moves the smallest cursor to its next group, dropping it at the
+// end of its run.
+func (h *groupCursors) advance() error {
+	ok, err := (*h)[0].next()
+	if err != nil {
+		return err
+	}
+	if ok {
+		heap.Fix(h, 0)
+	} else {
+		heap.Pop(h)
+	}
+	return nil
+}
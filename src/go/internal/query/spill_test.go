@@ -0,0 +1,122 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// spillRows are the rows of the spill tests: 100 keys, each in 3 passes
+// over them, so a small table spills every key into several runs.
+func spillRows(fn func(key string, val float64)) {
+	for pass := range 3 {
+		for k := range 100 {
+			fn(fmt.Sprintf("k%03d", k), float64((k*7+pass*13)%50)-10)
+		}
+	}
+}
+
+func TestGroupTableSpill(t *testing.T) {
+	for _, fn := range []string{"count", "sum", "avg", "min", "max", ""} {
+		memory := &groupTable{aggFunc: fn, results: map[string]float64{}, counts: map[string]int64{}, limit: 1 << 30}
+		spilling := &groupTable{aggFunc: fn, results: map[string]float64{}, counts: map[string]int64{}, limit: 30 * (4 + groupOverhead), tempBase: t.TempDir()}
+		spillRows(func(key string, val float64) {
+			if err := memory.add(key, val, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := spilling.add(key, val, 1); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if memory.spilled() || len(spilling.runs) < 6 {
+			t.Fatalf("%q: %d runs in memory, %d spilling; want 0 and at least 6", fn, len(memory.runs), len(spilling.runs))
+		}
+		dir := spilling.dir
+
+		want, err := memory.collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := spilling.collect()
+		if err != nil {
+			t.Fatalf("%q: %v", fn, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: spilled groups %v, want %v", fn, got, want)
+		}
+
+		// The JSON of merged runs decodes to the in-memory groups too
+		var wantJSON, gotJSON bytes.Buffer
+		if err := memory.writeJSON(&wantJSON); err != nil {
+			t.Fatal(err)
+		}
+		if err := spilling.writeJSON(&gotJSON); err != nil {
+			t.Fatal(err)
+		}
+		var wantGroups, gotGroups map[string]float64
+		if err := json.Unmarshal(wantJSON.Bytes(), &wantGroups); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(gotJSON.Bytes(), &gotGroups); err != nil {
+			t.Fatalf("%q: spilled JSON %q: %v", fn, gotJSON.String(), err)
+		}
+		if !reflect.DeepEqual(gotGroups, wantGroups) {
+			t.Errorf("%q: spilled JSON %v, want %v", fn, gotGroups, wantGroups)
+		}
+
+		spilling.cleanup()
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%q: spill dir left after cleanup (%v)", fn, err)
+		}
+		spilling.cleanup() // Again: no-op
+	}
+}
+
+func TestGroupBySpill(t *testing.T) {
+	// 15000 cities, each in a row of status a and one of status b: the
+	// status index visits every city twice, so the spilled runs share keys
+	var b strings.Builder
+	b.WriteString("id,city,status,amount\n")
+	for s, status := range []string{"a", "b"} {
+		for i := range 15000 {
+			fmt.Fprintf(&b, "%d,c%05d,%s,%d\n", s*15000+i, i, status, (i*31+s*7)%1000)
+		}
+	}
+	csvPath, dir := newTestCSV(t, b.String(), `["status"]`)
+	filter := `{"operator":">=","column":"status","value":"a"}`
+
+	for _, fn := range []string{"count", "sum", "avg", "min", "max", ""} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, filter), GroupBy: "city", AggFunc: fn, AggCol: "amount"}
+		want, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Fatalf("%q: %v", fn, err)
+		}
+		if len(want.Groups) != 15000 {
+			t.Fatalf("%q: %d groups, want 15000", fn, len(want.Groups))
+		}
+
+		temp := t.TempDir()
+		cfg.Where, cfg.GroupMemoryMB, cfg.TempDir = where(t, filter), 1, temp
+		got, _, err := runTest(t, cfg)
+		if err != nil {
+			t.Fatalf("%q spilled: %v", fn, err)
+		}
+		if !reflect.DeepEqual(got.Groups, want.Groups) {
+			t.Errorf("%q: spilled groups differ from the in-memory ones", fn)
+		}
+		if entries, err := os.ReadDir(temp); err != nil || len(entries) != 0 {
+			t.Errorf("%q: temp dir holds %v after the query (%v)", fn, entries, err)
+		}
+
+		// It did spill: without a temp dir to spill to, it fails
+		cfg.Where, cfg.TempDir = where(t, filter), filepath.Join(temp, "missing")
+		if _, _, err := runTest(t, cfg); err == nil || !strings.Contains(err.Error(), "spill directory") {
+			t.Errorf("%q: without a temp dir: %v, want a spill error", fn, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package query
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Index union. A filter that is an OR of children which each hold an
+// equality on a column with a single-column index ("status = X OR status =
+// Y", or "a = 1 OR (b = 2 AND c > 3)") is answered from the posting lists
+// of those equalities (see intersect.go): their records are merged in CSV
+// offset order, a row in several of them kept once, and only those rows
+// are read and checked against the whole filter. When every child is such
+// an equality and no key is truncated, the union is the answer, and counts
+// never read the CSV. Rows come in CSV order, as from a full scan, and
+// cursors resume after the offset of the last row. Group-by, MIN/MAX,
+// samples, backward scans and pending updates plan as before.
+
+// cursorUnion is the source of cursors taken by index unions.
+const cursorUnion = "union"
+
+// planUnion plans an index union for the filter, if it is an OR whose
+// children all hold an indexed equality.
+func (q *QueryEngine) planUnion() (map[string]interface{}, bool) {
+	where := q.config.Where
+	if where == nil || where.Operator != "OR" || len(where.Children) == 0 || q.config.GroupBy != "" || q.minMax() ||
+		q.sampling() || q.backward() || q.orderColumn != "" || q.updates != nil {
+		return nil, false
+	}
+	folded := q.foldedColumns()
+	var probes []postingProbe
+	var names []string
+	var estimate int64
+	estimated, covered := true, true
+	for i := range where.Children {
+		child := &where.Children[i]
+		conds := child.ExtractIndexConditions()
+		var cols []string
+		for col := range conds {
+			cols = append(cols, col)
+		}
+		slices.Sort(cols)
+
+		found := false
+		for _, col := range q.bySelectivity(cols) {
+			p, truncated, ok := q.newPostingProbe(col, conds[col], folded)
+			if !ok {
+				continue
+			}
+			probes = append(probes, p)
+			if !slices.Contains(names, col) {
+				names = append(names, col)
+			}
+			if rows, ok := q.equalityEstimate(col); ok {
+				estimate += rows
+			} else {
+				estimated = false
+			}
+			covered = covered && child.Operator == OpEq && !truncated
+			found = true
+			break
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	q.probes, q.unionCovered = probes, covered
+	plan := map[string]interface{}{
+		"query":    q.config.Where,
+		"strategy": "Index Union",
+		"index":    names[0],
+		"unioned":  names,
+	}
+	if estimated {
+		plan["estimated_rows"] = estimate
+	}
+	if covered {
+		plan["covered_columns"] = names
+	}
+	return plan, true
+}
+
+// runUnion reads the rows of the planned posting lists, in CSV order.
+func (q *QueryEngine) runUnion() error {
+	q.activity.SetPhase("index union")
+	var records []common.IndexRecord
+	files := make([]string, len(q.probes))
+	for i, p := range q.probes {
+		files[i] = p.file
+		err := q.readPosting(p, func(rec *common.IndexRecord) {
+			records = append(records, *rec)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slices.SortFunc(records, func(a, b common.IndexRecord) int { return cmp.Compare(a.Offset, b.Offset) })
+	records = slices.CompactFunc(records, func(a, b common.IndexRecord) bool { return a.Offset == b.Offset })
+
+	if q.unionCovered {
+		q.config.Where = nil
+		if q.config.CountOnly {
+			q.printCount(int64(len(records)))
+			return nil
+		}
+	}
+
+	headers, virtualDefaults, err := q.getHeaderMap()
+	if err != nil {
+		return fmt.Errorf("failed to read headers: %v", err)
+	}
+	q.VirtualDefaults = virtualDefaults
+	maxCol := -1
+	if q.config.Where != nil {
+		q.config.Where.ResolveColumns(headers)
+		for _, idx := range headers {
+			maxCol = max(maxCol, idx)
+		}
+	}
+	proj := q.newRowProjector(maxCol)
+	colsBuf := make([]string, 0, maxCol+1)
+
+	if err := q.checkCursorSource(cursorUnion); err != nil {
+		return err
+	}
+	emitter, err := q.newRowEmitter(cursorUnion + ":" + strings.Join(files, ","))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = emitter.w.Flush() }()
+	rows, err := q.openRows()
+	if err != nil {
+		return err
+	}
+	defer rows.close()
+
+	var count int64
+	skipped := 0
+	full := false
+	var last cursorPos
+	for i := range records {
+		rec := &records[i]
+		if i%deadlineCheckRows == 0 {
+			if err := q.checkDeadline(); err != nil {
+				return err
+			}
+		}
+		if q.cursor.passed(cursorBlocks, nil, rec.Offset) {
+			continue
+		}
+		var row, raw []byte
+		if q.config.Where != nil || !q.config.CountOnly {
+			if raw, err = rows.rowAt(rec.Offset); err != nil {
+				return err
+			}
+			row = bytes.TrimSuffix(bytes.TrimSuffix(raw, []byte{'\n'}), []byte{'\r'})
+			if q.config.Where != nil {
+				cols := q.appendVirtual(proj.extract(row, colsBuf))
+				colsBuf = cols
+				if !q.config.Where.EvaluateFast(cols) {
+					continue
+				}
+			}
+		}
+		if skipped < q.config.Offset {
+			skipped++
+			continue
+		}
+		count++
+		if !q.config.CountOnly {
+			if err := emitter.Emit(rec.Offset, rec.Line, row, raw); err != nil {
+				return err
+			}
+		}
+		if q.config.Limit > 0 {
+			last.at(cursorBlocks, nil, rec.Offset, rec.Line)
+			if count >= int64(q.config.Limit) {
+				full = true
+				break
+			}
+		}
+	}
+
+	if q.config.CountOnly {
+		q.writeCount(emitter.w, count)
+	}
+	if full {
+		q.setNextCursor(cursorUnion, last)
+	}
+	return emitter.Finish()
+}
@@ -0,0 +1,106 @@
+package query
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+func TestIndexUnion(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city","status"]`)
+	for _, tc := range []struct {
+		name     string
+		where    string
+		strategy string
+	}{
+		{"one column", `{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"=","column":"city","value":"Rome"}]}`, "Index Union"},
+		{"overlapping columns", `{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"=","column":"status","value":"void"}]}`, "Index Union"},
+		{"absent key", `{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"=","column":"city","value":"Quito"}]}`, "Index Union"},
+		{"post-filter", `{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Lima"},
+			{"operator":"AND","children":[
+				{"operator":"=","column":"status","value":"open"},
+				{"operator":"LIKE","column":"name","value":"n2%"}]}]}`, "Index Union"},
+		{"unindexed child", `{"operator":"OR","children":[
+			{"operator":"=","column":"city","value":"Paris"},
+			{"operator":"=","column":"name","value":"n3"}]}`, "Full Scan"},
+	} {
+		cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, tc.where)}
+		want := scanTest(t, cfg)
+
+		res, q, err := runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if q.Strategy != tc.strategy {
+			t.Errorf("%s: strategy %q, want %q", tc.name, q.Strategy, tc.strategy)
+		}
+		// Unions read rows in CSV order, as full scans do
+		if !reflect.DeepEqual(offsets(res.Rows), offsets(want.Rows)) {
+			t.Errorf("%s: rows %v, want %v", tc.name, offsets(res.Rows), offsets(want.Rows))
+		}
+
+		cfg.CountOnly = true
+		res, _, err = runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: count: %v", tc.name, err)
+		} else if res.Count.Count != int64(len(want.Rows)) {
+			t.Errorf("%s: count %d, want %d", tc.name, res.Count.Count, len(want.Rows))
+		}
+
+		cfg.CountOnly = false
+		if got := pageAll(t, cfg, 4); !reflect.DeepEqual(offsets(got), offsets(want.Rows)) {
+			t.Errorf("%s: pages %v, want %v", tc.name, offsets(got), offsets(want.Rows))
+		}
+		cfg.Offset = 5
+		cfg.Limit = 3
+		res, _, err = runTest(t, cfg)
+		if err != nil {
+			t.Errorf("%s: offset: %v", tc.name, err)
+		} else if wantRows := want.Rows[min(5, len(want.Rows)):min(8, len(want.Rows))]; !reflect.DeepEqual(offsets(res.Rows), offsets(wantRows)) {
+			t.Errorf("%s: offset 5, limit 3: rows %v, want %v", tc.name, offsets(res.Rows), offsets(wantRows))
+		}
+	}
+}
+
+func TestIndexUnionPendingUpdates(t *testing.T) {
+	csvPath, dir := newTestCSV(t, testOrders, `["city"]`)
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Set(rowOffset(testOrders, "1"), "city", "Paris") // Now matches
+	um.Delete(rowOffset(testOrders, "0"))
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := QueryConfig{CsvPath: csvPath, IndexDir: dir, Where: where(t, `{"operator":"OR","children":[
+		{"operator":"=","column":"city","value":"Paris"},
+		{"operator":"=","column":"city","value":"Oslo"}]}`)}
+	want := scanTest(t, cfg)
+	res, q, err := runTest(t, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Strategy == "Index Union" {
+		t.Error("united posting lists under pending updates")
+	}
+	got := offsets(res.Rows)
+	slices.Sort(got)
+	if !reflect.DeepEqual(got, offsets(want.Rows)) {
+		t.Errorf("rows %v, want %v", got, offsets(want.Rows))
+	}
+	if !slices.Contains(got, rowOffset(testOrders, "1")) || slices.Contains(got, rowOffset(testOrders, "0")) {
+		t.Errorf("rows %v: want updated row 1 and not deleted row 0", got)
+	}
+}
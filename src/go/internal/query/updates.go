@@ -0,0 +1,102 @@
+package query
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Pending row updates on the index path. Index records hold the values rows
+// had when the index was built, so the deletes and overrides saved since
+// (see updatemgr) are applied to the rows an index scan finds: deleted rows
+// are dropped, and updated ones are read and filtered again as they now
+// are. Rows whose overrides change a filtered column are dirty: the scan
+// may not visit them at all (their old key no longer matches), so those it
+// did not check are checked after it. There are few of them; the rows of
+// untouched keys cost nothing more than before.
+
+// rowUpdates are the pending updates of the rows of a query, by offset.
+type rowUpdates struct {
+	filter    *Condition // The query's filter, kept where the index covers it (nil = none)
+	deleted   map[int64]bool
+	overrides map[int64]map[string]string
+	dirty     []int64        // Rows whose overrides change a filtered column, by offset
+	seen      map[int64]bool // Dirty rows the scan checked
+
+	headers map[string]int
+	proj    *rowProjector // Every column, for the rows read again
+	buf     []string
+}
+
+// newRowUpdates loads the pending updates of q.Updates for an index scan
+// filtered by the query's where condition.
+func (q *QueryEngine) newRowUpdates() (*rowUpdates, error) {
+	headers, virtualDefaults, err := q.getHeaderMap()
+	if err != nil {
+		return nil, err
+	}
+	q.VirtualDefaults = virtualDefaults
+	maxCol := -1
+	for _, idx := range headers {
+		maxCol = max(maxCol, idx)
+	}
+
+	u := &rowUpdates{
+		filter:    q.config.Where,
+		deleted:   make(map[int64]bool, len(q.Updates.Deleted)),
+		overrides: make(map[int64]map[string]string, len(q.Updates.Overrides)),
+		seen:      make(map[int64]bool),
+		headers:   headers,
+		proj:      q.newRowProjector(maxCol),
+	}
+	u.proj.projectAll()
+
+	filtered := make([]bool, maxCol+1)
+	if u.filter != nil {
+		u.filter.ResolveColumns(headers)
+		u.filter.markColumns(filtered)
+		q.markComputed(filtered) // Updates to what they read change them
+	}
+	for key, deleted := range q.Updates.Deleted {
+		if offset, err := strconv.ParseInt(key, 10, 64); err == nil && deleted {
+			u.deleted[offset] = true
+		}
+	}
+	for key, row := range q.Updates.Overrides {
+		offset, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || len(row) == 0 {
+			continue
+		}
+		u.overrides[offset] = row
+		for col := range row {
+			if idx, ok := headers[col]; ok && filtered[idx] {
+				u.dirty = append(u.dirty, offset)
+				break
+			}
+		}
+	}
+	sort.Slice(u.dirty, func(i, j int) bool { return u.dirty[i] < u.dirty[j] })
+	return u, nil
+}
+
+// updatedRowMatches reports whether the row at offset, with its overrides
+// applied, passes the filter, and marks it checked.
+func (q *QueryEngine) updatedRowMatches(offset int64, row []byte) bool {
+	if q.updates.filter == nil {
+		q.updates.seen[offset] = true
+		return true
+	}
+	return q.updates.filter.EvaluateFast(q.updatedColumns(offset, row))
+}
+
+// updatedColumns returns the columns of the row at offset, virtual ones
+// included, with its overrides applied, and marks it checked. They hold
+// until the next call.
+func (q *QueryEngine) updatedColumns(offset int64, row []byte) []string {
+	u := q.updates
+	u.seen[offset] = true
+	cols := u.proj.extract(row, u.buf)
+	cols = append(cols, q.VirtualDefaults...)
+	cols = q.computeVirtual(q.applyUpdates(cols, u.overrides[offset], u.headers))
+	u.buf = cols
+	return cols
+}
@@ -0,0 +1,141 @@
+package query
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// IndexUsage records how often an index served a query.
+type IndexUsage struct {
+	Hits     int64     `json:"hits"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// UsagePath returns the usage file for a CSV (<csv>_usage.json next to its indexes).
+func UsagePath(csvPath, indexDir string) string {
+	if indexDir == "" {
+		indexDir = filepath.Dir(csvPath)
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	return filepath.Join(indexDir, csvName+"_usage.json")
+}
+
+// LoadUsage reads a usage file. A missing file means no recorded usage.
+func LoadUsage(path string) (map[string]IndexUsage, error) {
+	usage := make(map[string]IndexUsage)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// UsageTracker counts index hits in memory and merges them into the
+// usage files on Flush, so a busy daemon doesn't write per query.
+type UsageTracker struct {
+	mu      sync.Mutex
+	pending map[string]map[string]IndexUsage // usage path -> index -> delta
+}
+
+// NewUsageTracker creates an empty tracker.
+func NewUsageTracker() *UsageTracker {
+	return &UsageTracker{pending: make(map[string]map[string]IndexUsage)}
+}
+
+// Record notes one query served by index of the given CSV. Usage of
+// indexes in remote storage is not tracked.
+func (t *UsageTracker) Record(csvPath, indexDir, index string) {
+	if index == "" || storage.IsRemote(indexDir) {
+		return
+	}
+	index = strings.ToLower(index)
+	path := UsagePath(csvPath, indexDir)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	indexes := t.pending[path]
+	if indexes == nil {
+		indexes = make(map[string]IndexUsage)
+		t.pending[path] = indexes
+	}
+	u := indexes[index]
+	u.Hits++
+	u.LastUsed = time.Now().UTC()
+	indexes[index] = u
+}
+
+// Flush adds the pending hits to the usage files.
+// Files that fail to update keep their hits pending for the next Flush.
+func (t *UsageTracker) Flush() error {
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]map[string]IndexUsage)
+	t.mu.Unlock()
+
+	var firstErr error
+	for path, deltas := range pending {
+		if err := mergeUsage(path, deltas); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			t.requeue(path, deltas)
+		}
+	}
+	return firstErr
+}
+
+func (t *UsageTracker) requeue(path string, deltas map[string]IndexUsage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	indexes := t.pending[path]
+	if indexes == nil {
+		t.pending[path] = deltas
+		return
+	}
+	for name, d := range deltas {
+		addUsage(indexes, name, d)
+	}
+}
+
+func addUsage(usage map[string]IndexUsage, name string, d IndexUsage) {
+	u := usage[name]
+	u.Hits += d.Hits
+	if d.LastUsed.After(u.LastUsed) {
+		u.LastUsed = d.LastUsed
+	}
+	usage[name] = u
+}
+
+func mergeUsage(path string, deltas map[string]IndexUsage) error {
+	usage, err := LoadUsage(path)
+	if err != nil {
+		usage = make(map[string]IndexUsage) // Start over from a corrupt file
+	}
+	for name, d := range deltas {
+		addUsage(usage, name, d)
+	}
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,211 @@
+package query
+
+import (
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// zoneFilter skips index blocks that cannot hold a row matching the range
+// predicates (>, >=, <, <=) and null checks (IS NULL, IS NOT NULL) of the
+// WHERE clause, using the per-block zone maps in the footer. Only predicates
+// that must hold for every matching row (the root leaf, or direct children
+// of a root AND) are used.
+type zoneFilter struct {
+	keyPreds   []*Condition // Predicates on the index's own (single) column
+	valuePreds []*Condition // Predicates on the footer's zone column
+	zoneMaps   bool         // Blocks carry EndKey
+}
+
+// newZoneFilter returns nil when no block can be skipped for this index.
+func (q *QueryEngine) newZoneFilter(indexName string, footer common.SparseIndex) *zoneFilter {
+	if q.config.Where == nil {
+		return nil
+	}
+	z := &zoneFilter{zoneMaps: footer.ZoneMaps}
+	for _, c := range q.config.Where.rangePredicates() {
+		column := strings.ToLower(c.Column)
+		if strings.EqualFold(column, indexName) {
+			z.keyPreds = append(z.keyPreds, c)
+		}
+		if c.isNullCheck() {
+			continue // Zone maps have no null counts
+		}
+		if footer.ZoneColumn != "" && column == footer.ZoneColumn {
+			z.valuePreds = append(z.valuePreds, c)
+		}
+	}
+	if len(z.keyPreds) == 0 && len(z.valuePreds) == 0 {
+		return nil
+	}
+	return z
+}
+
+// rangePredicates returns the range and null check leaves every matching
+// row satisfies. A BETWEEN contributes its two bounds.
+func (c *Condition) rangePredicates() []*Condition {
+	var preds []*Condition
+	add := func(leaf *Condition) {
+		switch leaf.Operator {
+		case OpGt, OpGte, OpLt, OpLte, OpIsNull, OpIsNotNull:
+			if leaf.Column != "" {
+				preds = append(preds, leaf)
+			}
+		case OpBetween:
+			for i := range leaf.between {
+				preds = append(preds, &leaf.between[i])
+			}
+		}
+	}
+	if c.Operator == "AND" {
+		for i := range c.Children {
+			add(&c.Children[i])
+		}
+	} else {
+		add(c)
+	}
+	return preds
+}
+
+// onlyKeyPredicates reports whether the WHERE clause is made only of range
+// predicates and null checks on column (a leaf, or a root AND of them), so
+// the keys of an index of column alone decide which rows match.
+func (c *Condition) onlyKeyPredicates(column string) bool {
+	leaf := func(l *Condition) bool {
+		switch l.Operator {
+		case OpGt, OpGte, OpLt, OpLte, OpBetween, OpIsNull, OpIsNotNull:
+			return l.Column != "" && strings.EqualFold(l.Column, column) && !l.fold
+		}
+		return false
+	}
+	if c.Operator == "AND" {
+		for i := range c.Children {
+			if !leaf(&c.Children[i]) {
+				return false
+			}
+		}
+		return len(c.Children) > 0
+	}
+	return leaf(c)
+}
+
+// skipBlock reports whether no record of the block can match.
+func (z *zoneFilter) skipBlock(b common.BlockMeta) bool {
+	for _, c := range z.valuePreds {
+		if c.targetIsNum && b.MinValue != nil && !c.rangeMayMatchNum(*b.MinValue, *b.MaxValue) {
+			return true
+		}
+	}
+	for _, c := range z.keyPreds {
+		if c.isNullCheck() {
+			if !c.nullMayMatch(b) {
+				return true
+			}
+			continue
+		}
+		// Key bounds are string-ordered, which only matches the predicate's
+		// ordering for text comparisons (see sortsAsKeys), and can only skip
+		// whole ones. A truncated EndKey understates the block's largest value.
+		if !z.zoneMaps || common.KeyMayBeTruncated(b.EndKey) {
+			continue
+		}
+		lo, hi := common.DecodeKey(b.StartKey), common.DecodeKey(b.EndKey)
+		if c.sortsAsKeys(lo, hi) && !c.rangeMayMatchStr(lo, hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockCount returns the number of records of the block matching the key
+// predicates when the footer tells: a distinct block has one key, and every
+// key of a block whose bounds both match a range predicate (in an order the
+// predicate shares, see sortsAsKeys) matches it too. ok is false when the
+// block's keys must be checked one by one.
+func (z *zoneFilter) blockCount(b common.BlockMeta) (n int64, ok bool) {
+	if common.KeyMayBeTruncated(b.StartKey) {
+		return 0, false
+	}
+	lo := common.DecodeKey(b.StartKey)
+	if b.IsDistinct {
+		for _, c := range z.keyPreds {
+			if !c.matchesKey(lo) {
+				return 0, true
+			}
+		}
+		return b.RecordCount, true
+	}
+	if !z.zoneMaps || common.KeyMayBeTruncated(b.EndKey) {
+		return 0, false
+	}
+	hi := common.DecodeKey(b.EndKey)
+	for _, c := range z.keyPreds {
+		// Null keys ("" and "NULL") are not a range of the key order
+		if c.isNullCheck() || !c.sortsAsKeys(lo, hi) || !c.matchesKey(lo) || !c.matchesKey(hi) {
+			return 0, false
+		}
+	}
+	return b.RecordCount, true
+}
+
+// keyMatches checks the key predicates against a record's key, so rows
+// that fail them are skipped without reading the CSV.
+func (z *zoneFilter) keyMatches(key *[64]byte) bool {
+	if len(z.keyPreds) == 0 {
+		return true
+	}
+	stored := common.KeyString(key)
+	if common.KeyMayBeTruncated(stored) {
+		return true // Only a prefix: leave it to the post-filter
+	}
+	val := common.DecodeKey(stored)
+	for _, c := range z.keyPreds {
+		if !c.matchesKey(val) {
+			return false
+		}
+	}
+	return true
+}
+
+// nullMayMatch reports whether a block may hold a key matching a null
+// check. Null values are stored as the keys "" (first in key order) and
+// "NULL" (see common.IsNullKey); both are short, so never truncated.
+func (c *Condition) nullMayMatch(b common.BlockMeta) bool {
+	if c.Operator == OpIsNotNull {
+		return !(b.IsDistinct && common.IsNullKey(b.StartKey))
+	}
+	if b.StartKey == "" || b.EndKey == "" {
+		return true // Starts with empty keys, or an old index without EndKey
+	}
+	return b.StartKey <= "NULL" && "NULL" <= b.EndKey
+}
+
+// rangeMayMatchNum reports whether some value in [lo, hi] satisfies c.
+func (c *Condition) rangeMayMatchNum(lo, hi float64) bool {
+	switch c.Operator {
+	case OpGt:
+		return hi > c.targetNum
+	case OpGte:
+		return hi >= c.targetNum
+	case OpLt:
+		return lo < c.targetNum
+	case OpLte:
+		return lo <= c.targetNum
+	}
+	return true
+}
+
+// rangeMayMatchStr reports whether some string in [lo, hi] satisfies c.
+func (c *Condition) rangeMayMatchStr(lo, hi string) bool {
+	switch c.Operator {
+	case OpGt:
+		return hi > c.resolvedTarget
+	case OpGte:
+		return hi >= c.resolvedTarget
+	case OpLt:
+		return lo < c.resolvedTarget
+	case OpLte:
+		return lo <= c.resolvedTarget
+	}
+	return true
+}
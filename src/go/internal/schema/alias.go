@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Column aliases give clean names to columns whose header has spaces,
+// punctuation or duplicates. In the schema file, "aliases" maps each alias
+// to a header name, or to "#N" for the Nth column (1-based), which tells
+// duplicate names apart:
+//
+//	"aliases": {"customer_id": "Customer ID", "email2": "#7"}
+//
+// Aliases are case-insensitive, like column names.
+
+// alias returns the target of an alias: a header name, or a 0-based
+// column position (name "").
+func (s *Schema) alias(name string) (target string, pos int, ok bool) {
+	if s == nil {
+		return "", 0, false
+	}
+	key := strings.ToLower(strings.TrimSpace(name))
+	for alias, t := range s.Aliases {
+		if strings.ToLower(alias) != key {
+			continue
+		}
+		if n, ok := strings.CutPrefix(t, "#"); ok {
+			if n, err := strconv.Atoi(n); err == nil {
+				return "", n - 1, true
+			}
+		}
+		return t, 0, true
+	}
+	return "", 0, false
+}
+
+// ColumnName returns the name a column is indexed and typed under: the
+// header name an alias stands for, or name itself (also for aliases of a
+// column position, whose header name may be ambiguous).
+func (s *Schema) ColumnName(name string) string {
+	if target, _, ok := s.alias(name); ok && target != "" {
+		return target
+	}
+	return name
+}
+
+// AddAliases adds the aliases to a header map (lowercase name -> column,
+// virtual columns included). columns is the number of physical columns.
+// It fails on a target the map lacks, a position out of range, or an
+// alias that is also the name of another column.
+func (s *Schema) AddAliases(m map[string]int, columns int) error {
+	if s == nil {
+		return nil
+	}
+	positions := make(map[string]int, len(s.Aliases))
+	for alias := range s.Aliases {
+		target, pos, _ := s.alias(alias)
+		if target != "" {
+			var ok bool
+			if pos, ok = m[strings.ToLower(strings.TrimSpace(target))]; !ok {
+				return fmt.Errorf("alias %q: column %q not found", alias, target)
+			}
+		} else if pos < 0 || pos >= columns {
+			return fmt.Errorf("alias %q: the CSV has no column %d", alias, pos+1)
+		}
+		key := strings.ToLower(strings.TrimSpace(alias))
+		if cur, ok := m[key]; ok && cur != pos {
+			return fmt.Errorf("alias %q is also the name of column %d", alias, cur+1)
+		}
+		positions[key] = pos
+	}
+	for key, pos := range positions {
+		m[key] = pos
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+package schema
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Computed columns are virtual columns whose value is an expression of the
+// other columns of the row, evaluated as queries read it. In the schema
+// file, "computed_columns" maps each name to its expression:
+//
+//	"computed_columns": {"total": "price * qty", "year": "substr(date, 0, 4)"}
+//
+// Expressions have numbers, 'strings' (a quote is doubled inside), column
+// names (in double quotes when they are not plain words), + - * / % on
+// numbers, || joining strings, parentheses and the functions of exprFuncs.
+// Values are strings, like fields: arithmetic on a value that is not a
+// number, or a division by zero, gives "". Integers stay integers except
+// in a division; other results are written with up to 15 significant
+// digits, so 19.99 * 3 gives 59.97.
+
+// ComputedColumn is a computed column bound to the columns of a CSV.
+type ComputedColumn struct {
+	Name string
+	Pos  int // Position in the row, after the CSV's columns
+	Expr *Expr
+}
+
+// Computed returns the computed columns of a header map (lowercase name ->
+// position, virtual columns and aliases included) whose name is not one of
+// the first physical columns, with their expressions bound to the map,
+// each after the computed columns it reads. It fails on a column the map
+// lacks and on columns computed from each other.
+func (s *Schema) Computed(m map[string]int, physical int) ([]ComputedColumn, error) {
+	if s == nil || len(s.ComputedColumns) == 0 {
+		return nil, nil
+	}
+	byPos := make(map[int]*ComputedColumn)
+	for _, name := range slices.Sorted(maps.Keys(s.ComputedColumns)) {
+		pos, ok := m[strings.ToLower(name)]
+		if !ok || pos < physical {
+			continue // Not in the map, or a CSV column of that name
+		}
+		expr, err := ParseExpr(s.ComputedColumns[name])
+		if err == nil {
+			err = expr.Bind(m)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("computed column %q: %w", name, err)
+		}
+		byPos[pos] = &ComputedColumn{Name: name, Pos: pos, Expr: expr}
+	}
+
+	var ordered []ComputedColumn
+	visiting := make(map[int]bool)
+	var visit func(c *ComputedColumn) error
+	visit = func(c *ComputedColumn) error {
+		if visiting[c.Pos] {
+			return fmt.Errorf("computed column %q depends on itself", c.Name)
+		}
+		visiting[c.Pos] = true
+		for _, pos := range c.Expr.Positions() {
+			if dep, ok := byPos[pos]; ok {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		delete(byPos, c.Pos)
+		ordered = append(ordered, *c)
+		return nil
+	}
+	for _, pos := range slices.Sorted(maps.Keys(byPos)) {
+		if c, ok := byPos[pos]; ok {
+			if err := visit(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// ReadBy returns the computed columns whose expression reads the column
+// name (case-insensitive), sorted.
+func (s *Schema) ReadBy(name string) []string {
+	var names []string
+	for col, src := range s.ComputedColumns {
+		if expr, err := ParseExpr(src); err == nil && slices.Contains(expr.Columns(), strings.ToLower(name)) {
+			names = append(names, col)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Expr is a parsed expression of a computed column.
+type Expr struct {
+	root    exprNode
+	columns []*exprColumn
+}
+
+type exprNode interface {
+	eval(cols []string) string
+}
+
+type exprLiteral string
+
+type exprColumn struct {
+	name string // Lowercase
+	pos  int    // Position in the row, once bound
+}
+
+type exprNeg struct{ x exprNode }
+
+type exprBinary struct {
+	op   string
+	l, r exprNode
+}
+
+type exprCall struct {
+	fn   *exprFunc
+	args []exprNode
+}
+
+// ParseExpr parses the expression of a computed column.
+func ParseExpr(src string) (*Expr, error) {
+	p := &exprParser{src: src}
+	p.next()
+	root, err := p.parseSum()
+	if err == nil && p.tok != "" {
+		err = fmt.Errorf("unexpected %q", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return &Expr{root: root, columns: p.columns}, nil
+}
+
+// Columns returns the lowercase names of the columns the expression reads.
+func (e *Expr) Columns() []string {
+	var names []string
+	for _, c := range e.columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// Positions returns the positions of the columns the expression reads,
+// once bound.
+func (e *Expr) Positions() []int {
+	var positions []int
+	for _, c := range e.columns {
+		positions = append(positions, c.pos)
+	}
+	return positions
+}
+
+// Bind resolves the columns of the expression in a header map (lowercase
+// name -> position).
+func (e *Expr) Bind(m map[string]int) error {
+	for _, c := range e.columns {
+		pos, ok := m[c.name]
+		if !ok {
+			return fmt.Errorf("column %q not found", c.name)
+		}
+		c.pos = pos
+	}
+	return nil
+}
+
+// Eval returns the value of the bound expression on the columns of a row;
+// columns past its end read as "".
+func (e *Expr) Eval(cols []string) string {
+	return e.root.eval(cols)
+}
+
+func (l exprLiteral) eval([]string) string { return string(l) }
+
+func (c *exprColumn) eval(cols []string) string {
+	if c.pos < len(cols) {
+		return cols[c.pos]
+	}
+	return ""
+}
+
+func (n exprNeg) eval(cols []string) string {
+	v := n.x.eval(cols)
+	if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+		return strconv.FormatInt(-i, 10)
+	}
+	if f, ok := parseFloat(v); ok {
+		return formatFloat(-f)
+	}
+	return ""
+}
+
+func (b *exprBinary) eval(cols []string) string {
+	l, r := b.l.eval(cols), b.r.eval(cols)
+	if b.op == "||" {
+		return l + r
+	}
+	if b.op != "/" {
+		x, errX := strconv.ParseInt(strings.TrimSpace(l), 10, 64)
+		y, errY := strconv.ParseInt(strings.TrimSpace(r), 10, 64)
+		if errX == nil && errY == nil {
+			switch b.op {
+			case "+":
+				return strconv.FormatInt(x+y, 10)
+			case "-":
+				return strconv.FormatInt(x-y, 10)
+			case "*":
+				return strconv.FormatInt(x*y, 10)
+			case "%":
+				if y == 0 {
+					return ""
+				}
+				return strconv.FormatInt(x%y, 10)
+			}
+		}
+	}
+	x, okX := parseFloat(l)
+	y, okY := parseFloat(r)
+	if !okX || !okY {
+		return ""
+	}
+	switch b.op {
+	case "+":
+		return formatFloat(x + y)
+	case "-":
+		return formatFloat(x - y)
+	case "*":
+		return formatFloat(x * y)
+	}
+	if y == 0 {
+		return ""
+	}
+	if b.op == "%" {
+		return formatFloat(math.Mod(x, y))
+	}
+	return formatFloat(x / y)
+}
+
+func (c *exprCall) eval(cols []string) string {
+	vals := make([]string, len(c.args)) // Scans evaluate rows concurrently
+	for i, arg := range c.args {
+		vals[i] = arg.eval(cols)
+	}
+	return c.fn.eval(vals)
+}
+
+// parseFloat parses a number, ignoring surrounding spaces.
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// formatFloat writes a result with up to 15 significant digits, which
+// drops the noise of binary fractions.
+func formatFloat(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return ""
+	}
+	f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', 15, 64), 64)
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// exprFunc is a function of expressions, taking from min to max arguments
+// (max -1: any number).
+type exprFunc struct {
+	min, max int
+	eval     func(args []string) string
+}
+
+var exprFuncs = map[string]*exprFunc{
+	// substr(s, start[, length]): start is 0-based, from the end if negative
+	"substr": {2, 3, func(args []string) string {
+		s := []rune(args[0])
+		start, err := strconv.Atoi(strings.TrimSpace(args[1]))
+		if err != nil {
+			return ""
+		}
+		if start < 0 {
+			start = max(len(s)+start, 0)
+		}
+		start = min(start, len(s))
+		end := len(s)
+		if len(args) == 3 {
+			n, err := strconv.Atoi(strings.TrimSpace(args[2]))
+			if err != nil {
+				return ""
+			}
+			end = min(start+max(n, 0), len(s))
+		}
+		return string(s[start:end])
+	}},
+	"upper":  {1, 1, func(args []string) string { return strings.ToUpper(args[0]) }},
+	"lower":  {1, 1, func(args []string) string { return strings.ToLower(args[0]) }},
+	"trim":   {1, 1, func(args []string) string { return strings.TrimSpace(args[0]) }},
+	"length": {1, 1, func(args []string) string { return strconv.Itoa(utf8.RuneCountInString(args[0])) }},
+	"concat": {1, -1, func(args []string) string { return strings.Join(args, "") }},
+	"replace": {3, 3, func(args []string) string {
+		if args[1] == "" {
+			return args[0]
+		}
+		return strings.ReplaceAll(args[0], args[1], args[2])
+	}},
+	// coalesce(a, b, ...): the first value that is not empty
+	"coalesce": {1, -1, func(args []string) string {
+		for _, a := range args {
+			if a != "" {
+				return a
+			}
+		}
+		return ""
+	}},
+	"abs": {1, 1, func(args []string) string {
+		if i, err := strconv.ParseInt(strings.TrimSpace(args[0]), 10, 64); err == nil {
+			return strconv.FormatInt(max(i, -i), 10)
+		}
+		return mathFunc(args[0], math.Abs)
+	}},
+	"floor": {1, 1, func(args []string) string { return mathFunc(args[0], math.Floor) }},
+	"ceil":  {1, 1, func(args []string) string { return mathFunc(args[0], math.Ceil) }},
+	// round(x[, digits]): half away from zero, to digits after the point
+	"round": {1, 2, func(args []string) string {
+		digits := 0
+		if len(args) == 2 {
+			var err error
+			if digits, err = strconv.Atoi(strings.TrimSpace(args[1])); err != nil {
+				return ""
+			}
+		}
+		return mathFunc(args[0], func(f float64) float64 {
+			scale := math.Pow(10, float64(digits))
+			return math.Round(f*scale) / scale
+		})
+	}},
+}
+
+// mathFunc applies fn to a number, giving "" for a value that is not one.
+func mathFunc(s string, fn func(float64) float64) string {
+	f, ok := parseFloat(s)
+	if !ok {
+		return ""
+	}
+	return formatFloat(fn(f))
+}
+
+// exprParser is a recursive descent parser of expressions:
+//
+//	sum     = product { ("+" | "-" | "||") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | primary
+//	primary = number | string | column | name "(" [ sum { "," sum } ] ")" | "(" sum ")"
+type exprParser struct {
+	src     string
+	pos     int
+	tok     string // Current token; "" at the end
+	kind    byte   // 'n' number, 's' string, 'c' column, 'o' operator
+	val     string // Value of a string, number or column token
+	err     error
+	columns []*exprColumn
+}
+
+// next reads the next token.
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok, p.kind = "", 0
+		return
+	}
+	c := p.src[p.pos]
+	switch {
+	case c >= '0' && c <= '9' || c == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		p.kind, p.val = 'n', p.src[start:p.pos]
+		if _, err := strconv.ParseFloat(p.val, 64); err != nil && p.err == nil {
+			p.err = fmt.Errorf("bad number %q", p.val)
+		}
+	case c == '\'' || c == '"':
+		var b strings.Builder
+		for p.pos++; ; p.pos++ {
+			if p.pos >= len(p.src) {
+				if p.err == nil {
+					p.err = fmt.Errorf("unterminated %c", c)
+				}
+				break
+			}
+			if p.src[p.pos] == c {
+				if p.pos+1 < len(p.src) && p.src[p.pos+1] == c {
+					p.pos++ // Doubled quote
+				} else {
+					p.pos++
+					break
+				}
+			}
+			b.WriteByte(p.src[p.pos])
+		}
+		p.kind, p.val = 's', b.String()
+		if c == '"' {
+			p.kind = 'c'
+		}
+	case isNameByte(c) && (c < '0' || c > '9'):
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind, p.val = 'c', p.src[start:p.pos]
+	case strings.HasPrefix(p.src[p.pos:], "||"):
+		p.pos += 2
+		p.kind = 'o'
+	default:
+		p.pos++
+		p.kind = 'o'
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+// isNameByte reports whether c may be part of a column name that is not
+// quoted.
+func isNameByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	l, err := p.parseProduct()
+	for err == nil && p.kind == 'o' && (p.tok == "+" || p.tok == "-" || p.tok == "||") {
+		op := p.tok
+		p.next()
+		var r exprNode
+		if r, err = p.parseProduct(); err == nil {
+			l = &exprBinary{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.kind == 'o' && (p.tok == "*" || p.tok == "/" || p.tok == "%") {
+		op := p.tok
+		p.next()
+		var r exprNode
+		if r, err = p.parseUnary(); err == nil {
+			l = &exprBinary{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.kind == 'o' && p.tok == "-" {
+		p.next()
+		x, err := p.parseUnary()
+		return exprNeg{x}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok, kind, val := p.tok, p.kind, p.val
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case kind == 'n' || kind == 's':
+		p.next()
+		return exprLiteral(val), nil
+	case kind == 'c':
+		p.next()
+		if p.tok != "(" || tok[0] == '"' { // A quoted name is never a function
+			c := &exprColumn{name: strings.ToLower(val)}
+			p.columns = append(p.columns, c)
+			return c, nil
+		}
+		return p.parseCall(strings.ToLower(val))
+	case tok == "(":
+		p.next()
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return x, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+// parseCall parses the arguments of a call of function name, after its
+// opening parenthesis.
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	call := &exprCall{fn: fn}
+	p.next()
+	for p.tok != ")" {
+		if len(call.args) > 0 {
+			if p.tok != "," {
+				return nil, fmt.Errorf("expected , or ) in %s()", name)
+			}
+			p.next()
+		}
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next()
+	if len(call.args) < fn.min || fn.max >= 0 && len(call.args) > fn.max {
+		return nil, fmt.Errorf("wrong number of arguments to %s()", name)
+	}
+	return call, nil
+}
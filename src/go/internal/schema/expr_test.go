@@ -0,0 +1,97 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExprEval(t *testing.T) {
+	m := map[string]int{"price": 0, "qty": 1, "date": 2, "name": 3, "unit price": 4, "missing": 9}
+	row := []string{"19.99", "3", "2024-01-05", " Ann ", "2"}
+	for src, want := range map[string]string{
+		"price * qty":                  "59.97",
+		"qty * 2 + 1":                  "7",
+		"qty * (2 + 1)":                "9",
+		"-qty - -1":                    "-2",
+		"qty / 2":                      "1.5",
+		"qty % 2":                      "1",
+		"qty / 0":                      "",
+		"name * 2":                     "",
+		"substr(date, 0, 4)":           "2024",
+		"substr(date, -2)":             "05",
+		"substr(date, 8, 10)":          "05",
+		"upper(trim(name)) || '!'":     "ANN!",
+		"concat('it''s ', qty)":        "it's 3",
+		"length(name)":                 "5",
+		"coalesce(missing, 'x')":       "x",
+		"round(price)":                 "20",
+		"round(price, 1)":              "20",
+		"round(2.345, 2)":              "2.35",
+		"abs(-qty)":                    "3",
+		`"unit price" * qty`:           "6",
+		"replace(date, '-', '')":       "20240105",
+		"floor(price) + ceil(price)":   "39",
+		"lower(substr(name, 1, 1))":    "a",
+		"coalesce('', '', qty)":        "3",
+		"substr(date, 20)":             "",
+		"price + 0.01":                 "20",
+		"1.5 * 2":                      "3",
+		"(price)":                      "19.99",
+		"concat(qty)":                  "3",
+		"'a' || qty || \"unit price\"": "a32",
+	} {
+		e, err := ParseExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if err := e.Bind(m); err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got := e.Eval(row); got != want {
+			t.Errorf("%s = %q, want %q", src, got, want)
+		}
+	}
+
+	for _, src := range []string{"", "price *", "(qty", "nope(1)", "substr(date)", "'open", "1.2.3", "qty qty", "upper(a b)"} {
+		if _, err := ParseExpr(src); err == nil {
+			t.Errorf("Parsed %q", src)
+		}
+	}
+}
+
+func TestComputedOrder(t *testing.T) {
+	s := &Schema{ComputedColumns: map[string]string{
+		"b": "a * 2", "a": "x + 1", "id": "x", // id is a CSV column: not computed
+	}}
+	m := map[string]int{"x": 0, "id": 1, "a": 2, "b": 3}
+	cols, err := s.Computed(m, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	row := []string{"4", "7", "", ""}
+	for _, c := range cols {
+		names = append(names, c.Name)
+		row[c.Pos] = c.Expr.Eval(row)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Order %v, want %v", names, want)
+	}
+	if row[3] != "10" {
+		t.Errorf("b = %q, want 10", row[3])
+	}
+	if got := s.ReadBy("A"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("ReadBy(A) = %v", got)
+	}
+
+	s.ComputedColumns["a"] = "b - 1"
+	if _, err := s.Computed(m, 2); err == nil {
+		t.Error("Bound columns computed from each other")
+	}
+	s.ComputedColumns["a"] = "nope"
+	if _, err := s.Computed(m, 2); err == nil {
+		t.Error("Bound a missing column")
+	}
+}
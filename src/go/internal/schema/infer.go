@@ -0,0 +1,356 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// ColumnType is the inferred type of a column.
+type ColumnType string
+
+const (
+	TypeString ColumnType = "string"
+	TypeInt    ColumnType = "int"
+	TypeFloat  ColumnType = "float"
+	TypeBool   ColumnType = "bool"
+	TypeDate   ColumnType = "date"
+)
+
+// ColumnInfo is what `csvquery analyze` learned about a column.
+type ColumnInfo struct {
+	Type      ColumnType `json:"type"`
+	Format    string     `json:"format,omitempty"` // Go time layout of date columns
+	NullRatio float64    `json:"nullRatio"`        // Share of empty or NULL values
+	Distinct  int64      `json:"distinct"`         // Estimated distinct non-null values
+}
+
+// Analysis describes the sample the column metadata was inferred from.
+type Analysis struct {
+	Columns       []string  `json:"columns"` // Header order
+	SampledRows   int64     `json:"sampledRows"`
+	EstimatedRows int64     `json:"estimatedRows"`
+	Exact         bool      `json:"exact"` // The sample covered the whole file
+	AnalyzedAt    time.Time `json:"analyzedAt"`
+}
+
+// DateLayouts are the date formats analyze recognizes, in order of
+// preference (01/02 before 02/01 when the days don't tell them apart).
+var DateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006/01/02",
+	"01/02/2006",
+	"02/01/2006",
+	"02-Jan-2006",
+	"Jan 2, 2006",
+	time.RFC1123,
+}
+
+// inferSegments is how many evenly spaced places of the CSV are sampled,
+// so sorted or clustered files are not judged by their first rows only.
+const inferSegments = 64
+
+// IsNull reports whether a value counts as null (as for IS NULL filters).
+func IsNull(v string) bool {
+	return v == "" || v == "NULL"
+}
+
+// IsInt reports whether v is a plain integer. Leading zeros ("007") mark
+// identifiers that must keep their text, so they are not integers.
+func IsInt(v string) bool {
+	digits := strings.TrimLeft(v, "+-")
+	if len(v)-len(digits) > 1 || digits == "" || (len(digits) > 1 && digits[0] == '0') {
+		return false
+	}
+	_, err := strconv.ParseInt(v, 10, 64)
+	return err == nil
+}
+
+// IsFloat reports whether v is a decimal number (no hex, NaN or Inf).
+func IsFloat(v string) bool {
+	if v == "" || strings.ContainsAny(v, "xXpPnNiI_") {
+		return false
+	}
+	if digits := strings.TrimLeft(v, "+-"); len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return false
+	}
+	_, err := strconv.ParseFloat(v, 64)
+	return err == nil
+}
+
+// ParseBool accepts true/false and yes/no in any case.
+func ParseBool(v string) (bool, bool) {
+	switch strings.ToLower(v) {
+	case "true", "yes":
+		return true, true
+	case "false", "no":
+		return false, true
+	}
+	return false, false
+}
+
+// ParseDate parses v with layout, or with any known layout if layout is "".
+func ParseDate(layout, v string) (time.Time, bool) {
+	if layout != "" {
+		t, err := time.Parse(layout, v)
+		return t, err == nil
+	}
+	for _, l := range DateLayouts {
+		if t, err := time.Parse(l, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// DetectDateLayout returns the first of DateLayouts that parses v.
+func DetectDateLayout(v string) (string, bool) {
+	for _, l := range DateLayouts {
+		if _, err := time.Parse(l, v); err == nil {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+// SortsAsText reports whether dates of a layout sort like their text
+// (year first, fixed width), so string order of index keys is date order.
+func SortsAsText(layout string) bool {
+	switch layout {
+	case "2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006/01/02":
+		return true
+	}
+	return false
+}
+
+// columnSample accumulates the evidence about one column.
+type columnSample struct {
+	nulls    int64
+	notInt   bool
+	notFloat bool
+	notBool  bool
+	dates    []bool // dates[i]: every value parsed with DateLayouts[i]
+	counts   map[string]int
+}
+
+func (c *columnSample) add(v string) {
+	if IsNull(v) {
+		c.nulls++
+		return
+	}
+	c.counts[v]++
+	if c.counts[v] > 1 {
+		return // Same value, same verdict
+	}
+	c.notInt = c.notInt || !IsInt(v)
+	c.notFloat = c.notFloat || !IsFloat(v)
+	if !c.notBool {
+		_, ok := ParseBool(v)
+		c.notBool = !ok
+	}
+	for i, ok := range c.dates {
+		if ok {
+			_, err := time.Parse(DateLayouts[i], v)
+			c.dates[i] = err == nil
+		}
+	}
+}
+
+// info turns the sample into column metadata. The distinct count is
+// extrapolated with the Haas-Stokes Duj1 estimator (as PostgreSQL's
+// ANALYZE does): n*d / (n - f1 + f1*n/N), where f1 counts the values seen
+// once. A sample without repeats makes it N: the column looks unique.
+func (c *columnSample) info(rows, estimatedRows int64, exact bool) ColumnInfo {
+	info := ColumnInfo{Type: TypeString}
+	if rows > 0 {
+		info.NullRatio = float64(c.nulls) / float64(rows)
+	}
+	n := rows - c.nulls
+	if n > 0 {
+		switch {
+		case !c.notInt:
+			info.Type = TypeInt
+		case !c.notFloat:
+			info.Type = TypeFloat
+		case !c.notBool:
+			info.Type = TypeBool
+		default:
+			for i, ok := range c.dates {
+				if ok {
+					info.Type, info.Format = TypeDate, DateLayouts[i]
+					break
+				}
+			}
+		}
+	}
+
+	distinct := int64(len(c.counts))
+	if exact || n == 0 {
+		info.Distinct = distinct
+		return info
+	}
+	var once int64
+	for _, k := range c.counts {
+		if k == 1 {
+			once++
+		}
+	}
+	total := float64(n) * float64(estimatedRows) / float64(rows) // Non-null rows of the file
+	sampled := float64(n)
+	est := sampled * float64(distinct) / (sampled - float64(once) + float64(once)*sampled/total)
+	info.Distinct = max(distinct, min(int64(math.Round(est)), int64(total)))
+	return info
+}
+
+// EstimateRows estimates the rows of a CSV from the length of the lines at
+// its start.
+func EstimateRows(csvPath string) (int64, error) {
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1<<20)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	buf = buf[:n]
+	if int64(n) == stat.Size() {
+		return int64(max(bytes.Count(buf, []byte{'\n'})-1, 0)), nil // All of it, but the header
+	}
+	lines := bytes.Count(buf, []byte{'\n'})
+	if lines == 0 {
+		return 0, nil
+	}
+	return int64(float64(stat.Size()) / (float64(n) / float64(lines))), nil
+}
+
+// Infer samples up to sampleRows rows, spread over the whole CSV, and
+// infers the type, null ratio and distinct count of every column. Small
+// files are read completely, which makes the result exact. A separator of
+// 0 is detected.
+func Infer(csvPath string, separator rune, sampleRows int) (map[string]ColumnInfo, Analysis, error) {
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return nil, Analysis{}, err
+	}
+	defer func() { _ = f.Close() }()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, Analysis{}, err
+	}
+	size := stat.Size()
+	if separator == 0 {
+		dialect, err := common.SniffReader(io.NewSectionReader(f, 0, size))
+		if err != nil {
+			return nil, Analysis{}, err
+		}
+		separator = rune(dialect.Separator)
+	}
+
+	newReader := func(r io.Reader) *csv.Reader {
+		cr := csv.NewReader(r)
+		cr.Comma = separator
+		cr.LazyQuotes = true
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		return cr
+	}
+
+	cr := newReader(bufio.NewReader(f))
+	header, err := cr.Read()
+	if err != nil {
+		return nil, Analysis{}, fmt.Errorf("failed to read header: %w", err)
+	}
+	names := make([]string, len(header))
+	samples := make([]*columnSample, len(header))
+	for i, h := range header {
+		names[i] = strings.ToLower(strings.TrimSpace(h))
+		samples[i] = &columnSample{dates: make([]bool, len(DateLayouts)), counts: make(map[string]int)}
+		for j := range samples[i].dates {
+			samples[i].dates[j] = true
+		}
+	}
+	dataStart := cr.InputOffset()
+
+	perSegment := int64(max(1, (sampleRows+inferSegments-1)/inferSegments))
+	var rows, rowBytes int64
+	exact := true
+	for seg := int64(0); seg < inferSegments; seg++ {
+		start := dataStart + (size-dataStart)*seg/inferSegments
+		end := dataStart + (size-dataStart)*(seg+1)/inferSegments
+		if start >= end {
+			continue
+		}
+		// Start at the first row beginning at or after start: seek one byte
+		// back and skip to the end of that line
+		pos := start
+		if seg > 0 {
+			pos = start - 1
+		}
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			return nil, Analysis{}, err
+		}
+		br := bufio.NewReader(f)
+		if seg > 0 {
+			skipped, err := br.ReadBytes('\n')
+			if err != nil {
+				continue
+			}
+			pos += int64(len(skipped))
+		}
+		sr := newReader(br)
+		var n int64
+		for pos+sr.InputOffset() < end {
+			if n == perSegment {
+				exact = false
+				break
+			}
+			record, err := sr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, Analysis{}, err
+			}
+			for i, s := range samples {
+				v := ""
+				if i < len(record) {
+					v = record[i]
+				}
+				s.add(v)
+			}
+			n++
+		}
+		rows += n
+		rowBytes += sr.InputOffset()
+	}
+
+	analysis := Analysis{Columns: names, SampledRows: rows, EstimatedRows: rows, Exact: exact, AnalyzedAt: time.Now().UTC()}
+	if !exact && rowBytes > 0 {
+		analysis.EstimatedRows = int64(float64(size-dataStart) / (float64(rowBytes) / float64(rows)))
+	}
+	columns := make(map[string]ColumnInfo, len(names))
+	for i, name := range names {
+		columns[name] = samples[i].info(rows, analysis.EstimatedRows, exact)
+	}
+	return columns, analysis, nil
+}
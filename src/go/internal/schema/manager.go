@@ -4,14 +4,28 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 // Schema definition
 type Schema struct {
 	VirtualColumns map[string]string `json:"virtual_columns"` // Name -> Default Value
-	path           string
-	mu             sync.Mutex
+
+	// Virtual columns computed from the row: name -> expression (see expr.go)
+	ComputedColumns map[string]string `json:"computed_columns,omitempty"`
+
+	// Clean names of columns: alias -> header name or "#N" (see alias.go)
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Inferred by `csvquery analyze` (see infer.go); keyed by lowercase name
+	Columns  map[string]ColumnInfo `json:"columns,omitempty"`
+	Analysis *Analysis             `json:"analysis,omitempty"`
+
+	path string
+	mu   sync.Mutex
 }
 
 // Load loads schema from metadata file.
@@ -60,6 +74,71 @@ func (s *Schema) AddVirtualColumn(name, defaultValue string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.VirtualColumns[name] = defaultValue
+	delete(s.ComputedColumns, name)
+}
+
+// AddComputedColumn registers a computed column, after checking its
+// expression parses. It replaces a virtual column of the same name.
+func (s *Schema) AddComputedColumn(name, expr string) error {
+	if _, err := ParseExpr(expr); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ComputedColumns == nil {
+		s.ComputedColumns = make(map[string]string)
+	}
+	delete(s.VirtualColumns, name)
+	s.ComputedColumns[name] = expr
+	return nil
+}
+
+// SetColumns replaces the inferred column metadata.
+func (s *Schema) SetColumns(columns map[string]ColumnInfo, analysis Analysis) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Columns = columns
+	s.Analysis = &analysis
+}
+
+// SetColumnType declares the type of a column, keeping the rest of what
+// analyze inferred about it. A date layout is dropped with the date type.
+func (s *Schema) SetColumnType(name string, typ ColumnType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Columns == nil {
+		s.Columns = make(map[string]ColumnInfo)
+	}
+	key := strings.ToLower(name)
+	info := s.Columns[key]
+	if info.Type != typ {
+		info.Format = ""
+	}
+	info.Type = typ
+	s.Columns[key] = info
+}
+
+// Column returns the inferred metadata of a column (case-insensitive), or
+// of the column an alias stands for.
+func (s *Schema) Column(name string) (ColumnInfo, bool) {
+	info, ok := s.Columns[strings.ToLower(s.ColumnName(name))]
+	return info, ok
+}
+
+// VirtualNames returns the names of the virtual columns, computed ones
+// included, sorted: the order in which they follow the CSV's columns.
+func (s *Schema) VirtualNames() []string {
+	names := make([]string, 0, len(s.VirtualColumns)+len(s.ComputedColumns))
+	for name := range s.VirtualColumns {
+		names = append(names, name)
+	}
+	for name := range s.ComputedColumns {
+		if _, ok := s.VirtualColumns[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 // RemoveVirtualColumn removes a virtual column (used when materializing)
@@ -67,6 +146,73 @@ func (s *Schema) RemoveVirtualColumn(name string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.VirtualColumns, name)
+	delete(s.ComputedColumns, name)
+}
+
+// RenameColumn moves what the schema says of a column (case-insensitive):
+// its default if it is virtual, its inferred metadata and the aliases that
+// name it.
+func (s *Schema) RenameColumn(old, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for col, def := range s.VirtualColumns {
+		if strings.EqualFold(col, old) {
+			delete(s.VirtualColumns, col)
+			s.VirtualColumns[name] = def
+		}
+	}
+	for col, expr := range s.ComputedColumns {
+		if strings.EqualFold(col, old) {
+			delete(s.ComputedColumns, col)
+			s.ComputedColumns[name] = expr
+		}
+	}
+	if info, ok := s.Columns[strings.ToLower(old)]; ok {
+		delete(s.Columns, strings.ToLower(old))
+		s.Columns[strings.ToLower(name)] = info
+	}
+	for alias, target := range s.Aliases {
+		if strings.EqualFold(strings.TrimSpace(target), old) {
+			s.Aliases[alias] = name
+		}
+	}
+}
+
+// DropColumn forgets a column (case-insensitive) and the aliases of it.
+// pos is its 0-based position in the CSV, whose later columns move down
+// one, so aliases of positions are renumbered; -1 for a virtual column.
+func (s *Schema) DropColumn(name string, pos int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for col := range s.VirtualColumns {
+		if strings.EqualFold(col, name) {
+			delete(s.VirtualColumns, col)
+		}
+	}
+	for col := range s.ComputedColumns {
+		if strings.EqualFold(col, name) {
+			delete(s.ComputedColumns, col)
+		}
+	}
+	delete(s.Columns, strings.ToLower(name))
+	for alias, target := range s.Aliases {
+		if strings.EqualFold(strings.TrimSpace(target), name) {
+			delete(s.Aliases, alias)
+			continue
+		}
+		n, ok := strings.CutPrefix(target, "#")
+		if !ok || pos < 0 {
+			continue
+		}
+		if n, err := strconv.Atoi(n); err == nil {
+			switch {
+			case n-1 == pos:
+				delete(s.Aliases, alias)
+			case n-1 > pos:
+				s.Aliases[alias] = "#" + strconv.Itoa(n-1)
+			}
+		}
+	}
 }
 
 func getHeaderPath(csvPath string) string {
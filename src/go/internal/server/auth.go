@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// A daemon listening on TCP can require clients to authenticate: the first
+// line of every connection must then be
+//
+//	{"action":"auth","token":"..."}
+//
+// with the daemon's token, or the connection is closed after an error
+// response. Unix sockets are protected by their file permissions instead.
+// TCP connections can also use TLS (DaemonConfig.TLSCert/TLSKey).
+
+// AuthTokenEnv holds the daemon's auth token when no token file is given.
+const AuthTokenEnv = "CSVQUERY_AUTH_TOKEN"
+
+// LoadAuthToken reads the token from file, or from AuthTokenEnv when file
+// is empty. "" means no authentication.
+func LoadAuthToken(file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(AuthTokenEnv)), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read auth token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("auth token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// initTLS loads the certificate of a TLS listener and the CA that shard
+// connections verify against.
+func (d *UDSDaemon) initTLS() error {
+	if d.config.TLSCert != "" || d.config.TLSKey != "" {
+		if d.config.TLSCert == "" || d.config.TLSKey == "" {
+			return fmt.Errorf("TLS needs both a certificate and a key")
+		}
+		if d.config.Network != "tcp" && d.config.HTTPAddr == "" {
+			return fmt.Errorf("TLS applies to TCP and HTTP listeners only")
+		}
+		cert, err := tls.LoadX509KeyPair(d.config.TLSCert, d.config.TLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		d.tlsServer = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	var err error
+	d.tlsClient, err = ClientTLS(d.config.TLSCA)
+	return err
+}
+
+// ClientTLS returns the TLS configuration of connections to daemons,
+// verified against the CA certificate in caFile ("" = system roots).
+func ClientTLS(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in TLS CA %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// requireAuth reports whether connections must authenticate first.
+func (d *UDSDaemon) requireAuth() bool {
+	return d.config.AuthToken != "" && d.config.Network == "tcp"
+}
+
+// authenticate reads the handshake line of a connection and answers it.
+// It reports whether the client may go on.
+func (d *UDSDaemon) authenticate(conn net.Conn, reader *bufio.Reader) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(d.config.IdleTimeout))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return false
+	}
+
+	var req DaemonRequest
+	response := d.successResponse(map[string]interface{}{"authenticated": true})
+	ok := json.Unmarshal(line, &req) == nil && req.Action == "auth" &&
+		subtle.ConstantTimeCompare([]byte(req.Token), []byte(d.config.AuthToken)) == 1
+	if !ok {
+		response = codedResponse(codeUnauthorized, "authentication required")
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write(append(response, '\n'))
+	return ok
+}
+
+// handshake authenticates a fresh connection to a worker daemon with the
+// coordinator's own token.
+func (c *shardClient) handshake(sc *shardConn, deadline time.Time) error {
+	_ = sc.conn.SetDeadline(deadline)
+	body, err := json.Marshal(DaemonRequest{Action: "auth", Token: c.token})
+	if err != nil {
+		return err
+	}
+	if _, err := sc.conn.Write(append(body, '\n')); err != nil {
+		return err
+	}
+	line, err := sc.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Error *string `json:"error"`
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("invalid auth response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s", *resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const countRequest = `{"action":"count","where":{"city":"Rome"}}`
+
+// listenTCP serves d's connections on a TCP port of localhost, over TLS
+// when d has a certificate, and returns its address.
+func listenTCP(t *testing.T, d *UDSDaemon) string {
+	t.Helper()
+	d.config.Network = "tcp"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		d.Shutdown()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if d.tlsServer != nil {
+				conn = tls.Server(conn, d.tlsServer)
+			}
+			d.wg.Add(1)
+			go d.handleConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newTLSFiles writes a self-signed certificate for 127.0.0.1 and its key,
+// and returns their paths. The certificate is its own CA.
+func newTLSFiles(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "csvquery test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// lineClient sends request lines over a connection and reads the answers.
+type lineClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newLineClient(t *testing.T, conn net.Conn) *lineClient {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { _ = conn.Close() })
+	return &lineClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send writes line and decodes the response line.
+func (c *lineClient) send(line string) map[string]interface{} {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	answer, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("%s: %v", line, err)
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		c.t.Fatalf("%s: answered %q: %v", line, answer, err)
+	}
+	return resp
+}
+
+// closed reports whether the daemon closed the connection.
+func (c *lineClient) closed() bool {
+	_, err := c.reader.ReadByte()
+	return err == io.EOF
+}
+
+func TestAuthTCP(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	d.config.AuthToken = "secret"
+	addr := listenTCP(t, d)
+	dial := func() *lineClient {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newLineClient(t, conn)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		first string
+	}{
+		{"no auth", countRequest},
+		{"wrong token", `{"action":"auth","token":"guess"}`},
+		{"empty token", `{"action":"auth","token":""}`},
+		{"batch before auth", "[" + `{"action":"auth","token":"secret"},` + countRequest + "]"},
+		{"not JSON", "secret"},
+	} {
+		c := dial()
+		if resp := c.send(tc.first); resp["code"] != codeUnauthorized {
+			t.Errorf("%s: %v, want unauthorized", tc.name, resp)
+		}
+		if !c.closed() {
+			t.Errorf("%s: connection left open", tc.name)
+		}
+	}
+
+	c := dial()
+	if resp := c.send(`{"action":"auth","token":"secret"}`); resp["authenticated"] != true {
+		t.Fatalf("auth: %v", resp)
+	}
+	if resp := c.send(countRequest); resp["count"] != 1.0 {
+		t.Errorf("count after auth: %v", resp)
+	}
+	var batch []map[string]interface{}
+	if _, err := io.WriteString(c.conn, "["+countRequest+"]\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.reader.ReadBytes('\n'); err != nil || json.Unmarshal(line, &batch) != nil || len(batch) != 1 || batch[0]["count"] != 1.0 {
+		t.Errorf("batch after auth: %q (%v)", line, err)
+	}
+}
+
+func TestAuthTLS(t *testing.T) {
+	certFile, keyFile := newTLSFiles(t)
+	d := newTestDaemon(t, testCSV)
+	d.config.Network, d.config.AuthToken = "tcp", "secret"
+	d.config.TLSCert, d.config.TLSKey, d.config.TLSCA = certFile, keyFile, certFile
+	if err := d.initTLS(); err != nil {
+		t.Fatal(err)
+	}
+	addr := listenTCP(t, d)
+
+	// Verified against the CA, then authenticated as over plain TCP
+	clientTLS, err := ClientTLS(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newLineClient(t, conn)
+	if resp := c.send(countRequest); resp["code"] != codeUnauthorized {
+		t.Errorf("TLS without auth: %v, want unauthorized", resp)
+	}
+	conn, err = tls.Dial("tcp", addr, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newLineClient(t, conn)
+	if resp := c.send(`{"action":"auth","token":"secret"}`); resp["authenticated"] != true {
+		t.Fatalf("TLS auth: %v", resp)
+	}
+	if resp := c.send(countRequest); resp["count"] != 1.0 {
+		t.Errorf("TLS count: %v", resp)
+	}
+
+	// Without the CA the certificate is not trusted
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{MinVersion: tls.VersionTLS12}); err == nil {
+		_ = conn.Close()
+		t.Error("TLS dial without the CA succeeded")
+	}
+}
+
+func TestAuthHTTP(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	d.config.AuthToken = "secret"
+	for _, tc := range []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"not bearer", "Basic secret", http.StatusUnauthorized},
+		{"token", "Bearer secret", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(countRequest))
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		d.serveHTTPRequest(rec, r)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.status)
+		}
+		if tc.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"count":1`) {
+			t.Errorf("%s: %s", tc.name, rec.Body.String())
+		}
+	}
+}
+
+// wsClient is the client end of a WebSocket to the daemon.
+type wsClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialWebSocket opens /ws of the HTTP server at url with header.
+func dialWebSocket(t *testing.T, url string, header http.Header) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { _ = conn.Close() })
+	req, err := http.NewRequest(http.MethodGet, url+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: status %d", resp.StatusCode)
+	}
+	return &wsClient{t: t, conn: conn, reader: reader}
+}
+
+// send writes a masked text frame, as clients must.
+func (c *wsClient) send(message string) {
+	c.t.Helper()
+	frame := []byte{0x80 | wsText}
+	switch n := len(message); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame = append(frame, mask[:]...)
+	for i := range len(message) {
+		frame = append(frame, message[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads a frame from the daemon: its opcode and payload.
+func (c *wsClient) read() (byte, []byte) {
+	c.t.Helper()
+	var h [2]byte
+	if _, err := io.ReadFull(c.reader, h[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return h[0] & 0x0f, payload
+}
+
+// event reads a text message and decodes it.
+func (c *wsClient) event() map[string]interface{} {
+	c.t.Helper()
+	op, payload := c.read()
+	if op != wsText {
+		c.t.Fatalf("frame %d (%q), want a text message", op, payload)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		c.t.Fatal(err)
+	}
+	return fields
+}
+
+func TestAuthWebSocket(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	d.config.AuthToken = "secret"
+	srv := httptest.NewServer(http.HandlerFunc(d.serveWebSocket))
+	t.Cleanup(srv.Close)
+
+	// The bearer header, or an auth message first
+	ws := dialWebSocket(t, srv.URL, http.Header{"Authorization": {"Bearer secret"}})
+	ws.send(countRequest)
+	if ev := ws.event(); ev["event"] != "done" || ev["count"] != 1.0 {
+		t.Errorf("with the header: %v", ev)
+	}
+	ws = dialWebSocket(t, srv.URL, nil)
+	ws.send(`{"action":"auth","token":"secret"}`)
+	if ev := ws.event(); ev["event"] != "done" || ev["authenticated"] != true {
+		t.Errorf("auth message: %v", ev)
+	}
+	ws.send(countRequest)
+	if ev := ws.event(); ev["event"] != "done" || ev["count"] != 1.0 {
+		t.Errorf("after the auth message: %v", ev)
+	}
+
+	// Anything else first: an error, then the connection closes
+	for _, first := range []string{countRequest, `{"action":"auth","token":"guess"}`} {
+		ws = dialWebSocket(t, srv.URL, http.Header{"Authorization": {"Bearer guess"}})
+		ws.send(first)
+		if ev := ws.event(); ev["event"] != "error" || ev["code"] != codeUnauthorized {
+			t.Errorf("%s: %v, want unauthorized", first, ev)
+		}
+		if op, payload := ws.read(); op != wsClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1008 {
+			t.Errorf("%s: frame %d %v, want close 1008", first, op, payload)
+		}
+	}
+}
+
+func TestShardHandshake(t *testing.T) {
+	worker := newTestDaemon(t, testCSV)
+	worker.config.AuthToken = "secret"
+	addr := listenTCP(t, worker)
+	deadline := time.Now().Add(10 * time.Second)
+
+	client, err := newShardClient("tcp:"+addr, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.close)
+	resp, err := client.do([]byte(countRequest), deadline)
+	if err != nil {
+		t.Fatalf("with the token: %v", err)
+	}
+	if string(resp["count"]) != "1" {
+		t.Errorf("count %s, want 1", resp["count"])
+	}
+
+	for _, token := range []string{"guess", ""} {
+		client, err := newShardClient("tcp:"+addr, token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.do([]byte(countRequest), deadline)
+		if err == nil || !strings.Contains(err.Error(), "authentication required") {
+			t.Errorf("token %q: %v, want authentication required", token, err)
+		}
+		client.close()
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A request line can also hold a JSON array of requests. They are answered
+// in order, and the response line is the array of their responses, so a
+// client with many small lookups pays for one round trip instead of one
+// per request. Each request is recorded and logged as if sent on its own.
+
+// maxBatchRequests bounds the requests of one batch line.
+const maxBatchRequests = 1000
+
+// serveBatch answers a batch line (open as for serve).
+func (d *UDSDaemon) serveBatch(line []byte, open bool) []byte {
+	var requests []json.RawMessage
+	if err := json.Unmarshal(line, &requests); err != nil {
+		return d.errorResponse("invalid JSON: " + err.Error())
+	}
+	if len(requests) > maxBatchRequests {
+		return d.errorResponse(fmt.Sprintf("a batch takes at most %d requests", maxBatchRequests))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, request := range requests {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if d.shuttingDown() {
+			buf.Write(d.errorFor(errShuttingDown))
+			continue
+		}
+		buf.Write(d.serve(request, open, nil))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CaptureEntry is one recorded request/response pair.
+// Entries carry no peer address and no wall-clock time (only the offset
+// from the start of the capture). Unless the capture is raw, the literal
+// values of requests are replaced by hashes (see redactRequest): the
+// entry keeps the shape of the request, its columns and options, but not
+// the data it filtered on or wrote. Auth requests are never recorded.
+type CaptureEntry struct {
+	Seq          int64           `json:"seq"`
+	OffsetMs     int64           `json:"offsetMs"`
+	Request      json.RawMessage `json:"request"`
+	Redacted     bool            `json:"redacted,omitempty"` // Request values are hashes: replay cannot compare the response
+	ResponseHash string          `json:"responseHash"`
+	LatencyUs    int64           `json:"latencyUs"`
+}
+
+// Recorder appends daemon traffic to a JSON-lines capture file.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	raw     bool // Record requests verbatim
+	started time.Time
+	seq     int64
+}
+
+// NewRecorder opens (or creates) a capture file for appending. Requests
+// are redacted unless raw is set.
+func NewRecorder(path string, raw bool) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	return &Recorder{
+		file:    f,
+		w:       bufio.NewWriter(f),
+		raw:     raw,
+		started: time.Now(),
+	}, nil
+}
+
+// Record writes a single entry. The request is compacted so that
+// whitespace differences don't leak client formatting.
+func (r *Recorder) Record(request, response []byte, latency time.Duration) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, request); err != nil {
+		return // Invalid JSON is not worth replaying
+	}
+	var action struct {
+		Action string `json:"action"`
+	}
+	if json.Unmarshal(compact.Bytes(), &action) == nil && action.Action == "auth" {
+		return // Holds the token
+	}
+	recorded := compact.Bytes()
+	if !r.raw {
+		var err error
+		if recorded, err = redactRequest(recorded); err != nil {
+			return
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	entry := CaptureEntry{
+		Seq:          r.seq,
+		OffsetMs:     time.Since(r.started).Milliseconds(),
+		Request:      recorded,
+		Redacted:     !r.raw,
+		ResponseHash: hashResponse(response),
+		LatencyUs:    latency.Microseconds(),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = r.w.Write(b)
+	_ = r.w.WriteByte('\n')
+	_ = r.w.Flush()
+}
+
+// Close flushes and closes the capture file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.w.Flush()
+	return r.file.Close()
+}
+
+// redactedFields are the request fields that hold literal values: the
+// where and set values, written rows, key sets and cursors (which hold
+// the keys of the last row).
+var redactedFields = []string{"where", "set", "rows", "inSet", "cursor"}
+
+// redactRequest replaces the literal values of a request, or of each
+// request of a batch, by hashes of them: equal values keep equal hashes,
+// so the capture still shows which requests asked for the same thing.
+func redactRequest(request []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(request))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	requests, batch := v.([]interface{})
+	if !batch {
+		requests = []interface{}{v}
+	}
+	for _, req := range requests {
+		fields, ok := req.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		delete(fields, "token")
+		for _, name := range redactedFields {
+			if value, ok := fields[name]; ok {
+				fields[name] = redactValue(value)
+			}
+		}
+	}
+	return json.Marshal(v)
+}
+
+// redactValue replaces the strings and numbers in v by their hashes,
+// keeping object keys (column names).
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = redactValue(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+		return v
+	case string:
+		return redactedString(v)
+	case json.Number:
+		return redactedString(v.String())
+	}
+	return v // Booleans and nulls
+}
+
+func redactedString(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return "sha1:" + hex.EncodeToString(sum[:8])
+}
+
+func hashResponse(response []byte) string {
+	sum := sha1.Sum(bytes.TrimSpace(response))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReplayConfig configures a replay run against a live daemon.
+type ReplayConfig struct {
+	CapturePath string
+	Address     string      // "unix:/path", "tcp:host:port" or "tls:host:port"
+	Token       string      // Authenticate to a TCP daemon with this token ("" = none)
+	TLS         *tls.Config // Of tls: addresses (nil = verified against system roots)
+	Timeout     time.Duration
+	Output      io.Writer // Mismatch details and summary (defaults to stdout)
+}
+
+// ReplayReport summarizes a replay run.
+type ReplayReport struct {
+	Total      int   `json:"total"`
+	Mismatches int   `json:"mismatches"`
+	Errors     int   `json:"errors"`
+	Unchecked  int   `json:"unchecked"` // Redacted requests, sent for latency only
+	Skipped    int   `json:"skipped"`   // Redacted write requests, not sent
+	OldP50Us   int64 `json:"oldP50Us"`
+	OldP95Us   int64 `json:"oldP95Us"`
+	NewP50Us   int64 `json:"newP50Us"`
+	NewP95Us   int64 `json:"newP95Us"`
+}
+
+// Replay re-sends every captured request over a single connection and
+// compares response hashes and latency with the recorded values. Redacted
+// requests ask for hashes instead of the values of the capture, so their
+// responses are not compared, and those that would write are not sent.
+func Replay(cfg ReplayConfig) (*ReplayReport, error) {
+	if cfg.Output == nil {
+		cfg.Output = os.Stdout
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	f, err := os.Open(cfg.CapturePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if cfg.TLS == nil {
+		cfg.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client, err := newShardClient(cfg.Address, cfg.Token, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := client.dial(time.Now().Add(cfg.Timeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", client, err)
+	}
+	conn := sc.conn
+	defer func() { _ = conn.Close() }()
+
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	report := &ReplayReport{}
+	var oldLat, newLat []int64
+
+	for lines.Scan() {
+		var entry CaptureEntry
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			continue
+		}
+		report.Total++
+		if entry.Redacted && writesData(entry.Request) {
+			report.Skipped++
+			continue
+		}
+
+		start := time.Now()
+		_ = conn.SetDeadline(start.Add(cfg.Timeout))
+		if _, err := conn.Write(append(entry.Request, '\n')); err != nil {
+			return report, fmt.Errorf("write failed at seq %d: %w", entry.Seq, err)
+		}
+		response, err := sc.reader.ReadBytes('\n')
+		if err != nil {
+			report.Errors++
+			_, _ = fmt.Fprintf(cfg.Output, "seq %d: read failed: %v\n", entry.Seq, err)
+			return report, fmt.Errorf("read failed at seq %d: %w", entry.Seq, err)
+		}
+		elapsed := time.Since(start)
+
+		oldLat = append(oldLat, entry.LatencyUs)
+		newLat = append(newLat, elapsed.Microseconds())
+
+		if entry.Redacted {
+			report.Unchecked++
+		} else if hashResponse(response) != entry.ResponseHash {
+			report.Mismatches++
+			_, _ = fmt.Fprintf(cfg.Output, "seq %d: response differs\n  request: %s\n  got:     %s\n",
+				entry.Seq, entry.Request, bytes.TrimSpace(response))
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return report, err
+	}
+
+	report.OldP50Us, report.OldP95Us = percentiles(oldLat)
+	report.NewP50Us, report.NewP95Us = percentiles(newLat)
+
+	_, _ = fmt.Fprintf(cfg.Output, "Replayed %d requests: %d mismatches, %d errors\n",
+		report.Total, report.Mismatches, report.Errors)
+	if report.Unchecked > 0 || report.Skipped > 0 {
+		_, _ = fmt.Fprintf(cfg.Output, "Redacted: %d sent unchecked, %d writes skipped (capture with daemon --capture-raw to compare responses)\n",
+			report.Unchecked, report.Skipped)
+	}
+	_, _ = fmt.Fprintf(cfg.Output, "Latency p50: %dµs -> %dµs | p95: %dµs -> %dµs\n",
+		report.OldP50Us, report.NewP50Us, report.OldP95Us, report.NewP95Us)
+
+	return report, nil
+}
+
+// writesData reports whether a request, or one of a batch, changes the
+// dataset.
+func writesData(request []byte) bool {
+	type action struct {
+		Action string `json:"action"`
+	}
+	var requests []action
+	if json.Unmarshal(request, &requests) != nil {
+		var one action
+		_ = json.Unmarshal(request, &one)
+		requests = []action{one}
+	}
+	for _, req := range requests {
+		switch req.Action {
+		case "write", "update", "delete", "reindex":
+			return true
+		}
+	}
+	return false
+}
+
+// percentiles returns the p50 and p95 of the given samples.
+func percentiles(samples []int64) (int64, int64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sorted := make([]int64, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*50/100], sorted[(len(sorted)-1)*95/100]
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorderRedacts(t *testing.T) {
+	requests := []string{
+		`{"action":"auth","token":"s3cret"}`,
+		`{"action":"select","where":{"email":"ann@example.com"},"limit":10,"cursor":"abc"}`,
+		`[{"action":"update","where":{"id":"5"},"set":{"city":"Bergen"}},{"action":"write","rows":[["6","fay",9876543210]]}]`,
+	}
+	for _, raw := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "capture.jsonl")
+		r, err := NewRecorder(path, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, req := range requests {
+			r.Record([]byte(req), []byte(`{"ok":true}`), time.Millisecond)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []CaptureEntry
+		for lines := bufio.NewScanner(f); lines.Scan(); {
+			var entry CaptureEntry
+			if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		_ = f.Close()
+		if len(entries) != 2 {
+			t.Fatalf("raw %v: %d entries, want 2 (no auth)", raw, len(entries))
+		}
+		for i, entry := range entries {
+			got := string(entry.Request)
+			if entry.Redacted == raw {
+				t.Errorf("raw %v: entry %d redacted %v", raw, i, entry.Redacted)
+			}
+			for _, value := range []string{"ann@example.com", "abc", "Bergen", `"5"`, "fay", "9876543210"} {
+				if has := strings.Contains(got, value); has != raw && strings.Contains(requests[i+1], value) {
+					t.Errorf("raw %v: %s holds %s: %v, want %v", raw, got, value, has, raw)
+				}
+			}
+		}
+		if !raw {
+			want := `{"action":"select","cursor":"` + redactedString("abc") + `","limit":10,"where":{"email":"` + redactedString("ann@example.com") + `"}}`
+			if got := string(entries[0].Request); got != want {
+				t.Errorf("Redacted select %s, want %s", got, want)
+			}
+		}
+	}
+}
+
+func TestWritesData(t *testing.T) {
+	for request, want := range map[string]bool{
+		`{"action":"select"}`:                       false,
+		`{"action":"delete","where":{"id":"1"}}`:    true,
+		`[{"action":"count"},{"action":"write"}]`:   true,
+		`[{"action":"count"},{"action":"groupby"}]`: false,
+	} {
+		if got := writesData([]byte(request)); got != want {
+			t.Errorf("writesData(%s) = %v, want %v", request, got, want)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// A daemon started with shards is a coordinator: it holds no data, sends
+// each request to every worker daemon (each serving its own shard of the
+// dataset) and merges their responses into one. Counts and aggregations
+// are combined; rows come back tagged with the index of their shard in
+// DaemonConfig.Shards, in shard order.
+
+// shardIdleConns is how many idle connections are kept per worker.
+const shardIdleConns = 8
+
+// shardDefaultTimeout bounds a fan-out when no query timeout is set.
+const shardDefaultTimeout = 5 * time.Minute
+
+// shardClient sends requests to one worker daemon over pooled connections.
+type shardClient struct {
+	network string // "unix", "tcp" or "tls"
+	address string
+	token   string      // Auth handshake of TCP connections ("" = none)
+	tls     *tls.Config // For "tls"
+	idle    chan *shardConn
+}
+
+type shardConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// parseShardAddress accepts "unix:/path", "tcp:host:port",
+// "tls:host:port", a socket path (or "@name") or host:port.
+func parseShardAddress(s string) (network, address string, err error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		return "unix", strings.TrimPrefix(s, "unix:"), nil
+	case strings.HasPrefix(s, "tcp:"):
+		return "tcp", strings.TrimPrefix(s, "tcp:"), nil
+	case strings.HasPrefix(s, "tls:"):
+		return "tls", strings.TrimPrefix(s, "tls:"), nil
+	case strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") || abstractSocket(s):
+		return "unix", s, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", fmt.Errorf("invalid shard address %q: use unix:/path, tcp:host:port or tls:host:port", s)
+	}
+	return "tcp", s, nil
+}
+
+func newShardClient(addr, token string, tlsConfig *tls.Config) (*shardClient, error) {
+	network, address, err := parseShardAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &shardClient{
+		network: network,
+		address: address,
+		idle:    make(chan *shardConn, shardIdleConns),
+	}
+	if network != "unix" {
+		c.token = token
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(address)
+		c.tls = tlsConfig.Clone()
+		c.tls.ServerName = host
+	}
+	return c, nil
+}
+
+// dial opens a connection to the worker, authenticated if need be.
+func (c *shardClient) dial(deadline time.Time) (*shardConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, c.tls)
+	} else {
+		conn, err = dialer.Dial(c.network, c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := &shardConn{conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+	if c.token != "" {
+		if err := c.handshake(sc, deadline); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	return sc, nil
+}
+
+func (c *shardClient) String() string {
+	return c.network + ":" + c.address
+}
+
+// do sends one request line and decodes the response, turning an "error"
+// field into an error.
+func (c *shardClient) do(request []byte, deadline time.Time) (map[string]json.RawMessage, error) {
+	line, err := c.roundTrip(request, deadline)
+	if err != nil {
+		return nil, err
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if raw, ok := resp["error"]; ok && string(raw) != "null" {
+		var msg string
+		if json.Unmarshal(raw, &msg) != nil {
+			msg = string(raw)
+		}
+		var code string
+		_ = json.Unmarshal(resp["code"], &code)
+		return nil, &remoteError{code: code, msg: msg}
+	}
+	return resp, nil
+}
+
+// roundTrip writes the request and reads the response line. A pooled
+// connection the worker has since closed (idle timeout, restart) fails on
+// first use, so that case is retried once on a fresh connection: requests
+// are reads and safe to resend.
+func (c *shardClient) roundTrip(request []byte, deadline time.Time) ([]byte, error) {
+	// The shards share request: append to a copy, not its spare capacity
+	request = append(request[:len(request):len(request)], '\n')
+	for {
+		var sc *shardConn
+		pooled := false
+		select {
+		case sc = <-c.idle:
+			pooled = true
+		default:
+			var err error
+			if sc, err = c.dial(deadline); err != nil {
+				return nil, err
+			}
+		}
+
+		_ = sc.conn.SetDeadline(deadline)
+		line, err := func() ([]byte, error) {
+			if _, err := sc.conn.Write(request); err != nil {
+				return nil, err
+			}
+			return sc.reader.ReadBytes('\n')
+		}()
+		if err != nil {
+			_ = sc.conn.Close()
+			if pooled && !isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		select {
+		case c.idle <- sc:
+		default:
+			_ = sc.conn.Close()
+		}
+		return line, nil
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// close drops the idle connections.
+func (c *shardClient) close() {
+	for {
+		select {
+		case sc := <-c.idle:
+			_ = sc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// initShards connects the coordinator's worker list.
+func (d *UDSDaemon) initShards() error {
+	for _, addr := range d.config.Shards {
+		client, err := newShardClient(addr, d.config.AuthToken, d.tlsClient)
+		if err != nil {
+			return err
+		}
+		d.shards = append(d.shards, client)
+	}
+	return nil
+}
+
+// fanOut sends req to every shard concurrently. Any failing shard fails
+// the request: a merge without it would be silently incomplete.
+func (d *UDSDaemon) fanOut(req DaemonRequest) ([]map[string]json.RawMessage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := shardDefaultTimeout
+	if cfgTimeout := d.config.QueryTimeout; cfgTimeout > 0 {
+		timeout = cfgTimeout
+	}
+	if req.Timeout > 0 {
+		if t := time.Duration(req.Timeout) * time.Millisecond; t < timeout {
+			timeout = t
+		}
+	}
+	// Workers enforce the timeout themselves; allow for the round trip
+	deadline := time.Now().Add(timeout + 5*time.Second)
+
+	responses := make([]map[string]json.RawMessage, len(d.shards))
+	errs := make([]error, len(d.shards))
+	var wg sync.WaitGroup
+	for i, shard := range d.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = shard.do(body, deadline)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("shard %d (%s): %w", i, d.shards[i], err)
+		}
+	}
+	return responses, nil
+}
+
+// coordinate answers a request by fanning it out to the shards.
+func (d *UDSDaemon) coordinate(req DaemonRequest) []byte {
+	if req.Cursor != "" {
+		return d.errorResponse("cursors are not supported by a coordinator: page with offset")
+	}
+	if req.Pivot != "" {
+		return d.errorResponse("pivot is not supported by a coordinator: group by both columns instead")
+	}
+	if req.OrderBy != "" {
+		return d.errorResponse("orderBy is not supported by a coordinator: shards return rows in their own index order")
+	}
+	if req.Spool || req.Action == "page" {
+		return d.errorResponse("spooled selects are not supported by a coordinator: page with offset")
+	}
+	if req.Ranges {
+		return d.errorResponse("ranges are not supported by a coordinator: ask the worker daemons, which serve their CSVs")
+	}
+	switch req.Action {
+	case "ping":
+		if _, err := d.fanOut(req); err != nil {
+			return d.errorFor(err)
+		}
+		return d.successResponse(map[string]interface{}{"pong": true, "shards": len(d.shards)})
+
+	case "count":
+		responses, err := d.fanOut(req)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		var total int64
+		for _, resp := range responses {
+			var count int64
+			_ = json.Unmarshal(resp["count"], &count)
+			total += count
+		}
+		return d.successResponse(map[string]interface{}{"count": total})
+
+	case "select":
+		rows, err := d.coordinateRows(req, func(resp map[string]json.RawMessage, shard int) ([]interface{}, error) {
+			var rows []map[string]interface{}
+			if err := json.Unmarshal(resp["rows"], &rows); err != nil {
+				return nil, err
+			}
+			tagged := make([]interface{}, len(rows))
+			for i, row := range rows {
+				row["shard"] = shard
+				tagged[i] = row
+			}
+			return tagged, nil
+		})
+		if err != nil {
+			return d.errorFor(err)
+		}
+		return d.successResponse(map[string]interface{}{"rows": rows})
+
+	case "groupby":
+		if req.GroupBy == "" {
+			req.GroupBy = req.Column
+		}
+		if req.AggFunc == "" {
+			req.AggFunc = "count"
+		}
+		groups, err := d.coordinatedGroups(req)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		return d.successResponse(map[string]interface{}{"groups": groups})
+
+	case "explain":
+		req.Explain = true
+		return d.coordinateQuery(req)
+
+	case "query":
+		return d.coordinateQuery(req)
+
+	case "status":
+		return d.coordinateStatus(req)
+
+	case "health":
+		return d.coordinateHealth(req)
+
+	case "keyset", "indexes":
+		return d.errorResponse(req.Action + " is not supported by a coordinator: ask the worker daemons")
+
+	case "fetch":
+		return d.coordinateFetch(req)
+
+	case "reindex":
+		if _, err := d.fanOut(req); err != nil {
+			return d.errorFor(err)
+		}
+		return d.successResponse(map[string]interface{}{"shards": len(d.shards)})
+
+	case "write", "update", "delete":
+		return d.errorResponse(req.Action + " is not supported by a coordinator: send it to the worker daemon of the shard")
+
+	default:
+		return d.errorResponse("unknown action: " + req.Action)
+	}
+}
+
+// coordinateFetch passes a fetch on to the shard its offsets are from
+// (the "shard" of the select rows they came with).
+func (d *UDSDaemon) coordinateFetch(req DaemonRequest) []byte {
+	if req.Shard == nil || *req.Shard < 0 || *req.Shard >= len(d.shards) {
+		return d.errorResponse(fmt.Sprintf("fetch from a coordinator needs the shard (0-%d) of the offsets", len(d.shards)-1))
+	}
+	i := *req.Shard
+	req.Shard = nil
+	body, err := json.Marshal(req)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	resp, err := d.shards[i].do(body, time.Now().Add(shardDefaultTimeout))
+	if err != nil {
+		return d.errorFor(fmt.Errorf("shard %d (%s): %w", i, d.shards[i], err))
+	}
+	return d.successResponse(map[string]interface{}{"columns": resp["columns"], "rows": resp["rows"], "shard": i})
+}
+
+// coordinateQuery handles the generic query action: per-shard plans for
+// explain, merged groups for aggregations, else the shards' offset lines
+// prefixed with the shard index ("shard,offset,line").
+func (d *UDSDaemon) coordinateQuery(req DaemonRequest) []byte {
+	switch {
+	case req.Explain:
+		responses, err := d.fanOut(req)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		plans := make([]interface{}, len(responses))
+		for i, resp := range responses {
+			plans[i] = map[string]interface{}{"shard": i, "address": d.shards[i].String(), "plan": resp["data"]}
+		}
+		return d.successResponse(map[string]interface{}{"data": map[string]interface{}{"shards": plans}})
+
+	case req.GroupBy != "":
+		groups, err := d.coordinatedGroups(req)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		return d.successResponse(map[string]interface{}{"data": groups})
+	}
+
+	lines, err := d.coordinateRows(req, func(resp map[string]json.RawMessage, shard int) ([]interface{}, error) {
+		var output string
+		if err := json.Unmarshal(resp["output"], &output); err != nil {
+			return nil, err
+		}
+		var lines []interface{}
+		for _, line := range strings.Split(output, "\n") {
+			if line != "" {
+				lines = append(lines, fmt.Sprintf("%d,%s", shard, line))
+			}
+		}
+		return lines, nil
+	})
+	if err != nil {
+		return d.errorFor(err)
+	}
+	var sb strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(line.(string))
+	}
+	return d.successResponse(map[string]interface{}{"output": sb.String()})
+}
+
+// coordinateRows fetches the first offset+limit rows of every shard and
+// applies offset and limit to their concatenation in shard order.
+func (d *UDSDaemon) coordinateRows(req DaemonRequest, extract func(resp map[string]json.RawMessage, shard int) ([]interface{}, error)) ([]interface{}, error) {
+	offset, limit := req.Offset, req.Limit
+	req.Offset = 0
+	if limit > 0 {
+		req.Limit = offset + limit
+	}
+
+	responses, err := d.fanOut(req)
+	if err != nil {
+		return nil, err
+	}
+	var all []interface{}
+	for i, resp := range responses {
+		rows, err := extract(resp, i)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d (%s): invalid response: %w", i, d.shards[i], err)
+		}
+		all = append(all, rows...)
+	}
+
+	if offset >= len(all) {
+		return []interface{}{}, nil
+	}
+	all = all[offset:]
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// coordinatedGroups is the groups of a request merged from the shards: a
+// map, or with aggSort the ordered array a single daemon would return. The
+// shards return all their groups, as a group's rank needs every shard's.
+func (d *UDSDaemon) coordinatedGroups(req DaemonRequest) (interface{}, error) {
+	sort, limit := req.AggSort, req.AggLimit
+	req.AggSort, req.AggLimit = "", 0
+	groups, err := d.coordinateGroups(req)
+	if err != nil || (sort == "" && limit == 0) {
+		return groups, err
+	}
+	return query.RankGroups(groups, sort, limit)
+}
+
+// coordinateGroups merges the shards' group aggregates. An average cannot
+// be combined from averages, so it is computed from per-shard sums and
+// counts instead.
+func (d *UDSDaemon) coordinateGroups(req DaemonRequest) (map[string]float64, error) {
+	if req.AggFunc == "avg" {
+		req.AggFunc = "sum"
+		sums, err := d.coordinateGroups(req)
+		if err != nil {
+			return nil, err
+		}
+		req.AggFunc = "count"
+		counts, err := d.coordinateGroups(req)
+		if err != nil {
+			return nil, err
+		}
+		for group, sum := range sums {
+			if counts[group] > 0 {
+				sums[group] = sum / counts[group]
+			}
+		}
+		return sums, nil
+	}
+
+	responses, err := d.fanOut(req)
+	if err != nil {
+		return nil, err
+	}
+	field := "groups"
+	if req.Action == "query" {
+		field = "data"
+	}
+
+	merged := make(map[string]float64)
+	for i, resp := range responses {
+		var groups map[string]float64
+		if raw := resp[field]; raw != nil && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &groups); err != nil {
+				return nil, fmt.Errorf("shard %d (%s): invalid groups: %w", i, d.shards[i], err)
+			}
+		}
+		for group, v := range groups {
+			cur, seen := merged[group]
+			switch {
+			case !seen:
+				merged[group] = v
+			case req.AggFunc == "count" || req.AggFunc == "sum":
+				merged[group] = cur + v
+			case req.AggFunc == "min":
+				merged[group] = min(cur, v)
+			case req.AggFunc == "max":
+				merged[group] = max(cur, v)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// coordinateStatus reports the coordinator and the status of every shard.
+func (d *UDSDaemon) coordinateStatus(req DaemonRequest) []byte {
+	responses, err := d.fanOut(req)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	var rows int64
+	shards := make([]interface{}, len(responses))
+	for i, resp := range responses {
+		var n int64
+		_ = json.Unmarshal(resp["rows"], &n)
+		rows += n
+		shards[i] = map[string]interface{}{
+			"shard":   i,
+			"address": d.shards[i].String(),
+			"csv":     resp["csv"],
+			"rows":    n,
+		}
+	}
+	requests, uptime := d.metrics.snapshot()
+	return d.successResponse(map[string]interface{}{
+		"status":      "running",
+		"mode":        "coordinator",
+		"dataset":     d.config.Dataset,
+		"rows":        rows,
+		"shards":      shards,
+		"network":     d.config.Network,
+		"address":     d.config.Address,
+		"connections": len(d.sem),
+		"maxWorkers":  cap(d.sem),
+		"uptimeSec":   uptime,
+		"requests":    requests,
+	})
+}
+
+// writeShardStatus lists the workers in a SIGUSR1 status dump.
+func (d *UDSDaemon) writeShardStatus(w io.Writer) {
+	names := make([]string, len(d.shards))
+	for i, shard := range d.shards {
+		names[i] = fmt.Sprintf("%d=%s (%d idle)", i, shard, len(shard.idle))
+	}
+	fmt.Fprintf(w, "  Shards:      %s\n", strings.Join(names, ", "))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/indexer"
+)
+
+// newWorker starts a worker daemon over data, indexed on city, on a TCP
+// port, and returns its shard address.
+func newWorker(t *testing.T, data string) string {
+	t.Helper()
+	d := newTestDaemon(t, data)
+	err := indexer.NewIndexer(indexer.IndexerConfig{
+		InputFile: d.config.CsvPath, OutputDir: d.config.IndexDir, Columns: `["city"]`,
+		Workers: 1, MemoryMB: 16, BloomFPRate: 0.01, Output: io.Discard,
+	}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "tcp:" + listenTCP(t, d)
+}
+
+// newCoordinator returns a coordinator of the shards at addrs.
+func newCoordinator(t *testing.T, addrs ...string) *UDSDaemon {
+	t.Helper()
+	d := NewUDSDaemon(DaemonConfig{Shards: addrs})
+	if err := d.initShards(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Shutdown)
+	return d
+}
+
+func TestCoordinator(t *testing.T) {
+	const shard0 = "id,name,city\n1,ann,Paris\n3,cy,Paris\n4,dee,Rome\n"
+	const shard1 = "id,name,city\n10,jo,Paris\n20,kim,Oslo\n"
+	d := newCoordinator(t, newWorker(t, shard0), newWorker(t, shard1))
+
+	if resp := request(t, d, `{"action":"count","where":{"city":"Paris"}}`); resp["count"] != 3.0 {
+		t.Errorf("count: %v, want 3", resp)
+	}
+
+	// Groups of the first column, merged; avg from the shards' sums and
+	// counts: Paris is (1+3+10)/3, not the average of 2 and 10
+	for _, tc := range []struct {
+		fn   string
+		want map[string]interface{}
+	}{
+		{"count", map[string]interface{}{"Paris": 3.0, "Rome": 1.0, "Oslo": 1.0}},
+		{"sum", map[string]interface{}{"Paris": 14.0, "Rome": 4.0, "Oslo": 20.0}},
+		{"avg", map[string]interface{}{"Paris": 14.0 / 3, "Rome": 4.0, "Oslo": 20.0}},
+		{"min", map[string]interface{}{"Paris": 1.0, "Rome": 4.0, "Oslo": 20.0}},
+		{"max", map[string]interface{}{"Paris": 10.0, "Rome": 4.0, "Oslo": 20.0}},
+	} {
+		resp := request(t, d, `{"action":"groupby","groupBy":"city","aggFunc":"`+tc.fn+`"}`)
+		if !reflect.DeepEqual(resp["groups"], tc.want) {
+			t.Errorf("%s: %v, want groups %v", tc.fn, resp, tc.want)
+		}
+	}
+
+	// Rows in shard order, tagged with their shard; offset and limit apply
+	// to all of them
+	for _, tc := range []struct {
+		name string
+		page string
+		want []string // shard:offset
+	}{
+		{"all", "", []string{"0:13", "0:25", "1:13"}},
+		{"page", `,"offset":1,"limit":1`, []string{"0:25"}},
+		{"across shards", `,"offset":2,"limit":5`, []string{"1:13"}},
+	} {
+		resp := request(t, d, `{"action":"select","where":{"city":"Paris"}`+tc.page+`}`)
+		rows, ok := resp["rows"].([]interface{})
+		if !ok {
+			t.Errorf("%s: %v", tc.name, resp)
+			continue
+		}
+		var got []string
+		for _, r := range rows {
+			row := r.(map[string]interface{})
+			got = append(got, fmt.Sprintf("%v:%v", row["shard"], row["offset"]))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: rows %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCoordinatorShardDown(t *testing.T) {
+	// An address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "tcp:" + listener.Addr().String()
+	_ = listener.Close()
+
+	d := newCoordinator(t, newWorker(t, testCSV), down)
+	for _, req := range []string{
+		`{"action":"count","where":{"city":"Rome"}}`,
+		`{"action":"groupby","groupBy":"city","aggFunc":"avg"}`,
+		`{"action":"select","where":{"city":"Rome"}}`,
+	} {
+		resp := request(t, d, req)
+		msg, _ := resp["error"].(string)
+		if !strings.Contains(msg, "shard 1 ("+down+")") {
+			t.Errorf("%s: %v, want the error of shard 1", req, resp)
+		}
+		if resp["count"] != nil || resp["groups"] != nil || resp["rows"] != nil {
+			t.Errorf("%s: partial result %v", req, resp)
+		}
+	}
+}
@@ -4,39 +4,127 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
 	"github.com/entreya/csvquery/internal/query"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/status"
+	"github.com/entreya/csvquery/internal/storage"
 )
 
 // DaemonConfig holds configuration for the Unix socket daemon.
 type DaemonConfig struct {
 	Network        string // "unix" or "tcp"
-	Address        string // Socket path or "host:port"
+	Address        string // Socket path ("@name" = abstract, Linux only) or "host:port"
 	CsvPath        string
 	IndexDir       string
 	MaxConcurrency int
+	LookupWorkers  int // Index lookups running at once (0 = MaxConcurrency; see slots.go)
+	ScanWorkers    int // Full scans running at once (0 = DefaultScanWorkers)
 	IdleTimeout    time.Duration
+	CapturePath    string // Record requests for later replay (empty = off)
+	CaptureRaw     bool   // Record their values verbatim instead of hashes (see capture.go)
+	Dataset        string // Manifest dataset served, for the request log
+
+	// LogPath is the request log: JSON lines, "-" = stderr ("" = off, but
+	// slow queries still go to stderr when SlowQuery is set; see reqlog.go)
+	LogPath   string
+	SlowQuery time.Duration // Log requests slower than this with their plan (0 = off)
+
+	RequireIndex     bool          // Reject queries that would fall back to a full scan
+	MaxFullScanBytes int64         // Reject full scans of CSVs larger than this (0 = no limit)
+	MaxQueryCost     int64         // Reject queries expected to read more bytes than this (0 = no limit; see slots.go)
+	CostBudget       int64         // Bytes running queries may be expected to read together (0 = no limit)
+	QueryTimeout     time.Duration // Abort requests running longer than this (0 = no limit)
+	BlockCacheMB     int           // Memory for decoded index blocks shared by requests (0 = no cache)
+	DrainTimeout     time.Duration // On shutdown, cancel requests still running after this (0 = wait for them)
+	UpdatesLog       bool          // Keep row updates in the binary update log (see updatemgr/log.go)
+
+	// Shards makes the daemon a coordinator over these worker daemons
+	// ("unix:/path", "tcp:host:port" or "tls:host:port"; see coordinator.go)
+	Shards []string
+
+	// AuthToken is the token TCP clients must authenticate with ("" = none;
+	// see auth.go). A coordinator authenticates to TCP workers with it too.
+	AuthToken string
+	TLSCert   string // Serve TCP over TLS with this certificate and key
+	TLSKey    string
+	TLSCA     string // CA that tls: shard workers are verified against (default: system roots)
+
+	// Access to the Unix socket (see socket.go): its mode, and the user
+	// and group that own it, by name or id (zero values = as created)
+	SocketMode  os.FileMode
+	SocketOwner string
+	SocketGroup string
+
+	// HTTPAddr also serves requests over HTTP and WebSocket on this
+	// "host:port" ("" = off; see http.go)
+	HTTPAddr string
+	// AllowedOrigins are the origins of the web pages that may open /ws
+	// besides the daemon's own ("*" = any; see originAllowed)
+	AllowedOrigins []string
+
+	SpoolDir string // Directory of the files of spooled selects ("" = system temp dir; see spool.go)
 }
 
+// DefaultBlockCacheMB is the default memory for decoded index blocks, kept
+// between requests so queries over the hot part of an index skip reading
+// and decompressing it again.
+const DefaultBlockCacheMB = 256
+
+// maxIdleHandles is how many files no request is reading stay open.
+const maxIdleHandles = 64
+
 // UDSDaemon represents the Unix Domain Socket server.
 type UDSDaemon struct {
 	config   DaemonConfig
 	listener net.Listener
 	sem      chan struct{}
+	sched    *scheduler // Execution slots and cost budget (see slots.go)
+	spools   *spoolSet  // Results of spooled selects (see spool.go)
 	shutdown chan struct{}
 	wg       sync.WaitGroup
-
-	// In-memory data (loaded on startup)
+	recorder *Recorder
+	conns    map[net.Conn]struct{} // Open connections (see drain.go)
+	connMu   sync.Mutex
+	ctx      context.Context // Canceled when draining runs out of time
+	cancel   context.CancelCauseFunc
+	reqLog   *requestLog // Request and slow-query log (nil = off)
+	metrics  *requestMetrics
+	usage    *query.UsageTracker
+	cache    *common.BlockCache // Decoded index blocks (nil = off)
+	handles  *common.HandlePool // Indexes, CSVs and bloom filters kept open between requests
+	stopOnce sync.Once
+	shards   []*shardClient // Coordinator mode
+	writeMu  sync.Mutex     // Serializes write actions and builds (see write.go)
+	indexMu  sync.RWMutex   // Held by queries; builds publish under it (see reindex.go)
+
+	tlsServer *tls.Config // TLS listener (nil = plain)
+	tlsClient *tls.Config // Connections to tls: shards
+
+	httpServer *http.Server // HTTP mode (nil = off)
+
+	// In-memory data (loaded on startup, reloaded after writes)
+	dataMu    sync.RWMutex
 	csvData   []byte
 	headers   []string
 	headerMap map[string]int
@@ -48,6 +136,12 @@ func NewUDSDaemon(cfg DaemonConfig) *UDSDaemon {
 	if cfg.MaxConcurrency <= 0 {
 		cfg.MaxConcurrency = 50
 	}
+	if cfg.LookupWorkers <= 0 {
+		cfg.LookupWorkers = cfg.MaxConcurrency
+	}
+	if cfg.ScanWorkers <= 0 {
+		cfg.ScanWorkers = DefaultScanWorkers
+	}
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 30 * time.Second
 	}
@@ -66,17 +160,30 @@ func NewUDSDaemon(cfg DaemonConfig) *UDSDaemon {
 		}
 	}
 
+	ctx, cancel := context.WithCancelCause(context.Background())
 	return &UDSDaemon{
 		config:   cfg,
 		sem:      make(chan struct{}, cfg.MaxConcurrency),
+		sched:    newScheduler(cfg.LookupWorkers, cfg.ScanWorkers, cfg.CostBudget),
+		spools:   newSpoolSet(cfg.SpoolDir),
 		shutdown: make(chan struct{}),
+		usage:    query.NewUsageTracker(),
+		cache:    common.NewBlockCache(int64(cfg.BlockCacheMB) << 20),
+		handles:  common.NewHandlePool(maxIdleHandles),
+		conns:    make(map[net.Conn]struct{}),
+		metrics:  newRequestMetrics(),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
+// usageFlushInterval is how often index hit counts are written to disk.
+const usageFlushInterval = 30 * time.Second
+
 // Start initializes the daemon: loads CSV, builds indexes, starts listening.
 func (d *UDSDaemon) Start() error {
 	// 1. Remove stale socket file if exists (only for unix)
-	if d.config.Network == "unix" {
+	if d.config.Network == "unix" && !abstractSocket(d.config.Address) {
 		if _, err := os.Stat(d.config.Address); err == nil {
 			if err := os.Remove(d.config.Address); err != nil {
 				return fmt.Errorf("failed to remove stale socket: %w", err)
@@ -86,17 +193,54 @@ func (d *UDSDaemon) Start() error {
 
 	// 2. Load CSV into memory
 	if d.config.CsvPath != "" {
+		if _, err := os.Stat(d.config.CsvPath); os.IsNotExist(err) {
+			return fmt.Errorf("CSV file not found: %s", d.config.CsvPath)
+		}
 		if err := d.loadCSV(); err != nil {
 			return fmt.Errorf("failed to load CSV: %w", err)
 		}
 	}
 
+	if err := d.initTLS(); err != nil {
+		return err
+	}
+	if err := d.initShards(); err != nil {
+		return err
+	}
+
+	// Open the logs before accepting traffic
+	reqLog, err := newRequestLog(d.config.LogPath, d.config.SlowQuery, d.config.Dataset)
+	if err != nil {
+		return fmt.Errorf("failed to open request log: %w", err)
+	}
+	d.reqLog = reqLog
+	if d.config.CapturePath != "" {
+		rec, err := NewRecorder(d.config.CapturePath, d.config.CaptureRaw)
+		if err != nil {
+			return err
+		}
+		d.recorder = rec
+	}
+
 	// 3. Create listener
-	listener, err := net.Listen(d.config.Network, d.config.Address)
+	var listener net.Listener
+	if d.config.Network == "unix" {
+		listener, err = d.listenUnix()
+	} else if d.config.SocketMode != 0 || d.config.SocketOwner != "" || d.config.SocketGroup != "" {
+		err = fmt.Errorf("socket mode, owner and group apply to Unix sockets only")
+	} else {
+		listener, err = net.Listen(d.config.Network, d.config.Address)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to bind %s %s: %w", d.config.Network, d.config.Address, err)
 	}
 	d.listener = listener
+	if d.config.HTTPAddr != "" {
+		if err := d.startHTTP(); err != nil {
+			_ = listener.Close()
+			return err
+		}
+	}
 
 	// 4. Setup signal handler for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -106,15 +250,33 @@ func (d *UDSDaemon) Start() error {
 		d.Shutdown()
 	}()
 
+	go d.flushUsageLoop()
+	status.Register("Daemon", d.writeStatus)
+
 	fmt.Printf("CsvQuery Daemon started on %s (%s)\n", d.config.Network, d.config.Address)
 	if d.config.CsvPath != "" {
 		fmt.Printf("  CSV: %s (%d rows, %d columns)\n", d.config.CsvPath, d.countRows(), len(d.headers))
 	}
+	for i, shard := range d.shards {
+		fmt.Printf("  Shard %d: %s\n", i, shard)
+	}
+	if d.config.HTTPAddr != "" {
+		fmt.Printf("  HTTP: %s (/request, /ws)\n", d.config.HTTPAddr)
+	}
+	if d.tlsServer != nil {
+		fmt.Println("  TLS: on")
+	}
+	if d.requireAuth() || (d.config.HTTPAddr != "" && d.config.AuthToken != "") {
+		fmt.Println("  Auth: token required")
+	} else if d.config.Network == "tcp" || d.config.HTTPAddr != "" {
+		fmt.Fprintln(os.Stderr, "Warning: TCP listener without an auth token: anyone who can reach it can query")
+	}
 
 	// 5. Accept connections
 	for {
 		select {
 		case <-d.shutdown:
+			d.Shutdown() // Wait for the in-progress shutdown to finish
 			return nil
 		default:
 		}
@@ -136,6 +298,7 @@ func (d *UDSDaemon) Start() error {
 			}
 			select {
 			case <-d.shutdown:
+				d.Shutdown() // Wait for the in-progress shutdown to finish
 				return nil
 			default:
 				fmt.Fprintf(os.Stderr, "Accept error: %v\n", err)
@@ -148,22 +311,46 @@ func (d *UDSDaemon) Start() error {
 			_ = tcpConn.SetKeepAlive(true)
 			_ = tcpConn.SetKeepAlivePeriod(30 * time.Second)
 		}
+		if d.tlsServer != nil && d.config.Network == "tcp" {
+			conn = tls.Server(conn, d.tlsServer)
+		}
 
 		d.wg.Add(1)
 		go d.handleConnection(conn)
 	}
 }
 
-// Shutdown gracefully stops the daemon.
+// Shutdown gracefully stops the daemon. Safe to call more than once;
+// later calls wait for the first to finish.
 func (d *UDSDaemon) Shutdown() {
+	d.stopOnce.Do(d.shutdownOnce)
+}
+
+func (d *UDSDaemon) shutdownOnce() {
 	close(d.shutdown)
 	if d.listener != nil {
 		_ = d.listener.Close()
 	}
-	d.wg.Wait()
+	d.stopHTTP()
+	d.drain()
+
+	if d.recorder != nil {
+		_ = d.recorder.Close()
+	}
+	if d.reqLog != nil {
+		d.reqLog.close()
+	}
+	for _, shard := range d.shards {
+		shard.close()
+	}
+	if err := d.usage.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save index usage: %v\n", err)
+	}
+	d.handles.Close()
+	d.spools.closeAll()
 
 	// Cleanup socket file (only for unix)
-	if d.config.Network == "unix" {
+	if d.config.Network == "unix" && !abstractSocket(d.config.Address) {
 		_ = os.Remove(d.config.Address)
 	}
 	fmt.Println("Daemon shutdown complete")
@@ -171,6 +358,9 @@ func (d *UDSDaemon) Shutdown() {
 
 // loadCSV loads the CSV file into memory and parses headers.
 func (d *UDSDaemon) loadCSV() error {
+	if format, err := indexer.InputFormat(d.config.CsvPath); err == nil && format != "" {
+		return fmt.Errorf("%s is in %s format; the daemon serves CSV files (query it with the query command)", d.config.CsvPath, format)
+	}
 	f, err := os.Open(d.config.CsvPath)
 	if err != nil {
 		return err
@@ -182,8 +372,8 @@ func (d *UDSDaemon) loadCSV() error {
 		return err
 	}
 
-	// Find separator (default comma)
-	d.separator = ','
+	sample := data[:min(len(data), common.SniffBytes)]
+	sep := common.SniffDialect(sample, len(sample) < len(data)).Separator
 
 	// Parse headers
 	nlIdx := bytes.IndexByte(data, '\n')
@@ -194,18 +384,25 @@ func (d *UDSDaemon) loadCSV() error {
 	headerLine := string(data[:nlIdx])
 	headerLine = strings.TrimSuffix(headerLine, "\r")
 
-	d.headers = strings.Split(headerLine, string(d.separator))
-	d.headerMap = make(map[string]int, len(d.headers))
-	for i, h := range d.headers {
-		d.headerMap[strings.ToLower(strings.TrimSpace(h))] = i
+	headers := strings.Split(headerLine, string(sep))
+	headerMap := make(map[string]int, len(headers))
+	for i, h := range headers {
+		headerMap[strings.ToLower(strings.TrimSpace(h))] = i
 	}
 
-	d.csvData = data
+	d.dataMu.Lock()
+	defer d.dataMu.Unlock()
+	if d.csvData != nil {
+		_ = common.MunmapFile(d.csvData)
+	}
+	d.csvData, d.headers, d.headerMap, d.separator = data, headers, headerMap, sep
 	return nil
 }
 
 // countRows returns the number of data rows (excluding header).
 func (d *UDSDaemon) countRows() int {
+	d.dataMu.RLock()
+	defer d.dataMu.RUnlock()
 	if d.csvData == nil {
 		return 0
 	}
@@ -222,6 +419,8 @@ func (d *UDSDaemon) countRows() int {
 func (d *UDSDaemon) handleConnection(conn net.Conn) {
 	defer d.wg.Done()
 	defer func() { _ = conn.Close() }()
+	d.trackConn(conn, true)
+	defer d.trackConn(conn, false)
 
 	// Acquire worker slot
 	select {
@@ -232,6 +431,10 @@ func (d *UDSDaemon) handleConnection(conn net.Conn) {
 	}
 
 	reader := bufio.NewReader(conn)
+	if d.requireAuth() && !d.authenticate(conn, reader) {
+		return
+	}
+	open := d.config.Network == "tcp" && d.config.AuthToken == ""
 
 	for {
 		select {
@@ -240,21 +443,43 @@ func (d *UDSDaemon) handleConnection(conn net.Conn) {
 		default:
 		}
 
-		// Set idle timeout
+		// Set idle timeout. Shutdown cuts it short after closing d.shutdown,
+		// so check again in case it did so before this
 		_ = conn.SetReadDeadline(time.Now().Add(d.config.IdleTimeout))
+		if d.shuttingDown() {
+			return
+		}
 
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
-			return // EOF or timeout
+			return // EOF, timeout or shutdown
 		}
 
 		line = bytes.TrimSpace(line)
 		if len(line) == 0 {
 			continue
 		}
+		if d.shuttingDown() {
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write(append(d.errorFor(errShuttingDown), '\n'))
+			return
+		}
 
-		// Process request
-		response := d.processRequest(line)
+		var response []byte
+		if line[0] == '[' {
+			response = d.serveBatch(line, open)
+		} else {
+			response = d.serve(line, open, func(event string, fields map[string]interface{}) error {
+				fields["event"] = event
+				b, err := json.Marshal(fields)
+				if err != nil {
+					return err
+				}
+				_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				_, err = conn.Write(append(b, '\n'))
+				return err
+			})
+		}
 
 		// Write response
 		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
@@ -263,31 +488,140 @@ func (d *UDSDaemon) handleConnection(conn net.Conn) {
 	}
 }
 
+// serve answers one request line, recording and logging it. Requests that
+// ask for progress send it as events (nil = they cannot). open tells that
+// the line came over a network listener without an auth token.
+func (d *UDSDaemon) serve(line []byte, open bool, events func(event string, fields map[string]interface{}) error) []byte {
+	start := time.Now()
+	trace := &requestTrace{open: open}
+	response := d.processRequest(line, trace, events)
+	elapsed := time.Since(start)
+	d.metrics.record(trace.action, response, elapsed)
+	if d.recorder != nil {
+		d.recorder.Record(line, response, elapsed)
+	}
+	if d.reqLog != nil && trace.action != "auth" {
+		d.reqLog.log(trace, line, response, elapsed, func() json.RawMessage { return d.explainPlan(line) })
+	}
+	return response
+}
+
 // Request represents incoming JSON request.
 type DaemonRequest struct {
-	Action  string            `json:"action"`
-	Csv     string            `json:"csv,omitempty"`
-	Where   map[string]string `json:"where,omitempty"`
-	Column  string            `json:"column,omitempty"`
-	AggFunc string            `json:"aggFunc,omitempty"`
-	Limit   int               `json:"limit,omitempty"`
-	Offset  int               `json:"offset,omitempty"`
-	GroupBy string            `json:"groupBy,omitempty"`
-	Verbose bool              `json:"verbose,omitempty"`
-	Explain bool              `json:"explain,omitempty"`
-}
-
-// processRequest handles a single JSON request.
-func (d *UDSDaemon) processRequest(data []byte) []byte {
+	Action   string            `json:"action"`
+	Csv      string            `json:"csv,omitempty"`
+	Where    map[string]string `json:"where,omitempty"`
+	Column   string            `json:"column,omitempty"`
+	AggFunc  string            `json:"aggFunc,omitempty"`
+	Limit    int               `json:"limit,omitempty"`
+	Offset   int               `json:"offset,omitempty"`
+	Cursor   string            `json:"cursor,omitempty"`  // select, query: continue after a previous page (its "cursor")
+	OrderBy  string            `json:"orderBy,omitempty"` // select, query: "key" or an indexed column, then "asc" or "desc"
+	GroupBy  string            `json:"groupBy,omitempty"`
+	AggSort  string            `json:"aggSort,omitempty"`  // groupby, query: "key" or "value", then "asc" or "desc": groups as an ordered array
+	AggLimit int               `json:"aggLimit,omitempty"` // groupby, query: groups kept after aggSort
+	Pivot    string            `json:"pivot,omitempty"`    // groupby: column whose values become the columns of each group
+	Verbose  bool              `json:"verbose,omitempty"`
+	Explain  bool              `json:"explain,omitempty"`
+	Timeout  int               `json:"timeoutMs,omitempty"` // Milliseconds; can only lower the daemon's limit
+	Deadline int64             `json:"deadline,omitempty"`  // Unix milliseconds: fail unstarted, abort running work past it
+	Priority string            `json:"priority,omitempty"`  // "high", "normal" (default) or "low": order among queued queries (see slots.go)
+	Format   string            `json:"format,omitempty"`    // keyset: "keys" or "bloom"
+	InSet    string            `json:"inSet,omitempty"`     // Base64 key set: only rows whose column is in it
+
+	Progress bool `json:"progress,omitempty"` // Send "progress" events while the query scans (connections and WebSocket)
+
+	// Write actions
+	Headers []string          `json:"headers,omitempty"` // write: header of a new CSV (checked against an existing one)
+	Rows    [][]string        `json:"rows,omitempty"`    // write: rows to append
+	Set     map[string]string `json:"set,omitempty"`     // update: column values to set
+	Reindex bool              `json:"reindex,omitempty"` // write: update the indexes before responding
+	Deltas  bool              `json:"deltas,omitempty"`  // write: add the rows to the index deltas before responding
+	DryRun  bool              `json:"dryRun,omitempty"`  // write, update, delete: check and count, change nothing
+
+	Columns json.RawMessage `json:"columns,omitempty"` // reindex: `index --columns` array (default: the current indexes)
+
+	Token string `json:"token,omitempty"` // auth: the daemon's token
+
+	Spool    bool   `json:"spool,omitempty"`    // select: write the rows to a spool file, read with page (see spool.go)
+	Ranges   bool   `json:"ranges,omitempty"`   // select: answer with the byte ranges of the rows (see ranges.go)
+	PageSize int    `json:"pageSize,omitempty"` // select with spool: rows per page
+	SpoolID  string `json:"spoolId,omitempty"`  // page: the spool ("spool" of the select)
+	Page     int    `json:"page,omitempty"`     // page: the page, from 0
+	Close    bool   `json:"close,omitempty"`    // page: remove the spool
+
+	Offsets []int64 `json:"offsets,omitempty"` // fetch: byte offsets of the rows (as select returns them)
+	Shard   *int    `json:"shard,omitempty"`   // fetch from a coordinator: the shard the offsets are from
+
+	trace      *requestTrace        // For the request log (nil = not logged)
+	onProgress func(query.Progress) // Receives the scan progress (nil = not sent)
+	priority   int                  // Parsed Priority
+}
+
+// processRequest handles a single JSON request, noting what it did in
+// trace (if not nil) and sending progress events with events (if not nil).
+func (d *UDSDaemon) processRequest(data []byte, trace *requestTrace, events func(string, map[string]interface{}) error) []byte {
 	var req DaemonRequest
 	if err := json.Unmarshal(data, &req); err != nil {
 		return d.errorResponse("invalid JSON: " + err.Error())
 	}
+	if trace != nil {
+		trace.action, trace.csv = req.Action, req.Csv
+		req.trace = trace
+	}
+	if req.Progress && events != nil {
+		req.onProgress = progressSender(events)
+	}
+
+	activity := status.Begin("request", "action="+req.Action)
+	defer activity.End()
+
+	if req.Action == "auth" {
+		// The connection is authenticated already, or needs no token
+		return d.successResponse(map[string]interface{}{"authenticated": true})
+	}
+	var err error
+	if req.priority, err = parsePriority(req.Priority); err != nil {
+		return d.errorResponse(err.Error())
+	}
+	if err := applyDeadline(&req); err != nil {
+		return d.errorFor(err)
+	}
+	if d.shards != nil {
+		return d.coordinate(req)
+	}
+
+	// Write actions lock for themselves
+	switch req.Action {
+	case "write", "update", "delete", "reindex":
+		if trace != nil && trace.open {
+			return d.errorFor(fmt.Errorf("%w: %s needs an auth token on TCP and HTTP listeners (daemon --auth-token-file)", errForbidden, req.Action))
+		}
+	}
+	switch req.Action {
+	case "write":
+		return d.handleWrite(req)
+
+	case "update":
+		return d.handleUpdate(req)
+
+	case "delete":
+		return d.handleDelete(req)
+
+	case "reindex":
+		return d.handleReindex(req)
+	}
+
+	d.indexMu.RLock()
+	defer d.indexMu.RUnlock()
 
 	switch req.Action {
 	case "ping":
 		return d.successResponse(map[string]interface{}{"pong": true})
 
+	case "health":
+		return d.successResponse(d.checkHealth())
+
 	case "count":
 		return d.handleCount(req)
 
@@ -308,6 +642,18 @@ func (d *UDSDaemon) processRequest(data []byte) []byte {
 	case "status":
 		return d.handleStatus()
 
+	case "indexes":
+		return d.handleIndexes(req)
+
+	case "keyset":
+		return d.handleKeySet(req)
+
+	case "fetch":
+		return d.handleFetch(req)
+
+	case "page":
+		return d.handlePage(req)
+
 	default:
 		return d.errorResponse("unknown action: " + req.Action)
 	}
@@ -323,7 +669,7 @@ func (d *UDSDaemon) handleCount(req DaemonRequest) []byte {
 	// Use existing query engine
 	cond, err := d.parseWhere(req.Where)
 	if err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
 
 	cfg := query.QueryConfig{
@@ -334,18 +680,24 @@ func (d *UDSDaemon) handleCount(req DaemonRequest) []byte {
 		Verbose:   req.Verbose,
 	}
 
-	var outBuf bytes.Buffer
+	d.applyLimits(&cfg, req)
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+
+	var result query.Result
 	engine := query.NewQueryEngine(cfg)
-	engine.Writer = &outBuf
+	engine.Result = &result
 
 	if err := engine.Run(); err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
 
-	countStr := strings.TrimSpace(outBuf.String())
-	var count int
-	_, _ = fmt.Sscanf(countStr, "%d", &count)
-
+	var count int64
+	if result.Count != nil {
+		count = result.Count.Count
+	}
 	return d.successResponse(map[string]interface{}{"count": count})
 }
 
@@ -358,7 +710,7 @@ func (d *UDSDaemon) handleSelect(req DaemonRequest) []byte {
 
 	cond, err := d.parseWhere(req.Where)
 	if err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
 
 	cfg := query.QueryConfig{
@@ -367,39 +719,34 @@ func (d *UDSDaemon) handleSelect(req DaemonRequest) []byte {
 		Where:    cond,
 		Limit:    req.Limit,
 		Offset:   req.Offset,
+		Cursor:   req.Cursor,
+		OrderBy:  req.OrderBy,
 		Verbose:  req.Verbose,
 	}
 
-	var outBuf bytes.Buffer
-	engine := query.NewQueryEngine(cfg)
-	engine.Writer = &outBuf
-
-	if err := engine.Run(); err != nil {
-		return d.errorResponse(err.Error())
+	d.applyLimits(&cfg, req)
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+	switch {
+	case req.Spool && req.Ranges:
+		return d.errorResponse("spool and ranges do not combine")
+	case req.Spool:
+		return d.spoolSelect(req, cfg)
+	case req.Ranges:
+		return d.rangeSelect(req, cfg)
 	}
 
-	// Parse the output (newline-separated offset,line pairs)
-	result := strings.TrimSpace(outBuf.String())
-	lines := strings.Split(result, "\n")
+	result := query.Result{Rows: []query.RowRef{}}
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &result
 
-	offsets := make([]map[string]interface{}, 0, len(lines))
-	for _, line := range lines {
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, ",")
-		if len(parts) >= 2 {
-			var offset, lineNum int
-			_, _ = fmt.Sscanf(parts[0], "%d", &offset)
-			_, _ = fmt.Sscanf(parts[1], "%d", &lineNum)
-			offsets = append(offsets, map[string]interface{}{
-				"offset": offset,
-				"line":   lineNum,
-			})
-		}
+	if err := engine.Run(); err != nil {
+		return d.errorFor(err)
 	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
 
-	return d.successResponse(map[string]interface{}{"rows": offsets})
+	return d.successResponse(map[string]interface{}{"rows": result.Rows, "cursor": nextCursor(engine)})
 }
 
 // handleGroupBy returns grouped aggregation results.
@@ -411,7 +758,7 @@ func (d *UDSDaemon) handleGroupBy(req DaemonRequest) []byte {
 
 	cond, err := d.parseWhere(req.Where)
 	if err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
 
 	groupCol := req.GroupBy
@@ -430,24 +777,33 @@ func (d *UDSDaemon) handleGroupBy(req DaemonRequest) []byte {
 		Where:    cond,
 		GroupBy:  groupCol,
 		AggFunc:  aggFunc,
+		AggSort:  req.AggSort,
+		AggLimit: req.AggLimit,
+		Pivot:    req.Pivot,
 		Verbose:  req.Verbose,
 	}
 
-	var outBuf bytes.Buffer
+	d.applyLimits(&cfg, req)
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+
+	var result query.Result
 	engine := query.NewQueryEngine(cfg)
-	engine.Writer = &outBuf
+	engine.Result = &result
 
 	if err := engine.Run(); err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
 
-	// Parse JSON output from engine
-	var groups map[string]interface{}
-	if err := json.Unmarshal([]byte(strings.TrimSpace(outBuf.String())), &groups); err != nil {
-		return d.errorResponse("failed to parse groupby result: " + err.Error())
+	switch {
+	case result.Pivot != nil:
+		return d.successResponse(map[string]interface{}{"pivot": result.Pivot})
+	case result.Ranked != nil:
+		return d.successResponse(map[string]interface{}{"groups": result.Ranked})
 	}
-
-	return d.successResponse(map[string]interface{}{"groups": groups})
+	return d.successResponse(map[string]interface{}{"groups": result.Groups})
 }
 
 // handleQuery handles generic queries (agg, explain, or offsets).
@@ -459,7 +815,7 @@ func (d *UDSDaemon) handleQuery(req DaemonRequest) []byte {
 
 	cond, err := d.parseWhere(req.Where)
 	if err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
 	}
 
 	cfg := query.QueryConfig{
@@ -468,50 +824,278 @@ func (d *UDSDaemon) handleQuery(req DaemonRequest) []byte {
 		Where:     cond,
 		Limit:     req.Limit,
 		Offset:    req.Offset,
+		Cursor:    req.Cursor,
+		OrderBy:   req.OrderBy,
 		CountOnly: false,
 		Explain:   req.Explain,
 		GroupBy:   req.GroupBy,
 		AggFunc:   req.AggFunc,
+		AggSort:   req.AggSort,
+		AggLimit:  req.AggLimit,
 		Verbose:   req.Verbose,
 	}
 
-	var outBuf bytes.Buffer
+	d.applyLimits(&cfg, req)
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+
+	var result query.Result
 	engine := query.NewQueryEngine(cfg)
-	engine.Writer = &outBuf
+	engine.Result = &result
 
 	if err := engine.Run(); err != nil {
-		return d.errorResponse(err.Error())
+		return d.errorFor(err)
+	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+
+	switch {
+	case result.Plan != nil:
+		return d.successResponse(map[string]interface{}{"data": result.Plan})
+	case result.Ranked != nil:
+		return d.successResponse(map[string]interface{}{"data": result.Ranked})
+	case result.Groups != nil:
+		return d.successResponse(map[string]interface{}{"data": result.Groups})
 	}
 
-	output := strings.TrimSpace(outBuf.String())
-
-	// If it's JSON output (Agg or Explain), return as is (wrapped if needed)
-	if strings.HasPrefix(output, "{") || strings.HasPrefix(output, "[") {
-		// It's JSON from the engine.
-		// We can return it directly as the "data" field or similar.
-		var jsonData interface{}
-		if err := json.Unmarshal([]byte(output), &jsonData); err == nil {
-			return d.successResponse(map[string]interface{}{"data": jsonData})
+	// Rows as the CLI prints them, "offset,line" per line (select returns them as objects)
+	var output []byte
+	for i, row := range result.Rows {
+		if i > 0 {
+			output = append(output, '\n')
 		}
+		output = strconv.AppendInt(output, row.Offset, 10)
+		output = append(output, ',')
+		output = strconv.AppendInt(output, row.Line, 10)
 	}
+	return d.successResponse(map[string]interface{}{"output": string(output), "cursor": nextCursor(engine)})
+}
 
-	// Fallback to text (e.g. for simple selects, though select action is preferred)
-	return d.successResponse(map[string]interface{}{"output": output})
+// nextCursor is the "cursor" of a row response: the page after it, or nil
+// when there are no more rows.
+func nextCursor(engine *query.QueryEngine) interface{} {
+	if engine.NextCursor == "" {
+		return nil
+	}
+	return engine.NextCursor
+}
+
+// handleKeySet exports the distinct keys of an indexed column as a base64
+// key set, which another daemon accepts as "inSet" (or the CLI as
+// --where-in-set once decoded to a file).
+func (d *UDSDaemon) handleKeySet(req DaemonRequest) []byte {
+	csvPath := req.Csv
+	if csvPath == "" {
+		csvPath = d.config.CsvPath
+	}
+	if req.Column == "" {
+		return d.errorResponse("column is required")
+	}
+	format := req.Format
+	if format == "" {
+		format = query.KeySetKeys
+	}
+
+	var outBuf bytes.Buffer
+	engine := query.NewQueryEngine(query.QueryConfig{
+		CsvPath:  csvPath,
+		IndexDir: d.config.IndexDir,
+	})
+	engine.Writer = &outBuf
+
+	header, err := engine.ExportKeySet(req.Column, format, 0)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	d.recordRun(req, csvPath, d.config.IndexDir, engine)
+
+	return d.successResponse(map[string]interface{}{
+		"column": header.Column,
+		"kind":   header.Kind,
+		"count":  header.Count,
+		"keyset": base64.StdEncoding.EncodeToString(outBuf.Bytes()),
+	})
+}
+
+// applyKeySet decodes a request's key set for a semi-join.
+func (d *UDSDaemon) applyKeySet(cfg *query.QueryConfig, req DaemonRequest) error {
+	if req.InSet == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(req.InSet)
+	if err != nil {
+		return fmt.Errorf("invalid inSet: %w", err)
+	}
+	set, err := query.ParseKeySet(data)
+	if err != nil {
+		return err
+	}
+	cfg.InSet = set
+	cfg.InSetColumn = req.Column
+	return nil
 }
 
 // handleStatus returns daemon status.
 func (d *UDSDaemon) handleStatus() []byte {
+	d.dataMu.RLock()
+	columns := len(d.headers)
+	d.dataMu.RUnlock()
+	requests, uptime := d.metrics.snapshot()
 	return d.successResponse(map[string]interface{}{
-		"status":   "running",
-		"csv":      d.config.CsvPath,
-		"indexDir": d.config.IndexDir,
-		"rows":     d.countRows(),
-		"columns":  len(d.headers),
-		"network":  d.config.Network,
-		"address":  d.config.Address,
+		"status":      "running",
+		"csv":         d.config.CsvPath,
+		"dataset":     d.config.Dataset,
+		"indexDir":    d.config.IndexDir,
+		"rows":        d.countRows(),
+		"columns":     columns,
+		"network":     d.config.Network,
+		"address":     d.config.Address,
+		"blockCache":  d.cache.Stats(),
+		"openFiles":   d.handles.Len(),
+		"connections": len(d.sem),
+		"maxWorkers":  cap(d.sem),
+		"slots":       d.sched.status(),
+		"uptimeSec":   uptime,
+		"requests":    requests,
 	})
 }
 
+// handleIndexes returns the index metadata of a CSV, as its _meta.json
+// has it, with the columns queries can name when it is the daemon's CSV.
+func (d *UDSDaemon) handleIndexes(req DaemonRequest) []byte {
+	csvPath := req.Csv
+	if csvPath == "" {
+		csvPath = d.config.CsvPath
+	}
+	if csvPath == "" {
+		return d.errorResponse("csv is required")
+	}
+	store, err := storage.Open(d.config.IndexDir)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	csvName := strings.TrimSuffix(filepath.Base(csvPath), filepath.Ext(csvPath))
+	data, err := storage.ReadFile(store, csvName+"_meta.json")
+	if err != nil {
+		return d.errorFor(fmt.Errorf("no index metadata for %s: %w", csvPath, err))
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return d.errorFor(fmt.Errorf("invalid index metadata: %w", err))
+	}
+
+	resp := map[string]interface{}{"csv": csvPath, "meta": meta}
+	if csvPath == d.config.CsvPath {
+		d.dataMu.RLock()
+		columns := slices.Clone(d.headers)
+		d.dataMu.RUnlock()
+		if s, err := schema.Load(csvPath); err == nil {
+			columns = append(columns, s.VirtualNames()...)
+		}
+		resp["columns"] = columns
+	}
+	return d.successResponse(resp)
+}
+
+// writeStatus is the daemon's section of a SIGUSR1 status dump.
+func (d *UDSDaemon) writeStatus(w io.Writer) {
+	fmt.Fprintf(w, "  Listening:   %s (%s)\n", d.config.Address, d.config.Network)
+	fmt.Fprintf(w, "  Connections: %d active, %d max\n", len(d.sem), cap(d.sem))
+	slots := d.sched.status()
+	lookups, scans := slots[query.ClassLookup].(map[string]int), slots[query.ClassScan].(map[string]int)
+	fmt.Fprintf(w, "  Slots:       %d/%d lookups (%d queued), %d/%d scans (%d queued)\n",
+		lookups["busy"], lookups["max"], lookups["queued"], scans["busy"], scans["max"], scans["queued"])
+	if budget, ok := slots["costBudget"].(map[string]int64); ok {
+		fmt.Fprintf(w, "  Cost budget: %d of %d MB\n", budget["used"]>>20, budget["max"]>>20)
+	}
+	d.dataMu.RLock()
+	fmt.Fprintf(w, "  CSV:         %s (%d MB in memory)\n", d.config.CsvPath, len(d.csvData)>>20)
+	d.dataMu.RUnlock()
+	fmt.Fprintf(w, "  Open files:  %d (indexes, CSVs, bloom filters)\n", d.handles.Len())
+	if d.cache != nil {
+		st := d.cache.Stats()
+		fmt.Fprintf(w, "  Block cache: %d blocks, %d of %d MB, %d hits, %d misses\n", st.Blocks, st.Bytes>>20, st.Max>>20, st.Hits, st.Misses)
+	}
+	if d.shards != nil {
+		d.writeShardStatus(w)
+	}
+	select {
+	case <-d.shutdown:
+		fmt.Fprintln(w, "  Shutting down")
+	default:
+	}
+}
+
+// flushUsageLoop periodically persists index hit counts until shutdown.
+func (d *UDSDaemon) flushUsageLoop() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.shutdown:
+			return
+		case <-ticker.C:
+			if err := d.usage.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to save index usage: %v\n", err)
+			}
+		}
+	}
+}
+
+// applyLimits copies daemon-wide query guards into a per-request config.
+// A request may ask for a shorter timeout than the daemon's, never a longer one.
+func (d *UDSDaemon) applyLimits(cfg *query.QueryConfig, req DaemonRequest) {
+	cfg.RequireIndex = d.config.RequireIndex
+	cfg.MaxFullScanBytes = d.config.MaxFullScanBytes
+	cfg.MaxCost = d.config.MaxQueryCost
+	cfg.BlockCache = d.cache
+	cfg.Handles = d.handles
+	cfg.Context = d.ctx
+	cfg.Admit = d.admitter(req)
+	if req.onProgress != nil {
+		cfg.OnProgress = req.onProgress
+	}
+
+	cfg.Timeout = d.config.QueryTimeout
+	if req.Timeout > 0 {
+		if t := time.Duration(req.Timeout) * time.Millisecond; cfg.Timeout == 0 || t < cfg.Timeout {
+			cfg.Timeout = t
+		}
+	}
+}
+
+// applyDeadline turns the deadline of req into its timeout, if shorter. A
+// request whose deadline has passed fails before doing any work: its
+// caller has given up on it.
+func applyDeadline(req *DaemonRequest) error {
+	if req.Deadline <= 0 {
+		return nil
+	}
+	left := time.Until(time.UnixMilli(req.Deadline)).Milliseconds()
+	if left <= 0 {
+		return fmt.Errorf("%w: deadline passed %v ago, before it ran", query.ErrTimeout, time.Duration(-left)*time.Millisecond)
+	}
+	if req.Timeout <= 0 || int(left) < req.Timeout {
+		req.Timeout = int(left)
+	}
+	return nil
+}
+
+// progressSender returns a QueryConfig.OnProgress that sends each update
+// as a "progress" event.
+func progressSender(events func(string, map[string]interface{}) error) func(query.Progress) {
+	return func(p query.Progress) {
+		_ = events("progress", map[string]interface{}{
+			"phase":     p.Phase,
+			"scanned":   p.Scanned,
+			"total":     p.Total,
+			"matched":   p.Matched,
+			"elapsedMs": p.Elapsed.Milliseconds(),
+			"etaMs":     p.ETA.Milliseconds(),
+		})
+	}
+}
+
 // parseWhere converts simple where map to query condition.
 func (d *UDSDaemon) parseWhere(where map[string]string) (*query.Condition, error) {
 	if len(where) == 0 {
@@ -527,14 +1111,73 @@ func (d *UDSDaemon) parseWhere(where map[string]string) (*query.Condition, error
 	return query.ParseCondition(whereJSON)
 }
 
-// errorResponse creates an error JSON response.
+// Error codes of daemon responses besides those of query.ErrorCode.
+const (
+	codeBadRequest   = "bad_request"   // Malformed or incomplete request
+	codeUnauthorized = "unauthorized"  // Missing or wrong auth token
+	codeForbidden    = "forbidden"     // Action or CSV not open to the client
+	codeShuttingDown = "shutting_down" // Daemon draining; retry on another
+)
+
+// errorResponse creates the error JSON response of a request the daemon
+// rejects as malformed.
 func (d *UDSDaemon) errorResponse(msg string) []byte {
+	return codedResponse(codeBadRequest, msg)
+}
+
+// errorFor creates the error JSON response of a request that failed with
+// err, with its code: clients tell a missing index from a bad query by
+// "code", not by the message. Queries refused for their cost also carry
+// "cost": its class, bytes, limit and the index that would serve it.
+func (d *UDSDaemon) errorFor(err error) []byte {
+	var cost *query.CostError
+	if errors.As(err, &cost) {
+		b, _ := json.Marshal(map[string]interface{}{
+			"error": err.Error(),
+			"code":  query.CodeTooExpensive,
+			"cost": map[string]interface{}{
+				"class": cost.Class,
+				"bytes": cost.Bytes,
+				"limit": cost.Limit,
+				"index": cost.Index,
+			},
+		})
+		return b
+	}
+	return codedResponse(errorCode(err), err.Error())
+}
+
+func codedResponse(code, msg string) []byte {
 	b, _ := json.Marshal(map[string]interface{}{
 		"error": msg,
+		"code":  code,
 	})
 	return b
 }
 
+// errorCode returns the response code of err: that of a worker daemon's
+// response for shard errors, else query.ErrorCode's.
+func errorCode(err error) string {
+	var remote *remoteError
+	switch {
+	case errors.As(err, &remote):
+		return remote.code
+	case errors.Is(err, errShuttingDown):
+		return codeShuttingDown
+	case errors.Is(err, errForbidden):
+		return codeForbidden
+	}
+	return query.ErrorCode(err)
+}
+
+// remoteError is the error response of another daemon.
+type remoteError struct {
+	code string // "" for daemons predating codes
+	msg  string
+}
+
+func (e *remoteError) Error() string { return e.msg }
+
 // successResponse creates a success JSON response.
 func (d *UDSDaemon) successResponse(data map[string]interface{}) []byte {
 	data["error"] = nil
@@ -543,22 +1186,7 @@ func (d *UDSDaemon) successResponse(data map[string]interface{}) []byte {
 }
 
 // RunDaemon is the entry point called from main.go
-func RunDaemon(network, address, csvPath, indexDir string, maxConcurrency int) error {
-	cfg := DaemonConfig{
-		Network:        network,
-		Address:        address,
-		CsvPath:        csvPath,
-		IndexDir:       indexDir,
-		MaxConcurrency: maxConcurrency,
-	}
-
-	// Use indexer to verify CSV path if provided
-	if csvPath != "" {
-		if _, err := os.Stat(csvPath); os.IsNotExist(err) {
-			return fmt.Errorf("CSV file not found: %s", csvPath)
-		}
-	}
-
+func RunDaemon(cfg DaemonConfig) error {
 	daemon := NewUDSDaemon(cfg)
 	return daemon.Start()
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Shutdown drains the daemon: the listener is closed, idle connections
+// are closed at once, and requests in progress get DrainTimeout to finish
+// before their queries are canceled. Clients whose request arrives during
+// the drain, or is canceled by it, get errShuttingDown.
+
+var errShuttingDown = errors.New("server shutting down")
+
+// trackConn adds a connection to the open ones, or removes it.
+func (d *UDSDaemon) trackConn(conn net.Conn, open bool) {
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	if open {
+		d.conns[conn] = struct{}{}
+	} else {
+		delete(d.conns, conn)
+	}
+}
+
+func (d *UDSDaemon) shuttingDown() bool {
+	select {
+	case <-d.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits for the connection handlers after d.shutdown is closed.
+func (d *UDSDaemon) drain() {
+	// Connections waiting for their next request stop reading now; those
+	// in a request stop after answering it
+	d.connMu.Lock()
+	for conn := range d.conns {
+		_ = conn.SetReadDeadline(time.Now())
+	}
+	d.connMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	if d.config.DrainTimeout <= 0 {
+		<-done
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(d.config.DrainTimeout):
+		d.connMu.Lock()
+		active := len(d.conns)
+		d.connMu.Unlock()
+		fmt.Fprintf(os.Stderr, "Drain timeout: canceling %d active connection(s)\n", active)
+		d.cancel(errShuttingDown)
+		<-done
+	}
+}
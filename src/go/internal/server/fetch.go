@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/schema"
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+// maxFetchRows bounds the offsets of one fetch request.
+const maxFetchRows = 10000
+
+// handleFetch returns the rows at the given byte offsets (as select
+// returns them), parsed into column values, with the virtual columns of
+// the schema and pending updates applied. Deleted rows come back marked
+// as such. Fetch reads the daemon's own CSV only (see ownCSV), so it hands
+// out no file a select could not.
+func (d *UDSDaemon) handleFetch(req DaemonRequest) []byte {
+	csvPath, err := d.ownCSV(req.Csv)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	if len(req.Offsets) > maxFetchRows {
+		return d.errorResponse(fmt.Sprintf("fetch takes at most %d offsets", maxFetchRows))
+	}
+
+	f, err := d.openFetcher(csvPath)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	defer f.close()
+
+	rows := make([]map[string]interface{}, 0, len(req.Offsets))
+	for _, offset := range req.Offsets {
+		row, err := f.fetch(offset)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		rows = append(rows, row)
+	}
+	return d.successResponse(map[string]interface{}{"columns": f.columns, "rows": rows})
+}
+
+// rowFetcher reads rows of a CSV by offset.
+type rowFetcher struct {
+	data      []byte
+	headerEnd int
+	separator byte
+	columns   []string // CSV columns, then virtual ones
+	physical  int      // Number of CSV columns
+	defaults  []string // Values of the virtual columns
+	computed  []schema.ComputedColumn
+	updates   *updatemgr.UpdateManager
+	release   func()
+}
+
+// openFetcher prepares to read rows of csvPath. The daemon's CSV is read
+// from memory (and cannot be reloaded until close); another one is mapped
+// through the handle pool.
+func (d *UDSDaemon) openFetcher(csvPath string) (*rowFetcher, error) {
+	f := &rowFetcher{}
+	if d.config.CsvPath != "" && sameFile(csvPath, d.config.CsvPath) {
+		d.dataMu.RLock()
+		f.data, f.separator, f.release = d.csvData, d.separator, d.dataMu.RUnlock
+	} else {
+		data, release, err := d.handles.MapFile(csvPath)
+		if err != nil {
+			return nil, err
+		}
+		f.data, f.release = data, release
+		sample := data[:min(len(data), common.SniffBytes)]
+		f.separator = common.SniffDialect(sample, len(sample) < len(data)).Separator
+	}
+	if err := f.init(csvPath); err != nil {
+		f.close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rowFetcher) init(csvPath string) error {
+	f.headerEnd = bytes.IndexByte(f.data, '\n')
+	if f.headerEnd < 0 {
+		return fmt.Errorf("no newline found in CSV")
+	}
+	columns, err := parseCSVLine(f.data[:f.headerEnd], f.separator)
+	if err != nil {
+		return fmt.Errorf("invalid CSV header: %w", err)
+	}
+	for i, col := range columns {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(col, "\uFEFF"))
+	}
+	f.columns, f.physical = columns, len(columns)
+
+	// Virtual columns follow the CSV's, in name order (as queries see them)
+	if s, err := schema.Load(csvPath); err == nil {
+		for _, name := range s.VirtualNames() {
+			if columnIndex(f.columns, name) < 0 {
+				f.columns = append(f.columns, name)
+				f.defaults = append(f.defaults, s.VirtualColumns[name])
+			}
+		}
+		m := make(map[string]int, len(f.columns))
+		for i, col := range f.columns {
+			m[strings.ToLower(col)] = i
+		}
+		if err := s.AddAliases(m, f.physical); err != nil {
+			return err
+		}
+		if f.computed, err = s.Computed(m, f.physical); err != nil {
+			return err
+		}
+	}
+	f.updates, err = updatemgr.Load(csvPath)
+	return err
+}
+
+func (f *rowFetcher) close() {
+	f.release()
+}
+
+// fetch reads the row at offset: {"offset","row"}, or {"offset","deleted"}.
+func (f *rowFetcher) fetch(offset int64) (map[string]interface{}, error) {
+	data := f.data
+	if offset <= int64(f.headerEnd) || offset >= int64(len(data)) || data[offset-1] != '\n' {
+		return nil, fmt.Errorf("offset %d is not the start of a row", offset)
+	}
+	if f.updates.IsDeleted(offset) {
+		return map[string]interface{}{"offset": offset, "deleted": true}, nil
+	}
+	line := data[offset:]
+	if end := common.RecordEnd(line); end >= 0 {
+		line = line[:end]
+	}
+	values, err := parseCSVLine(bytes.TrimSuffix(line, []byte("\r")), f.separator)
+	if err != nil {
+		return nil, fmt.Errorf("row at offset %d: %v", offset, err)
+	}
+	for len(values) < f.physical {
+		values = append(values, "")
+	}
+	values = append(values[:f.physical], f.defaults...)
+	for col, val := range f.updates.GetRow(offset) {
+		if i := columnIndex(f.columns, col); i >= 0 {
+			values[i] = val
+		}
+	}
+	for _, c := range f.computed {
+		values[c.Pos] = c.Expr.Eval(values)
+	}
+
+	row := make(map[string]string, len(f.columns))
+	for i, col := range f.columns {
+		row[col] = values[i]
+	}
+	return map[string]interface{}{"offset": offset, "row": row}, nil
+}
+
+// parseCSVLine splits one CSV line into its fields.
+func parseCSVLine(line []byte, sep byte) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(line))
+	r.Comma = rune(sep)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err != nil && len(line) == 0 {
+		return []string{""}, nil
+	}
+	return fields, err
+}
+
+// columnIndex finds a column by name, ignoring case like queries do.
+func columnIndex(columns []string, name string) int {
+	for i, col := range columns {
+		if strings.EqualFold(col, name) {
+			return i
+		}
+	}
+	return -1
+}
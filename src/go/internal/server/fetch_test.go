@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("user:x:0\nroot:x:1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	row1, row2 := strings.Index(testCSV, "1,"), strings.Index(testCSV, "2,")
+
+	resp := request(t, d, fmt.Sprintf(`{"action":"fetch","offsets":[%d,%d]}`, row1, row2))
+	if resp["error"] != nil {
+		t.Fatal(resp["error"])
+	}
+	if !reflect.DeepEqual(resp["columns"], []interface{}{"id", "name", "city"}) {
+		t.Errorf("columns %v", resp["columns"])
+	}
+	rows, _ := resp["rows"].([]interface{})
+	if len(rows) != 2 || !reflect.DeepEqual(rows[1].(map[string]interface{})["row"], map[string]interface{}{"id": "2", "name": "bob\nsmith", "city": "Rome"}) {
+		t.Errorf("rows %v", rows)
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  string
+		code string
+	}{
+		{"by name", fmt.Sprintf(`{"action":"fetch","csv":%q,"offsets":[%d]}`, d.config.CsvPath, row1), ""},
+		{"another file", fmt.Sprintf(`{"action":"fetch","csv":%q,"offsets":[9]}`, secret), codeForbidden},
+	} {
+		resp := request(t, d, tc.req)
+		if code, _ := resp["code"].(string); code != tc.code {
+			t.Errorf("%s: %v, want code %q", tc.name, resp, tc.code)
+		}
+		if tc.code == codeForbidden && strings.Contains(fmt.Sprint(resp), "root") {
+			t.Errorf("%s: leaked %v", tc.name, resp)
+		}
+	}
+}
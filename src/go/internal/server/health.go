@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Health checks. The "health" action (`csvquery health`) and GET /readyz
+// over HTTP tell container orchestrators whether the daemon can serve:
+// it answers, is not shutting down, and every index of its CSV matches
+// the CSV (see indexer.ListIndexes: rows appended since the build must be
+// in the index deltas). A stale index would turn lookups into full scans
+// or read rows at wrong offsets. A daemon without --index-dir, or whose
+// CSV has no indexes, is ready unless it requires them (--require-index).
+// A coordinator is ready when all its shards are.
+
+// checkHealth reports whether the daemon is ready, with the indexes of
+// its CSV and what is wrong with them.
+func (d *UDSDaemon) checkHealth() map[string]interface{} {
+	problems := []string{}
+	if d.shuttingDown() {
+		problems = append(problems, errShuttingDown.Error())
+	}
+	health := map[string]interface{}{"csv": d.config.CsvPath}
+	if d.config.CsvPath != "" && d.config.IndexDir != "" {
+		infos, err := d.listIndexes()
+		switch {
+		case err != nil && d.config.RequireIndex:
+			problems = append(problems, err.Error())
+		case err == nil:
+			for _, info := range infos {
+				if info.Stale != "" {
+					problems = append(problems, fmt.Sprintf("index %s: %s", info.Name, info.Stale))
+				}
+			}
+			health["indexes"] = len(infos)
+		}
+	}
+	health["ready"] = len(problems) == 0
+	health["problems"] = problems
+	return health
+}
+
+// listIndexes lists the indexes of the daemon's CSV.
+func (d *UDSDaemon) listIndexes() ([]indexer.IndexInfo, error) {
+	store, err := storage.Open(d.config.IndexDir)
+	if err != nil {
+		return nil, err
+	}
+	return indexer.ListIndexes(store, d.config.CsvPath)
+}
+
+// coordinateHealth reports a coordinator ready when every shard is.
+func (d *UDSDaemon) coordinateHealth(req DaemonRequest) []byte {
+	responses, err := d.fanOut(req)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	problems := []string{}
+	if d.shuttingDown() {
+		problems = append(problems, errShuttingDown.Error())
+	}
+	for i, resp := range responses {
+		var shard []string
+		_ = json.Unmarshal(resp["problems"], &shard)
+		for _, problem := range shard {
+			problems = append(problems, fmt.Sprintf("shard %d (%s): %s", i, d.shards[i], problem))
+		}
+	}
+	return d.successResponse(map[string]interface{}{
+		"ready":    len(problems) == 0,
+		"problems": problems,
+		"shards":   len(d.shards),
+	})
+}
+
+// serveReadyz answers GET /readyz: 200 when the daemon is ready, 503 when
+// not. Probes need no token; only authorized clients see the problems.
+func (d *UDSDaemon) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	body := d.processRequest([]byte(`{"action":"health"}`), nil, nil)
+	var health struct {
+		Ready bool `json:"ready"`
+	}
+	_ = json.Unmarshal(body, &health)
+	if !d.httpAuthorized(r) {
+		body, _ = json.Marshal(health)
+	}
+	body = append(body, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(body)
+}
+
+// HealthReport is a daemon's answer to a health check.
+type HealthReport struct {
+	Ready    bool     `json:"ready"`
+	Problems []string `json:"problems"`
+	CSV      string   `json:"csv,omitempty"`
+	Indexes  int      `json:"indexes,omitempty"`
+	Shards   int      `json:"shards,omitempty"` // Of a coordinator
+}
+
+// CheckHealth asks the daemon at addr (a socket path or tcp:host:port)
+// whether it is ready. An error means it could not answer.
+func CheckHealth(addr, token string, timeout time.Duration) (*HealthReport, error) {
+	client, err := newShardClient(addr, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer client.close()
+	body, err := json.Marshal(DaemonRequest{Action: "health"})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.do(body, time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	report := &HealthReport{}
+	for field, value := range map[string]any{"ready": &report.Ready, "problems": &report.Problems,
+		"csv": &report.CSV, "indexes": &report.Indexes, "shards": &report.Shards} {
+		if raw, ok := resp[field]; ok {
+			if err := json.Unmarshal(raw, value); err != nil {
+				return nil, fmt.Errorf("invalid %s in the response: %w", field, err)
+			}
+		}
+	}
+	return report, nil
+}
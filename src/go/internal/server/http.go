@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/entreya/csvquery/internal/query"
+	"github.com/entreya/csvquery/internal/status"
+)
+
+// With DaemonConfig.HTTPAddr the daemon also serves HTTP:
+//
+//	POST /request   one request (or a batch array) as the body; the response
+//	                is what the socket protocol answers
+//	GET  /ws        WebSocket: each text message is a request, answered by
+//	                JSON events (see serveWebSocket)
+//	GET  /ui        the admin console (see ui.go)
+//	GET  /readyz    200 when the daemon is ready to serve, else 503 (see
+//	                health.go)
+//	POST /rows      the bytes of row ranges of a CSV, sent from the file
+//	                (see ranges.go)
+//
+// HTTP clients authenticate with "Authorization: Bearer <token>" when the
+// daemon has a token; a WebSocket client may send an auth request as its
+// first message instead, as browsers cannot set the header. Browsers do
+// not apply the same-origin policy to WebSockets, so any page could open
+// /ws on a daemon its visitor reaches: upgrades from a page of another
+// origin than the daemon's are refused unless --allowed-origins lists it.
+
+// maxHTTPBody bounds the body of a POST /request.
+const maxHTTPBody = 64 << 20
+
+// wsMaxPending bounds the requests a WebSocket client can queue while one
+// runs.
+const wsMaxPending = 64
+
+var errClientGone = errors.New("client disconnected")
+
+// startHTTP starts the HTTP listener.
+func (d *UDSDaemon) startHTTP() error {
+	listener, err := net.Listen("tcp", d.config.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to bind HTTP %s: %w", d.config.HTTPAddr, err)
+	}
+	if d.tlsServer != nil {
+		listener = tls.NewListener(listener, d.tlsServer)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request", d.serveHTTPRequest)
+	mux.HandleFunc("/ws", d.serveWebSocket)
+	mux.HandleFunc("/ui", d.serveUI)
+	mux.HandleFunc("/readyz", d.serveReadyz)
+	mux.HandleFunc("/rows", d.serveRows)
+	d.httpServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: d.config.IdleTimeout}
+	go func() {
+		if err := d.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "HTTP server error: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// stopHTTP closes the HTTP listener when the daemon shuts down.
+// Requests in progress are drained with the socket connections.
+func (d *UDSDaemon) stopHTTP() {
+	if d.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // Stop listening and close idle connections, without waiting
+	_ = d.httpServer.Shutdown(ctx)
+}
+
+// httpAuthorized checks the bearer token of an HTTP request.
+func (d *UDSDaemon) httpAuthorized(r *http.Request) bool {
+	if d.config.AuthToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(d.config.AuthToken)) == 1
+}
+
+// originAllowed reports whether a WebSocket upgrade may come from the page
+// it names as its Origin: the daemon's own (the console), one of
+// AllowedOrigins, or none at all (clients other than browsers).
+func (d *UDSDaemon) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range d.config.AllowedOrigins {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// beginHTTP takes a worker slot for an HTTP request, and registers it for
+// the drain. It reports false (and answers) when the daemon is going away.
+func (d *UDSDaemon) beginHTTP(w http.ResponseWriter) bool {
+	if d.shuttingDown() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	d.wg.Add(1)
+	select {
+	case d.sem <- struct{}{}:
+		return true
+	case <-d.shutdown:
+		d.wg.Done()
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+}
+
+func (d *UDSDaemon) endHTTP() {
+	<-d.sem
+	d.wg.Done()
+}
+
+// serveHTTPRequest answers POST /request.
+func (d *UDSDaemon) serveHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.httpAuthorized(r) {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		http.Error(w, "empty request", http.StatusBadRequest)
+		return
+	}
+	if !d.beginHTTP(w) {
+		return
+	}
+	defer d.endHTTP()
+
+	var response []byte
+	if body[0] == '[' {
+		response = d.serveBatch(body, d.config.AuthToken == "")
+	} else {
+		response = d.serve(body, d.config.AuthToken == "", nil)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(response, '\n'))
+}
+
+// serveWebSocket answers GET /ws. Requests on one connection run one at a
+// time, in order. Every message sent back is a JSON object with the
+// request's "id" (when it has one) and an "event":
+//
+//	row      select: one matching row as fetch returns it, sent as found
+//	partial  groupby: the groups so far, while the scan runs
+//	progress with "progress": true, once a second while the query scans:
+//	         "phase", "scanned" and "total" bytes, "matched", "elapsedMs", "etaMs"
+//	done     the request finished: its response, as the socket answers it
+//	error    the request failed: "error" and its "code"
+//
+// Closing the connection cancels the request in progress.
+func (d *UDSDaemon) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !d.originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	authenticated := d.httpAuthorized(r)
+	if !d.beginHTTP(w) {
+		return
+	}
+	defer d.endHTTP()
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	d.trackConn(ws.conn, true)
+	defer d.trackConn(ws.conn, false)
+
+	ctx, cancel := context.WithCancelCause(d.ctx)
+	defer cancel(nil)
+
+	// Read ahead so that a client going away cancels its running request
+	pending := make(chan []byte, wsMaxPending)
+	go func() {
+		defer close(pending)
+		for {
+			op, message, err := ws.readMessage()
+			if err != nil {
+				if !d.shuttingDown() {
+					cancel(errClientGone)
+				}
+				return
+			}
+			if op != wsText {
+				continue
+			}
+			select {
+			case pending <- message:
+			default:
+				cancel(fmt.Errorf("more than %d requests pending", wsMaxPending))
+				return
+			}
+		}
+	}()
+
+	for message := range pending {
+		var envelope struct {
+			ID     json.RawMessage `json:"id"`
+			Action string          `json:"action"`
+			Token  string          `json:"token"`
+		}
+		_ = json.Unmarshal(message, &envelope)
+		send := func(event string, fields map[string]interface{}) error {
+			if fields == nil {
+				fields = map[string]interface{}{}
+			}
+			fields["event"] = event
+			if envelope.ID != nil {
+				fields["id"] = envelope.ID
+			}
+			b, err := json.Marshal(fields)
+			if err != nil {
+				return err
+			}
+			return ws.writeMessage(wsText, b)
+		}
+
+		if !authenticated {
+			if envelope.Action != "auth" || subtle.ConstantTimeCompare([]byte(envelope.Token), []byte(d.config.AuthToken)) != 1 {
+				_ = send("error", map[string]interface{}{"error": "authentication required", "code": codeUnauthorized})
+				ws.close(1008)
+				return
+			}
+			authenticated = true
+		}
+		if d.shuttingDown() {
+			_ = send("error", map[string]interface{}{"error": errShuttingDown.Error(), "code": codeShuttingDown})
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			break
+		}
+
+		response := d.streamRequest(ctx, message, send)
+		var fields map[string]interface{}
+		if err := json.Unmarshal(response, &fields); err != nil {
+			fields = map[string]interface{}{"error": "invalid response: " + err.Error(), "code": query.CodeInternal}
+		}
+		event := "done"
+		if fields["error"] != nil {
+			event = "error"
+		}
+		if send(event, fields) != nil {
+			break
+		}
+	}
+
+	code := uint16(1000)
+	if d.shuttingDown() {
+		code = 1001 // Going away
+	} else if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errClientGone) {
+		code = 1008
+	}
+	ws.close(code)
+}
+
+// streamRequest answers a WebSocket request. select and groupby send their
+// rows or partial groups as they go; other actions are answered whole.
+// It returns the final response.
+func (d *UDSDaemon) streamRequest(ctx context.Context, message []byte, send func(string, map[string]interface{}) error) []byte {
+	var req DaemonRequest
+	if err := json.Unmarshal(message, &req); err != nil || d.shards != nil ||
+		(req.Action != "select" && req.Action != "groupby") {
+		return d.serve(message, d.config.AuthToken == "", send)
+	}
+
+	if req.Progress {
+		req.onProgress = progressSender(send)
+	}
+	start := time.Now()
+	trace := &requestTrace{action: req.Action, csv: req.Csv}
+	req.trace = trace
+	activity := status.Begin("request", "action="+req.Action)
+	d.indexMu.RLock()
+	var response []byte
+	if req.Action == "select" {
+		response = d.streamSelect(ctx, req, send)
+	} else {
+		response = d.streamGroupBy(ctx, req, send)
+	}
+	d.indexMu.RUnlock()
+	activity.End()
+
+	elapsed := time.Since(start)
+	d.metrics.record(req.Action, response, elapsed)
+	if d.recorder != nil {
+		d.recorder.Record(message, response, elapsed)
+	}
+	if d.reqLog != nil {
+		d.reqLog.log(trace, message, response, elapsed, func() json.RawMessage { return d.explainPlan(message) })
+	}
+	return response
+}
+
+// streamSelect runs a select, sending each row as it is found.
+func (d *UDSDaemon) streamSelect(ctx context.Context, req DaemonRequest, send func(string, map[string]interface{}) error) []byte {
+	csvPath := req.Csv
+	if csvPath == "" {
+		csvPath = d.config.CsvPath
+	}
+	cond, err := d.parseWhere(req.Where)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	cfg := query.QueryConfig{
+		CsvPath:  csvPath,
+		IndexDir: d.config.IndexDir,
+		Where:    cond,
+		Limit:    req.Limit,
+		Offset:   req.Offset,
+		Cursor:   req.Cursor,
+		OrderBy:  req.OrderBy,
+		Verbose:  req.Verbose,
+		Stream:   true,
+	}
+	d.applyLimits(&cfg, req)
+	cfg.Context = ctx
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+
+	f, err := d.openFetcher(csvPath)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	defer f.close()
+
+	var rows int64
+	var rowErr error
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &query.Result{OnRow: func(ref query.RowRef) {
+		if rowErr != nil {
+			return
+		}
+		row, err := f.fetch(ref.Offset)
+		if err != nil {
+			rowErr = err
+			return
+		}
+		row["line"] = ref.Line
+		rows++
+		_ = send("row", row) // A client gone cancels ctx
+	}}
+
+	if err := engine.Run(); err != nil {
+		return d.errorFor(err)
+	}
+	if rowErr != nil {
+		return d.errorFor(rowErr)
+	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+	return d.successResponse(map[string]interface{}{"rows": rows, "cursor": nextCursor(engine)})
+}
+
+// streamGroupBy runs a group-by, sending the groups so far while it scans.
+func (d *UDSDaemon) streamGroupBy(ctx context.Context, req DaemonRequest, send func(string, map[string]interface{}) error) []byte {
+	csvPath := req.Csv
+	if csvPath == "" {
+		csvPath = d.config.CsvPath
+	}
+	cond, err := d.parseWhere(req.Where)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	groupCol := req.GroupBy
+	if groupCol == "" {
+		groupCol = req.Column
+	}
+	aggFunc := req.AggFunc
+	if aggFunc == "" {
+		aggFunc = "count"
+	}
+	cfg := query.QueryConfig{
+		CsvPath:  csvPath,
+		IndexDir: d.config.IndexDir,
+		Where:    cond,
+		GroupBy:  groupCol,
+		AggFunc:  aggFunc,
+		AggSort:  req.AggSort,
+		AggLimit: req.AggLimit,
+		Pivot:    req.Pivot,
+		Verbose:  req.Verbose,
+		OnPartial: func(groups map[string]float64) {
+			_ = send("partial", map[string]interface{}{"groups": groups})
+		},
+	}
+	d.applyLimits(&cfg, req)
+	cfg.Context = ctx
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return d.errorFor(err)
+	}
+
+	var result query.Result
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &result
+	if err := engine.Run(); err != nil {
+		return d.errorFor(err)
+	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+	switch {
+	case result.Pivot != nil:
+		return d.successResponse(map[string]interface{}{"pivot": result.Pivot})
+	case result.Ranked != nil:
+		return d.successResponse(map[string]interface{}{"groups": result.Ranked})
+	}
+	return d.successResponse(map[string]interface{}{"groups": result.Groups})
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://127.0.0.1:8080", nil, true},
+		{"https://127.0.0.1:8080", nil, true},
+		{"http://evil.example", nil, false},
+		{"null", nil, false},
+		{"http://127.0.0.1:9090", nil, false},
+		{"https://app.example", []string{"https://app.example/"}, true},
+		{"https://APP.example", []string{"https://app.example"}, true},
+		{"http://app.example", []string{"https://app.example"}, false},
+		{"http://evil.example", []string{"*"}, true},
+	} {
+		d := NewUDSDaemon(DaemonConfig{AllowedOrigins: tc.allowed})
+		r := httptest.NewRequest("GET", "http://127.0.0.1:8080/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := d.originAllowed(r); got != tc.want {
+			t.Errorf("Origin %q, allowed %v: %v, want %v", tc.origin, tc.allowed, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// requestMetrics counts the requests a daemon has answered, by action, for
+// status (and so the /ui console). They cover the daemon's lifetime.
+type requestMetrics struct {
+	started time.Time
+	mu      sync.Mutex
+	actions map[string]*actionMetrics
+}
+
+// actionMetrics are the counts of one action.
+type actionMetrics struct {
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"`
+	TotalMs  float64 `json:"totalMs"`
+	MaxMs    float64 `json:"maxMs"`
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{started: time.Now(), actions: make(map[string]*actionMetrics)}
+}
+
+// errorPrefix starts every error response (see codedResponse); the keys of
+// a success response never sort before "code".
+var errorPrefix = []byte(`{"code":`)
+
+// record counts a finished request.
+func (m *requestMetrics) record(action string, response []byte, elapsed time.Duration) {
+	if action == "" {
+		action = "invalid"
+	}
+	ms := float64(elapsed.Microseconds()) / 1000
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.actions[action]
+	if a == nil {
+		a = &actionMetrics{}
+		m.actions[action] = a
+	}
+	a.Requests++
+	if bytes.HasPrefix(response, errorPrefix) {
+		a.Errors++
+	}
+	a.TotalMs += ms
+	a.MaxMs = max(a.MaxMs, ms)
+}
+
+// snapshot returns the counts so far, and the seconds since the daemon
+// started.
+func (m *requestMetrics) snapshot() (map[string]actionMetrics, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	actions := make(map[string]actionMetrics, len(m.actions))
+	for name, a := range m.actions {
+		actions[name] = *a
+	}
+	return actions, time.Since(m.started).Seconds()
+}
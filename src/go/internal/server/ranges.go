@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// Raw row ranges. Exports that want whole rows as stored need not have
+// the daemon parse them into JSON: a select with "ranges":true answers
+// with the [offset, length] byte ranges of its rows in the CSV instead,
+// each row with its newline and adjacent rows merged into one range. POST
+// /rows over HTTP then sends the bytes of those ranges, with the kernel
+// copying them from the CSV's page cache to the socket (sendfile; TLS
+// connections copy through user space). Ranges are the rows as stored:
+// without the schema's virtual columns, and a row with pending updates
+// fails the select rather than come back stale. /rows serves the daemon's
+// own CSV only, and only ranges of whole rows, so it hands out no bytes a
+// select could not.
+
+// maxRowRanges bounds the ranges of one POST /rows.
+const maxRowRanges = 1 << 20
+
+// rangeSelect runs a select, answering with the byte ranges of its rows.
+func (d *UDSDaemon) rangeSelect(req DaemonRequest, cfg query.QueryConfig) []byte {
+	f, err := d.openFetcher(cfg.CsvPath)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	defer f.close()
+
+	ranges := [][2]int64{}
+	var rows, total int64
+	var rowErr error
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &query.Result{OnRow: func(ref query.RowRef) {
+		if rowErr != nil || f.updates.IsDeleted(ref.Offset) {
+			return
+		}
+		var length int64
+		if length, rowErr = f.rowLength(ref.Offset); rowErr != nil {
+			return
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][0]+ranges[n-1][1] == ref.Offset {
+			ranges[n-1][1] += length
+		} else {
+			ranges = append(ranges, [2]int64{ref.Offset, length})
+		}
+		rows++
+		total += length
+	}}
+	if err := engine.Run(); err != nil {
+		return d.errorFor(err)
+	}
+	if rowErr != nil {
+		return d.errorFor(rowErr)
+	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+
+	return d.successResponse(map[string]interface{}{
+		"ranges": ranges,
+		"rows":   rows,
+		"bytes":  total,
+		"cursor": nextCursor(engine),
+	})
+}
+
+// rowLength returns the bytes of the row at offset, with its newline.
+func (f *rowFetcher) rowLength(offset int64) (int64, error) {
+	data := f.data
+	if offset <= int64(f.headerEnd) || offset >= int64(len(data)) || data[offset-1] != '\n' {
+		return 0, fmt.Errorf("offset %d is not the start of a row", offset)
+	}
+	if len(f.updates.GetRow(offset)) > 0 {
+		return 0, fmt.Errorf("row at offset %d has pending updates: ranges serve rows as stored", offset)
+	}
+	end := common.RecordEnd(data[offset:])
+	if end < 0 {
+		return int64(len(data)) - offset, nil // Last row, no newline
+	}
+	return int64(end) + 1, nil
+}
+
+// rowsRequest is the body of POST /rows.
+type rowsRequest struct {
+	Ranges [][2]int64 `json:"ranges"`           // [offset, length], as a select with ranges returns them
+	Header bool       `json:"header,omitempty"` // Send the CSV's header line first
+}
+
+// serveRows answers POST /rows: the bytes of the ranges of the body, one
+// after the other, as text/csv.
+func (d *UDSDaemon) serveRows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.httpAuthorized(r) {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	var req rowsRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+	dec.DisallowUnknownFields() // A "csv" of old would be ignored: fail instead
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Ranges) > maxRowRanges {
+		http.Error(w, fmt.Sprintf("at most %d ranges", maxRowRanges), http.StatusBadRequest)
+		return
+	}
+	csvPath := d.config.CsvPath
+	if csvPath == "" {
+		http.Error(w, "the daemon serves no CSV", http.StatusNotFound)
+		return
+	}
+	if !d.beginHTTP(w) {
+		return
+	}
+	defer d.endHTTP()
+
+	// The fetcher holds the CSV in place while its bytes are sent
+	f, err := d.openFetcher(csvPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.close()
+	file, err := os.Open(csvPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	var total int64
+	for _, rg := range req.Ranges {
+		if err := f.checkRange(rg); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		total += rg[1]
+	}
+	ranges := req.Ranges
+	if req.Header {
+		header := [2]int64{0, int64(f.headerEnd) + 1}
+		ranges = append([][2]int64{header}, ranges...)
+		total += header[1]
+	}
+
+	// A known length keeps the body unchunked, so the copies below can
+	// hand the file to the socket
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	w.WriteHeader(http.StatusOK)
+	for _, rg := range ranges {
+		if _, err := file.Seek(rg[0], io.SeekStart); err != nil {
+			return
+		}
+		if _, err := io.Copy(w, io.LimitReader(file, rg[1])); err != nil {
+			return // Client gone
+		}
+	}
+}
+
+// checkRange fails unless rg is whole rows of the CSV: it starts at a row
+// and ends where a row does, with no row in it that has pending updates.
+func (f *rowFetcher) checkRange(rg [2]int64) error {
+	if rg[0] < 0 || rg[1] <= 0 || rg[1] > int64(len(f.data))-rg[0] {
+		return fmt.Errorf("range [%d, %d] is outside the CSV (%d bytes)", rg[0], rg[1], len(f.data))
+	}
+	offset, end := rg[0], rg[0]+rg[1]
+	for offset < end {
+		length, err := f.rowLength(offset)
+		if err != nil {
+			return err
+		}
+		offset += length
+	}
+	if offset != end {
+		return fmt.Errorf("range [%d, %d] ends inside a row", rg[0], rg[1])
+	}
+	return nil
+}
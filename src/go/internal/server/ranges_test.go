@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/entreya/csvquery/internal/updatemgr"
+)
+
+const testCSV = "id,name,city\n1,ann,Paris\n2,\"bob\nsmith\",Rome\n3,cy,Oslo\n"
+
+// newTestDaemon returns a daemon serving a CSV of data, loaded but not
+// listening.
+func newTestDaemon(t *testing.T, data string) *UDSDaemon {
+	t.Helper()
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "t.csv")
+	if err := os.WriteFile(csvPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewUDSDaemon(DaemonConfig{CsvPath: csvPath, IndexDir: dir, MaxConcurrency: 4})
+	if err := d.loadCSV(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestServeRows(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	row1 := strings.Index(testCSV, "1,")
+	row2 := strings.Index(testCSV, "2,")
+	row3 := strings.Index(testCSV, "3,")
+	end := len(testCSV)
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"rows", rangesBody(false, [2]int{row2, end - row2}), http.StatusOK, testCSV[row2:]},
+		{"header", rangesBody(true, [2]int{row1, row2 - row1}, [2]int{row3, end - row3}), http.StatusOK, "id,name,city\n1,ann,Paris\n3,cy,Oslo\n"},
+		{"inside a row", rangesBody(false, [2]int{row1 + 2, row2 - row1 - 2}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"inside a quoted newline", rangesBody(false, [2]int{row2 + 6, row3 - row2 - 6}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"ends inside a row", rangesBody(false, [2]int{row1, row2 - row1 + 3}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"header line", rangesBody(false, [2]int{0, row1}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"past the end", rangesBody(false, [2]int{row3, end}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"negative", rangesBody(false, [2]int{-1, 2}), http.StatusRequestedRangeNotSatisfiable, ""},
+		{"another file", `{"csv":"/etc/passwd","ranges":[[0,10]]}`, http.StatusBadRequest, ""},
+	} {
+		rec := httptest.NewRecorder()
+		d.serveRows(rec, httptest.NewRequest(http.MethodPost, "/rows", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d (%s)", tc.name, rec.Code, tc.status, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		if tc.status == http.StatusOK && rec.Body.String() != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, rec.Body.String(), tc.want)
+		}
+	}
+}
+
+func rangesBody(header bool, ranges ...[2]int) string {
+	req := rowsRequest{Header: header}
+	for _, rg := range ranges {
+		req.Ranges = append(req.Ranges, [2]int64{int64(rg[0]), int64(rg[1])})
+	}
+	body, _ := json.Marshal(req)
+	return string(body)
+}
+
+func TestRangeSelect(t *testing.T) {
+	// Rows 1 and 2 are adjacent; row 5 ends without a newline
+	const data = "id,city\n1,A\n2,A\n3,B\n4,\"A\nB\"\n5,A"
+	d := newTestDaemon(t, data)
+	row := func(id string) int { return strings.Index(data, "\n"+id+",") + 1 }
+	end := len(data)
+
+	for _, tc := range []struct {
+		name  string
+		where string
+		rows  int
+		want  [][2]int
+	}{
+		{"merged and unterminated", `{"city":"A"}`, 3, [][2]int{{row("1"), row("3") - row("1")}, {row("5"), end - row("5")}}},
+		{"quoted newline", `{"city":"A\nB"}`, 1, [][2]int{{row("4"), row("5") - row("4")}}},
+		{"no rows", `{"city":"C"}`, 0, [][2]int{}},
+	} {
+		resp := request(t, d, `{"action":"select","ranges":true,"where":`+tc.where+`}`)
+		if resp["error"] != nil {
+			t.Errorf("%s: %v", tc.name, resp["error"])
+			continue
+		}
+		want, bytes := []interface{}{}, 0
+		for _, rg := range tc.want {
+			want = append(want, []interface{}{float64(rg[0]), float64(rg[1])})
+			bytes += rg[1]
+		}
+		if !reflect.DeepEqual(resp["ranges"], want) {
+			t.Errorf("%s: ranges %v, want %v", tc.name, resp["ranges"], want)
+		}
+		if resp["rows"] != float64(tc.rows) || resp["bytes"] != float64(bytes) {
+			t.Errorf("%s: %v rows of %v bytes, want %d of %d", tc.name, resp["rows"], resp["bytes"], tc.rows, bytes)
+		}
+		if len(tc.want) == 0 {
+			continue
+		}
+
+		// The ranges the select answers are served back as its rows
+		rec := httptest.NewRecorder()
+		d.serveRows(rec, httptest.NewRequest(http.MethodPost, "/rows", strings.NewReader(rangesBody(false, tc.want...))))
+		var rowsWant string
+		for _, rg := range tc.want {
+			rowsWant += data[rg[0] : rg[0]+rg[1]]
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != rowsWant {
+			t.Errorf("%s: /rows answered %d %q, want %q", tc.name, rec.Code, rec.Body.String(), rowsWant)
+		}
+	}
+}
+
+func TestRangeSelectPendingUpdates(t *testing.T) {
+	const data = "id,city\n1,A\n2,A\n3,A\n"
+	d := newTestDaemon(t, data)
+	um, err := updatemgr.Load(d.config.CsvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.Delete(int64(strings.Index(data, "2,")))
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A deleted row is left out, splitting the range around it
+	resp := request(t, d, `{"action":"select","ranges":true,"where":{"city":"A"}}`)
+	row1, row3 := strings.Index(data, "1,"), strings.Index(data, "3,")
+	want := []interface{}{[]interface{}{float64(row1), float64(4)}, []interface{}{float64(row3), float64(4)}}
+	if !reflect.DeepEqual(resp["ranges"], want) || resp["rows"] != float64(2) {
+		t.Errorf("ranges %v of %v rows, want %v of 2", resp["ranges"], resp["rows"], want)
+	}
+
+	// An updated row would be served as stored: the select fails instead
+	um.Set(int64(row3), "city", "A2")
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	resp = request(t, d, `{"action":"select","ranges":true,"where":{"id":"1"}}`)
+	if resp["error"] != nil {
+		t.Errorf("row without updates: %v", resp["error"])
+	}
+	resp = request(t, d, `{"action":"select","ranges":true,"where":{"id":"3"}}`)
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "pending updates") {
+		t.Errorf("updated row: %v, want a pending updates error", resp)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/entreya/csvquery/internal/indexer"
+)
+
+// Index refresh without downtime: a build writes the files of a new
+// generation next to the ones queries are reading (see indexer.saveMeta),
+// so only the switch to them needs care. Queries hold indexMu for reading
+// while they run; publish takes it for writing around the metadata write,
+// so running queries finish on the old index, new ones wait the moment it
+// takes and then open the new one, and no query loses a file it is about
+// to open when the superseded ones are removed.
+
+// publish is the indexer.IndexerConfig.Publish hook of the daemon's builds.
+func (d *UDSDaemon) publish(save func() error) error {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	return save()
+}
+
+// handleReindex rebuilds the indexes of a CSV: the ones its metadata
+// lists, or those of req.Columns (an `index --columns` array; the others
+// stay as they are).
+func (d *UDSDaemon) handleReindex(req DaemonRequest) []byte {
+	csvPath, err := d.ownCSV(req.Csv)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	if d.config.IndexDir == "" {
+		return d.errorResponse("reindex needs the daemon's --index-dir")
+	}
+
+	// One build at a time, and none while rows are being written
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	cfg, _, err := indexer.CurrentConfig(csvPath, d.config.IndexDir)
+	if len(req.Columns) > 0 {
+		if err != nil {
+			// No usable metadata: build just what was asked for
+			cfg = indexer.IndexerConfig{InputFile: csvPath, OutputDir: d.config.IndexDir, BloomFPRate: 0.01}
+		}
+		cfg.Columns = string(req.Columns)
+	} else if err != nil {
+		return d.errorFor(fmt.Errorf("reindex %s: %w", csvPath, err))
+	}
+	cfg.Publish = d.publish
+	cfg.Output = io.Discard
+
+	start := time.Now()
+	idx := indexer.NewIndexer(cfg)
+	err = idx.Run()
+	idx.Cleanup()
+	if err != nil {
+		return d.errorFor(fmt.Errorf("reindex failed: %w", err))
+	}
+
+	_, meta, err := indexer.CurrentConfig(csvPath, d.config.IndexDir)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	names := make([]string, 0, len(meta.Indexes))
+	for name := range meta.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return d.successResponse(map[string]interface{}{
+		"indexes":    names,
+		"rows":       meta.TotalRows,
+		"generation": meta.Generation,
+		"ms":         time.Since(start).Milliseconds(),
+	})
+}
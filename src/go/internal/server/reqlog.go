@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// The request log has one JSON line per request: its action, dataset,
+// duration, rows and the strategy that answered it. Requests slower than
+// the slow-query threshold also carry the full request and its plan. With
+// only a threshold set, only slow requests are logged.
+
+// requestTrace collects what is known about a request for its log entry.
+type requestTrace struct {
+	action   string
+	csv      string
+	index    string
+	strategy string
+	class    string // Execution slot class (see slots.go)
+	cost     int64  // Bytes the query was expected to read
+	open     bool   // Came over a TCP or HTTP listener without an auth token: no write actions
+}
+
+// recordRun notes the index an engine used: in the usage counts, and in
+// the request's trace for the log.
+func (d *UDSDaemon) recordRun(req DaemonRequest, csvPath, indexDir string, engine *query.QueryEngine) {
+	d.usage.Record(csvPath, indexDir, engine.UsedIndex)
+	if t := req.trace; t != nil {
+		t.csv = csvPath
+		t.index = engine.UsedIndex
+		t.strategy = engine.Strategy
+		t.class = engine.Class
+		t.cost = engine.Cost
+	}
+}
+
+// logEntry is one line of the request log.
+type logEntry struct {
+	Time       time.Time       `json:"time"`
+	Action     string          `json:"action"`
+	Dataset    string          `json:"dataset,omitempty"` // Of the daemon's manifest
+	Csv        string          `json:"csv,omitempty"`
+	DurationMs float64         `json:"durationMs"`
+	Rows       *int64          `json:"rows,omitempty"`
+	Strategy   string          `json:"strategy,omitempty"`
+	Index      string          `json:"index,omitempty"`
+	Class      string          `json:"class,omitempty"` // Execution slot class: lookup or scan
+	Cost       int64           `json:"cost,omitempty"`  // Bytes it was expected to read
+	Error      string          `json:"error,omitempty"`
+	Slow       bool            `json:"slow,omitempty"`
+	Request    json.RawMessage `json:"request,omitempty"` // Slow requests only
+	Plan       json.RawMessage `json:"plan,omitempty"`    // Slow queries only
+}
+
+// requestLog writes the request log.
+type requestLog struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer // nil for stderr
+	all     bool      // Log every request, not only slow ones
+	slow    time.Duration
+	dataset string
+}
+
+// newRequestLog opens the log: path ("-" = stderr; "" = stderr for slow
+// queries only) and the slow-query threshold (0 = none). nil means no log.
+func newRequestLog(path string, slow time.Duration, dataset string) (*requestLog, error) {
+	if path == "" && slow <= 0 {
+		return nil, nil
+	}
+	l := &requestLog{all: path != "", slow: slow, dataset: dataset}
+	if path == "" || path == "-" {
+		l.w = bufio.NewWriter(os.Stderr)
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.w, l.closer = bufio.NewWriter(f), f
+	return l, nil
+}
+
+// log writes the entry of a finished request. plan is called for slow
+// requests only.
+func (l *requestLog) log(t *requestTrace, request, response []byte, elapsed time.Duration, plan func() json.RawMessage) {
+	slow := l.slow > 0 && elapsed >= l.slow
+	if !l.all && !slow {
+		return
+	}
+	entry := logEntry{
+		Time:       time.Now().UTC(),
+		Action:     t.action,
+		Dataset:    l.dataset,
+		Csv:        t.csv,
+		DurationMs: float64(elapsed.Microseconds()) / 1000,
+		Index:      t.index,
+		Strategy:   t.strategy,
+		Class:      t.class,
+		Cost:       t.cost,
+		Slow:       slow,
+	}
+	entry.Rows, entry.Error = responseRows(response)
+	if slow {
+		entry.Request = json.RawMessage(request)
+		entry.Plan = plan()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(b)
+	_ = l.w.WriteByte('\n')
+	_ = l.w.Flush()
+}
+
+// responseRows reads the row count and error of a response: its count,
+// or the number of rows or groups it returned or changed.
+func responseRows(response []byte) (*int64, string) {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(response, &resp) != nil {
+		return nil, ""
+	}
+	var errMsg string
+	_ = json.Unmarshal(resp["error"], &errMsg)
+	for _, key := range []string{"count", "written", "updated", "deleted", "rows", "groups"} {
+		raw, ok := resp[key]
+		if !ok {
+			continue
+		}
+		var n int64
+		var items []json.RawMessage
+		var groups map[string]json.RawMessage
+		switch {
+		case json.Unmarshal(raw, &n) == nil:
+		case json.Unmarshal(raw, &items) == nil:
+			n = int64(len(items))
+		case json.Unmarshal(raw, &groups) == nil:
+			n = int64(len(groups))
+		default:
+			continue
+		}
+		return &n, errMsg
+	}
+	return nil, errMsg
+}
+
+func (l *requestLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.w.Flush()
+	if l.closer != nil {
+		_ = l.closer.Close()
+	}
+}
+
+// explainPlan answers a slow query's request again as explain, for the
+// log. Other actions have no plan.
+func (d *UDSDaemon) explainPlan(request []byte) json.RawMessage {
+	var req DaemonRequest
+	if json.Unmarshal(request, &req) != nil {
+		return nil
+	}
+	switch req.Action {
+	case "groupby":
+		if req.GroupBy == "" {
+			req.GroupBy = req.Column
+		}
+	case "count", "select", "query", "update", "delete":
+	default:
+		return nil
+	}
+	req.Action = "explain"
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(d.processRequest(body, nil, nil), &resp) != nil {
+		return nil
+	}
+	if plan := resp["data"]; plan != nil {
+		return plan
+	}
+	return resp["error"]
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// Execution slots. A connection holds a worker slot (--workers) while it
+// is open; each query it runs also takes an execution slot once its plan
+// tells whether it reads the whole CSV (see query.QueryConfig.Admit).
+// Full scans share --scan-workers slots and index lookups --lookup-workers
+// slots, so scans queue behind each other while lookups keep running
+// beside them. Each full scan already reads the CSV with every CPU, so a
+// few at a time keep the disks and CPUs busy. Requests that read no rows
+// (explain, status, fetch, keyset) take no execution slot.
+//
+// Cost budget. Queries expected to read more than --max-query-cost bytes
+// are refused with their cost and the index that would serve them (see
+// query/admit.go). Below that, --cost-budget caps the bytes all running
+// queries together are expected to read: a query waits for its share
+// before it takes a slot, so a few large scans leave room for lookups
+// without starving them of disk. A query costing more than the whole
+// budget runs alone; one of unknown cost takes none of it.
+//
+// Scheduling. Waiting queries queue by request priority ("high",
+// "normal" or "low"), then arrival. When a slot or budget frees, the
+// queue is served in that order: a waiter whose class has a free slot
+// runs if its cost fits, and one whose cost does not fit keeps the budget
+// for itself from the costed waiters behind it, so a large scan is not
+// starved by a stream of smaller ones. Interactive callers send high
+// priority lookups, which then run before the scans queued for the budget.
+// A waiter whose deadline passes leaves the queue with a timeout.
+
+// DefaultScanWorkers is how many full scans run at once by default.
+const DefaultScanWorkers = 4
+
+// Request priorities, as DaemonRequest.Priority names them.
+const (
+	priorityLow    = -1
+	priorityNormal = 0
+	priorityHigh   = 1
+)
+
+// parsePriority returns the priority a request names ("" = normal).
+func parsePriority(name string) (int, error) {
+	switch name {
+	case "high":
+		return priorityHigh, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q (high, normal or low)", name)
+}
+
+// scheduler hands out the execution slots of each query class and the
+// cost budget to waiting queries, in priority order.
+type scheduler struct {
+	mu     sync.Mutex
+	max    map[string]int // Slots of each class
+	busy   map[string]int
+	budget int64 // Bytes running queries may cost together (0 = no limit)
+	used   int64
+	queue  []*waiter // By priority, then arrival
+}
+
+// waiter is a query waiting for a slot.
+type waiter struct {
+	ctx      context.Context
+	class    string
+	cost     int64
+	priority int
+	granted  chan struct{} // Closed when it may run
+}
+
+func newScheduler(lookups, scans int, budget int64) *scheduler {
+	return &scheduler{
+		max:    map[string]int{query.ClassLookup: lookups, query.ClassScan: scans},
+		busy:   map[string]int{},
+		budget: max(budget, 0),
+	}
+}
+
+// admit takes an execution slot of class and its budget share for a
+// query of priority expected to read cost bytes, waiting until both are
+// free or ctx is done.
+func (s *scheduler) admit(ctx context.Context, class string, cost int64, priority int) (func(), error) {
+	if s.budget > 0 {
+		cost = min(cost, s.budget)
+	}
+	w := &waiter{ctx: ctx, class: class, cost: max(cost, 0), priority: priority, granted: make(chan struct{})}
+	s.mu.Lock()
+	at := len(s.queue)
+	for at > 0 && s.queue[at-1].priority < priority {
+		at--
+	}
+	s.queue = slices.Insert(s.queue, at, w)
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return func() { s.release(w) }, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := slices.Index(s.queue, w); i >= 0 {
+		s.queue = slices.Delete(s.queue, i, i+1)
+		s.dispatch() // It may have held the budget for those behind it
+		what := class + " slot"
+		if s.busy[class] < s.max[class] {
+			what = fmt.Sprintf("budget for a %s of %d bytes", class, w.cost)
+		}
+		return nil, fmt.Errorf("no %s free: %w", what, context.Cause(ctx))
+	}
+	// Granted as ctx ended: give the slot back
+	s.free(w)
+	return nil, fmt.Errorf("no %s slot free: %w", class, context.Cause(ctx))
+}
+
+// release gives back the slot and budget share of a query that ran.
+func (s *scheduler) release(w *waiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free(w)
+}
+
+func (s *scheduler) free(w *waiter) {
+	s.busy[w.class]--
+	s.used -= w.cost
+	s.dispatch()
+}
+
+// dispatch lets the waiters run that can, in queue order. The caller
+// holds s.mu.
+func (s *scheduler) dispatch() {
+	reserved := false // A costed waiter ahead is waiting for the budget
+	kept := s.queue[:0]
+	for _, w := range s.queue {
+		if w.ctx.Err() != nil || s.busy[w.class] >= s.max[w.class] {
+			kept = append(kept, w) // Leaves, or waits for a slot of its class
+			continue
+		}
+		if w.cost > 0 && (reserved || (s.budget > 0 && s.used+w.cost > s.budget)) {
+			reserved = true
+			kept = append(kept, w)
+			continue
+		}
+		s.busy[w.class]++
+		s.used += w.cost
+		close(w.granted)
+	}
+	clear(s.queue[len(kept):])
+	s.queue = kept
+}
+
+// status reports the busy, total and queued slots of each class and the
+// budget in use, for status.
+func (s *scheduler) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := map[string]int{}
+	for _, w := range s.queue {
+		queued[w.class]++
+	}
+	st := map[string]interface{}{}
+	for class, n := range s.max {
+		st[class] = map[string]int{"busy": s.busy[class], "max": n, "queued": queued[class]}
+	}
+	if s.budget > 0 {
+		st["costBudget"] = map[string]int64{"used": s.used, "max": s.budget}
+	}
+	return st
+}
+
+// admitter returns the QueryConfig.Admit of a request's queries.
+func (d *UDSDaemon) admitter(req DaemonRequest) func(context.Context, string, int64) (func(), error) {
+	return func(ctx context.Context, class string, cost int64) (func(), error) {
+		return d.sched.admit(ctx, class, cost, req.priority)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// admitted is the outcome of an admit run in the background.
+type admitted struct {
+	name    string
+	release func()
+	err     error
+}
+
+// admitAsync runs admit in a goroutine, sending its outcome to done.
+func admitAsync(s *scheduler, ctx context.Context, name, class string, cost int64, priority int, done chan<- admitted) {
+	go func() {
+		release, err := s.admit(ctx, class, cost, priority)
+		done <- admitted{name, release, err}
+	}()
+}
+
+// waitQueued waits until n queries are queued.
+func waitQueued(t *testing.T, s *scheduler, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		queued := len(s.queue)
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf("%d queries never queued", n)
+}
+
+// expectNone fails if a query was admitted.
+func expectNone(t *testing.T, done <-chan admitted) {
+	t.Helper()
+	select {
+	case a := <-done:
+		t.Fatalf("%s admitted (%v) while it should wait", a.name, a.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSchedulerPriorityOrder(t *testing.T) {
+	s := newScheduler(1, 1, 0)
+	hold, err := s.admit(context.Background(), query.ClassLookup, 0, priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan admitted)
+	for i, w := range []struct {
+		name     string
+		priority int
+	}{{"low", priorityLow}, {"normal", priorityNormal}, {"high", priorityHigh}, {"normal2", priorityNormal}} {
+		admitAsync(s, context.Background(), w.name, query.ClassLookup, 0, w.priority, done)
+		waitQueued(t, s, i+1)
+	}
+
+	hold()
+	var order []string
+	for range 4 {
+		a := <-done
+		if a.err != nil {
+			t.Fatal(a.err)
+		}
+		order = append(order, a.name)
+		a.release()
+	}
+	if got, want := order, []string{"high", "normal", "normal2", "low"}; !slices.Equal(got, want) {
+		t.Errorf("Admitted %v, want %v", got, want)
+	}
+}
+
+func TestSchedulerDeadlineWhileQueued(t *testing.T) {
+	s := newScheduler(1, 1, 0)
+	hold, err := s.admit(context.Background(), query.ClassScan, 0, priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	release, err := s.admit(ctx, query.ClassScan, 0, priorityHigh)
+	if err == nil {
+		release()
+		t.Fatal("Admitted past its deadline")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error %v, want a deadline", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) != 0 || s.busy[query.ClassScan] != 1 {
+		t.Errorf("After the deadline: %d queued, %d busy", len(s.queue), s.busy[query.ClassScan])
+	}
+}
+
+func TestSchedulerGrantRacingCancel(t *testing.T) {
+	s := newScheduler(1, 1, 100)
+	for range 500 {
+		hold, err := s.admit(context.Background(), query.ClassLookup, 40, priorityNormal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan admitted)
+		admitAsync(s, ctx, "waiter", query.ClassLookup, 70, priorityNormal, done)
+		waitQueued(t, s, 1)
+
+		// The release grants the waiter as it is canceled: either way, it
+		// must end up holding nothing or its whole share
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); hold() }()
+		go func() { defer wg.Done(); cancel() }()
+		wg.Wait()
+		if a := <-done; a.err == nil {
+			a.release()
+		}
+
+		s.mu.Lock()
+		busy, used, queued := s.busy[query.ClassLookup], s.used, len(s.queue)
+		s.mu.Unlock()
+		if busy != 0 || used != 0 || queued != 0 {
+			t.Fatalf("After the race: %d busy, %d bytes used, %d queued", busy, used, queued)
+		}
+	}
+}
+
+func TestSchedulerReservedBudget(t *testing.T) {
+	s := newScheduler(4, 4, 100)
+	running, err := s.admit(context.Background(), query.ClassScan, 60, priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large, small, free := make(chan admitted), make(chan admitted), make(chan admitted)
+	admitAsync(s, context.Background(), "large", query.ClassScan, 80, priorityNormal, large)
+	waitQueued(t, s, 1)
+	admitAsync(s, context.Background(), "small", query.ClassScan, 30, priorityNormal, small)
+	waitQueued(t, s, 2)
+
+	// The small scan fits beside the running one, but the large one ahead
+	// keeps the budget; a query of unknown cost takes none of it
+	expectNone(t, small)
+	admitAsync(s, context.Background(), "free", query.ClassLookup, 0, priorityNormal, free)
+	if a := <-free; a.err != nil {
+		t.Fatal(a.err)
+	} else {
+		a.release()
+	}
+	expectNone(t, large)
+
+	running()
+	a := <-large
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	expectNone(t, small) // 80 + 30 is over the budget
+	a.release()
+	if a := <-small; a.err != nil {
+		t.Fatal(a.err)
+	} else {
+		a.release()
+	}
+
+	// A query costing more than the whole budget runs alone
+	huge := make(chan admitted)
+	admitAsync(s, context.Background(), "huge", query.ClassScan, 500, priorityNormal, huge)
+	a = <-huge
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	if st := s.status()["costBudget"].(map[string]int64); st["used"] != 100 {
+		t.Errorf("Huge query holds %d of the budget, want all 100", st["used"])
+	}
+	a.release()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Unix socket access. The socket file is created with the process umask,
+// so on a multi-user host anyone may connect. DaemonConfig.SocketMode,
+// SocketOwner and SocketGroup restrict it: the socket is bound with no
+// access for anyone but the daemon's user, handed to the owner and group,
+// and only then opened up to the mode, so no other user can connect in
+// between. On Linux a socket address starting with "@" is in the abstract
+// namespace: there is no file to remove, chmod or leave behind, and any
+// process of the network namespace can connect, so it suits containers
+// more than shared hosts.
+
+// defaultSocketMode is the mode of a socket given an owner or group but
+// no mode: read and write for the owner and the group.
+const defaultSocketMode os.FileMode = 0660
+
+// abstractSocket reports whether a socket address is in the abstract
+// namespace.
+func abstractSocket(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// listenUnix binds the daemon's Unix socket with the configured access.
+func (d *UDSDaemon) listenUnix() (net.Listener, error) {
+	address := d.config.Address
+	restricted := d.config.SocketMode != 0 || d.config.SocketOwner != "" || d.config.SocketGroup != ""
+	if abstractSocket(address) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("abstract socket %s: only Linux has them", address)
+		}
+		if restricted {
+			return nil, fmt.Errorf("abstract socket %s has no file to set a mode, owner or group on", address)
+		}
+		return net.Listen("unix", address)
+	}
+	if !restricted {
+		return net.Listen("unix", address)
+	}
+
+	listener, err := listenPrivate(address)
+	if err != nil {
+		return nil, err
+	}
+	mode := d.config.SocketMode
+	if mode == 0 {
+		mode = defaultSocketMode
+	}
+	if err := chownSocket(address, d.config.SocketOwner, d.config.SocketGroup); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	if err := os.Chmod(address, mode); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set the socket mode: %w", err)
+	}
+	return listener, nil
+}
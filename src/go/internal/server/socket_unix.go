@@ -0,0 +1,55 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// listenPrivate binds a Unix socket only its owner can connect to. The
+// umask is process-wide; the daemon binds before serving anything.
+func listenPrivate(address string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", address)
+}
+
+// chownSocket hands the socket file to a user and group, given by name or
+// numeric id ("" = unchanged).
+func chownSocket(path, owner, group string) error {
+	uid, gid := -1, -1
+	if owner != "" {
+		id := owner
+		if _, err := strconv.Atoi(owner); err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return fmt.Errorf("socket owner: %w", err)
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if group != "" {
+		id := group
+		if _, err := strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return fmt.Errorf("socket group: %w", err)
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to set the socket owner: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenPrivate binds a Unix socket. Windows has no umask; the socket
+// file gets the access of its directory.
+func listenPrivate(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
+
+// chownSocket refuses socket owners and groups, which Windows does not
+// have.
+func chownSocket(path, owner, group string) error {
+	if owner != "" || group != "" {
+		return fmt.Errorf("socket owner and group are not supported on Windows")
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// Spooled selects. A select answers with all its rows in one response,
+// which the daemon builds in memory: a result of millions of rows holds
+// as many row references, then their JSON. A select with "spool":true
+// writes its rows to a temp file in --spool-dir as the engine finds them
+// instead, in pages of "pageSize" rows, each page an LZ4 frame, and
+// answers with the spool's id and its row and page counts. The client
+// reads the pages with the "page" action, in any order and as often as it
+// needs, then closes the spool ("close":true); a spool left idle for
+// spoolIdleTimeout is removed. The daemon holds one page in memory per
+// request, and the file offsets of the pages.
+
+// Spool limits.
+const (
+	defaultSpoolPage = 10000
+	maxSpoolPage     = 100000
+	maxSpools        = 64
+	spoolIdleTimeout = 10 * time.Minute
+)
+
+// errNoPage is a page request outside the pages of its spool.
+var errNoPage = errors.New("no such page")
+
+// spoolRecordSize is the bytes of a row in a spool page: its offset and
+// line, little-endian.
+const spoolRecordSize = 16
+
+// spool is the file of the rows of a spooled select.
+type spool struct {
+	id       string
+	file     *os.File
+	codec    common.Codec
+	pageSize int
+	rows     int64
+	pages    []int64 // File offsets of the pages, then of the end
+	buf      []byte  // Rows of the page being written
+	out      []byte  // Compressed page
+	used     time.Time
+	mu       sync.Mutex // Held by the writer, and by reads (they share the buffers)
+}
+
+// spoolSet is the open spools of a daemon.
+type spoolSet struct {
+	mu     sync.Mutex
+	dir    string // "" = the system temp dir
+	spools map[string]*spool
+}
+
+func newSpoolSet(dir string) *spoolSet {
+	return &spoolSet{dir: dir, spools: make(map[string]*spool)}
+}
+
+// create opens a spool of pages of pageSize rows, locked for its writer.
+func (s *spoolSet) create(pageSize int) (*spool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if len(s.spools) >= maxSpools {
+		return nil, fmt.Errorf("%d spools open: close those read", maxSpools)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(s.dir, "csvquery-spool-*.lz4")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	codec, _ := common.NewCodec(common.CodecLZ4)
+	sp := &spool{id: hex.EncodeToString(id), file: file, codec: codec, pageSize: pageSize, pages: []int64{0}, used: time.Now()}
+	sp.mu.Lock()
+	s.spools[sp.id] = sp
+	return sp, nil
+}
+
+// get returns the spool of id, nil if closed or expired.
+func (s *spoolSet) get(id string) *spool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	sp := s.spools[id]
+	if sp != nil {
+		sp.used = time.Now()
+	}
+	return sp
+}
+
+// remove closes the spool of id and deletes its file.
+func (s *spoolSet) remove(id string) bool {
+	s.mu.Lock()
+	sp := s.spools[id]
+	delete(s.spools, id)
+	s.mu.Unlock()
+	if sp == nil {
+		return false
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.discard()
+	return true
+}
+
+// expire removes the spools idle for spoolIdleTimeout. The caller holds
+// s.mu.
+func (s *spoolSet) expire() {
+	for id, sp := range s.spools {
+		if time.Since(sp.used) > spoolIdleTimeout && sp.mu.TryLock() {
+			delete(s.spools, id)
+			sp.discard()
+			sp.mu.Unlock()
+		}
+	}
+}
+
+// closeAll removes every spool, on shutdown.
+func (s *spoolSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sp := range s.spools {
+		delete(s.spools, id)
+		sp.mu.Lock()
+		sp.discard()
+		sp.mu.Unlock()
+	}
+}
+
+// add appends a row to the spool.
+func (sp *spool) add(ref query.RowRef) error {
+	sp.buf = binary.LittleEndian.AppendUint64(sp.buf, uint64(ref.Offset))
+	sp.buf = binary.LittleEndian.AppendUint64(sp.buf, uint64(ref.Line))
+	sp.rows++
+	if len(sp.buf) == sp.pageSize*spoolRecordSize {
+		return sp.flush()
+	}
+	return nil
+}
+
+// flush writes the rows of the page being written as a page.
+func (sp *spool) flush() error {
+	if len(sp.buf) == 0 {
+		return nil
+	}
+	var err error
+	if sp.out, err = sp.codec.Compress(sp.out[:0], sp.buf); err != nil {
+		return err
+	}
+	if _, err := sp.file.Write(sp.out); err != nil {
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	sp.pages = append(sp.pages, sp.pages[len(sp.pages)-1]+int64(len(sp.out)))
+	sp.buf = sp.buf[:0]
+	return nil
+}
+
+// page reads the rows of page n, and returns the pages of the spool.
+func (sp *spool) page(n int) ([]query.RowRef, int, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	pages := len(sp.pages) - 1
+	switch {
+	case sp.file == nil:
+		return nil, 0, fmt.Errorf("spool %s is closed", sp.id)
+	case pages == 0 && n == 0:
+		return []query.RowRef{}, 0, nil
+	case n < 0 || n >= pages:
+		return nil, pages, fmt.Errorf("%w: page %d is outside the spool's %d pages", errNoPage, n, pages)
+	}
+	size := int(sp.pages[n+1] - sp.pages[n])
+	sp.out = slices.Grow(sp.out[:0], size)[:size]
+	if _, err := sp.file.ReadAt(sp.out, sp.pages[n]); err != nil {
+		return nil, pages, fmt.Errorf("failed to read spool: %w", err)
+	}
+	var err error
+	if sp.buf, err = sp.codec.Decompress(sp.buf[:0], sp.out); err != nil {
+		return nil, pages, fmt.Errorf("corrupt spool page %d: %w", n, err)
+	}
+	rows := make([]query.RowRef, len(sp.buf)/spoolRecordSize)
+	for i := range rows {
+		rec := sp.buf[i*spoolRecordSize:]
+		rows[i] = query.RowRef{Offset: int64(binary.LittleEndian.Uint64(rec)), Line: int64(binary.LittleEndian.Uint64(rec[8:]))}
+	}
+	return rows, pages, nil
+}
+
+// discard closes and deletes the spool file. The caller holds sp.mu.
+func (sp *spool) discard() {
+	if sp.file == nil {
+		return
+	}
+	_ = sp.file.Close()
+	_ = os.Remove(sp.file.Name())
+	sp.file = nil
+}
+
+// spoolSelect runs a select into a spool (see above).
+func (d *UDSDaemon) spoolSelect(req DaemonRequest, cfg query.QueryConfig) []byte {
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultSpoolPage
+	}
+	if pageSize > maxSpoolPage {
+		return d.errorResponse(fmt.Sprintf("pageSize is at most %d", maxSpoolPage))
+	}
+	sp, err := d.spools.create(pageSize)
+	if err != nil {
+		return d.errorFor(err)
+	}
+
+	var writeErr error
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &query.Result{OnRow: func(ref query.RowRef) {
+		if writeErr == nil {
+			writeErr = sp.add(ref)
+		}
+	}}
+	err = engine.Run()
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = sp.flush()
+	}
+	rows, pages := sp.rows, len(sp.pages)-1
+	sp.mu.Unlock()
+	if err != nil {
+		d.spools.remove(sp.id)
+		return d.errorFor(err)
+	}
+	d.spools.get(sp.id) // Idle from now
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+
+	return d.successResponse(map[string]interface{}{
+		"spool":    sp.id,
+		"rows":     rows,
+		"pages":    pages,
+		"pageSize": pageSize,
+		"cursor":   nextCursor(engine),
+	})
+}
+
+// handlePage returns a page of a spooled select, or closes the spool.
+func (d *UDSDaemon) handlePage(req DaemonRequest) []byte {
+	if req.SpoolID == "" {
+		return d.errorResponse("spoolId is required")
+	}
+	if req.Close {
+		return d.successResponse(map[string]interface{}{"closed": d.spools.remove(req.SpoolID)})
+	}
+	sp := d.spools.get(req.SpoolID)
+	if sp == nil {
+		return codedResponse(query.CodeNotFound, fmt.Sprintf("no spool %s: closed, or idle for over %v", req.SpoolID, spoolIdleTimeout))
+	}
+	rows, pages, err := sp.page(req.Page)
+	if errors.Is(err, errNoPage) {
+		return d.errorResponse(err.Error())
+	}
+	if err != nil {
+		return d.errorFor(err)
+	}
+	var next interface{}
+	if req.Page+1 < pages {
+		next = req.Page + 1
+	}
+	return d.successResponse(map[string]interface{}{"rows": rows, "page": req.Page, "pages": pages, "next": next})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/entreya/csvquery/internal/query"
+)
+
+// request runs a JSON request on d and decodes its response.
+func request(t *testing.T, d *UDSDaemon, req string) map[string]interface{} {
+	t.Helper()
+	var resp map[string]interface{}
+	if err := json.Unmarshal(d.processRequest([]byte(req), nil, nil), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// spoolRows returns the offsets of a response's rows.
+func spoolRows(t *testing.T, resp map[string]interface{}) []int64 {
+	t.Helper()
+	rows, ok := resp["rows"].([]interface{})
+	if !ok {
+		t.Fatalf("no rows in %v", resp)
+	}
+	out := []int64{}
+	for _, r := range rows {
+		out = append(out, int64(r.(map[string]interface{})["offset"].(float64)))
+	}
+	return out
+}
+
+func TestSpoolSelect(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("id,city\n")
+	for i := range 250 {
+		fmt.Fprintf(&b, "%d,%s\n", i, []string{"Paris", "Rome"}[i%5/4])
+	}
+	d := newTestDaemon(t, b.String())
+	spoolDir := t.TempDir()
+	d.spools = newSpoolSet(spoolDir)
+
+	for _, tc := range []struct {
+		name     string
+		where    string
+		pageSize int
+		pages    int
+	}{
+		{"several pages", `{"city":"Paris"}`, 40, 5},
+		{"one page", `{"city":"Rome"}`, 0, 1},
+		{"exact pages", `{"city":"Rome"}`, 10, 5},
+		{"no rows", `{"city":"Oslo"}`, 10, 0},
+	} {
+		want := spoolRows(t, request(t, d, `{"action":"select","where":`+tc.where+`}`))
+		resp := request(t, d, fmt.Sprintf(`{"action":"select","where":%s,"spool":true,"pageSize":%d}`, tc.where, tc.pageSize))
+		id, _ := resp["spool"].(string)
+		if id == "" {
+			t.Errorf("%s: no spool in %v", tc.name, resp)
+			continue
+		}
+		if int(resp["rows"].(float64)) != len(want) || int(resp["pages"].(float64)) != tc.pages {
+			t.Errorf("%s: %v rows in %v pages, want %d in %d", tc.name, resp["rows"], resp["pages"], len(want), tc.pages)
+		}
+
+		got := []int64{}
+		for page := 0; ; page++ {
+			resp := request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"page":%d}`, id, page))
+			if resp["error"] != nil {
+				t.Fatalf("%s: page %d: %v", tc.name, page, resp["error"])
+			}
+			got = append(got, spoolRows(t, resp)...)
+			if resp["next"] == nil {
+				break
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: spooled rows %v, want %v", tc.name, got, want)
+		}
+
+		// Pages read again, in any order
+		if tc.pages > 1 {
+			last := spoolRows(t, request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"page":%d}`, id, tc.pages-1)))
+			first := spoolRows(t, request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"page":0}`, id)))
+			if !reflect.DeepEqual(first, want[:len(first)]) || !reflect.DeepEqual(last, want[len(want)-len(last):]) {
+				t.Errorf("%s: pages read again: %v and %v", tc.name, first, last)
+			}
+		}
+		if resp := request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"page":%d}`, id, tc.pages+1)); resp["code"] != codeBadRequest {
+			t.Errorf("%s: page past the end: %v", tc.name, resp)
+		}
+
+		if resp := request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"close":true}`, id)); resp["closed"] != true {
+			t.Errorf("%s: close: %v", tc.name, resp)
+		}
+		if resp := request(t, d, fmt.Sprintf(`{"action":"page","spoolId":%q,"page":0}`, id)); resp["code"] != query.CodeNotFound {
+			t.Errorf("%s: page of a closed spool: %v", tc.name, resp)
+		}
+	}
+	if files, _ := os.ReadDir(spoolDir); len(files) != 0 {
+		t.Errorf("%d spool files left after closing", len(files))
+	}
+
+	for _, req := range []string{
+		`{"action":"select","where":{"city":"Paris"},"spool":true,"pageSize":100001}`,
+		`{"action":"select","where":{"city":"Paris"},"spool":true,"ranges":true}`,
+		`{"action":"page"}`,
+	} {
+		if resp := request(t, d, req); resp["code"] != codeBadRequest {
+			t.Errorf("%s: %v, want a bad request", req, resp)
+		}
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	dir := t.TempDir()
+	s := newSpoolSet(dir)
+	sp, err := s.create(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 25 {
+		if err := sp.add(query.RowRef{Offset: int64(i * 10), Line: int64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	sp.mu.Unlock()
+	rows, pages, err := sp.page(2)
+	if err != nil || pages != 3 || len(rows) != 5 || rows[4] != (query.RowRef{Offset: 240, Line: 25}) {
+		t.Fatalf("page 2: %v of %d pages, %v", rows, pages, err)
+	}
+
+	sp.used = time.Now().Add(-spoolIdleTimeout - time.Second)
+	if s.get(sp.id) != nil {
+		t.Error("idle spool not expired")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left after expiry", len(files))
+	}
+
+	for range maxSpools {
+		sp, err := s.create(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp.mu.Unlock()
+	}
+	if _, err := s.create(10); err == nil {
+		t.Errorf("created spool %d", maxSpools+1)
+	}
+	s.closeAll()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left after closeAll", len(files))
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// GET /ui is the admin console: one page, embedded in the binary, that
+// shows the datasets and metrics of status, the index metadata of the
+// indexes action, and runs queries and explains through POST /request.
+// The page holds no data, so it is served without a token; the requests
+// it sends carry the token typed into it.
+
+//go:embed ui.html
+var uiPage []byte
+
+// serveUI answers GET /ui.
+func (d *UDSDaemon) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(uiPage)
+	}
+}
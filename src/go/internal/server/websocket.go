@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal WebSocket (RFC 6455) server side: the upgrade handshake and
+// framing of text messages, with ping, pong and close handled internally.
+// Extensions and subprotocols are not negotiated.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsGUID is appended to the client's key to form the accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage bounds a message from the client (requests are small).
+const wsMaxMessage = 16 << 20
+
+// wsConn is an upgraded WebSocket connection. Reads must come from one
+// goroutine; writes may come from any.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// upgradeWebSocket answers the handshake of a WebSocket request and takes
+// over its connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	_, _ = io.WriteString(h, key+wsGUID)
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// headerHas reports whether a comma-separated header lists token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message. Pings are answered
+// and pongs skipped; a close frame is echoed and ends the connection with
+// io.EOF.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeMessage(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			if len(payload) >= 2 {
+				payload = payload[:2] // Echo the status code only
+			}
+			_ = c.writeMessage(wsClose, payload)
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if message == nil {
+				return 0, nil, errors.New("websocket: continuation without a message")
+			}
+		case wsText, wsBinary:
+			if message != nil {
+				return 0, nil, errors.New("websocket: message inside a fragmented message")
+			}
+			opcode, message = op, []byte{}
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if len(message)+len(payload) > wsMaxMessage {
+			return 0, nil, fmt.Errorf("websocket: message larger than %d bytes", wsMaxMessage)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0F
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket: reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("websocket: client frame not masked")
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsClose && (length > 125 || !fin) {
+		return false, 0, nil, errors.New("websocket: invalid control frame")
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, fmt.Errorf("websocket: message larger than %d bytes", wsMaxMessage)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeMessage sends one unfragmented frame.
+func (c *wsConn) writeMessage(opcode byte, payload []byte) error {
+	head := make([]byte, 0, 10)
+	head = append(head, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(head); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// close sends a close frame with status code and closes the connection.
+func (c *wsConn) close(code uint16) {
+	_ = c.writeMessage(wsClose, binary.BigEndian.AppendUint16(nil, code))
+	_ = c.conn.Close()
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/query"
+	"github.com/entreya/csvquery/internal/updatemgr"
+	"github.com/entreya/csvquery/internal/writer"
+)
+
+// Write actions change the dataset. They run one at a time (writeMu, which
+// index builds take too); the CSV append also takes the writer's file
+// lock, so CLI writes to the same file interleave safely. Updates and
+// deletes go to the update sidecar, which queries apply on top of the CSV,
+// under its writer lock (see updatemgr.Lock), which `csvquery update`
+// takes too. They change the daemon's own --csv only, and are refused on
+// TCP and HTTP listeners without an auth token, so a client that reaches
+// the daemon cannot create or append to other files it may write.
+
+// errForbidden is a request for an action or file the daemon does not
+// open to its client.
+var errForbidden = errors.New("forbidden")
+
+// handleWrite appends rows to the CSV. With reindex, the indexes are
+// brought up to date with an append build before the response, so a
+// following query sees the new rows through them; with deltas, the rows
+// are added to the index deltas instead, which costs a scan of the new
+// rows alone. A dry run checks the header and creates or changes nothing.
+func (d *UDSDaemon) handleWrite(req DaemonRequest) []byte {
+	csvPath, err := d.ownCSV(req.Csv)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	if len(req.Rows) == 0 {
+		return d.errorResponse("rows are required")
+	}
+
+	deltaDir := ""
+	if req.Deltas && !req.Reindex {
+		if d.config.IndexDir == "" {
+			return d.errorResponse("deltas need the daemon's --index-dir")
+		}
+		deltaDir = d.config.IndexDir
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	w := writer.NewCsvWriter(writer.WriterConfig{CsvPath: csvPath, DryRun: req.DryRun, DeltaDir: deltaDir})
+	if err := w.Write(req.Headers, req.Rows); err != nil {
+		return d.errorFor(fmt.Errorf("write failed: %w", err))
+	}
+	if req.DryRun {
+		return d.successResponse(map[string]interface{}{"written": len(req.Rows), "dryRun": true})
+	}
+	if err := d.reloadCSV(csvPath); err != nil {
+		return d.errorFor(err)
+	}
+
+	resp := map[string]interface{}{"written": len(req.Rows)}
+	if deltaDir != "" {
+		resp["deltas"] = true
+	}
+	if req.Reindex {
+		if d.config.IndexDir == "" {
+			return d.errorResponse("rows written, but reindex needs the daemon's --index-dir")
+		}
+		if err := indexer.AppendIndexes(csvPath, d.config.IndexDir, d.publish, io.Discard); err != nil {
+			return d.errorFor(fmt.Errorf("rows written, but reindex failed: %w", err))
+		}
+		resp["reindexed"] = true
+	}
+	return d.successResponse(resp)
+}
+
+// handleUpdate sets the columns of req.Set in every row matching the filter.
+func (d *UDSDaemon) handleUpdate(req DaemonRequest) []byte {
+	if len(req.Set) == 0 {
+		return d.errorResponse("set is required")
+	}
+	return d.changeRows(req, "updated", func(um *updatemgr.UpdateManager, offset int64) {
+		for col, val := range req.Set {
+			um.Set(offset, col, val)
+		}
+	})
+}
+
+// handleDelete marks every row matching the filter as deleted.
+func (d *UDSDaemon) handleDelete(req DaemonRequest) []byte {
+	return d.changeRows(req, "deleted", func(um *updatemgr.UpdateManager, offset int64) {
+		um.Delete(offset)
+	})
+}
+
+// changeRows applies change to the rows matching the request's filter and
+// saves the update sidecar; a dry run only counts them. A filter is
+// required: an empty one would change every row.
+func (d *UDSDaemon) changeRows(req DaemonRequest, what string, change func(*updatemgr.UpdateManager, int64)) []byte {
+	csvPath, err := d.ownCSV(req.Csv)
+	if err != nil {
+		return d.errorFor(err)
+	}
+	if len(req.Where) == 0 && req.InSet == "" {
+		return d.errorResponse("where is required")
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+
+	d.indexMu.RLock()
+	offsets, err := d.matchOffsets(csvPath, req)
+	d.indexMu.RUnlock()
+	if err != nil {
+		return d.errorFor(err)
+	}
+	if req.DryRun {
+		return d.successResponse(map[string]interface{}{what: len(offsets), "dryRun": true})
+	}
+	if len(offsets) > 0 {
+		unlock, err := updatemgr.Lock(csvPath)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		defer unlock()
+		um, err := updatemgr.Load(csvPath)
+		if err != nil {
+			return d.errorFor(err)
+		}
+		if d.config.UpdatesLog {
+			um.UseLog()
+		}
+		for _, offset := range offsets {
+			change(um, offset)
+		}
+		if err := um.Save(); err != nil {
+			return d.errorFor(fmt.Errorf("failed to save updates: %w", err))
+		}
+	}
+	return d.successResponse(map[string]interface{}{what: len(offsets)})
+}
+
+// matchOffsets returns the byte offsets of the rows matching the request.
+func (d *UDSDaemon) matchOffsets(csvPath string, req DaemonRequest) ([]int64, error) {
+	cond, err := d.parseWhere(req.Where)
+	if err != nil {
+		return nil, err
+	}
+	cfg := query.QueryConfig{
+		CsvPath:  csvPath,
+		IndexDir: d.config.IndexDir,
+		Where:    cond,
+		Verbose:  req.Verbose,
+	}
+	d.applyLimits(&cfg, req)
+	if err := d.applyKeySet(&cfg, req); err != nil {
+		return nil, err
+	}
+
+	var result query.Result
+	engine := query.NewQueryEngine(cfg)
+	engine.Result = &result
+	if err := engine.Run(); err != nil {
+		return nil, err
+	}
+	d.recordRun(req, cfg.CsvPath, cfg.IndexDir, engine)
+
+	offsets := make([]int64, len(result.Rows))
+	for i, row := range result.Rows {
+		offsets[i] = row.Offset
+	}
+	return offsets, nil
+}
+
+// reloadCSV maps the daemon's CSV again after a write to it, so status
+// reports its new size. Writes to other CSVs need nothing.
+func (d *UDSDaemon) reloadCSV(csvPath string) error {
+	if d.config.CsvPath == "" || !sameFile(csvPath, d.config.CsvPath) {
+		return nil
+	}
+	if err := d.loadCSV(); err != nil {
+		return fmt.Errorf("rows written, but failed to reload CSV: %w", err)
+	}
+	return nil
+}
+
+// ownCSV returns the daemon's CSV for a request naming csvPath ("" = the
+// daemon's), failing when it names another file or the daemon has none.
+func (d *UDSDaemon) ownCSV(csvPath string) (string, error) {
+	own := d.config.CsvPath
+	switch {
+	case own == "":
+		return "", fmt.Errorf("%w: the daemon serves no CSV (daemon --csv)", errForbidden)
+	case csvPath == "" || sameFile(csvPath, own) || samePath(csvPath, own):
+		return own, nil
+	}
+	return "", fmt.Errorf("%w: the daemon serves %s only, not %s", errForbidden, filepath.Base(own), csvPath)
+}
+
+// samePath reports whether a and b name the same path, for files that may
+// not exist yet.
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
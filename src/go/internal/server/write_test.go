@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteOwnCSVOnly(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	other := filepath.Join(t.TempDir(), "evil.txt")
+
+	for _, tc := range []struct {
+		name string
+		req  string
+		code string
+	}{
+		{"write elsewhere", `{"action":"write","csv":"` + other + `","headers":["x"],"rows":[["pwned"]]}`, codeForbidden},
+		{"update elsewhere", `{"action":"update","csv":"` + other + `","where":{"id":"1"},"set":{"name":"x"}}`, codeForbidden},
+		{"delete elsewhere", `{"action":"delete","csv":"` + other + `","where":{"id":"1"}}`, codeForbidden},
+		{"reindex elsewhere", `{"action":"reindex","csv":"` + other + `"}`, codeForbidden},
+		{"write", `{"action":"write","rows":[["4","dee","Lima"]]}`, ""},
+		{"write by name", `{"action":"write","csv":"` + d.config.CsvPath + `","rows":[["5","eve","Rome"]]}`, ""},
+		{"update", `{"action":"update","where":{"id":"1"},"set":{"name":"al"}}`, ""},
+	} {
+		resp := request(t, d, tc.req)
+		if code, _ := resp["code"].(string); code != tc.code {
+			t.Errorf("%s: %v, want code %q", tc.name, resp, tc.code)
+		}
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Errorf("write elsewhere created %s: %v", other, err)
+	}
+	if data, _ := os.ReadFile(d.config.CsvPath); !strings.HasSuffix(string(data), "4,dee,Lima\n5,eve,Rome\n") {
+		t.Errorf("CSV after writes: %q", data)
+	}
+
+	// Without a CSV of its own, the daemon writes nowhere
+	d.config.CsvPath = ""
+	if resp := request(t, d, `{"action":"write","csv":"`+other+`","headers":["x"],"rows":[["pwned"]]}`); resp["code"] != codeForbidden {
+		t.Errorf("write without --csv: %v", resp)
+	}
+}
+
+func TestWriteNeedsAuthOnNetwork(t *testing.T) {
+	d := newTestDaemon(t, testCSV)
+	const write = `{"action":"write","rows":[["4","dee","Lima"]]}`
+	decode := func(body []byte) map[string]interface{} {
+		var resp map[string]interface{}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A TCP connection without a token, then the Unix socket
+	if resp := decode(d.serve([]byte(write), true, nil)); resp["code"] != codeForbidden {
+		t.Errorf("open listener: %v, want forbidden", resp)
+	}
+	var batch []map[string]interface{}
+	if err := json.Unmarshal(d.serveBatch([]byte("["+write+"]"), true), &batch); err != nil || len(batch) != 1 || batch[0]["code"] != codeForbidden {
+		t.Errorf("open listener batch: %v (%v), want forbidden", batch, err)
+	}
+	if resp := decode(d.serve([]byte(`{"action":"count","where":{"id":"1"}}`), true, nil)); resp["error"] != nil {
+		t.Errorf("query on an open listener: %v", resp)
+	}
+	if resp := decode(d.serve([]byte(write), false, nil)); resp["error"] != nil {
+		t.Errorf("socket: %v", resp)
+	}
+
+	// HTTP without a token, then with one
+	post := func(auth string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/request", strings.NewReader(write))
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+		d.serveHTTPRequest(rec, r)
+		return decode(rec.Body.Bytes())
+	}
+	if resp := post(""); resp["code"] != codeForbidden {
+		t.Errorf("HTTP without a token: %v, want forbidden", resp)
+	}
+	d.config.AuthToken = "secret"
+	if resp := post("secret"); resp["error"] != nil {
+		t.Errorf("HTTP with the token: %v", resp)
+	}
+}
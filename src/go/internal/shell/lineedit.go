@@ -0,0 +1,232 @@
+package shell
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C discards the line.
+var errInterrupted = errors.New("interrupted")
+
+// editor reads lines from a terminal in raw mode: Emacs-style editing keys,
+// history on the arrow keys and tab completion.
+type editor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete func(prefix string) []string // Candidates for the word before the cursor
+
+	prompt string
+	line   []rune
+	pos    int
+}
+
+// readLine reads one line, echoing and editing it. It returns io.EOF on
+// Ctrl-D at an empty line and errInterrupted on Ctrl-C.
+func (e *editor) readLine(prompt string) (string, error) {
+	e.prompt, e.line, e.pos = prompt, e.line[:0], 0
+	hist := len(e.history) // Position in the history; len = the new line
+	var saved []rune       // The new line, while browsing the history
+	e.refresh()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			e.write("\r\n")
+			return string(e.line), nil
+		case 3: // Ctrl-C
+			e.write("^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(e.line) == 0 {
+				e.write("\r\n")
+				return "", io.EOF
+			}
+			e.deleteAt(e.pos)
+		case 1: // Ctrl-A
+			e.pos = 0
+		case 5: // Ctrl-E
+			e.pos = len(e.line)
+		case 2: // Ctrl-B
+			e.pos = max(e.pos-1, 0)
+		case 6: // Ctrl-F
+			e.pos = min(e.pos+1, len(e.line))
+		case 8, 127: // Backspace
+			if e.pos > 0 {
+				e.pos--
+				e.deleteAt(e.pos)
+			}
+		case 11: // Ctrl-K
+			e.line = e.line[:e.pos]
+		case 21: // Ctrl-U
+			e.line = append(e.line[:0], e.line[e.pos:]...)
+			e.pos = 0
+		case 23: // Ctrl-W
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			e.line = append(e.line[:start], e.line[e.pos:]...)
+			e.pos = start
+		case 12: // Ctrl-L
+			e.write("\x1b[H\x1b[2J")
+		case 16, 14: // Ctrl-P, Ctrl-N
+			hist, saved = e.browse(r == 16, hist, saved)
+		case '\t':
+			e.completeWord()
+		case 27: // Escape sequence
+			switch e.escape() {
+			case 'A':
+				hist, saved = e.browse(true, hist, saved)
+			case 'B':
+				hist, saved = e.browse(false, hist, saved)
+			case 'C':
+				e.pos = min(e.pos+1, len(e.line))
+			case 'D':
+				e.pos = max(e.pos-1, 0)
+			case 'H':
+				e.pos = 0
+			case 'F':
+				e.pos = len(e.line)
+			case '3': // Delete
+				e.deleteAt(e.pos)
+			}
+		default:
+			if unicode.IsPrint(r) {
+				e.line = slices.Insert(e.line, e.pos, r)
+				e.pos++
+			}
+		}
+		e.refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence and returns its final key:
+// an arrow (A-D), Home (H), End (F) or Delete (3), or 0 for another.
+func (e *editor) escape() rune {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return 0
+	}
+	var params []rune
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return 0
+		}
+		if r < '0' || r > '9' && r != ';' {
+			break
+		}
+		params = append(params, r)
+	}
+	switch {
+	case r == '~' && len(params) > 0:
+		switch params[0] {
+		case '1', '7':
+			return 'H'
+		case '4', '8':
+			return 'F'
+		case '3':
+			return '3'
+		}
+		return 0
+	case strings.ContainsRune("ABCDHF", r):
+		return r
+	}
+	return 0
+}
+
+// browse moves through the history, keeping the new line aside.
+func (e *editor) browse(back bool, hist int, saved []rune) (int, []rune) {
+	switch {
+	case back && hist > 0:
+		if hist == len(e.history) {
+			saved = slices.Clone(e.line)
+		}
+		hist--
+		e.line = []rune(e.history[hist])
+	case !back && hist < len(e.history):
+		hist++
+		if hist == len(e.history) {
+			e.line = saved
+		} else {
+			e.line = []rune(e.history[hist])
+		}
+	}
+	e.pos = len(e.line)
+	return hist, saved
+}
+
+func (e *editor) deleteAt(i int) {
+	if i < len(e.line) {
+		e.line = slices.Delete(e.line, i, i+1)
+	}
+}
+
+// completeWord completes the word before the cursor: to the candidate if
+// there is one, else as far as the candidates agree, listing them when
+// they agree no further.
+func (e *editor) completeWord() {
+	start := e.pos
+	for start > 0 && isCompletionRune(e.line[start-1]) {
+		start--
+	}
+	prefix := string(e.line[start:e.pos])
+	candidates := e.complete(prefix)
+	if len(candidates) == 0 {
+		return
+	}
+	insert := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		insert += " "
+	}
+	if len([]rune(insert)) <= len([]rune(prefix)) && len(candidates) > 1 {
+		e.write("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+		return
+	}
+	e.line = slices.Concat(e.line[:start], []rune(insert), e.line[e.pos:])
+	e.pos = start + len([]rune(insert))
+}
+
+func isCompletionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '"' || r == '`'
+}
+
+// commonPrefix returns the longest prefix the candidates share, ignoring
+// case, in the case of the first.
+func commonPrefix(candidates []string) string {
+	prefix := []rune(candidates[0])
+	for _, c := range candidates[1:] {
+		rs := []rune(c)
+		n := 0
+		for n < len(prefix) && n < len(rs) && unicode.ToLower(prefix[n]) == unicode.ToLower(rs[n]) {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// refresh redraws the line and puts the cursor in place.
+func (e *editor) refresh() {
+	s := "\r" + e.prompt + string(e.line) + "\x1b[K"
+	if back := len(e.line) - e.pos; back > 0 {
+		s += fmt.Sprintf("\x1b[%dD", back)
+	}
+	e.write(s)
+}
+
+func (e *editor) write(s string) {
+	_, _ = io.WriteString(e.out, s)
+}
@@ -0,0 +1,564 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The shell reads SQL-ish statements:
+//
+//	[EXPLAIN] SELECT <what> [FROM <name>] [WHERE <condition>]
+//	          [GROUP BY <column>] [LIMIT <n> [OFFSET <n>]] [;]
+//
+// <what> is *, a list of columns, COUNT(*), or with GROUP BY the grouped
+// column and one aggregate: COUNT(*), SUM, AVG, MIN or MAX of a column.
+// FROM is accepted and ignored: the shell queries its CSV. Conditions
+// combine =, != (<>), <, <=, >, >=, [NOT] LIKE, REGEXP, IS [NOT] NULL,
+// [NOT] IN (...) and [NOT] BETWEEN ... AND ... with AND, OR, NOT and
+// parentheses, and become the where JSON of the query command.
+
+// statement is a parsed query.
+type statement struct {
+	explain  bool
+	columns  []string // Selected columns ("*" = all); nil for COUNT(*) and GROUP BY
+	count    bool     // SELECT COUNT(*) without GROUP BY
+	groupBy  string
+	aggFunc  string // With groupBy: count, sum, avg, min or max; without, count, min or max
+	aggCol   string
+	where    map[string]any // Condition tree as where JSON (nil = all rows)
+	limit    int
+	offset   int
+	hasLimit bool
+}
+
+// whereJSON returns the where JSON of the statement.
+func (s *statement) whereJSON() []byte {
+	if s.where == nil {
+		return nil
+	}
+	b, _ := json.Marshal(s.where)
+	return b
+}
+
+// names returns every column the statement reads, as written.
+func (s *statement) names() []string {
+	var names []string
+	for _, c := range s.columns {
+		if c != "*" {
+			names = append(names, c)
+		}
+	}
+	if s.groupBy != "" {
+		column, _, _ := strings.Cut(s.groupBy, ":")
+		names = append(names, column)
+	}
+	if s.aggCol != "" {
+		names = append(names, s.aggCol)
+	}
+	return append(names, conditionColumns(s.where)...)
+}
+
+func conditionColumns(c map[string]any) []string {
+	if c == nil {
+		return nil
+	}
+	var names []string
+	if col, ok := c["column"].(string); ok {
+		names = append(names, col)
+	}
+	if children, ok := c["children"].([]map[string]any); ok {
+		for _, child := range children {
+			names = append(names, conditionColumns(child)...)
+		}
+	}
+	return names
+}
+
+// token kinds
+const (
+	tokWord   = iota // Keyword or bare column name
+	tokIdent         // "quoted" or `quoted` column name
+	tokString        // 'string'
+	tokNumber
+	tokSymbol // Operator or punctuation
+	tokEOF
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// tokenize splits a statement into tokens.
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"' || r == '`':
+			kind := tokIdent
+			if r == '\'' {
+				kind = tokString
+			}
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == r {
+					if j+1 < len(rs) && rs[j+1] == r { // Doubled quote
+						sb.WriteRune(r)
+						j++
+						continue
+					}
+					break
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated %c at %d", r, i+1)
+			}
+			toks = append(toks, token{kind, sb.String(), i})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' || r == '.') && i+1 < len(rs) && unicode.IsDigit(rs[i+1]):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, string(rs[i:j]), i})
+			i = j
+		case isWordRune(r):
+			j := i + 1
+			for j < len(rs) && (isWordRune(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == ':') {
+				j++
+			}
+			toks = append(toks, token{tokWord, string(rs[i:j]), i})
+			i = j
+		default:
+			sym := string(r)
+			if i+1 < len(rs) {
+				if two := string(rs[i : i+2]); two == "<=" || two == ">=" || two == "!=" || two == "<>" || two == "==" {
+					sym = two
+				}
+			}
+			if !strings.Contains("=<>!(),*;", string(r)) {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i+1)
+			}
+			toks = append(toks, token{tokSymbol, sym, i})
+			i += len([]rune(sym))
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(rs)}), nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '.'
+}
+
+// parser reads a statement from its tokens.
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is one of the words kw (any case).
+func (p *parser) keyword(kw ...string) bool {
+	t := p.peek()
+	if t.kind != tokWord || len(kw) == 0 {
+		return false
+	}
+	for j, w := range kw {
+		t := p.toks[min(p.i+j, len(p.toks)-1)]
+		if t.kind != tokWord || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	p.i += len(kw)
+	return true
+}
+
+func (p *parser) symbol(s string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	t := p.peek()
+	near := "end of statement"
+	if t.kind != tokEOF {
+		near = fmt.Sprintf("%q at %d", t.text, t.pos+1)
+	}
+	return fmt.Errorf(format+" near %s", append(args, near)...)
+}
+
+// keywords are the words the parser reserves; columns named like them must
+// be quoted. The shell also completes them.
+var keywords = []string{
+	"SELECT", "FROM", "WHERE", "GROUP", "BY", "LIMIT", "OFFSET", "EXPLAIN",
+	"AND", "OR", "NOT", "LIKE", "REGEXP", "IS", "NULL", "IN", "BETWEEN",
+	"COUNT", "SUM", "AVG", "MIN", "MAX", "ORDER",
+}
+
+func isKeyword(word string) bool {
+	for _, k := range keywords {
+		if strings.EqualFold(k, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatement parses one statement.
+func parseStatement(src string) (*statement, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	s := &statement{explain: p.keyword("EXPLAIN")}
+	if !p.keyword("SELECT") {
+		return nil, p.errorf("expected SELECT")
+	}
+	if err := p.selectList(s); err != nil {
+		return nil, err
+	}
+	if p.keyword("FROM") {
+		if t := p.next(); t.kind != tokWord && t.kind != tokIdent && t.kind != tokString {
+			return nil, p.errorf("expected a table name")
+		}
+	}
+	if p.keyword("WHERE") {
+		if s.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("GROUP", "BY") {
+		if s.groupBy, err = p.column(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		return nil, fmt.Errorf("ORDER BY is not supported: rows come in index order")
+	}
+	if p.keyword("LIMIT") {
+		if s.limit, err = p.count(); err != nil {
+			return nil, err
+		}
+		s.hasLimit = true
+	}
+	if p.keyword("OFFSET") {
+		if s.offset, err = p.count(); err != nil {
+			return nil, err
+		}
+	}
+	p.symbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected input")
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// check validates the select list against GROUP BY.
+func (s *statement) check() error {
+	if s.groupBy == "" {
+		if s.aggFunc != "" && !s.count && s.aggFunc != "min" && s.aggFunc != "max" {
+			return fmt.Errorf("%s needs GROUP BY; only COUNT(*), MIN and MAX aggregate all matching rows", strings.ToUpper(s.aggFunc))
+		}
+		if s.aggFunc != "" && len(s.columns) > 0 {
+			return fmt.Errorf("select columns or one aggregate, or add GROUP BY")
+		}
+		return nil
+	}
+	if s.count {
+		s.count, s.aggFunc = false, "count"
+	}
+	column, _, _ := strings.Cut(s.groupBy, ":")
+	for _, c := range s.columns {
+		if !strings.EqualFold(c, column) && !strings.EqualFold(c, s.groupBy) {
+			return fmt.Errorf("with GROUP BY, select the grouped column %s and one aggregate, not %s", s.groupBy, c)
+		}
+	}
+	s.columns = nil
+	if s.aggFunc == "" {
+		s.aggFunc = "count"
+	}
+	return nil
+}
+
+// selectList reads what a SELECT returns.
+func (p *parser) selectList(s *statement) error {
+	for {
+		switch {
+		case p.symbol("*"):
+			s.columns = append(s.columns, "*")
+		case p.isAggregate():
+			if s.aggFunc != "" {
+				return p.errorf("only one aggregate is supported")
+			}
+			fn := strings.ToLower(p.next().text)
+			p.next() // (
+			if p.symbol("*") {
+				if fn != "count" {
+					return p.errorf("%s needs a column", strings.ToUpper(fn))
+				}
+				s.count = true
+			} else {
+				col, err := p.column()
+				if err != nil {
+					return err
+				}
+				if fn == "count" {
+					s.count = true // COUNT(col) counts rows, as COUNT(*)
+				} else {
+					s.aggCol = col
+				}
+			}
+			if !p.symbol(")") {
+				return p.errorf("expected )")
+			}
+			s.aggFunc = fn
+		default:
+			col, err := p.column()
+			if err != nil {
+				return err
+			}
+			s.columns = append(s.columns, col)
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return nil
+}
+
+// isAggregate reports whether an aggregate call starts here.
+func (p *parser) isAggregate() bool {
+	t := p.peek()
+	if t.kind != tokWord || p.toks[p.i+1].kind != tokSymbol || p.toks[p.i+1].text != "(" {
+		return false
+	}
+	switch strings.ToLower(t.text) {
+	case "count", "sum", "avg", "min", "max":
+		return true
+	}
+	return false
+}
+
+// column reads a column name.
+func (p *parser) column() (string, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokIdent:
+	case t.kind == tokWord && !isKeyword(t.text):
+	default:
+		return "", p.errorf("expected a column")
+	}
+	p.next()
+	return t.text, nil
+}
+
+// count reads a LIMIT or OFFSET.
+func (p *parser) count() (int, error) {
+	t := p.next()
+	n, err := strconv.Atoi(t.text)
+	if t.kind != tokNumber || err != nil || n < 0 {
+		p.i--
+		return 0, p.errorf("expected a row count")
+	}
+	return n, nil
+}
+
+// or reads conditions joined by OR.
+func (p *parser) or() (map[string]any, error) {
+	return p.joined("OR", p.and)
+}
+
+func (p *parser) and() (map[string]any, error) {
+	return p.joined("AND", p.not)
+}
+
+func (p *parser) joined(op string, operand func() (map[string]any, error)) (map[string]any, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	children := []map[string]any{first}
+	for p.keyword(op) {
+		c, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, c)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return map[string]any{"operator": op, "children": children}, nil
+}
+
+func (p *parser) not() (map[string]any, error) {
+	if p.keyword("NOT") {
+		c, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return negate(c), nil
+	}
+	if p.symbol("(") {
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("expected )")
+		}
+		return c, nil
+	}
+	return p.predicate()
+}
+
+func negate(c map[string]any) map[string]any {
+	return map[string]any{"operator": "NOT", "children": []map[string]any{c}}
+}
+
+// predicate reads one column condition.
+func (p *parser) predicate() (map[string]any, error) {
+	col, err := p.column()
+	if err != nil {
+		return nil, err
+	}
+	leaf := func(op string, value any) map[string]any {
+		c := map[string]any{"operator": op, "column": col}
+		if value != nil {
+			c["value"] = value
+		}
+		return c
+	}
+
+	if t := p.peek(); t.kind == tokSymbol {
+		op := t.text
+		switch op {
+		case "==":
+			op = "="
+		case "<>":
+			op = "!="
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, p.errorf("expected an operator")
+		}
+		p.next()
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return leaf(op, v), nil
+	}
+
+	if p.keyword("IS") {
+		negated := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, p.errorf("expected NULL")
+		}
+		if negated {
+			return leaf("IS NOT NULL", nil), nil
+		}
+		return leaf("IS NULL", nil), nil
+	}
+
+	negated := p.keyword("NOT")
+	var c map[string]any
+	switch {
+	case p.keyword("LIKE"):
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = leaf("LIKE", v)
+	case p.keyword("REGEXP"):
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = leaf("REGEXP", v)
+	case p.keyword("BETWEEN"):
+		lo, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword("AND") {
+			return nil, p.errorf("expected AND")
+		}
+		hi, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = leaf("BETWEEN", []string{lo, hi})
+	case p.keyword("IN"):
+		// The engine has no IN: an OR of equalities
+		if !p.symbol("(") {
+			return nil, p.errorf("expected (")
+		}
+		var children []map[string]any
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, leaf("=", v))
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, p.errorf("expected )")
+		}
+		c = children[0]
+		if len(children) > 1 {
+			c = map[string]any{"operator": "OR", "children": children}
+		}
+	default:
+		return nil, p.errorf("expected an operator")
+	}
+	if negated {
+		c = negate(c)
+	}
+	return c, nil
+}
+
+// value reads a literal: a string, a number or a bare word. Numbers keep
+// their text, so they compare as written.
+func (p *parser) value() (string, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokString, tokNumber:
+	case tokWord:
+		if isKeyword(t.text) {
+			return "", p.errorf("expected a value")
+		}
+	default:
+		return "", p.errorf("expected a value")
+	}
+	p.next()
+	return t.text, nil
+}
@@ -0,0 +1,71 @@
+package shell
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatementWhere(t *testing.T) {
+	for src, want := range map[string]string{
+		"SELECT * WHERE city = 'Paris'":                `{"column":"city","operator":"=","value":"Paris"}`,
+		"select * from t where age >= 18 and age < 65": `{"children":[{"column":"age","operator":"\u003e=","value":"18"},{"column":"age","operator":"\u003c","value":"65"}],"operator":"AND"}`,
+		"SELECT * WHERE city IN ('a', 'b')":            `{"children":[{"column":"city","operator":"=","value":"a"},{"column":"city","operator":"=","value":"b"}],"operator":"OR"}`,
+		"SELECT * WHERE city NOT LIKE 'P%'":            `{"children":[{"column":"city","operator":"LIKE","value":"P%"}],"operator":"NOT"}`,
+		`SELECT * WHERE "unit price" BETWEEN 1 AND 2`:  `{"column":"unit price","operator":"BETWEEN","value":["1","2"]}`,
+		"SELECT * WHERE name IS NOT NULL":              `{"column":"name","operator":"IS NOT NULL"}`,
+		"SELECT * WHERE name = 'it''s'":                `{"column":"name","operator":"=","value":"it's"}`,
+		"SELECT * WHERE (a = 1 OR b = 2) AND c <> 3":   `{"children":[{"children":[{"column":"a","operator":"=","value":"1"},{"column":"b","operator":"=","value":"2"}],"operator":"OR"},{"column":"c","operator":"!=","value":"3"}],"operator":"AND"}`,
+	} {
+		s, err := parseStatement(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got := string(s.whereJSON()); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", src, got, want)
+		}
+	}
+}
+
+func TestParseStatementShape(t *testing.T) {
+	s, err := parseStatement("EXPLAIN SELECT city, sum(price) GROUP BY city LIMIT 5 OFFSET 10;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := statement{explain: true, groupBy: "city", aggFunc: "sum", aggCol: "price", limit: 5, offset: 10, hasLimit: true}
+	if !reflect.DeepEqual(*s, want) {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+
+	s, err = parseStatement("SELECT id, `name` LIMIT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.columns, []string{"id", "name"}) || s.limit != 3 {
+		t.Errorf("got %+v", *s)
+	}
+
+	s, err = parseStatement("SELECT MAX(price) WHERE city = 'x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.aggFunc != "max" || s.aggCol != "price" || s.groupBy != "" || s.columns != nil {
+		t.Errorf("got %+v", *s)
+	}
+
+	for _, src := range []string{
+		"SELECT",
+		"SELECT SUM(price)",
+		"SELECT id, MIN(price)",
+		"SELECT * ORDER BY id",
+		"SELECT * WHERE city",
+		"SELECT * WHERE city = 'x",
+		"SELECT id, COUNT(*)",
+		"SELECT * LIMIT x",
+		"DELETE FROM t",
+	} {
+		if _, err := parseStatement(src); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+// Package shell is the interactive query prompt of `csvquery shell`: it
+// reads SQL-ish statements (see parse.go) and answers them with the query
+// engine in-process, keeping index blocks and files open between them.
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/query"
+	"github.com/entreya/csvquery/internal/schema"
+)
+
+// Config holds the settings of a shell session.
+type Config struct {
+	CsvPath      string
+	IndexDir     string
+	HistoryPath  string // Where lines are kept between sessions ("" = nowhere)
+	Limit        int    // Rows a SELECT without LIMIT shows (0 = all)
+	Workers      int    // Full scan threads (0 = CPU count)
+	BlockCacheMB int    // Memory for index blocks kept between statements
+	RequireIndex bool
+
+	In  *os.File // The terminal (or a script)
+	Out io.Writer
+}
+
+// maxHistory is how many lines the history keeps.
+const maxHistory = 1000
+
+// maxIdleHandles is how many files no statement is reading stay open.
+const maxIdleHandles = 32
+
+// Shell is an interactive session over one CSV.
+type Shell struct {
+	config  Config
+	columns []string // Header and virtual columns, in "*" order
+	names   []string // columns and aliases: what a statement may name
+	sep     byte
+	cache   *common.BlockCache
+	handles *common.HandlePool
+	history []string
+	timing  bool
+}
+
+// New opens a session: it reads the CSV's header, and the history.
+func New(cfg Config) (*Shell, error) {
+	s := &Shell{
+		config:  cfg,
+		cache:   common.NewBlockCache(int64(cfg.BlockCacheMB) << 20),
+		handles: common.NewHandlePool(maxIdleHandles),
+		timing:  true,
+	}
+	engine := query.NewQueryEngine(query.QueryConfig{CsvPath: cfg.CsvPath, IndexDir: cfg.IndexDir})
+	columns, err := engine.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header of %s: %w", cfg.CsvPath, err)
+	}
+	s.columns, s.sep = columns, engine.Separator()
+	s.names = slices.Clone(columns)
+	if sc, err := schema.Load(cfg.CsvPath); err == nil {
+		for alias := range sc.Aliases {
+			s.names = append(s.names, alias)
+		}
+	}
+	s.loadHistory()
+	return s, nil
+}
+
+// Close releases the files kept open between statements.
+func (s *Shell) Close() {
+	s.handles.Close()
+}
+
+// Run reads and answers statements until end of input or .quit. On a
+// terminal lines are edited in place, with history and completion;
+// otherwise (a script on stdin) they are read as they come, without a
+// prompt.
+func (s *Shell) Run() error {
+	fd := int(s.config.In.Fd())
+	in := bufio.NewReader(s.config.In)
+	ed := &editor{in: in, out: s.config.Out, history: s.history, complete: s.complete}
+	interactive := false
+	if restore, err := makeRaw(fd); err == nil {
+		restore()
+		interactive = true
+		fmt.Fprintf(s.config.Out, "csvquery shell on %s (%d columns). Type .help for help.\n", s.config.CsvPath, len(s.columns))
+	}
+
+	for {
+		var line string
+		var err error
+		if interactive {
+			var restore func()
+			if restore, err = makeRaw(fd); err != nil {
+				return err
+			}
+			line, err = ed.readLine("csvquery> ")
+			restore()
+		} else {
+			line, err = in.ReadString('\n')
+			if err == io.EOF && line != "" {
+				err = nil
+			}
+		}
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if interactive {
+			s.addHistory(line)
+			ed.history = s.history
+		}
+		if quit := s.execute(line); quit {
+			return nil
+		}
+	}
+}
+
+// execute runs one line: a dot command or a statement. It reports whether
+// the session is over.
+func (s *Shell) execute(line string) bool {
+	if strings.HasPrefix(line, ".") || strings.HasPrefix(line, `\`) {
+		return s.command(line)
+	}
+	stmt, err := parseStatement(line)
+	if err == nil {
+		err = s.checkColumns(stmt)
+	}
+	if err == nil {
+		err = s.run(stmt)
+	}
+	if err != nil {
+		fmt.Fprintf(s.config.Out, "Error: %v\n", err)
+	}
+	return false
+}
+
+// commands are the dot commands, as .help lists them.
+var commands = [][2]string{
+	{".columns", "List the columns, virtual ones included"},
+	{".timing on|off", "Show how long statements take (default on)"},
+	{".help", "Show this help"},
+	{".quit", "Leave the shell (or Ctrl-D)"},
+}
+
+func (s *Shell) command(line string) bool {
+	fields := strings.Fields(line)
+	switch strings.TrimLeft(fields[0], `.\`) {
+	case "quit", "exit", "q":
+		return true
+	case "columns", "d":
+		for _, c := range s.columns {
+			fmt.Fprintln(s.config.Out, c)
+		}
+	case "timing":
+		if len(fields) == 2 && (fields[1] == "on" || fields[1] == "off") {
+			s.timing = fields[1] == "on"
+		} else {
+			fmt.Fprintln(s.config.Out, "Usage: .timing on|off")
+		}
+	case "help":
+		w := tabwriter.NewWriter(s.config.Out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SELECT * | col, ... | COUNT(*) [WHERE cond] [GROUP BY col] [LIMIT n [OFFSET n]]\t")
+		fmt.Fprintln(w, "SELECT col, SUM(x) | AVG(x) | MIN(x) | MAX(x) | COUNT(*) WHERE ... GROUP BY col\t")
+		fmt.Fprintln(w, "SELECT MIN(x) | MAX(x) [WHERE col = v AND ...]\t")
+		fmt.Fprintln(w, "EXPLAIN SELECT ...\tShow the query plan")
+		fmt.Fprintln(w, "Conditions\t= != < <= > >= [NOT] LIKE, REGEXP, IS [NOT] NULL, [NOT] IN (...), [NOT] BETWEEN a AND b, AND, OR, NOT")
+		for _, c := range commands {
+			fmt.Fprintf(w, "%s\t%s\n", c[0], c[1])
+		}
+		_ = w.Flush()
+	default:
+		fmt.Fprintf(s.config.Out, "Unknown command %s (try .help)\n", fields[0])
+	}
+	return false
+}
+
+// checkColumns rejects a statement naming a column the CSV lacks, which
+// would otherwise match no rows.
+func (s *Shell) checkColumns(stmt *statement) error {
+	for _, name := range stmt.names() {
+		if !slices.ContainsFunc(s.names, func(c string) bool { return strings.EqualFold(c, name) }) {
+			return fmt.Errorf("no column %q (see .columns)", name)
+		}
+	}
+	return nil
+}
+
+// run answers a statement with the engine, stopping it on Ctrl-C.
+func (s *Shell) run(stmt *statement) error {
+	cond, err := query.ParseCondition(stmt.whereJSON())
+	if err != nil {
+		return err
+	}
+	cfg := query.QueryConfig{
+		CsvPath:      s.config.CsvPath,
+		IndexDir:     s.config.IndexDir,
+		Where:        cond,
+		Explain:      stmt.explain,
+		CountOnly:    stmt.count,
+		GroupBy:      stmt.groupBy,
+		AggFunc:      stmt.aggFunc,
+		AggCol:       stmt.aggCol,
+		Workers:      s.config.Workers,
+		RequireIndex: s.config.RequireIndex,
+		BlockCache:   s.cache,
+		Handles:      s.handles,
+	}
+	if stmt.columns != nil {
+		// Groups are limited once sorted (see printGroups)
+		cfg.Limit, cfg.Offset = stmt.limit, stmt.offset
+		if !stmt.hasLimit {
+			cfg.Limit = s.config.Limit
+		}
+		if !stmt.explain {
+			cfg.Format, cfg.Select = "csv", stmt.columns
+		}
+	}
+	var out bytes.Buffer
+	var result query.Result
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel(errors.New("interrupted"))
+		case <-ctx.Done():
+		}
+	}()
+	cfg.Context = ctx
+
+	engine := query.NewQueryEngine(cfg)
+	if cfg.Format == "csv" {
+		engine.Writer = &out
+	} else {
+		engine.Result = &result
+	}
+	start := time.Now()
+	err = engine.Run()
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+
+	var summary string
+	switch {
+	case result.Plan != nil:
+		b, _ := json.MarshalIndent(result.Plan, "", "  ")
+		fmt.Fprintln(s.config.Out, string(b))
+	case result.Count != nil:
+		fmt.Fprintln(s.config.Out, result.Count.Count)
+		summary = "1 row"
+	case result.Value != nil:
+		if result.Value.Value != nil {
+			fmt.Fprintln(s.config.Out, *result.Value.Value)
+		} else {
+			fmt.Fprintln(s.config.Out, "NULL")
+		}
+		summary = "1 row"
+	case stmt.groupBy != "":
+		summary = s.printGroups(stmt, result.Groups)
+	default:
+		if summary, err = s.printRows(out.Bytes(), cfg.Limit, stmt.hasLimit); err != nil {
+			return err
+		}
+	}
+	if s.timing {
+		s.printTiming(summary, elapsed, engine)
+	}
+	return nil
+}
+
+// printRows prints the csv rows of a SELECT as a table, and returns the
+// row count for the summary.
+func (s *Shell) printRows(data []byte, limit int, explicit bool) (string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = rune(s.sep)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "0 rows", nil
+	}
+	w := tabwriter.NewWriter(s.config.Out, 0, 0, 2, ' ', 0)
+	for i, rec := range records {
+		for j, field := range rec {
+			if j > 0 {
+				_, _ = io.WriteString(w, "\t")
+			}
+			_, _ = io.WriteString(w, cell(field))
+		}
+		_, _ = io.WriteString(w, "\t\n")
+		if i == 0 {
+			for j, field := range rec {
+				if j > 0 {
+					_, _ = io.WriteString(w, "\t")
+				}
+				_, _ = io.WriteString(w, strings.Repeat("-", max(len([]rune(cell(field))), 1)))
+			}
+			_, _ = io.WriteString(w, "\t\n")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	n := len(records) - 1
+	summary := plural(n, "row")
+	if !explicit && limit > 0 && n == limit {
+		summary += fmt.Sprintf(", the first %d: add LIMIT for more", limit)
+	}
+	return summary, nil
+}
+
+// printGroups prints the groups of an aggregation in key order, and
+// returns the group count for the summary.
+func (s *Shell) printGroups(stmt *statement, groups map[string]query.AggValue) string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if stmt.offset > 0 {
+		keys = keys[min(stmt.offset, len(keys)):]
+	}
+	if stmt.hasLimit {
+		keys = keys[:min(stmt.limit, len(keys))]
+	}
+	agg := strings.ToUpper(stmt.aggFunc) + "(*)"
+	if stmt.aggCol != "" {
+		agg = strings.ToUpper(stmt.aggFunc) + "(" + stmt.aggCol + ")"
+	}
+	w := tabwriter.NewWriter(s.config.Out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\t%s\t\n", stmt.groupBy, agg)
+	fmt.Fprintf(w, "%s\t%s\t\n", strings.Repeat("-", len(stmt.groupBy)), strings.Repeat("-", len(agg)))
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\t\n", cell(k), strconv.FormatFloat(float64(groups[k]), 'f', -1, 64))
+	}
+	_ = w.Flush()
+	return plural(len(keys), "group")
+}
+
+// printTiming prints how long the statement took and how it was answered.
+func (s *Shell) printTiming(summary string, elapsed time.Duration, engine *query.QueryEngine) {
+	var parts []string
+	if summary != "" {
+		parts = append(parts, summary)
+	}
+	parts = append(parts, fmt.Sprintf("%.1f ms", float64(elapsed.Microseconds())/1000))
+	switch {
+	case engine.UsedIndex != "" && engine.Strategy != "":
+		parts = append(parts, engine.Strategy+" on "+engine.UsedIndex)
+	case engine.UsedIndex != "":
+		parts = append(parts, "index "+engine.UsedIndex)
+	case engine.Strategy != "":
+		parts = append(parts, engine.Strategy)
+	}
+	fmt.Fprintf(s.config.Out, "(%s)\n", strings.Join(parts, ", "))
+}
+
+// cell makes a value printable on one table line.
+func cell(v string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(v)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// complete returns the completions of the word before the cursor: columns
+// (quoted when they need it), keywords in the case typed, and dot commands.
+func (s *Shell) complete(prefix string) []string {
+	var out []string
+	if strings.HasPrefix(prefix, ".") {
+		for _, c := range commands {
+			if name, _, _ := strings.Cut(c[0], " "); strings.HasPrefix(name, prefix) {
+				out = append(out, name)
+			}
+		}
+		return out
+	}
+	quote := ""
+	if strings.HasPrefix(prefix, `"`) || strings.HasPrefix(prefix, "`") {
+		quote, prefix = prefix[:1], prefix[1:]
+	}
+	lower := strings.ToLower(prefix)
+	for _, name := range s.names {
+		if !strings.HasPrefix(strings.ToLower(name), lower) {
+			continue
+		}
+		switch {
+		case quote != "":
+			out = append(out, quote+name+quote)
+		case needsQuotes(name):
+			out = append(out, `"`+name+`"`)
+		default:
+			out = append(out, name)
+		}
+	}
+	if quote == "" && prefix != "" {
+		for _, k := range keywords {
+			if strings.HasPrefix(strings.ToLower(k), lower) {
+				if prefix == lower {
+					k = strings.ToLower(k)
+				}
+				out = append(out, k)
+			}
+		}
+	}
+	return slices.Compact(out)
+}
+
+// needsQuotes reports whether a column name only parses quoted.
+func needsQuotes(name string) bool {
+	toks, err := tokenize(name)
+	return err != nil || len(toks) != 2 || toks[0].kind != tokWord || isKeyword(name)
+}
+
+// loadHistory reads the last lines of the history file.
+func (s *Shell) loadHistory() {
+	if s.config.HistoryPath == "" {
+		return
+	}
+	data, err := os.ReadFile(s.config.HistoryPath)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	for _, line := range lines {
+		if line != "" {
+			s.history = append(s.history, line)
+		}
+	}
+}
+
+// addHistory adds a line to the history and appends it to the history
+// file, so it survives the session ending any way it does.
+func (s *Shell) addHistory(line string) {
+	if n := len(s.history); n > 0 && s.history[n-1] == line {
+		return
+	}
+	s.history = append(s.history, line)
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+	if s.config.HistoryPath == "" {
+		return
+	}
+	f, err := os.OpenFile(s.config.HistoryPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	_, _ = f.WriteString(line + "\n")
+	_ = f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package shell
+
+import "errors"
+
+// makeRaw is not implemented here: the shell reads whole lines, without
+// editing, history keys or completion.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("no raw terminal mode on this platform")
+}
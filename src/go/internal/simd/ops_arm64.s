@@ -0,0 +1,124 @@
+#include "textflag.h"
+
+// func countSeparatorsNEON(data []byte, sep byte) uint64
+// len(data) must be a multiple of 32.
+TEXT ·countSeparatorsNEON(SB), NOSPLIT, $0-40
+    MOVD    data_base+0(FP), R0    // R0 = data pointer
+    MOVD    data_len+8(FP), R1     // R1 = data length
+    MOVBU   sep+24(FP), R2         // R2 = separator byte
+
+    MOVD    $0, R11                // R11 = count (Result)
+    CBZ     R1, ret_count
+
+    ADD     R0, R1, R3             // R3 = end of data
+    MOVD    $1, R5
+    VMOV    R5, V5.B16             // V5 = 0x01 in every lane
+    VMOV    R2, V0.B16             // V0 = separator in every lane
+    VEOR    V8.B16, V8.B16, V8.B16 // V8 = running total
+
+loop_count:
+    VLD1.P  32(R0), [V1.B16, V2.B16]
+    CMP     R0, R3
+    VCMEQ   V0.B16, V1.B16, V3.B16 // 0xFF where byte == sep
+    VCMEQ   V0.B16, V2.B16, V4.B16
+    VAND    V5.B16, V3.B16, V3.B16 // 0xFF -> 0x01
+    VAND    V5.B16, V4.B16, V4.B16
+    VADDP   V4.B16, V3.B16, V6.B16 // 32 lanes -> 16 lanes
+    VUADDLV V6.B16, V7             // Horizontal sum
+    VADD    V7, V8
+    BNE     loop_count
+
+    VMOV    V8.D[0], R11
+
+ret_count:
+    MOVD    R11, ret+32(FP)
+    RET
+
+
+// func scanBitmapsNEON(data []byte, sep byte, quotes, seps, newlines []uint64)
+// len(data) must be a multiple of 64.
+//
+// NEON has no movemask instruction. Each compare result is ANDed with the
+// per-lane bit weights {1,2,4,...,128} and folded with three pairwise adds,
+// which leaves the 64-bit mask for the 64-byte block in the low doubleword.
+TEXT ·scanBitmapsNEON(SB), NOSPLIT, $0-104
+    MOVD    data_base+0(FP), R0      // R0 = data pointer
+    MOVD    data_len+8(FP), R1       // R1 = data length
+    MOVBU   sep+24(FP), R2           // R2 = separator byte
+    MOVD    quotes_base+32(FP), R4   // R4 = quotes bitmap
+    MOVD    seps_base+56(FP), R5     // R5 = separators bitmap
+    MOVD    newlines_base+80(FP), R6 // R6 = newlines bitmap
+
+    CBZ     R1, ret_bitmaps
+    ADD     R0, R1, R3               // R3 = end of data
+
+    MOVD    $0x8040201008040201, R9
+    VMOV    R9, V9.D2                // V9 = bit weight per lane
+    VMOV    R2, V10.B16              // V10 = separator
+    MOVD    $0x22, R9
+    VMOV    R9, V11.B16              // V11 = '"'
+    MOVD    $0x0A, R9
+    VMOV    R9, V12.B16              // V12 = '\n'
+
+loop_bitmaps:
+    VLD1.P  64(R0), [V1.B16, V2.B16, V3.B16, V4.B16]
+    CMP     R0, R3
+
+    // Quotes
+    VCMEQ   V11.B16, V1.B16, V13.B16
+    VCMEQ   V11.B16, V2.B16, V14.B16
+    VCMEQ   V11.B16, V3.B16, V15.B16
+    VCMEQ   V11.B16, V4.B16, V16.B16
+    VAND    V9.B16, V13.B16, V13.B16
+    VAND    V9.B16, V14.B16, V14.B16
+    VAND    V9.B16, V15.B16, V15.B16
+    VAND    V9.B16, V16.B16, V16.B16
+    VADDP   V14.B16, V13.B16, V13.B16
+    VADDP   V16.B16, V15.B16, V15.B16
+    VADDP   V15.B16, V13.B16, V13.B16
+    VADDP   V13.B16, V13.B16, V13.B16
+    VMOV    V13.D[0], R7
+    MOVD    (R4), R8
+    ORR     R7, R8, R8
+    MOVD.P  R8, 8(R4)
+
+    // Separators
+    VCMEQ   V10.B16, V1.B16, V13.B16
+    VCMEQ   V10.B16, V2.B16, V14.B16
+    VCMEQ   V10.B16, V3.B16, V15.B16
+    VCMEQ   V10.B16, V4.B16, V16.B16
+    VAND    V9.B16, V13.B16, V13.B16
+    VAND    V9.B16, V14.B16, V14.B16
+    VAND    V9.B16, V15.B16, V15.B16
+    VAND    V9.B16, V16.B16, V16.B16
+    VADDP   V14.B16, V13.B16, V13.B16
+    VADDP   V16.B16, V15.B16, V15.B16
+    VADDP   V15.B16, V13.B16, V13.B16
+    VADDP   V13.B16, V13.B16, V13.B16
+    VMOV    V13.D[0], R7
+    MOVD    (R5), R8
+    ORR     R7, R8, R8
+    MOVD.P  R8, 8(R5)
+
+    // Newlines
+    VCMEQ   V12.B16, V1.B16, V13.B16
+    VCMEQ   V12.B16, V2.B16, V14.B16
+    VCMEQ   V12.B16, V3.B16, V15.B16
+    VCMEQ   V12.B16, V4.B16, V16.B16
+    VAND    V9.B16, V13.B16, V13.B16
+    VAND    V9.B16, V14.B16, V14.B16
+    VAND    V9.B16, V15.B16, V15.B16
+    VAND    V9.B16, V16.B16, V16.B16
+    VADDP   V14.B16, V13.B16, V13.B16
+    VADDP   V16.B16, V15.B16, V15.B16
+    VADDP   V15.B16, V13.B16, V13.B16
+    VADDP   V13.B16, V13.B16, V13.B16
+    VMOV    V13.D[0], R7
+    MOVD    (R6), R8
+    ORR     R7, R8, R8
+    MOVD.P  R8, 8(R6)
+
+    BNE     loop_bitmaps
+
+ret_bitmaps:
+    RET
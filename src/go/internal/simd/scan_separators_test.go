@@ -69,3 +69,16 @@ func TestScanSeparatorsTail(t *testing.T) {
 		}
 	}
 }
+
+func FuzzScanSeparators(f *testing.F) {
+	f.Add([]byte("a,b,c"), byte(','))
+	f.Add([]byte(strings.Repeat("x|", 100)), byte('|'))
+	f.Add([]byte{}, byte('\n'))
+
+	f.Fuzz(func(t *testing.T, input []byte, sep byte) {
+		want := uint64(bytes.Count(input, []byte{sep}))
+		if got := ScanSeparators(input, sep); got != want {
+			t.Errorf("ScanSeparators(len=%d, %q) = %d, want %d", len(input), sep, got, want)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package simd
 
 import (
 	"math/bits"
+	"strings"
 	"testing"
 )
 
@@ -294,3 +295,50 @@ func FuzzScan(f *testing.F) {
 		}
 	})
 }
+
+// TestScanMatchesGeneric checks the dispatched implementation against the
+// scalar reference across lengths that straddle the 64-byte block boundary.
+func TestScanMatchesGeneric(t *testing.T) {
+	pattern := []byte("ab,\"c;d\"\n|x\tq")
+	for _, sep := range []byte{',', ';', '|', '\t', '"', '\n'} {
+		for size := 0; size <= 300; size++ {
+			input := make([]byte, size)
+			for i := range input {
+				input[i] = pattern[(i*7+size)%len(pattern)]
+			}
+			checkAgainstGeneric(t, input, sep)
+		}
+	}
+}
+
+func checkAgainstGeneric(t *testing.T, input []byte, sep byte) {
+	t.Helper()
+	bitmapLen := (len(input) + 63) / 64
+
+	quotes := make([]uint64, bitmapLen)
+	seps := make([]uint64, bitmapLen)
+	newlines := make([]uint64, bitmapLen)
+	ScanWithSeparator(input, sep, quotes, seps, newlines)
+
+	wantQuotes := make([]uint64, bitmapLen)
+	wantSeps := make([]uint64, bitmapLen)
+	wantNewlines := make([]uint64, bitmapLen)
+	scanWithSeparatorGeneric(input, sep, wantQuotes, wantSeps, wantNewlines)
+
+	for w := 0; w < bitmapLen; w++ {
+		if quotes[w] != wantQuotes[w] || seps[w] != wantSeps[w] || newlines[w] != wantNewlines[w] {
+			t.Fatalf("len=%d sep=%q word %d: got (%x,%x,%x), want (%x,%x,%x)",
+				len(input), sep, w, quotes[w], seps[w], newlines[w], wantQuotes[w], wantSeps[w], wantNewlines[w])
+		}
+	}
+}
+
+func FuzzScanWithSeparator(f *testing.F) {
+	f.Add([]byte("a;b;c\n"), byte(';'))
+	f.Add([]byte(`"x|y"|z`+"\n"), byte('|'))
+	f.Add([]byte(strings.Repeat("a\tb\t\"c\"\n", 20)), byte('\t'))
+
+	f.Fuzz(func(t *testing.T, input []byte, sep byte) {
+		checkAgainstGeneric(t, input, sep)
+	})
+}
@@ -0,0 +1,53 @@
+//go:build arm64
+
+package simd
+
+// NEON (Advanced SIMD) is mandatory on ARMv8, so unlike AMD64 there is no
+// runtime feature detection: the vector paths are always selected.
+func init() {
+	scanImpl = scanSeparatorsNEON
+	bitmapImpl = scanWithSeparatorNEON
+}
+
+// scanSeparatorsNEON counts separators 32 bytes at a time and finishes the
+// tail with the scalar loop.
+func scanSeparatorsNEON(data []byte, sep byte) uint64 {
+	n := len(data) &^ 31
+	count := countSeparatorsNEON(data[:n], sep)
+	for _, b := range data[n:] {
+		if b == sep {
+			count++
+		}
+	}
+	return count
+}
+
+// scanWithSeparatorNEON builds the quote/separator/newline bitmaps 64 bytes
+// (one bitmap word) at a time. The tail shorter than 64 bytes is handled by
+// the generic implementation starting at the next bitmap word.
+func scanWithSeparatorNEON(data []byte, sep byte, quotes, seps, newlines []uint64) {
+	// The generic path gives quotes priority over separators and separators
+	// priority over newlines; the vector path assumes the three are distinct.
+	if sep == '"' || sep == '\n' {
+		scanWithSeparatorGeneric(data, sep, quotes, seps, newlines)
+		return
+	}
+
+	n := len(data) &^ 63
+	if n > 0 {
+		scanBitmapsNEON(data[:n], sep, quotes, seps, newlines)
+	}
+	if n < len(data) {
+		w := n / 64
+		scanWithSeparatorGeneric(data[n:], sep, quotes[w:], seps[w:], newlines[w:])
+	}
+}
+
+// Declared in ops_arm64.s
+
+// countSeparatorsNEON requires len(data) to be a multiple of 32.
+func countSeparatorsNEON(data []byte, sep byte) uint64
+
+// scanBitmapsNEON requires len(data) to be a multiple of 64 and each bitmap
+// to hold at least len(data)/64 words.
+func scanBitmapsNEON(data []byte, sep byte, quotes, seps, newlines []uint64)
@@ -1,4 +1,4 @@
-//go:build !amd64
+//go:build !amd64 && !arm64
 
 package simd
 
@@ -8,7 +8,7 @@ func init() {
 	scanImpl = scanSeparatorsGeneric
 }
 
-// scanSeparatorsGeneric is a pure Go fallback for non-AMD64 architectures.
+// scanSeparatorsGeneric is a pure Go fallback for architectures without assembly.
 func scanSeparatorsGeneric(data []byte, sep byte) uint64 {
 	return uint64(bytes.Count(data, []byte{sep}))
 }
@@ -9,6 +9,10 @@ func ScanSeparators(data []byte, sep byte) uint64 {
 // It is set in init() based on CPU flags for AMD64, or defaults to the generic version.
 var scanImpl func(data []byte, sep byte) uint64
 
+// bitmapImpl is the function pointer used by Scan and ScanWithSeparator.
+// Architectures with a vector implementation override it in init().
+var bitmapImpl = scanWithSeparatorGeneric
+
 // Scan generates bitmaps for quotes, commas, and newlines.
 // Deprecated: optimizations moved to ScanSeparators, this is now a fallback wrapper or generic.
 func Scan(data []byte, quotes, commas, newlines []uint64) {
@@ -17,8 +21,7 @@ func Scan(data []byte, quotes, commas, newlines []uint64) {
 
 // ScanWithSeparator generates bitmaps for a custom separator.
 func ScanWithSeparator(data []byte, sep byte, quotes, seps, newlines []uint64) {
-	// Fallback to generic implementation for now to satisfy build
-	scanWithSeparatorGeneric(data, sep, quotes, seps, newlines)
+	bitmapImpl(data, sep, quotes, seps, newlines)
 }
 
 func scanWithSeparatorGeneric(data []byte, sep byte, quotes, seps, newlines []uint64) {
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package status
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals dumps the status report on every SIGUSR1.
+func HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			dumpToTarget()
+		}
+	}()
+}
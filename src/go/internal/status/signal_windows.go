@@ -0,0 +1,6 @@
+//go:build windows
+
+package status
+
+// HandleSignals is a no-op: Windows has no SIGUSR1.
+func HandleSignals() {}
@@ -0,0 +1,158 @@
+// Package status keeps a registry of what the process is doing (running
+// queries, index builds, daemon requests) and dumps it, together with
+// memory and goroutine figures, on SIGUSR1. Useful when something looks
+// hung in production.
+package status
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileEnv names a file status dumps are appended to instead of stderr.
+const FileEnv = "CSVQUERY_STATUS_FILE"
+
+var (
+	mu         sync.Mutex
+	activities = make(map[uint64]*Activity)
+	sections   []section
+	nextID     atomic.Uint64
+	started    = time.Now()
+)
+
+type section struct {
+	name string
+	fn   func(w io.Writer)
+}
+
+// Activity is one unit of work shown in a dump. All methods are safe on a
+// nil *Activity and from any goroutine.
+type Activity struct {
+	id      uint64
+	kind    string
+	detail  string
+	started time.Time
+
+	phase    atomic.Value // string
+	reporter atomic.Value // func() string
+}
+
+// Begin registers an activity; call End when it finishes.
+func Begin(kind, detail string) *Activity {
+	a := &Activity{
+		id:      nextID.Add(1),
+		kind:    kind,
+		detail:  detail,
+		started: time.Now(),
+	}
+	mu.Lock()
+	activities[a.id] = a
+	mu.Unlock()
+	return a
+}
+
+// SetPhase records what the activity is currently doing.
+func (a *Activity) SetPhase(phase string) {
+	if a == nil {
+		return
+	}
+	a.phase.Store(phase)
+}
+
+// SetReporter installs a function returning a one-line progress summary,
+// called at dump time.
+func (a *Activity) SetReporter(fn func() string) {
+	if a == nil {
+		return
+	}
+	a.reporter.Store(fn)
+}
+
+// End removes the activity from the registry.
+func (a *Activity) End() {
+	if a == nil {
+		return
+	}
+	mu.Lock()
+	delete(activities, a.id)
+	mu.Unlock()
+}
+
+// Register adds a named section to every dump (e.g. daemon connection
+// counts). fn must not block.
+func Register(name string, fn func(w io.Writer)) {
+	mu.Lock()
+	sections = append(sections, section{name: name, fn: fn})
+	mu.Unlock()
+}
+
+// Dump writes the status report to w.
+func Dump(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintf(w, "=== csvquery status (pid %d) %s ===\n", os.Getpid(), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "Uptime:     %s\n", time.Since(started).Round(time.Second))
+	fmt.Fprintf(w, "Goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "Memory:     heap %d MB in use, %d MB from OS, %d GCs", mem.HeapAlloc>>20, mem.Sys>>20, mem.NumGC)
+	if limit := debug.SetMemoryLimit(-1); limit < 1<<62 {
+		fmt.Fprintf(w, ", GOMEMLIMIT %d MB", limit>>20)
+	}
+	fmt.Fprintln(w)
+
+	mu.Lock()
+	list := make([]*Activity, 0, len(activities))
+	for _, a := range activities {
+		list = append(list, a)
+	}
+	secs := append([]section(nil), sections...)
+	mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	fmt.Fprintf(w, "Activities: %d\n", len(list))
+	for _, a := range list {
+		fmt.Fprintf(w, "  #%d %s [%s]", a.id, a.kind, time.Since(a.started).Round(time.Millisecond))
+		if phase, _ := a.phase.Load().(string); phase != "" {
+			fmt.Fprintf(w, " phase=%s", phase)
+		}
+		if a.detail != "" {
+			fmt.Fprintf(w, " %s", a.detail)
+		}
+		fmt.Fprintln(w)
+		if fn, _ := a.reporter.Load().(func() string); fn != nil {
+			if line := fn(); line != "" {
+				fmt.Fprintf(w, "      %s\n", line)
+			}
+		}
+	}
+
+	for _, s := range secs {
+		fmt.Fprintf(w, "%s:\n", s.name)
+		s.fn(w)
+	}
+	fmt.Fprintln(w, "=== end status ===")
+}
+
+// dumpToTarget writes a dump to the FileEnv file (appending) or stderr.
+func dumpToTarget() {
+	path := os.Getenv(FileEnv)
+	if path == "" {
+		Dump(os.Stderr)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %v; dumping to stderr\n", err)
+		Dump(os.Stderr)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	Dump(f)
+}
@@ -0,0 +1,32 @@
+package status
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	a := Begin("query", "csv=data.csv")
+	a.SetPhase("index scan")
+	a.SetReporter(func() string { return "Scanned: 10 MB / 20 MB" })
+	Register("Test", func(w io.Writer) { fmt.Fprintln(w, "  in flight: 3") })
+
+	var buf bytes.Buffer
+	Dump(&buf)
+	out := buf.String()
+	for _, want := range []string{"Goroutines:", "Memory:", "query", "phase=index scan", "csv=data.csv", "Scanned: 10 MB / 20 MB", "in flight: 3"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Dump missing %q:\n%s", want, out)
+		}
+	}
+
+	a.End()
+	buf.Reset()
+	Dump(&buf)
+	if strings.Contains(buf.String(), "csv=data.csv") {
+		t.Errorf("Ended activity still listed:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Local stores artifacts as files in a directory.
+type Local struct {
+	Dir string
+}
+
+// NewLocal returns the backend of a local directory.
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+// Path returns the file of an artifact.
+func (l *Local) Path(name string) string {
+	return filepath.Join(l.Dir, name)
+}
+
+func (l *Local) String() string {
+	return l.Dir
+}
+
+type localObject struct {
+	*os.File
+	size int64
+}
+
+func (o *localObject) Size() int64 { return o.size }
+
+func (l *Local) Open(name string) (Object, error) {
+	f, err := os.Open(l.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &localObject{File: f, size: info.Size()}, nil
+}
+
+// localWriter writes next to the artifact and renames over it on Commit,
+// so readers never see a partially written file.
+type localWriter struct {
+	*os.File
+	path string
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return nil, err
+	}
+	path := l.Path(name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f, path: path}, nil
+}
+
+func (w *localWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.path)
+}
+
+func (w *localWriter) Abort() {
+	_ = w.File.Close()
+	_ = os.Remove(w.Name())
+}
+
+func (l *Local) Stat(name string) (Info, error) {
+	info, err := os.Stat(l.Path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(l.Path(name))
+}
+
+func (l *Local) List(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(l.Dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = filepath.Base(m)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the part size of multipart uploads, used for artifacts
+// too large for one PUT request. 10,000 parts allow indexes up to 1.25 TB.
+var s3PartSize int64 = 128 << 20
+
+// S3Config holds the connection settings of an S3 backend.
+type S3Config struct {
+	Region       string
+	Endpoint     string // Custom endpoint (MinIO, R2, ...); implies path-style URLs
+	AccessKey    string // Requests are sent unsigned without credentials
+	SecretKey    string
+	SessionToken string
+	Client       *http.Client
+}
+
+// S3ConfigFromEnv reads the standard AWS environment variables:
+// AWS_REGION (or AWS_DEFAULT_REGION, default us-east-1), AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_ENDPOINT_URL_S3 (or
+// AWS_ENDPOINT_URL).
+func S3ConfigFromEnv() S3Config {
+	cfg := S3Config{
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL_S3"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return cfg
+}
+
+// S3 stores artifacts as objects under a key prefix of a bucket. Reads are
+// ranged GETs, so a query only downloads the footer and the blocks it
+// scans. Writes are staged in a local temp file and uploaded on Commit.
+type S3 struct {
+	bucket string
+	prefix string // "" or ending in "/"
+	cfg    S3Config
+	base   *url.URL // Endpoint of the bucket
+	path   bool     // Path-style URLs (bucket in the path)
+}
+
+// NewS3 returns the backend of s3://bucket/prefix.
+func NewS3(bucket, prefix string, cfg S3Config) (*S3, error) {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &S3{bucket: bucket, prefix: prefix, cfg: cfg}
+	if cfg.Endpoint != "" {
+		base, err := url.Parse(cfg.Endpoint)
+		if err != nil || base.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+		}
+		s.base, s.path = base, true
+	} else {
+		s.base = &url.URL{Scheme: "https", Host: bucket + ".s3." + cfg.Region + ".amazonaws.com"}
+	}
+	return s, nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// url returns the URL of an object key ("" = the bucket itself).
+func (s *S3) url(key string, query url.Values) *url.URL {
+	p := "/" + key
+	if s.path {
+		p = "/" + s.bucket + p
+	}
+	return &url.URL{
+		Scheme:   s.base.Scheme,
+		Host:     s.base.Host,
+		Path:     p,
+		RawPath:  uriEncode(p, false),
+		RawQuery: canonicalQuery(query),
+	}
+}
+
+// do sends a signed request. Error responses are turned into errors; a
+// missing object matches fs.ErrNotExist.
+func (s *S3) do(method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now())
+
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(method), s.String()+strings.TrimPrefix(key, s.prefix))
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, e.Code, e.Message)
+}
+
+// sign adds AWS Signature Version 4 headers. The payload is not hashed
+// (UNSIGNED-PAYLOAD): requests go over TLS and artifacts carry their own
+// checksums.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.cfg.SessionToken)
+	}
+	if s.cfg.AccessKey == "" {
+		return
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.cfg.SessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but RFC 3986 unreserved characters (and
+// '/' unless encodeSlash), as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes a query string in SigV4 canonical form (sorted,
+// strictly escaped), which S3 also accepts as the request's query string.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3Object struct {
+	s    *S3
+	key  string
+	size int64
+}
+
+func (s *S3) Open(name string) (Object, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s: s, key: s.prefix + name, size: info.Size}, nil
+}
+
+func (o *s3Object) Size() int64  { return o.size }
+func (o *s3Object) Close() error { return nil }
+
+// ReadAt issues one ranged GET per call.
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), o.size-off)
+	if want == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+want-1)}}
+	resp, err := o.s.do(http.MethodGet, o.key, nil, nil, 0, header)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	n, err := io.ReadFull(resp.Body, p[:want])
+	if err != nil {
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// s3Writer stages the artifact in a temp file until Commit uploads it.
+type s3Writer struct {
+	s    *S3
+	key  string
+	file *os.File
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	f, err := os.CreateTemp("", "csvquery-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, key: s.prefix + name, file: f}, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *s3Writer) Abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+func (w *s3Writer) Commit() error {
+	defer w.Abort()
+	size, err := w.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size <= s3PartSize {
+		resp, err := w.s.do(http.MethodPut, w.key, nil, io.NewSectionReader(w.file, 0, size), size, nil)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return w.multipart(size)
+}
+
+// multipart uploads the staged file in s3PartSize parts.
+func (w *s3Writer) multipart(size int64) error {
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3 multipart upload of %s: %w", w.key, err)
+	}
+	uploadID := initiated.UploadID
+
+	type part struct {
+		Number int    `xml:"PartNumber"`
+		ETag   string `xml:"ETag"`
+	}
+	var parts []part
+	for off, n := int64(0), 1; off < size; off, n = off+s3PartSize, n+1 {
+		length := min(s3PartSize, size-off)
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		resp, err := w.s.do(http.MethodPut, w.key, query, io.NewSectionReader(w.file, off, length), length, nil)
+		if err != nil {
+			w.abortMultipart(uploadID)
+			return err
+		}
+		_ = resp.Body.Close()
+		parts = append(parts, part{Number: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		w.abortMultipart(uploadID)
+		return err
+	}
+	// S3 can report a failed completion in a 200 response
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return fmt.Errorf("s3 multipart upload of %s failed: %s", w.key, data)
+	}
+	return nil
+}
+
+func (w *s3Writer) abortMultipart(uploadID string) {
+	if resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {uploadID}}, nil, 0, nil); err == nil {
+		_ = resp.Body.Close()
+	}
+}
+
+func (s *S3) Stat(name string) (Info, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+name, nil, nil, 0, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	_ = resp.Body.Close()
+	info := Info{Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+func (s *S3) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List pages through ListObjectsV2 under the literal prefix of pattern.
+func (s *S3) List(pattern string) ([]string, error) {
+	literal := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		literal = pattern[:i]
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + literal}}
+
+	var names []string
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %w", s, err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(obj.Key, s.prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				names = append(names, name)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,121 @@
+// Package storage abstracts where index artifacts (.cidx, .bloom and
+// _meta.json files) live. The indexer writes them and the query engine reads
+// them through a Backend, so they can be kept on the local filesystem or in
+// an object store without the sorter or block reader knowing the difference.
+//
+// Spill chunks, checkpoints and other scratch files are always local.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Backend stores index artifacts by name (a file name such as
+// "orders_status.cidx", relative to the backend's location).
+type Backend interface {
+	// Open opens an artifact for random-access reads.
+	Open(name string) (Object, error)
+	// Create starts writing an artifact. It only replaces an existing one
+	// once Commit succeeds; Abort discards it.
+	Create(name string) (Writer, error)
+	// Stat describes an artifact. Missing artifacts fail with an error
+	// matching fs.ErrNotExist.
+	Stat(name string) (Info, error)
+	// Remove deletes an artifact.
+	Remove(name string) error
+	// List returns the names matching a path.Match pattern, sorted.
+	List(pattern string) ([]string, error)
+	// String describes the location for messages.
+	String() string
+}
+
+// Object is an artifact opened for reading.
+type Object interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// Writer is an artifact being written.
+type Writer interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+// Info describes a stored artifact.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Open returns the backend of an index location: "s3://bucket/prefix" for
+// S3 (see NewS3), anything else is a local directory.
+func Open(location string) (Backend, error) {
+	scheme, rest, ok := strings.Cut(location, "://")
+	if !ok {
+		return NewLocal(location), nil
+	}
+	switch scheme {
+	case "s3":
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid S3 location %q: want s3://bucket/prefix", location)
+		}
+		return NewS3(bucket, prefix, S3ConfigFromEnv())
+	case "file":
+		return NewLocal(rest), nil
+	}
+	return nil, fmt.Errorf("unsupported index location %q (use a directory or s3://bucket/prefix)", location)
+}
+
+// IsRemote reports whether an index location is not a local directory.
+func IsRemote(location string) bool {
+	scheme, _, ok := strings.Cut(location, "://")
+	return ok && scheme != "file"
+}
+
+// LocalPath returns the filesystem path of an artifact if the backend is
+// local, so callers can memory-map it or rename it in place.
+func LocalPath(b Backend, name string) (string, bool) {
+	if l, ok := b.(*Local); ok {
+		return l.Path(name), true
+	}
+	return "", false
+}
+
+// ReadFile reads a whole artifact.
+func ReadFile(b Backend, name string) ([]byte, error) {
+	obj, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = obj.Close() }()
+	data := make([]byte, obj.Size())
+	if _, err := obj.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteFile writes a whole artifact.
+func WriteFile(b Backend, name string, data []byte) error {
+	w, err := b.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// notExist wraps a missing-artifact error so it matches fs.ErrNotExist.
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 serves the subset of the S3 API the backend uses (path-style).
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int][]byte
+	gets    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		type content struct{ Key string }
+		var page struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		for k := range f.objects {
+			if strings.HasPrefix(k, q.Get("prefix")) {
+				page.Contents = append(page.Contents, content{k})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.parts[key] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key)
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.parts[key][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		var done struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		_ = xml.Unmarshal(body, &done)
+		var data []byte
+		for _, p := range done.Parts {
+			data = append(data, f.parts[key][p.PartNumber]...)
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	default:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodDelete:
+			delete(f.objects, key)
+		case http.MethodHead:
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		case http.MethodGet:
+			f.gets++
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+				data = data[start : end+1]
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			_, _ = w.Write(data)
+		}
+	}
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, Backend) {
+	fake := &fakeS3{objects: map[string][]byte{}, parts: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	store, err := NewS3("bucket", "indexes/", S3Config{Endpoint: srv.URL, AccessKey: "AK", SecretKey: "SK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, store
+}
+
+// testBackend checks the Backend contract shared by all implementations.
+func testBackend(t *testing.T, store Backend) {
+	if _, err := store.Stat("missing.cidx"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing artifact: %v, want fs.ErrNotExist", err)
+	}
+
+	data := []byte("CIDX block data and a footer")
+	if err := WriteFile(store, "orders_status.cidx", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(store, "orders_status.cidx.bloom", []byte("bloom")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(store, "other_id.cidx", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aborted writes leave the previous artifact in place
+	w, err := store.Create("orders_status.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("partial"))
+	w.Abort()
+
+	info, err := store.Stat("orders_status.cidx")
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("Stat = %+v, %v; want %d bytes", info, err, len(data))
+	}
+
+	obj, err := store.Open("orders_status.cidx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := obj.ReadAt(buf, 11); n != 5 || err != nil || string(buf) != "data " {
+		t.Errorf("ReadAt(5, 11) = %d %q %v", n, buf[:n], err)
+	}
+	// Reads past the end are short with io.EOF
+	if n, err := obj.ReadAt(buf, int64(len(data))-3); n != 3 || err != io.EOF || string(buf[:n]) != "ter" {
+		t.Errorf("ReadAt at the end = %d %q %v", n, buf[:n], err)
+	}
+	_ = obj.Close()
+
+	if got, err := ReadFile(store, "orders_status.cidx"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFile = %q, %v", got, err)
+	}
+
+	names, err := store.List("orders_*.cidx")
+	if err != nil || !reflect.DeepEqual(names, []string{"orders_status.cidx"}) {
+		t.Errorf("List = %v, %v", names, err)
+	}
+
+	if err := store.Remove("orders_status.cidx"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("orders_status.cidx"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Remove: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, store)
+	if path, ok := LocalPath(store, "x.cidx"); !ok || !strings.HasPrefix(path, dir) {
+		t.Errorf("LocalPath = %q, %v", path, ok)
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake, store := newFakeS3(t)
+	testBackend(t, store)
+	if _, ok := LocalPath(store, "x.cidx"); ok {
+		t.Error("S3 backend reported a local path")
+	}
+	if _, ok := fake.objects["indexes/other_id.cidx"]; !ok {
+		keys := make([]string, 0, len(fake.objects))
+		for k := range fake.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.Errorf("Objects not stored under the prefix: %v", keys)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	defer func(size int64) { s3PartSize = size }(s3PartSize)
+	s3PartSize = 10
+
+	fake, store := newFakeS3(t)
+	data := []byte("a multipart upload of several parts")
+	if err := WriteFile(store, "big.cidx", data); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["indexes/big.cidx"]; !bytes.Equal(got, data) {
+		t.Errorf("Uploaded %q, want %q", got, data)
+	}
+	if len(fake.parts["indexes/big.cidx"]) != 4 {
+		t.Errorf("Uploaded %d parts, want 4", len(fake.parts["indexes/big.cidx"]))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for location, want := range map[string]string{
+		"/data/idx":            "/data/idx",
+		"file:///data/idx":     "/data/idx",
+		"s3://bucket/a/b":      "s3://bucket/a/b/",
+		"s3://bucket":          "s3://bucket/",
+		"gs://bucket/idx":      "",
+		"s3:///missing-bucket": "",
+	} {
+		store, err := Open(location)
+		if want == "" {
+			if err == nil {
+				t.Errorf("Open(%q) accepted", location)
+			}
+			continue
+		}
+		if err != nil || store.String() != want {
+			t.Errorf("Open(%q) = %v, %v; want %s", location, store, err, want)
+		}
+		if IsRemote(location) != strings.HasPrefix(want, "s3://") {
+			t.Errorf("IsRemote(%q) = %v", location, IsRemote(location))
+		}
+	}
+}
@@ -1,10 +1,8 @@
 package update
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/entreya/csvquery/internal/query"
@@ -14,64 +12,195 @@ import (
 // Config represents update configuration
 type Config struct {
 	CsvPath   string
-	SetClause string // "COL=VAL,COL2=VAL2"
+	SetClause string // "COL=VAL,COL2=VAL2" or a JSON object (see ParseSet)
 	WhereStr  string // "COL=VAL" or json filter
 	IndexDir  string
+	DryRun    bool // Count the matching rows without saving
+	Log       bool // Save to the binary update log (see updatemgr.UseLog)
 }
 
-// Execute logic handled by RunUpdate via main.go logic
-// func Execute(cfg Config) error { ... }
-
-// RunUpdate executes the update logic given a query engine and update map
-func RunUpdate(q *query.QueryEngine, csvPath string, updates map[string]string) (int, error) {
-	// Capture Output
-	// We need to capture query output to get Offsets.
-	// QueryEngine prints to q.Writer.
-	var buf bytes.Buffer
-	q.Writer = &buf
-
-	// Run Query
-	if err := q.Run(); err != nil {
-		return 0, fmt.Errorf("query failed: %v", err)
+// Execute sets the columns of SetClause in every row matching WhereStr and
+// returns how many rows it changed (or would, with DryRun). Rows are found
+// through the indexes of IndexDir when they answer the filter.
+func Execute(cfg Config) (int, error) {
+	updates, err := ParseSet(cfg.SetClause)
+	if err != nil {
+		return 0, err
 	}
-
-	// Load Updates Manager
-	um, err := updatemgr.Load(csvPath)
+	where, err := ParseWhere(cfg.WhereStr)
 	if err != nil {
 		return 0, err
 	}
+	if where == nil {
+		return 0, fmt.Errorf("%w: a where filter is required: an empty one would update every row", query.ErrBadQuery)
+	}
 
-	// Parse Results
-	scanner := bufio.NewScanner(&buf)
-	count := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Output format: "Offset,LineNum"
-		parts := strings.Split(line, ",")
-		if len(parts) < 2 {
-			continue
+	q := query.NewQueryEngine(query.QueryConfig{
+		CsvPath:  cfg.CsvPath,
+		IndexDir: cfg.IndexDir,
+		Where:    where,
+	})
+	for col := range updates {
+		ok, err := q.HasColumn(col)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the CSV header: %w", err)
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: column '%s' not found", query.ErrBadQuery, col)
+		}
+	}
+	if cfg.DryRun {
+		var result query.Result
+		q.Result = &result
+		if err := q.Run(); err != nil {
+			return 0, fmt.Errorf("query failed: %w", err)
 		}
+		return len(result.Rows), nil
+	}
+	return RunUpdate(q, cfg.CsvPath, updates, cfg.Log)
+}
 
-		offsetStr := parts[0]
-		offset, err := strconv.ParseInt(offsetStr, 10, 64)
-		if err != nil {
+// ParseSet parses a set clause into lowercase column names (as row
+// overrides store them) and values: "COL=VAL,COL2=VAL2", where a value in
+// double quotes may hold commas (and "" for a quote, as in CSV), or a JSON
+// object of the columns and their values.
+func ParseSet(clause string) (map[string]string, error) {
+	if strings.HasPrefix(strings.TrimSpace(clause), "{") {
+		return parseSetJSON(clause)
+	}
+	pairs, err := splitSet(clause)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string]string)
+	for _, pair := range pairs {
+		if strings.TrimSpace(pair) == "" {
 			continue
 		}
+		col, val, ok := strings.Cut(pair, "=")
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !ok || col == "" {
+			return nil, fmt.Errorf("%w: invalid set %q: expected COL=VAL", query.ErrBadQuery, pair)
+		}
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = strings.ReplaceAll(val[1:len(val)-1], `""`, `"`)
+		}
+		updates[col] = val
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("%w: nothing to set", query.ErrBadQuery)
+	}
+	return updates, nil
+}
 
-		// Apply Updates (Indexed by Offset now)
-		for col, val := range updates {
-			um.Set(offset, col, val)
+// splitSet splits a set clause at the commas outside double quotes.
+func splitSet(clause string) ([]string, error) {
+	var pairs []string
+	start, quoted := 0, false
+	for i := 0; i < len(clause); i++ {
+		switch clause[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				pairs = append(pairs, clause[start:i])
+				start = i + 1
+			}
 		}
-		count++
 	}
+	if quoted {
+		return nil, fmt.Errorf("%w: invalid set %q: unterminated quote", query.ErrBadQuery, clause)
+	}
+	return append(pairs, clause[start:]), nil
+}
 
-	// Save
-	if count > 0 {
-		if err := um.Save(); err != nil {
-			return count, fmt.Errorf("failed to save updates: %v", err)
+// parseSetJSON parses a set clause given as a JSON object. Numbers and
+// booleans are set as written; null sets an empty value.
+func parseSetJSON(clause string) (map[string]string, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(clause))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%w: invalid set %q: %v", query.ErrBadQuery, clause, err)
+	}
+	updates := make(map[string]string, len(fields))
+	for col, v := range fields {
+		name := strings.ToLower(strings.TrimSpace(col))
+		if name == "" {
+			return nil, fmt.Errorf("%w: invalid set: empty column name", query.ErrBadQuery)
 		}
+		switch v := v.(type) {
+		case string:
+			updates[name] = v
+		case json.Number:
+			updates[name] = v.String()
+		case bool:
+			updates[name] = fmt.Sprint(v)
+		case nil:
+			updates[name] = ""
+		default:
+			return nil, fmt.Errorf("%w: invalid set: the value of %s is not a string, number or boolean", query.ErrBadQuery, col)
+		}
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("%w: nothing to set", query.ErrBadQuery)
+	}
+	return updates, nil
+}
+
+// ParseWhere parses a filter: the JSON of query --where, or "COL=VAL" for
+// one equality.
+func ParseWhere(s string) (*query.Condition, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		return query.ParseCondition([]byte(s))
 	}
+	col, val, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(col) == "" {
+		return nil, fmt.Errorf("%w: %q: expected COL=VAL or JSON", query.ErrBadWhere, s)
+	}
+	data, err := json.Marshal(map[string]string{strings.TrimSpace(col): val})
+	if err != nil {
+		return nil, err
+	}
+	return query.ParseCondition(data)
+}
 
-	return count, nil
+// RunUpdate runs q, whose filter selects the rows, and sets updates in
+// every row it returns. The overrides are saved to the sidecar at once,
+// atomically, or not at all if the query fails. It returns the number of
+// rows updated. With useLog they go to the update log, which is created if
+// need be. Loading and saving them holds the CSV's writer lock (see
+// updatemgr.Lock).
+func RunUpdate(q *query.QueryEngine, csvPath string, updates map[string]string, useLog bool) (int, error) {
+	var result query.Result
+	q.Result = &result
+	if err := q.Run(); err != nil {
+		return 0, fmt.Errorf("query failed: %w", err)
+	}
+	if len(result.Rows) == 0 {
+		return 0, nil
+	}
+
+	unlock, err := updatemgr.Lock(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	um, err := updatemgr.Load(csvPath)
+	if err != nil {
+		return 0, err
+	}
+	if useLog {
+		um.UseLog()
+	}
+	for _, row := range result.Rows {
+		for col, val := range updates {
+			um.Set(row.Offset, col, val)
+		}
+	}
+	if err := um.Save(); err != nil {
+		return 0, fmt.Errorf("failed to save updates: %w", err)
+	}
+	return len(result.Rows), nil
 }
@@ -0,0 +1,31 @@
+package update
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSet(t *testing.T) {
+	for _, tc := range []struct {
+		clause string
+		want   map[string]string
+	}{
+		{"city=Oslo", map[string]string{"city": "Oslo"}},
+		{"City=Oslo, zip=0150", map[string]string{"city": "Oslo", "zip": "0150"}},
+		{`note="Smith, Ann",city=Oslo`, map[string]string{"note": "Smith, Ann", "city": "Oslo"}},
+		{`note="say ""hi"", then go"`, map[string]string{"note": `say "hi", then go`}},
+		{"note=a=b", map[string]string{"note": "a=b"}},
+		{`{"Note":"Smith, Ann","n":5,"ok":true,"gone":null}`, map[string]string{"note": "Smith, Ann", "n": "5", "ok": "true", "gone": ""}},
+		{`note="open, city=Oslo`, nil},
+		{"=x", nil},
+		{"city", nil},
+		{"", nil},
+		{`{"a":[1]}`, nil},
+		{`{}`, nil},
+	} {
+		got, err := ParseSet(tc.clause)
+		if (err != nil) != (tc.want == nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseSet(%q) = %v, %v; want %v", tc.clause, got, err, tc.want)
+		}
+	}
+}
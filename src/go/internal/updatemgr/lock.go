@@ -0,0 +1,44 @@
+package updatemgr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Writers of the updates of a CSV hold its writer lock from Load to Save:
+// an exclusive lock on <csv>_updates.lock, which the daemon and
+// `csvquery update` both take. Without it a second writer would lose
+// changes: it saves on top of the state it loaded, and a log compaction
+// renames a new file over the log, dropping what others appended to the
+// old one. The lock has its own file because the sidecar and the log are
+// replaced by renames. Readers take no lock: saves are atomic renames or
+// appends of whole entries (see log.go).
+
+// LockPath returns the path of the writer lock of the CSV at csvPath.
+func LockPath(csvPath string) string {
+	return csvPath + "_updates.lock"
+}
+
+// Lock takes the writer lock of the updates of the CSV at csvPath,
+// waiting until no other writer holds it. Call unlock after Save.
+func Lock(csvPath string) (unlock func(), err error) {
+	absPath, err := filepath.Abs(csvPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(LockPath(absPath), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open updates lock: %v", err)
+	}
+	if err := common.LockFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to lock updates: %v", err)
+	}
+	return func() {
+		_ = common.UnlockFile(f)
+		_ = f.Close()
+	}, nil
+}
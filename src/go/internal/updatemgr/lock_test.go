@@ -0,0 +1,61 @@
+package updatemgr
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLockedWriters(t *testing.T) {
+	_, csvPath := newLogManager(t)
+	big := strings.Repeat("v", 100<<10)
+
+	// Each writer sets rows of its own; both overwrite row 1, so the log
+	// grows past compactMinBytes and is compacted under them
+	const writers, saves = 2, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*saves)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range saves {
+				unlock, err := Lock(csvPath)
+				if err != nil {
+					errs <- err
+					return
+				}
+				um, err := Load(csvPath)
+				if err == nil {
+					um.UseLog()
+					um.Set(int64(100+w*saves+i), "a", "x")
+					um.Set(1, "a", big)
+					err = um.Save()
+				}
+				unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	um, err := Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := int64(100); offset < 100+writers*saves; offset++ {
+		if um.GetRow(offset)["a"] != "x" {
+			t.Errorf("row %d lost", offset)
+		}
+	}
+	if size := logSize(t, csvPath); size >= writers*saves*int64(len(big)) {
+		t.Errorf("log of %d bytes never compacted", size)
+	}
+}
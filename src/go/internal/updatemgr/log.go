@@ -0,0 +1,263 @@
+package updatemgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// The update log is the sidecar of CSVs with many updates: <csv>_updates.log,
+// which Save appends the changes since Load to instead of rewriting all of
+// them, and Load reads through mmap instead of parsing JSON. After an
+// 8-byte magic, each entry is a fixed header and the column and value bytes:
+//
+//	op u8 | offset u64 | column length u16 | value length u32 | column | value
+//
+// all big-endian. op is logSet, or logDelete with no column or value. Later
+// entries win. A torn last entry, from a write cut short, is ignored, and
+// the next Save rewrites the log without it. Once the log is more than
+// twice the size of the updates it holds, and past compactMinBytes, Save
+// compacts it: one entry per live value, written to a temporary file and
+// renamed over it, so the log stays bounded by the updates it holds.
+//
+// The log has one writer at a time: writers hold the CSV's writer lock
+// from Load to Save (see lock.go), so appends always follow the state they
+// were loaded after, and no append goes to a log a compaction replaced.
+//
+// When the log exists it holds all the updates of the CSV: a JSON sidecar
+// next to it is ignored, and removed by the Save that creates the log.
+
+const (
+	logMagic        = "CQUPLOG1"
+	logHeaderSize   = 15
+	compactMinBytes = 1 << 20
+
+	logSet    byte = 1
+	logDelete byte = 2
+)
+
+// logEntry is a change waiting for Save to append it.
+type logEntry struct {
+	op            byte
+	offset        int64
+	column, value string
+}
+
+// LogPath returns the path of the update log of the CSV at csvPath.
+func LogPath(csvPath string) string {
+	return csvPath + "_updates.log"
+}
+
+// UseLog makes Save write the update log, creating it (with the updates
+// loaded from the JSON sidecar) if there is none yet.
+func (um *UpdateManager) UseLog() {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if !um.useLog {
+		um.useLog = true
+		um.rewrite = true
+	}
+}
+
+// UsesLog reports whether the updates are kept in the update log.
+func (um *UpdateManager) UsesLog() bool {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	return um.useLog
+}
+
+// loadLog replays the update log, if the CSV has one. ok is false when it
+// does not.
+func (um *UpdateManager) loadLog() (ok bool, err error) {
+	data, release, err := common.MapFile(um.logPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read update log: %v", err)
+	}
+	defer release()
+
+	um.useLog = true
+	if len(data) < len(logMagic) || string(data[:len(logMagic)]) != logMagic {
+		return true, fmt.Errorf("%s is not an update log", um.logPath)
+	}
+	columns := make(map[string]string) // Interned: few columns, many rows
+	pos := len(logMagic)
+	for len(data)-pos >= logHeaderSize {
+		h := data[pos : pos+logHeaderSize]
+		offset := int64(binary.BigEndian.Uint64(h[1:9]))
+		colLen := int(binary.BigEndian.Uint16(h[9:11]))
+		valLen := int(binary.BigEndian.Uint32(h[11:15]))
+		end := pos + logHeaderSize + colLen + valLen
+		if end > len(data) {
+			break
+		}
+		key := strconv.FormatInt(offset, 10)
+		switch h[0] {
+		case logSet:
+			col := data[pos+logHeaderSize : pos+logHeaderSize+colLen]
+			column, ok := columns[string(col)]
+			if !ok {
+				column = string(col)
+				columns[column] = column
+			}
+			row := um.Overrides[key]
+			if row == nil {
+				row = make(map[string]string, 1)
+				um.Overrides[key] = row
+			}
+			row[column] = string(data[pos+logHeaderSize+colLen : end])
+		case logDelete:
+			if um.Deleted == nil {
+				um.Deleted = make(map[string]bool)
+			}
+			um.Deleted[key] = true
+			delete(um.Overrides, key)
+		default:
+			return true, fmt.Errorf("%s: unknown entry %d at byte %d", um.logPath, h[0], pos)
+		}
+		pos = end
+	}
+	um.logSize = int64(pos)
+	um.rewrite = pos < len(data) // Drop the torn entry
+	return true, nil
+}
+
+// saveLog appends the changes since Load to the update log, or rewrites it
+// when it is new, torn or due for compaction.
+func (um *UpdateManager) saveLog() error {
+	if !um.rewrite && len(um.changes) > 0 {
+		if err := um.appendLog(); err != nil {
+			return err
+		}
+	}
+	live := um.liveSize()
+	if um.rewrite || (um.logSize > compactMinBytes && um.logSize > 2*live) {
+		if err := um.compactLog(); err != nil {
+			return err
+		}
+		// The JSON sidecar the log replaces
+		if err := os.Remove(um.schemaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	um.changes = um.changes[:0]
+	return nil
+}
+
+// appendLog appends the pending changes in one write.
+func (um *UpdateManager) appendLog() error {
+	var buf []byte
+	for _, e := range um.changes {
+		buf = appendLogEntry(buf, e)
+	}
+	f, err := os.OpenFile(um.logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		um.logSize += int64(len(buf))
+	}
+	return err
+}
+
+// compactLog rewrites the log with one entry per live value, by offset.
+func (um *UpdateManager) compactLog() error {
+	buf := []byte(logMagic)
+	for _, offset := range sortedKeys(um.Deleted) {
+		buf = appendLogEntry(buf, logEntry{op: logDelete, offset: offset})
+	}
+	for _, offset := range sortedKeys(um.Overrides) {
+		row := um.Overrides[RowKey(offset)]
+		columns := make([]string, 0, len(row))
+		for col := range row {
+			columns = append(columns, col)
+		}
+		sort.Strings(columns)
+		for _, col := range columns {
+			buf = appendLogEntry(buf, logEntry{op: logSet, offset: offset, column: col, value: row[col]})
+		}
+	}
+	if err := writeAtomic(um.logPath, buf); err != nil {
+		return err
+	}
+	um.logSize = int64(len(buf))
+	um.rewrite = false
+	return nil
+}
+
+// liveSize returns the size a compacted log would have.
+func (um *UpdateManager) liveSize() int64 {
+	size := int64(len(logMagic) + len(um.Deleted)*logHeaderSize)
+	for _, row := range um.Overrides {
+		for col, val := range row {
+			size += int64(logHeaderSize + len(col) + len(val))
+		}
+	}
+	return size
+}
+
+// appendLogEntry appends the encoding of e to buf.
+func appendLogEntry(buf []byte, e logEntry) []byte {
+	buf = append(buf, e.op)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.offset))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.column)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.value)))
+	buf = append(buf, e.column...)
+	return append(buf, e.value...)
+}
+
+// sortedKeys returns the row offsets of the keys of m, ascending. Keys that
+// are not offsets are skipped.
+func sortedKeys[V any](m map[string]V) []int64 {
+	offsets := make([]int64, 0, len(m))
+	for key := range m {
+		if offset, err := strconv.ParseInt(key, 10, 64); err == nil {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
+
+// writeAtomic replaces the file at path with data: written to a temporary
+// file next to it and renamed over it, so readers see all of it or the old
+// file, and a failed write leaves the old one.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
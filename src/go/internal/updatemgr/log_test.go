@@ -0,0 +1,254 @@
+package updatemgr
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newLogManager returns a manager of a CSV in a temp dir keeping its
+// updates in the update log.
+func newLogManager(t *testing.T) (*UpdateManager, string) {
+	t.Helper()
+	csvPath := filepath.Join(t.TempDir(), "t.csv")
+	if err := os.WriteFile(csvPath, []byte("id\n1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	um, err := Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.UseLog()
+	return um, csvPath
+}
+
+// reload loads the updates of csvPath again and checks they are those of
+// um.
+func reload(t *testing.T, um *UpdateManager, csvPath string) *UpdateManager {
+	t.Helper()
+	loaded, err := Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.UsesLog() {
+		t.Fatal("loaded without the log")
+	}
+	if !reflect.DeepEqual(loaded.Overrides, um.Overrides) || len(loaded.Deleted) != len(um.Deleted) {
+		t.Fatalf("loaded %v, deleted %v; saved %v, deleted %v", loaded.Overrides, loaded.Deleted, um.Overrides, um.Deleted)
+	}
+	for key := range um.Deleted {
+		if !loaded.Deleted[key] {
+			t.Fatalf("loaded deleted %v, saved %v", loaded.Deleted, um.Deleted)
+		}
+	}
+	return loaded
+}
+
+// logSize returns the size of the update log of csvPath.
+func logSize(t *testing.T, csvPath string) int64 {
+	t.Helper()
+	info, err := os.Stat(LogPath(csvPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestLogRoundTrip(t *testing.T) {
+	um, csvPath := newLogManager(t)
+	if err := os.WriteFile(um.schemaPath, []byte(`{"version":2,"rows":{"7":{"a":"json"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	um, err := Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.UseLog()
+	um.Set(10, "a", "x")
+	um.Set(10, "b", "")
+	um.Set(20, "a", "y")
+	um.Delete(30)
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(um.schemaPath); !os.IsNotExist(err) {
+		t.Errorf("JSON sidecar left beside the log: %v", err)
+	}
+	um = reload(t, um, csvPath)
+	if um.Overrides["7"]["a"] != "json" {
+		t.Errorf("updates of the JSON sidecar lost: %v", um.Overrides)
+	}
+
+	// Later saves append
+	before := logSize(t, csvPath)
+	um.Set(20, "a", "z")
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if after := logSize(t, csvPath); after != before+logHeaderSize+2 {
+		t.Errorf("log grew from %d to %d bytes, want one entry", before, after)
+	}
+	reload(t, um, csvPath)
+}
+
+func TestLogDeleteThenSet(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		changes func(um *UpdateManager)
+		deleted bool
+		row     map[string]string
+	}{
+		{"delete then set", func(um *UpdateManager) {
+			um.Delete(10)
+			um.Set(10, "a", "x")
+		}, true, map[string]string{"a": "x"}},
+		{"set then delete", func(um *UpdateManager) {
+			um.Set(10, "a", "x")
+			um.Delete(10)
+		}, true, nil},
+		{"set, delete, set", func(um *UpdateManager) {
+			um.Set(10, "a", "x")
+			um.Delete(10)
+			um.Set(10, "b", "y")
+		}, true, map[string]string{"b": "y"}},
+	} {
+		for _, compact := range []bool{false, true} {
+			um, csvPath := newLogManager(t)
+			if err := um.Save(); err != nil { // Creates the log: later saves append
+				t.Fatal(err)
+			}
+			tc.changes(um)
+			if compact {
+				um.rewrite = true
+			}
+			if err := um.Save(); err != nil {
+				t.Fatal(err)
+			}
+			loaded := reload(t, um, csvPath)
+			if loaded.IsDeleted(10) != tc.deleted || !reflect.DeepEqual(loaded.GetRow(10), tc.row) {
+				t.Errorf("%s (compacted %v): deleted %v, row %v; want %v, %v",
+					tc.name, compact, loaded.IsDeleted(10), loaded.GetRow(10), tc.deleted, tc.row)
+			}
+		}
+	}
+}
+
+func TestLogTornTail(t *testing.T) {
+	for _, cut := range []int{1, logHeaderSize - 1, logHeaderSize, logHeaderSize + 3} {
+		um, csvPath := newLogManager(t)
+		um.Set(10, "a", "x")
+		if err := um.Save(); err != nil {
+			t.Fatal(err)
+		}
+		whole := logSize(t, csvPath)
+		um.Set(20, "city", "Paris")
+		if err := um.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		// A write cut short leaves the start of the last entry
+		if err := os.Truncate(LogPath(csvPath), whole+int64(cut)); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := Load(csvPath)
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		if loaded.GetRow(20) != nil || loaded.GetRow(10)["a"] != "x" {
+			t.Errorf("cut at %d: loaded %v", cut, loaded.Overrides)
+		}
+
+		// The next save drops the torn entry, so appends after it are read
+		loaded.Set(30, "a", "y")
+		if err := loaded.Save(); err != nil {
+			t.Fatal(err)
+		}
+		loaded.Set(40, "a", "z")
+		if err := loaded.Save(); err != nil {
+			t.Fatal(err)
+		}
+		reload(t, loaded, csvPath)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	big := strings.Repeat("v", 100<<10)
+	um, csvPath := newLogManager(t)
+	um.Set(10, "a", big)
+	um.Set(20, "a", big)
+	um.Set(30, "a", big)
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	live := um.liveSize()
+	if got := logSize(t, csvPath); got != live {
+		t.Fatalf("new log of %d bytes, want %d", got, live)
+	}
+
+	// Overwrites grow the log until it is past compactMinBytes and twice
+	// the live updates: then the save compacts it
+	compacted := false
+	for i := 0; i < 30 && !compacted; i++ {
+		before := logSize(t, csvPath)
+		um.Set(10, "a", big[:len(big)-i-1])
+		if err := um.Save(); err != nil {
+			t.Fatal(err)
+		}
+		grown := before + logHeaderSize + 1 + int64(len(big)-i-1)
+		switch size := logSize(t, csvPath); {
+		case size == grown:
+			if grown > compactMinBytes && grown > 2*um.liveSize() {
+				t.Fatalf("log of %d bytes, %d live, not compacted", grown, um.liveSize())
+			}
+		case size == um.liveSize():
+			if grown <= compactMinBytes || grown <= 2*um.liveSize() {
+				t.Fatalf("log of %d bytes, %d live, compacted", grown, um.liveSize())
+			}
+			compacted = true
+		default:
+			t.Fatalf("log of %d bytes, want %d or %d", size, grown, um.liveSize())
+		}
+	}
+	if !compacted {
+		t.Fatal("log never compacted")
+	}
+	reload(t, um, csvPath)
+
+	// Past compactMinBytes but mostly live: appended to
+	um, csvPath = newLogManager(t)
+	for i := range 12 {
+		um.Set(int64(i), "a", big)
+	}
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	before := logSize(t, csvPath)
+	um.Set(100, "a", big)
+	if err := um.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := logSize(t, csvPath), before+logHeaderSize+1+int64(len(big)); got != want {
+		t.Errorf("mostly live log of %d bytes, want %d appended to", got, want)
+	}
+}
+
+func TestLogInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"magic", []byte("CQUPLOG0")},
+		{"short", []byte("CQU")},
+		{"op", appendLogEntry([]byte(logMagic), logEntry{op: 9, offset: 10})},
+	} {
+		csvPath := filepath.Join(t.TempDir(), "t.csv")
+		if err := os.WriteFile(LogPath(csvPath), tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(csvPath); err == nil {
+			t.Errorf("%s: loaded", tc.name)
+		}
+	}
+}
@@ -5,20 +5,47 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 )
 
+// FormatVersion is the version of the sidecars Load returns and Save
+// writes. Since version 2 rows are identified by the byte offset of their
+// start in the CSV, everywhere: updates, queries, fetches. Appends leave
+// offsets as they are; rewriting the CSV changes them. Older sidecars are
+// migrated in memory as they load (see migrate), and saved migrated by the
+// next write.
+const FormatVersion = 2
+
 // UpdateManager handles row-level overrides stored in a sidecar JSON file.
 type UpdateManager struct {
 	csvPath    string
 	schemaPath string
 	mu         sync.RWMutex
-	// Overrides maps LineNumber -> Column -> Value
+
+	// Update log state (see log.go)
+	logPath string
+	useLog  bool
+	rewrite bool       // Save rewrites the log rather than appending to it
+	logSize int64      // Bytes of whole entries in the log
+	changes []logEntry // Since Load, for Save to append
+
+	Version int `json:"version"`
+	// Overrides maps row ID (see RowKey) -> Column -> Value
 	Overrides map[string]map[string]string `json:"rows"`
-	// Note: JSON keys are strings, so we use string for LineNumber key.
+
+	// Deleted holds the IDs of deleted rows, which scans skip
+	Deleted map[string]bool `json:"deleted,omitempty"`
 }
 
-// Load creates a manager and loads existing updates if present.
+// RowKey returns the ID of the row starting at offset, as sidecar keys
+// hold it.
+func RowKey(offset int64) string {
+	return strconv.FormatInt(offset, 10)
+}
+
+// Load creates a manager and loads existing updates if present. Writers
+// take the CSV's writer lock first (see Lock).
 func Load(csvPath string) (*UpdateManager, error) {
 	absPath, err := filepath.Abs(csvPath)
 	if err != nil {
@@ -29,9 +56,15 @@ func Load(csvPath string) (*UpdateManager, error) {
 	um := &UpdateManager{
 		csvPath:    absPath,
 		schemaPath: schemaPath,
+		logPath:    LogPath(absPath),
 		Overrides:  make(map[string]map[string]string),
 	}
 
+	if ok, err := um.loadLog(); ok || err != nil {
+		um.Version = FormatVersion // Log entries always hold offsets
+		return um, err
+	}
+
 	if _, err := os.Stat(schemaPath); err == nil {
 		data, err := os.ReadFile(schemaPath)
 		if err != nil {
@@ -44,20 +77,34 @@ func Load(csvPath string) (*UpdateManager, error) {
 		}
 	}
 
+	if um.Version < FormatVersion {
+		// In memory only: the next Save, by a writer holding the lock,
+		// writes the migrated sidecar
+		if err := um.migrate(); err != nil {
+			return nil, fmt.Errorf("failed to migrate updates file: %v", err)
+		}
+		um.Version = FormatVersion
+	}
 	return um, nil
 }
 
-// Save persists the updates to disk.
+// Save persists the updates to disk atomically: the sidecar is written to
+// a temporary file next to it and renamed over it, so readers see all of
+// a change or none of it, and a failed save leaves the old one. With the
+// update log, the changes since Load are appended to it instead.
 func (um *UpdateManager) Save() error {
-	um.mu.RLock()
-	defer um.mu.RUnlock()
+	um.mu.Lock()
+	defer um.mu.Unlock()
 
+	if um.useLog {
+		return um.saveLog()
+	}
 	data, err := json.MarshalIndent(um, "", "  ")
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(um.schemaPath, data, 0644)
+	um.changes = um.changes[:0]
+	return writeAtomic(um.schemaPath, data)
 }
 
 // Set updates a value for a specific row via offset.
@@ -65,11 +112,34 @@ func (um *UpdateManager) Set(offset int64, column, value string) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	key := fmt.Sprintf("%d", offset)
+	key := RowKey(offset)
 	if _, ok := um.Overrides[key]; !ok {
 		um.Overrides[key] = make(map[string]string)
 	}
 	um.Overrides[key][column] = value
+	um.changes = append(um.changes, logEntry{op: logSet, offset: offset, column: column, value: value})
+}
+
+// Delete marks the row at offset as deleted, dropping its overrides.
+func (um *UpdateManager) Delete(offset int64) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	key := RowKey(offset)
+	if um.Deleted == nil {
+		um.Deleted = make(map[string]bool)
+	}
+	um.Deleted[key] = true
+	delete(um.Overrides, key)
+	um.changes = append(um.changes, logEntry{op: logDelete, offset: offset})
+}
+
+// IsDeleted reports whether the row at offset was deleted.
+func (um *UpdateManager) IsDeleted(offset int64) bool {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	return um.Deleted[RowKey(offset)]
 }
 
 // GetRow returns all overrides for a specific row offset, or nil if none exist.
@@ -77,7 +147,7 @@ func (um *UpdateManager) GetRow(offset int64) map[string]string {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	key := fmt.Sprintf("%d", offset)
+	key := RowKey(offset)
 	if row, ok := um.Overrides[key]; ok {
 		// Return a copy to avoid race conditions if caller modifies it?
 		// For read-only query engine, direct map access is risky if updates happen concurrently?
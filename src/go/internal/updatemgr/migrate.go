@@ -0,0 +1,107 @@
+package updatemgr
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// migrate brings the keys of a sidecar older than FormatVersion to row IDs.
+// Updates always keyed rows by offset, but full scans looked them up by
+// line number, so a key may be either: one that is the start of a row (the
+// CSV byte before it is a newline) is kept, any other is taken as a line
+// number, the header being line 1, and replaced by the offset of that row.
+// Keys of lines past the end are kept as they are.
+func (um *UpdateManager) migrate() error {
+	if len(um.Overrides) == 0 && len(um.Deleted) == 0 {
+		return nil
+	}
+	f, err := os.Open(um.csvPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // Archived CSV: nothing to check the keys against
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	lines := make(map[int64]int64) // Line number -> offset, once found
+	var last int64
+	var b [1]byte
+	for _, key := range um.keys() {
+		n, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || n < 1 {
+			continue
+		}
+		if _, err := f.ReadAt(b[:], n-1); err == nil && b[0] == '\n' {
+			continue // A row start
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		lines[n] = -1
+		last = max(last, n)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	// Find the offsets of the lines, reading records up to the last one
+	r := bufio.NewReader(f)
+	var offset int64
+	for line := int64(1); line <= last; line++ {
+		record, err := common.ReadCSVRecord(r)
+		if len(record) == 0 {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+		if _, ok := lines[line]; ok {
+			lines[line] = offset
+		}
+		offset += int64(len(record))
+		if err != nil {
+			break
+		}
+	}
+
+	for line, offset := range lines {
+		if offset < 0 {
+			continue
+		}
+		from, to := RowKey(line), RowKey(offset)
+		if row, ok := um.Overrides[from]; ok {
+			delete(um.Overrides, from)
+			if um.Overrides[to] == nil {
+				um.Overrides[to] = make(map[string]string, len(row))
+			}
+			for col, val := range row {
+				if _, set := um.Overrides[to][col]; !set {
+					um.Overrides[to][col] = val // Values set by offset are the newer ones
+				}
+			}
+		}
+		if um.Deleted[from] {
+			delete(um.Deleted, from)
+			um.Deleted[to] = true
+		}
+	}
+	return nil
+}
+
+// keys returns the row IDs the sidecar holds updates of.
+func (um *UpdateManager) keys() []string {
+	keys := make([]string, 0, len(um.Overrides)+len(um.Deleted))
+	for key := range um.Overrides {
+		keys = append(keys, key)
+	}
+	for key := range um.Deleted {
+		keys = append(keys, key)
+	}
+	return keys
+}
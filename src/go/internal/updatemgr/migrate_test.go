@@ -0,0 +1,77 @@
+package updatemgr
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateOnRead(t *testing.T) {
+	// Line 3 is the row of id 2 (offset 14), line 4 that of id 3 (offset 20)
+	csvPath := filepath.Join(t.TempDir(), "t.csv")
+	if err := os.WriteFile(csvPath, []byte("id,name\n1,ann\n2,bob\n3,cy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := csvPath + "_updates.json"
+	old := []byte(`{"rows":{"3":{"name":"x"}},"deleted":{"4":true}}`)
+	if err := os.WriteFile(sidecar, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, um *UpdateManager) {
+		t.Helper()
+		if got := um.GetRow(14)["name"]; got != "x" {
+			t.Errorf("%s: row 14 name %q, want x", what, got)
+		}
+		if !um.IsDeleted(20) {
+			t.Errorf("%s: row 20 not deleted", what)
+		}
+		if um.GetRow(3) != nil || um.IsDeleted(4) {
+			t.Errorf("%s: line keys left: %v, deleted %v", what, um.Overrides, um.Deleted)
+		}
+	}
+
+	// Reads migrate in memory and leave the file alone
+	um, err := Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("read", um)
+	if data, err := os.ReadFile(sidecar); err != nil || string(data) != string(old) {
+		t.Errorf("read rewrote the sidecar: %s (%v)", data, err)
+	}
+
+	// A write saves it migrated
+	unlock, err := Lock(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	um, err = Load(csvPath)
+	if err == nil {
+		um.Set(8, "name", "y")
+		err = um.Save()
+	}
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved struct {
+		Version int                          `json:"version"`
+		Rows    map[string]map[string]string `json:"rows"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Version != FormatVersion || saved.Rows["14"]["name"] != "x" || saved.Rows["8"]["name"] != "y" {
+		t.Errorf("saved %s, want version %d with rows 8 and 14", data, FormatVersion)
+	}
+	um, err = Load(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after write", um)
+}
@@ -0,0 +1,380 @@
+// Package validate checks a CSV file against RFC 4180 before it is indexed:
+// rows whose field count differs from the header, broken quoting, invalid
+// UTF-8 and header problems, each reported with its line number. It can
+// also write a cleaned copy of the file.
+package validate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/entreya/csvquery/internal/common"
+)
+
+// Problem kinds
+const (
+	KindRagged = "ragged" // Field count differs from the header
+	KindQuote  = "quote"  // Bare, stray or unclosed quote
+	KindUTF8   = "utf8"   // Invalid UTF-8
+	KindHeader = "header" // Empty or duplicate column name
+)
+
+// Options configure a validation run.
+type Options struct {
+	Separator byte   // 0 = detect
+	MaxIssues int    // Issues kept in the report (0 = all); all are counted
+	CleanPath string // Write a cleaned copy here ("" = none)
+}
+
+// Issue is a problem found in one record.
+type Issue struct {
+	Line    int64  `json:"line"`   // Physical line (1-based) the record starts on
+	Offset  int64  `json:"offset"` // Byte offset of the record
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// Report is the outcome of a validation run.
+type Report struct {
+	Separator   string           `json:"separator"`
+	Columns     int              `json:"columns"` // Fields of the header
+	Records     int64            `json:"records"` // Data records, without the header
+	Lines       int64            `json:"lines"`   // Physical lines
+	Issues      []Issue          `json:"issues"`
+	Counts      map[string]int64 `json:"counts"`      // Problems by kind
+	FieldCounts map[int]int64    `json:"fieldCounts"` // Records by field count
+	Cleaned     string           `json:"cleaned,omitempty"`
+	Dropped     int64            `json:"dropped,omitempty"` // Records left out of the cleaned copy
+}
+
+// OK tells whether no problem was found.
+func (r *Report) OK() bool {
+	return len(r.Counts) == 0
+}
+
+// Total is the number of problems found.
+func (r *Report) Total() int64 {
+	var n int64
+	for _, c := range r.Counts {
+		n += c
+	}
+	return n
+}
+
+func (r *Report) add(opts Options, issue Issue) {
+	r.Counts[issue.Kind]++
+	if opts.MaxIssues <= 0 || len(r.Issues) < opts.MaxIssues {
+		r.Issues = append(r.Issues, issue)
+	}
+}
+
+// maxQuotedLines bounds the lines a quoted field may span. A quote left
+// open longer is reported, and checking resumes on the line after it.
+const maxQuotedLines = 1000
+
+// File validates the CSV at path.
+func File(path string, opts Options) (*Report, error) {
+	if opts.Separator == 0 {
+		dialect, err := common.SniffFile(path)
+		if err != nil {
+			return nil, err
+		}
+		opts.Separator = dialect.Separator
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	data, err := common.MmapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = common.MunmapFile(data) }()
+
+	var clean *cleaner
+	if opts.CleanPath != "" {
+		if same, _ := samePath(path, opts.CleanPath); same {
+			return nil, fmt.Errorf("the cleaned copy cannot replace %s", path)
+		}
+		if clean, err = newCleaner(opts.CleanPath, opts.Separator); err != nil {
+			return nil, err
+		}
+		defer clean.abort()
+	}
+
+	report, err := check(data, opts, clean)
+	if err != nil {
+		return nil, err
+	}
+	if clean != nil {
+		if err := clean.commit(); err != nil {
+			return nil, err
+		}
+		report.Cleaned = opts.CleanPath
+		report.Dropped = clean.dropped
+	}
+	return report, nil
+}
+
+// check validates the CSV in data. opts.Separator must be set; clean (nil =
+// none) receives the records of the cleaned copy.
+func check(data []byte, opts Options, clean *cleaner) (*Report, error) {
+	report := &Report{
+		Separator:   common.SeparatorName(opts.Separator),
+		Counts:      make(map[string]int64),
+		FieldCounts: make(map[int]int64),
+	}
+	pos := 0
+	if bytes.HasPrefix(data, []byte("\uFEFF")) {
+		pos = len("\uFEFF")
+	}
+	var fields [][]byte
+	seen := make(map[string]bool)
+	header := true
+
+	for pos < len(data) {
+		line := report.Lines + 1
+		if rest := data[pos:]; rest[0] == '\n' || bytes.HasPrefix(rest, []byte("\r\n")) {
+			pos += bytes.IndexByte(rest, '\n') + 1
+			report.Lines++
+			continue // Empty lines are skipped, as when indexing
+		}
+		var end int
+		var problem string
+		fields, end, problem = parseRecord(data, pos, opts.Separator, fields[:0])
+		rec := data[pos:end]
+		report.Lines += int64(bytes.Count(rec, []byte{'\n'}))
+		if rec[len(rec)-1] != '\n' {
+			report.Lines++
+		}
+
+		issue := func(kind, format string, args ...any) {
+			report.add(opts, Issue{Line: line, Offset: int64(pos), Kind: kind, Message: fmt.Sprintf(format, args...)})
+		}
+		valid := problem == ""
+		if !valid {
+			issue(KindQuote, "%s", problem)
+		}
+		if bad := invalidUTF8(rec); bad >= 0 {
+			issue(KindUTF8, "invalid UTF-8 at byte %d of the record (line %d)", bad, line+int64(bytes.Count(rec[:bad], []byte{'\n'})))
+		}
+		pos = end
+
+		if header {
+			header = false
+			report.Columns = len(fields)
+			for i, f := range fields {
+				name := strings.TrimSpace(string(f))
+				switch {
+				case name == "":
+					issue(KindHeader, "column %d has no name", i+1)
+				case seen[name]:
+					issue(KindHeader, "duplicate column name %q (column %d)", name, i+1)
+				}
+				seen[name] = true
+			}
+			if clean != nil {
+				if err := clean.write(fields); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		report.Records++
+		report.FieldCounts[len(fields)]++
+		if valid && len(fields) != report.Columns {
+			issue(KindRagged, "%d fields, the header has %d", len(fields), report.Columns)
+			valid = false
+		}
+		if clean != nil {
+			if !valid {
+				clean.dropped++
+			} else if err := clean.write(fields); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// parseRecord parses the record starting at data[start] as RFC 4180 has
+// it, appending its unescaped fields to fields. Only a quote that opens a
+// field starts a quoted field, which may span lines. It returns the end of
+// the record (past its terminator) and the first violation found, if any.
+// A quote that is never closed (or not within maxQuotedLines) ends the
+// record at the end of the line it opened on.
+func parseRecord(data []byte, start int, sep byte, fields [][]byte) ([][]byte, int, string) {
+	var problem string
+	fail := func(format string, args ...any) {
+		if problem == "" {
+			problem = fmt.Sprintf(format, args...)
+		}
+	}
+	for i := start; ; {
+		n := len(fields) + 1
+		if i < len(data) && data[i] == '"' {
+			var field []byte
+			j, closed, lines := i+1, false, 0
+			for j < len(data) && lines <= maxQuotedLines {
+				c := data[j]
+				if c == '"' {
+					if j+1 < len(data) && data[j+1] == '"' {
+						field = append(field, '"')
+						j += 2
+						continue
+					}
+					j++
+					closed = true
+					break
+				}
+				if c == '\n' {
+					lines++
+				}
+				field = append(field, c)
+				j++
+			}
+			if !closed {
+				if lines > maxQuotedLines {
+					fail("quote opening field %d is not closed within %d lines", n, maxQuotedLines)
+				} else {
+					fail("quote opening field %d is never closed", n)
+				}
+				end := len(data)
+				if nl := bytes.IndexByte(data[start:], '\n'); nl >= 0 {
+					end = start + nl + 1
+				}
+				return append(fields, field), end, problem
+			}
+			if j < len(data) && data[j] == '\r' && (j+1 == len(data) || data[j+1] == '\n') {
+				j++
+			} else if j < len(data) && data[j] != sep && data[j] != '\n' {
+				fail("text after the closing quote of field %d", n)
+				for j < len(data) && data[j] != sep && data[j] != '\n' {
+					field = append(field, data[j])
+					j++
+				}
+			}
+			fields = append(fields, field)
+			i = j
+		} else {
+			j := i
+			for j < len(data) && data[j] != sep && data[j] != '\n' {
+				if data[j] == '"' {
+					fail("bare quote in unquoted field %d", n)
+				}
+				j++
+			}
+			field := data[i:j]
+			if j == len(data) || data[j] == '\n' {
+				field = bytes.TrimSuffix(field, []byte{'\r'})
+			}
+			fields = append(fields, field)
+			i = j
+		}
+		switch {
+		case i >= len(data):
+			return fields, len(data), problem
+		case data[i] == '\n':
+			return fields, i + 1, problem
+		}
+		i++ // Separator
+	}
+}
+
+// invalidUTF8 returns the position of the first invalid UTF-8 byte of b, or
+// -1 if it is valid.
+func invalidUTF8(b []byte) int {
+	if utf8.Valid(b) {
+		return -1
+	}
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+// cleaner writes the cleaned copy: the header and every record without
+// quoting or field count problems, re-quoted as RFC 4180 requires, with
+// invalid UTF-8 replaced by U+FFFD. It is written to a temp file that
+// commit renames into place.
+type cleaner struct {
+	path    string
+	f       *os.File
+	buf     *bufio.Writer
+	w       *csv.Writer
+	record  []string
+	dropped int64
+}
+
+func newCleaner(path string, sep byte) (*cleaner, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriterSize(f, 1<<20)
+	w := csv.NewWriter(buf)
+	w.Comma = rune(sep)
+	return &cleaner{path: path, f: f, buf: buf, w: w}, nil
+}
+
+func (c *cleaner) write(fields [][]byte) error {
+	c.record = c.record[:0]
+	for _, f := range fields {
+		c.record = append(c.record, strings.ToValidUTF8(string(f), "\uFFFD"))
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *cleaner) commit() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return err
+	}
+	if err := c.buf.Flush(); err != nil {
+		return err
+	}
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(c.f.Name(), c.path); err != nil {
+		return err
+	}
+	c.f = nil
+	return nil
+}
+
+// abort removes the temp file unless commit succeeded.
+func (c *cleaner) abort() {
+	if c.f != nil {
+		_ = c.f.Close()
+		_ = os.Remove(c.f.Name())
+	}
+}
+
+func samePath(a, b string) (bool, error) {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(ia, ib), nil
+}
@@ -0,0 +1,64 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	data := "\uFEFFid,name,note\r\n" +
+		"1,alice,ok\r\n" +
+		"2,bob\r\n" + // Ragged
+		"3,\"car\"ol,x\n" + // Text after the closing quote
+		"4,da\"ve,y\n" + // Bare quote, which must not swallow the next record
+		"5,\"multi\nline, \"\"quoted\"\"\",z\n" +
+		"\n" +
+		"6,\xffrin,w\n" + // Invalid UTF-8, kept (replaced) in the cleaned copy
+		"7,\"open,never\n" + // Unclosed quote, resynced at the next line
+		"8,h,i"
+	report, err := check([]byte(data), Options{Separator: ','}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Columns != 3 || report.Records != 8 || report.Lines != 11 {
+		t.Errorf("Columns %d, records %d, lines %d", report.Columns, report.Records, report.Lines)
+	}
+	want := []struct {
+		line int64
+		kind string
+	}{{3, KindRagged}, {4, KindQuote}, {5, KindQuote}, {9, KindUTF8}, {10, KindQuote}}
+	if len(report.Issues) != len(want) {
+		t.Fatalf("Issues: %v", report.Issues)
+	}
+	for i, w := range want {
+		if got := report.Issues[i]; got.Line != w.line || got.Kind != w.kind {
+			t.Errorf("Issue %d: %v (%s), want line %d (%s)", i, got, got.Kind, w.line, w.kind)
+		}
+	}
+
+	// The cleaned copy keeps the good records, re-quoted
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in.csv"), filepath.Join(dir, "out.csv")
+	if err := os.WriteFile(in, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = File(in, Options{CleanPath: out, MaxIssues: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Total() != 5 || report.Dropped != 4 {
+		t.Errorf("Listed %d of %d issues, dropped %d", len(report.Issues), report.Total(), report.Dropped)
+	}
+	cleaned, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantClean := "id,name,note\n1,alice,ok\n5,\"multi\nline, \"\"quoted\"\"\",z\n6,\uFFFDrin,w\n8,h,i\n"
+	if string(cleaned) != wantClean {
+		t.Errorf("Cleaned copy:\n%s\nwant:\n%s", cleaned, wantClean)
+	}
+	if report, err := File(out, Options{}); err != nil || !report.OK() {
+		t.Errorf("Cleaned copy has problems: %v %v", report, err)
+	}
+}
@@ -0,0 +1,353 @@
+// Package watch keeps the indexes of a CSV file fresh while it changes.
+//
+// Appends are indexed incrementally (only the new rows are sorted, then
+// merged into the existing .cidx files); anything else - truncation, an
+// in-place edit, a file replaced via rename - triggers a full rebuild.
+package watch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/storage"
+)
+
+// Config holds watch mode settings. Index settings mirror `csvquery index`.
+type Config struct {
+	CsvPath     string
+	OutputDir   string
+	Columns     string // JSON array of columns to index
+	Separator   string
+	Workers     int
+	MemoryMB    int
+	BloomFPRate float64
+	ZoneColumn  string        // Column for per-block min/max (see indexer.IndexerConfig)
+	Codec       string        // Block compression (see indexer.IndexerConfig)
+	Partitions  int           // Part files per index (see indexer.IndexerConfig)
+	Debounce    time.Duration // Quiet period after the last change before reindexing
+	Verbose     bool          // Show full indexer output
+	Status      io.Writer     // Status lines (defaults to stdout)
+	Version     string
+}
+
+// Status summarizes what the watcher has done so far.
+type Status struct {
+	Appends    int       `json:"appends"`
+	Rebuilds   int       `json:"rebuilds"`
+	Errors     int       `json:"errors"`
+	LastAction string    `json:"lastAction"`
+	LastRun    time.Time `json:"lastRun"`
+	LastError  string    `json:"lastError,omitempty"`
+	TotalRows  int64     `json:"totalRows"`
+}
+
+type action int
+
+const (
+	actionNone action = iota
+	actionAppend
+	actionRebuild
+)
+
+// Watcher monitors a CSV and reindexes it on change.
+type Watcher struct {
+	cfg     Config
+	csvPath string // Absolute, cleaned
+	indexes []string
+	fsw     *fsnotify.Watcher
+	done    chan struct{}
+	once    sync.Once
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New validates the configuration and starts watching the CSV's directory.
+// The directory (not the file) is watched so that rewrites which replace
+// the file are seen too.
+func New(cfg Config) (*Watcher, error) {
+	if cfg.CsvPath == "" {
+		return nil, fmt.Errorf("csv path required")
+	}
+	if cfg.OutputDir == "" {
+		cfg.OutputDir = filepath.Dir(cfg.CsvPath)
+	}
+	if storage.IsRemote(cfg.OutputDir) {
+		return nil, fmt.Errorf("watch requires a local index directory (appends are merged in place), not %s", cfg.OutputDir)
+	}
+	if cfg.Debounce <= 0 {
+		cfg.Debounce = 2 * time.Second
+	}
+	if cfg.Status == nil {
+		cfg.Status = os.Stdout
+	}
+
+	colDefs, err := indexer.ParseColumns(cfg.Columns)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]string, len(colDefs))
+	for i, cols := range colDefs {
+		indexes[i] = indexer.IndexName(cols)
+	}
+
+	csvPath, err := filepath.Abs(cfg.CsvPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start file watcher: %w", err)
+	}
+	if err := fsw.Add(filepath.Dir(csvPath)); err != nil {
+		_ = fsw.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", filepath.Dir(csvPath), err)
+	}
+
+	return &Watcher{
+		cfg:     cfg,
+		csvPath: csvPath,
+		indexes: indexes,
+		fsw:     fsw,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Run brings the indexes up to date, then reindexes after every burst of
+// changes until Close is called.
+func (w *Watcher) Run() error {
+	w.logf("watching %s (%d indexes, debounce %v)", w.csvPath, len(w.indexes), w.cfg.Debounce)
+	w.sync()
+
+	timer := time.NewTimer(w.cfg.Debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			timer.Stop()
+			return nil
+
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(ev.Name) != w.csvPath || ev.Op == fsnotify.Chmod {
+				continue
+			}
+			// Debounce: restart the quiet period on every change
+			timer.Reset(w.cfg.Debounce)
+
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return nil
+			}
+			w.logf("watch error: %v", err)
+
+		case <-timer.C:
+			w.sync()
+		}
+	}
+}
+
+// Close stops the watcher. Safe to call more than once.
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.fsw.Close()
+	})
+	return err
+}
+
+// Status returns a snapshot of the watcher's activity.
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// sync compares the CSV with the index metadata and appends or rebuilds.
+func (w *Watcher) sync() {
+	act, from, reason := w.plan()
+	if act == actionNone {
+		if reason != "" {
+			w.logf("%s", reason)
+		}
+		return
+	}
+
+	start := time.Now()
+	before := w.loadMeta()
+
+	cfg := indexer.IndexerConfig{
+		InputFile:   w.csvPath,
+		OutputDir:   w.cfg.OutputDir,
+		Columns:     w.cfg.Columns,
+		Separator:   w.cfg.Separator,
+		Workers:     w.cfg.Workers,
+		MemoryMB:    w.cfg.MemoryMB,
+		BloomFPRate: w.cfg.BloomFPRate,
+		ZoneColumn:  w.cfg.ZoneColumn,
+		Codec:       w.cfg.Codec,
+		Partitions:  w.cfg.Partitions,
+		Verbose:     w.cfg.Verbose,
+		Version:     w.cfg.Version,
+		Output:      io.Discard,
+	}
+	if w.cfg.Verbose {
+		cfg.Output = w.cfg.Status
+	}
+	name := "rebuild"
+	if act == actionAppend {
+		cfg.AppendFrom = from
+		name = "append"
+	}
+
+	idx := indexer.NewIndexer(cfg)
+	err := idx.Run()
+	idx.Cleanup()
+
+	after := w.loadMeta()
+
+	w.mu.Lock()
+	w.status.LastRun = time.Now()
+	w.status.LastAction = name
+	if err != nil {
+		w.status.Errors++
+		w.status.LastError = err.Error()
+	} else {
+		if act == actionAppend {
+			w.status.Appends++
+		} else {
+			w.status.Rebuilds++
+		}
+		w.status.LastError = ""
+		if after != nil {
+			w.status.TotalRows = after.TotalRows
+		}
+	}
+	w.mu.Unlock()
+
+	if err != nil {
+		w.logf("%s failed (%s): %v", name, reason, err)
+		return
+	}
+
+	var rows int64
+	if after != nil {
+		rows = after.TotalRows
+		if act == actionAppend && before != nil {
+			rows -= before.TotalRows
+		}
+	}
+	if act == actionAppend {
+		w.logf("append: +%d rows from byte %d in %v", rows, from, time.Since(start).Round(time.Millisecond))
+	} else {
+		w.logf("rebuild (%s): %d rows in %v", reason, rows, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// plan decides what the indexes need. from is the append start offset;
+// reason explains a rebuild (or why nothing can be done yet).
+func (w *Watcher) plan() (act action, from int64, reason string) {
+	info, err := os.Stat(w.csvPath)
+	if err != nil {
+		return actionNone, 0, fmt.Sprintf("waiting for %s: %v", filepath.Base(w.csvPath), err)
+	}
+
+	meta := w.loadMeta()
+	if meta == nil {
+		return actionRebuild, 0, "no index metadata"
+	}
+	for _, name := range w.indexes {
+		if _, ok := meta.Indexes[name]; !ok {
+			return actionRebuild, 0, "index " + name + " missing"
+		}
+		if _, err := os.Stat(w.indexPath(meta, name)); err != nil {
+			return actionRebuild, 0, "index " + name + " missing"
+		}
+	}
+
+	size := info.Size()
+	switch {
+	case size < meta.CsvSize:
+		return actionRebuild, 0, "file shrank"
+	case size == meta.CsvSize && info.ModTime().Unix() == meta.CsvMtime:
+		return actionNone, 0, ""
+	}
+
+	// Same size or grown: the indexed prefix must be unchanged
+	hash, err := indexer.CsvFingerprint(w.csvPath, meta.CsvSize)
+	if err != nil || hash != meta.CsvHash {
+		return actionRebuild, 0, "file rewritten"
+	}
+	if size == meta.CsvSize {
+		return actionNone, 0, ""
+	}
+	if !w.endsWithNewline(meta.CsvSize) {
+		// Last indexed row was extended in place
+		return actionRebuild, 0, "last row modified"
+	}
+	return actionAppend, meta.CsvSize, ""
+}
+
+// endsWithNewline reports whether the byte before offset is '\n', i.e.
+// the indexed prefix ended on a complete row.
+func (w *Watcher) endsWithNewline(offset int64) bool {
+	if offset == 0 {
+		return false
+	}
+	f, err := os.Open(w.csvPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset-1); err != nil {
+		return false
+	}
+	return b[0] == '\n'
+}
+
+func (w *Watcher) csvName() string {
+	return strings.TrimSuffix(filepath.Base(w.csvPath), filepath.Ext(w.csvPath))
+}
+
+// indexPath returns the .cidx file of an index listed in meta, or its
+// unsuffixed name for metadata without a manifest.
+func (w *Watcher) indexPath(meta *common.IndexMeta, name string) string {
+	file := meta.Indexes[name].File
+	if file == "" {
+		file = common.IndexFileName(w.csvName(), name, 0)
+	}
+	return filepath.Join(w.cfg.OutputDir, file)
+}
+
+func (w *Watcher) loadMeta() *common.IndexMeta {
+	data, err := os.ReadFile(filepath.Join(w.cfg.OutputDir, w.csvName()+"_meta.json"))
+	if err != nil {
+		return nil
+	}
+	var meta common.IndexMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+func (w *Watcher) logf(format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(w.cfg.Status, "[%s] %s\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,231 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ImportJSON appends the JSON objects of r (see ReadJSONRows) to the CSV
+// and returns how many rows it wrote (or would, with DryRun). Without
+// columns, the keys of a new file's objects make its header, and an
+// existing file's header orders the values; a key it lacks is an error.
+func (w *CsvWriter) ImportJSON(r io.Reader, columns []string) (int, error) {
+	existing := []string(nil)
+	if len(columns) == 0 {
+		var err error
+		if existing, err = w.Headers(); err != nil {
+			return 0, err
+		}
+	}
+	header, rows, err := ReadJSONRows(r, columns)
+	if err != nil {
+		return 0, fmt.Errorf("invalid JSON input: %w", err)
+	}
+	if existing != nil {
+		position := make(map[string]int, len(existing))
+		for i, col := range existing {
+			position[col] = i
+		}
+		for i, row := range rows {
+			ordered := make([]string, len(existing))
+			for j, col := range header {
+				k, ok := position[col]
+				if !ok {
+					return 0, fmt.Errorf("key %q is not a column of %s (columns: %v)", col, w.config.CsvPath, existing)
+				}
+				ordered[k] = row[j]
+			}
+			rows[i] = ordered
+		}
+		header = existing
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return len(rows), w.Write(header, rows)
+}
+
+// ReadJSONRows converts JSON objects into CSV rows: a JSON array of
+// objects, or NDJSON (one object per line; any whitespace between objects
+// will do). Each row holds the values of columns, in order; without
+// columns, they are the union of the objects' keys in order of first
+// appearance, and are returned as the header. Strings are taken as is,
+// numbers and booleans as written, null and missing keys as empty fields,
+// and nested objects and arrays as their compact JSON text.
+func ReadJSONRows(r io.Reader, columns []string) ([]string, [][]string, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	array, err := startsArray(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	known := len(columns) > 0
+	header := slices.Clone(columns)
+	position := make(map[string]int, len(header))
+	for i, col := range header {
+		position[col] = i
+	}
+	var objects []map[string]string
+	for n := 1; ; n++ {
+		if array && !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, nil, fmt.Errorf("record %d: %w", n, err)
+			}
+			break
+		}
+		keys, obj, err := decodeObject(dec)
+		if err == io.EOF && !array {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("record %d: %w", n, err)
+		}
+		if !known {
+			for _, key := range keys {
+				if _, ok := position[key]; !ok {
+					position[key] = len(header)
+					header = append(header, key)
+				}
+			}
+		}
+		objects = append(objects, obj)
+	}
+
+	rows := make([][]string, len(objects))
+	for i, obj := range objects {
+		row := make([]string, len(header))
+		for j, col := range header {
+			row[j] = obj[col]
+		}
+		rows[i] = row
+	}
+	return header, rows, nil
+}
+
+// startsArray reports whether the first non-blank byte of br opens an
+// array, leaving it unread.
+func startsArray(br *bufio.Reader) (bool, error) {
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c == '[', br.UnreadByte()
+	}
+}
+
+// decodeObject reads the next JSON object of dec: its keys in order, and
+// its values as CSV fields (see ReadJSONRows). It returns io.EOF when
+// there is none.
+func decodeObject(dec *json.Decoder) ([]string, map[string]string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, nil, fmt.Errorf("expected an object, found %v", tok)
+	}
+	var keys []string
+	obj := make(map[string]string)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string) // Object keys are always strings
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		if _, dup := obj[key]; !dup {
+			keys = append(keys, key)
+		}
+		if obj[key], err = fieldValue(raw); err != nil {
+			return nil, nil, fmt.Errorf("key %q: %w", key, err)
+		}
+	}
+	if _, err := dec.Token(); err != nil { // Closing brace
+		return nil, nil, err
+	}
+	return keys, obj, nil
+}
+
+// fieldValue returns the CSV field of a JSON value.
+func fieldValue(raw json.RawMessage) (string, error) {
+	switch raw[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case 'n':
+		return "", nil
+	case '{', '[':
+		var buf bytes.Buffer
+		err := json.Compact(&buf, raw)
+		return buf.String(), err
+	}
+	return string(raw), nil
+}
+
+// JSONRowReader reads rows from a JSON array of arrays of strings, one row
+// at a time, so the array never has to be held in memory.
+type JSONRowReader struct {
+	dec     *json.Decoder
+	started bool
+	done    bool
+}
+
+// NewJSONRowReader returns a reader of the JSON array of rows in r.
+func NewJSONRowReader(r io.Reader) *JSONRowReader {
+	return &JSONRowReader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next row, or io.EOF after the closing bracket.
+func (j *JSONRowReader) Read() ([]string, error) {
+	if j.done {
+		return nil, io.EOF
+	}
+	if !j.started {
+		tok, err := j.dec.Token()
+		if err == io.EOF {
+			j.done = true // No input: no rows
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected an array of rows, found %v", tok)
+		}
+		j.started = true
+	}
+	if !j.dec.More() {
+		if _, err := j.dec.Token(); err != nil {
+			return nil, err
+		}
+		j.done = true
+		return nil, io.EOF
+	}
+	var row []string
+	if err := j.dec.Decode(&row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
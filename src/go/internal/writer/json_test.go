@@ -0,0 +1,39 @@
+package writer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJSONRows(t *testing.T) {
+	ndjson := `{"id":1,"name":"a","tags":["x", "y"]}
+{"id":2.50,"ok":true,"name":null}
+`
+	header, rows, err := ReadJSONRows(strings.NewReader(ndjson), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id", "name", "tags", "ok"}; !reflect.DeepEqual(header, want) {
+		t.Errorf("Header %v, want the union of keys %v", header, want)
+	}
+	want := [][]string{{"1", "a", `["x","y"]`, ""}, {"2.50", "", "", "true"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Rows %q, want %q", rows, want)
+	}
+
+	// An array of objects, with explicit columns
+	header, rows, err = ReadJSONRows(strings.NewReader(` [{"b":"x","a":"y"},{"c":1}]`), []string{"a", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(header, []string{"a", "c"}) || !reflect.DeepEqual(rows, [][]string{{"y", ""}, {"", "1"}}) {
+		t.Errorf("Read %v %q from an array", header, rows)
+	}
+
+	for _, bad := range []string{`[1]`, `{"a":1}{"b":`, `[{"a":1}`, `"x"`} {
+		if _, _, err := ReadJSONRows(strings.NewReader(bad), nil); err == nil {
+			t.Errorf("Read %q", bad)
+		}
+	}
+}
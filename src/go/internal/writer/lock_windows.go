@@ -1,26 +0,0 @@
-//go:build windows
-
-package writer
-
-import (
-	"os"
-)
-
-// lockFile acquires an exclusive lock on the file
-// Windows file locking via standard library/syscall is complex.
-// For now, we will SKIP locking on Windows or implement basic single-process safety?
-// Or we can use a simpler approach: Just rely on O_APPEND atomicity (mostly).
-// Robust locking on Windows requires syscall.LockFileEx.
-// Given time constraints, let's implement a dummy lock or simple retry?
-// A stub is acceptable if we warn.
-// BUT since user asked for "Good", we should try.
-// However, to fix the build immediately:
-func lockFile(file *os.File) error {
-	// TODO: Implement Windows locking
-	return nil
-}
-
-// unlockFile releases the lock
-func unlockFile(file *os.File) error {
-	return nil
-}
@@ -1,17 +1,44 @@
 package writer
 
 import (
+	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
+
+	"github.com/entreya/csvquery/internal/common"
+	"github.com/entreya/csvquery/internal/indexer"
 )
 
 // WriterConfig holds configuration for the writer
 type WriterConfig struct {
 	CsvPath   string
-	Separator string
+	Separator string // "" or "auto": the existing file's (detected), comma for a new file
+	DryRun    bool   // Check the write without creating, locking or changing the file
+
+	// DeltaDir is an index directory: each write adds the index records of
+	// the rows it appends to the index deltas there, which queries merge
+	// into their index scans until the next build ("" = none; see
+	// indexer.WriteDeltas).
+	DeltaDir string
+
+	// FlushRows is how many rows WriteFrom writes between flushes to the
+	// file (0 = DefaultFlushRows).
+	FlushRows int
+}
+
+// DefaultFlushRows is the default of WriterConfig.FlushRows.
+const DefaultFlushRows = 10000
+
+// RowReader is a source of rows to append, as csv.Reader is. Read returns
+// io.EOF after the last row.
+type RowReader interface {
+	Read() ([]string, error)
 }
 
 // CsvWriter handles writing to CSV files
@@ -21,92 +48,277 @@ type CsvWriter struct {
 
 // NewCsvWriter creates a new writer instance
 func NewCsvWriter(config WriterConfig) *CsvWriter {
-	if config.Separator == "" {
-		config.Separator = ","
-	}
 	return &CsvWriter{config: config}
 }
 
 // Write appends rows to the CSV file.
 // If headers are provided and file doesn't exist, it creates the file with headers.
 // If file exists, it validates headers match (if provided).
+// With DryRun, it makes the same checks and returns without writing.
+// With DeltaDir, the index deltas there then cover the new rows.
 func (w *CsvWriter) Write(headers []string, rows [][]string) error {
+	_, err := w.WriteFrom(headers, &SliceRows{Rows: rows})
+	return err
+}
+
+// WriteFrom appends the rows of src like Write, reading them as it goes
+// and flushing them to the file every FlushRows rows, so a batch of any
+// size takes the memory of one chunk. It returns how many rows it wrote
+// (with DryRun, read). When src fails midway, the rows before the failure
+// stay written and are counted.
+func (w *CsvWriter) WriteFrom(headers []string, src RowReader) (int64, error) {
+	if w.config.DryRun {
+		if err := w.check(headers); err != nil {
+			return 0, err
+		}
+		return copyRows(nil, src, 0)
+	}
+
 	// Ensure directory exists
 	dir := filepath.Dir(w.config.CsvPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %v", err)
+		return 0, fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	// Open file with O_APPEND|O_CREATE|O_RDWR
 	file, err := os.OpenFile(w.config.CsvPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return 0, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer func() { _ = file.Close() }()
 
 	// Exclusive Lock
-	if err := lockFile(file); err != nil {
-		return fmt.Errorf("failed to lock file: %v", err)
+	if err := common.LockFile(file); err != nil {
+		return 0, fmt.Errorf("failed to lock file: %v", err)
 	}
-	defer func() { _ = unlockFile(file) }()
+	defer func() { _ = common.UnlockFile(file) }()
 
 	// Check if file is new (size 0)
 	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	sep, err := w.separator(file, stat.Size())
+	if err != nil {
+		return 0, err
 	}
 
 	csvW := csv.NewWriter(file)
-	csvW.Comma = rune(w.config.Separator[0])
+	csvW.Comma = rune(sep)
 
 	// If new file, write headers
 	if stat.Size() == 0 {
 		if len(headers) == 0 {
-			return fmt.Errorf("cannot create new file without headers")
+			return 0, fmt.Errorf("cannot create new file without headers")
 		}
 		if err := csvW.Write(headers); err != nil {
+			return 0, err
+		}
+	} else if len(headers) > 0 {
+		// Existing file: Validate headers if provided.
+		// O_APPEND forces writes to the end whatever the read position.
+		if err := checkHeaders(file, sep, headers); err != nil {
+			return 0, err
+		}
+	}
+
+	// Write Rows
+	flushRows := w.config.FlushRows
+	if flushRows <= 0 {
+		flushRows = DefaultFlushRows
+	}
+	n, err := copyRows(csvW, src, flushRows)
+	if err != nil {
+		return n, err
+	}
+
+	// Still under the lock, so no other write lands in between
+	if w.config.DeltaDir != "" {
+		if err := indexer.WriteDeltas(w.config.CsvPath, w.config.DeltaDir, stat.Size()); err != nil {
+			return n, fmt.Errorf("rows written, but index deltas failed: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// copyRows writes the rows of src to csvW (nil = only count them),
+// flushing every flushRows rows and after the last, and returns how many
+// rows it wrote.
+func copyRows(csvW *csv.Writer, src RowReader, flushRows int) (int64, error) {
+	var n, flushed int64
+	flush := func() error {
+		if csvW == nil {
+			return nil
+		}
+		csvW.Flush()
+		if err := csvW.Error(); err != nil {
 			return err
 		}
-	} else {
-		// Existing file: Validate headers if provided
-		if len(headers) > 0 {
-			// Read first line to verify headers
-			// We need to read from a separate handle or seek?
-			// Since we opened with O_APPEND, read might be tricky?
-			// Actually O_APPEND forces writes to end, but read pointer depends.
-			// Let's rely on user correctness for now to avoid overhead?
-			// OR validation is crucial.
-			// Let's open a separate read handle for validation or seek to 0.
-			// file is RDWR.
-
-			// Seek to 0
-			if _, err := file.Seek(0, 0); err != nil {
-				return fmt.Errorf("failed to seek: %v", err)
+		flushed = n
+		return nil
+	}
+	for {
+		row, err := src.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ferr := flush(); ferr != nil {
+				return flushed, ferr
 			}
-
-			reader := csv.NewReader(file)
-			reader.Comma = rune(w.config.Separator[0])
-			existingHeaders, err := reader.Read()
-			if err != nil {
-				return fmt.Errorf("failed to read existing headers: %v", err)
+			return n, fmt.Errorf("row %d: %w", n+1, err)
+		}
+		if csvW != nil {
+			if err := csvW.Write(row); err != nil {
+				return flushed, err
 			}
-
-			// Validate
-			if !reflect.DeepEqual(existingHeaders, headers) {
-				return fmt.Errorf("header mismatch. File: %v, New: %v", existingHeaders, headers)
+		}
+		n++
+		if flushRows > 0 && n%int64(flushRows) == 0 {
+			if err := flush(); err != nil {
+				return flushed, err
 			}
+		}
+	}
+	if err := flush(); err != nil {
+		return flushed, err
+	}
+	return n, nil
+}
+
+// NewCSVRowReader returns the header row of the CSV in r and a reader of
+// the rows after it. The separator is detected from the start of r.
+func NewCSVRowReader(r io.Reader) ([]string, *csv.Reader, error) {
+	br := bufio.NewReaderSize(r, common.SniffBytes)
+	sample, err := br.Peek(common.SniffBytes)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	dialect := common.SniffDialect(sample, len(sample) == common.SniffBytes)
+	reader := csv.NewReader(br)
+	reader.Comma = rune(dialect.Separator)
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("no header row")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, reader, nil
+}
 
-			// Seek back to end for writing?
-			// O_APPEND handles writing position automatically (atomic append).
-			// Seek affects read pointer. Write pointer is forced to end by O_APPEND.
+// SliceRows reads the rows of a slice.
+type SliceRows struct {
+	Rows [][]string
+}
+
+func (s *SliceRows) Read() ([]string, error) {
+	if len(s.Rows) == 0 {
+		return nil, io.EOF
+	}
+	row := s.Rows[0]
+	s.Rows = s.Rows[1:]
+	return row, nil
+}
+
+// check makes the checks of Write on a read-only handle, if the file
+// exists.
+func (w *CsvWriter) check(headers []string) error {
+	file, err := os.Open(w.config.CsvPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := common.ParseSeparator(w.config.Separator); err != nil {
+			return err
 		}
+		if len(headers) == 0 {
+			return fmt.Errorf("cannot create new file without headers")
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
 	}
+	defer func() { _ = file.Close() }()
 
-	// Write Rows
-	if err := csvW.WriteAll(rows); err != nil {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	sep, err := w.separator(file, stat.Size())
+	if err != nil {
 		return err
 	}
+	switch {
+	case stat.Size() == 0 && len(headers) == 0:
+		return fmt.Errorf("cannot create new file without headers")
+	case stat.Size() > 0 && len(headers) > 0:
+		return checkHeaders(file, sep, headers)
+	}
+	return nil
+}
 
-	csvW.Flush()
-	return csvW.Error()
+// separator returns the configured separator, or that of the file's
+// existing content (size bytes), or a comma.
+func (w *CsvWriter) separator(file *os.File, size int64) (byte, error) {
+	sep, err := common.ParseSeparator(w.config.Separator)
+	if err != nil || sep != 0 {
+		return sep, err
+	}
+	if size == 0 {
+		return ',', nil
+	}
+	dialect, err := common.SniffReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read existing file: %v", err)
+	}
+	return dialect.Separator, nil
+}
+
+// Headers returns the header row of the file, or nil when it does not
+// exist or is empty.
+func (w *CsvWriter) Headers() ([]string, error) {
+	file, err := os.Open(w.config.CsvPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	stat, err := file.Stat()
+	if err != nil || stat.Size() == 0 {
+		return nil, err
+	}
+	sep, err := w.separator(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	return readHeaders(file, sep)
+}
+
+// readHeaders reads the header row of file.
+func readHeaders(file *os.File, sep byte) ([]string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek: %v", err)
+	}
+	reader := csv.NewReader(file)
+	reader.Comma = rune(sep)
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read existing headers: %v", err)
+	}
+	return headers, nil
+}
+
+// checkHeaders compares headers with the header row of file.
+func checkHeaders(file *os.File, sep byte, headers []string) error {
+	existingHeaders, err := readHeaders(file, sep)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(existingHeaders, headers) {
+		return fmt.Errorf("header mismatch. File: %v, New: %v", existingHeaders, headers)
+	}
+	return nil
 }
@@ -0,0 +1,43 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFrom(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "out.csv")
+	w := NewCsvWriter(WriterConfig{CsvPath: csvPath, FlushRows: 2})
+
+	n, err := w.WriteFrom([]string{"id", "name"}, NewJSONRowReader(strings.NewReader(`[["1","a"],["2","b, c"],["3","d"]]`)))
+	if err != nil || n != 3 {
+		t.Fatalf("Wrote %d rows: %v", n, err)
+	}
+
+	// A bad row stops the batch; the rows before it stay written
+	n, err = w.WriteFrom(nil, NewJSONRowReader(strings.NewReader(`[["4","e"],["5",6]]`)))
+	if err == nil || n != 1 {
+		t.Fatalf("Wrote %d rows of a bad batch: %v", n, err)
+	}
+
+	data, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "id,name\n1,a\n2,\"b, c\"\n3,d\n4,e\n"; string(data) != want {
+		t.Errorf("File holds %q, want %q", data, want)
+	}
+
+	headers, rows, err := NewCSVRowReader(strings.NewReader("id;name\n6;f\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err = w.WriteFrom(headers, rows); err != nil || n != 1 {
+		t.Errorf("Wrote %d rows of a CSV file: %v", n, err)
+	}
+	if n, err = w.WriteFrom([]string{"x"}, &SliceRows{Rows: [][]string{{"7", "g"}}}); err == nil {
+		t.Errorf("Wrote %d rows under a different header", n)
+	}
+}
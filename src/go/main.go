@@ -2,18 +2,37 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/entreya/csvquery/internal/alter"
+	"github.com/entreya/csvquery/internal/common"
 	"github.com/entreya/csvquery/internal/indexer"
+	"github.com/entreya/csvquery/internal/manifest"
+	"github.com/entreya/csvquery/internal/memlimit"
 	"github.com/entreya/csvquery/internal/query"
+	"github.com/entreya/csvquery/internal/schema"
 	"github.com/entreya/csvquery/internal/server"
+	"github.com/entreya/csvquery/internal/shell"
+	"github.com/entreya/csvquery/internal/status"
+	"github.com/entreya/csvquery/internal/storage"
+	"github.com/entreya/csvquery/internal/update"
+	"github.com/entreya/csvquery/internal/validate"
+	"github.com/entreya/csvquery/internal/watch"
 	"github.com/entreya/csvquery/internal/writer"
 )
 
@@ -43,12 +62,38 @@ func main() {
 	switch command {
 	case "index":
 		runIndex(os.Args[2:])
+	case "indexes":
+		runIndexes(os.Args[2:])
 	case "query":
 		runQuery(os.Args[2:])
 	case "daemon":
 		runDaemon(os.Args[2:])
 	case "write":
 		runWrite(os.Args[2:])
+	case "import":
+		runImport(os.Args[2:])
+	case "update":
+		runUpdate(os.Args[2:])
+	case "alter":
+		runAlter(os.Args[2:])
+	case "replay":
+		runReplay(os.Args[2:])
+	case "health":
+		runHealth(os.Args[2:])
+	case "watch":
+		runWatch(os.Args[2:])
+	case "keyset":
+		runKeySet(os.Args[2:])
+	case "export":
+		runExport(os.Args[2:])
+	case "analyze":
+		runAnalyze(os.Args[2:])
+	case "apply":
+		runApply(os.Args[2:])
+	case "validate":
+		runValidate(os.Args[2:])
+	case "shell":
+		runShell(os.Args[2:])
 	case "version":
 		fmt.Printf("CsvQuery v%s (%s)\n", Version, BuildDate)
 	case "help":
@@ -63,6 +108,7 @@ func main() {
 func setupSignalHandler() {
 	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 	go handleShutdown()
+	status.HandleSignals()
 }
 
 // handleShutdown handles graceful shutdown on signals
@@ -79,6 +125,39 @@ func handleShutdown() {
 	os.Exit(130) // Standard exit code for SIGINT
 }
 
+// sorterMemoryFraction is the share of a container memory limit the
+// indexer's sort buffers may use by default.
+const sorterMemoryFraction = 0.5
+
+// blockCacheMemoryFraction is the share of a container memory limit the
+// daemon's block cache may use by default.
+const blockCacheMemoryFraction = 0.25
+
+// applyMemoryLimit sets the Go soft memory limit from the container's
+// cgroup limit and, unless --memory was given explicitly, shrinks the
+// sorter budget to fit under it. memoryMB may be nil (daemon). It returns
+// the limit (none: Bytes is 0).
+func applyMemoryLimit(fs *flag.FlagSet, memoryMB *int) memlimit.Limit {
+	limit := memlimit.Detect()
+	soft := memlimit.ApplyGoMemLimit(limit, memlimit.GoMemLimitFraction)
+	if limit.Bytes == 0 {
+		return limit
+	}
+
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "memory" {
+			explicit = true
+		}
+	})
+	if memoryMB != nil && !explicit {
+		*memoryMB = memlimit.BudgetMB(limit, sorterMemoryFraction, *memoryMB)
+	}
+
+	fmt.Printf("Memory limit: %d MB (%s), GOMEMLIMIT %d MB\n", limit.Bytes>>20, limit.Source, soft>>20)
+	return limit
+}
+
 func getDir(path string) string {
 	return filepath.Dir(path)
 }
@@ -91,9 +170,22 @@ Usage:
 
 Commands:
     index    Create indexes from CSV
+    indexes  List, drop or rebuild the indexes of CSVs
     query    Query CSV (using indexes if available)
     daemon   Start Unix Domain Socket server
     write    Append data to CSV
+    import   Append JSON or NDJSON objects to CSV as rows
+    update   Set columns of the rows matching a filter
+    alter    Add, drop or rename columns, or change a virtual column's default
+    replay   Replay captured daemon traffic and diff responses
+    health   Check that a daemon answers and its indexes are fresh
+    watch    Keep indexes fresh while a CSV changes
+    keyset   Export an indexed column's keys for semi-joins elsewhere
+    export   Write the matching rows to a new CSV (or gzip)
+    analyze  Infer column types and statistics into the CSV's schema
+    apply    Build and drop whatever a dataset manifest declares
+    validate Check a CSV for RFC 4180 problems before indexing it
+    shell    Interactive SQL-ish prompt over a CSV
     version  Show version
     help     Show this help
 
@@ -102,16 +194,31 @@ Use "csvquery <command> --help" for command-specific options.`)
 
 // runIndex handles the index command
 func runIndex(args []string) {
+	if len(args) > 0 && args[0] == "stats" {
+		runIndexStats(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "tier" {
+		runIndexTier(args[1:])
+		return
+	}
+
 	fs := flag.NewFlagSet("index", flag.ExitOnError)
 
-	input := fs.String("input", "", "Input CSV file path")
+	input := fs.String("input", "", "Input CSV file path (or a Parquet or Arrow file)")
 	output := fs.String("output", "", "Output directory for indexes")
 	columns := fs.String("columns", "[]", "JSON array of columns to index")
-	separator := fs.String("separator", ",", "CSV separator")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
 	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers")
 	memoryMB := fs.Int("memory", 500, "Memory limit in MB per worker")
 	bloomFP := fs.Float64("bloom", 0.01, "Bloom filter false positive rate")
 	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	zoneColumn := fs.String("zone-column", "", "Record per-block numeric min/max of this column in every index")
+	codec := fs.String("codec", common.CodecLZ4, "Block compression: lz4, zstd (smaller) or none (fastest reads)")
+	partitions := fs.Int("partitions", 0, "Split each index into this many part files; lookups read only the part holding their key")
+	rowStore := fs.Bool("csvz", false, "Also write a compressed copy of the rows (.csvz) that queries use when the CSV is gone")
+	resume := fs.Bool("resume", false, "Continue an interrupted build from its checkpoint")
+	checkpointMB := fs.Int64("checkpoint-mb", 1024, "MB of CSV scanned between resume checkpoints")
 
 	_ = fs.Parse(args)
 
@@ -125,6 +232,8 @@ func runIndex(args []string) {
 		*output = getDir(*input)
 	}
 
+	applyMemoryLimit(fs, memoryMB)
+
 	// Create indexer and run
 	idx := indexer.NewIndexer(indexer.IndexerConfig{
 		InputFile:   *input,
@@ -136,6 +245,13 @@ func runIndex(args []string) {
 		BloomFPRate: *bloomFP,
 		Verbose:     *verbose,
 		Version:     Version,
+		ZoneColumn:  *zoneColumn,
+		Codec:       *codec,
+		RowStore:    *rowStore,
+		Partitions:  *partitions,
+		Resume:      *resume,
+
+		CheckpointBytes: *checkpointMB << 20,
 	})
 
 	// Register cleanup
@@ -149,6 +265,429 @@ func runIndex(args []string) {
 	}
 }
 
+// runIndexTier handles "index tier": moves the blocks of a cold key range
+// of an index to slower storage
+func runIndexTier(args []string) {
+	fs := flag.NewFlagSet("index tier", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	name := fs.String("index", "", "Index to tier (e.g. created_at or status_category)")
+	cold := fs.String("cold", "", "Directory or s3://bucket/prefix for the cold blocks")
+	hotFrom := fs.String("hot-from", "", "Keep blocks with keys from this one up on fast storage (empty = move all blocks back)")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || *name == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv and --index are required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	store, err := storage.Open(*indexDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	file, err := indexer.ResolveIndexFile(store, *csvPath, *name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	stats, err := indexer.TierIndex(store, file, *cold, *hotFrom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: %d hot blocks (%.1f MB), %d cold blocks (%.1f MB)\n",
+		file, stats.HotBlocks, float64(stats.HotBytes)/1024/1024, stats.ColdBlocks, float64(stats.ColdBytes)/1024/1024)
+	if stats.ColdFile != "" {
+		fmt.Printf("Cold blocks: %s\n", stats.ColdFile)
+	}
+}
+
+// runIndexStats handles "index stats": per-index hit counts recorded by the
+// daemon and the key statistics recorded by the build
+func runIndexStats(args []string) {
+	fs := flag.NewFlagSet("index stats", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	asJSON := fs.Bool("json", false, "Output JSON")
+	name := fs.String("index", "", "Show the key statistics and histogram of this index")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	store, err := storage.Open(*indexDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	usage := map[string]query.IndexUsage{} // Not tracked for remote storage
+	if !storage.IsRemote(*indexDir) {
+		usage, err = query.LoadUsage(query.UsagePath(*csvPath, *indexDir))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to read usage: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	files, err := indexer.IndexFiles(store, *csvPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to list indexes: %v\n", err)
+		os.Exit(1)
+	}
+	var meta common.IndexMeta
+	csvName := strings.TrimSuffix(filepath.Base(*csvPath), filepath.Ext(*csvPath))
+	if data, err := storage.ReadFile(store, csvName+"_meta.json"); err == nil {
+		_ = json.Unmarshal(data, &meta)
+	}
+
+	if *name != "" {
+		printKeyStats(strings.ToLower(*name), meta, *asJSON)
+		return
+	}
+
+	type indexStat struct {
+		Name     string     `json:"name"`
+		Size     int64      `json:"size"`
+		Hits     int64      `json:"hits"`
+		LastUsed *time.Time `json:"lastUsed"`
+
+		Records   int64   `json:"records,omitempty"`
+		Distinct  int64   `json:"distinct,omitempty"`
+		Nulls     *int64  `json:"nulls,omitempty"`
+		MinKey    string  `json:"minKey,omitempty"`
+		MaxKey    string  `json:"maxKey,omitempty"`
+		AvgKeyLen float64 `json:"avgKeyLen,omitempty"`
+	}
+	stats := make([]indexStat, 0, len(files))
+	for name, file := range files {
+		st := indexStat{Name: name}
+		if ks, ok := meta.Indexes[name]; ok && ks.Histogram != nil {
+			st.Records, st.Distinct, st.Nulls = ks.Records, ks.DistinctCount, ks.NullCount
+			st.MinKey, st.MaxKey = common.DecodeKey(ks.MinKey), common.DecodeKey(ks.MaxKey)
+			st.AvgKeyLen = ks.AvgKeyLen
+		}
+		info, err := store.Stat(file)
+		if err != nil {
+			continue // Listed in metadata, but removed since
+		}
+		st.Size = info.Size
+		if bloom, err := store.Stat(file + ".bloom"); err == nil {
+			st.Size += bloom.Size
+		}
+		if u, ok := usage[name]; ok {
+			st.Hits = u.Hits
+			lastUsed := u.LastUsed
+			st.LastUsed = &lastUsed
+		}
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Hits != stats[j].Hits {
+			return stats[i].Hits > stats[j].Hits
+		}
+		return stats[i].Name < stats[j].Name
+	})
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(stats)
+		return
+	}
+
+	if len(stats) == 0 {
+		fmt.Printf("No indexes found for %s in %s\n", filepath.Base(*csvPath), *indexDir)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "INDEX\tSIZE\tHITS\tLAST USED\tROWS\tDISTINCT\tNULLS\tMIN\tMAX")
+	var unused int
+	var unusedBytes int64
+	for _, st := range stats {
+		last := "never"
+		if st.LastUsed != nil {
+			last = st.LastUsed.Local().Format("2006-01-02 15:04:05")
+		} else {
+			unused++
+			unusedBytes += st.Size
+		}
+		keys := "-\t-\t-\t-\t-" // Built before key statistics
+		if st.Nulls != nil {
+			keys = fmt.Sprintf("%d\t%d\t%d\t%s\t%s", st.Records, st.Distinct, *st.Nulls, shortKey(st.MinKey), shortKey(st.MaxKey))
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%.1f MB\t%d\t%s\t%s\n", st.Name, float64(st.Size)/1024/1024, st.Hits, last, keys)
+	}
+	_ = tw.Flush()
+
+	if unused > 0 {
+		fmt.Printf("\n%d index(es) never used by the daemon (%.1f MB)\n", unused, float64(unusedBytes)/1024/1024)
+	}
+}
+
+// printKeyStats prints the key statistics of one index, with its histogram.
+func printKeyStats(name string, meta common.IndexMeta, asJSON bool) {
+	stats, ok := meta.Indexes[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: no index %s in the metadata\n", name)
+		os.Exit(1)
+	}
+	if stats.Histogram == nil {
+		fmt.Fprintf(os.Stderr, "Error: index %s was built before key statistics; rebuild it to record them\n", name)
+		os.Exit(1)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(stats)
+		return
+	}
+
+	fmt.Printf("Index:      %s (%s)\n", name, stats.File)
+	fmt.Printf("Records:    %d\n", stats.Records)
+	fmt.Printf("Distinct:   %d\n", stats.DistinctCount)
+	fmt.Printf("Nulls:      %d\n", *stats.NullCount)
+	fmt.Printf("Min key:    %s\n", common.DecodeKey(stats.MinKey))
+	fmt.Printf("Max key:    %s\n", common.DecodeKey(stats.MaxKey))
+	fmt.Printf("Avg length: %.1f bytes\n", stats.AvgKeyLen)
+	if len(stats.Histogram.Bounds) == 0 {
+		return
+	}
+
+	fmt.Printf("\nHistogram (%d rows per bucket):\n", stats.Histogram.Depth)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "BUCKET\tROWS\tUP TO")
+	rest := stats.Records - *stats.NullCount
+	for i, bound := range stats.Histogram.Bounds {
+		_, _ = fmt.Fprintf(tw, "%d\t%d\t%s\n", i+1, stats.Histogram.Depth, common.DecodeKey(bound))
+		rest -= stats.Histogram.Depth
+	}
+	if rest > 0 {
+		_, _ = fmt.Fprintf(tw, "%d\t%d\t%s\n", len(stats.Histogram.Bounds)+1, rest, common.DecodeKey(stats.MaxKey))
+	}
+	_ = tw.Flush()
+}
+
+// shortKey cuts a key for a table cell.
+func shortKey(key string) string {
+	if len(key) <= 24 {
+		return key
+	}
+	return key[:21] + "..."
+}
+
+// runIndexes handles the indexes command: list, drop and rebuild the
+// indexes of CSVs
+func runIndexes(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: csvquery indexes <list|drop|rebuild> --csv FILE [options]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "list":
+		runIndexesList(args[1:])
+	case "drop":
+		runIndexesDrop(args[1:])
+	case "rebuild":
+		runIndexesRebuild(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown indexes command: %s (want list, drop or rebuild)\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// runIndexesList handles "indexes list": the indexes of each CSV given
+// with their sizes, distinct counts and staleness
+func runIndexesList(args []string) {
+	fs := flag.NewFlagSet("indexes list", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file (more may follow the flags)")
+	indexDir := fs.String("index-dir", "", "Directory containing index files (default: each CSV's directory)")
+	asJSON := fs.Bool("json", false, "Output JSON")
+
+	_ = fs.Parse(args)
+
+	csvPaths := fs.Args()
+	if *csvPath != "" {
+		csvPaths = append([]string{*csvPath}, csvPaths...)
+	}
+	if len(csvPaths) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	type csvIndexes struct {
+		CSV     string              `json:"csv"`
+		Indexes []indexer.IndexInfo `json:"indexes"`
+	}
+	var all []csvIndexes
+	failed := false
+	for _, path := range csvPaths {
+		dir := *indexDir
+		if dir == "" {
+			dir = getDir(path)
+		}
+		store, err := storage.Open(dir)
+		if err == nil {
+			var infos []indexer.IndexInfo
+			if infos, err = indexer.ListIndexes(store, path); err == nil {
+				all = append(all, csvIndexes{CSV: path, Indexes: infos})
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+		failed = true
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(all)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "CSV\tINDEX\tCOLUMNS\tSIZE\tDISTINCT\tSTATUS")
+		for _, c := range all {
+			for _, info := range c.Indexes {
+				columns := strings.Join(info.Columns, ",")
+				if info.Collation != "" {
+					columns += " (" + info.Collation + ")"
+				}
+				status := "fresh"
+				if info.DeltaRows > 0 {
+					status = fmt.Sprintf("fresh (+%d delta rows)", info.DeltaRows)
+				}
+				if info.Stale != "" {
+					status = "stale: " + info.Stale
+				}
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f MB\t%d\t%s\n",
+					filepath.Base(c.CSV), info.Name, columns, float64(info.Size)/1024/1024, info.Distinct, status)
+			}
+		}
+		_ = tw.Flush()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runIndexesDrop handles "indexes drop": removes indexes with their bloom
+// filters and metadata entries
+func runIndexesDrop(args []string) {
+	fs := flag.NewFlagSet("indexes drop", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	names := fs.String("index", "", "Comma-separated indexes to drop (e.g. status,status_category)")
+	rowStore := fs.Bool("csvz", false, "Also drop the row store (.csvz)")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || (*names == "" && !*rowStore) {
+		fmt.Fprintln(os.Stderr, "Error: --csv and --index are required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	store, err := storage.Open(*indexDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	infos, err := indexer.ListIndexes(store, *csvPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var drop []string
+	if *names != "" {
+		for _, name := range strings.Split(*names, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !slices.ContainsFunc(infos, func(info indexer.IndexInfo) bool { return info.Name == name }) {
+				fmt.Fprintf(os.Stderr, "Error: no index %s for %s\n", name, filepath.Base(*csvPath))
+				os.Exit(1)
+			}
+			drop = append(drop, name)
+		}
+	}
+	if err := indexer.DropIndexes(store, *csvPath, drop, *rowStore); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, name := range drop {
+		fmt.Printf("Dropped index %s\n", name)
+	}
+	if *rowStore {
+		fmt.Println("Dropped row store")
+	}
+}
+
+// runIndexesRebuild handles "indexes rebuild": builds some indexes of a
+// CSV again from their metadata, leaving the others as they are
+func runIndexesRebuild(args []string) {
+	fs := flag.NewFlagSet("indexes rebuild", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	names := fs.String("index", "", "Comma-separated indexes to rebuild")
+	all := fs.Bool("all", false, "Rebuild every index of the CSV")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers")
+	memoryMB := fs.Int("memory", 500, "Memory limit in MB per worker")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || (*names == "") == !*all {
+		fmt.Fprintln(os.Stderr, "Error: --csv and one of --index or --all are required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	var cfg indexer.IndexerConfig
+	var err error
+	if *all {
+		cfg, _, err = indexer.CurrentConfig(*csvPath, *indexDir)
+	} else {
+		cfg, err = indexer.RebuildConfig(*csvPath, *indexDir, strings.Split(strings.ReplaceAll(*names, " ", ""), ","))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	applyMemoryLimit(fs, memoryMB)
+	cfg.Workers, cfg.MemoryMB, cfg.Verbose, cfg.Version = *workers, *memoryMB, *verbose, Version
+	idx := indexer.NewIndexer(cfg)
+	err = idx.Run()
+	idx.Cleanup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // runQuery handles the query command
 func runQuery(args []string) {
 	fs := flag.NewFlagSet("query", flag.ExitOnError)
@@ -158,51 +697,137 @@ func runQuery(args []string) {
 	whereJSON := fs.String("where", "{}", "JSON object of conditions")
 	limit := fs.Int("limit", 0, "Maximum results (0 = no limit)")
 	offset := fs.Int("offset", 0, "Skip first N results")
+	cursor := fs.String("cursor", "", "Continue after the last row of a previous --limit page (its \"Next cursor\")")
+	last := fs.Bool("last", false, "Return the last --limit rows (after skipping --offset from the end), reading the index backward")
+	orderBy := fs.String("order-by", "", "Index order of the rows: key or an indexed column, then asc or desc (\"id desc\" reads the id index backward)")
 	countOnly := fs.Bool("count", false, "Only output count")
 	explain := fs.Bool("explain", false, "Explain query plan")
 	groupBy := fs.String("group-by", "", "Column to group by")
 	aggCol := fs.String("agg-col", "", "Column to aggregate")
 	aggFunc := fs.String("agg-func", "", "Aggregation function")
+	aggSort := fs.String("agg-sort", "", "Order groups by key or value, then asc or desc (\"count desc\"): output a JSON array of {key, value}")
+	aggLimit := fs.Int("agg-limit", 0, "Keep the first N groups of --agg-sort (0 = all)")
+	pivot := fs.String("pivot", "", "Spread --group-by groups into one column per value of this column (JSON, or a table with --format csv)")
 	debugHeaders := fs.Bool("debug-headers", false, "Debug raw headers")
+	verbose := fs.Bool("verbose", false, "Print progress of long scans to stderr")
+	requireIndex := fs.Bool("require-index", false, "Fail instead of falling back to a full scan")
+	maxFullScan := fs.Int64("max-fullscan-bytes", 0, "Refuse fallback full scans of CSVs larger than N bytes (0 = no limit)")
+	notInFile := fs.String("where-not-in-file", "", "Output keys from this file (one per line) that are NOT in --column")
+	notInColumn := fs.String("column", "", "Column to match --where-not-in-file / --where-in-set keys against")
+	inSetFile := fs.String("where-in-set", "", "Only rows whose --column value is in this key set (from csvquery keyset)")
+	format := fs.String("format", "offsets", "Row output format: offsets, csv or raw")
+	raw := fs.Bool("raw", false, "Output matching lines byte-for-byte as stored (same as --format raw)")
+	output := fs.String("output", "", "Write results to file instead of stdout")
+	checkpoint := fs.String("checkpoint", "", "Write export progress markers to file")
+	resumeFrom := fs.String("resume-from", "", "Resume an interrupted export from a checkpoint file")
+	checkpointEvery := fs.Int64("checkpoint-every", query.DefaultCheckpointEvery, "Rows between export progress markers")
+	timeoutMs := fs.Int("timeout", 0, "Abort the query after N milliseconds (0 = no limit)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Full scan threads, or files queried in parallel when --csv is a glob")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: as indexed, or detected)")
+	sample := fs.Float64("sample", 0, "Return each matching row with probability P, e.g. 0.01 (0 = all)")
+	sampleRows := fs.Int("sample-rows", 0, "Return N matching rows picked at random (0 = all)")
+	seed := fs.Int64("seed", 0, "Seed of --sample/--sample-rows, to draw the same sample again (0 = random)")
+	memoryMB := fs.Int("memory", query.DefaultGroupMemoryMB, "Memory in MB for --group-by groups before they spill to disk")
+	tempDir := fs.String("temp-dir", "", "Directory for --group-by spill files (default: system temp dir)")
+	blockCacheMB := fs.Int("block-cache-mb", 0, "Memory in MB for index blocks a query reads more than once (0 = off)")
 
 	_ = fs.Parse(args)
 
+	if *raw {
+		if *format != "offsets" && *format != "raw" {
+			fmt.Fprintf(os.Stderr, "Error: --raw conflicts with --format %s\n", *format)
+			os.Exit(1)
+		}
+		*format = "raw"
+	}
+
+	// A glob selects several CSVs, each with its own indexes (see query.RunMulti)
+	multi := query.IsMultiFile(*csvPath)
+
 	// Default index-dir to CSV directory
-	if *indexDir == "" && *csvPath != "" {
+	if *indexDir == "" && *csvPath != "" && !multi {
 		*indexDir = filepath.Dir(*csvPath)
 	}
 
-	if *indexDir == "" {
+	if *indexDir == "" && !multi {
 		fmt.Fprintln(os.Stderr, "Error: --index-dir or --csv is required")
 		fs.PrintDefaults()
 		os.Exit(1)
 	}
 
+	sep, err := common.ParseSeparator(*separator)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Parse WHERE conditions
 	cond, err := query.ParseCondition([]byte(*whereJSON))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing --where JSON: %v\nRaw JSON: %s\n", err, *whereJSON)
-		os.Exit(1)
+		os.Exit(query.ExitCode(err))
 	}
 
 	// Create and run query engine
-	engine := query.NewQueryEngine(query.QueryConfig{
+	config := query.QueryConfig{
 		CsvPath:      *csvPath,
 		IndexDir:     *indexDir,
 		Where:        cond,
 		Limit:        *limit,
 		Offset:       *offset,
+		Cursor:       *cursor,
+		Last:         *last,
+		OrderBy:      *orderBy,
 		CountOnly:    *countOnly,
 		Explain:      *explain,
 		GroupBy:      *groupBy,
 		AggCol:       *aggCol,
 		AggFunc:      *aggFunc,
+		AggSort:      *aggSort,
+		AggLimit:     *aggLimit,
+		Pivot:        *pivot,
+		Separator:    sep,
 		DebugHeaders: *debugHeaders,
-	})
+		Verbose:      *verbose,
+
+		RequireIndex:     *requireIndex,
+		MaxFullScanBytes: *maxFullScan,
+
+		NotInFile:   *notInFile,
+		NotInColumn: *notInColumn,
 
-	if err := engine.Run(); err != nil {
+		Format:          *format,
+		OutputPath:      *output,
+		CheckpointPath:  *checkpoint,
+		ResumeFrom:      *resumeFrom,
+		CheckpointEvery: *checkpointEvery,
+
+		Timeout: time.Duration(*timeoutMs) * time.Millisecond,
+
+		InSetFile:   *inSetFile,
+		InSetColumn: *notInColumn,
+
+		SampleFraction: *sample,
+		SampleRows:     *sampleRows,
+		SampleSeed:     *seed,
+
+		GroupMemoryMB: *memoryMB,
+		TempDir:       *tempDir,
+		BlockCache:    common.NewBlockCache(int64(*blockCacheMB) << 20),
+	}
+
+	if multi {
+		err = query.RunMulti(*csvPath, []byte(*whereJSON), config, *workers, os.Stdout)
+	} else {
+		config.Workers = *workers
+		engine := query.NewQueryEngine(config)
+		if err = engine.Run(); err == nil && engine.NextCursor != "" {
+			fmt.Fprintf(os.Stderr, "Next cursor: %s\n", engine.NextCursor)
+		}
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		// os.Exit(1) // Don't exit on query error, just print (unless critical)
+		os.Exit(query.ExitCode(err)) // 124 on timeout: output so far is partial, as with timeout(1)
 	}
 }
 
@@ -210,14 +835,73 @@ func runQuery(args []string) {
 func runDaemon(args []string) {
 	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
 
-	socket := fs.String("socket", "/tmp/csvquery.sock", "Socket path (Unix)")
+	socket := fs.String("socket", "/tmp/csvquery.sock", "Socket path (Unix; @name = abstract socket, Linux only)")
+	socketMode := fs.String("socket-mode", "", "Octal mode of the socket file, e.g. 0660 (default: from the umask, or 0660 with --socket-owner/--socket-group)")
+	socketOwner := fs.String("socket-owner", "", "User (name or uid) to own the socket file")
+	socketGroup := fs.String("socket-group", "", "Group (name or gid) to own the socket file")
 	host := fs.String("host", "127.0.0.1", "Host (TCP)")
 	port := fs.Int("port", 0, "Port (TCP)")
 	csvPath := fs.String("csv", "", "Path to CSV")
 	indexDir := fs.String("index-dir", "", "Index directory")
 	workers := fs.Int("workers", 50, "Max concurrency")
+	lookupWorkers := fs.Int("lookup-workers", 0, "Index lookups running at once (0 = --workers)")
+	scanWorkers := fs.Int("scan-workers", server.DefaultScanWorkers, "Full scans running at once; more wait for a slot without holding up lookups")
+	capture := fs.String("capture", "", "Record requests to this file for replay")
+	captureRaw := fs.Bool("capture-raw", false, "Record the values of requests verbatim in --capture instead of hashes of them")
+	requireIndex := fs.Bool("require-index", false, "Reject queries that would need a full scan")
+	maxFullScan := fs.Int64("max-fullscan-bytes", 0, "Reject full scans of CSVs larger than N bytes (0 = no limit)")
+	maxQueryCost := fs.Int64("max-query-cost", 0, "Reject queries expected to read more than N bytes, naming the index that would serve them (0 = no limit)")
+	costBudget := fs.Int64("cost-budget", 0, "Queue queries while those running are expected to read N bytes together (0 = no limit)")
+	timeoutMs := fs.Int("timeout", 0, "Abort requests running longer than N milliseconds (0 = no limit)")
+	blockCacheMB := fs.Int("block-cache-mb", server.DefaultBlockCacheMB, "Memory in MB for decoded index blocks shared by requests (0 = off)")
+	drainSec := fs.Int("drain-timeout", 30, "On shutdown, cancel requests still running after N seconds (0 = wait for them)")
+	shards := fs.String("shards", "", "Coordinate these worker daemons (comma-separated unix:/path, tcp:host:port or tls:host:port)")
+	manifestPath := fs.String("manifest", "", "Serve --dataset with the settings of this manifest (see apply)")
+	dataset := fs.String("dataset", "", "Dataset of --manifest to serve")
+	authTokenFile := fs.String("auth-token-file", "", "Require TCP clients to authenticate with the token in this file (default: $"+server.AuthTokenEnv+")")
+	tlsCert := fs.String("tls-cert", "", "Serve TCP over TLS with this certificate (PEM)")
+	tlsKey := fs.String("tls-key", "", "Private key of --tls-cert (PEM)")
+	tlsCA := fs.String("tls-ca", "", "CA certificate to verify tls: shards against (default: system roots)")
+	logPath := fs.String("log", "", "Log every request as a JSON line to this file (- = stderr)")
+	slowMs := fs.Int("slow-query-ms", 0, "Log requests slower than N milliseconds with the request and its plan (0 = off)")
+	httpAddr := fs.String("http", "", "Also serve HTTP and WebSocket requests on this host:port")
+	allowedOrigins := fs.String("allowed-origins", "", "Accept WebSocket connections from pages of these origins (comma-separated scheme://host[:port], * = any; default: the daemon's own)")
+	spoolDir := fs.String("spool-dir", "", "Directory for the result files of spooled selects (default: system temp dir)")
+	updatesLog := fs.Bool("updates-log", false, "Keep the updates of update and delete actions in the binary update log instead of _updates.json")
+	printConfig := fs.Bool("print-config", false, "Print the effective settings with where each comes from, and exit")
 
+	// Flags given explicitly win over the environment, which wins over the
+	// manifest: the environment is read before the manifest, to find it,
+	// and again after, to override it
 	_ = fs.Parse(args)
+	explicit := setFlags(fs)
+	fromEnv, err := setFromEnv(fs, explicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *manifestPath != "" {
+		m, err := manifest.Load(*manifestPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		ds, ok := m.Datasets[*dataset]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: --dataset must be one of %s\n", strings.Join(m.Names(), ", "))
+			os.Exit(1)
+		}
+		// The manifest's settings first, so flags given explicitly win
+		_ = fs.Parse(append(ds.DaemonArgs(), args...))
+		if fromEnv, err = setFromEnv(fs, explicit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *printConfig {
+		printFlagConfig(fs, explicit, fromEnv)
+		return
+	}
 
 	network := "unix"
 	address := *socket
@@ -228,40 +912,1002 @@ func runDaemon(args []string) {
 		address = fmt.Sprintf("%s:%d", *host, *port)
 	}
 
-	if err := server.RunDaemon(network, address, *csvPath, *indexDir, *workers); err != nil {
-		fmt.Fprintf(os.Stderr, "Daemon Error: %v\n", err)
+	cfg := server.DaemonConfig{
+		Network:        network,
+		Address:        address,
+		CsvPath:        *csvPath,
+		IndexDir:       *indexDir,
+		MaxConcurrency: *workers,
+		LookupWorkers:  *lookupWorkers,
+		ScanWorkers:    *scanWorkers,
+		CapturePath:    *capture,
+		CaptureRaw:     *captureRaw,
+		Dataset:        *dataset,
+		LogPath:        *logPath,
+		SlowQuery:      time.Duration(*slowMs) * time.Millisecond,
+
+		RequireIndex:     *requireIndex,
+		MaxFullScanBytes: *maxFullScan,
+		MaxQueryCost:     *maxQueryCost,
+		CostBudget:       *costBudget,
+		QueryTimeout:     time.Duration(*timeoutMs) * time.Millisecond,
+		BlockCacheMB:     *blockCacheMB,
+		DrainTimeout:     time.Duration(*drainSec) * time.Second,
+		UpdatesLog:       *updatesLog,
+
+		TLSCert: *tlsCert,
+		TLSKey:  *tlsKey,
+		TLSCA:   *tlsCA,
+
+		HTTPAddr: *httpAddr,
+		SpoolDir: *spoolDir,
+
+		SocketOwner: *socketOwner,
+		SocketGroup: *socketGroup,
+	}
+	if *socketMode != "" {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			fmt.Fprintf(os.Stderr, "Error: invalid --socket-mode %q: want octal permissions such as 0660\n", *socketMode)
+			os.Exit(1)
+		}
+		cfg.SocketMode = os.FileMode(mode)
+	}
+	token, err := server.LoadAuthToken(*authTokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-}
-
-// runWrite handles the write command
-func runWrite(args []string) {
-	fs := flag.NewFlagSet("write", flag.ExitOnError)
+	cfg.AuthToken = token
+	if *shards != "" {
+		cfg.Shards = strings.Split(*shards, ",")
+	}
+	if *allowedOrigins != "" {
+		cfg.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
 
-	csvPath := fs.String("csv", "", "Path to CSV file")
-	headersJSON := fs.String("headers", "[]", "JSON array of headers (for new file)")
-	dataJSON := fs.String("data", "[]", "JSON array of rows (each row is array of strings)")
-	separator := fs.String("separator", ",", "CSV separator")
+	// The default block cache shrinks to fit a container, like the sorter
+	// budget of index
+	limit := applyMemoryLimit(fs, nil)
+	if !setFlags(fs)["block-cache-mb"] {
+		cfg.BlockCacheMB = memlimit.BudgetMB(limit, blockCacheMemoryFraction, cfg.BlockCacheMB)
+	}
 
-	_ = fs.Parse(args)
+	// Shut down through the global handler too, so in-flight requests
+	// finish and state is flushed before the process exits
+	daemon := server.NewUDSDaemon(cfg)
+	cleanupFuncs = append(cleanupFuncs, daemon.Shutdown)
 
-	if *csvPath == "" {
-		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+	if err := daemon.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Daemon Error: %v\n", err)
 		os.Exit(1)
 	}
+}
 
-	var headers []string
-	_ = json.Unmarshal([]byte(*headersJSON), &headers)
+// envPrefix starts the environment variables that set daemon flags:
+// --max-fullscan-bytes is CSVQUERY_MAX_FULLSCAN_BYTES.
+const envPrefix = "CSVQUERY_"
 
-	var data [][]string
-	_ = json.Unmarshal([]byte(*dataJSON), &data)
+// flagEnv returns the environment variable of a flag.
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
 
-	w := writer.NewCsvWriter(writer.WriterConfig{
-		CsvPath:   *csvPath,
-		Separator: *separator,
+// setFlags returns the flags of fs set so far.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// setFromEnv sets the flags of fs not in explicit from their environment
+// variables (see flagEnv), and returns those it set.
+func setFromEnv(fs *flag.FlagSet, explicit map[string]bool) (map[string]bool, error) {
+	fromEnv := map[string]bool{}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(flagEnv(f.Name))
+		if !ok || explicit[f.Name] || f.Name == "print-config" || err != nil {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("%s: %w", flagEnv(f.Name), err)
+			return
+		}
+		fromEnv[f.Name] = true
 	})
-	if err := w.Write(headers, data); err != nil {
-		fmt.Fprintf(os.Stderr, "Write Error: %v\n", err)
+	return fromEnv, err
+}
+
+// printFlagConfig prints the value of every flag of fs with its
+// environment variable and where the value came from: a flag, the
+// environment, the manifest or the default.
+func printFlagConfig(fs *flag.FlagSet, explicit, fromEnv map[string]bool) {
+	set := setFlags(fs)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "FLAG\tENV\tVALUE\tSOURCE")
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" {
+			return
+		}
+		source := "default"
+		switch {
+		case explicit[f.Name]:
+			source = "flag"
+		case fromEnv[f.Name]:
+			source = "env"
+		case set[f.Name]:
+			source = "manifest"
+		}
+		_, _ = fmt.Fprintf(tw, "--%s\t%s\t%s\t%s\n", f.Name, flagEnv(f.Name), f.Value, source)
+	})
+	_ = tw.Flush()
+}
+
+// runApply handles the apply command: makes every dataset of a manifest
+// match it
+func runApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+
+	dryRun := fs.Bool("dry-run", false, "Print the changes without making them")
+	dataset := fs.String("dataset", "", "Apply only this dataset")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers for builds")
+	memoryMB := fs.Int("memory", 500, "Memory limit in MB per worker for builds")
+	verbose := fs.Bool("verbose", false, "Show indexer output")
+
+	// The manifest may come before or after the flags
+	path := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+	}
+	_ = fs.Parse(args)
+	if path == "" && fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "Usage: csvquery apply manifest.yaml [flags]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	m, err := manifest.Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	names := m.Names()
+	if *dataset != "" {
+		if _, ok := m.Datasets[*dataset]; !ok {
+			fmt.Fprintf(os.Stderr, "Error: no dataset %q in %s\n", *dataset, path)
+			os.Exit(1)
+		}
+		names = []string{*dataset}
+	}
+	if !*dryRun {
+		applyMemoryLimit(fs, memoryMB)
+	}
+
+	var out io.Writer = io.Discard
+	if *verbose {
+		out = os.Stdout
+	}
+	failed := false
+	for _, name := range names {
+		plan, err := manifest.PlanDataset(name, m.Datasets[name])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		plan.Describe(os.Stdout)
+		if *dryRun || plan.Empty() {
+			continue
+		}
+		err = plan.Apply(manifest.Options{Workers: *workers, MemoryMB: *memoryMB, Version: Version, Output: out})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Println("  applied")
+	}
+	if *dryRun {
+		fmt.Println("\nDry run: nothing changed")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runReplay handles the replay command
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	capture := fs.String("capture", "", "Capture file written by daemon --capture")
+	socket := fs.String("socket", "/tmp/csvquery.sock", "Socket path (Unix)")
+	host := fs.String("host", "127.0.0.1", "Host (TCP)")
+	port := fs.Int("port", 0, "Port (TCP)")
+	authTokenFile := fs.String("auth-token-file", "", "Authenticate to a TCP daemon with the token in this file (default: $"+server.AuthTokenEnv+")")
+	useTLS := fs.Bool("tls", false, "Connect to the TCP daemon over TLS")
+	tlsCA := fs.String("tls-ca", "", "CA certificate to verify the daemon against with --tls (default: system roots)")
+	timeout := fs.Duration("timeout", 30*time.Second, "Per-request timeout")
+
+	_ = fs.Parse(args)
+
+	if *capture == "" {
+		fmt.Fprintln(os.Stderr, "Error: --capture is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	address := "unix:" + *socket
+	if *port > 0 {
+		scheme := "tcp"
+		if *useTLS {
+			scheme = "tls"
+		}
+		address = fmt.Sprintf("%s:%s:%d", scheme, *host, *port)
+	}
+	token, err := server.LoadAuthToken(*authTokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	tlsConfig, err := server.ClientTLS(*tlsCA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := server.Replay(server.ReplayConfig{
+		CapturePath: *capture,
+		Address:     address,
+		Token:       token,
+		TLS:         tlsConfig,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay Error: %v\n", err)
+		os.Exit(1)
+	}
+	if report.Mismatches > 0 || report.Errors > 0 {
+		os.Exit(2)
+	}
+}
+
+// runHealth handles the health command: a container health probe that
+// exits 0 when the daemon is ready, 1 when it cannot be reached and 2 when
+// it answers but is not ready
+func runHealth(args []string) {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+
+	socket := fs.String("socket", "/tmp/csvquery.sock", "Socket path (Unix)")
+	host := fs.String("host", "127.0.0.1", "Host (TCP)")
+	port := fs.Int("port", 0, "Port (TCP)")
+	authTokenFile := fs.String("auth-token-file", "", "Authenticate to a TCP daemon with the token in this file (default: $"+server.AuthTokenEnv+")")
+	timeout := fs.Duration("timeout", 5*time.Second, "Give up after this long")
+	asJSON := fs.Bool("json", false, "Output JSON")
+
+	// The daemon's environment variables, so a probe in its container
+	// finds it without flags
+	_ = fs.Parse(args)
+	if _, err := setFromEnv(fs, setFlags(fs)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	address := "unix:" + *socket
+	if *port > 0 {
+		address = fmt.Sprintf("tcp:%s:%d", *host, *port)
+	}
+	token, err := server.LoadAuthToken(*authTokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	report, err := server.CheckHealth(address, token, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unhealthy: %s: %v\n", address, err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else if report.Ready {
+		fmt.Printf("Ready: %s\n", address)
+	} else {
+		fmt.Printf("Not ready: %s\n", address)
+		for _, problem := range report.Problems {
+			fmt.Printf("  %s\n", problem)
+		}
+	}
+	if !report.Ready {
+		os.Exit(2)
+	}
+}
+
+// runKeySet exports the distinct keys of an indexed column as a key set
+func runKeySet(args []string) {
+	fs := flag.NewFlagSet("keyset", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	column := fs.String("column", "", "Indexed column to export")
+	format := fs.String("format", query.KeySetKeys, "Key set format: keys (exact) or bloom (compact, approximate)")
+	fpRate := fs.Float64("fp", 0.01, "False-positive rate for --format bloom")
+	output := fs.String("output", "", "Write the key set to file instead of stdout")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || *column == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv and --column are required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	engine := query.NewQueryEngine(query.QueryConfig{
+		CsvPath:  *csvPath,
+		IndexDir: *indexDir,
+	})
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+		engine.Writer = f
+	}
+
+	header, err := engine.ExportKeySet(*column, *format, *fpRate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(query.ExitCode(err))
+	}
+	if *output != "" {
+		fmt.Printf("Exported %d distinct %s keys (%s) to %s\n", header.Count, header.Column, header.Kind, *output)
+	}
+}
+
+// runShell handles the shell command: an interactive prompt answering
+// SQL-ish statements with the engine in-process.
+func runShell(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	historyPath := fs.String("history", defaultHistoryPath(), "File keeping the history between sessions (empty = none)")
+	limit := fs.Int("limit", 100, "Rows a SELECT without LIMIT shows (0 = all)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of threads for full scans")
+	blockCacheMB := fs.Int("block-cache-mb", 64, "Memory in MB for index blocks kept between statements (0 = off)")
+	requireIndex := fs.Bool("require-index", false, "Refuse statements no index can answer instead of scanning")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	// Ctrl-C cancels the running statement, not the process.
+	signal.Stop(shutdownChan)
+
+	sh, err := shell.New(shell.Config{
+		CsvPath:      *csvPath,
+		IndexDir:     *indexDir,
+		HistoryPath:  *historyPath,
+		Limit:        *limit,
+		Workers:      *workers,
+		BlockCacheMB: *blockCacheMB,
+		RequireIndex: *requireIndex,
+		In:           os.Stdin,
+		Out:          os.Stdout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	err = sh.Run()
+	sh.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// defaultHistoryPath is ~/.csvquery_history, or none without a home.
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".csvquery_history")
+}
+
+// runExport handles the export command: a csv row query of selected
+// columns, written to a new file.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files")
+	whereJSON := fs.String("where", "{}", "JSON object of conditions ({} = all rows)")
+	selectCols := fs.String("select", "*", "Comma-separated columns to export, virtual ones included (* = all)")
+	out := fs.String("out", "", "Write the CSV to file instead of stdout")
+	gz := fs.Bool("gzip", false, "Gzip the output (implied by an --out ending in .gz)")
+	limit := fs.Int("limit", 0, "Maximum rows (0 = no limit)")
+	offset := fs.Int("offset", 0, "Skip first N matching rows")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: as indexed, or detected)")
+	requireIndex := fs.Bool("require-index", false, "Fail instead of falling back to a full scan")
+	timeoutMs := fs.Int("timeout", 0, "Abort the export after N milliseconds (0 = no limit)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Full scan threads")
+	verbose := fs.Bool("verbose", false, "Print progress of long scans to stderr")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if query.IsMultiFile(*csvPath) {
+		fmt.Fprintln(os.Stderr, "Error: export reads a single CSV, not a glob")
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+	sep, err := common.ParseSeparator(*separator)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cond, err := query.ParseCondition([]byte(*whereJSON))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing --where JSON: %v\nRaw JSON: %s\n", err, *whereJSON)
+		os.Exit(query.ExitCode(err))
+	}
+	var columns []string
+	for _, c := range strings.Split(*selectCols, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			columns = append(columns, c)
+		}
+	}
+	if len(columns) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: --select names no columns")
+		os.Exit(1)
+	}
+
+	engine := query.NewQueryEngine(query.QueryConfig{
+		CsvPath:      *csvPath,
+		IndexDir:     *indexDir,
+		Where:        cond,
+		Limit:        *limit,
+		Offset:       *offset,
+		Separator:    sep,
+		Verbose:      *verbose,
+		RequireIndex: *requireIndex,
+		Format:       "csv",
+		Select:       columns,
+		Timeout:      time.Duration(*timeoutMs) * time.Millisecond,
+		Workers:      *workers,
+	})
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		w = f
+	}
+	var zw *gzip.Writer
+	if *gz || strings.HasSuffix(*out, ".gz") {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	engine.Writer = w
+
+	err = engine.Run()
+	if zw != nil {
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(*out) // No partial export left behind
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(query.ExitCode(err))
+	}
+}
+
+// runAnalyze handles the analyze command
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	sample := fs.Float64("sample", 0, "Fraction of the rows to sample, e.g. 0.01 (a count of 1 or more is read as --sample-rows)")
+	sampleRows := fs.Int("sample-rows", 100000, "Rows to sample (spread over the file)")
+	asJSON := fs.Bool("json", false, "Output JSON")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	sep, err := common.ParseSeparator(*separator)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	switch {
+	case *sample >= 1:
+		*sampleRows = int(*sample)
+	case *sample > 0:
+		rows, err := schema.EstimateRows(*csvPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		*sampleRows = max(1, int(float64(rows)**sample))
+	}
+
+	columns, analysis, err := schema.Infer(*csvPath, rune(sep), *sampleRows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	s, err := schema.Load(*csvPath)
+	if err == nil {
+		s.SetColumns(columns, analysis)
+		err = s.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to save schema: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(s)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "COLUMN\tTYPE\tNULLS\tDISTINCT")
+	for _, name := range analysis.Columns {
+		info := columns[name]
+		typ := string(info.Type)
+		if info.Format != "" {
+			typ += " (" + info.Format + ")"
+		}
+		approx := "~"
+		if analysis.Exact {
+			approx = ""
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%s%d\n", name, typ, info.NullRatio*100, approx, info.Distinct)
+	}
+	_ = tw.Flush()
+	if dialect, err := common.SniffFile(*csvPath); err == nil {
+		if sep != 0 {
+			dialect.Separator = sep
+		}
+		fmt.Printf("\nDialect: %v\n", dialect)
+		if !dialect.HasHeader {
+			fmt.Println("Warning: the first line looks like data rather than a header")
+		}
+	}
+	sampled := "all rows"
+	if !analysis.Exact {
+		sampled = fmt.Sprintf("%d of ~%d rows", analysis.SampledRows, analysis.EstimatedRows)
+	}
+	fmt.Printf("\nAnalyzed %s; saved to the schema of %s\n", sampled, filepath.Base(*csvPath))
+}
+
+// runValidate handles the validate command. It exits with status 1 when
+// the file has problems, so scripts can stop before indexing it.
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	clean := fs.String("clean", "", "Write a copy without the problem rows to this file")
+	maxIssues := fs.Int("max-issues", 100, "Problems to list (0 = all); all are counted")
+	asJSON := fs.Bool("json", false, "Output the report as JSON")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	sep, err := common.ParseSeparator(*separator)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := validate.File(*csvPath, validate.Options{Separator: sep, MaxIssues: *maxIssues, CleanPath: *clean})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, issue := range report.Issues {
+			fmt.Println(issue)
+		}
+		if listed := int64(len(report.Issues)); listed < report.Total() {
+			fmt.Printf("... %d more\n", report.Total()-listed)
+		}
+		fmt.Printf("\nChecked %d records (%d lines, %d columns, separator %s): ", report.Records, report.Lines, report.Columns, report.Separator)
+		if report.OK() {
+			fmt.Println("no problems")
+		} else {
+			fmt.Printf("%d problems\n", report.Total())
+			for _, kind := range []string{validate.KindRagged, validate.KindQuote, validate.KindUTF8, validate.KindHeader} {
+				if n := report.Counts[kind]; n > 0 {
+					fmt.Printf("  %-7s %d\n", kind, n)
+				}
+			}
+		}
+		if len(report.FieldCounts) > 1 {
+			counts := make([]int, 0, len(report.FieldCounts))
+			for n := range report.FieldCounts {
+				counts = append(counts, n)
+			}
+			sort.Ints(counts)
+			fmt.Println("Fields per record:")
+			for _, n := range counts {
+				fmt.Printf("  %-7d %d records\n", n, report.FieldCounts[n])
+			}
+		}
+		if report.Cleaned != "" {
+			fmt.Printf("Cleaned copy: %s (%d records dropped)\n", report.Cleaned, report.Dropped)
+		}
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// runWatch handles the watch command
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "CSV file to watch")
+	output := fs.String("output", "", "Output directory for indexes")
+	columns := fs.String("columns", "[]", "JSON array of columns to index")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers")
+	memoryMB := fs.Int("memory", 500, "Memory limit in MB per worker")
+	bloomFP := fs.Float64("bloom", 0.01, "Bloom filter false positive rate")
+	debounce := fs.Duration("debounce", 2*time.Second, "Wait this long after the last change before reindexing")
+	verbose := fs.Bool("verbose", false, "Show indexer output")
+	zoneColumn := fs.String("zone-column", "", "Record per-block numeric min/max of this column in every index")
+	codec := fs.String("codec", common.CodecLZ4, "Block compression: lz4, zstd (smaller) or none (fastest reads)")
+	partitions := fs.Int("partitions", 0, "Split each index into this many part files")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if *output == "" {
+		*output = getDir(*csvPath)
+	}
+
+	applyMemoryLimit(fs, memoryMB)
+
+	w, err := watch.New(watch.Config{
+		CsvPath:     *csvPath,
+		OutputDir:   *output,
+		Columns:     *columns,
+		Separator:   *separator,
+		Workers:     *workers,
+		MemoryMB:    *memoryMB,
+		BloomFPRate: *bloomFP,
+		Debounce:    *debounce,
+		Verbose:     *verbose,
+		Version:     Version,
+		ZoneColumn:  *zoneColumn,
+		Codec:       *codec,
+		Partitions:  *partitions,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cleanupFuncs = append(cleanupFuncs, func() {
+		_ = w.Close()
+	})
+
+	if err := w.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runWrite handles the write command
+func runWrite(args []string) {
+	fs := flag.NewFlagSet("write", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	headersJSON := fs.String("headers", "[]", "JSON array of headers (for new file)")
+	dataJSON := fs.String("data", "[]", "JSON array of rows (each row is array of strings); - reads it from stdin")
+	fromFile := fs.String("from-file", "", "CSV file of rows to append, header first (- = stdin)")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	flushRows := fs.Int("flush-rows", writer.DefaultFlushRows, "Rows written between flushes to the file")
+	dryRun := fs.Bool("dry-run", false, "Check the header and count the rows without writing")
+	deltas := fs.Bool("deltas", false, "Add the new rows to the index deltas, so queries find them through the indexes before the next build")
+	indexDir := fs.String("index-dir", "", "Directory containing index files (default: the CSV's)")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		os.Exit(1)
+	}
+	deltaDir := ""
+	if *deltas {
+		deltaDir = *indexDir
+		if deltaDir == "" {
+			deltaDir = getDir(*csvPath)
+		}
+	}
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "Write Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var headers []string
+	_ = json.Unmarshal([]byte(*headersJSON), &headers)
+
+	// Rows stream from stdin or a file; a --data argument is parsed whole
+	var rows writer.RowReader
+	switch {
+	case *fromFile != "":
+		in := os.Stdin
+		if *fromFile != "-" {
+			f, err := os.Open(*fromFile)
+			if err != nil {
+				fail(err)
+			}
+			defer func() { _ = f.Close() }()
+			in = f
+		}
+		fileHeaders, reader, err := writer.NewCSVRowReader(in)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", *fromFile, err))
+		}
+		headers, rows = fileHeaders, reader
+	case *dataJSON == "-":
+		rows = writer.NewJSONRowReader(os.Stdin)
+	default:
+		var data [][]string
+		_ = json.Unmarshal([]byte(*dataJSON), &data)
+		rows = &writer.SliceRows{Rows: data}
+	}
+
+	w := writer.NewCsvWriter(writer.WriterConfig{
+		CsvPath:   *csvPath,
+		Separator: *separator,
+		DryRun:    *dryRun,
+		DeltaDir:  deltaDir,
+		FlushRows: *flushRows,
+	})
+	n, err := w.WriteFrom(headers, rows)
+	if err != nil {
+		if n > 0 && !*dryRun {
+			fmt.Printf("Wrote %d rows to %s before the error\n", n, *csvPath)
+		}
+		fail(err)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: would append %d rows to %s\n", n, *csvPath)
+		return
+	}
+	fmt.Printf("Wrote %d rows to %s\n", n, *csvPath)
+}
+
+// runImport handles the import command: JSON objects appended as rows.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+
+	jsonPath := fs.String("json", "", "JSON array or NDJSON file of objects (- = stdin)")
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	columns := fs.String("columns", "", "Comma-separated keys to write, in order (default: the CSV's header, or every key of a new file)")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	dryRun := fs.Bool("dry-run", false, "Check the input and count the rows without writing")
+	deltas := fs.Bool("deltas", false, "Add the new rows to the index deltas, so queries find them through the indexes before the next build")
+	indexDir := fs.String("index-dir", "", "Directory containing index files (default: the CSV's)")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || *jsonPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --json and --csv are required")
+		os.Exit(1)
+	}
+	var cols []string
+	for _, col := range strings.Split(*columns, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			cols = append(cols, col)
+		}
+	}
+	deltaDir := ""
+	if *deltas {
+		deltaDir = *indexDir
+		if deltaDir == "" {
+			deltaDir = getDir(*csvPath)
+		}
+	}
+
+	in := os.Stdin
+	if *jsonPath != "-" {
+		f, err := os.Open(*jsonPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+
+	w := writer.NewCsvWriter(writer.WriterConfig{
+		CsvPath:   *csvPath,
+		Separator: *separator,
+		DryRun:    *dryRun,
+		DeltaDir:  deltaDir,
+	})
+	n, err := w.ImportJSON(in, cols)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: would append %d rows to %s\n", n, *csvPath)
+		return
+	}
+	fmt.Printf("Imported %d rows to %s\n", n, *csvPath)
+}
+
+// runUpdate handles the update command: row overrides in the CSV's update
+// sidecar for the rows a filter matches.
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	indexDir := fs.String("index-dir", "", "Directory containing index files (default: the CSV's)")
+	set := fs.String("set", "", `Columns to set: COL=VAL,COL2=VAL2 (COL="a, b" for commas) or a JSON object`)
+	where := fs.String("where", "", "Rows to update: COL=VAL or JSON conditions as for query")
+	dryRun := fs.Bool("dry-run", false, "Count the matching rows without updating them")
+	updatesLog := fs.Bool("updates-log", false, "Keep the updates in the binary update log (<csv>_updates.log) instead of _updates.json")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" || *set == "" || *where == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv, --set and --where are required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if *indexDir == "" {
+		*indexDir = getDir(*csvPath)
+	}
+
+	n, err := update.Execute(update.Config{
+		CsvPath:   *csvPath,
+		SetClause: *set,
+		WhereStr:  *where,
+		IndexDir:  *indexDir,
+		DryRun:    *dryRun,
+		Log:       *updatesLog,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(query.ExitCode(err))
+	}
+	if *dryRun {
+		fmt.Fprintln(os.Stderr, "Dry run: nothing updated")
+	}
+	fmt.Println(n) // The count alone, as the PHP bridge reads it
+}
+
+// runAlter handles the alter command: one schema change per run
+func runAlter(args []string) {
+	fs := flag.NewFlagSet("alter", flag.ExitOnError)
+
+	csvPath := fs.String("csv", "", "Path to CSV file")
+	addColumn := fs.String("add-column", "", "Add a column (virtual unless --materialize)")
+	defaultValue := fs.String("default", "", "Value of the added column, or the new default of --set-default")
+	materialize := fs.Bool("materialize", false, "Write the added column into the CSV (rewrites it)")
+	dropColumn := fs.String("drop-column", "", "Drop a column (a column of the CSV is rewritten without it)")
+	renameColumn := fs.String("rename-column", "", "Rename a column to --to (a column of the CSV rewrites its header)")
+	to := fs.String("to", "", "New name of --rename-column")
+	setDefault := fs.String("set-default", "", "Change the default of a virtual column to --default (or its --expr)")
+	expr := fs.String("expr", "", "Compute the added or --set-default column from its row, e.g. 'price * qty'")
+	separator := fs.String("separator", "", "CSV separator: a character or tab (default: detected)")
+	indexDir := fs.String("index-dir", "", "Directory containing index files (default: the CSV's)")
+	rebuild := fs.Bool("rebuild", true, "Rebuild the indexes a rewrite of the CSV invalidates (false: only drop them)")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of parallel workers for rebuilds")
+	memoryMB := fs.Int("memory", 500, "Memory limit in MB per worker for rebuilds")
+	verbose := fs.Bool("verbose", false, "Show indexer output")
+
+	_ = fs.Parse(args)
+
+	if *csvPath == "" {
+		fmt.Fprintln(os.Stderr, "Error: --csv is required")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	var out io.Writer = io.Discard
+	if *verbose {
+		out = os.Stdout
+	}
+	res, err := alter.NewAlterTable(alter.AlterConfig{
+		CsvPath:      *csvPath,
+		AddColumn:    *addColumn,
+		DefaultValue: *defaultValue,
+		Materialize:  *materialize,
+		Separator:    *separator,
+		DropColumn:   *dropColumn,
+		RenameColumn: *renameColumn,
+		NewName:      *to,
+		SetDefault:   *setDefault,
+		Expression:   *expr,
+		IndexDir:     *indexDir,
+		Rebuild:      *rebuild,
+		Workers:      *workers,
+		MemoryMB:     *memoryMB,
+		Version:      Version,
+		Output:       out,
+	}).Run()
+	if len(res.Dropped) > 0 {
+		fmt.Printf("Dropped indexes: %s\n", strings.Join(res.Dropped, ", "))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(res.Rebuilt) > 0 {
+		fmt.Printf("Rebuilt indexes: %s\n", strings.Join(res.Rebuilt, ", "))
+	}
+	if len(res.Translated) > 0 {
+		fmt.Printf("Translated indexes: %s\n", strings.Join(res.Translated, ", "))
+	}
+	if res.Rewritten {
+		fmt.Printf("Rewrote %s\n", *csvPath)
+	} else {
+		fmt.Println("Schema updated")
+	}
 }
@@ -412,8 +412,11 @@ class GoBridge
      */
     /**
      * Execute the Go binary.
+     *
+     * $stdin, if given, is written to the process before its output is
+     * read; commands taking it print little until they have read it all.
      */
-    private function execute(array $args, bool $passthrough = false): bool
+    private function execute(array $args, bool $passthrough = false, ?string $stdin = null): bool
     {
         $command = array_merge([$this->binaryPath], $args);
 
@@ -431,7 +434,14 @@ class GoBridge
             throw new \RuntimeException("Failed to start csvquery process");
         }
 
-        // Close stdin immediately as we don't write to it
+        if ($stdin !== null) {
+            for ($written = 0, $len = strlen($stdin); $written < $len; $written += $n) {
+                $n = fwrite($processPipes[0], substr($stdin, $written, 65536));
+                if ($n === false || $n === 0) {
+                    break; // Process exited early; its error is read below
+                }
+            }
+        }
         fclose($processPipes[0]);
 
         // Set streams to non-blocking mode for manuals polling loop
@@ -652,10 +662,11 @@ class GoBridge
      */
     public function write(string $csvPath, array $rows, array $headers = [], string $separator = ','): void
     {
+        // Rows go over stdin: large batches would exceed the argument size limit
         $args = [
             'write',
             '--csv', $csvPath,
-            '--data', json_encode($rows),
+            '--data', '-',
             '--separator', $separator
         ];
 
@@ -664,9 +675,7 @@ class GoBridge
             $args[] = json_encode($headers);
         }
 
-        // Execute via execute() (passthrough false)
-        // execute() implementation above handles array args
-        $this->execute($args);
+        $this->execute($args, false, json_encode($rows));
     }
     
     /**
@@ -123,10 +123,47 @@ class SocketClient
      */
     public function query(string $action, array $params = []): array
     {
-        $this->ensureConnected();
-
         $request = array_merge(['action' => $action], $params);
-        $json = json_encode($request);
+        $data = $this->exchange(json_encode($request));
+
+        if (!empty($data['error'])) {
+            throw new \RuntimeException('Daemon error: ' . $data['error']);
+        }
+
+        return $data;
+    }
+
+    /**
+     * Execute several requests in one round trip.
+     *
+     * Each request is an array with its 'action' and parameters. Responses
+     * come back in request order; a failed request's response carries its
+     * 'error' instead of throwing, so the others are still returned.
+     *
+     * @param array $requests List of requests
+     * @return array List of response data
+     * @throws \RuntimeException On communication error
+     */
+    public function batch(array $requests): array
+    {
+        if (empty($requests)) {
+            return [];
+        }
+
+        $data = $this->exchange(json_encode(array_values($requests)));
+        if (!array_is_list($data)) {
+            throw new \RuntimeException('Daemon error: ' . ($data['error'] ?? 'invalid batch response'));
+        }
+
+        return $data;
+    }
+
+    /**
+     * Send one request line and decode the response line.
+     */
+    private function exchange(string $json): array
+    {
+        $this->ensureConnected();
 
         if ($this->debug) {
             echo "[SocketClient] Request: $json\n";
@@ -164,14 +201,10 @@ class SocketClient
         }
 
         $data = json_decode(trim($response), true);
-        if ($data === null) {
+        if (!is_array($data)) {
             throw new \RuntimeException('Invalid JSON response: ' . $response);
         }
 
-        if (!empty($data['error'])) {
-            throw new \RuntimeException('Daemon error: ' . $data['error']);
-        }
-
         return $data;
     }
 
@@ -282,6 +315,33 @@ class SocketClient
         }
 
         stream_set_blocking($this->socket, true);
+
+        if (str_starts_with($address, 'tcp://') || str_starts_with($address, 'tls://')) {
+            $this->authenticate();
+        }
+    }
+
+    /**
+     * Authenticate a TCP connection with the token in CSVQUERY_AUTH_TOKEN
+     * (daemons without a token accept any).
+     */
+    private function authenticate(): void
+    {
+        $token = getenv('CSVQUERY_AUTH_TOKEN');
+        if (!$token) {
+            return;
+        }
+
+        @fwrite($this->socket, json_encode(['action' => 'auth', 'token' => trim($token)]) . "\n");
+        fflush($this->socket);
+        stream_set_timeout($this->socket, self::QUERY_TIMEOUT_SEC);
+        $response = @fgets($this->socket);
+        $data = $response === false ? null : json_decode(trim($response), true);
+        if (!is_array($data) || !empty($data['error'])) {
+            @fclose($this->socket);
+            $this->socket = null;
+            throw new \RuntimeException('Daemon authentication failed: ' . ($data['error'] ?? 'no response'));
+        }
     }
 
     /**
@@ -342,7 +402,7 @@ class SocketClient
      */
     private static function pathExists(string $address): bool
     {
-        if (str_starts_with($address, 'tcp://')) {
+        if (str_starts_with($address, 'tcp://') || str_starts_with($address, 'tls://')) {
             return true;
         }
 
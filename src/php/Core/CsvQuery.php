@@ -223,6 +223,11 @@ class CsvQuery
         } else {
             $name = strtolower($column);
         }
+        // Builds write <csv>_<name>.g<generation>.cidx and list it in the metadata
+        $file = $this->getMeta()['indexes'][$name]['file'] ?? null;
+        if (is_string($file) && $file !== '') {
+            return $this->indexDir . '/' . $file;
+        }
         return $this->indexDir . '/' . $csvFilename . '_' . $name . '.cidx';
     }
 
@@ -445,8 +450,12 @@ class CsvQuery
             return;
         }
 
+        $logPath = $this->csvPath . '_updates.log';
         $updatesPath = $this->csvPath . '_updates.json';
-        if (file_exists($updatesPath)) {
+        if (file_exists($logPath)) {
+            // The update log holds all updates when it exists
+            $this->overrides = $this->readUpdateLog($logPath);
+        } elseif (file_exists($updatesPath)) {
             $json = file_get_contents($updatesPath);
             $data = json_decode($json, true);
             if (is_array($data) && isset($data['rows'])) {
@@ -457,6 +466,44 @@ class CsvQuery
         $this->updatesLoaded = true;
     }
 
+    /**
+     * Read the row overrides of a binary update log: after an 8-byte magic,
+     * entries of op (1 = set, 2 = delete), offset, column and value lengths
+     * (big-endian u8, u64, u16, u32), column and value. Later entries win;
+     * a torn last entry is ignored.
+     *
+     * @param string $path Path to the _updates.log file
+     * @return array Map of [Offset => [Column => Value]]
+     */
+    private function readUpdateLog(string $path): array
+    {
+        $data = file_get_contents($path);
+        if ($data === false || strncmp($data, 'CQUPLOG1', 8) !== 0) {
+            return [];
+        }
+
+        $overrides = [];
+        $pos = 8;
+        $size = strlen($data);
+        while ($size - $pos >= 15) {
+            $entry = unpack('Cop/Joffset/ncolLen/NvalLen', $data, $pos);
+            $end = $pos + 15 + $entry['colLen'] + $entry['valLen'];
+            if ($end > $size) {
+                break;
+            }
+            $key = (string)$entry['offset'];
+            if ($entry['op'] === 1) {
+                $col = substr($data, $pos + 15, $entry['colLen']);
+                $overrides[$key][$col] = substr($data, $pos + 15 + $entry['colLen'], $entry['valLen']);
+            } elseif ($entry['op'] === 2) {
+                unset($overrides[$key]);
+            }
+            $pos = $end;
+        }
+
+        return $overrides;
+    }
+
     /**
      * Apply overrides to a row based on its offset.
      * 
@@ -922,6 +922,8 @@ class ActiveQuery
                         if ($this->evaluateCondition($condition[$i], $row)) return true;
                     }
                     return false;
+                case 'not':
+                    return !$this->evaluateCondition($condition[1] ?? [], $row);
                 case '=':
                     return isset($row[$condition[1]]) && $row[$condition[1]] == $condition[2];
                 case '>':
@@ -947,13 +949,40 @@ class ActiveQuery
                     return !isset($row[$condition[1]]) || $row[$condition[1]] != $condition[2];
                 case 'like':
                     if (!isset($row[$condition[1]])) return false;
-                    $pattern = str_replace(['%', '_'], ['.*', '.'], preg_quote((string)$condition[2], '/'));
-                    return (bool)preg_match('/^' . $pattern . '$/i', (string)$row[$condition[1]]);
+                    return (bool)preg_match($this->likeToRegex((string)$condition[2]), (string)$row[$condition[1]]);
+                case 'between':
+                    return isset($row[$condition[1]]) && $row[$condition[1]] >= $condition[2] && $row[$condition[1]] <= $condition[3];
+                case 'regexp':
+                    if (!isset($row[$condition[1]])) return false;
+                    return (bool)preg_match('~' . str_replace('~', '\~', (string)$condition[2]) . '~u', (string)$row[$condition[1]]);
             }
         }
         return true;
     }
 
+    /**
+     * Converts a SQL LIKE pattern (% and _ wildcards, \ escapes) into a
+     * case-insensitive regular expression, matching the Go engine.
+     */
+    private function likeToRegex(string $pattern): string
+    {
+        $regex = '';
+        $len = strlen($pattern);
+        for ($i = 0; $i < $len; $i++) {
+            $c = $pattern[$i];
+            if ($c === '\\' && $i + 1 < $len) {
+                $regex .= preg_quote($pattern[++$i], '/');
+            } elseif ($c === '%') {
+                $regex .= '.*';
+            } elseif ($c === '_') {
+                $regex .= '.';
+            } else {
+                $regex .= preg_quote($c, '/');
+            }
+        }
+        return '/^' . $regex . '$/isu';
+    }
+
     private function formatWhereForGo($condition): array
     {
         if (empty($condition)) {
@@ -1024,23 +1053,16 @@ class ActiveQuery
             ];
         }
 
-        // Handle NOT (special case, maybe transform common patterns or defer)
-        // Go engine doesn't have partial logical NOT support yet.
-        // Support specific NOT like ['not', ['=', col, val]] -> ['!=', col, val]
+        // NOT wraps one condition; the engine pushes it down (De Morgan)
         if ($op === 'NOT') {
-            if (isset($condition[1])) {
-                 $child = $condition[1];
-                 // Check if child is simple operator
-                 if (is_array($child) && isset($child[0])) {
-                     $childOp = strtoupper((string)$child[0]);
-                     if ($childOp === '=') return ['operator' => '!=', 'column' => $child[1], 'value' => $child[2]];
-                     if ($childOp === 'IN') return ['operator' => 'NOT IN', 'column' => $child[1], 'value' => $child[2]]; // Not IN not supported in Go yet?
-                     // For 'IS NULL' -> 'IS NOT NULL'
-                     // But usually users write ['is not', col, null]
-                 }
+            $child = $this->buildFilterTree($condition[1] ?? null);
+            if (empty($child)) {
+                return [];
             }
-            // Fallback: Ignored or Error? For now ignore or risk partial results
-            return [];
+            return [
+                'operator' => 'NOT',
+                'children' => [$child]
+            ];
         }
 
         // Comparison Operators
@@ -1056,6 +1078,8 @@ class ActiveQuery
             '>=' => ['operator' => '>=', 'column' => $col, 'value' => $val],
             '<=' => ['operator' => '<=', 'column' => $col, 'value' => $val],
             'LIKE' => ['operator' => 'LIKE', 'column' => $col, 'value' => $val],
+            'REGEXP' => ['operator' => 'REGEXP', 'column' => $col, 'value' => $val],
+            'BETWEEN' => ['operator' => 'BETWEEN', 'column' => $col, 'value' => [$val, $condition[3] ?? null]],
             'IS' => ($val === null) ? ['operator' => 'IS NULL', 'column' => $col] : ['operator' => '=', 'column' => $col, 'value' => $val],
             'IS NOT' => ($val === null) ? ['operator' => 'IS NOT NULL', 'column' => $col] : ['operator' => '!=', 'column' => $col, 'value' => $val],
             default => [] // Unknown operator
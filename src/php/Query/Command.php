@@ -90,6 +90,8 @@ class Command
                         $parts[] = '(' . $this->buildWhere($operand) . ')';
                     }
                     return implode(" {$operator} ", $parts);
+                case 'NOT':
+                    return 'NOT (' . $this->buildWhere($condition[0] ?? []) . ')';
                 case '=':
                 case '>':
                 case '<':
@@ -97,6 +99,7 @@ class Command
                 case '<=':
                 case '!=':
                 case 'LIKE':
+                case 'REGEXP':
                 case 'IS':
                 case 'IS NOT':
                     return "`{$condition[0]}` {$operator} " . $this->quoteValue($condition[1]);